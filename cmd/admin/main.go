@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -10,10 +11,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/ardanlabs/conf"
 	"github.com/pkg/errors"
+	"gorm.io/gorm"
 
+	"github.com/noelruault/golang-authentication/internal/models"
 	"github.com/noelruault/golang-authentication/internal/schema"
 )
 
@@ -81,9 +86,11 @@ func run() error {
 		}
 	case "cleanup":
 		schema.CleanupDatabase(db)
+	case "flags":
+		err = setFeatureFlags(db, cfg.Args.Num(1), cfg.Args[2:])
 
 	default:
-		err = errors.New("Must specify a command. e.g: <migrate>, <cleanup>")
+		err = errors.New("Must specify a command. e.g: <migrate>, <cleanup>, <flags>")
 	}
 
 	if err != nil {
@@ -93,6 +100,33 @@ func run() error {
 	return nil
 }
 
+// setFeatureFlags sets the feature flags of the user with ID userID, given as name=true or name=false.
+func setFeatureFlags(db *gorm.DB, userID string, args []string) error {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil || len(args) == 0 {
+		return errors.New("usage: flags <user_id> <name>=<true|false>...")
+	}
+
+	flags := models.FeatureFlags{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("flag %q is not in the name=value form", arg)
+		}
+
+		on, err := strconv.ParseBool(kv[1])
+		if err != nil {
+			return errors.Wrapf(err, "parsing flag %q", kv[0])
+		}
+		flags[kv[0]] = on
+	}
+
+	// no tokens are issued, so the service needs no secret.
+	us := models.NewUserService(db, nil, models.Config{})
+
+	return errors.Wrap(us.SetFeatureFlags(context.Background(), id, flags), "setting feature flags")
+}
+
 // keygen creates an x509 private key for signing auth tokens.
 func keygen(path string) error {
 	if path == "" {
@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	_ "expvar" // Register the expvar handlers
 	"fmt"
 	"log"
@@ -9,6 +13,7 @@ import (
 	_ "net/http/pprof" // Register the pprof handlers
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,6 +27,9 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/noelruault/golang-authentication/internal/handlers"
+	"github.com/noelruault/golang-authentication/internal/middleware"
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
 )
 
 const logServiceName = "GOLANG-AUTHENTICATION-SERVICE"
@@ -30,6 +38,175 @@ var cfg struct {
 	Services struct {
 		// JWTSecret is used to sign the JWT tokens used to identify users.
 		JWTSecret []byte
+		// SigningAlgorithm is HS512, signing the tokens with JWTSecret, ES256 or EdDSA, signing them with the
+		// PKCS #8 private key in the PEM file SigningKeyFile, whose public key is published at /oauth/jwks/.
+		SigningAlgorithm string `conf:"default:HS512"`
+		SigningKeyFile   string
+		// Issuer is the URL clients reach the service at, issuing the ID tokens and serving the OpenID
+		// Connect discovery document at /.well-known/openid-configuration. Empty disables the document.
+		Issuer string
+		// AccessTokenGrace is how long an expired access token is still accepted while the client refreshes.
+		AccessTokenGrace time.Duration `conf:"default:0s"`
+		// FormClientCredentials gives the client credentials form fields precedence over HTTP Basic credentials.
+		FormClientCredentials bool `conf:"default:false"`
+		// ClockSkew is the tolerance allowed when comparing token times with the current time.
+		ClockSkew time.Duration `conf:"default:1m"`
+		// ConsentTTL is how long users' approval of a scope lasts before they are prompted again.
+		ConsentTTL time.Duration `conf:"default:0s"`
+		// ScopeConsentTTL are "scope=duration" pairs, separated by semicolons, overriding ConsentTTL for those scopes.
+		ScopeConsentTTL []string
+		// ScopeTokenTTL are "scope=duration" pairs, separated by semicolons, capping the lifetime of the access tokens granting those scopes.
+		ScopeTokenTTL []string
+		// MaxRefreshRotations is how many times a login's refresh tokens can be exchanged. Zero is unlimited.
+		MaxRefreshRotations int `conf:"default:0"`
+		// RefreshScopeReauth grants narrower scopes on refresh, and requires a fresh login for broader ones.
+		RefreshScopeReauth bool `conf:"default:false"`
+		// MaxSessionLifetime is how long a session lasts from the login however it is refreshed. Zero is unlimited.
+		MaxSessionLifetime time.Duration `conf:"default:0s"`
+		// RefreshIdempotencyWindow is how long a retried refresh gets the tokens already issued. Zero disables it.
+		RefreshIdempotencyWindow time.Duration `conf:"default:0s"`
+		// RefreshIdempotencyRecheck checks the refresh token again before returning the tokens already issued.
+		RefreshIdempotencyRecheck bool `conf:"default:true"`
+		// UserCacheTTL is how long users looked up when validating tokens are cached. Zero disables the cache.
+		UserCacheTTL time.Duration `conf:"default:0s"`
+		// DeleteUserData removes the MFA devices, security answers, API keys and grants of the users deleted.
+		DeleteUserData bool `conf:"default:false"`
+		// AuditBatchSize is the number of audit events written together. Values lower than two disable batching.
+		AuditBatchSize int `conf:"default:100"`
+		// AuditFlushInterval is the maximum time buffered audit events wait before being written.
+		AuditFlushInterval time.Duration `conf:"default:1s"`
+		// AuditMaxEvents and AuditMaxAge bound the audit events kept per user, pruned every AuditPruneInterval.
+		// Zero keeps any number or age, and never prunes. The events with the AuditExemptActions are never pruned.
+		AuditMaxEvents     int           `conf:"default:0"`
+		AuditMaxAge        time.Duration `conf:"default:0s"`
+		AuditExemptActions []string
+		AuditPruneInterval time.Duration `conf:"default:0s"`
+		// MaxAPIKeys is the maximum number of active API keys per user. Zero is unlimited.
+		MaxAPIKeys int `conf:"default:10"`
+		// CheckBreachedPasswords rejects passwords found in the Have I Been Pwned database.
+		CheckBreachedPasswords bool `conf:"default:false"`
+		// PasswordRequireDigit rejects passwords without any digit.
+		PasswordRequireDigit bool `conf:"default:false"`
+		// PasswordCost is the bcrypt cost the passwords are hashed with.
+		PasswordCost int `conf:"default:12"`
+		// DenyDisposableEmails rejects signups from disposable email services, listed one per line in
+		// DisposableEmailsFile, or in the list embedded in the service when no file is set.
+		DenyDisposableEmails bool `conf:"default:false"`
+		DisposableEmailsFile string
+		// CanonicalGmail treats Gmail addresses differing only in dots or "+tag" suffixes as the same
+		// address when checking emails are unique. PlusAddressDomains lists other domains whose "+tag"
+		// suffixes are ignored.
+		CanonicalGmail     bool `conf:"default:false"`
+		PlusAddressDomains []string
+		// MFAMaxAttempts is the number of failed MFA codes after which the MFA step is locked for MFALockout.
+		MFAMaxAttempts int           `conf:"default:5"`
+		MFALockout     time.Duration `conf:"default:15m"`
+		// MFAMinSecretBytes is the minimum length of the TOTP secrets enrolled, once base32 decoded.
+		MFAMinSecretBytes int `conf:"default:16"`
+		// MaxMFADevices caps the MFA devices of a user. MFARequired prevents users from removing the last one.
+		MaxMFADevices int  `conf:"default:5"`
+		MFARequired   bool `conf:"default:false"`
+		// MFATrustDuration is how long a device trusted after the MFA step skips it. Zero disables trust.
+		MFATrustDuration time.Duration `conf:"default:720h"`
+		// OTPSendInterval is the minimum time between the codes sent to a user by email or SMS. Zero disables it.
+		OTPSendInterval time.Duration `conf:"default:30s"`
+		// RecoveryQuestions is the number of security questions needed to recover an account. Zero only needs the email.
+		RecoveryQuestions int `conf:"default:2"`
+		// RecoveryMaxAttempts is the number of wrong answers locking account recovery for RecoveryLockout.
+		RecoveryMaxAttempts int           `conf:"default:3"`
+		RecoveryLockout     time.Duration `conf:"default:24h"`
+		// EnumerationSafe makes logins, signups and password resets respond alike for existing and missing accounts.
+		EnumerationSafe bool `conf:"default:false"`
+		// SignupEmailDomains restricts signups to these email domains, "*.example.com" allowing subdomains. Empty allows any.
+		SignupEmailDomains []string
+		// ResetAutoLogin returns new tokens after a password reset instead of requiring a fresh login.
+		ResetAutoLogin bool `conf:"default:false"`
+		// MaxResetTokens is the maximum number of valid password reset tokens per user. Zero is unlimited.
+		MaxResetTokens int `conf:"default:3"`
+		// ActionTokenMaxAge are "purpose=duration" pairs, separated by semicolons, capping the age of the
+		// verification, reset, magic_link and recovery tokens, already sent ones included.
+		ActionTokenMaxAge []string
+		// GlobalFailureRate is the share of failed logins over which every login is slowed down. Zero disables it.
+		GlobalFailureRate        float64       `conf:"default:0"`
+		GlobalFailureWindow      time.Duration `conf:"default:1m"`
+		GlobalFailureMinAttempts int           `conf:"default:100"`
+		GlobalFrictionDelay      time.Duration `conf:"default:1s"`
+		// MaxConcurrentLogins is how many logins of the same user are processed at once. Zero is unlimited.
+		MaxConcurrentLogins int `conf:"default:0"`
+		// CaptchaVerifyURL and CaptchaSecret configure the siteverify API used to check CAPTCHA solutions.
+		// An empty secret disables the CAPTCHA checks.
+		CaptchaVerifyURL string `conf:"default:https://www.google.com/recaptcha/api/siteverify"`
+		CaptchaSecret    string `conf:"noprint"`
+		// SignupCaptchaThreshold is the number of failed signups from an IP after which a CAPTCHA is required.
+		SignupCaptchaThreshold int           `conf:"default:5"`
+		SignupFailureWindow    time.Duration `conf:"default:1h"`
+		// MaxSignupsPerIP is the number of users that can be created from an IP within SignupWindow. Zero is unlimited.
+		MaxSignupsPerIP int           `conf:"default:0"`
+		SignupWindow    time.Duration `conf:"default:1h"`
+		// DisableSignups rejects the creation of users through the API. As emails are not verified, open
+		// signups fail the ConfigCheck unless UnverifiedSignups accepts them.
+		DisableSignups    bool `conf:"default:false"`
+		UnverifiedSignups bool `conf:"default:true"`
+		// RejectDuplicateParams rejects token requests repeating a parameter such as grant_type or scope.
+		RejectDuplicateParams bool `conf:"default:true"`
+		// MaxRequestedScopes is the maximum number of scopes a grant request can ask for. Zero is unlimited.
+		MaxRequestedScopes int `conf:"default:20"`
+		// KnownScopes lists the scopes that can be requested, separated by semicolons. Empty accepts any scope.
+		KnownScopes []string
+		// GrantScopes are "grant_type=scope scope" pairs, separated by semicolons, restricting the scopes each grant type can request.
+		GrantScopes []string
+		// TokenGrants includes the granted scopes and the user roles in the token responses of the logins.
+		TokenGrants bool `conf:"default:false"`
+		// TokenScope includes the granted scope in the token responses of the logins not granted the requested one.
+		TokenScope bool `conf:"default:false"`
+		// PrincipalType includes the kind of principal, such as user, in the responses of /me and the token info.
+		PrincipalType bool `conf:"default:false"`
+		// IDTokens issues OpenID Connect ID tokens to the logins granted the openid scope.
+		IDTokens bool `conf:"default:false"`
+		// AuthMethods includes the acr and amr claims in the ID tokens, telling how the users logged in. The acr
+		// is SingleFactorClass or MultiFactorClass, depending on whether the login completed a second factor.
+		AuthMethods       bool `conf:"default:false"`
+		SingleFactorClass string
+		MultiFactorClass  string
+		// SilentAuth honours prompt=none, only continuing active sessions without involving the user.
+		SilentAuth bool `conf:"default:false"`
+		// EnforceMaxAge honours max_age on refresh, requiring a fresh login for older sessions.
+		EnforceMaxAge bool `conf:"default:false"`
+		// StandardErrors responds OAuth 2.0 errors, such as invalid_grant, from the token, device and logout endpoints.
+		StandardErrors bool `conf:"default:false"`
+		// ErrorURI is the start of the error_uri of the OAuth 2.0 errors, followed by the error code. Empty sends none.
+		ErrorURI string
+		// TokenFeatureFlags includes the features enabled for the users in their access tokens.
+		TokenFeatureFlags bool `conf:"default:false"`
+		// TokenIDInResponse sends the jti of the access tokens in the token responses.
+		TokenIDInResponse bool `conf:"default:false"`
+		// ConfigCheck refuses to start when the service settings are invalid or dangerous.
+		ConfigCheck bool `conf:"default:true"`
+		// ClientRegistration enables dynamic client registration, requiring RegistrationToken when set.
+		ClientRegistration bool   `conf:"default:false"`
+		RegistrationToken  string `conf:"noprint"`
+		// SecretRotationOverlap is how long a client secret is still accepted once the client rotates it.
+		SecretRotationOverlap time.Duration `conf:"default:24h"`
+		// DeviceVerificationURI is the page where users approve devices. Empty disables the device grant.
+		DeviceVerificationURI string
+		// DevicePollInterval is the minimum time between polls of a device, which get slow_down when faster.
+		DevicePollInterval time.Duration `conf:"default:5s"`
+		// MaxDeviceCodes caps the outstanding device codes per client. Zero is unlimited.
+		MaxDeviceCodes int `conf:"default:20"`
+		// DistinctTokenErrors reports expired access tokens as token_expired and other rejected ones as invalid_token.
+		DistinctTokenErrors bool `conf:"default:false"`
+		// RejectDisabledClients rejects the tokens issued through clients disabled or deleted since.
+		RejectDisabledClients bool `conf:"default:false"`
+		// BackchannelLogout notifies the clients registering a back-channel logout URI when users log out.
+		BackchannelLogout bool `conf:"default:false"`
+		// StoreFailurePolicy is either fail_closed or fail_open, deciding whether access tokens are accepted
+		// for StoreFailOpenWindow when the database cannot be read to validate them.
+		StoreFailurePolicy  string        `conf:"default:fail_closed"`
+		StoreFailOpenWindow time.Duration `conf:"default:1m"`
+		// StoreBreakerThreshold is the number of consecutive database failures after which user and token
+		// lookups fail fast with service_unavailable for StoreBreakerCooldown. Zero disables the breaker.
+		StoreBreakerThreshold int           `conf:"default:5"`
+		StoreBreakerCooldown  time.Duration `conf:"default:30s"`
 	}
 	Web struct {
 		Address         string        `conf:"default:0.0.0.0:8080"`
@@ -37,6 +214,54 @@ var cfg struct {
 		ReadTimeout     time.Duration `conf:"default:5s"`
 		WriteTimeout    time.Duration `conf:"default:5s"`
 		ShutdownTimeout time.Duration `conf:"default:5s"`
+		// BodyReadTimeout is the maximum time taken to receive the body of signup and token requests.
+		BodyReadTimeout time.Duration `conf:"default:2s"`
+		// Maintenance rejects signups, updates and token requests with a 503 while reads keep working.
+		Maintenance           bool          `conf:"default:false"`
+		MaintenanceRetryAfter time.Duration `conf:"default:5m"`
+		// MaxURLLength is the maximum length of the request URLs, rejected with a 414 when longer. Zero disables it.
+		MaxURLLength int `conf:"default:8192"`
+		// MaxJSONDepth and MaxJSONTokens limit the nesting and size of the JSON request bodies. Zero disables them.
+		MaxJSONDepth  int `conf:"default:32"`
+		MaxJSONTokens int `conf:"default:10000"`
+		// TokenCacheControl is the Cache-Control header of the token responses, always sent with Pragma: no-cache.
+		TokenCacheControl string `conf:"default:no-store"`
+		// DevMode includes development aids, such as error cause chains, in the API responses.
+		DevMode bool `conf:"default:false"`
+		// Envelope nests successful API responses under "data", with request metadata under "meta".
+		Envelope bool `conf:"default:false"`
+		// NextActions are "code=action" pairs hinting clients what to do next on the errors with those codes.
+		NextActions []string
+		// JSONCharset is the charset of the JSON responses Content-Type, "-" sending none.
+		JSONCharset string `conf:"default:utf-8"`
+		// FieldsArray sends the fields of validation errors as an array of {field, code} objects instead of a map.
+		FieldsArray bool `conf:"default:false"`
+		// LimitScopes tells in the rate limiting errors which limit was hit, such as per IP or per user.
+		LimitScopes bool `conf:"default:false"`
+		// ErrorIDs sends a random ID with each error response, and logs it along with the request.
+		ErrorIDs bool `conf:"default:false"`
+		// DrainPeriod is how long new requests get a 503 before the server shuts down, so load balancers
+		// stop routing to it. DrainRetryAfter is sent with them as the time to wait before retrying.
+		DrainPeriod     time.Duration `conf:"default:0s"`
+		DrainRetryAfter time.Duration `conf:"default:5s"`
+		// MessagesFile is a JSON file of the error messages sent to clients, by language and error code.
+		MessagesFile string
+		// MaxAuthHeaderSize is the maximum length in bytes of the Authorization header. Zero disables the limit.
+		MaxAuthHeaderSize int `conf:"default:4096"`
+		// RedactLogs removes tokens and secrets from the logs. It should only be disabled to debug locally.
+		RedactLogs bool `conf:"default:true"`
+		// AuthCookie is the name of the cookie accepted as an alternative to the Authorization header. Empty disables it.
+		AuthCookie string
+		// PreferAuthCookie gives the cookie precedence over the Authorization header when both are sent.
+		PreferAuthCookie bool `conf:"default:false"`
+		// QuietPaths are logged at debug level, so health checks do not flood the logs. DebugLogs logs them.
+		QuietPaths []string `conf:"default:/;/health/;/api/;/api/health/"`
+		DebugLogs  bool     `conf:"default:false"`
+		// Compress gzips the responses of CompressTypes, except CompressSkipTypes, at CompressLevel (1-9).
+		Compress          bool     `conf:"default:true"`
+		CompressLevel     int      `conf:"default:6"`
+		CompressTypes     []string `conf:"default:application/json;application/cbor;text/*"`
+		CompressSkipTypes []string `conf:"default:image/*;video/*;audio/*;application/zip;application/gzip"`
 	}
 	Database struct {
 		User     string `conf:"default:goauthsvc"`
@@ -47,6 +272,13 @@ var cfg struct {
 		SSLMode  string `conf:"default:disable"`
 		Timezone string `conf:"default:Europe/London"`
 	}
+	Redis struct {
+		// Addr is the Redis server keeping the short-lived state of multi-request flows, shared by all the
+		// instances. Empty keeps the state in memory, which only works with a single instance.
+		Addr     string
+		Password string `conf:"noprint"`
+		Prefix   string `conf:"default:goauthsvc:"`
+	}
 	Trace struct {
 		URL     string `conf:"default:http://0.0.0.0:9411/api/v2/spans"`
 		Service string `conf:"default:golang-authentication-service"`
@@ -79,6 +311,10 @@ func run() error {
 		return fmt.Errorf("parsing config: %w", err)
 	}
 
+	if cfg.Web.RedactLogs {
+		log.SetOutput(middleware.RedactWriter(os.Stdout))
+	}
+
 	log.Printf("main : Started")
 	defer log.Println("main : Completed")
 
@@ -137,9 +373,30 @@ func run() error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
+	apiCfg, err := apiConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.Services.ConfigCheck {
+		if err := apiCfg.Validate(); err != nil {
+			return fmt.Errorf("checking configuration: %w", err)
+		}
+	}
+
+	// The audit service buffers events, so it is closed once the server stops handling requests to
+	// write the pending ones. This includes shutdowns requested through web.NewShutdownError.
+	audit := models.NewAuditService(db, apiCfg.Users)
+	defer func() {
+		if err := audit.Close(context.Background()); err != nil {
+			log.Printf("main : Audit events could not be written on shutdown : %v", err)
+		}
+	}()
+	apiCfg.Users.Audit = audit
+
+	app := handlers.API(shutdown, log, db, audit, apiCfg)
 	api := http.Server{
 		Addr:         cfg.Web.Address,
-		Handler:      handlers.API(shutdown, log, db, cfg.Services.JWTSecret),
+		Handler:      app,
 		ReadTimeout:  cfg.Web.ReadTimeout,
 		WriteTimeout: cfg.Web.WriteTimeout,
 	}
@@ -165,6 +422,11 @@ func run() error {
 	case sig := <-shutdown:
 		log.Printf("main : %v : Start shutdown", sig)
 
+		// New requests are turned away while the ones in flight complete, for the drain period if any,
+		// so clients retry against other instances.
+		app.Drain()
+		time.Sleep(cfg.Web.DrainPeriod)
+
 		// Give outstanding requests a deadline for completion.
 		ctx, cancel := context.WithTimeout(context.Background(), cfg.Web.ShutdownTimeout)
 		defer cancel()
@@ -188,6 +450,260 @@ func run() error {
 	return nil
 }
 
+// apiConfig returns the settings of the API, built from the parsed configuration.
+func apiConfig() (handlers.Config, error) {
+	grantScopes := make(map[string][]string, len(cfg.Services.GrantScopes))
+	for _, gs := range cfg.Services.GrantScopes {
+		kv := strings.SplitN(gs, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return handlers.Config{}, fmt.Errorf("grant scopes %q are not in the grant_type=scopes form", gs)
+		}
+		grantScopes[kv[0]] = strings.Fields(kv[1])
+	}
+
+	scopeConsentTTL, err := durationPairs("scope consent TTL", "scope", cfg.Services.ScopeConsentTTL)
+	if err != nil {
+		return handlers.Config{}, err
+	}
+
+	scopeTokenTTL, err := durationPairs("scope token TTL", "scope", cfg.Services.ScopeTokenTTL)
+	if err != nil {
+		return handlers.Config{}, err
+	}
+
+	actionTokenMaxAge, err := durationPairs("action token max age", "purpose", cfg.Services.ActionTokenMaxAge)
+	if err != nil {
+		return handlers.Config{}, err
+	}
+
+	nextActions := make(map[string]string, len(cfg.Web.NextActions))
+	for _, na := range cfg.Web.NextActions {
+		kv := strings.SplitN(na, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return handlers.Config{}, fmt.Errorf("next action %q is not in the code=action form", na)
+		}
+		nextActions[kv[0]] = kv[1]
+	}
+
+	var messages map[string]map[string]string
+	if cfg.Web.MessagesFile != "" {
+		b, err := os.ReadFile(cfg.Web.MessagesFile)
+		if err != nil {
+			return handlers.Config{}, fmt.Errorf("reading messages file: %w", err)
+		}
+		if err := json.Unmarshal(b, &messages); err != nil {
+			return handlers.Config{}, fmt.Errorf("parsing messages file: %w", err)
+		}
+	}
+
+	apiCfg := handlers.Config{
+		JWTSecret: cfg.Services.JWTSecret,
+		Web: web.Config{
+			DevMode:         cfg.Web.DevMode,
+			Envelope:        cfg.Web.Envelope,
+			NextActions:     nextActions,
+			Messages:        messages,
+			JSONCharset:     cfg.Web.JSONCharset,
+			FieldsArray:     cfg.Web.FieldsArray,
+			LimitScopes:     cfg.Web.LimitScopes,
+			ErrorIDs:        cfg.Web.ErrorIDs,
+			DrainRetryAfter: cfg.Web.DrainRetryAfter,
+		},
+		Auth: middleware.AuthConfig{
+			MaxHeaderSize: cfg.Web.MaxAuthHeaderSize,
+			Cookie:        cfg.Web.AuthCookie,
+			PreferCookie:  cfg.Web.PreferAuthCookie,
+		},
+		Log: middleware.LogConfig{
+			Debug:      cfg.Web.DebugLogs,
+			PathLevels: make(map[string]middleware.LogLevel),
+		},
+		Compress: middleware.CompressConfig{
+			Enabled:   cfg.Web.Compress,
+			Level:     cfg.Web.CompressLevel,
+			Types:     cfg.Web.CompressTypes,
+			SkipTypes: cfg.Web.CompressSkipTypes,
+		},
+		OAuth: handlers.OAuthConfig{
+			FormClientCredentials: cfg.Services.FormClientCredentials,
+			EnumerationSafe:       cfg.Services.EnumerationSafe,
+			MaxRequestedScopes:    cfg.Services.MaxRequestedScopes,
+			RejectDuplicateParams: cfg.Services.RejectDuplicateParams,
+			KnownScopes:           cfg.Services.KnownScopes,
+			GrantScopes:           grantScopes,
+			TokenGrants:           cfg.Services.TokenGrants,
+			TokenScope:            cfg.Services.TokenScope,
+			PrincipalType:         cfg.Services.PrincipalType,
+			IDTokens:              cfg.Services.IDTokens,
+			AuthMethods:           cfg.Services.AuthMethods,
+			SingleFactorClass:     cfg.Services.SingleFactorClass,
+			MultiFactorClass:      cfg.Services.MultiFactorClass,
+			SilentAuth:            cfg.Services.SilentAuth,
+			EnforceMaxAge:         cfg.Services.EnforceMaxAge,
+			StandardErrors:        cfg.Services.StandardErrors,
+			ErrorURI:              cfg.Services.ErrorURI,
+
+			SignupCaptchaThreshold: cfg.Services.SignupCaptchaThreshold,
+			SignupFailureWindow:    cfg.Services.SignupFailureWindow,
+			MaxSignupsPerIP:        cfg.Services.MaxSignupsPerIP,
+			SignupWindow:           cfg.Services.SignupWindow,
+			DisableSignups:         cfg.Services.DisableSignups,
+			UnverifiedSignups:      cfg.Services.UnverifiedSignups,
+
+			ClientRegistration: cfg.Services.ClientRegistration,
+			RegistrationToken:  cfg.Services.RegistrationToken,
+
+			SecretRotationOverlap: cfg.Services.SecretRotationOverlap,
+
+			DeviceVerificationURI: cfg.Services.DeviceVerificationURI,
+		},
+		Users: models.Config{
+			AccessTokenGrace:          cfg.Services.AccessTokenGrace,
+			Issuer:                    cfg.Services.Issuer,
+			PasswordRequireDigit:      cfg.Services.PasswordRequireDigit,
+			PasswordCost:              cfg.Services.PasswordCost,
+			ClockSkew:                 cfg.Services.ClockSkew,
+			ConsentTTL:                cfg.Services.ConsentTTL,
+			ScopeConsentTTL:           scopeConsentTTL,
+			ScopeTokenTTL:             scopeTokenTTL,
+			ActionTokenMaxAge:         actionTokenMaxAge,
+			MaxRefreshRotations:       cfg.Services.MaxRefreshRotations,
+			RefreshScopeReauth:        cfg.Services.RefreshScopeReauth,
+			MaxSessionLifetime:        cfg.Services.MaxSessionLifetime,
+			RefreshIdempotencyWindow:  cfg.Services.RefreshIdempotencyWindow,
+			RefreshIdempotencyRecheck: cfg.Services.RefreshIdempotencyRecheck,
+			UserCacheTTL:              cfg.Services.UserCacheTTL,
+			DeleteUserData:            cfg.Services.DeleteUserData,
+			AuditBatchSize:            cfg.Services.AuditBatchSize,
+			AuditFlushInterval:        cfg.Services.AuditFlushInterval,
+			MaxAPIKeys:                cfg.Services.MaxAPIKeys,
+			MFAMaxAttempts:            cfg.Services.MFAMaxAttempts,
+			MFALockout:                cfg.Services.MFALockout,
+			EnumerationSafe:           cfg.Services.EnumerationSafe,
+			TokenFeatureFlags:         cfg.Services.TokenFeatureFlags,
+			TokenIDInResponse:         cfg.Services.TokenIDInResponse,
+			SignupEmailDomains:        cfg.Services.SignupEmailDomains,
+			MaxActionTokens:           map[string]int{models.PurposeReset: cfg.Services.MaxResetTokens},
+			ResetAutoLogin:            cfg.Services.ResetAutoLogin,
+			DistinctTokenErrors:       cfg.Services.DistinctTokenErrors,
+			RejectDisabledClients:     cfg.Services.RejectDisabledClients,
+			StoreFailurePolicy:        cfg.Services.StoreFailurePolicy,
+			StoreFailOpenWindow:       cfg.Services.StoreFailOpenWindow,
+
+			AuditRetention: models.AuditRetention{
+				MaxEvents: cfg.Services.AuditMaxEvents,
+				MaxAge:    cfg.Services.AuditMaxAge,
+				Exempt:    cfg.Services.AuditExemptActions,
+			},
+			AuditPruneInterval: cfg.Services.AuditPruneInterval,
+
+			StoreBreakerThreshold: cfg.Services.StoreBreakerThreshold,
+			StoreBreakerCooldown:  cfg.Services.StoreBreakerCooldown,
+
+			GlobalFailureRate:        cfg.Services.GlobalFailureRate,
+			GlobalFailureWindow:      cfg.Services.GlobalFailureWindow,
+			GlobalFailureMinAttempts: cfg.Services.GlobalFailureMinAttempts,
+			GlobalFrictionDelay:      cfg.Services.GlobalFrictionDelay,
+			MaxConcurrentLogins:      cfg.Services.MaxConcurrentLogins,
+
+			DevicePollInterval: cfg.Services.DevicePollInterval,
+			MaxDeviceCodes:     cfg.Services.MaxDeviceCodes,
+
+			MFAMinSecretBytes: cfg.Services.MFAMinSecretBytes,
+			MaxMFADevices:     cfg.Services.MaxMFADevices,
+			MFARequired:       cfg.Services.MFARequired,
+			MFATrustDuration:  cfg.Services.MFATrustDuration,
+			OTPSendInterval:   cfg.Services.OTPSendInterval,
+
+			RecoveryQuestions:   cfg.Services.RecoveryQuestions,
+			RecoveryMaxAttempts: cfg.Services.RecoveryMaxAttempts,
+			RecoveryLockout:     cfg.Services.RecoveryLockout,
+		},
+		BodyReadTimeout: cfg.Web.BodyReadTimeout,
+
+		Maintenance:           cfg.Web.Maintenance,
+		MaintenanceRetryAfter: cfg.Web.MaintenanceRetryAfter,
+
+		MaxURLLength: cfg.Web.MaxURLLength,
+
+		MaxJSONDepth:  cfg.Web.MaxJSONDepth,
+		MaxJSONTokens: cfg.Web.MaxJSONTokens,
+
+		TokenCacheControl: cfg.Web.TokenCacheControl,
+	}
+
+	for _, p := range cfg.Web.QuietPaths {
+		apiCfg.Log.PathLevels[p] = middleware.LogDebug
+	}
+
+	if cfg.Redis.Addr != "" {
+		apiCfg.Ephemeral = models.NewRedisStore(cfg.Redis.Addr, cfg.Redis.Password, cfg.Redis.Prefix)
+	}
+	if cfg.Services.CheckBreachedPasswords {
+		apiCfg.Users.BreachChecker = models.NewHIBPChecker(&http.Client{Timeout: 2 * time.Second})
+	}
+	if cfg.Services.DenyDisposableEmails && cfg.Services.DisposableEmailsFile == "" {
+		apiCfg.Users.DisposableChecker = models.DefaultDisposableList()
+	} else if cfg.Services.DenyDisposableEmails {
+		f, err := os.Open(cfg.Services.DisposableEmailsFile)
+		if err != nil {
+			return handlers.Config{}, fmt.Errorf("opening disposable email domains: %w", err)
+		}
+		apiCfg.Users.DisposableChecker, err = models.NewDisposableList(f)
+		f.Close()
+		if err != nil {
+			return handlers.Config{}, fmt.Errorf("reading disposable email domains: %w", err)
+		}
+	}
+	if cfg.Services.CanonicalGmail || len(cfg.Services.PlusAddressDomains) > 0 {
+		apiCfg.Users.CanonicalEmails = map[string]models.EmailCanonicalisation{}
+		if cfg.Services.CanonicalGmail {
+			for d, c := range models.GmailCanonicalisation {
+				apiCfg.Users.CanonicalEmails[d] = c
+			}
+		}
+		for _, d := range cfg.Services.PlusAddressDomains {
+			apiCfg.Users.CanonicalEmails[d] = models.EmailCanonicalisation{StripTags: true}
+		}
+	}
+	if cfg.Services.SigningKeyFile != "" {
+		key, err := readSigningKey(cfg.Services.SigningKeyFile)
+		if err != nil {
+			return handlers.Config{}, fmt.Errorf("reading signing key: %w", err)
+		}
+		apiCfg.Users.SigningKey = key
+	}
+	apiCfg.Users.SigningAlgorithm = cfg.Services.SigningAlgorithm
+	if cfg.Services.CaptchaSecret != "" {
+		apiCfg.OAuth.Captcha = handlers.NewSiteVerifier(&http.Client{Timeout: 2 * time.Second},
+			cfg.Services.CaptchaVerifyURL, cfg.Services.CaptchaSecret)
+	}
+	if cfg.Services.BackchannelLogout {
+		apiCfg.Users.LogoutNotifier = models.NewBackchannelNotifier(&http.Client{Timeout: 2 * time.Second})
+	}
+
+	return apiCfg, nil
+}
+
+// durationPairs parses the "key=duration" pairs of the setting called name, keyed on key.
+func durationPairs(name, key string, pairs []string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration, len(pairs))
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%s %q is not in the %s=duration form", name, p, key)
+		}
+
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s %q: %w", name, p, err)
+		}
+		m[kv[0]] = d
+	}
+
+	return m, nil
+}
+
 func registerTracer(service, httpAddr, traceURL string, probability float64) (func() error, error) {
 	localEndpoint, err := openzipkin.NewEndpoint(service, httpAddr)
 	if err != nil {
@@ -202,3 +718,28 @@ func registerTracer(service, httpAddr, traceURL string, probability float64) (fu
 
 	return reporter.Close, nil
 }
+
+// readSigningKey reads the PKCS #8 private key in the PEM file at path.
+func readSigningKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return signer, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIConfig_Defaults(t *testing.T) {
+	require.NoError(t, conf.Parse(nil, logServiceName, &cfg))
+	// the JWT secret has no default, and must be set for the service to start.
+	cfg.Services.JWTSecret = bytes.Repeat([]byte("s"), 64)
+
+	apiCfg, err := apiConfig()
+	require.NoError(t, err)
+	assert.NoError(t, apiCfg.Validate())
+}
+
+func TestDurationPairs(t *testing.T) {
+	var cases = []struct {
+		name   string
+		pairs  []string
+		outMap map[string]time.Duration
+		outErr bool
+	}{
+		{"none", nil, map[string]time.Duration{}, false},
+		{"pairs", []string{"admin=5m", "billing=1h30m"}, map[string]time.Duration{"admin": 5 * time.Minute, "billing": 90 * time.Minute}, false},
+		{"missingDuration", []string{"admin"}, nil, true},
+		{"missingKey", []string{"=5m"}, nil, true},
+		{"invalidDuration", []string{"admin=soon"}, nil, true},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			m, err := durationPairs("scope consent TTL", "scope", cs.pairs)
+			if cs.outErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, cs.outMap, m)
+		})
+	}
+}
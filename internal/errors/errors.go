@@ -1,6 +1,10 @@
 package errors
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
 
 // FuncWrap is a function that wraps the err argument with the msg message,
 // returning the wrapped error. When err is nil, the function will create a new
@@ -12,10 +16,10 @@ type FuncWrap func(msg string, err error) error
 func Wrapper(pkg string) FuncWrap {
 	return func(msg string, err error) error {
 		if err == nil {
-			return errors.Errorf(pkg + ": " + msg)
+			return errors.New(pkg + ": " + msg)
 		}
 
-		return errors.Errorf(pkg+": "+msg+": %w", err)
+		return errors.WithStack(fmt.Errorf(pkg+": "+msg+": %w", err))
 	}
 }
 
@@ -23,8 +27,25 @@ func Wrapper(pkg string) FuncWrap {
 // any package information.
 func WrapInternal(msg string, err error) error {
 	if err == nil {
-		return errors.Errorf(msg)
+		return errors.New(msg)
+	}
+
+	return errors.WithStack(fmt.Errorf(msg+": %w", err))
+}
+
+// Causes unwraps err and returns the message of every error found in its chain, starting with err
+// itself. Consecutive repeated messages, such as the ones produced by wrappers that only attach a stack
+// trace, are reported once.
+func Causes(err error) []string {
+	var causes []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		msg := err.Error()
+		if len(causes) > 0 && causes[len(causes)-1] == msg {
+			continue
+		}
+
+		causes = append(causes, msg)
 	}
 
-	return errors.Errorf(msg+": %w", err)
+	return causes
 }
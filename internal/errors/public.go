@@ -0,0 +1,92 @@
+package errors
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// publicCode matches the error codes extracted by the Public() methods of the error types.
+var publicCode = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// CheckPublic returns an error unless msg, the message of a public error of the pkg package, has the
+// "pkg: error_code, description" shape the Public() methods extract the error code from. The error
+// code is made of lowercase letters, digits and underscores, so it cannot contain the comma ending it.
+func CheckPublic(pkg, msg string) error {
+	prefix := pkg + ": "
+	if !strings.HasPrefix(msg, prefix) {
+		return fmt.Errorf("%q does not start with %q", msg, prefix)
+	}
+
+	i := strings.Index(msg, ", ")
+	if i < 0 {
+		return fmt.Errorf("%q has no comma separating the error code from the description", msg)
+	}
+
+	code, desc := msg[len(prefix):i], msg[i+len(", "):]
+	if !publicCode.MatchString(code) {
+		return fmt.Errorf("%q has a malformed error code %q", msg, code)
+	}
+	if strings.TrimSpace(desc) == "" {
+		return fmt.Errorf("%q has no description", msg)
+	}
+
+	return nil
+}
+
+// Constants returns the values of the string constants of type typeName declared in the Go files of the
+// dir directory, by name. Test files are skipped. It is meant to be used by the tests checking the shape
+// of the error constants, which cannot be listed at runtime.
+func Constants(dir, typeName string) (map[string]string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	consts := map[string]string{}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.CONST {
+					continue
+				}
+
+				for _, spec := range gen.Specs {
+					vs := spec.(*ast.ValueSpec)
+					if typ, ok := vs.Type.(*ast.Ident); !ok || typ.Name != typeName {
+						continue
+					}
+
+					for i, name := range vs.Names {
+						if i >= len(vs.Values) {
+							return nil, fmt.Errorf("%s: %s has no value", fset.Position(name.Pos()), name.Name)
+						}
+
+						lit, ok := vs.Values[i].(*ast.BasicLit)
+						if !ok || lit.Kind != token.STRING {
+							return nil, fmt.Errorf("%s: %s is not a string literal", fset.Position(name.Pos()), name.Name)
+						}
+
+						value, err := strconv.Unquote(lit.Value)
+						if err != nil {
+							return nil, err
+						}
+
+						consts[name.Name] = value
+					}
+				}
+			}
+		}
+	}
+
+	return consts, nil
+}
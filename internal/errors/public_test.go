@@ -0,0 +1,33 @@
+package errors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPublic(t *testing.T) {
+	var cases = []struct {
+		name  string
+		msg   string
+		outOK bool
+	}{
+		{"valid", "models: not_found, resource not found", true},
+		{"commaInDescription", "models: invalid_id, the ID is invalid, provide a positive number", true},
+		{"digits", "models: mfa_totp2, second factor required", true},
+		{"wrongPrefix", "handlers: not_found, resource not found", false},
+		{"noPrefix", "not_found, resource not found", false},
+		{"noComma", "models: not_found resource not found", false},
+		{"commaWithoutSpace", "models: not_found,resource not found", false},
+		{"spaceInCode", "models: not found, resource not found", false},
+		{"uppercaseCode", "models: NotFound, resource not found", false},
+		{"emptyCode", "models: , resource not found", false},
+		{"noDescription", "models: not_found, ", false},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			err := CheckPublic("models", cs.msg)
+			assert.Equal(t, cs.outOK, err == nil, "%v", err)
+		})
+	}
+}
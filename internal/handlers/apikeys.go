@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// APIKeys implements a controller for the API keys users create to access the API from scripts and other
+// applications.
+type APIKeys struct {
+	as models.APIKeyService
+
+	viewErr web.Error
+}
+
+// NewAPIKeys creates a new APIKeys controller.
+func NewAPIKeys(as models.APIKeyService) *APIKeys {
+	var ev web.Error
+	ev.SetCode(ErrNotFound, http.StatusNotFound)
+	ev.SetCode(models.ErrNotFound, http.StatusNotFound)
+	ev.SetCode(models.ErrTooManyAPIKeys, http.StatusConflict)
+
+	return &APIKeys{
+		as:      as,
+		viewErr: ev,
+	}
+}
+
+// Create generates an API key for the authenticated user. The response holds the secret of the key, which
+// is never returned again. Users can have up to the maximum number of active keys configured.
+//
+// POST /api/me/api-keys/
+func (a *APIKeys) Create(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.APIKeys.Create")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: Create called without/before Authenticate", nil)
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		a.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	key, secret, err := a.as.Create(ctx, claims.User.ID, req.Name)
+	if err != nil {
+		a.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	res := struct {
+		models.APIKey
+		Secret string `json:"secret"`
+	}{key, secret}
+
+	return web.Respond(ctx, w, res, http.StatusCreated)
+}
+
+// Revoke disables an API key of the authenticated user, which can no longer be used to authenticate.
+//
+// DELETE /api/me/api-keys/{key_id}
+func (a *APIKeys) Revoke(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.APIKeys.Revoke")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: Revoke called without/before Authenticate", nil)
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "key_id"), 10, 64)
+	if err != nil {
+		a.viewErr.JSON(ctx, w, ErrNotFound)
+		return nil
+	}
+
+	if err := a.as.Revoke(ctx, claims.User.ID, id); err != nil {
+		a.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+type testAPIKeyService struct {
+	models.APIKeyService
+	create func(ctx context.Context, userID int64, name string) (models.APIKey, string, error)
+	revoke func(ctx context.Context, userID, id int64) error
+}
+
+func (t *testAPIKeyService) Create(ctx context.Context, userID int64, name string) (models.APIKey, string, error) {
+	if t.create != nil {
+		return t.create(ctx, userID, name)
+	}
+
+	panic("not provided")
+}
+
+func (t *testAPIKeyService) Revoke(ctx context.Context, userID, id int64) error {
+	if t.revoke != nil {
+		return t.revoke(ctx, userID, id)
+	}
+
+	panic("not provided")
+}
+
+func TestAPIKeys_Create(t *testing.T) {
+	as := &testAPIKeyService{}
+	a := NewAPIKeys(as)
+
+	as.create = func(ctx context.Context, userID int64, name string) (models.APIKey, string, error) {
+		assert.Equal(t, int64(88), userID)
+		if name == "" {
+			return models.APIKey{}, "", models.ValidationError{"name": models.ErrRequired}
+		}
+		if name == "full" {
+			return models.APIKey{}, "", models.ErrTooManyAPIKeys
+		}
+
+		return models.APIKey{
+			ID:        3,
+			UserID:    userID,
+			Name:      name,
+			Hash:      "hash",
+			CreatedAt: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+		}, "secret", nil
+	}
+
+	var cases = []struct {
+		name      string
+		content   string
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"created",
+			`{"name": "ci"}`,
+			http.StatusCreated,
+			`{"id": 3, "user_id": 88, "name": "ci", "created_at": "2021-03-01T12:00:00Z", "secret": "secret"}`,
+		},
+		{
+			"tooManyKeys",
+			`{"name": "full"}`,
+			http.StatusConflict,
+			`{"error": "too_many_api_keys"}`,
+		},
+		{
+			"nameRequired",
+			`{}`,
+			http.StatusBadRequest,
+			`{"error": "validation_error", "fields": {"name": "required"}}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/me/api-keys/", strings.NewReader(cs.content))
+
+			err := a.Create(testClaimsContext(88), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestAPIKeys_Revoke(t *testing.T) {
+	as := &testAPIKeyService{}
+	a := NewAPIKeys(as)
+
+	as.revoke = func(ctx context.Context, userID, id int64) error {
+		assert.Equal(t, int64(88), userID)
+		if id == 1 {
+			return nil
+		}
+
+		return models.ErrNotFound
+	}
+
+	var cases = []struct {
+		name      string
+		keyID     string
+		outStatus int
+		outJSON   string
+	}{
+		{"revoked", "1", http.StatusNoContent, ``},
+		{"missing", "3", http.StatusNotFound, `{"error": "not_found"}`},
+		{"badID", "ci", http.StatusNotFound, `{"error": "not_found"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodDelete, "/api/me/api-keys/"+cs.keyID, nil)
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("key_id", cs.keyID)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+			err := a.Revoke(testClaimsContext(88), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+		})
+	}
+}
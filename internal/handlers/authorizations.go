@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// Authorizations implements a controller for the clients authenticated users have granted access to
+// their account.
+type Authorizations struct {
+	cs models.ConsentService
+	us models.UserService
+
+	viewErr web.Error
+}
+
+// NewAuthorizations creates a new Authorizations controller.
+func NewAuthorizations(cs models.ConsentService, us models.UserService) *Authorizations {
+	var ev web.Error
+	ev.SetCode(ErrNotFound, http.StatusNotFound)
+	ev.SetCode(models.ErrNotFound, http.StatusNotFound)
+
+	return &Authorizations{
+		cs:      cs,
+		us:      us,
+		viewErr: ev,
+	}
+}
+
+// List returns the clients the authenticated user has approved, along with the scopes granted to them.
+//
+// GET /api/me/authorizations
+func (a *Authorizations) List(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Authorizations.List")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: List called without/before Authenticate", nil)
+	}
+
+	auths, err := a.cs.Authorizations(ctx, claims.User.ID)
+	if err != nil {
+		a.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, auths, http.StatusOK)
+}
+
+// Revoke removes the access the authenticated user granted to a client, invalidating all the tokens
+// issued to the client for the user.
+//
+// DELETE /api/me/authorizations/:client_id
+func (a *Authorizations) Revoke(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Authorizations.Revoke")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: Revoke called without/before Authenticate", nil)
+	}
+
+	clientID := chi.URLParam(r, "client_id")
+	if clientID == "" {
+		a.viewErr.JSON(ctx, w, ErrNotFound)
+		return nil
+	}
+
+	// the tokens are revoked first, so a failure never leaves them valid once the approval is removed.
+	if err := a.us.RevokeClient(ctx, claims.User.ID, clientID); err != nil {
+		a.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if err := a.cs.Revoke(ctx, claims.User.ID, clientID); err != nil {
+		a.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+type testConsentService struct {
+	models.ConsentService
+	authorizations func(ctx context.Context, userID int64) ([]models.Authorization, error)
+	revoke         func(ctx context.Context, userID int64, clientID string) error
+}
+
+func (t *testConsentService) Authorizations(ctx context.Context, userID int64) ([]models.Authorization, error) {
+	if t.authorizations != nil {
+		return t.authorizations(ctx, userID)
+	}
+
+	panic("not provided")
+}
+
+func (t *testConsentService) Revoke(ctx context.Context, userID int64, clientID string) error {
+	if t.revoke != nil {
+		return t.revoke(ctx, userID, clientID)
+	}
+
+	panic("not provided")
+}
+
+// testClaimsContext returns a test context for requests authenticated as the user userID.
+func testClaimsContext(userID int64) context.Context {
+	return context.WithValue(testContext(), models.KeyClaims, models.NewClaims(models.User{ID: userID}))
+}
+
+func TestAuthorizations_List(t *testing.T) {
+	cs := &testConsentService{}
+	a := NewAuthorizations(cs, &testUserService{})
+
+	cs.authorizations = func(ctx context.Context, userID int64) ([]models.Authorization, error) {
+		assert.Equal(t, int64(88), userID)
+
+		return []models.Authorization{
+			{
+				ClientID:  "calendar",
+				Scopes:    []string{"events", "profile"},
+				GrantedAt: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+			},
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/me/authorizations", nil)
+
+	err := a.List(testClaimsContext(88), w, r)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.JSONEq(t,
+		`[{"client_id":"calendar","scopes":["events","profile"],"granted_at":"2021-03-01T12:00:00Z"}]`,
+		w.Body.String())
+}
+
+func TestAuthorizations_Revoke(t *testing.T) {
+	consents := &testConsentService{}
+	us := &testUserService{}
+	a := NewAuthorizations(consents, us)
+
+	var cases = []struct {
+		name      string
+		clientID  string
+		outStatus int
+		outJSON   string
+		setup     func(*testing.T)
+	}{
+		{
+			"notApproved",
+			"unknown",
+			http.StatusNotFound,
+			`{"error":"not_found"}`,
+			func(t *testing.T) {
+				us.revoke = func(ctx context.Context, userID int64, clientID string) error {
+					return nil
+				}
+				consents.revoke = func(ctx context.Context, userID int64, clientID string) error {
+					return models.ErrNotFound
+				}
+			},
+		},
+		{
+			"revokeTokensFailed",
+			"calendar",
+			http.StatusInternalServerError,
+			`{"error":"server_error"}`,
+			func(t *testing.T) {
+				us.revoke = func(ctx context.Context, userID int64, clientID string) error {
+					return privateError("test error message")
+				}
+			},
+		},
+		{
+			"ok",
+			"calendar",
+			http.StatusNoContent,
+			``,
+			func(t *testing.T) {
+				var tokensRevoked bool
+				us.revoke = func(ctx context.Context, userID int64, clientID string) error {
+					assert.Equal(t, int64(88), userID)
+					assert.Equal(t, "calendar", clientID)
+					tokensRevoked = true
+					return nil
+				}
+				consents.revoke = func(ctx context.Context, userID int64, clientID string) error {
+					assert.True(t, tokensRevoked)
+					assert.Equal(t, int64(88), userID)
+					assert.Equal(t, "calendar", clientID)
+					return nil
+				}
+			},
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodDelete, "/api/me/authorizations/"+cs.clientID, nil)
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("client_id", cs.clientID)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+			if cs.setup != nil {
+				cs.setup(t)
+			}
+
+			err := a.Revoke(testClaimsContext(88), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+
+			*consents = testConsentService{}
+			*us = testUserService{}
+		})
+	}
+}
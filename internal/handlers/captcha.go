@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// captchaHeader is the request header carrying the solution of the CAPTCHA, as the request bodies only
+// hold the resource being created.
+const captchaHeader = "X-Captcha-Response"
+
+// defaultSignupFailureWindow is the period failed signups are counted over when none is configured.
+const defaultSignupFailureWindow = time.Hour
+
+// A CaptchaVerifier checks the CAPTCHA solutions sent by clients, usually against a third party service.
+type CaptchaVerifier interface {
+	// Verify reports whether response solves the CAPTCHA presented to the client with the given IP.
+	Verify(ctx context.Context, response, remoteIP string) (bool, error)
+}
+
+type siteVerifier struct {
+	client *http.Client
+	url    string
+	secret string
+}
+
+// NewSiteVerifier returns a CaptchaVerifier using the "siteverify" API at verifyURL through client, as
+// offered by reCAPTCHA, hCaptcha and Turnstile. The secret identifies the site to the provider.
+func NewSiteVerifier(client *http.Client, verifyURL, secret string) CaptchaVerifier {
+	return &siteVerifier{
+		client: client,
+		url:    verifyURL,
+		secret: secret,
+	}
+}
+
+func (sv *siteVerifier) Verify(ctx context.Context, response, remoteIP string) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "handlers.CaptchaVerifier.Verify")
+	defer span.End()
+
+	form := url.Values{
+		"secret":   {sv.secret},
+		"response": {response},
+		"remoteip": {remoteIP},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sv.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, wrap("failed to create captcha verification request", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := sv.client.Do(req)
+	if err != nil {
+		return false, wrap("failed to request captcha verification", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, wrap("unexpected captcha verification response "+res.Status, nil)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return false, wrap("failed to read captcha verification response", err)
+	}
+
+	return result.Success, nil
+}
+
+// failureCounter counts the failures by key within a fixed window, starting with the first failure. It
+// counts the successful signups as well.
+type failureCounter struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]failureCount
+}
+
+type failureCount struct {
+	count int
+	since time.Time
+}
+
+func newFailureCounter(window time.Duration) *failureCounter {
+	if window == 0 {
+		window = defaultSignupFailureWindow
+	}
+
+	return &failureCounter{
+		window:  window,
+		entries: make(map[string]failureCount),
+	}
+}
+
+// Record adds a failure for key.
+func (fc *failureCounter) Record(key string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	now := time.Now()
+	e := fc.entries[key]
+	if now.Sub(e.since) > fc.window {
+		e = failureCount{since: now}
+	}
+
+	e.count++
+	fc.entries[key] = e
+}
+
+// Count returns the failures recorded for key within the current window.
+func (fc *failureCounter) Count(key string) int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	e, ok := fc.entries[key]
+	if !ok {
+		return 0
+	}
+
+	if time.Since(e.since) > fc.window {
+		delete(fc.entries, key)
+		return 0
+	}
+
+	return e.count
+}
+
+// remoteIP returns the IP address of the client sending r, as seen by the server.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSiteVerifier_Verify(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "sitesecret", r.PostForm.Get("secret"))
+		assert.Equal(t, "192.0.2.1", r.PostForm.Get("remoteip"))
+
+		switch r.PostForm.Get("response") {
+		case "solved":
+			w.Write([]byte(`{"success":true}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"success":false,"error-codes":["invalid-input-response"]}`))
+		}
+	}))
+	defer srv.Close()
+
+	cv := NewSiteVerifier(srv.Client(), srv.URL, "sitesecret")
+
+	var cases = []struct {
+		name     string
+		response string
+		outOK    bool
+		outErr   bool
+	}{
+		{"solved", "solved", true, false},
+		{"wrong", "guessed", false, false},
+		{"providerError", "broken", false, true},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			ok, err := cv.Verify(context.Background(), cs.response, "192.0.2.1")
+			if cs.outErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, cs.outOK, ok)
+		})
+	}
+}
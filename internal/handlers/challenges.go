@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+const (
+	// grantTypeChallenge is the grant type completing the challenge of a risky login, or its MFA step.
+	grantTypeChallenge = "urn:goauthsvc:params:oauth:grant-type:challenge"
+
+	// trustedDeviceCookie is the name of the cookie marking a device trusted to skip the MFA step.
+	trustedDeviceCookie = "trusted_device"
+)
+
+// loginChallenge is the response of the token endpoint to a risky login, telling the client how to
+// complete it.
+type loginChallenge struct {
+	Error      string `json:"error"`
+	NextAction string `json:"next_action,omitempty"`
+	models.Challenge
+}
+
+// challenge assesses the risk of the login of user through client, and issues a challenge when risk
+// signals are detected. The returned challenge is empty when the login can proceed, or when the
+// controller is not configured to challenge logins. It has no token when the code was sent too recently
+// to send another one, in which case the client must complete the challenge it was previously given.
+func (u *Users) challenge(ctx context.Context, r *http.Request, user models.User, client models.Client, scope string) (models.Challenge, error) {
+	if u.cfg.RiskAssessor == nil || u.cfg.Challenges == nil {
+		return models.Challenge{}, nil
+	}
+
+	signals, err := u.cfg.RiskAssessor.AssessLogin(ctx, user, models.LoginSignals{
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+		ClientID:  client.ID,
+	})
+	if err != nil || len(signals) == 0 {
+		return models.Challenge{}, err
+	}
+
+	ch, err := u.cfg.Challenges.Issue(ctx, user, client.ID, strings.Join(requestedScopes(scope), " "), signals)
+	if errors.Is(err, models.ErrOTPSendTooSoon) {
+		return models.Challenge{Method: models.ChallengeMethodEmail, Signals: signals}, nil
+	}
+
+	return ch, err
+}
+
+// authMethods returns the amr of a login completing a challenge issued with method, which always follows
+// the password of the user.
+func authMethods(method string) []string {
+	code := models.AuthMethodOTP
+	if method == models.ChallengeMethodSMS {
+		code = models.AuthMethodSMS
+	}
+
+	return []string{models.AuthMethodPassword, code, models.AuthMethodMFA}
+}
+
+// mfaChallenge issues the MFA step of the login of user through client, when the user has MFA devices
+// and the device of the request is not trusted. The returned challenge is empty when the login can
+// proceed, or when the controller is not configured for MFA. Like for challenge, it has no token when
+// the code was sent by SMS too recently.
+func (u *Users) mfaChallenge(ctx context.Context, r *http.Request, user models.User, client models.Client, scope string) (models.Challenge, error) {
+	if u.cfg.MFA == nil || u.cfg.Challenges == nil {
+		return models.Challenge{}, nil
+	}
+
+	n, err := u.cfg.MFA.CountDevices(ctx, user.ID)
+	if err != nil || n == 0 {
+		return models.Challenge{}, err
+	}
+
+	if c, err := r.Cookie(trustedDeviceCookie); err == nil && u.cfg.Trust != nil {
+		trusted, err := u.cfg.Trust.Trusted(ctx, user.ID, c.Value)
+		if err != nil || trusted {
+			return models.Challenge{}, err
+		}
+	}
+
+	ch, err := u.cfg.Challenges.IssueMFA(ctx, user, client.ID, strings.Join(requestedScopes(scope), " "))
+	if errors.Is(err, models.ErrOTPSendTooSoon) {
+		return models.Challenge{Method: models.ChallengeMethodSMS}, nil
+	}
+
+	return ch, err
+}
+
+// trustDevice sets the cookie trusting the device of the request to skip the MFA step of the user, when
+// the controller is configured to trust devices.
+func (u *Users) trustDevice(ctx context.Context, w http.ResponseWriter, userID int64) error {
+	if u.cfg.Trust == nil {
+		return nil
+	}
+
+	value, expiresAt, err := u.cfg.Trust.Trust(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     trustedDeviceCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
@@ -0,0 +1,461 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+type testNotifier struct {
+	models.Notifier
+	codes map[int64]string
+}
+
+func (t *testNotifier) SendChallenge(ctx context.Context, u models.User, code string) error {
+	t.codes[u.ID] = code
+	return nil
+}
+
+func (t *testNotifier) SendSMS(ctx context.Context, u models.User, phone, code string) error {
+	t.codes[u.ID] = code
+	return nil
+}
+
+func TestUsers_LoginChallenge(t *testing.T) {
+	us := &testUserService{}
+	as := &testAuditService{}
+	notifier := &testNotifier{codes: make(map[int64]string)}
+
+	risky := map[string]bool{"203.0.113.9": true}
+	u := NewUsers(us, nil, nil, as, OAuthConfig{
+		RiskAssessor: models.RiskAssessorFunc(func(ctx context.Context, u models.User, s models.LoginSignals) ([]string, error) {
+			if risky[s.IP] {
+				return []string{"new_device"}, nil
+			}
+
+			return nil, nil
+		}),
+		Challenges: models.NewChallengeService(models.NewMemoryStore(models.Config{}), nil, models.Config{Notifier: notifier}),
+	}, nil)
+
+	us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+		return models.User{ID: 99, Active: true}, nil
+	}
+	us.byID = func(ctx context.Context, id int64) (models.User, error) {
+		return models.User{ID: id, Active: true}, nil
+	}
+	us.clientToken = func(ctx context.Context, u *models.User, c *models.Client, scopes ...string) (models.Token, error) {
+		assert.Equal(t, int64(99), u.ID)
+		assert.Equal(t, []string{"profile"}, scopes)
+
+		return models.Token{AccessToken: "stepped-up", ExpiresIn: 300, TokenType: "bearer"}, nil
+	}
+
+	login := func(content, remoteAddr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(content))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remoteAddr
+
+		err := u.Login(testContext(), w, r)
+		require.NoError(t, err)
+
+		return w
+	}
+
+	w := login("grant_type=password&email=test@test.com&password=secret&scope=profile", "203.0.113.9:4321")
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	var ch struct {
+		Error     string   `json:"error"`
+		Token     string   `json:"challenge_token"`
+		Method    string   `json:"method"`
+		Signals   []string `json:"signals"`
+		ExpiresIn int64    `json:"expires_in"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ch))
+	assert.Equal(t, "challenge_required", ch.Error)
+	assert.NotEmpty(t, ch.Token)
+	assert.Equal(t, models.ChallengeMethodEmail, ch.Method)
+	assert.Equal(t, []string{"new_device"}, ch.Signals)
+	assert.Equal(t, int64(300), ch.ExpiresIn)
+	assert.NotContains(t, w.Body.String(), "access_token")
+
+	complete := func(code string) *httptest.ResponseRecorder {
+		return login(url.Values{
+			"grant_type":      {grantTypeChallenge},
+			"challenge_token": {ch.Token},
+			"code":            {code},
+		}.Encode(), "203.0.113.9:4321")
+	}
+
+	t.Run("wrongCode", func(t *testing.T) {
+		w := complete("000000x")
+
+		assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		assert.JSONEq(t, `{"error": "invalid_challenge_code"}`, w.Body.String())
+	})
+
+	t.Run("completed", func(t *testing.T) {
+		w := complete(notifier.codes[99])
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.JSONEq(t, `{"access_token": "stepped-up", "expires_in": 300, "token_type": "bearer"}`, w.Body.String())
+	})
+
+	t.Run("reused", func(t *testing.T) {
+		w := complete(notifier.codes[99])
+
+		assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		assert.JSONEq(t, `{"error": "invalid_challenge"}`, w.Body.String())
+	})
+
+	t.Run("notRisky", func(t *testing.T) {
+		w := login("grant_type=password&email=test@test.com&password=secret&scope=profile", "198.51.100.7:4321")
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.JSONEq(t, `{"access_token": "stepped-up", "expires_in": 300, "token_type": "bearer"}`, w.Body.String())
+	})
+
+	assert.Equal(t, []models.AuditEvent{
+		{Action: "login_challenged", UserID: 99},
+		{Action: "login", UserID: 99},
+		{Action: "login", UserID: 99},
+	}, as.events)
+}
+
+func TestUsers_LoginChallengeSendInterval(t *testing.T) {
+	us := &testUserService{}
+	notifier := &testNotifier{codes: make(map[int64]string)}
+	cfg := models.Config{Notifier: notifier, OTPSendInterval: time.Minute}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{
+		RiskAssessor: models.RiskAssessorFunc(func(ctx context.Context, u models.User, s models.LoginSignals) ([]string, error) {
+			return []string{"new_device"}, nil
+		}),
+		Challenges: models.NewChallengeService(models.NewMemoryStore(cfg), nil, cfg),
+	}, nil)
+
+	us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+		return models.User{ID: 99, Active: true}, nil
+	}
+
+	login := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader("grant_type=password&email=test@test.com&password=secret"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		require.NoError(t, u.Login(testContext(), w, r))
+		return w
+	}
+
+	w := login()
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "challenge_token")
+	assert.NotEmpty(t, notifier.codes[99])
+	delete(notifier.codes, 99)
+
+	// the second login gets the same response, but no code is sent and no challenge issued.
+	w = login()
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	assert.JSONEq(t, `{"error": "challenge_required", "method": "email", "signals": ["new_device"]}`, w.Body.String())
+	assert.Empty(t, notifier.codes)
+}
+
+func TestUsers_LoginChallengeNextAction(t *testing.T) {
+	us := &testUserService{}
+	notifier := &testNotifier{codes: make(map[int64]string)}
+	cfg := models.Config{Notifier: notifier}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{
+		RiskAssessor: models.RiskAssessorFunc(func(ctx context.Context, u models.User, s models.LoginSignals) ([]string, error) {
+			return []string{"new_device"}, nil
+		}),
+		Challenges: models.NewChallengeService(models.NewMemoryStore(cfg), nil, cfg),
+	}, nil)
+
+	us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+		return models.User{ID: 99, Active: true}, nil
+	}
+
+	var cases = []struct {
+		name          string
+		actions       map[string]string
+		outNextAction string
+	}{
+		{"configured", map[string]string{"challenge_required": "submit_code"}, "submit_code"},
+		{"otherCode", map[string]string{"mfa_required": "submit_mfa"}, ""},
+		{"notConfigured", nil, ""},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader("grant_type=password&email=test@test.com&password=secret"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			ctx := context.WithValue(context.Background(), web.KeyValues, &web.Values{NextActions: cs.actions})
+
+			require.NoError(t, u.Login(ctx, w, r))
+			require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+			var ch map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ch))
+			assert.Equal(t, "challenge_required", ch["error"])
+			if cs.outNextAction != "" {
+				assert.Equal(t, cs.outNextAction, ch["next_action"])
+			} else {
+				assert.NotContains(t, ch, "next_action")
+			}
+		})
+	}
+}
+
+func TestUsers_LoginTrustedDevice(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	cfg := models.Config{
+		Now:              func() time.Time { return now },
+		MFATrustDuration: 24 * time.Hour,
+	}
+
+	us := &testUserService{}
+	ms := &testMFAService{}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{
+		MFA:        ms,
+		Trust:      models.NewTrustService(us, []byte("very lengthy jwt test secret to be used for tests"), cfg),
+		Challenges: models.NewChallengeService(models.NewMemoryStore(cfg), ms, cfg),
+	}, nil)
+
+	us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+		return models.User{ID: 99, Active: true}, nil
+	}
+	us.byID = func(ctx context.Context, id int64) (models.User, error) {
+		return models.User{ID: id, Active: true}, nil
+	}
+	us.token = func(ctx context.Context, u *models.User) (models.Token, error) {
+		return models.Token{AccessToken: "mfa", ExpiresIn: 300, TokenType: "bearer"}, nil
+	}
+	us.trustRevokedAt = func(ctx context.Context, userID int64) (time.Time, error) {
+		return time.Time{}, nil
+	}
+	ms.count = func(ctx context.Context, userID int64) (int, error) {
+		return 1, nil
+	}
+	ms.devices = func(ctx context.Context, userID int64) ([]models.MFADevice, error) {
+		return []models.MFADevice{{ID: 1, UserID: userID, Method: models.ChallengeMethodTOTP}}, nil
+	}
+	ms.verify = func(ctx context.Context, userID int64, code string) error {
+		if code != "123456" {
+			return models.ErrInvalidMFACode
+		}
+
+		return nil
+	}
+
+	login := func(content string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(content))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+
+		err := u.Login(testContext(), w, r)
+		require.NoError(t, err)
+
+		return w
+	}
+	passwordLogin := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		return login("grant_type=password&email=test@test.com&password=secret", cookie)
+	}
+
+	w := passwordLogin(nil)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	var ch struct {
+		Error  string `json:"error"`
+		Token  string `json:"challenge_token"`
+		Method string `json:"method"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ch))
+	assert.Equal(t, "mfa_required", ch.Error)
+	assert.Equal(t, models.ChallengeMethodTOTP, ch.Method)
+
+	w = login(url.Values{
+		"grant_type":      {grantTypeChallenge},
+		"challenge_token": {ch.Token},
+		"code":            {"123456"},
+		"trust_device":    {"true"},
+	}.Encode(), nil)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	trusted := cookies[0]
+	assert.Equal(t, trustedDeviceCookie, trusted.Name)
+	assert.True(t, trusted.HttpOnly)
+	assert.True(t, trusted.Secure)
+
+	var cases = []struct {
+		name       string
+		after      time.Duration
+		cookie     *http.Cookie
+		outCode    int
+		outPrompts bool
+	}{
+		{
+			name:    "withinWindow",
+			after:   23 * time.Hour,
+			cookie:  trusted,
+			outCode: http.StatusOK,
+		},
+		{
+			name:       "expired",
+			after:      24*time.Hour + time.Second,
+			cookie:     trusted,
+			outCode:    http.StatusUnauthorized,
+			outPrompts: true,
+		},
+		{
+			name:       "otherDevice",
+			after:      time.Hour,
+			outCode:    http.StatusUnauthorized,
+			outPrompts: true,
+		},
+		{
+			name:       "forged",
+			after:      time.Hour,
+			cookie:     &http.Cookie{Name: trustedDeviceCookie, Value: "forged"},
+			outCode:    http.StatusUnauthorized,
+			outPrompts: true,
+		},
+	}
+
+	issued := now
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now = issued.Add(cs.after)
+			w := passwordLogin(cs.cookie)
+
+			assert.Equal(t, cs.outCode, w.Result().StatusCode)
+			if cs.outPrompts {
+				assert.Contains(t, w.Body.String(), `"error":"mfa_required"`)
+			} else {
+				assert.JSONEq(t, `{"access_token": "mfa", "expires_in": 300, "token_type": "bearer"}`, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUsers_LoginAuthMethods(t *testing.T) {
+	cfg := models.Config{}
+	us := &testUserService{}
+	ms := &testMFAService{}
+
+	mfaUsers := map[int64]bool{77: true}
+	us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+		if username == "mfa@test.com" {
+			return models.User{ID: 77, Active: true}, nil
+		}
+
+		return models.User{ID: 99, Active: true}, nil
+	}
+	us.byID = func(ctx context.Context, id int64) (models.User, error) {
+		return models.User{ID: id, Active: true}, nil
+	}
+	us.clientToken = func(ctx context.Context, u *models.User, c *models.Client, scopes ...string) (models.Token, error) {
+		return models.Token{AccessToken: "access", ExpiresIn: 300, TokenType: "bearer"}, nil
+	}
+	ms.count = func(ctx context.Context, userID int64) (int, error) {
+		if mfaUsers[userID] {
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+	ms.devices = func(ctx context.Context, userID int64) ([]models.MFADevice, error) {
+		return []models.MFADevice{{ID: 1, UserID: userID, Method: models.ChallengeMethodTOTP}}, nil
+	}
+	ms.verify = func(ctx context.Context, userID int64, code string) error {
+		return nil
+	}
+
+	var got models.IDTokenOptions
+	us.idToken = func(ctx context.Context, u *models.User, clientID string, opts models.IDTokenOptions, scopes ...string) (string, error) {
+		got = opts
+		return "id", nil
+	}
+
+	login := func(u *Users, content string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(content))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		err := u.Login(testContext(), w, r)
+		require.NoError(t, err)
+
+		return w
+	}
+
+	var cases = []struct {
+		name     string
+		enabled  bool
+		email    string
+		outAMR   []string
+		outClass string
+	}{
+		{"password", true, "test@test.com", []string{"pwd"}, "urn:example:loa:1"},
+		{"mfa", true, "mfa@test.com", []string{"pwd", "otp", "mfa"}, "urn:example:loa:2"},
+		{"disabled", false, "mfa@test.com", nil, ""},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			u := NewUsers(us, nil, nil, nil, OAuthConfig{
+				IDTokens:          true,
+				AuthMethods:       cs.enabled,
+				SingleFactorClass: "urn:example:loa:1",
+				MultiFactorClass:  "urn:example:loa:2",
+				MFA:               ms,
+				Challenges:        models.NewChallengeService(models.NewMemoryStore(cfg), ms, cfg),
+			}, nil)
+			got = models.IDTokenOptions{}
+
+			w := login(u, url.Values{
+				"grant_type": {"password"},
+				"email":      {cs.email},
+				"password":   {"secret"},
+				"scope":      {"openid"},
+			}.Encode())
+
+			// the users with MFA devices complete the MFA step first.
+			if cs.email == "mfa@test.com" {
+				require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+				var ch struct {
+					Token string `json:"challenge_token"`
+				}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ch))
+
+				w = login(u, url.Values{
+					"grant_type":      {grantTypeChallenge},
+					"challenge_token": {ch.Token},
+					"code":            {"123456"},
+				}.Encode())
+			}
+
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+			assert.Equal(t, cs.outAMR, got.AuthMethods)
+			assert.Equal(t, cs.outClass, got.AuthClass)
+		})
+	}
+
+	assert.Equal(t, []string{"pwd", "sms", "mfa"}, authMethods(models.ChallengeMethodSMS))
+	assert.Equal(t, []string{"pwd", "otp", "mfa"}, authMethods(models.ChallengeMethodEmail))
+}
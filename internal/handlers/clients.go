@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// Clients implements a controller for the OAuth clients registering themselves.
+type Clients struct {
+	cs  models.ClientService
+	cfg OAuthConfig
+
+	viewErr web.Error
+}
+
+// NewClients creates a new Clients controller.
+func NewClients(cs models.ClientService, cfg OAuthConfig) *Clients {
+	var ev web.Error
+	ev.SetCode(ErrInvalidRegistrationToken, http.StatusUnauthorized)
+	ev.SetCode(models.ErrInvalidClient, http.StatusUnauthorized)
+
+	return &Clients{
+		cs:      cs,
+		cfg:     cfg,
+		viewErr: ev,
+	}
+}
+
+// registeredClient is the response of the registration endpoint, holding the metadata of the client
+// along with its credentials.
+type registeredClient struct {
+	models.Client
+
+	ClientIDIssuedAt      int64 `json:"client_id_issued_at"`
+	ClientSecretExpiresAt int64 `json:"client_secret_expires_at"`
+}
+
+// Register adds a client from the metadata it sends, returning the client ID and secret it must
+// authenticate with, as defined by the dynamic client registration protocol (RFC 7591). The secret
+// never expires.
+//
+// When the controller is configured with a registration token, clients must send it as a bearer
+// token, so only the parties it was given to can register clients.
+//
+// POST /oauth/register/
+func (c *Clients) Register(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Clients.Register")
+	defer span.End()
+
+	if c.cfg.RegistrationToken != "" {
+		header := r.Header.Get("Authorization")
+		if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(header[len("Bearer "):]), []byte(c.cfg.RegistrationToken)) != 1 {
+			c.viewErr.JSON(ctx, w, ErrInvalidRegistrationToken)
+			return nil
+		}
+	}
+
+	var req struct {
+		Name                   string   `json:"client_name"`
+		RedirectURIs           []string `json:"redirect_uris"`
+		PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris"`
+		BackchannelLogoutURI   string   `json:"backchannel_logout_uri"`
+		GrantTypes             []string `json:"grant_types"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		c.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	client := models.Client{
+		Name:                   req.Name,
+		RedirectURIs:           req.RedirectURIs,
+		PostLogoutRedirectURIs: req.PostLogoutRedirectURIs,
+		BackchannelLogoutURI:   req.BackchannelLogoutURI,
+		GrantTypes:             req.GrantTypes,
+	}
+
+	secret, err := c.cs.Register(ctx, &client)
+	if err != nil {
+		c.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	client.Secret = secret
+	return web.Respond(ctx, w, registeredClient{
+		Client:           client,
+		ClientIDIssuedAt: time.Now().Unix(),
+	}, http.StatusCreated)
+}
+
+// rotatedSecret is the response of the secret rotation endpoint.
+type rotatedSecret struct {
+	ClientID              string `json:"client_id"`
+	ClientSecret          string `json:"client_secret"`
+	ClientSecretExpiresAt int64  `json:"client_secret_expires_at"`
+
+	// PreviousSecretExpiresAt is the time the replaced secret stops being accepted, or zero if it
+	// already is.
+	PreviousSecretExpiresAt int64 `json:"previous_secret_expires_at"`
+}
+
+// RotateSecret generates a new secret for the authenticated client. The replaced secret is still
+// accepted for the rotation overlap configured, so the client can roll out the new secret without
+// failing the requests using the old one.
+//
+// Clients authenticate the same way as with the token endpoint.
+//
+// POST /oauth/clients/secret/
+func (c *Clients) RotateSecret(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Clients.RotateSecret")
+	defer span.End()
+
+	if err := r.ParseForm(); err != nil {
+		c.viewErr.JSON(ctx, w, ErrInvalidFormInput)
+		return nil
+	}
+
+	clientID, clientSecret, err := clientCredentials(r, r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"), c.cfg)
+	if err != nil {
+		c.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	client, err := c.cs.Authenticate(ctx, clientID, clientSecret)
+	if err != nil {
+		c.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	overlap := c.cfg.SecretRotationOverlap
+	secret, err := c.cs.RotateSecret(ctx, client.ID, overlap)
+	if err != nil {
+		c.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	res := rotatedSecret{
+		ClientID:     client.ID,
+		ClientSecret: secret,
+	}
+	if overlap > 0 {
+		res.PreviousSecretExpiresAt = time.Now().Add(overlap).Unix()
+	}
+
+	return web.Respond(ctx, w, res, http.StatusOK)
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+func TestClients_Register(t *testing.T) {
+	clients := &testClientService{}
+	c := NewClients(clients, OAuthConfig{ClientRegistration: true, RegistrationToken: "initial-token"})
+
+	clients.register = func(ctx context.Context, cl *models.Client) (string, error) {
+		for _, uri := range cl.RedirectURIs {
+			if !strings.HasPrefix(uri, "https://") {
+				return "", models.ValidationError{"redirect_uris": models.ErrInvalidRedirectURI}
+			}
+		}
+
+		cl.ID = "generated-id"
+		cl.Active = true
+		return "generated-secret", nil
+	}
+
+	var cases = []struct {
+		name       string
+		authHeader string
+		content    string
+		outStatus  int
+		outJSON    string
+	}{
+		{
+			"valid",
+			"Bearer initial-token",
+			`{"client_name": "Calendar", "redirect_uris": ["https://calendar.example.com/callback"]}`,
+			http.StatusCreated,
+			``,
+		},
+		{
+			"badRedirectURI",
+			"Bearer initial-token",
+			`{"client_name": "Calendar", "redirect_uris": ["http://calendar.example.com/callback"]}`,
+			http.StatusBadRequest,
+			`{"error": "validation_error", "fields": {"redirect_uris": "invalid_redirect_uri"}}`,
+		},
+		{
+			"missingToken",
+			"",
+			`{"client_name": "Calendar", "redirect_uris": ["https://calendar.example.com/callback"]}`,
+			http.StatusUnauthorized,
+			`{"error": "invalid_token"}`,
+		},
+		{
+			"wrongToken",
+			"Bearer guessed-token",
+			`{"client_name": "Calendar", "redirect_uris": ["https://calendar.example.com/callback"]}`,
+			http.StatusUnauthorized,
+			`{"error": "invalid_token"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/register/", strings.NewReader(cs.content))
+			if cs.authHeader != "" {
+				r.Header.Set("Authorization", cs.authHeader)
+			}
+
+			err := c.Register(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+				return
+			}
+
+			var res map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, "generated-id", res["client_id"])
+			assert.Equal(t, "generated-secret", res["client_secret"])
+			assert.Equal(t, "Calendar", res["client_name"])
+			assert.Equal(t, []interface{}{"https://calendar.example.com/callback"}, res["redirect_uris"])
+			assert.EqualValues(t, 0, res["client_secret_expires_at"])
+			assert.NotZero(t, res["client_id_issued_at"])
+		})
+	}
+}
+
+func TestClients_RotateSecret(t *testing.T) {
+	clients := &testClientService{}
+	c := NewClients(clients, OAuthConfig{SecretRotationOverlap: time.Hour})
+
+	clients.auth = func(ctx context.Context, clientID, secret string) (models.Client, error) {
+		if clientID != "ci-bot" || secret != "s3cret" {
+			return models.Client{}, models.ErrInvalidClient
+		}
+
+		return models.Client{ID: clientID, Active: true}, nil
+	}
+
+	var rotated bool
+	clients.rotate = func(ctx context.Context, clientID string, overlap time.Duration) (string, error) {
+		assert.Equal(t, "ci-bot", clientID)
+		assert.Equal(t, time.Hour, overlap)
+
+		rotated = true
+		return "new-secret", nil
+	}
+
+	var cases = []struct {
+		name       string
+		authHeader string
+		outStatus  int
+		outRotated bool
+	}{
+		{"authenticated", "Basic " + base64.StdEncoding.EncodeToString([]byte("ci-bot:s3cret")), http.StatusOK, true},
+		{"badSecret", "Basic " + base64.StdEncoding.EncodeToString([]byte("ci-bot:wrong")), http.StatusUnauthorized, false},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			rotated = false
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/clients/secret/", nil)
+			r.Header.Set("Authorization", cs.authHeader)
+
+			err := c.RotateSecret(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.Equal(t, cs.outRotated, rotated)
+			if !cs.outRotated {
+				return
+			}
+
+			var res map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, "ci-bot", res["client_id"])
+			assert.Equal(t, "new-secret", res["client_secret"])
+			assert.InDelta(t, time.Now().Add(time.Hour).Unix(), res["previous_secret_expires_at"], 5)
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/schema"
+	"go.opencensus.io/trace"
+
+	mw "github.com/noelruault/golang-authentication/internal/middleware"
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// grantTypeDeviceCode is the grant type devices poll the token endpoint with, as defined by RFC 8628.
+const grantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// deviceAuthorization is the response of the device authorization endpoint.
+type deviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceAuthorize starts the device authorization grant for an authenticated client, returning the
+// device code the device polls the token endpoint with, and the user code the user enters at the
+// verification URI to approve the device.
+//
+// Like Login, it takes form encoded requests.
+//
+// POST /oauth/device/
+func (u *Users) DeviceAuthorize(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.DeviceAuthorize")
+	defer span.End()
+
+	var decoder = schema.NewDecoder()
+	var req struct {
+		ClientID     string `schema:"client_id"`
+		ClientSecret string `schema:"client_secret"`
+		Scope        string `schema:"scope"`
+	}
+
+	if !strings.Contains(r.Header.Get("Content-type"), "application/x-www-form-urlencoded") {
+		return ErrContentTypeNotAccepted
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		if errors.Is(err, mw.ErrBodyTimeout) {
+			u.viewErr.JSON(ctx, w, mw.ErrBodyTimeout)
+			return nil
+		}
+
+		u.viewErr.JSON(ctx, w, fmt.Errorf("ParseForm: couldn't parse given form %w", err))
+		return nil
+	}
+
+	if u.cfg.RejectDuplicateParams && duplicateParam(r.PostForm, tokenParams...) {
+		u.viewErr.JSON(ctx, w, ErrInvalidFormInput)
+		return nil
+	}
+
+	if err := decoder.Decode(&req, r.PostForm); err != nil {
+		u.viewErr.JSON(ctx, w, ErrInvalidFormInput)
+		return nil
+	}
+
+	scopes := requestedScopes(req.Scope)
+	if err := u.checkScopes(grantTypeDeviceCode, scopes); err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	clientID, clientSecret, err := clientCredentials(r, req.ClientID, req.ClientSecret, u.cfg)
+	if err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	client, err := u.cs.Authenticate(ctx, clientID, clientSecret)
+	if err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	da, err := u.ds.Authorize(ctx, client.ID, strings.Join(scopes, " "))
+	if err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	verify := u.cfg.DeviceVerificationURI
+	sep := "?"
+	if strings.Contains(verify, "?") {
+		sep = "&"
+	}
+
+	return web.Respond(ctx, w, deviceAuthorization{
+		DeviceCode:              da.DeviceCode,
+		UserCode:                da.UserCode,
+		VerificationURI:         verify,
+		VerificationURIComplete: verify + sep + "user_code=" + url.QueryEscape(da.UserCode),
+		ExpiresIn:               da.ExpiresIn,
+		Interval:                int64(da.Interval.Seconds()),
+	}, http.StatusOK)
+}
+
+// DeviceVerify records the decision of the authenticated user on the device with the given user code.
+// Devices polling the token endpoint get the tokens of the user once approved.
+//
+// POST /oauth/device/verify/
+func (u *Users) DeviceVerify(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.DeviceVerify")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: DeviceVerify called without/before Authenticate", nil)
+	}
+
+	var req struct {
+		UserCode string `json:"user_code" validate:"required"`
+		Approve  bool   `json:"approve"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	var err error
+	if req.Approve {
+		err = u.ds.Approve(ctx, req.UserCode, claims.User.ID)
+	} else {
+		err = u.ds.Deny(ctx, req.UserCode, claims.User.ID)
+	}
+	if err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+type testDeviceService struct {
+	models.DeviceService
+	authorize func(ctx context.Context, clientID, scope string) (models.DeviceAuthorization, error)
+	approve   func(ctx context.Context, userCode string, userID int64) error
+	deny      func(ctx context.Context, userCode string, userID int64) error
+	poll      func(ctx context.Context, deviceCode, clientID string) (models.DeviceAuthorization, error)
+}
+
+func (t *testDeviceService) Authorize(ctx context.Context, clientID, scope string) (models.DeviceAuthorization, error) {
+	if t.authorize != nil {
+		return t.authorize(ctx, clientID, scope)
+	}
+
+	panic("not provided")
+}
+
+func (t *testDeviceService) Approve(ctx context.Context, userCode string, userID int64) error {
+	if t.approve != nil {
+		return t.approve(ctx, userCode, userID)
+	}
+
+	panic("not provided")
+}
+
+func (t *testDeviceService) Deny(ctx context.Context, userCode string, userID int64) error {
+	if t.deny != nil {
+		return t.deny(ctx, userCode, userID)
+	}
+
+	panic("not provided")
+}
+
+func (t *testDeviceService) Poll(ctx context.Context, deviceCode, clientID string) (models.DeviceAuthorization, error) {
+	if t.poll != nil {
+		return t.poll(ctx, deviceCode, clientID)
+	}
+
+	panic("not provided")
+}
+
+func TestUsers_DeviceAuthorize(t *testing.T) {
+	clients := &testClientService{}
+	ds := &testDeviceService{}
+	u := NewUsers(&testUserService{}, clients, ds, nil, OAuthConfig{DeviceVerificationURI: "https://example.com/device"}, nil)
+
+	clients.auth = func(ctx context.Context, clientID, secret string) (models.Client, error) {
+		if secret != "s3cret" {
+			return models.Client{}, models.ErrInvalidClient
+		}
+
+		return models.Client{ID: clientID, Active: true}, nil
+	}
+	ds.authorize = func(ctx context.Context, clientID, scope string) (models.DeviceAuthorization, error) {
+		assert.Equal(t, "tv", clientID)
+		assert.Equal(t, "profile", scope)
+
+		return models.DeviceAuthorization{
+			DeviceCode: "device-code",
+			UserCode:   "BDFG-HJKL",
+			Interval:   5 * time.Second,
+			ExpiresIn:  600,
+		}, nil
+	}
+
+	var cases = []struct {
+		name      string
+		content   string
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"issued",
+			"client_id=tv&client_secret=s3cret&scope=profile",
+			http.StatusOK,
+			`{
+				"device_code": "device-code",
+				"user_code": "BDFG-HJKL",
+				"verification_uri": "https://example.com/device",
+				"verification_uri_complete": "https://example.com/device?user_code=BDFG-HJKL",
+				"expires_in": 600,
+				"interval": 5
+			}`,
+		},
+		{
+			"badClient",
+			"client_id=tv&client_secret=wrong",
+			http.StatusUnauthorized,
+			`{"error": "invalid_client"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/device/", strings.NewReader(cs.content))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.DeviceAuthorize(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_DeviceVerify(t *testing.T) {
+	ds := &testDeviceService{}
+	u := NewUsers(&testUserService{}, nil, ds, nil, OAuthConfig{}, nil)
+
+	var decision string
+	ds.approve = func(ctx context.Context, userCode string, userID int64) error {
+		assert.Equal(t, int64(88), userID)
+		if userCode != "BDFG-HJKL" {
+			return models.ErrNotFound
+		}
+
+		decision = "approved"
+		return nil
+	}
+	ds.deny = func(ctx context.Context, userCode string, userID int64) error {
+		assert.Equal(t, int64(88), userID)
+
+		decision = "denied"
+		return nil
+	}
+
+	var cases = []struct {
+		name        string
+		content     string
+		outStatus   int
+		outJSON     string
+		outDecision string
+	}{
+		{
+			"approve",
+			`{"user_code": "BDFG-HJKL", "approve": true}`,
+			http.StatusNoContent,
+			``,
+			"approved",
+		},
+		{
+			"deny",
+			`{"user_code": "BDFG-HJKL", "approve": false}`,
+			http.StatusNoContent,
+			``,
+			"denied",
+		},
+		{
+			"unknownCode",
+			`{"user_code": "BBBB-BBBB", "approve": true}`,
+			http.StatusNotFound,
+			`{"error": "not_found"}`,
+			"",
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			decision = ""
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/device/verify/", strings.NewReader(cs.content))
+
+			err := u.DeviceVerify(testClaimsContext(88), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+			assert.Equal(t, cs.outDecision, decision)
+		})
+	}
+}
+
+func TestUsers_LoginDeviceCode(t *testing.T) {
+	us := &testUserService{}
+	clients := &testClientService{}
+	ds := &testDeviceService{}
+	u := NewUsers(us, clients, ds, nil, OAuthConfig{}, nil)
+
+	clients.auth = func(ctx context.Context, clientID, secret string) (models.Client, error) {
+		return models.Client{ID: clientID, Active: true}, nil
+	}
+	us.byID = func(ctx context.Context, id int64) (models.User, error) {
+		return models.User{ID: id, Active: true}, nil
+	}
+	us.clientToken = func(ctx context.Context, u *models.User, c *models.Client, scopes ...string) (models.Token, error) {
+		assert.Equal(t, int64(88), u.ID)
+		assert.Equal(t, "tv", c.ID)
+		assert.Equal(t, []string{"profile"}, scopes)
+
+		return models.Token{AccessToken: "device", ExpiresIn: 300, TokenType: "bearer"}, nil
+	}
+
+	var cases = []struct {
+		name      string
+		pollErr   error
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"pending",
+			models.ErrAuthorizationPending,
+			http.StatusBadRequest,
+			`{"error": "authorization_pending"}`,
+		},
+		{
+			"slowDown",
+			models.ErrSlowDown,
+			http.StatusBadRequest,
+			`{"error": "slow_down"}`,
+		},
+		{
+			"denied",
+			models.ErrAccessDenied,
+			http.StatusBadRequest,
+			`{"error": "access_denied"}`,
+		},
+		{
+			"approved",
+			nil,
+			http.StatusOK,
+			`{"access_token": "device", "expires_in": 300, "token_type": "bearer"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			ds.poll = func(ctx context.Context, deviceCode, clientID string) (models.DeviceAuthorization, error) {
+				assert.Equal(t, "device-code", deviceCode)
+				assert.Equal(t, "tv", clientID)
+				if cs.pollErr != nil {
+					return models.DeviceAuthorization{}, cs.pollErr
+				}
+
+				return models.DeviceAuthorization{UserID: 88, ClientID: "tv", Scope: "profile"}, nil
+			}
+
+			content := "grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Adevice_code" +
+				"&device_code=device-code&client_id=tv&client_secret=s3cret"
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(content))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		u := NewUsers(us, clients, nil, nil, OAuthConfig{}, nil)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/",
+			strings.NewReader("grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Adevice_code&device_code=device-code&client_id=tv&client_secret=s3cret"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		err := u.Login(testContext(), w, r)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		assert.JSONEq(t, `{"error": "unsupported_grant_type"}`, w.Body.String())
+	})
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// Discovery implements a controller for the OpenID Connect discovery document, describing the endpoints
+// and capabilities of the service to the clients configuring themselves from it.
+type Discovery struct {
+	doc discoveryDocument
+}
+
+// discoveryDocument is the OpenID Provider metadata, as defined by OpenID Connect Discovery 1.0.
+type discoveryDocument struct {
+	Issuer                      string `json:"issuer"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	UserInfoEndpoint            string `json:"userinfo_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+	RegistrationEndpoint        string `json:"registration_endpoint,omitempty"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint,omitempty"`
+
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	ACRValuesSupported                []string `json:"acr_values_supported,omitempty"`
+}
+
+// NewDiscovery creates a new Discovery controller describing the service configured with users and
+// oauth. The issuer of the document is users.Issuer, which the endpoints are relative to.
+func NewDiscovery(users models.Config, oauth OAuthConfig) *Discovery {
+	// the issuer is kept as it is, matching the iss claim of the ID tokens.
+	base := strings.TrimSuffix(users.Issuer, "/")
+
+	alg := users.SigningAlgorithm
+	if alg == "" {
+		alg = models.SigningHS512
+	}
+
+	doc := discoveryDocument{
+		Issuer:           users.Issuer,
+		TokenEndpoint:    base + "/oauth/login/",
+		UserInfoEndpoint: base + "/userinfo/",
+		JWKSURI:          base + "/oauth/jwks/",
+
+		// the tokens are only issued by the token endpoint, there is no authorization endpoint.
+		ResponseTypesSupported:            []string{},
+		GrantTypesSupported:               []string{"password", "refresh_token", "client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{alg},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "name", "given_name", "family_name", "nickname", "email"},
+	}
+	if oauth.ClientRegistration {
+		doc.RegistrationEndpoint = base + "/oauth/register/"
+	}
+	if oauth.DeviceVerificationURI != "" {
+		doc.DeviceAuthorizationEndpoint = base + "/oauth/device/"
+		doc.GrantTypesSupported = append(doc.GrantTypesSupported, grantTypeDeviceCode)
+	}
+	if oauth.Challenges != nil {
+		doc.GrantTypesSupported = append(doc.GrantTypesSupported, grantTypeChallenge)
+	}
+	if oauth.AuthMethods {
+		doc.ClaimsSupported = append(doc.ClaimsSupported, "acr", "amr")
+		for _, class := range []string{oauth.SingleFactorClass, oauth.MultiFactorClass} {
+			if class != "" {
+				doc.ACRValuesSupported = append(doc.ACRValuesSupported, class)
+			}
+		}
+	}
+
+	// any scope is granted when the known scopes are not configured, which cannot be listed.
+	if len(oauth.KnownScopes) > 0 {
+		doc.ScopesSupported = append([]string(nil), oauth.KnownScopes...)
+	}
+
+	return &Discovery{doc: doc}
+}
+
+// OpenIDConfiguration returns the OpenID Connect discovery document of the service.
+//
+// GET /.well-known/openid-configuration
+func (d *Discovery) OpenIDConfiguration(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Discovery.OpenIDConfiguration")
+	defer span.End()
+
+	return web.Respond(ctx, w, d.doc, http.StatusOK)
+}
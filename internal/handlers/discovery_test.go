@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+func TestDiscovery_OpenIDConfiguration(t *testing.T) {
+	var cases = []struct {
+		name  string
+		users models.Config
+		oauth OAuthConfig
+
+		outEndpoints map[string]string
+		outGrants    []string
+		outScopes    []string
+		outAlg       string
+	}{
+		{
+			"defaults",
+			models.Config{Issuer: "https://auth.example.com/api"},
+			OAuthConfig{},
+			map[string]string{
+				"token_endpoint":    "https://auth.example.com/api/oauth/login/",
+				"userinfo_endpoint": "https://auth.example.com/api/userinfo/",
+				"jwks_uri":          "https://auth.example.com/api/oauth/jwks/",
+			},
+			[]string{"password", "refresh_token", "client_credentials"},
+			nil,
+			"HS512",
+		},
+		{
+			"configured",
+			models.Config{Issuer: "https://auth.example.com/", SigningAlgorithm: models.SigningES256},
+			OAuthConfig{
+				ClientRegistration:    true,
+				DeviceVerificationURI: "https://example.com/device",
+				KnownScopes:           []string{"openid", "profile", "email"},
+				AuthMethods:           true,
+				MultiFactorClass:      "urn:example:loa:2",
+			},
+			map[string]string{
+				"token_endpoint":                "https://auth.example.com/oauth/login/",
+				"userinfo_endpoint":             "https://auth.example.com/userinfo/",
+				"jwks_uri":                      "https://auth.example.com/oauth/jwks/",
+				"registration_endpoint":         "https://auth.example.com/oauth/register/",
+				"device_authorization_endpoint": "https://auth.example.com/oauth/device/",
+			},
+			[]string{"password", "refresh_token", "client_credentials", grantTypeDeviceCode},
+			[]string{"openid", "profile", "email"},
+			"ES256",
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			d := NewDiscovery(cs.users, cs.oauth)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/.well-known/openid-configuration", nil)
+
+			err := d.OpenIDConfiguration(testContext(), w, r)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var doc map[string]interface{}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&doc))
+
+			// the issuer matches the iss claim of the ID tokens as it is configured.
+			assert.Equal(t, cs.users.Issuer, doc["issuer"])
+			for field, uri := range cs.outEndpoints {
+				assert.Equal(t, uri, doc[field], field)
+			}
+			if _, ok := cs.outEndpoints["registration_endpoint"]; !ok {
+				assert.NotContains(t, doc, "registration_endpoint")
+			}
+			if _, ok := cs.outEndpoints["device_authorization_endpoint"]; !ok {
+				assert.NotContains(t, doc, "device_authorization_endpoint")
+			}
+
+			assert.Equal(t, jsonStrings(cs.outGrants), doc["grant_types_supported"])
+			assert.Equal(t, jsonStrings([]string{cs.outAlg}), doc["id_token_signing_alg_values_supported"])
+			assert.Equal(t, []interface{}{}, doc["response_types_supported"])
+			assert.Equal(t, jsonStrings([]string{"public"}), doc["subject_types_supported"])
+			if cs.outScopes == nil {
+				assert.NotContains(t, doc, "scopes_supported")
+			} else {
+				assert.Equal(t, jsonStrings(cs.outScopes), doc["scopes_supported"])
+			}
+
+			// the acr and amr claims are only advertised when the ID tokens include them.
+			if cs.oauth.AuthMethods {
+				assert.Contains(t, doc["claims_supported"], "amr")
+				assert.Equal(t, jsonStrings([]string{cs.oauth.MultiFactorClass}), doc["acr_values_supported"])
+			} else {
+				assert.NotContains(t, doc["claims_supported"], "amr")
+				assert.NotContains(t, doc, "acr_values_supported")
+			}
+		})
+	}
+}
+
+// jsonStrings returns ss as decoded from a JSON array.
+func jsonStrings(ss []string) []interface{} {
+	out := make([]interface{}, len(ss))
+	for i, s := range ss {
+		out[i] = s
+	}
+
+	return out
+}
@@ -12,11 +12,23 @@ var (
 // These errors are returned by the controllers and can be used to provide error codes to the
 // API results.
 const (
-	ErrNotFound               ControllerError   = "handlers: not_found, resource not found"
-	ErrInvalidFormInput       ControllerError   = "handlers: invalid_form, provided input cannot be parsed"
-	ErrContentTypeNotAccepted ControllerError   = "handlers: content_type_not_accepted, the content-type provided is not supported"
-	ErrGrantTypeNotAccepted   ControllerError   = "handlers: unsupported_grant_type, the grant-type provided is not supported"
-	ErrParseError             models.ModelError = "models: invalid_parse, contents are not in appropriate format"
+	ErrNotFound                 ControllerError   = "handlers: not_found, resource not found"
+	ErrInvalidFormInput         ControllerError   = "handlers: invalid_form, provided input cannot be parsed"
+	ErrContentTypeNotAccepted   ControllerError   = "handlers: content_type_not_accepted, the content-type provided is not supported"
+	ErrGrantTypeNotAccepted     ControllerError   = "handlers: unsupported_grant_type, the grant-type provided is not supported"
+	ErrGrantTypeMissing         ControllerError   = "handlers: invalid_request, the grant_type parameter is required"
+	ErrMalformedClientAuth      ControllerError   = "handlers: invalid_client, the client credentials provided are malformed"
+	ErrTooManyScopes            ControllerError   = "handlers: too_many_scopes, the number of scopes requested exceeds the maximum allowed"
+	ErrInvalidScope             ControllerError   = "handlers: invalid_scope, one of the scopes requested is not known"
+	ErrScopeNotAllowed          ControllerError   = "handlers: invalid_scope, one of the scopes requested cannot be obtained with this grant type"
+	ErrLoginRequired            ControllerError   = "handlers: login_required, there is no active session to authenticate the user without interaction"
+	ErrInteractionRequired      ControllerError   = "handlers: interaction_required, the login requires the user to complete another step"
+	ErrInsufficientScope        ControllerError   = "handlers: insufficient_scope, the access token does not grant the scope required"
+	ErrCaptchaRequired          ControllerError   = "handlers: captcha_required, a valid CAPTCHA response must be sent in the X-Captcha-Response header"
+	ErrInvalidRegistrationToken ControllerError   = "handlers: invalid_token, the initial access token required to register clients is missing or not valid"
+	ErrSignupRateLimited        ControllerError   = "handlers: signup_rate_limited, too many accounts were created from this address, try again later"
+	ErrSignupsDisabled          ControllerError   = "handlers: signups_disabled, new accounts cannot be created"
+	ErrParseError               models.ModelError = "models: invalid_parse, contents are not in appropriate format"
 )
 
 // ControllerError defines errors exported by this package. This type implement a Public() method that
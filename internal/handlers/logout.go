@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// Sessions implements a controller for ending user sessions.
+type Sessions struct {
+	ls models.LogoutService
+
+	viewErr web.Error
+}
+
+// NewSessions creates a new Sessions controller.
+func NewSessions(ls models.LogoutService) *Sessions {
+	var ev web.Error
+	ev.SetCode(models.ErrUnauthorised, http.StatusUnauthorized)
+	ev.SetCode(models.ErrInvalidClient, http.StatusUnauthorized)
+	ev.SetOAuthCode(models.ErrUnauthorised, "invalid_grant")
+
+	return &Sessions{
+		ls:      ls,
+		viewErr: ev,
+	}
+}
+
+// Logout ends the session of a refresh token. When a post_logout_redirect_uri registered for the
+// client_id is provided, the user is redirected to it, along with the state parameter if one was
+// sent. The response has no content otherwise.
+//
+// POST /oauth/logout/
+func (s *Sessions) Logout(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Sessions.Logout")
+	defer span.End()
+
+	if !strings.Contains(r.Header.Get("Content-type"), "application/x-www-form-urlencoded") {
+		return ErrContentTypeNotAccepted
+	}
+
+	if err := r.ParseForm(); err != nil {
+		s.viewErr.JSON(ctx, w, ErrInvalidFormInput)
+		return nil
+	}
+
+	redirect, err := s.ls.Logout(ctx,
+		r.PostForm.Get("refresh_token"),
+		r.PostForm.Get("client_id"),
+		r.PostForm.Get("post_logout_redirect_uri"))
+	if err != nil {
+		s.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if redirect == "" {
+		return web.Respond(ctx, w, nil, http.StatusNoContent)
+	}
+
+	if state := r.PostForm.Get("state"); state != "" {
+		u, err := url.Parse(redirect)
+		if err != nil {
+			return wrap("failed to parse registered post logout redirect uri", err)
+		}
+
+		q := u.Query()
+		q.Set("state", state)
+		u.RawQuery = q.Encode()
+		redirect = u.String()
+	}
+
+	return web.Redirect(ctx, w, r, redirect, http.StatusSeeOther)
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+type testLogoutService struct {
+	logout func(ctx context.Context, refreshToken, clientID, postLogoutRedirectURI string) (string, error)
+}
+
+func (t *testLogoutService) Logout(ctx context.Context, refreshToken, clientID, postLogoutRedirectURI string) (string, error) {
+	if t.logout != nil {
+		return t.logout(ctx, refreshToken, clientID, postLogoutRedirectURI)
+	}
+
+	panic("not provided")
+}
+
+func TestSessions_Logout(t *testing.T) {
+	ls := &testLogoutService{}
+	s := NewSessions(ls)
+
+	var cases = []struct {
+		name        string
+		input       string
+		outStatus   int
+		outJSON     string
+		outLocation string
+		setup       func(*testing.T)
+	}{
+		{
+			"invalidToken",
+			"refresh_token=badtoken",
+			http.StatusUnauthorized,
+			`{"error":"unauthorised"}`,
+			"",
+			func(t *testing.T) {
+				ls.logout = func(ctx context.Context, refreshToken, clientID, uri string) (string, error) {
+					return "", models.ErrUnauthorised
+				}
+			},
+		},
+		{
+			"unregisteredRedirectURI",
+			"refresh_token=atoken&client_id=webapp&post_logout_redirect_uri=https%3A%2F%2Fevil.example.com%2F",
+			http.StatusBadRequest,
+			`{"error":"invalid_redirect_uri"}`,
+			"",
+			func(t *testing.T) {
+				ls.logout = func(ctx context.Context, refreshToken, clientID, uri string) (string, error) {
+					assert.Equal(t, "webapp", clientID)
+					assert.Equal(t, "https://evil.example.com/", uri)
+					return "", models.ErrInvalidRedirectURI
+				}
+			},
+		},
+		{
+			"noRedirect",
+			"refresh_token=atoken",
+			http.StatusNoContent,
+			"",
+			"",
+			func(t *testing.T) {
+				ls.logout = func(ctx context.Context, refreshToken, clientID, uri string) (string, error) {
+					assert.Equal(t, "atoken", refreshToken)
+					return "", nil
+				}
+			},
+		},
+		{
+			"redirectWithState",
+			"refresh_token=atoken&client_id=webapp&post_logout_redirect_uri=https%3A%2F%2Fwebapp.example.com%2Fbye&state=xyz",
+			http.StatusSeeOther,
+			"",
+			"https://webapp.example.com/bye?state=xyz",
+			func(t *testing.T) {
+				ls.logout = func(ctx context.Context, refreshToken, clientID, uri string) (string, error) {
+					return uri, nil
+				}
+			},
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/logout/", strings.NewReader(cs.input))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			if cs.setup != nil {
+				cs.setup(t)
+			}
+
+			err := s.Logout(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.Equal(t, cs.outLocation, w.Header().Get("Location"))
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+
+			*ls = testLogoutService{}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// MFA implements a controller for the authenticators users enroll for multi-factor authentication.
+type MFA struct {
+	ms  models.MFAService
+	ts  models.TrustService
+	chs models.ChallengeService
+
+	viewErr web.Error
+}
+
+// NewMFA creates a new MFA controller. When ts is nil, trusted devices are not supported, and when chs is
+// nil, phones cannot be enrolled.
+func NewMFA(ms models.MFAService, ts models.TrustService, chs models.ChallengeService) *MFA {
+	var ev web.Error
+	ev.SetCode(ErrNotFound, http.StatusNotFound)
+	ev.SetCode(models.ErrNotFound, http.StatusNotFound)
+	ev.SetCode(models.ErrMFALocked, http.StatusTooManyRequests)
+	ev.SetLimitScope(models.ErrMFALocked, web.LimitScopeUser)
+	ev.SetCode(models.ErrTooManyMFADevices, http.StatusConflict)
+	ev.SetCode(models.ErrLastMFADevice, http.StatusConflict)
+	ev.SetCode(models.ErrInvalidChallenge, http.StatusBadRequest)
+	ev.SetCode(models.ErrInvalidChallengeCode, http.StatusBadRequest)
+
+	return &MFA{
+		ms:      ms,
+		ts:      ts,
+		chs:     chs,
+		viewErr: ev,
+	}
+}
+
+// List returns the authenticators enrolled by the authenticated user. Their secrets are never returned.
+//
+// GET /api/me/mfa/devices/
+func (m *MFA) List(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.MFA.List")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: List called without/before Authenticate", nil)
+	}
+
+	devices, err := m.ms.Devices(ctx, claims.User.ID)
+	if err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if devices == nil {
+		devices = []models.MFADevice{}
+	}
+
+	return web.Respond(ctx, w, devices, http.StatusOK)
+}
+
+// Enroll adds an authenticator to the authenticated user. The request holds the base32 encoded TOTP
+// secret the authenticator was set up with, and a code it generated to prove it. Users can enroll up
+// to the maximum number of devices configured.
+//
+// POST /api/me/mfa/devices/
+func (m *MFA) Enroll(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.MFA.Enroll")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: Enroll called without/before Authenticate", nil)
+	}
+
+	var req struct {
+		Name   string `json:"name"`
+		Secret string `json:"secret" validate:"required"`
+		Period int    `json:"period"`
+		Digits int    `json:"digits"`
+		Code   string `json:"code" validate:"required"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	d := models.MFADevice{
+		UserID: claims.User.ID,
+		Name:   req.Name,
+		Secret: req.Secret,
+		Period: req.Period,
+		Digits: req.Digits,
+	}
+	if err := m.ms.Enroll(ctx, &d, req.Code); err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, d, http.StatusCreated)
+}
+
+// EnrollPhone starts the enrollment of a phone as an MFA device of the authenticated user, sending it a
+// code by SMS. The response holds the challenge token to send along with the code to VerifyPhone. When
+// a code was sent too recently, no code is sent and the response has no challenge token, so the previous
+// enrollment must be completed instead.
+//
+// POST /api/me/mfa/phones/
+func (m *MFA) EnrollPhone(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.MFA.EnrollPhone")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: EnrollPhone called without/before Authenticate", nil)
+	}
+
+	var req struct {
+		Phone string `json:"phone" validate:"required"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	ch, err := m.chs.IssuePhone(ctx, claims.User, req.Phone)
+	if errors.Is(err, models.ErrOTPSendTooSoon) {
+		ch, err = models.Challenge{Method: models.ChallengeMethodSMS}, nil
+	}
+	if err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, ch, http.StatusAccepted)
+}
+
+// VerifyPhone completes the enrollment of a phone started by EnrollPhone with the code sent to it, adding
+// the phone to the MFA devices of the authenticated user. Codes are single use, and the enrollment must
+// be started again after too many wrong codes.
+//
+// POST /api/me/mfa/phones/verify/
+func (m *MFA) VerifyPhone(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.MFA.VerifyPhone")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: VerifyPhone called without/before Authenticate", nil)
+	}
+
+	var req struct {
+		Name      string `json:"name"`
+		Challenge string `json:"challenge_token" validate:"required"`
+		Code      string `json:"code" validate:"required"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	ch, err := m.chs.CompletePhone(ctx, req.Challenge, req.Code)
+	if err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	// the challenge must have been issued to the same user.
+	if ch.UserID != claims.User.ID {
+		m.viewErr.JSON(ctx, w, models.ErrInvalidChallenge)
+		return nil
+	}
+
+	d := models.MFADevice{
+		UserID: claims.User.ID,
+		Name:   req.Name,
+		Phone:  ch.Phone,
+	}
+	if err := m.ms.EnrollSMS(ctx, &d); err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, d, http.StatusCreated)
+}
+
+// Remove deletes an authenticator of the authenticated user. When MFA is required, the last one cannot
+// be removed.
+//
+// DELETE /api/me/mfa/devices/:device_id
+func (m *MFA) Remove(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.MFA.Remove")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: Remove called without/before Authenticate", nil)
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "device_id"), 10, 64)
+	if err != nil {
+		m.viewErr.JSON(ctx, w, ErrNotFound)
+		return nil
+	}
+
+	if err := m.ms.Remove(ctx, claims.User.ID, id); err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// RevokeTrust stops trusting all the devices the authenticated user trusted to skip the MFA step, so
+// every device must complete it on the next login. The trusted device cookie of the requesting device is
+// cleared as well.
+//
+// DELETE /api/me/mfa/trusted/
+func (m *MFA) RevokeTrust(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.MFA.RevokeTrust")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: RevokeTrust called without/before Authenticate", nil)
+	}
+
+	if err := m.ts.Revoke(ctx, claims.User.ID); err != nil {
+		m.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     trustedDeviceCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
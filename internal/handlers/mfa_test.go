@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+type testMFAService struct {
+	models.MFAService
+	enroll  func(ctx context.Context, d *models.MFADevice, code string) error
+	sms     func(ctx context.Context, d *models.MFADevice) error
+	remove  func(ctx context.Context, userID, id int64) error
+	devices func(ctx context.Context, userID int64) ([]models.MFADevice, error)
+	count   func(ctx context.Context, userID int64) (int, error)
+	verify  func(ctx context.Context, userID int64, code string) error
+}
+
+func (t *testMFAService) Enroll(ctx context.Context, d *models.MFADevice, code string) error {
+	if t.enroll != nil {
+		return t.enroll(ctx, d, code)
+	}
+
+	panic("not provided")
+}
+
+func (t *testMFAService) EnrollSMS(ctx context.Context, d *models.MFADevice) error {
+	if t.sms != nil {
+		return t.sms(ctx, d)
+	}
+
+	panic("not provided")
+}
+
+func (t *testMFAService) Remove(ctx context.Context, userID, id int64) error {
+	if t.remove != nil {
+		return t.remove(ctx, userID, id)
+	}
+
+	panic("not provided")
+}
+
+func (t *testMFAService) Devices(ctx context.Context, userID int64) ([]models.MFADevice, error) {
+	if t.devices != nil {
+		return t.devices(ctx, userID)
+	}
+
+	panic("not provided")
+}
+
+func (t *testMFAService) CountDevices(ctx context.Context, userID int64) (int, error) {
+	if t.count != nil {
+		return t.count(ctx, userID)
+	}
+
+	panic("not provided")
+}
+
+func (t *testMFAService) VerifyUser(ctx context.Context, userID int64, code string) error {
+	if t.verify != nil {
+		return t.verify(ctx, userID, code)
+	}
+
+	panic("not provided")
+}
+
+func TestMFA_Enroll(t *testing.T) {
+	ms := &testMFAService{}
+	m := NewMFA(ms, nil, nil)
+
+	ms.enroll = func(ctx context.Context, d *models.MFADevice, code string) error {
+		assert.Equal(t, int64(88), d.UserID)
+		assert.Equal(t, "123456", code)
+		if len(d.Secret) < 26 {
+			return models.ErrInvalidMFASecret
+		}
+		if len(d.Secret) > 32 {
+			return models.ErrTooManyMFADevices
+		}
+
+		d.ID, d.Method, d.Period, d.Digits = 3, models.ChallengeMethodTOTP, 30, 6
+		d.CreatedAt = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+		return nil
+	}
+
+	var cases = []struct {
+		name      string
+		content   string
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"enrolled",
+			`{"name": "phone", "secret": "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", "code": "123456"}`,
+			http.StatusCreated,
+			`{"id": 3, "user_id": 88, "name": "phone", "method": "totp", "period": 30, "digits": 6, "created_at": "2021-03-01T12:00:00Z"}`,
+		},
+		{
+			"tooManyDevices",
+			`{"name": "phone", "secret": "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZDGNBV", "code": "123456"}`,
+			http.StatusConflict,
+			`{"error": "too_many_mfa_devices"}`,
+		},
+		{
+			"secretTooShort",
+			`{"name": "phone", "secret": "GEZDGNBVGY3TQOJQ", "code": "123456"}`,
+			http.StatusBadRequest,
+			`{"error": "invalid_mfa_secret"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/me/mfa/devices/", strings.NewReader(cs.content))
+
+			err := m.Enroll(testClaimsContext(88), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestMFA_EnrollPhone(t *testing.T) {
+	ms := &testMFAService{}
+	notifier := &testNotifier{codes: make(map[int64]string)}
+	m := NewMFA(ms, nil, models.NewChallengeService(models.NewMemoryStore(models.Config{}), ms, models.Config{Notifier: notifier}))
+
+	ms.sms = func(ctx context.Context, d *models.MFADevice) error {
+		d.ID, d.Method = 5, models.ChallengeMethodSMS
+		d.CreatedAt = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+		return nil
+	}
+
+	request := func(userID int64, path, content string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(content))
+
+		handler := m.EnrollPhone
+		if strings.HasSuffix(path, "/verify/") {
+			handler = m.VerifyPhone
+		}
+		require.NoError(t, handler(testClaimsContext(userID), w, r))
+
+		return w
+	}
+
+	w := request(88, "/api/me/mfa/phones/", `{"phone": "0770090012"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	w = request(88, "/api/me/mfa/phones/", `{"phone": "+44 7700 900123"}`)
+	require.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+
+	var ch struct {
+		Token  string `json:"challenge_token"`
+		Method string `json:"method"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ch))
+	assert.Equal(t, models.ChallengeMethodSMS, ch.Method)
+	assert.NotContains(t, w.Body.String(), notifier.codes[88])
+
+	verify := func(userID int64, code string) *httptest.ResponseRecorder {
+		return request(userID, "/api/me/mfa/phones/verify/",
+			`{"name": "work", "challenge_token": "`+ch.Token+`", "code": "`+code+`"}`)
+	}
+
+	var cases = []struct {
+		name      string
+		userID    int64
+		code      string // "" standing for the code sent
+		reissue   bool   // whether to start the enrollment again first
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"wrongCode",
+			88,
+			"000000x",
+			false,
+			http.StatusBadRequest,
+			`{"error": "invalid_challenge_code"}`,
+		},
+		{
+			"otherUser",
+			99,
+			"",
+			false,
+			http.StatusBadRequest,
+			`{"error": "invalid_challenge"}`,
+		},
+		{
+			"verified",
+			88,
+			"",
+			true,
+			http.StatusCreated,
+			`{"id": 5, "user_id": 88, "name": "work", "method": "sms", "phone": "+447700900123", "created_at": "2021-03-01T12:00:00Z"}`,
+		},
+		{
+			"reused",
+			88,
+			"",
+			false,
+			http.StatusBadRequest,
+			`{"error": "invalid_challenge"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			if cs.reissue {
+				w := request(88, "/api/me/mfa/phones/", `{"phone": "+44 7700 900123"}`)
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ch))
+			}
+			if cs.code == "" {
+				cs.code = notifier.codes[88]
+			}
+
+			w := verify(cs.userID, cs.code)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestMFA_List(t *testing.T) {
+	ms := &testMFAService{}
+	m := NewMFA(ms, nil, nil)
+
+	var cases = []struct {
+		name    string
+		userID  int64
+		outJSON string
+	}{
+		{
+			"devices",
+			88,
+			`[
+				{"id": 1, "user_id": 88, "name": "phone", "method": "totp", "period": 30, "digits": 6, "created_at": "2021-03-01T12:00:00Z"},
+				{"id": 4, "user_id": 88, "name": "work", "method": "sms", "phone": "+447700900123", "created_at": "2021-03-02T12:00:00Z"}
+			]`,
+		},
+		{
+			"none",
+			99,
+			`[]`,
+		},
+	}
+
+	ms.devices = func(ctx context.Context, userID int64) ([]models.MFADevice, error) {
+		if userID != 88 {
+			return nil, nil
+		}
+
+		return []models.MFADevice{
+			{ID: 1, UserID: 88, Name: "phone", Method: models.ChallengeMethodTOTP, Secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+				Period: 30, Digits: 6, CreatedAt: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)},
+			{ID: 4, UserID: 88, Name: "work", Method: models.ChallengeMethodSMS, Phone: "+447700900123",
+				CreatedAt: time.Date(2021, 3, 2, 12, 0, 0, 0, time.UTC)},
+		}, nil
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/me/mfa/devices/", nil)
+
+			err := m.List(testClaimsContext(cs.userID), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestMFA_Remove(t *testing.T) {
+	ms := &testMFAService{}
+	m := NewMFA(ms, nil, nil)
+
+	ms.remove = func(ctx context.Context, userID, id int64) error {
+		assert.Equal(t, int64(88), userID)
+
+		switch id {
+		case 1:
+			return nil
+		case 2:
+			return models.ErrLastMFADevice
+		}
+
+		return models.ErrNotFound
+	}
+
+	var cases = []struct {
+		name      string
+		deviceID  string
+		outStatus int
+		outJSON   string
+	}{
+		{"removed", "1", http.StatusNoContent, ``},
+		{"lastDevice", "2", http.StatusConflict, `{"error": "last_mfa_device"}`},
+		{"missing", "3", http.StatusNotFound, `{"error": "not_found"}`},
+		{"badID", "phone", http.StatusNotFound, `{"error": "not_found"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodDelete, "/api/me/mfa/devices/"+cs.deviceID, nil)
+
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("device_id", cs.deviceID)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+			err := m.Remove(testClaimsContext(88), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+		})
+	}
+}
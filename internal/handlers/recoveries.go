@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// Recoveries implements a controller for the recovery of the accounts of users without MFA.
+type Recoveries struct {
+	rs models.RecoveryService
+
+	viewErr web.Error
+}
+
+// NewRecoveries creates a new Recoveries controller.
+func NewRecoveries(rs models.RecoveryService) *Recoveries {
+	var ev web.Error
+	ev.SetCodes(map[models.PublicError]int{
+		models.ErrNotFound:               http.StatusNotFound,
+		models.ErrUnauthorised:           http.StatusUnauthorized,
+		models.ErrTokenAlreadyUsed:       http.StatusUnauthorized,
+		models.ErrInvalidRecovery:        http.StatusBadRequest,
+		models.ErrInvalidRecoveryAnswers: http.StatusBadRequest,
+		models.ErrRecoveryLocked:         http.StatusTooManyRequests,
+	})
+	ev.SetLimitScope(models.ErrRecoveryLocked, web.LimitScopeUser)
+
+	return &Recoveries{
+		rs:      rs,
+		viewErr: ev,
+	}
+}
+
+// SetQuestions replaces the security questions of the authenticated user, asked when recovering the
+// account. Only a hash of the answers is kept.
+//
+// PUT /api/me/recovery/questions/
+func (rs *Recoveries) SetQuestions(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Recoveries.SetQuestions")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: SetQuestions called without/before Authenticate", nil)
+	}
+
+	var req struct {
+		Questions []models.SecurityAnswer `json:"questions"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if err := rs.rs.SetAnswers(ctx, claims.User.ID, req.Questions); err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Request sends an account recovery token to the user with the given email, if the user has no MFA
+// devices and set enough security questions.
+//
+// In enumeration-safe mode, the recovery service hides the users who cannot recover their account, so
+// the response is always 202 Accepted with the same body.
+//
+// POST /oauth/recovery/
+func (rs *Recoveries) Request(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Recoveries.Request")
+	defer span.End()
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if err := rs.rs.Request(ctx, req.Email); err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, map[string]string{"status": "accepted"}, http.StatusAccepted)
+}
+
+// Start uses the recovery token sent to the user, responding with the recovery token and the security
+// questions to answer in Complete.
+//
+// POST /oauth/recovery/start/
+func (rs *Recoveries) Start(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Recoveries.Start")
+	defer span.End()
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	rec, err := rs.rs.Start(ctx, req.Token)
+	if err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, rec, http.StatusOK)
+}
+
+// Complete sets a new password for the user recovering their account, once the answers to the security
+// questions, in the order they were given, are verified. Too many wrong answers lock the recovery of the
+// account. Like for password resets, the response contains new tokens when users are logged in after a
+// recovery; it is 204 No Content otherwise.
+//
+// POST /oauth/recovery/complete/
+func (rs *Recoveries) Complete(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Recoveries.Complete")
+	defer span.End()
+
+	var req struct {
+		Token    string   `json:"recovery_token"`
+		Answers  []string `json:"answers"`
+		Password string   `json:"password"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	tok, err := rs.rs.Complete(ctx, req.Token, req.Answers, req.Password)
+	if err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if tok.AccessToken == "" {
+		return web.Respond(ctx, w, nil, http.StatusNoContent)
+	}
+
+	return web.Respond(ctx, w, tok, http.StatusOK)
+}
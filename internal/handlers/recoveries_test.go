@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+type testRecoveryService struct {
+	models.RecoveryService
+	complete func(ctx context.Context, token string, answers []string, password string) (models.Token, error)
+}
+
+func (t *testRecoveryService) Complete(ctx context.Context, token string, answers []string, password string) (models.Token, error) {
+	if t.complete != nil {
+		return t.complete(ctx, token, answers, password)
+	}
+
+	panic("not provided")
+}
+
+func TestRecoveries_Complete(t *testing.T) {
+	rs := &testRecoveryService{}
+	c := NewRecoveries(rs)
+
+	rs.complete = func(ctx context.Context, token string, answers []string, password string) (models.Token, error) {
+		switch token {
+		case "locked":
+			return models.Token{}, models.ErrRecoveryLocked
+		case "expired":
+			return models.Token{}, models.ErrInvalidRecovery
+		}
+
+		if len(answers) != 1 || answers[0] != "rex" {
+			return models.Token{}, models.ErrInvalidRecoveryAnswers
+		}
+
+		assert.Equal(t, "7vb6sCaHrV5DfV6wE7i9QdGC", password)
+		return models.Token{}, nil
+	}
+
+	var cases = []struct {
+		name      string
+		input     string
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"recovered",
+			`{"recovery_token": "valid", "answers": ["rex"], "password": "7vb6sCaHrV5DfV6wE7i9QdGC"}`,
+			http.StatusNoContent,
+			``,
+		},
+		{
+			"wrongAnswers",
+			`{"recovery_token": "valid", "answers": ["paris"], "password": "7vb6sCaHrV5DfV6wE7i9QdGC"}`,
+			http.StatusBadRequest,
+			`{"error": "invalid_recovery_answers"}`,
+		},
+		{
+			"expired",
+			`{"recovery_token": "expired", "answers": ["rex"], "password": "7vb6sCaHrV5DfV6wE7i9QdGC"}`,
+			http.StatusBadRequest,
+			`{"error": "invalid_recovery"}`,
+		},
+		{
+			"locked",
+			`{"recovery_token": "locked", "answers": ["rex"], "password": "7vb6sCaHrV5DfV6wE7i9QdGC"}`,
+			http.StatusTooManyRequests,
+			`{"error": "recovery_locked"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/recovery/complete/", strings.NewReader(cs.input))
+
+			err := c.Complete(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+		})
+	}
+}
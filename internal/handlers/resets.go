@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// Resets implements a controller for password resets.
+type Resets struct {
+	rs models.ResetService
+
+	viewErr web.Error
+}
+
+// NewResets creates a new Resets controller.
+func NewResets(rs models.ResetService) *Resets {
+	var ev web.Error
+	ev.SetCode(models.ErrNotFound, http.StatusNotFound)
+	ev.SetCode(models.ErrUnauthorised, http.StatusUnauthorized)
+	ev.SetCode(models.ErrTokenAlreadyUsed, http.StatusUnauthorized)
+
+	return &Resets{
+		rs:      rs,
+		viewErr: ev,
+	}
+}
+
+// Request sends a password reset token to the user with the given email.
+//
+// In enumeration-safe mode, the reset service hides missing users, so the response is always 202
+// Accepted with the same body.
+//
+// POST /oauth/reset/
+func (rs *Resets) Request(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Resets.Request")
+	defer span.End()
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if err := rs.rs.Request(ctx, req.Email); err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, map[string]string{"status": "accepted"}, http.StatusAccepted)
+}
+
+// Confirm sets a new password for the user a reset token was sent to. If the reset service logs users
+// in after a reset, the response contains the new tokens; it is 204 No Content otherwise.
+//
+// POST /oauth/reset/confirm/
+func (rs *Resets) Confirm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Resets.Confirm")
+	defer span.End()
+
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	tok, err := rs.rs.Reset(ctx, req.Token, req.Password)
+	if err != nil {
+		rs.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if tok.AccessToken == "" {
+		return web.Respond(ctx, w, nil, http.StatusNoContent)
+	}
+
+	return web.Respond(ctx, w, tok, http.StatusOK)
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+type testResetService struct {
+	request func(ctx context.Context, email string) error
+	reset   func(ctx context.Context, token, password string) (models.Token, error)
+}
+
+func (t *testResetService) Request(ctx context.Context, email string) error {
+	if t.request != nil {
+		return t.request(ctx, email)
+	}
+
+	panic("not provided")
+}
+
+func (t *testResetService) Reset(ctx context.Context, token, password string) (models.Token, error) {
+	if t.reset != nil {
+		return t.reset(ctx, token, password)
+	}
+
+	panic("not provided")
+}
+
+func TestResets_Request(t *testing.T) {
+	rs := &testResetService{}
+	c := NewResets(rs)
+
+	var cases = []struct {
+		name      string
+		input     string
+		outStatus int
+		outJSON   string
+		setup     func(*testing.T)
+	}{
+		{
+			"notJSON",
+			"a dalhd lkald fkjahd lfkjasdlf ",
+			http.StatusBadRequest,
+			`{"error":"invalid_json"}`,
+			nil,
+		},
+		{
+			"missing",
+			`{"email":"missing@somewhere.com"}`,
+			http.StatusNotFound,
+			`{"error":"not_found"}`,
+			func(t *testing.T) {
+				rs.request = func(ctx context.Context, email string) error {
+					assert.Equal(t, "missing@somewhere.com", email)
+					return models.ErrNotFound
+				}
+			},
+		},
+		{
+			"exists",
+			`{"email":"someone@somewhere.com"}`,
+			http.StatusAccepted,
+			`{"status":"accepted"}`,
+			func(t *testing.T) {
+				rs.request = func(ctx context.Context, email string) error {
+					assert.Equal(t, "someone@somewhere.com", email)
+					return nil
+				}
+			},
+		},
+		{
+			// in enumeration-safe mode, the service does not report missing users.
+			"safeMissing",
+			`{"email":"missing@somewhere.com"}`,
+			http.StatusAccepted,
+			`{"status":"accepted"}`,
+			func(t *testing.T) {
+				rs.request = func(ctx context.Context, email string) error {
+					return nil
+				}
+			},
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/reset/", bytes.NewReader([]byte(cs.input)))
+
+			if cs.setup != nil {
+				cs.setup(t)
+			}
+
+			err := c.Request(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+
+			*rs = testResetService{}
+		})
+	}
+}
+
+func TestResets_Confirm(t *testing.T) {
+	rs := &testResetService{}
+	c := NewResets(rs)
+
+	var cases = []struct {
+		name      string
+		input     string
+		outStatus int
+		outJSON   string
+		setup     func(*testing.T)
+	}{
+		{
+			"tokenUsed",
+			`{"token":"atoken","password":"newpassword"}`,
+			http.StatusUnauthorized,
+			`{"error":"token_already_used"}`,
+			func(t *testing.T) {
+				rs.reset = func(ctx context.Context, token, password string) (models.Token, error) {
+					return models.Token{}, models.ErrTokenAlreadyUsed
+				}
+			},
+		},
+		{
+			"validationError",
+			`{"token":"atoken","password":""}`,
+			http.StatusBadRequest,
+			`{"error":"validation_error","fields":{"password":"required"}}`,
+			func(t *testing.T) {
+				rs.reset = func(ctx context.Context, token, password string) (models.Token, error) {
+					return models.Token{}, models.ValidationError{"password": models.ErrRequired}
+				}
+			},
+		},
+		{
+			"ok",
+			`{"token":"atoken","password":"newpassword"}`,
+			http.StatusNoContent,
+			``,
+			func(t *testing.T) {
+				rs.reset = func(ctx context.Context, token, password string) (models.Token, error) {
+					assert.Equal(t, "atoken", token)
+					assert.Equal(t, "newpassword", password)
+					return models.Token{}, nil
+				}
+			},
+		},
+		{
+			"autoLogin",
+			`{"token":"atoken","password":"newpassword"}`,
+			http.StatusOK,
+			`{"access_token":"access","refresh_token":"refresh","expires_in":3600,"token_type":"bearer"}`,
+			func(t *testing.T) {
+				rs.reset = func(ctx context.Context, token, password string) (models.Token, error) {
+					return models.Token{
+						AccessToken:  "access",
+						RefreshToken: "refresh",
+						ExpiresIn:    3600,
+						TokenType:    "bearer",
+					}, nil
+				}
+			},
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/reset/confirm/", bytes.NewReader([]byte(cs.input)))
+
+			if cs.setup != nil {
+				cs.setup(t)
+			}
+
+			err := c.Confirm(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+
+			*rs = testResetService{}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
@@ -13,22 +16,311 @@ import (
 	"github.com/noelruault/golang-authentication/internal/web"
 )
 
-// API constructs an http.Handler with all application routes defined.
+// Config holds the settings required to construct the API.
+type Config struct {
+	// JWTSecret is used to sign the JWT tokens used to identify users.
+	JWTSecret []byte
+
+	// Web tunes how the application serves requests.
+	Web web.Config
+
+	// Auth tunes the authentication middleware.
+	Auth mw.AuthConfig
+
+	// Log tunes the request logger.
+	Log mw.LogConfig
+
+	// Compress tunes the compression of the responses.
+	Compress mw.CompressConfig
+
+	// OAuth tunes the behaviour of the OAuth endpoints.
+	OAuth OAuthConfig
+
+	// Users tunes the behaviour of the user service.
+	Users models.Config
+
+	// Ephemeral keeps the short-lived state of the flows spanning several requests, such as the login
+	// challenges. Nil keeps it in memory.
+	Ephemeral models.EphemeralStore
+
+	// BodyReadTimeout is the maximum time taken to receive the body of the signup and token requests.
+	// Zero disables the limit, leaving only the server read timeout.
+	BodyReadTimeout time.Duration
+
+	// Maintenance rejects the requests changing the state of the service, such as signups, updates and
+	// token requests, while read requests keep working. MaintenanceRetryAfter is sent to clients as the
+	// time to wait before retrying.
+	Maintenance           bool
+	MaintenanceRetryAfter time.Duration
+
+	// MaxURLLength is the maximum length in bytes of the request URLs, path and query string included.
+	// Longer ones are rejected with a uri_too_long error. Zero disables the limit.
+	MaxURLLength int
+
+	// MaxJSONDepth and MaxJSONTokens limit the nesting depth and the number of tokens of the JSON request
+	// bodies, rejected with a payload_too_complex error when exceeded. Zero is unlimited.
+	MaxJSONDepth  int
+	MaxJSONTokens int
+
+	// TokenCacheControl is the Cache-Control header of the responses holding tokens, such as the ones of
+	// the token endpoint, which are also sent with `Pragma: no-cache`. Empty uses no-store.
+	TokenCacheControl string
+}
+
+// minJWTSecretBytes is the minimum length of the JWT secret, the size of the HS512 hash output
+// RFC 7518 requires of its keys.
+const minJWTSecretBytes = 64
+
+// Validate checks the settings of c, those of the user service included, so misconfigurations are
+// reported at startup instead of on the first requests. It returns a models.ConfigErrors listing every
+// invalid or dangerous setting found, or nil when there is none.
+func (c Config) Validate() error {
+	var errs models.ConfigErrors
+	if err := c.Users.Validate(); err != nil {
+		cerrs, ok := err.(models.ConfigErrors)
+		if !ok {
+			return err
+		}
+		errs = append(errs, cerrs...)
+	}
+
+	if len(c.JWTSecret) == 0 {
+		errs = append(errs, "JWTSecret is empty, so the tokens cannot be signed")
+	} else if len(c.JWTSecret) < minJWTSecretBytes {
+		errs = append(errs, fmt.Sprintf("JWTSecret is shorter than %d bytes", minJWTSecretBytes))
+	}
+	if !c.OAuth.DisableSignups && !c.OAuth.UnverifiedSignups {
+		errs = append(errs, "signups are enabled but the emails of the users signing up are not verified")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	sort.Strings(errs)
+	return errs
+}
+
+// OAuthConfig holds the settings used to tune the OAuth endpoints.
+type OAuthConfig struct {
+	// FormClientCredentials lets the client_id and client_secret form fields take precedence over the
+	// HTTP Basic credentials when a request provides both. Basic credentials are preferred otherwise.
+	FormClientCredentials bool
+
+	// EnumerationSafe makes the signup endpoint respond the same way whether the email is taken or not.
+	// It should match the EnumerationSafe setting of the user service, which covers logins and password
+	// resets.
+	EnumerationSafe bool
+
+	// RejectDuplicateParams rejects the token and device authorization requests sending a parameter
+	// such as grant_type or scope more than once with an invalid_form error, instead of using the first
+	// value.
+	RejectDuplicateParams bool
+
+	// MaxRequestedScopes is the maximum number of distinct scopes a grant request can ask for. Requests
+	// over it are rejected with a too_many_scopes error. Zero is unlimited.
+	MaxRequestedScopes int
+
+	// TokenGrants includes the scopes granted and the roles of the user in the token responses of the
+	// logins, saving clients a lookup of the user once logged in. Roles are resolved with Roles, and are
+	// always empty when it is nil. The service keeps no roles itself, so Roles is only set by the programs
+	// embedding the API, not by cmd/api.
+	TokenGrants bool
+	Roles       models.RoleProvider
+
+	// TokenScope includes the scopes granted as the "scope" field of the token responses of the logins
+	// granted other scopes than the ones requested, such as the logins narrowed down by RoleScopes. The
+	// field is left out when the scopes requested are granted as they are.
+	TokenScope bool
+
+	// RoleScopes maps the roles of the users to the scopes they imply. The tokens of a user with any of
+	// these roles get the scopes of all of them by default, and a request for scopes narrows them down to
+	// the ones requested among them. The requests of users without any of these roles are granted as
+	// they are. Roles are resolved with Roles, and RoleScopes is ignored when it is nil, so it has no
+	// cmd/api setting either.
+	RoleScopes map[string][]string
+
+	// IDTokens issues an OpenID Connect ID token, as the "id_token" field of the token responses, to the
+	// logins granted the openid scope. The profile and email claims of the user are included when the
+	// profile and email scopes are granted too.
+	IDTokens bool
+
+	// AuthMethods includes how the users logged in in their ID tokens. The amr claim lists the methods
+	// used: "pwd" for the password, along with "otp" or "sms" and "mfa" once a login challenge or MFA step
+	// is completed. The acr claim is SingleFactorClass or MultiFactorClass, depending on whether a second
+	// factor was completed, and it is left out when empty. The logins of devices, whose users
+	// authenticated elsewhere, get neither claim.
+	AuthMethods       bool
+	SingleFactorClass string
+	MultiFactorClass  string
+
+	// SilentAuth honours the OpenID Connect prompt=none parameter of the token requests: only the active
+	// sessions are continued, and the requests needing the user to log in or to interact get
+	// login_required and interaction_required errors.
+	SilentAuth bool
+
+	// EnforceMaxAge honours the OpenID Connect max_age parameter of the refresh requests, requiring a
+	// fresh login when the session started longer ago than the number of seconds it holds.
+	EnforceMaxAge bool
+
+	// StandardErrors makes the token, device authorization and logout endpoints respond their errors as
+	// described by OAuth 2.0, with the standard error codes such as invalid_grant along with the
+	// "error_description" and "error_uri" fields, instead of the format used by the rest of the API.
+	// The "error_uri" is ErrorURI followed by the public error code, and it is not sent when empty.
+	StandardErrors bool
+	ErrorURI       string
+
+	// PrincipalType includes the kind of principal the access token represents, such as "user", as the
+	// "principal_type" field of the responses describing the authenticated principal or its token.
+	PrincipalType bool
+
+	// KnownScopes lists the scopes the service grants. Requests for any other scope are rejected with an
+	// invalid_scope error. Empty accepts any scope.
+	KnownScopes []string
+
+	// GrantScopes maps the grant types, such as "client_credentials", to the only scopes that can be
+	// requested with them, so scopes meant for users cannot be obtained by clients on their own for
+	// instance. Requests for any other scope are rejected with an invalid_scope error. Grant types not
+	// present can request any scope, and the device authorization requests are checked against the
+	// scopes of the device code grant.
+	GrantScopes map[string][]string
+
+	// Captcha verifies the CAPTCHA solutions sent by clients. Nil disables the CAPTCHA checks.
+	Captcha CaptchaVerifier
+
+	// SignupCaptchaThreshold is the number of signups failing validation from the same IP within
+	// SignupFailureWindow after which the signups from that IP must solve a CAPTCHA. Zero never
+	// requires a CAPTCHA. SignupFailureWindow defaults to one hour.
+	SignupCaptchaThreshold int
+	SignupFailureWindow    time.Duration
+
+	// MaxSignupsPerIP is the number of users that can be created from the same IP within SignupWindow.
+	// Further signups from that IP are rejected until the window ends. Zero is unlimited. SignupWindow
+	// defaults to one hour.
+	MaxSignupsPerIP int
+	SignupWindow    time.Duration
+
+	// DisableSignups rejects the signups with a signups_disabled error. The service does not verify the
+	// emails of the users signing up, so Config.Validate reports open signups unless UnverifiedSignups
+	// accepts them.
+	DisableSignups    bool
+	UnverifiedSignups bool
+
+	// ClientRegistration enables the dynamic client registration endpoint. When RegistrationToken is
+	// set, clients must send it as a bearer token to register.
+	ClientRegistration bool
+	RegistrationToken  string
+
+	// SecretRotationOverlap is how long the secret replaced when a client rotates its secret is still
+	// accepted. Zero invalidates it at once.
+	SecretRotationOverlap time.Duration
+
+	// DeviceVerificationURI is the page where users enter the user codes shown by the devices using the
+	// device authorization grant, calling the device verification endpoint. The grant is disabled when
+	// it is empty.
+	DeviceVerificationURI string
+
+	// RiskAssessor evaluates the password logins once their credentials are verified. Logins with risk
+	// signals get a challenge issued through Challenges instead of tokens. Challenges are disabled
+	// unless both are set.
+	RiskAssessor models.RiskAssessor
+	Challenges   models.ChallengeService
+
+	// MFA, when set, makes the password logins of the users with MFA devices complete an MFA step,
+	// issued through Challenges, before getting their tokens.
+	MFA models.MFAService
+
+	// Trust, when set, lets users completing the MFA step trust their device, which then skips the step
+	// until the trust expires or is revoked. Trusted devices are marked with a signed cookie.
+	Trust models.TrustService
+
+	// Now returns the current time. It defaults to time.Now and is meant to be replaced in tests.
+	Now func() time.Time
+}
+
+// now returns the current time, as reported by c.Now when set.
+func (c OAuthConfig) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+
+	return time.Now()
+}
+
+// API constructs a web.App with all application routes defined, the caller draining it before shutting
+// down. The audit service as is owned by the caller, which must close it on shutdown to write the
+// buffered events.
 func API(
 	shutdown chan os.Signal,
 	log *log.Logger,
 	db *gorm.DB,
-	JWTSecret []byte,
-) http.Handler {
+	as models.AuditService,
+	cfg Config,
+) *web.App {
 
 	r := chi.NewRouter()
 	r.Mount("/api/", r)
 
+	// Writes are rejected for every route while in maintenance.
+	var maintenance web.Middleware
+	if cfg.Maintenance {
+		maintenance = mw.Maintenance(cfg.MaintenanceRetryAfter)
+	}
+
 	// Construct the web.App which holds all routes as well as common Middleware and router.
-	app := web.NewApp(shutdown, log, r, mw.Logger(log), mw.Errors(log), mw.Metrics(), mw.Panics(log))
+	app := web.NewApp(shutdown, log, r, cfg.Web, mw.Logger(log, cfg.Log), mw.Compress(cfg.Compress), mw.Errors(log), mw.Metrics(), mw.Panics(log), mw.MaxURLLength(cfg.MaxURLLength), mw.JSONLimits(cfg.MaxJSONDepth, cfg.MaxJSONTokens), maintenance)
 
 	// Model services
-	usm := models.NewUserService(db, JWTSecret)
+	usm := models.NewUserService(db, cfg.JWTSecret, cfg.Users)
+	csm := models.NewClientService(db, cfg.JWTSecret)
+	aks := models.NewAPIKeyService(db, cfg.Users)
+
+	ephemeral := cfg.Ephemeral
+	if ephemeral == nil {
+		ephemeral = models.NewMemoryStore(cfg.Users)
+	}
+
+	var dsm models.DeviceService
+	if cfg.OAuth.DeviceVerificationURI != "" {
+		dsm = models.NewDeviceService(db, cfg.Users)
+	}
+
+	// risky logins are challenged with a code delivered to the users, when there is a way to, and the
+	// logins of the users with MFA devices complete an MFA step, unless their device is trusted.
+	oauth := cfg.OAuth
+	if cfg.Users.Notifier == nil {
+		oauth.RiskAssessor = nil
+	}
+	if oauth.MFA == nil {
+		oauth.MFA = models.NewMFAService(db, cfg.Users)
+	}
+	if oauth.Trust == nil && cfg.Users.MFATrustDuration > 0 {
+		oauth.Trust = models.NewTrustService(usm, cfg.JWTSecret, cfg.Users)
+	}
+	if oauth.Challenges == nil {
+		oauth.Challenges = models.NewChallengeService(ephemeral, oauth.MFA, cfg.Users)
+	}
+
+	// Route middlewares, composed once and shared by the routes requiring them.
+	// API keys authenticate the users as their access tokens do, except to manage the API keys, so a
+	// leaked key cannot be used to create others.
+	auth := cfg.Auth
+	auth.APIKeys = aks
+	authenticated := mw.Authenticate(usm, auth)
+	tokenOnly := mw.Authenticate(usm, cfg.Auth)
+
+	// The routes describing the token itself also accept the tokens clients got on their own behalf.
+	anyPrincipal := auth
+	anyPrincipal.Clients = csm
+	principals := mw.Authenticate(usm, anyPrincipal)
+	owner := web.Chain(authenticated, mw.Me())
+	bodyTimeout := mw.BodyTimeout(cfg.BodyReadTimeout)
+	noStore := mw.NoStore(cfg.TokenCacheControl)
+
+	var oauthErrors web.Middleware
+	if cfg.OAuth.StandardErrors {
+		oauthErrors = mw.OAuthErrors(cfg.OAuth.ErrorURI)
+	}
 
 	{
 		// Register health check handler. This route is not authenticated.
@@ -37,15 +329,83 @@ func API(
 		app.Handle(http.MethodGet, "/health/", c.Health)
 	}
 	{
-		usvc := NewUsers(usm, log)
-		app.Handle(http.MethodPost, "/users/", usvc.Create)
+		usvc := NewUsers(usm, csm, dsm, as, oauth, log)
+		app.Handle(http.MethodPost, "/users/", usvc.Create, bodyTimeout)
 		app.Handle(http.MethodGet, "/users/{user_id}", usvc.ByID)
 		app.Handle(http.MethodGet, "/users/", usvc.List)
 		app.Handle(http.MethodPut, "/users/{user_id}", usvc.Update)
-		app.Handle(http.MethodDelete, "/users/{user_id}", usvc.Delete, mw.Authenticate(usm), mw.Me())
+		app.Handle(http.MethodDelete, "/users/{user_id}", usvc.Delete, owner)
+		app.Handle(http.MethodGet, "/me/", usvc.Me, authenticated)
+		app.Handle(http.MethodGet, "/userinfo/", usvc.UserInfo, authenticated)
+
+		app.Handle(http.MethodPost, "/oauth/login/", usvc.Login, oauthErrors, noStore, bodyTimeout)
+		app.Handle(http.MethodPost, "/oauth/login/bench/", usvc.BenchLogin, noStore, mw.Deprecated(mw.Deprecation{})) // Used to benchmark. Instructional use only.
+		app.Handle(http.MethodPost, "/oauth/scopes/", usvc.CheckScopes, principals)
+		app.Handle(http.MethodGet, "/oauth/jwks/", usvc.Keys)
+		app.Handle(http.MethodGet, "/oauth/token/info/", usvc.TokenInfo, principals, noStore)
+
+		if dsm != nil {
+			app.Handle(http.MethodPost, "/oauth/device/", usvc.DeviceAuthorize, oauthErrors, noStore, bodyTimeout)
+			app.Handle(http.MethodPost, "/oauth/device/verify/", usvc.DeviceVerify, authenticated)
+		}
+	}
+	{
+		csvc := NewClients(csm, cfg.OAuth)
+		app.Handle(http.MethodPost, "/oauth/clients/secret/", csvc.RotateSecret, noStore, bodyTimeout)
+
+		if cfg.OAuth.ClientRegistration {
+			app.Handle(http.MethodPost, "/oauth/register/", csvc.Register, noStore, bodyTimeout)
+		}
+	}
+	{
+		asvc := NewAuthorizations(models.NewConsentService(db, cfg.Users), usm)
+		app.Handle(http.MethodGet, "/me/authorizations", asvc.List, authenticated)
+		app.Handle(http.MethodDelete, "/me/authorizations/{client_id}", asvc.Revoke, authenticated)
+	}
+	{
+		msvc := NewMFA(oauth.MFA, oauth.Trust, oauth.Challenges)
+		app.Handle(http.MethodGet, "/me/mfa/devices/", msvc.List, authenticated)
+		app.Handle(http.MethodPost, "/me/mfa/devices/", msvc.Enroll, authenticated)
+		app.Handle(http.MethodDelete, "/me/mfa/devices/{device_id}", msvc.Remove, authenticated)
+
+		if oauth.Trust != nil {
+			app.Handle(http.MethodDelete, "/me/mfa/trusted/", msvc.RevokeTrust, authenticated)
+		}
+		if cfg.Users.Notifier != nil {
+			// Phones are verified with a code sent to them before being enrolled.
+			app.Handle(http.MethodPost, "/me/mfa/phones/", msvc.EnrollPhone, authenticated)
+			app.Handle(http.MethodPost, "/me/mfa/phones/verify/", msvc.VerifyPhone, authenticated)
+		}
+	}
+	{
+		aksvc := NewAPIKeys(aks)
+		app.Handle(http.MethodPost, "/me/api-keys/", aksvc.Create, noStore, tokenOnly)
+		app.Handle(http.MethodDelete, "/me/api-keys/{key_id}", aksvc.Revoke, tokenOnly)
+	}
+	if cfg.Users.Issuer != "" {
+		// The discovery document needs the URL the clients reach the service at.
+		dsvc := NewDiscovery(cfg.Users, oauth)
+		app.Handle(http.MethodGet, "/.well-known/openid-configuration", dsvc.OpenIDConfiguration)
+	}
+	{
+		ssvc := NewSessions(models.NewLogoutService(usm, csm, cfg.JWTSecret, cfg.Users))
+		app.Handle(http.MethodPost, "/oauth/logout/", ssvc.Logout, oauthErrors)
+	}
+	if cfg.Users.Notifier != nil {
+		// Password resets need a way to deliver the reset tokens to users.
+		ats := models.NewActionTokenService(db, cfg.JWTSecret, cfg.Users)
+		rsm := models.NewResetService(usm, ats, cfg.Users)
+
+		rsvc := NewResets(rsm)
+		app.Handle(http.MethodPost, "/oauth/reset/", rsvc.Request)
+		app.Handle(http.MethodPost, "/oauth/reset/confirm/", rsvc.Confirm, noStore)
 
-		app.Handle(http.MethodPost, "/oauth/login/", usvc.Login)
-		app.Handle(http.MethodPost, "/oauth/login/bench/", usvc.BenchLogin) // Used to benchmark. Instructional use only.
+		// Account recoveries send their tokens the same way, for the users without MFA.
+		rcvc := NewRecoveries(models.NewRecoveryService(db, usm, ats, oauth.MFA, ephemeral, cfg.Users))
+		app.Handle(http.MethodPut, "/me/recovery/questions/", rcvc.SetQuestions, authenticated)
+		app.Handle(http.MethodPost, "/oauth/recovery/", rcvc.Request)
+		app.Handle(http.MethodPost, "/oauth/recovery/start/", rcvc.Start)
+		app.Handle(http.MethodPost, "/oauth/recovery/complete/", rcvc.Complete, noStore)
 	}
 
 	return app
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	secret := bytes.Repeat([]byte("s"), minJWTSecretBytes)
+
+	var cases = []struct {
+		name      string
+		cfg       Config
+		outErrors models.ConfigErrors
+	}{
+		{
+			"valid",
+			Config{JWTSecret: secret, OAuth: OAuthConfig{UnverifiedSignups: true}},
+			nil,
+		},
+		{
+			"signupsDisabled",
+			Config{JWTSecret: secret, OAuth: OAuthConfig{DisableSignups: true}},
+			nil,
+		},
+		{
+			"missingSecret",
+			Config{OAuth: OAuthConfig{DisableSignups: true}},
+			models.ConfigErrors{"JWTSecret is empty, so the tokens cannot be signed"},
+		},
+		{
+			"shortSecret",
+			Config{JWTSecret: []byte("secret"), OAuth: OAuthConfig{DisableSignups: true}},
+			models.ConfigErrors{"JWTSecret is shorter than 64 bytes"},
+		},
+		{
+			"unverifiedSignups",
+			Config{JWTSecret: secret},
+			models.ConfigErrors{"signups are enabled but the emails of the users signing up are not verified"},
+		},
+		{
+			"users",
+			Config{
+				OAuth: OAuthConfig{DisableSignups: true},
+				Users: models.Config{PasswordCost: 4},
+			},
+			models.ConfigErrors{
+				"JWTSecret is empty, so the tokens cannot be signed",
+				"PasswordCost is lower than the bcrypt cost of 10",
+			},
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			err := cs.cfg.Validate()
+			if cs.outErrors == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.IsType(t, models.ConfigErrors{}, err)
+			assert.Equal(t, cs.outErrors, err)
+		})
+	}
+}
+
+func TestAPI_NoStore(t *testing.T) {
+	cfg := Config{
+		JWTSecret: []byte("secret"),
+		OAuth: OAuthConfig{
+			ClientRegistration:    true,
+			RegistrationToken:     "initial",
+			DeviceVerificationURI: "https://example.com/device",
+		},
+	}
+	app := API(make(chan os.Signal, 1), log.New(io.Discard, "", 0), nil, nil, cfg)
+
+	// the requests are rejected or fail without a database, and the headers are sent all the same.
+	var cases = []struct {
+		method          string
+		path            string
+		outCacheControl string
+	}{
+		{http.MethodPost, "/api/oauth/login/", "no-store"},
+		{http.MethodPost, "/api/oauth/device/", "no-store"},
+		{http.MethodPost, "/api/oauth/clients/secret/", "no-store"},
+		{http.MethodPost, "/api/oauth/register/", "no-store"},
+		{http.MethodPost, "/api/me/api-keys/", "no-store"},
+		{http.MethodGet, "/api/oauth/jwks/", ""},
+	}
+	for _, cs := range cases {
+		t.Run(cs.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(cs.method, cs.path, nil)
+			app.ServeHTTP(w, r)
+
+			assert.Equal(t, cs.outCacheControl, w.Header().Get("Cache-Control"))
+		})
+	}
+}
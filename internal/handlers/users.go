@@ -2,16 +2,21 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/schema"
 	"go.opencensus.io/trace"
 
+	mw "github.com/noelruault/golang-authentication/internal/middleware"
 	"github.com/noelruault/golang-authentication/internal/models"
 	"github.com/noelruault/golang-authentication/internal/web"
 )
@@ -19,29 +24,107 @@ import (
 // Users implements a controller for authentication, authorisation and
 // user management.
 type Users struct {
-	us models.UserService
+	us  models.UserService
+	cs  models.ClientService
+	ds  models.DeviceService
+	as  models.AuditService
+	cfg OAuthConfig
 
 	viewErr web.Error
 	log     *log.Logger
+
+	// signupFailures counts the signups failing validation, by IP.
+	signupFailures *failureCounter
+
+	// signups counts the users created, by IP.
+	signups *failureCounter
 }
 
-// NewUsers creates a new Users controller.
-func NewUsers(us models.UserService, log *log.Logger) *Users {
+// NewUsers creates a new Users controller. When as is not nil, logins are recorded as audit events.
+// When ds is nil, the device authorization grant is not supported.
+func NewUsers(us models.UserService, cs models.ClientService, ds models.DeviceService, as models.AuditService, cfg OAuthConfig, log *log.Logger) *Users {
 	var ev web.Error
 	ev.SetCode(models.ErrDuplicate, http.StatusConflict)
 	ev.SetCode(ErrNotFound, http.StatusNotFound)
 	ev.SetCode(models.ErrNotFound, http.StatusNotFound)
 	ev.SetCode(models.ErrUnauthorised, http.StatusUnauthorized)
+	ev.SetCode(models.ErrInvalidClient, http.StatusUnauthorized)
+	ev.SetCode(models.ErrClientDisabled, http.StatusUnauthorized)
+	ev.SetCode(models.ErrReauthRequired, http.StatusUnauthorized)
+	ev.SetCode(ErrLoginRequired, http.StatusUnauthorized)
+	ev.SetCode(ErrInteractionRequired, http.StatusUnauthorized)
+	ev.SetCode(ErrInsufficientScope, http.StatusForbidden)
+	ev.SetCode(mw.ErrBodyTimeout, http.StatusRequestTimeout)
+	ev.SetCode(ErrCaptchaRequired, http.StatusForbidden)
+	ev.SetCode(ErrSignupRateLimited, http.StatusTooManyRequests)
+	ev.SetCode(ErrSignupsDisabled, http.StatusForbidden)
+	ev.SetCode(models.ErrTooManyDeviceCodes, http.StatusTooManyRequests)
+	ev.SetCode(models.ErrMFALocked, http.StatusTooManyRequests)
+	ev.SetCode(models.ErrTooManyConcurrentLogins, http.StatusTooManyRequests)
+	ev.SetLimitScope(ErrSignupRateLimited, web.LimitScopeIP)
+	ev.SetLimitScope(models.ErrTooManyConcurrentLogins, web.LimitScopeUser)
+	ev.SetLimitScope(models.ErrTooManyDeviceCodes, web.LimitScopeClient)
+	ev.SetLimitScope(models.ErrSlowDown, web.LimitScopeGrant)
+	ev.SetLimitScope(models.ErrMFALocked, web.LimitScopeUser)
+	ev.SetOAuthCodes(map[models.PublicError]string{
+		models.ErrUnauthorised:     "invalid_grant",
+		models.ErrReauthRequired:   "invalid_grant",
+		models.ErrRefreshInvalid:   "invalid_grant",
+		models.ErrRefreshExpired:   "invalid_grant",
+		models.ErrInvalidChallenge: "invalid_grant",
+		models.ErrClientDisabled:   "unauthorized_client",
+		ErrTooManyScopes:           "invalid_scope",
+	})
 
 	return &Users{
-		us:      us,
-		viewErr: ev,
-		log:     log,
+		us:             us,
+		cs:             cs,
+		ds:             ds,
+		as:             as,
+		cfg:            cfg,
+		viewErr:        ev,
+		log:            log,
+		signupFailures: newFailureCounter(cfg.SignupFailureWindow),
+		signups:        newFailureCounter(cfg.SignupWindow),
 	}
 }
 
 // Login takes a username and password or a refresh token and returns a set of
-// access and refresh tokens.
+// access and refresh tokens. With the client_credentials grant, it authenticates
+// a registered client and returns an access token identifying the client itself.
+// With the device_code grant, devices poll for the tokens of the user approving
+// them, getting an authorization_pending error until the user decides.
+//
+// Password logins showing risk signals get a challenge_required response with a
+// challenge token instead of tokens, when challenges are configured. The client
+// completes the login sending the challenge token along with the code sent to the
+// user, using the challenge grant. Users with MFA devices get an mfa_required
+// response instead, completed the same way with a code of their authenticator,
+// unless their device is trusted. Users whose only MFA devices are phones get
+// the sms method, and the code is sent to their phone. Sending trust_device=true
+// along with the code trusts the device, setting the trusted device cookie.
+// Logins needing a code sent too soon after the last one get the same response
+// without a challenge token, and complete the challenge they got before.
+//
+// When configured to include the grants, the responses to the logins of users
+// also hold the scopes granted and the roles of the user.
+//
+// When configured for silent authentication, sending prompt=none never involves
+// the user: only the refresh_token grant, continuing an active session, can issue
+// tokens. It gets a login_required error when the session is no longer active, and
+// the other grants of users get an interaction_required error.
+//
+// When configured to issue ID tokens, the logins granted the openid scope also get
+// an OpenID Connect ID token, echoing the nonce parameter sent with the request.
+//
+// When configured to enforce it, the max_age parameter of the refresh_token grant
+// is the maximum number of seconds since the user logged in to start the session.
+// Older sessions get a reauth_required error, or login_required when silent.
+//
+// Clients may authenticate with HTTP Basic credentials or with the client_id and
+// client_secret form fields. When client credentials are provided, they are always
+// verified, whatever the grant type. The refresh tokens issued to a client can only
+// be exchanged by the same client authenticating.
 //
 // Login takes care of its own Content-Types as it is not a standard API call. No
 // middlewares for content types should be applied to Login.
@@ -54,9 +137,19 @@ func (u *Users) Login(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	var decoder = schema.NewDecoder()
 	var auth struct {
 		Email        string `schema:"email"`
-		GrantType    string `schema:"grant_type, required"` // password, refresh_token
+		GrantType    string `schema:"grant_type, required"` // password, refresh_token, client_credentials, device_code
 		Password     string `schema:"password"`
 		RefreshToken string `schema:"refresh_token"`
+		DeviceCode   string `schema:"device_code"`
+		Challenge    string `schema:"challenge_token"`
+		Code         string `schema:"code"`
+		TrustDevice  bool   `schema:"trust_device"`
+		ClientID     string `schema:"client_id"`
+		ClientSecret string `schema:"client_secret"`
+		Scope        string `schema:"scope"`
+		Prompt       string `schema:"prompt"`
+		MaxAge       string `schema:"max_age"`
+		Nonce        string `schema:"nonce"`
 	}
 
 	if !strings.Contains(r.Header.Get("Content-type"), "application/x-www-form-urlencoded") {
@@ -65,10 +158,26 @@ func (u *Users) Login(ctx context.Context, w http.ResponseWriter, r *http.Reques
 
 	err := r.ParseForm()
 	if err != nil {
+		if errors.Is(err, mw.ErrBodyTimeout) {
+			u.viewErr.JSON(ctx, w, mw.ErrBodyTimeout)
+			return nil
+		}
+
 		u.viewErr.JSON(ctx, w, fmt.Errorf("ParseForm: couldn't parse given form %w", err))
 		return nil
 	}
 
+	if u.cfg.RejectDuplicateParams && duplicateParam(r.PostForm, tokenParams...) {
+		u.viewErr.JSON(ctx, w, ErrInvalidFormInput)
+		return nil
+	}
+
+	// a missing grant type is a malformed request, told apart from the grant types not supported.
+	if r.PostForm.Get("grant_type") == "" {
+		u.viewErr.JSON(ctx, w, ErrGrantTypeMissing)
+		return nil
+	}
+
 	// r.PostForm is a map of POST form values
 	err = decoder.Decode(&auth, r.PostForm)
 	if err != nil {
@@ -76,47 +185,502 @@ func (u *Users) Login(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		return nil
 	}
 
-	var user models.User
+	// the scopes are checked before any work is done for the request.
+	if err := u.checkScopes(auth.GrantType, requestedScopes(auth.Scope)); err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	// a silent authentication can only continue an active session, as the other grants of users involve them.
+	silent := u.cfg.SilentAuth && auth.Prompt == "none"
+	if silent && auth.GrantType != "refresh_token" && auth.GrantType != "client_credentials" {
+		u.viewErr.JSON(ctx, w, ErrInteractionRequired)
+		return nil
+	}
+
+	clientID, clientSecret, err := clientCredentials(r, auth.ClientID, auth.ClientSecret, u.cfg)
+	if err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	var client models.Client
+	if clientID != "" || auth.GrantType == "client_credentials" || auth.GrantType == grantTypeDeviceCode {
+		client, err = u.cs.Authenticate(ctx, clientID, clientSecret)
+		if err != nil {
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+	}
+
+	if auth.GrantType == "client_credentials" {
+		token, err := u.cs.Token(ctx, &client)
+		if err != nil {
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+
+		return web.Respond(ctx, w, token, http.StatusOK)
+	}
+
+	// amr is how the user authenticated, left nil when it is not known, such as for the devices.
+	var (
+		user models.User
+		amr  []string
+	)
 	if auth.GrantType == "password" {
 		user, err = u.us.Authenticate(ctx, auth.Email, auth.Password)
+		if err != nil {
+			u.audit(ctx, models.AuditEvent{Action: "login_failed", ClientID: client.ID})
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+
+		ch, err := u.mfaChallenge(ctx, r, user, client, auth.Scope)
+		if err != nil {
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+
+		if ch.Method != "" {
+			u.audit(ctx, models.AuditEvent{Action: "login_mfa", UserID: user.ID, ClientID: client.ID})
+			return web.Respond(ctx, w, loginChallenge{Error: "mfa_required", NextAction: web.NextAction(ctx, "mfa_required"), Challenge: ch}, http.StatusUnauthorized)
+		}
+
+		ch, err = u.challenge(ctx, r, user, client, auth.Scope)
 		if err != nil {
 			u.viewErr.JSON(ctx, w, err)
 			return nil
 		}
+
+		if ch.Method != "" {
+			u.audit(ctx, models.AuditEvent{Action: "login_challenged", UserID: user.ID, ClientID: client.ID})
+			return web.Respond(ctx, w, loginChallenge{Error: "challenge_required", NextAction: web.NextAction(ctx, "challenge_required"), Challenge: ch}, http.StatusUnauthorized)
+		}
+
+		amr = []string{models.AuthMethodPassword}
+		u.audit(ctx, models.AuditEvent{Action: "login", UserID: user.ID, ClientID: client.ID})
 	} else if auth.GrantType == "refresh_token" {
-		user, err = u.us.Refresh(ctx, auth.RefreshToken)
+		var token models.Token
+		opts := models.RotateOptions{Scope: auth.Scope, ClientID: client.ID}
+		if auth.MaxAge != "" && u.cfg.EnforceMaxAge {
+			opts.MaxAge, err = maxAge(auth.MaxAge)
+		}
+		if err == nil {
+			token, err = u.us.RotateWith(ctx, auth.RefreshToken, opts)
+		}
+		if silent && (errors.Is(err, models.ErrNoCredentials) || errors.Is(err, models.ErrUnauthorised) || errors.Is(err, models.ErrReauthRequired)) {
+			err = ErrLoginRequired
+		}
+		if err != nil {
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+
+		return web.Respond(ctx, w, token, http.StatusOK)
+	} else if auth.GrantType == grantTypeDeviceCode && u.ds != nil {
+		da, err := u.ds.Poll(ctx, auth.DeviceCode, client.ID)
+		if err != nil {
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+
+		user, err = u.us.ByID(ctx, da.UserID)
+		if err != nil {
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+
+		// the token gets the scopes the user approved, not the ones sent while polling.
+		auth.Scope = da.Scope
+		u.audit(ctx, models.AuditEvent{Action: "login_device", UserID: user.ID, ClientID: client.ID})
+	} else if auth.GrantType == grantTypeChallenge && u.cfg.Challenges != nil {
+		ch, err := u.cfg.Challenges.Complete(ctx, auth.Challenge, auth.Code)
 		if err != nil {
 			u.viewErr.JSON(ctx, w, err)
 			return nil
 		}
+
+		// only the client the challenge was issued to can complete it.
+		if ch.ClientID != client.ID {
+			u.viewErr.JSON(ctx, w, models.ErrInvalidChallenge)
+			return nil
+		}
+
+		user, err = u.us.ByID(ctx, ch.UserID)
+		if err != nil {
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+
+		if ch.Method != models.ChallengeMethodEmail && auth.TrustDevice {
+			if err := u.trustDevice(ctx, w, user.ID); err != nil {
+				u.viewErr.JSON(ctx, w, err)
+				return nil
+			}
+		}
+
+		// the token gets the scopes of the challenged login.
+		auth.Scope = ch.Scope
+		amr = authMethods(ch.Method)
+		u.audit(ctx, models.AuditEvent{Action: "login", UserID: user.ID, ClientID: client.ID})
 	} else {
 		u.viewErr.JSON(ctx, w, ErrGrantTypeNotAccepted)
 		return nil
 	}
 
-	token, err := u.us.Token(ctx, &user)
+	roles, err := u.userRoles(ctx, user)
 	if err != nil {
 		u.viewErr.JSON(ctx, w, err)
 		return nil
 	}
 
-	return web.Respond(ctx, w, token, http.StatusOK)
+	// tokens issued through a client, or for scopes, get the lifetimes configured for them.
+	var token models.Token
+	scopes := u.roleScopes(roles, requestedScopes(auth.Scope))
+	if client.ID != "" || len(scopes) > 0 {
+		token, err = u.us.ClientToken(ctx, &user, &client, scopes...)
+	} else {
+		token, err = u.us.Token(ctx, &user)
+	}
+	if err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	// OpenID Connect clients get an ID token along with the other tokens.
+	if u.cfg.IDTokens && models.StringList(scopes).Contains("openid") {
+		opts := models.IDTokenOptions{Nonce: auth.Nonce}
+		if u.cfg.AuthMethods {
+			opts.AuthMethods = amr
+			opts.AuthClass = u.authClass(amr)
+		}
+
+		token.IDToken, err = u.us.IDToken(ctx, &user, client.ID, opts, scopes...)
+		if err != nil {
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+	}
+
+	if !u.cfg.TokenGrants {
+		// the scope is sent when it is not the one requested, as RFC 6749 requires.
+		if granted := strings.Join(scopes, " "); u.cfg.TokenScope && granted != strings.Join(requestedScopes(auth.Scope), " ") {
+			return web.Respond(ctx, w, scopedToken{Token: token, Scope: granted}, http.StatusOK)
+		}
+
+		return web.Respond(ctx, w, token, http.StatusOK)
+	}
+
+	if roles == nil {
+		roles = []string{}
+	}
+
+	return web.Respond(ctx, w, grantedToken{
+		Token: token,
+		Scope: strings.Join(scopes, " "),
+		Roles: roles,
+	}, http.StatusOK)
+}
+
+// authClass returns the acr of a login authenticated with the methods amr, empty when they are unknown.
+func (u *Users) authClass(amr []string) string {
+	if len(amr) == 0 {
+		return ""
+	}
+	if models.StringList(amr).Contains(models.AuthMethodMFA) {
+		return u.cfg.MultiFactorClass
+	}
+
+	return u.cfg.SingleFactorClass
+}
+
+// grantedToken is the response of the token endpoint to a login when the grants are included, telling
+// the client what the user can do along with the tokens.
+type grantedToken struct {
+	models.Token
+	Scope string   `json:"scope"`
+	Roles []string `json:"roles"`
+}
+
+// maxAge parses the max_age parameter of a refresh request, the maximum number of seconds elapsed since
+// the user authenticated. It returns ErrInvalidFormInput if it is not a number of seconds, and
+// models.ErrReauthRequired if it is zero, which always asks for a fresh login.
+func maxAge(param string) (time.Duration, error) {
+	n, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || n < 0 {
+		return 0, ErrInvalidFormInput
+	}
+	if n == 0 {
+		return 0, models.ErrReauthRequired
+	}
+
+	return time.Duration(n) * time.Second, nil
+}
+
+// scopedToken is the response of the token endpoint to a login granted other scopes than the ones
+// requested, telling the client the scopes it got.
+type scopedToken struct {
+	models.Token
+	Scope string `json:"scope"`
+}
+
+// tokenParams are the parameters of the token requests that cannot be sent more than once, as RFC 6749
+// requires, so a request is never read differently by the service and by a proxy inspecting it.
+var tokenParams = []string{
+	"grant_type", "scope", "prompt", "max_age", "nonce", "email", "password", "refresh_token", "device_code", "challenge_token", "code",
+	"trust_device", "client_id", "client_secret",
+}
+
+// duplicateParam reports whether any of names is present more than once in form.
+func duplicateParam(form url.Values, names ...string) bool {
+	for _, name := range names {
+		if len(form[name]) > 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestedScopes returns the distinct scopes in scope, a space-delimited list as sent in the scope
+// parameter of a grant request, sorted so the tokens issued list them in the same order whatever the
+// order they were requested in.
+func requestedScopes(scope string) []string {
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, s := range strings.Fields(scope) {
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+
+	sort.Strings(scopes)
+	return scopes
+}
+
+// userRoles returns the roles of user, resolved when either the grants are included in the token
+// responses or the roles imply scopes. It returns nil otherwise.
+func (u *Users) userRoles(ctx context.Context, user models.User) ([]string, error) {
+	if u.cfg.Roles == nil || (!u.cfg.TokenGrants && len(u.cfg.RoleScopes) == 0) {
+		return nil, nil
+	}
+
+	return u.cfg.Roles.UserRoles(ctx, user)
 }
 
-// Create adds a new user to the system.
+// roleScopes returns the scopes granted to a user with roles requesting the sorted scopes in requested:
+// the scopes implied by the roles when none is requested, and the requested ones among them otherwise.
+// The requested scopes are returned as they are when the roles imply no scopes.
+func (u *Users) roleScopes(roles, requested []string) []string {
+	var implied []string
+	for _, role := range roles {
+		implied = append(implied, u.cfg.RoleScopes[role]...)
+	}
+	if len(implied) == 0 {
+		return requested
+	}
+
+	implied = requestedScopes(strings.Join(implied, " "))
+	if len(requested) == 0 {
+		return implied
+	}
+
+	var scopes []string
+	for _, s := range requested {
+		if models.StringList(implied).Contains(s) {
+			scopes = append(scopes, s)
+		}
+	}
+
+	return scopes
+}
+
+// checkScopes returns ErrTooManyScopes if more scopes than allowed are requested, ErrScopeNotAllowed if
+// any of them cannot be obtained with grantType, when the scopes of the grant type are configured, and
+// ErrInvalidScope if any of them is not a known scope, when the known scopes are configured.
+func (u *Users) checkScopes(grantType string, scopes []string) error {
+	if max := u.cfg.MaxRequestedScopes; max > 0 && len(scopes) > max {
+		return ErrTooManyScopes
+	}
+
+	if allowed, ok := u.cfg.GrantScopes[grantType]; ok {
+		for _, s := range scopes {
+			if !models.StringList(allowed).Contains(s) {
+				return ErrScopeNotAllowed
+			}
+		}
+	}
+
+	if len(u.cfg.KnownScopes) == 0 {
+		return nil
+	}
+
+	for _, s := range scopes {
+		if !models.StringList(u.cfg.KnownScopes).Contains(s) {
+			return ErrInvalidScope
+		}
+	}
+
+	return nil
+}
+
+// scopeCheck is the response of the scope check endpoint.
+type scopeCheck struct {
+	Satisfied []string `json:"satisfied"`
+	Missing   []string `json:"missing"`
+}
+
+// CheckScopes returns which of the scopes in the request the access token of the request grants, and
+// which it is missing, so gateways can check a set of scopes with a single call.
+//
+// POST /oauth/scopes/
+func (u *Users) CheckScopes(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.CheckScopes")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: CheckScopes called without/before Authenticate", nil)
+	}
+
+	var req struct {
+		Scopes []string `json:"scopes" validate:"required"`
+	}
+	if err := web.Decode(r, &req); err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if max := u.cfg.MaxRequestedScopes; max > 0 && len(req.Scopes) > max {
+		u.viewErr.JSON(ctx, w, ErrTooManyScopes)
+		return nil
+	}
+
+	res := scopeCheck{Satisfied: []string{}, Missing: []string{}}
+	satisfied, missing := claims.CheckScopes(req.Scopes...)
+	res.Satisfied = append(res.Satisfied, satisfied...)
+	res.Missing = append(res.Missing, missing...)
+
+	return web.Respond(ctx, w, res, http.StatusOK)
+}
+
+// audit records e, when the controller has an audit service. Failing to record an event does not fail
+// the request, as the audit service keeps the events it could not write to retry them.
+func (u *Users) audit(ctx context.Context, e models.AuditEvent) {
+	if u.as == nil {
+		return
+	}
+
+	if err := u.as.Record(ctx, &e); err != nil {
+		var traceID string
+		if v, ok := ctx.Value(web.KeyValues).(*web.Values); ok {
+			traceID = v.TraceID
+		}
+
+		u.log.Printf("%s : AUDIT : %+v", traceID, err)
+	}
+}
+
+// clientCredentials extracts the client ID and secret from the HTTP Basic credentials of r, falling
+// back to the formID and formSecret form values. When both are present, the Basic credentials are used
+// unless cfg gives precedence to the form fields.
+//
+// As required by RFC 6749, section 2.3.1, the Basic credentials are form-urlencoded before being
+// base64 encoded. It returns ErrMalformedClientAuth if the Basic credentials cannot be decoded.
+func clientCredentials(r *http.Request, formID, formSecret string, cfg OAuthConfig) (string, string, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Basic ") || !strings.EqualFold(header[:len("Basic ")], "Basic ") {
+		return formID, formSecret, nil
+	}
+
+	if formID != "" && cfg.FormClientCredentials {
+		return formID, formSecret, nil
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok || id == "" {
+		return "", "", ErrMalformedClientAuth
+	}
+
+	id, err := url.QueryUnescape(id)
+	if err != nil {
+		return "", "", ErrMalformedClientAuth
+	}
+
+	secret, err = url.QueryUnescape(secret)
+	if err != nil {
+		return "", "", ErrMalformedClientAuth
+	}
+
+	return id, secret, nil
+}
+
+// Create adds a new user to the system. Signups get a signups_disabled error when they are disabled.
+//
+// Once the signups from an IP failed validation too many times, the following ones must send a CAPTCHA
+// solution in the X-Captcha-Response header, or get a captcha_required error. Once too many users were
+// created from an IP, its signups get a signup_rate_limited error until the signup window ends.
+//
+// In enumeration-safe mode, a successful signup and one with an email already taken both get a 202
+// Accepted response with the same body, and the taken email is not reported.
 //
 // POST /api/users/
 func (u *Users) Create(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Users.Create")
 	defer span.End()
 
+	if u.cfg.DisableSignups {
+		u.viewErr.JSON(ctx, w, ErrSignupsDisabled)
+		return nil
+	}
+
+	ip := remoteIP(r)
+	if u.cfg.MaxSignupsPerIP > 0 && u.signups.Count(ip) >= u.cfg.MaxSignupsPerIP {
+		u.viewErr.JSON(ctx, w, ErrSignupRateLimited)
+		return nil
+	}
+
+	if err := u.checkSignupCaptcha(ctx, r, ip); err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
 	nu := models.NewUser()
 	if err := web.Decode(r, &nu); err != nil {
+		if _, ok := err.(models.ValidationError); ok {
+			u.signupFailures.Record(ip)
+		}
+
 		u.viewErr.JSON(ctx, w, err)
 		return nil
 	}
 
 	err := u.us.Create(ctx, &nu)
+	if _, ok := err.(models.ValidationError); ok {
+		u.signupFailures.Record(ip)
+	}
+	if err == nil {
+		u.signups.Record(ip)
+	}
+
+	if u.cfg.EnumerationSafe {
+		// a taken email is reported as a success, so signing up cannot reveal registered accounts.
+		if ve, ok := err.(models.ValidationError); ok && ve["email"] == models.ErrDuplicate {
+			delete(ve, "email")
+			if len(ve) > 0 {
+				u.viewErr.JSON(ctx, w, ve)
+				return nil
+			}
+			err = nil
+		}
+
+		if err == nil {
+			return web.Respond(ctx, w, map[string]string{"status": "accepted"}, http.StatusAccepted)
+		}
+	}
+
 	if err != nil {
 		u.viewErr.JSON(ctx, w, err)
 		return nil
@@ -125,8 +689,37 @@ func (u *Users) Create(ctx context.Context, w http.ResponseWriter, r *http.Reque
 	return web.Respond(ctx, w, &nu, http.StatusCreated)
 }
 
+// checkSignupCaptcha returns ErrCaptchaRequired when the client with the given IP has failed too many
+// signups and did not send a valid CAPTCHA solution.
+func (u *Users) checkSignupCaptcha(ctx context.Context, r *http.Request, ip string) error {
+	if u.cfg.Captcha == nil || u.cfg.SignupCaptchaThreshold <= 0 ||
+		u.signupFailures.Count(ip) < u.cfg.SignupCaptchaThreshold {
+		return nil
+	}
+
+	response := r.Header.Get(captchaHeader)
+	if response == "" {
+		return ErrCaptchaRequired
+	}
+
+	ok, err := u.cfg.Captcha.Verify(ctx, response, ip)
+	if err != nil {
+		return wrap("failed to verify captcha", err)
+	}
+
+	if !ok {
+		return ErrCaptchaRequired
+	}
+
+	return nil
+}
+
 // Update updates system existing user.
 //
+// With the "partial" query parameter set to true, the valid fields are saved even if others are not.
+// The response then has a 207 Multi-Status code, with the updated user in the JSON "user" field and
+// the rejected fields reported as in a validation error.
+//
 // PUT api/users/:id
 func (u *Users) Update(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Users.Update")
@@ -145,6 +738,20 @@ func (u *Users) Update(ctx context.Context, w http.ResponseWriter, r *http.Reque
 	}
 	user.ID = requestID
 
+	if r.URL.Query().Get("partial") == "true" {
+		ve, err := u.us.UpdatePartial(ctx, &user)
+		if err != nil {
+			u.viewErr.JSON(ctx, w, err)
+			return nil
+		}
+
+		if len(ve) > 0 {
+			return u.viewErr.JSONWith(ctx, w, ve, http.StatusMultiStatus, map[string]interface{}{"user": &user})
+		}
+
+		return web.Respond(ctx, w, &user, http.StatusOK)
+	}
+
 	err = u.us.Update(ctx, &user)
 	if err != nil {
 		u.viewErr.JSON(ctx, w, err)
@@ -176,6 +783,124 @@ func (u *Users) ByID(ctx context.Context, w http.ResponseWriter, r *http.Request
 	return web.Respond(ctx, w, user, http.StatusOK)
 }
 
+// Keys returns the JWKS holding the public key the tokens are signed with, so other services can verify
+// them without calling this one. The set is empty when the tokens are signed with the JWT secret.
+//
+// GET /oauth/jwks/
+func (u *Users) Keys(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Keys")
+	defer span.End()
+
+	return web.Respond(ctx, w, u.us.PublicKeys(), http.StatusOK)
+}
+
+// TokenInfo returns the remaining lifetime of the access token the request is authenticated with, so
+// clients can schedule its refresh just before it expires. It has no side effects on the token.
+//
+// GET /api/oauth/token/info/
+func (u *Users) TokenInfo(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.TokenInfo")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: TokenInfo called without/before Authenticate", nil)
+	}
+
+	var res struct {
+		ExpiresIn int64  `json:"expires_in"`
+		ExpiresAt int64  `json:"expires_at"`
+		IssuedAt  int64  `json:"issued_at,omitempty"`
+		ClientID  string `json:"client_id,omitempty"`
+		Scope     string `json:"scope,omitempty"`
+
+		PrincipalType string `json:"principal_type,omitempty"`
+	}
+
+	// tokens accepted within their grace period have no time left.
+	if remaining := claims.ExpiresAt.Sub(u.cfg.now()); remaining > 0 {
+		res.ExpiresIn = int64(remaining / time.Second)
+	}
+	res.ExpiresAt = claims.ExpiresAt.Unix()
+	if !claims.IssuedAt.IsZero() {
+		res.IssuedAt = claims.IssuedAt.Unix()
+	}
+	res.ClientID = claims.ClientID
+	res.Scope = strings.Join(claims.Scopes, " ")
+	if u.cfg.PrincipalType {
+		res.PrincipalType = claims.PrincipalType
+	}
+
+	return web.Respond(ctx, w, res, http.StatusOK)
+}
+
+// Me returns the authenticated user, along with the feature flags set for them.
+//
+// GET /api/me/
+func (u *Users) Me(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Me")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: Me called without/before Authenticate", nil)
+	}
+
+	user, err := u.us.ByID(ctx, claims.User.ID)
+	if err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	if u.cfg.PrincipalType {
+		return web.Respond(ctx, w, principal{User: user, PrincipalType: claims.PrincipalType}, http.StatusOK)
+	}
+
+	return web.Respond(ctx, w, user, http.StatusOK)
+}
+
+// UserInfo returns the OpenID Connect standard claims of the user the request is authenticated as, the
+// ones the scopes of the access token grant access to. The access token must grant the openid scope.
+//
+// GET /api/userinfo/
+func (u *Users) UserInfo(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.UserInfo")
+	defer span.End()
+
+	claims, ok := ctx.Value(models.KeyClaims).(models.Claims)
+	if !ok {
+		return wrap("claims missing from context: UserInfo called without/before Authenticate", nil)
+	}
+
+	if !models.StringList(claims.Scopes).Contains("openid") {
+		u.viewErr.JSON(ctx, w, ErrInsufficientScope)
+		return nil
+	}
+
+	user, err := u.us.ByID(ctx, claims.User.ID)
+	if err != nil {
+		u.viewErr.JSON(ctx, w, err)
+		return nil
+	}
+
+	return web.Respond(ctx, w, userInfo{
+		Subject:    strconv.FormatInt(user.ID, 10),
+		UserClaims: models.NewUserClaims(user, claims.Scopes...),
+	}, http.StatusOK)
+}
+
+// userInfo is the response of the UserInfo endpoint.
+type userInfo struct {
+	Subject string `json:"sub"`
+	models.UserClaims
+}
+
+// principal is the response of the Me endpoint when the principal type is included.
+type principal struct {
+	models.User
+	PrincipalType string `json:"principal_type"`
+}
+
 // List returns a list of users, optionally filteres by IDs or countries, to the requester.
 func (u *Users) List(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.List")
@@ -290,7 +1015,8 @@ func (u *Users) Delete(ctx context.Context, w http.ResponseWriter, r *http.Reque
 // - email:    api-client@test.com
 // - password: secret01234
 //
-// IMPORTANT: Instructional use only
+// IMPORTANT: Instructional use only. The route is deprecated, and its responses carry a Deprecation
+// header.
 func (u *Users) BenchLogin(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.Login")
 	defer span.End()
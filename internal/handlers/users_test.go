@@ -3,13 +3,24 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	mw "github.com/noelruault/golang-authentication/internal/middleware"
 	"github.com/noelruault/golang-authentication/internal/models"
 	"github.com/noelruault/golang-authentication/internal/web"
 )
@@ -18,13 +29,21 @@ type testUserService struct {
 	models.UserService
 	auth        func(ctx context.Context, username, password string) (models.User, error)
 	refresh     func(ctx context.Context, refreshToken string) (models.User, error)
+	rotate      func(ctx context.Context, refreshToken string) (models.Token, error)
+	rotateWith  func(ctx context.Context, refreshToken string, opts models.RotateOptions) (models.Token, error)
+	idToken     func(ctx context.Context, u *models.User, clientID string, opts models.IDTokenOptions, scopes ...string) (string, error)
 	token       func(context.Context, *models.User) (models.Token, error)
+	clientToken func(context.Context, *models.User, *models.Client, ...string) (models.Token, error)
+	revoke      func(ctx context.Context, userID int64, clientID string) error
 	byID        func(context.Context, int64) (models.User, error)
 	byIDs       func(context.Context, ...int64) ([]models.User, error)
 	byCountries func(context.Context, ...string) ([]models.User, error)
 	delete      func(context.Context, int64) error
 	create      func(context.Context, *models.User) error
 	update      func(context.Context, *models.User) error
+	partial     func(context.Context, *models.User) (models.ValidationError, error)
+
+	trustRevokedAt func(context.Context, int64) (time.Time, error)
 }
 
 func (t *testUserService) Authenticate(ctx context.Context, username, password string) (models.User, error) {
@@ -43,6 +62,38 @@ func (t *testUserService) Refresh(ctx context.Context, refreshToken string) (mod
 	panic("not provided")
 }
 
+// Rotate falls back to calling Refresh and Token when no rotate function is provided, as the
+// real service does.
+func (t *testUserService) Rotate(ctx context.Context, refreshToken string) (models.Token, error) {
+	if t.rotate != nil {
+		return t.rotate(ctx, refreshToken)
+	}
+
+	u, err := t.Refresh(ctx, refreshToken)
+	if err != nil {
+		return models.Token{}, err
+	}
+
+	return t.Token(ctx, &u)
+}
+
+func (t *testUserService) IDToken(ctx context.Context, u *models.User, clientID string, opts models.IDTokenOptions, scopes ...string) (string, error) {
+	if t.idToken != nil {
+		return t.idToken(ctx, u, clientID, opts, scopes...)
+	}
+
+	panic("not provided")
+}
+
+// RotateWith falls back to calling Rotate when no rotateWith function is provided.
+func (t *testUserService) RotateWith(ctx context.Context, refreshToken string, opts models.RotateOptions) (models.Token, error) {
+	if t.rotateWith != nil {
+		return t.rotateWith(ctx, refreshToken, opts)
+	}
+
+	return t.Rotate(ctx, refreshToken)
+}
+
 func (t *testUserService) Token(ctx context.Context, u *models.User) (models.Token, error) {
 	if t.token != nil {
 		return t.token(ctx, u)
@@ -51,6 +102,23 @@ func (t *testUserService) Token(ctx context.Context, u *models.User) (models.Tok
 	panic("not provided")
 }
 
+// ClientToken falls back to calling Token when no clientToken function is provided.
+func (t *testUserService) ClientToken(ctx context.Context, u *models.User, c *models.Client, scopes ...string) (models.Token, error) {
+	if t.clientToken != nil {
+		return t.clientToken(ctx, u, c, scopes...)
+	}
+
+	return t.Token(ctx, u)
+}
+
+func (t *testUserService) RevokeClient(ctx context.Context, userID int64, clientID string) error {
+	if t.revoke != nil {
+		return t.revoke(ctx, userID, clientID)
+	}
+
+	panic("not provided")
+}
+
 func (t *testUserService) ByID(ctx context.Context, id int64) (models.User, error) {
 	if t.byID != nil {
 		return t.byID(ctx, id)
@@ -99,13 +167,29 @@ func (t *testUserService) Update(ctx context.Context, u *models.User) error {
 	panic("not provided")
 }
 
+func (t *testUserService) UpdatePartial(ctx context.Context, u *models.User) (models.ValidationError, error) {
+	if t.partial != nil {
+		return t.partial(ctx, u)
+	}
+
+	panic("not provided")
+}
+
+func (t *testUserService) TrustRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	if t.trustRevokedAt != nil {
+		return t.trustRevokedAt(ctx, userID)
+	}
+
+	panic("not provided")
+}
+
 func testContext() context.Context {
 	return context.WithValue(context.Background(), web.KeyValues, &web.Values{})
 }
 
 func TestUsers_Login(t *testing.T) {
 	us := &testUserService{}
-	u := NewUsers(us, nil)
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
 
 	var cases = []struct {
 		name        string
@@ -120,7 +204,31 @@ func TestUsers_Login(t *testing.T) {
 			"application/x-www-form-urlencoded",
 			"graskdfhjglk!@98574sjdgfh ksdhf lksdfghlksjkl",
 			http.StatusBadRequest,
-			`{"error": "invalid_form"}`,
+			`{"error": "invalid_request"}`,
+			nil,
+		},
+		{
+			"missingGrantType",
+			"application/x-www-form-urlencoded",
+			"email=a@b.com&password=pass",
+			http.StatusBadRequest,
+			`{"error": "invalid_request"}`,
+			nil,
+		},
+		{
+			"emptyGrantType",
+			"application/x-www-form-urlencoded",
+			"grant_type=&email=a@b.com&password=pass",
+			http.StatusBadRequest,
+			`{"error": "invalid_request"}`,
+			nil,
+		},
+		{
+			"unknownGrantType",
+			"application/x-www-form-urlencoded",
+			"grant_type=magic&email=a@b.com&password=pass",
+			http.StatusBadRequest,
+			`{"error": "unsupported_grant_type"}`,
 			nil,
 		},
 		{
@@ -315,6 +423,31 @@ func TestUsers_Login(t *testing.T) {
 				}
 			},
 		},
+		{
+			"refreshReauthRequired",
+			"application/x-www-form-urlencoded",
+			"grant_type=refresh_token&refresh_token=k%40sjdhdfgkjsgfkj",
+			http.StatusUnauthorized,
+			`{"error": "reauth_required"}`,
+			func(*testing.T) {
+				us.rotate = func(ctx context.Context, r string) (models.Token, error) {
+					return models.Token{}, models.ErrReauthRequired
+				}
+			},
+		},
+		{
+			"refreshScopeBroadened",
+			"application/x-www-form-urlencoded",
+			"grant_type=refresh_token&refresh_token=k%40sjdhdfgkjsgfkj&scope=read+admin",
+			http.StatusUnauthorized,
+			`{"error": "reauth_required"}`,
+			func(t *testing.T) {
+				us.rotateWith = func(ctx context.Context, r string, opts models.RotateOptions) (models.Token, error) {
+					assert.Equal(t, "read admin", opts.Scope)
+					return models.Token{}, models.ErrReauthRequired
+				}
+			},
+		},
 		{
 			"grantedRefresh",
 			"application/x-www-form-urlencoded",
@@ -366,7 +499,7 @@ func TestUsers_Login(t *testing.T) {
 
 func TestUsers_Create(t *testing.T) {
 	us := &testUserService{}
-	u := NewUsers(us, nil)
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
 
 	var cases = []struct {
 		name      string
@@ -483,9 +616,61 @@ func TestUsers_Create(t *testing.T) {
 	}
 }
 
+func TestUsers_CreateEnumerationSafe(t *testing.T) {
+	us := &testUserService{}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{EnumerationSafe: true}, nil)
+
+	var cases = []struct {
+		name      string
+		createErr error
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"emailTaken",
+			models.ValidationError{"email": models.ErrDuplicate},
+			http.StatusAccepted,
+			`{"status":"accepted"}`,
+		},
+		{
+			"emailTakenValidationError",
+			models.ValidationError{"email": models.ErrDuplicate, "password": models.ErrRequired},
+			http.StatusBadRequest,
+			`{"error":"validation_error","fields":{"password":"required"}}`,
+		},
+		{
+			"ok",
+			nil,
+			http.StatusAccepted,
+			`{"status":"accepted"}`,
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/users/",
+				bytes.NewReader([]byte(`{"email":"someone@somewhere.com","firstName":"John","password":"testpassword"}`)))
+
+			us.create = func(ctx context.Context, u *models.User) error {
+				u.ID = 88
+				return cs.createErr
+			}
+
+			err := u.Create(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+
+			*us = testUserService{}
+		})
+	}
+}
+
 func TestUsers_Update(t *testing.T) {
 	us := &testUserService{}
-	u := NewUsers(us, nil)
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
 
 	var cases = []struct {
 		name      string
@@ -597,6 +782,63 @@ func TestUsers_Update(t *testing.T) {
 				}
 			},
 		},
+		{
+			"partialMixed",
+			"/api/users/99?partial=true",
+			`{"active":true,"country":"XX","email":"someone@somewhere.com","firstName":"Johnny"}`,
+			http.StatusMultiStatus,
+			`{"user":{"id":99,"active":true,"country":"GB","email":"someone@somewhere.com",
+				"firstName":"Johnny","lastName":"","nickname":""},
+				"error":"validation_error","fields":{"country":"invalid_country_code"}}`,
+			func(t *testing.T) {
+				us.partial = func(ctx context.Context, u *models.User) (models.ValidationError, error) {
+					assert.Equal(t, "XX", u.Country)
+
+					u.Country = "GB"
+					return models.ValidationError{"country": models.ErrInvalidCountry}, nil
+				}
+			},
+		},
+		{
+			"partialFieldErrors",
+			"/api/users/99?partial=true",
+			`{"active":true,"country":"GB","email":"someone@somewhere.com","firstName":"Johnny","password":"short"}`,
+			http.StatusMultiStatus,
+			`{"user":{"id":99,"active":true,"country":"GB","email":"someone@somewhere.com",
+				"firstName":"Johnny","lastName":"","nickname":""},
+				"error":"validation_error","fields":{"password":["too_short","password_no_digit"]}}`,
+			func(t *testing.T) {
+				us.partial = func(ctx context.Context, u *models.User) (models.ValidationError, error) {
+					u.Password = ""
+					return models.ValidationError{"password": models.FieldErrors{models.ErrTooShort, models.ErrPasswordNoDigit}}, nil
+				}
+			},
+		},
+		{
+			"partialAllValid",
+			"/api/users/99?partial=true",
+			`{"active":true,"country":"GB","email":"someone@somewhere.com","firstName":"Johnny"}`,
+			http.StatusOK,
+			`{"id":99,"active":true,"country":"GB","email":"someone@somewhere.com",
+				"firstName":"Johnny","lastName":"","nickname":""}`,
+			func(t *testing.T) {
+				us.partial = func(ctx context.Context, u *models.User) (models.ValidationError, error) {
+					return nil, nil
+				}
+			},
+		},
+		{
+			"strictMixed",
+			"/api/users/99",
+			`{"active":true,"country":"XX","email":"someone@somewhere.com","firstName":"Johnny"}`,
+			http.StatusBadRequest,
+			`{"error":"validation_error","fields":{"country":"invalid_country_code"}}`,
+			func(t *testing.T) {
+				us.update = func(ctx context.Context, u *models.User) error {
+					return models.ValidationError{"country": models.ErrInvalidCountry}
+				}
+			},
+		},
 	}
 
 	for _, cs := range cases {
@@ -621,7 +863,7 @@ func TestUsers_Update(t *testing.T) {
 
 func TestUsers_Delete(t *testing.T) {
 	us := &testUserService{}
-	u := NewUsers(us, nil)
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
 
 	var cases = []struct {
 		name      string
@@ -702,7 +944,7 @@ func TestUsers_Delete(t *testing.T) {
 
 func TestUsers_Get(t *testing.T) {
 	us := &testUserService{}
-	u := NewUsers(us, nil)
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
 
 	var cases = []struct {
 		name      string
@@ -794,142 +1036,395 @@ func TestUsers_Get(t *testing.T) {
 	}
 }
 
-func TestUsers_ListByIDs(t *testing.T) {
-	us := &testUserService{}
-	u := NewUsers(us, nil)
+func TestUsers_Keys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name    string
+		cfg     models.Config
+		outKeys int
+	}{
+		{"ES256", models.Config{SigningAlgorithm: models.SigningES256, SigningKey: key}, 1},
+		{"HS512", models.Config{}, 0},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			us := models.NewUserService(nil, []byte("very lengthy jwt test secret to be used for tests"), cs.cfg)
+			u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/oauth/jwks/", nil)
+
+			require.NoError(t, u.Keys(testContext(), w, r))
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			var set struct {
+				Keys []map[string]interface{} `json:"keys"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+			require.NotNil(t, set.Keys)
+			require.Len(t, set.Keys, cs.outKeys)
+			if cs.outKeys > 0 {
+				assert.Equal(t, "EC", set.Keys[0]["kty"])
+				assert.Equal(t, "ES256", set.Keys[0]["alg"])
+			}
+		})
+	}
+}
+
+func TestUsers_Me(t *testing.T) {
+	us := &testUserService{
+		byID: func(ctx context.Context, id int64) (models.User, error) {
+			if id != 999 {
+				return models.User{}, models.ErrNotFound
+			}
+
+			return models.User{
+				ID:           999,
+				Active:       true,
+				Country:      "ESP",
+				Email:        "test@email.com",
+				FirstName:    "Test",
+				FeatureFlags: models.FeatureFlags{"betaSearch": true},
+			}, nil
+		},
+	}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
 
 	var cases = []struct {
 		name      string
-		path      string
+		userID    int64
 		outStatus int
 		outJSON   string
-		setup     func(*testing.T)
 	}{
-		{
-			"notInStore",
-			"/api/users/?id=999,1000",
-			http.StatusOK,
-			`null`,
-			func(t *testing.T) {
-				us.byIDs = func(ctx context.Context, id ...int64) ([]models.User, error) {
-					assert.Equal(t, []int64{999, 1000}, id)
-					return nil, nil
-				}
-			},
-		},
-		{
-			"storeInternalError",
-			"/api/users/?id=999",
-			http.StatusInternalServerError,
-			`{"error":"server_error"}`,
-			func(t *testing.T) {
-				us.byIDs = func(ctx context.Context, id ...int64) ([]models.User, error) {
-					assert.Equal(t, []int64{999}, id)
-					return nil, wrap("test internal error", nil)
-				}
-			},
-		},
-		{
-			"blankQuery",
-			"/api/users/?id=",
-			http.StatusBadRequest,
-			`{"error":"validation_error", "fields":{"id":"required"}}`,
-			func(t *testing.T) {
-				us.byIDs = func(ctx context.Context, id ...int64) ([]models.User, error) {
-					assert.Len(t, id, 0)
-					return []models.User{
-						{
-							ID:        999,
-							Active:    true,
-							Country:   "ESP",
-							Email:     "test@email.com",
-							FirstName: "Test",
-							Nickname:  "tuser",
-							LastName:  "User",
-							Settings:  "settings_string",
-						},
-					}, nil
-				}
-			},
-		},
 		{
 			"ok",
-			"/api/users/?id=999,888",
+			999,
 			http.StatusOK,
-			`[{
+			`{
 				"active":true,
 				"country":"ESP",
 				"email":"test@email.com",
 				"firstName":"Test",
 				"id":999,
-				"lastName":"User",
-				"nickname":"usy",
-				"settings":"settings_string"
-			}]`,
-			func(t *testing.T) {
-				us.byIDs = func(ctx context.Context, id ...int64) ([]models.User, error) {
-					assert.Equal(t, []int64{999, 888}, id)
-					return []models.User{
-						{
-							ID:        999,
-							Active:    true,
-							Country:   "ESP",
-							Email:     "test@email.com",
-							FirstName: "Test",
-							Nickname:  "usy",
-							LastName:  "User",
-							Settings:  "settings_string",
-						},
-					}, nil
-				}
-			},
+				"lastName":"",
+				"nickname":"",
+				"featureFlags":{"betaSearch":true}
+			}`,
+		},
+		{
+			"deleted",
+			88,
+			http.StatusNotFound,
+			`{"error":"not_found"}`,
 		},
 	}
 
 	for _, cs := range cases {
 		t.Run(cs.name, func(t *testing.T) {
 			w := httptest.NewRecorder()
-			r := httptest.NewRequest(http.MethodGet, cs.path, nil)
-
-			if cs.setup != nil {
-				cs.setup(t)
-			}
+			r := httptest.NewRequest(http.MethodGet, "/api/me/", nil)
+			ctx := context.WithValue(testContext(), models.KeyClaims, models.NewClaims(models.User{ID: cs.userID}))
 
-			err := u.ListByIDs(testContext(), w, r)
+			err := u.Me(ctx, w, r)
 			require.NoError(t, err)
 
 			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
 			assert.JSONEq(t, cs.outJSON, w.Body.String())
-
-			*us = testUserService{}
 		})
 	}
 }
 
-func TestUsers_ListByCountries(t *testing.T) {
-	us := &testUserService{}
-	u := NewUsers(us, nil)
+func TestUsers_UserInfo(t *testing.T) {
+	us := &testUserService{
+		byID: func(ctx context.Context, id int64) (models.User, error) {
+			return models.User{ID: id, Email: "jane@example.com", FirstName: "Jane", LastName: "Doe", Nickname: "jd"}, nil
+		},
+	}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
 
 	var cases = []struct {
 		name      string
-		path      string
+		scopes    []string
 		outStatus int
 		outJSON   string
-		setup     func(*testing.T)
 	}{
-		{
-			"notInStore",
-			"/api/users/?country=ES,UK",
-			http.StatusOK,
-			`null`,
-			func(t *testing.T) {
-				us.byCountries = func(ctx context.Context, countries ...string) ([]models.User, error) {
-					assert.Equal(t, []string{"ES", "UK"}, countries)
-					return nil, nil
-				}
-			},
-		},
-		{
+		{"profileAndEmail", []string{"openid", "profile", "email"}, http.StatusOK,
+			`{"sub": "999", "name": "Jane Doe", "given_name": "Jane", "family_name": "Doe", "nickname": "jd", "email": "jane@example.com"}`},
+		{"emailOnly", []string{"openid", "email"}, http.StatusOK, `{"sub": "999", "email": "jane@example.com"}`},
+		{"openidOnly", []string{"openid"}, http.StatusOK, `{"sub": "999"}`},
+		{"notOpenID", []string{"profile", "email"}, http.StatusForbidden, `{"error": "insufficient_scope"}`},
+		{"unscoped", nil, http.StatusForbidden, `{"error": "insufficient_scope"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			claims := models.NewClaims(models.User{ID: 999})
+			claims.Scopes = cs.scopes
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/userinfo/", nil)
+			ctx := context.WithValue(testContext(), models.KeyClaims, claims)
+
+			err := u.UserInfo(ctx, w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_PrincipalType(t *testing.T) {
+	us := &testUserService{
+		byID: func(ctx context.Context, id int64) (models.User, error) {
+			return models.User{ID: id, Active: true, Email: "test@email.com"}, nil
+		},
+	}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name    string
+		enabled bool
+		outMe   string
+		outInfo string
+	}{
+		{
+			"enabled",
+			true,
+			`{"id":999,"active":true,"email":"test@email.com","firstName":"","lastName":"","nickname":"","country":"","principal_type":"user"}`,
+			`{"expires_in":300,"expires_at":1614600300,"principal_type":"user"}`,
+		},
+		{
+			"disabled",
+			false,
+			`{"id":999,"active":true,"email":"test@email.com","firstName":"","lastName":"","nickname":"","country":""}`,
+			`{"expires_in":300,"expires_at":1614600300}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			u := NewUsers(us, nil, nil, nil, OAuthConfig{PrincipalType: cs.enabled, Now: func() time.Time { return now }}, nil)
+
+			claims := models.NewClaims(models.User{ID: 999})
+			claims.ExpiresAt = now.Add(5 * time.Minute)
+			ctx := context.WithValue(testContext(), models.KeyClaims, claims)
+
+			w := httptest.NewRecorder()
+			require.NoError(t, u.Me(ctx, w, httptest.NewRequest(http.MethodGet, "/api/me/", nil)))
+			assert.JSONEq(t, cs.outMe, w.Body.String())
+
+			w = httptest.NewRecorder()
+			require.NoError(t, u.TokenInfo(ctx, w, httptest.NewRequest(http.MethodGet, "/api/oauth/token/info/", nil)))
+			assert.JSONEq(t, cs.outInfo, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_PrincipalTypeClient(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	clients := &testClientService{
+		validate: func(ctx context.Context, accessToken string) (models.Claims, error) {
+			if accessToken != "client-token" {
+				return models.Claims{}, models.ErrUnauthorised
+			}
+
+			return models.Claims{PrincipalType: models.PrincipalClient, ClientID: "ci-bot", ExpiresAt: now.Add(5 * time.Minute)}, nil
+		},
+	}
+	u := NewUsers(&testUserService{}, clients, nil, nil, OAuthConfig{PrincipalType: true, Now: func() time.Time { return now }}, nil)
+
+	// the token of the client is rejected by the users, and accepted by the clients.
+	users := models.NewUserService(nil, []byte("secret"), models.Config{})
+	h := mw.Authenticate(users, mw.AuthConfig{Clients: clients})(u.TokenInfo)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/oauth/token/info/", nil)
+	r.Header.Set("Authorization", "Bearer client-token")
+
+	require.NoError(t, h(testContext(), w, r))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"expires_in":300,"expires_at":1614600300,"client_id":"ci-bot","principal_type":"client"}`, w.Body.String())
+}
+
+func TestUsers_TokenInfo(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	u := NewUsers(&testUserService{}, nil, nil, nil, OAuthConfig{Now: func() time.Time { return now }}, nil)
+
+	var cases = []struct {
+		name      string
+		expiresAt time.Time
+		outJSON   string
+	}{
+		{
+			"valid",
+			now.Add(5*time.Minute + 30*time.Second),
+			`{"expires_in":330,"expires_at":1614600330,"issued_at":1614596400,"client_id":"webapp","scope":"read write"}`,
+		},
+		{
+			// tokens accepted within their grace period have no time left.
+			"grace",
+			now.Add(-10 * time.Second),
+			`{"expires_in":0,"expires_at":1614599990,"issued_at":1614596400,"client_id":"webapp","scope":"read write"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			claims := models.NewClaims(models.User{ID: 999})
+			claims.ClientID = "webapp"
+			claims.Scopes = []string{"read", "write"}
+			claims.IssuedAt = now.Add(-time.Hour)
+			claims.ExpiresAt = cs.expiresAt
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/oauth/token/info/", nil)
+			ctx := context.WithValue(testContext(), models.KeyClaims, claims)
+
+			err := u.TokenInfo(ctx, w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_ListByIDs(t *testing.T) {
+	us := &testUserService{}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
+
+	var cases = []struct {
+		name      string
+		path      string
+		outStatus int
+		outJSON   string
+		setup     func(*testing.T)
+	}{
+		{
+			"notInStore",
+			"/api/users/?id=999,1000",
+			http.StatusOK,
+			`null`,
+			func(t *testing.T) {
+				us.byIDs = func(ctx context.Context, id ...int64) ([]models.User, error) {
+					assert.Equal(t, []int64{999, 1000}, id)
+					return nil, nil
+				}
+			},
+		},
+		{
+			"storeInternalError",
+			"/api/users/?id=999",
+			http.StatusInternalServerError,
+			`{"error":"server_error"}`,
+			func(t *testing.T) {
+				us.byIDs = func(ctx context.Context, id ...int64) ([]models.User, error) {
+					assert.Equal(t, []int64{999}, id)
+					return nil, wrap("test internal error", nil)
+				}
+			},
+		},
+		{
+			"blankQuery",
+			"/api/users/?id=",
+			http.StatusBadRequest,
+			`{"error":"validation_error", "fields":{"id":"required"}}`,
+			func(t *testing.T) {
+				us.byIDs = func(ctx context.Context, id ...int64) ([]models.User, error) {
+					assert.Len(t, id, 0)
+					return []models.User{
+						{
+							ID:        999,
+							Active:    true,
+							Country:   "ESP",
+							Email:     "test@email.com",
+							FirstName: "Test",
+							Nickname:  "tuser",
+							LastName:  "User",
+							Settings:  "settings_string",
+						},
+					}, nil
+				}
+			},
+		},
+		{
+			"ok",
+			"/api/users/?id=999,888",
+			http.StatusOK,
+			`[{
+				"active":true,
+				"country":"ESP",
+				"email":"test@email.com",
+				"firstName":"Test",
+				"id":999,
+				"lastName":"User",
+				"nickname":"usy",
+				"settings":"settings_string"
+			}]`,
+			func(t *testing.T) {
+				us.byIDs = func(ctx context.Context, id ...int64) ([]models.User, error) {
+					assert.Equal(t, []int64{999, 888}, id)
+					return []models.User{
+						{
+							ID:        999,
+							Active:    true,
+							Country:   "ESP",
+							Email:     "test@email.com",
+							FirstName: "Test",
+							Nickname:  "usy",
+							LastName:  "User",
+							Settings:  "settings_string",
+						},
+					}, nil
+				}
+			},
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, cs.path, nil)
+
+			if cs.setup != nil {
+				cs.setup(t)
+			}
+
+			err := u.ListByIDs(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+
+			*us = testUserService{}
+		})
+	}
+}
+
+func TestUsers_ListByCountries(t *testing.T) {
+	us := &testUserService{}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
+
+	var cases = []struct {
+		name      string
+		path      string
+		outStatus int
+		outJSON   string
+		setup     func(*testing.T)
+	}{
+		{
+			"notInStore",
+			"/api/users/?country=ES,UK",
+			http.StatusOK,
+			`null`,
+			func(t *testing.T) {
+				us.byCountries = func(ctx context.Context, countries ...string) ([]models.User, error) {
+					assert.Equal(t, []string{"ES", "UK"}, countries)
+					return nil, nil
+				}
+			},
+		},
+		{
 			"storeInternalError",
 			"/api/users/?country=ES",
 			http.StatusInternalServerError,
@@ -1017,3 +1512,1374 @@ func TestUsers_ListByCountries(t *testing.T) {
 		})
 	}
 }
+
+type testClientService struct {
+	models.ClientService
+	auth     func(ctx context.Context, clientID, secret string) (models.Client, error)
+	token    func(context.Context, *models.Client) (models.Token, error)
+	register func(context.Context, *models.Client) (string, error)
+	rotate   func(ctx context.Context, clientID string, overlap time.Duration) (string, error)
+	validate func(ctx context.Context, accessToken string) (models.Claims, error)
+}
+
+func (t *testClientService) Authenticate(ctx context.Context, clientID, secret string) (models.Client, error) {
+	if t.auth != nil {
+		return t.auth(ctx, clientID, secret)
+	}
+
+	panic("not provided")
+}
+
+func (t *testClientService) Token(ctx context.Context, c *models.Client) (models.Token, error) {
+	if t.token != nil {
+		return t.token(ctx, c)
+	}
+
+	panic("not provided")
+}
+
+func (t *testClientService) Register(ctx context.Context, c *models.Client) (string, error) {
+	if t.register != nil {
+		return t.register(ctx, c)
+	}
+
+	panic("not provided")
+}
+
+func (t *testClientService) RotateSecret(ctx context.Context, clientID string, overlap time.Duration) (string, error) {
+	if t.rotate != nil {
+		return t.rotate(ctx, clientID, overlap)
+	}
+
+	panic("not provided")
+}
+
+func (t *testClientService) Validate(ctx context.Context, accessToken string) (models.Claims, error) {
+	if t.validate != nil {
+		return t.validate(ctx, accessToken)
+	}
+
+	panic("not provided")
+}
+
+func TestUsers_LoginClientCredentials(t *testing.T) {
+	clients := &testClientService{}
+
+	var cases = []struct {
+		name       string
+		cfg        OAuthConfig
+		content    string
+		authHeader string
+		outStatus  int
+		outJSON    string
+		outID      string
+		outSecret  string
+	}{
+		{
+			"basic",
+			OAuthConfig{},
+			"grant_type=client_credentials",
+			"Basic " + base64.StdEncoding.EncodeToString([]byte("ci-bot:s3cr%3At")),
+			http.StatusOK,
+			`{"access_token": "client access token", "expires_in": 900, "token_type": "bearer"}`,
+			"ci-bot",
+			"s3cr:t",
+		},
+		{
+			"form",
+			OAuthConfig{},
+			"grant_type=client_credentials&client_id=ci-bot&client_secret=s3cret",
+			"",
+			http.StatusOK,
+			`{"access_token": "client access token", "expires_in": 900, "token_type": "bearer"}`,
+			"ci-bot",
+			"s3cret",
+		},
+		{
+			"basicPrecedence",
+			OAuthConfig{},
+			"grant_type=client_credentials&client_id=form-bot&client_secret=form",
+			"Basic " + base64.StdEncoding.EncodeToString([]byte("ci-bot:s3cret")),
+			http.StatusOK,
+			`{"access_token": "client access token", "expires_in": 900, "token_type": "bearer"}`,
+			"ci-bot",
+			"s3cret",
+		},
+		{
+			"formPrecedenceAllowed",
+			OAuthConfig{FormClientCredentials: true},
+			"grant_type=client_credentials&client_id=form-bot&client_secret=form",
+			"Basic " + base64.StdEncoding.EncodeToString([]byte("ci-bot:s3cret")),
+			http.StatusOK,
+			`{"access_token": "client access token", "expires_in": 900, "token_type": "bearer"}`,
+			"form-bot",
+			"form",
+		},
+		{
+			"malformedBasic",
+			OAuthConfig{},
+			"grant_type=client_credentials",
+			"Basic not*base64",
+			http.StatusUnauthorized,
+			`{"error": "invalid_client"}`,
+			"",
+			"",
+		},
+		{
+			"malformedBasicNoColon",
+			OAuthConfig{},
+			"grant_type=client_credentials",
+			"Basic " + base64.StdEncoding.EncodeToString([]byte("ci-bot")),
+			http.StatusUnauthorized,
+			`{"error": "invalid_client"}`,
+			"",
+			"",
+		},
+		{
+			"badSecret",
+			OAuthConfig{},
+			"grant_type=client_credentials",
+			"Basic " + base64.StdEncoding.EncodeToString([]byte("ci-bot:wrong")),
+			http.StatusUnauthorized,
+			`{"error": "invalid_client"}`,
+			"ci-bot",
+			"wrong",
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			u := NewUsers(&testUserService{}, clients, nil, nil, cs.cfg, nil)
+
+			var called bool
+			clients.auth = func(ctx context.Context, clientID, secret string) (models.Client, error) {
+				called = true
+				assert.Equal(t, cs.outID, clientID)
+				assert.Equal(t, cs.outSecret, secret)
+
+				if secret == "wrong" {
+					return models.Client{}, models.ErrInvalidClient
+				}
+				return models.Client{ID: clientID, Active: true}, nil
+			}
+			clients.token = func(ctx context.Context, c *models.Client) (models.Token, error) {
+				assert.Equal(t, cs.outID, c.ID)
+
+				return models.Token{
+					AccessToken: "client access token",
+					ExpiresIn:   900,
+					TokenType:   "bearer",
+				}, nil
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/oauth/login/", bytes.NewReader([]byte(cs.content)))
+			r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			if cs.authHeader != "" {
+				r.Header.Add("Authorization", cs.authHeader)
+			}
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+			assert.Equal(t, cs.outID != "", called)
+
+			*clients = testClientService{}
+		})
+	}
+}
+
+type testAuditService struct {
+	models.AuditService
+	events []models.AuditEvent
+}
+
+func (t *testAuditService) Record(ctx context.Context, e *models.AuditEvent) error {
+	t.events = append(t.events, *e)
+	return nil
+}
+
+func TestUsers_LoginClientToken(t *testing.T) {
+	us := &testUserService{}
+	clients := &testClientService{}
+	u := NewUsers(us, clients, nil, nil, OAuthConfig{}, nil)
+
+	us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+		return models.User{ID: 88, Active: true}, nil
+	}
+	us.token = func(ctx context.Context, u *models.User) (models.Token, error) {
+		return models.Token{AccessToken: "default", ExpiresIn: 21600, TokenType: "bearer"}, nil
+	}
+	us.clientToken = func(ctx context.Context, u *models.User, c *models.Client, scopes ...string) (models.Token, error) {
+		assert.Equal(t, int64(88), u.ID)
+		if c.ID == "" {
+			assert.Equal(t, []string{"admin", "profile"}, scopes)
+			return models.Token{AccessToken: "scoped", ExpiresIn: 300, TokenType: "bearer"}, nil
+		}
+
+		assert.Equal(t, "mobile", c.ID)
+		return models.Token{AccessToken: "client", ExpiresIn: 300, TokenType: "bearer"}, nil
+	}
+	clients.auth = func(ctx context.Context, clientID, secret string) (models.Client, error) {
+		return models.Client{ID: clientID, Active: true, AccessTokenTTL: 5 * time.Minute}, nil
+	}
+
+	var cases = []struct {
+		name    string
+		content string
+		outJSON string
+	}{
+		{
+			"withClient",
+			"grant_type=password&email=a@b.com&password=pass&client_id=mobile&client_secret=s3cret",
+			`{"access_token": "client", "expires_in": 300, "token_type": "bearer"}`,
+		},
+		{
+			"withoutClient",
+			"grant_type=password&email=a@b.com&password=pass",
+			`{"access_token": "default", "expires_in": 21600, "token_type": "bearer"}`,
+		},
+		{
+			// scoped tokens get the lifetimes configured for their scopes.
+			"withScopes",
+			"grant_type=password&email=a@b.com&password=pass&scope=admin+profile+admin",
+			`{"access_token": "scoped", "expires_in": 300, "token_type": "bearer"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(cs.content))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_LoginMaxScopes(t *testing.T) {
+	us := &testUserService{
+		auth: func(ctx context.Context, username, password string) (models.User, error) {
+			return models.User{ID: 88, Active: true}, nil
+		},
+		token: func(ctx context.Context, u *models.User) (models.Token, error) {
+			return models.Token{AccessToken: "access", ExpiresIn: 21600, TokenType: "bearer"}, nil
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		max       int
+		scope     string
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"underCap",
+			3,
+			"profile email calendar",
+			http.StatusOK,
+			`{"access_token": "access", "expires_in": 21600, "token_type": "bearer"}`,
+		},
+		{
+			"duplicatesCountOnce",
+			3,
+			"profile email profile calendar email",
+			http.StatusOK,
+			`{"access_token": "access", "expires_in": 21600, "token_type": "bearer"}`,
+		},
+		{
+			"overCap",
+			3,
+			"profile email calendar contacts",
+			http.StatusBadRequest,
+			`{"error": "too_many_scopes"}`,
+		},
+		{
+			"unlimited",
+			0,
+			"profile email calendar contacts",
+			http.StatusOK,
+			`{"access_token": "access", "expires_in": 21600, "token_type": "bearer"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			u := NewUsers(us, nil, nil, nil, OAuthConfig{MaxRequestedScopes: cs.max}, nil)
+
+			form := url.Values{
+				"grant_type": {"password"},
+				"email":      {"a@b.com"},
+				"password":   {"pass"},
+				"scope":      {cs.scope},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_LoginGrantScopes(t *testing.T) {
+	us := &testUserService{
+		auth: func(ctx context.Context, username, password string) (models.User, error) {
+			return models.User{ID: 88, Active: true}, nil
+		},
+		token: func(ctx context.Context, u *models.User) (models.Token, error) {
+			return models.Token{AccessToken: "access", ExpiresIn: 21600, TokenType: "bearer"}, nil
+		},
+	}
+	clients := &testClientService{
+		auth: func(ctx context.Context, clientID, secret string) (models.Client, error) {
+			return models.Client{ID: clientID}, nil
+		},
+		token: func(ctx context.Context, c *models.Client) (models.Token, error) {
+			return models.Token{AccessToken: "client access", ExpiresIn: 900, TokenType: "bearer"}, nil
+		},
+	}
+	u := NewUsers(us, clients, nil, nil, OAuthConfig{GrantScopes: map[string][]string{
+		"client_credentials": {"metrics"},
+	}}, nil)
+
+	var cases = []struct {
+		name      string
+		form      url.Values
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"clientAllowed",
+			url.Values{"grant_type": {"client_credentials"}, "client_id": {"ci-bot"}, "client_secret": {"s3cret"}, "scope": {"metrics"}},
+			http.StatusOK,
+			`{"access_token": "client access", "expires_in": 900, "token_type": "bearer"}`,
+		},
+		{
+			"clientUserScope",
+			url.Values{"grant_type": {"client_credentials"}, "client_id": {"ci-bot"}, "client_secret": {"s3cret"}, "scope": {"metrics users.read"}},
+			http.StatusBadRequest,
+			`{"error": "invalid_scope"}`,
+		},
+		{
+			"unrestrictedGrant",
+			url.Values{"grant_type": {"password"}, "email": {"a@b.com"}, "password": {"pass"}, "scope": {"users.read"}},
+			http.StatusOK,
+			`{"access_token": "access", "expires_in": 21600, "token_type": "bearer"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(cs.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_LoginScopeNormalization(t *testing.T) {
+	var granted []string
+	us := &testUserService{
+		auth: func(ctx context.Context, username, password string) (models.User, error) {
+			return models.User{ID: 88, Active: true}, nil
+		},
+		clientToken: func(ctx context.Context, u *models.User, c *models.Client, scopes ...string) (models.Token, error) {
+			granted = scopes
+			return models.Token{AccessToken: "scoped", ExpiresIn: 300, TokenType: "bearer"}, nil
+		},
+	}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{KnownScopes: []string{"calendar", "email", "profile"}}, nil)
+
+	var cases = []struct {
+		name       string
+		scope      string
+		outStatus  int
+		outJSON    string
+		outGranted []string
+	}{
+		{
+			"duplicates",
+			"profile email profile",
+			http.StatusOK,
+			`{"access_token": "scoped", "expires_in": 300, "token_type": "bearer"}`,
+			[]string{"email", "profile"},
+		},
+		{
+			"whitespace",
+			"  calendar\t profile  email ",
+			http.StatusOK,
+			`{"access_token": "scoped", "expires_in": 300, "token_type": "bearer"}`,
+			[]string{"calendar", "email", "profile"},
+		},
+		{
+			"unknown",
+			"profile admin",
+			http.StatusBadRequest,
+			`{"error": "invalid_scope"}`,
+			nil,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			granted = nil
+
+			form := url.Values{
+				"grant_type": {"password"},
+				"email":      {"a@b.com"},
+				"password":   {"pass"},
+				"scope":      {cs.scope},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+			assert.Equal(t, cs.outGranted, granted)
+		})
+	}
+}
+
+func TestUsers_LoginGrants(t *testing.T) {
+	us := &testUserService{
+		auth: func(ctx context.Context, username, password string) (models.User, error) {
+			return models.User{ID: 88, Active: true}, nil
+		},
+		token: func(ctx context.Context, u *models.User) (models.Token, error) {
+			return models.Token{AccessToken: "plain", ExpiresIn: 300, TokenType: "bearer"}, nil
+		},
+		clientToken: func(ctx context.Context, u *models.User, c *models.Client, scopes ...string) (models.Token, error) {
+			return models.Token{AccessToken: "scoped", ExpiresIn: 300, TokenType: "bearer"}, nil
+		},
+	}
+	roles := models.RoleProviderFunc(func(ctx context.Context, u models.User) ([]string, error) {
+		assert.Equal(t, int64(88), u.ID)
+		return []string{"admin", "support"}, nil
+	})
+
+	var cases = []struct {
+		name      string
+		cfg       OAuthConfig
+		scope     string
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"disabled",
+			OAuthConfig{Roles: roles},
+			"profile email",
+			http.StatusOK,
+			`{"access_token": "scoped", "expires_in": 300, "token_type": "bearer"}`,
+		},
+		{
+			"enabled",
+			OAuthConfig{TokenGrants: true, Roles: roles},
+			"profile email",
+			http.StatusOK,
+			`{"access_token": "scoped", "expires_in": 300, "token_type": "bearer", "scope": "email profile", "roles": ["admin", "support"]}`,
+		},
+		{
+			"enabledNoScopes",
+			OAuthConfig{TokenGrants: true, Roles: roles},
+			"",
+			http.StatusOK,
+			`{"access_token": "plain", "expires_in": 300, "token_type": "bearer", "scope": "", "roles": ["admin", "support"]}`,
+		},
+		{
+			"enabledNoRoles",
+			OAuthConfig{TokenGrants: true},
+			"profile",
+			http.StatusOK,
+			`{"access_token": "scoped", "expires_in": 300, "token_type": "bearer", "scope": "profile", "roles": []}`,
+		},
+		{
+			"rolesFail",
+			OAuthConfig{TokenGrants: true, Roles: models.RoleProviderFunc(func(ctx context.Context, u models.User) ([]string, error) {
+				return nil, privateError("roles: directory unavailable")
+			})},
+			"profile",
+			http.StatusInternalServerError,
+			`{"error": "server_error"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			u := NewUsers(us, nil, nil, nil, cs.cfg, nil)
+
+			form := url.Values{
+				"grant_type": {"password"},
+				"email":      {"a@b.com"},
+				"password":   {"pass"},
+				"scope":      {cs.scope},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_LoginRoleScopes(t *testing.T) {
+	var granted []string
+	us := &testUserService{
+		auth: func(ctx context.Context, username, password string) (models.User, error) {
+			return models.User{ID: 88, Active: true}, nil
+		},
+		token: func(ctx context.Context, u *models.User) (models.Token, error) {
+			granted = nil
+			return models.Token{AccessToken: "plain", ExpiresIn: 300, TokenType: "bearer"}, nil
+		},
+		clientToken: func(ctx context.Context, u *models.User, c *models.Client, scopes ...string) (models.Token, error) {
+			granted = scopes
+			return models.Token{AccessToken: "scoped", ExpiresIn: 300, TokenType: "bearer"}, nil
+		},
+	}
+	rolesOf := func(roles ...string) models.RoleProvider {
+		return models.RoleProviderFunc(func(ctx context.Context, u models.User) ([]string, error) {
+			return roles, nil
+		})
+	}
+	roleScopes := map[string][]string{
+		"admin":   {"users.write", "users.read"},
+		"support": {"users.read", "tickets"},
+	}
+
+	var cases = []struct {
+		name      string
+		roles     models.RoleProvider
+		scope     string
+		outScopes []string
+	}{
+		{"adminDefault", rolesOf("admin"), "", []string{"users.read", "users.write"}},
+		{"adminNarrowed", rolesOf("admin"), "users.read", []string{"users.read"}},
+		{"adminNotImplied", rolesOf("admin"), "users.read tickets", []string{"users.read"}},
+		{"severalRoles", rolesOf("admin", "support"), "", []string{"tickets", "users.read", "users.write"}},
+		{"noImpliedScopes", rolesOf("guest"), "profile", []string{"profile"}},
+		{"noImpliedScopesDefault", rolesOf("guest"), "", nil},
+		{"noRoleProvider", nil, "profile", []string{"profile"}},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			u := NewUsers(us, nil, nil, nil, OAuthConfig{Roles: cs.roles, RoleScopes: roleScopes}, nil)
+
+			form := url.Values{
+				"grant_type": {"password"},
+				"email":      {"a@b.com"},
+				"password":   {"pass"},
+				"scope":      {cs.scope},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+			assert.Equal(t, cs.outScopes, granted)
+		})
+	}
+}
+
+func TestUsers_LoginTokenScope(t *testing.T) {
+	us := &testUserService{
+		auth: func(ctx context.Context, username, password string) (models.User, error) {
+			return models.User{ID: 88, Active: true}, nil
+		},
+		clientToken: func(ctx context.Context, u *models.User, c *models.Client, scopes ...string) (models.Token, error) {
+			return models.Token{AccessToken: "scoped", ExpiresIn: 300, TokenType: "bearer"}, nil
+		},
+	}
+	roles := models.RoleProviderFunc(func(ctx context.Context, u models.User) ([]string, error) {
+		return []string{"support"}, nil
+	})
+	roleScopes := map[string][]string{"support": {"users.read", "tickets"}}
+
+	var cases = []struct {
+		name    string
+		enabled bool
+		scope   string
+		outJSON string
+	}{
+		{"narrowed", true, "users.read users.write", `{"access_token": "scoped", "expires_in": 300, "token_type": "bearer", "scope": "users.read"}`},
+		{"defaulted", true, "", `{"access_token": "scoped", "expires_in": 300, "token_type": "bearer", "scope": "tickets users.read"}`},
+		{"full", true, "users.read tickets", `{"access_token": "scoped", "expires_in": 300, "token_type": "bearer"}`},
+		{"disabled", false, "users.read users.write", `{"access_token": "scoped", "expires_in": 300, "token_type": "bearer"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			u := NewUsers(us, nil, nil, nil, OAuthConfig{Roles: roles, RoleScopes: roleScopes, TokenScope: cs.enabled}, nil)
+
+			form := url.Values{
+				"grant_type": {"password"},
+				"email":      {"a@b.com"},
+				"password":   {"pass"},
+				"scope":      {cs.scope},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestLimitScopes(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.KeyValues, &web.Values{LimitScopes: true})
+
+	users := NewUsers(&testUserService{}, nil, nil, nil, OAuthConfig{}, nil).viewErr
+	mfa := NewMFA(nil, nil, nil).viewErr
+	recoveries := NewRecoveries(nil).viewErr
+
+	var cases = []struct {
+		name     string
+		view     web.Error
+		err      error
+		outScope string
+	}{
+		{"signup", users, ErrSignupRateLimited, web.LimitScopeIP},
+		{"deviceCodes", users, models.ErrTooManyDeviceCodes, web.LimitScopeClient},
+		{"devicePolling", users, models.ErrSlowDown, web.LimitScopeGrant},
+		{"loginMFA", users, models.ErrMFALocked, web.LimitScopeUser},
+		{"concurrentLogins", users, models.ErrTooManyConcurrentLogins, web.LimitScopeUser},
+		{"mfa", mfa, models.ErrMFALocked, web.LimitScopeUser},
+		{"recovery", recoveries, models.ErrRecoveryLocked, web.LimitScopeUser},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			require.NoError(t, cs.view.JSON(ctx, w, cs.err))
+
+			var body map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, cs.outScope, body["limit_scope"])
+		})
+	}
+}
+
+func TestUsers_LoginStandardErrors(t *testing.T) {
+	us := &testUserService{}
+	clients := &testClientService{}
+	u := NewUsers(us, clients, nil, nil, OAuthConfig{}, nil)
+	h := mw.OAuthErrors("https://docs.example.com/errors#")(u.Login)
+
+	var cases = []struct {
+		name      string
+		content   string
+		outStatus int
+		outJSON   string
+		setup     func()
+	}{
+		{
+			"wrongPassword",
+			"grant_type=password&email=someone%40example.com&password=wrong",
+			http.StatusBadRequest,
+			`{"error": "invalid_grant", "error_description": "username, password or refresh token are invalid, user does not exist or validation failed", "error_uri": "https://docs.example.com/errors#unauthorised"}`,
+			func() {
+				us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+					return models.User{}, models.ErrUnauthorised
+				}
+			},
+		},
+		{
+			"refreshReauthRequired",
+			"grant_type=refresh_token&refresh_token=expired",
+			http.StatusBadRequest,
+			`{"error": "invalid_grant", "error_description": "a fresh login is required to continue the session", "error_uri": "https://docs.example.com/errors#reauth_required"}`,
+			func() {
+				us.rotate = func(ctx context.Context, r string) (models.Token, error) {
+					return models.Token{}, models.ErrReauthRequired
+				}
+			},
+		},
+		{
+			"invalidClient",
+			"grant_type=client_credentials&client_id=ci-bot&client_secret=wrong",
+			http.StatusUnauthorized,
+			`{"error": "invalid_client", "error_description": "client authentication failed", "error_uri": "https://docs.example.com/errors#invalid_client"}`,
+			func() {
+				clients.auth = func(ctx context.Context, clientID, secret string) (models.Client, error) {
+					return models.Client{}, models.ErrInvalidClient
+				}
+			},
+		},
+		{
+			"unsupportedGrantType",
+			"grant_type=magic",
+			http.StatusBadRequest,
+			`{"error": "unsupported_grant_type", "error_description": "the grant-type provided is not supported", "error_uri": "https://docs.example.com/errors#unsupported_grant_type"}`,
+			nil,
+		},
+		{
+			"missingGrantType",
+			"email=someone%40example.com",
+			http.StatusBadRequest,
+			`{"error": "invalid_request", "error_description": "the grant_type parameter is required", "error_uri": "https://docs.example.com/errors#invalid_request"}`,
+			nil,
+		},
+		{
+			"serverError",
+			"grant_type=password&email=someone%40example.com&password=secret",
+			http.StatusInternalServerError,
+			`{"error": "server_error", "error_uri": "https://docs.example.com/errors#server_error"}`,
+			func() {
+				us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+					return models.User{}, errors.New("connection refused")
+				}
+			},
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			*us = testUserService{}
+			*clients = testClientService{}
+			if cs.setup != nil {
+				cs.setup()
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/oauth/login/", strings.NewReader(cs.content))
+			r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_LoginSilent(t *testing.T) {
+	us := &testUserService{}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{SilentAuth: true}, nil)
+
+	var cases = []struct {
+		name      string
+		content   string
+		outStatus int
+		outJSON   string
+		setup     func()
+	}{
+		{
+			"activeSession",
+			"grant_type=refresh_token&refresh_token=active&prompt=none",
+			http.StatusOK,
+			`{"access_token": "silent access", "refresh_token": "silent refresh", "expires_in": 900, "token_type": "bearer"}`,
+			func() {
+				us.rotate = func(ctx context.Context, r string) (models.Token, error) {
+					return models.Token{AccessToken: "silent access", RefreshToken: "silent refresh", ExpiresIn: 900, TokenType: "bearer"}, nil
+				}
+			},
+		},
+		{
+			"noSession",
+			"grant_type=refresh_token&prompt=none",
+			http.StatusUnauthorized,
+			`{"error": "login_required"}`,
+			func() {
+				us.rotate = func(ctx context.Context, r string) (models.Token, error) {
+					return models.Token{}, models.ErrNoCredentials
+				}
+			},
+		},
+		{
+			"sessionEnded",
+			"grant_type=refresh_token&refresh_token=revoked&prompt=none",
+			http.StatusUnauthorized,
+			`{"error": "login_required"}`,
+			func() {
+				us.rotate = func(ctx context.Context, r string) (models.Token, error) {
+					return models.Token{}, models.ErrReauthRequired
+				}
+			},
+		},
+		{
+			"interactiveGrant",
+			"grant_type=password&email=a%40b.com&password=pass&prompt=none",
+			http.StatusUnauthorized,
+			`{"error": "interaction_required"}`,
+			nil,
+		},
+		{
+			"notSilent",
+			"grant_type=refresh_token&refresh_token=revoked",
+			http.StatusUnauthorized,
+			`{"error": "reauth_required"}`,
+			func() {
+				us.rotate = func(ctx context.Context, r string) (models.Token, error) {
+					return models.Token{}, models.ErrReauthRequired
+				}
+			},
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			*us = testUserService{}
+			if cs.setup != nil {
+				cs.setup()
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(cs.content))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_LoginMaxAge(t *testing.T) {
+	var got models.RotateOptions
+	us := &testUserService{
+		rotateWith: func(ctx context.Context, r string, opts models.RotateOptions) (models.Token, error) {
+			got = opts
+			if opts.MaxAge > 0 && opts.MaxAge < time.Hour {
+				return models.Token{}, models.ErrReauthRequired
+			}
+
+			return models.Token{AccessToken: "access", ExpiresIn: 900, TokenType: "bearer"}, nil
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		enforce   bool
+		content   string
+		outStatus int
+		outJSON   string
+		outMaxAge time.Duration
+	}{
+		{"withinMaxAge", true, "max_age=7200", http.StatusOK, `{"access_token": "access", "expires_in": 900, "token_type": "bearer"}`, 2 * time.Hour},
+		{"beyondMaxAge", true, "max_age=600", http.StatusUnauthorized, `{"error": "reauth_required"}`, 10 * time.Minute},
+		{"beyondMaxAgeSilent", true, "max_age=600&prompt=none", http.StatusUnauthorized, `{"error": "login_required"}`, 10 * time.Minute},
+		{"zero", true, "max_age=0", http.StatusUnauthorized, `{"error": "reauth_required"}`, 0},
+		{"zeroSilent", true, "max_age=0&prompt=none", http.StatusUnauthorized, `{"error": "login_required"}`, 0},
+		{"invalid", true, "max_age=soon", http.StatusBadRequest, `{"error": "invalid_form"}`, 0},
+		{"disabled", false, "max_age=600", http.StatusOK, `{"access_token": "access", "expires_in": 900, "token_type": "bearer"}`, 0},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			got = models.RotateOptions{}
+			u := NewUsers(us, nil, nil, nil, OAuthConfig{EnforceMaxAge: cs.enforce, SilentAuth: true}, nil)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader("grant_type=refresh_token&refresh_token=active&"+cs.content))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+			assert.Equal(t, cs.outMaxAge, got.MaxAge)
+		})
+	}
+}
+
+func TestUsers_LoginRefreshClient(t *testing.T) {
+	// the refresh token was issued to the app client, which must authenticate to exchange it.
+	us := &testUserService{
+		rotateWith: func(ctx context.Context, r string, opts models.RotateOptions) (models.Token, error) {
+			if opts.ClientID != "app" {
+				return models.Token{}, models.ErrUnauthorised
+			}
+
+			return models.Token{AccessToken: "access", ExpiresIn: 900, TokenType: "bearer"}, nil
+		},
+	}
+	clients := &testClientService{
+		auth: func(ctx context.Context, clientID, secret string) (models.Client, error) {
+			return models.Client{ID: clientID}, nil
+		},
+	}
+	u := NewUsers(us, clients, nil, nil, OAuthConfig{}, nil)
+	h := mw.OAuthErrors("")(u.Login)
+
+	const invalidGrant = `{"error": "invalid_grant", "error_description": "username, password or refresh token are invalid, user does not exist or validation failed"}`
+
+	var cases = []struct {
+		name      string
+		content   string
+		outStatus int
+		outJSON   string
+	}{
+		{"sameClient", "client_id=app", http.StatusOK, `{"access_token": "access", "expires_in": 900, "token_type": "bearer"}`},
+		{"wrongClient", "client_id=other", http.StatusBadRequest, invalidGrant},
+		{"missingClient", "", http.StatusBadRequest, invalidGrant},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader("grant_type=refresh_token&refresh_token=active&"+cs.content))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_LoginIDToken(t *testing.T) {
+	us := &testUserService{
+		auth: func(ctx context.Context, username, password string) (models.User, error) {
+			return models.User{ID: 88, Active: true}, nil
+		},
+		token: func(ctx context.Context, u *models.User) (models.Token, error) {
+			return models.Token{AccessToken: "access", ExpiresIn: 900, TokenType: "bearer"}, nil
+		},
+		idToken: func(ctx context.Context, u *models.User, clientID string, opts models.IDTokenOptions, scopes ...string) (string, error) {
+			assert.Equal(t, int64(88), u.ID)
+			assert.Equal(t, "n-0S6_WzA2Mj", opts.Nonce)
+			return "id token for " + strings.Join(scopes, " "), nil
+		},
+	}
+
+	var cases = []struct {
+		name    string
+		enabled bool
+		scope   string
+		outJSON string
+	}{
+		{"openid", true, "openid profile", `{"access_token": "access", "expires_in": 900, "token_type": "bearer", "id_token": "id token for openid profile"}`},
+		{"notRequested", true, "profile", `{"access_token": "access", "expires_in": 900, "token_type": "bearer"}`},
+		{"disabled", false, "openid profile", `{"access_token": "access", "expires_in": 900, "token_type": "bearer"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			u := NewUsers(us, nil, nil, nil, OAuthConfig{IDTokens: cs.enabled}, nil)
+
+			form := url.Values{
+				"grant_type": {"password"},
+				"email":      {"a@b.com"},
+				"password":   {"pass"},
+				"scope":      {cs.scope},
+				"nonce":      {"n-0S6_WzA2Mj"},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_LoginDuplicateParams(t *testing.T) {
+	us := &testUserService{
+		auth: func(ctx context.Context, username, password string) (models.User, error) {
+			return models.User{ID: 88, Active: true}, nil
+		},
+		token: func(ctx context.Context, u *models.User) (models.Token, error) {
+			return models.Token{AccessToken: "access", ExpiresIn: 21600, TokenType: "bearer"}, nil
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		reject    bool
+		content   string
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"single",
+			true,
+			"grant_type=password&email=a@b.com&password=pass&scope=profile",
+			http.StatusOK,
+			`{"access_token": "access", "expires_in": 21600, "token_type": "bearer"}`,
+		},
+		{
+			"duplicateGrantType",
+			true,
+			"grant_type=password&grant_type=client_credentials&email=a@b.com&password=pass",
+			http.StatusBadRequest,
+			`{"error": "invalid_form"}`,
+		},
+		{
+			"duplicateScope",
+			true,
+			"grant_type=password&email=a@b.com&password=pass&scope=profile&scope=admin",
+			http.StatusBadRequest,
+			`{"error": "invalid_form"}`,
+		},
+		{
+			"duplicateAllowed",
+			false,
+			"grant_type=password&email=a@b.com&password=pass&scope=profile&scope=admin",
+			http.StatusOK,
+			`{"access_token": "access", "expires_in": 21600, "token_type": "bearer"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			u := NewUsers(us, nil, nil, nil, OAuthConfig{RejectDuplicateParams: cs.reject}, nil)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", strings.NewReader(cs.content))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := u.Login(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestUsers_LoginAudit(t *testing.T) {
+	us := &testUserService{}
+	as := &testAuditService{}
+	u := NewUsers(us, nil, nil, as, OAuthConfig{}, nil)
+
+	login := func(content string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/oauth/login/", bytes.NewReader([]byte(content)))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+		err := u.Login(testContext(), w, r)
+		require.NoError(t, err)
+	}
+
+	us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+		return models.User{}, models.ErrUnauthorised
+	}
+	login("grant_type=password&email=test@test.com&password=wrong")
+
+	us.auth = func(ctx context.Context, username, password string) (models.User, error) {
+		return models.User{ID: 99}, nil
+	}
+	us.token = func(ctx context.Context, u *models.User) (models.Token, error) {
+		return models.Token{}, nil
+	}
+	login("grant_type=password&email=test@test.com&password=secret")
+
+	assert.Equal(t, []models.AuditEvent{
+		{Action: "login_failed"},
+		{Action: "login", UserID: 99},
+	}, as.events)
+}
+
+// trickleReader returns the bytes of body one at a time, waiting delay before each of them.
+type trickleReader struct {
+	body  string
+	delay time.Duration
+}
+
+func (tr *trickleReader) Read(p []byte) (int, error) {
+	if len(tr.body) == 0 {
+		return 0, io.EOF
+	}
+
+	time.Sleep(tr.delay)
+	p[0] = tr.body[0]
+	tr.body = tr.body[1:]
+
+	return 1, nil
+}
+
+func TestUsers_LoginBodyTimeout(t *testing.T) {
+	us := &testUserService{
+		auth: func(ctx context.Context, username, password string) (models.User, error) {
+			return models.User{ID: 88, Active: true}, nil
+		},
+		token: func(ctx context.Context, u *models.User) (models.Token, error) {
+			return models.Token{AccessToken: "access", ExpiresIn: 21600, TokenType: "bearer"}, nil
+		},
+	}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{}, nil)
+	h := mw.BodyTimeout(50 * time.Millisecond)(u.Login)
+
+	form := url.Values{
+		"grant_type": {"password"},
+		"email":      {"a@b.com"},
+		"password":   {"pass"},
+	}.Encode()
+
+	var cases = []struct {
+		name      string
+		body      io.Reader
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"inTime",
+			strings.NewReader(form),
+			http.StatusOK,
+			`{"access_token": "access", "expires_in": 21600, "token_type": "bearer"}`,
+		},
+		{
+			"slowBody",
+			&trickleReader{body: form, delay: 10 * time.Millisecond},
+			http.StatusRequestTimeout,
+			`{"error": "request_timeout"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/", cs.body)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+type testCaptchaVerifier struct {
+	verify func(ctx context.Context, response, remoteIP string) (bool, error)
+}
+
+func (t *testCaptchaVerifier) Verify(ctx context.Context, response, remoteIP string) (bool, error) {
+	if t.verify != nil {
+		return t.verify(ctx, response, remoteIP)
+	}
+
+	panic("not provided")
+}
+
+func TestUsers_CreateCaptchaThreshold(t *testing.T) {
+	us := &testUserService{
+		create: func(ctx context.Context, u *models.User) error {
+			if u.FirstName == "" {
+				return models.ValidationError{"firstName": models.ErrRequired}
+			}
+
+			u.ID = 88
+			return nil
+		},
+	}
+	cv := &testCaptchaVerifier{
+		verify: func(ctx context.Context, response, remoteIP string) (bool, error) {
+			assert.Equal(t, "192.0.2.1", remoteIP)
+			return response == "solved", nil
+		},
+	}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{Captcha: cv, SignupCaptchaThreshold: 2}, nil)
+
+	const (
+		invalid = `{"email":"someone@somewhere.com","password":"testpassword"}`
+		valid   = `{"email":"someone@somewhere.com","firstName":"John","password":"testpassword"}`
+	)
+
+	// the cases run in order, sharing the failures recorded by the controller.
+	var cases = []struct {
+		name       string
+		remoteAddr string
+		captcha    string
+		input      string
+		outStatus  int
+		outJSON    string
+	}{
+		{"firstFailure", "192.0.2.1:1234", "", invalid, http.StatusBadRequest, `{"error":"validation_error","fields":{"firstName":"required"}}`},
+		{"secondFailure", "192.0.2.1:1234", "", invalid, http.StatusBadRequest, `{"error":"validation_error","fields":{"firstName":"required"}}`},
+		{"captchaMissing", "192.0.2.1:5678", "", valid, http.StatusForbidden, `{"error":"captcha_required"}`},
+		{"captchaWrong", "192.0.2.1:5678", "guessed", valid, http.StatusForbidden, `{"error":"captcha_required"}`},
+		{"captchaSolved", "192.0.2.1:5678", "solved", valid, http.StatusCreated, ""},
+		{"otherIP", "198.51.100.7:1234", "", valid, http.StatusCreated, ""},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/users/", strings.NewReader(cs.input))
+			r.RemoteAddr = cs.remoteAddr
+			if cs.captcha != "" {
+				r.Header.Set("X-Captcha-Response", cs.captcha)
+			}
+
+			err := u.Create(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("disabledWithoutVerifier", func(t *testing.T) {
+		u := NewUsers(us, nil, nil, nil, OAuthConfig{SignupCaptchaThreshold: 1}, nil)
+
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/users/", strings.NewReader(invalid))
+
+			require.NoError(t, u.Create(testContext(), w, r))
+			assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		}
+	})
+}
+
+func TestUsers_CreateSignupLimit(t *testing.T) {
+	us := &testUserService{
+		create: func(ctx context.Context, u *models.User) error {
+			if u.FirstName == "" {
+				return models.ValidationError{"firstName": models.ErrRequired}
+			}
+
+			u.ID = 88
+			return nil
+		},
+	}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{MaxSignupsPerIP: 2}, nil)
+
+	const (
+		invalid = `{"email":"someone@somewhere.com","password":"testpassword"}`
+		valid   = `{"email":"someone@somewhere.com","firstName":"John","password":"testpassword"}`
+	)
+
+	// the cases run in order, sharing the signups recorded by the controller.
+	var cases = []struct {
+		name       string
+		remoteAddr string
+		input      string
+		outStatus  int
+		outJSON    string
+	}{
+		{"first", "192.0.2.1:1234", valid, http.StatusCreated, ""},
+		{"failureNotCounted", "192.0.2.1:1234", invalid, http.StatusBadRequest, `{"error":"validation_error","fields":{"firstName":"required"}}`},
+		{"second", "192.0.2.1:5678", valid, http.StatusCreated, ""},
+		{"limited", "192.0.2.1:1234", valid, http.StatusTooManyRequests, `{"error":"signup_rate_limited"}`},
+		{"limitedInvalid", "192.0.2.1:1234", invalid, http.StatusTooManyRequests, `{"error":"signup_rate_limited"}`},
+		{"otherIP", "198.51.100.7:1234", valid, http.StatusCreated, ""},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/users/", strings.NewReader(cs.input))
+			r.RemoteAddr = cs.remoteAddr
+
+			err := u.Create(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUsers_CreateDisabled(t *testing.T) {
+	us := &testUserService{
+		create: func(ctx context.Context, u *models.User) error {
+			t.Error("user created with signups disabled")
+			return nil
+		},
+	}
+	u := NewUsers(us, nil, nil, nil, OAuthConfig{DisableSignups: true}, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/users/",
+		strings.NewReader(`{"email":"someone@somewhere.com","firstName":"John","password":"testpassword"}`))
+
+	err := u.Create(testContext(), w, r)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	assert.JSONEq(t, `{"error":"signups_disabled"}`, w.Body.String())
+}
+
+func TestUsers_CheckScopes(t *testing.T) {
+	u := NewUsers(&testUserService{}, nil, nil, nil, OAuthConfig{MaxRequestedScopes: 4}, nil)
+
+	claims := models.NewClaims(models.User{ID: 88})
+	claims.ClientID = "gateway"
+	claims.Scopes = []string{"events", "profile"}
+	ctx := context.WithValue(testContext(), models.KeyClaims, claims)
+
+	var cases = []struct {
+		name      string
+		content   string
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"partiallySatisfied",
+			`{"scopes": ["profile", "email", "events", "profile"]}`,
+			http.StatusOK,
+			`{"satisfied": ["profile", "events"], "missing": ["email"]}`,
+		},
+		{
+			"allSatisfied",
+			`{"scopes": ["events"]}`,
+			http.StatusOK,
+			`{"satisfied": ["events"], "missing": []}`,
+		},
+		{
+			"noneSatisfied",
+			`{"scopes": ["email", "admin"]}`,
+			http.StatusOK,
+			`{"satisfied": [], "missing": ["email", "admin"]}`,
+		},
+		{
+			"tooManyScopes",
+			`{"scopes": ["a", "b", "c", "d", "e"]}`,
+			http.StatusBadRequest,
+			`{"error": "too_many_scopes"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/scopes/", strings.NewReader(cs.content))
+
+			err := u.CheckScopes(ctx, w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/pkg/errors"
@@ -19,7 +20,15 @@ import (
 var viewErr = func() web.Error {
 	var ev web.Error
 	ev.SetCode(models.ErrUnauthorised, http.StatusUnauthorized)
+	ev.SetCode(models.ErrTokenExpired, http.StatusUnauthorized)
+	ev.SetCode(models.ErrInvalidToken, http.StatusUnauthorized)
+	ev.SetCode(models.ErrClaimsRejected, http.StatusForbidden)
+	ev.SetCode(models.ErrClientDisabled, http.StatusUnauthorized)
 	ev.SetCode(ErrForbidden, http.StatusForbidden)
+	ev.SetCode(ErrTokenTooLarge, http.StatusUnauthorized)
+	ev.SetCode(ErrBodyTimeout, http.StatusRequestTimeout)
+	ev.SetCode(ErrMaintenance, http.StatusServiceUnavailable)
+	ev.SetCode(ErrURITooLong, http.StatusRequestURITooLong)
 
 	return ev
 }()
@@ -28,11 +37,62 @@ var viewErr = func() web.Error {
 // the methods required to run middleware.
 type UserService interface {
 	Validate(context.Context, string) (models.Claims, error)
+	ByID(context.Context, int64) (models.User, error)
 }
 
-// Authenticate validates a JWT from the `Authorization` header.
+// APIKeyService is a subset of the models.APIKeyService interface, containing only the methods required
+// to authenticate requests with API keys.
+type APIKeyService interface {
+	Authenticate(context.Context, string) (models.APIKey, error)
+}
+
+// ClientService is a subset of the models.ClientService interface, containing only the methods required
+// to authenticate the requests of clients on their own behalf.
+type ClientService interface {
+	Validate(context.Context, string) (models.Claims, error)
+}
+
+// apiKeyHeader is the header the API keys are sent in.
+const apiKeyHeader = "X-API-Key"
+
+// AuthConfig holds the settings used to tune the authentication middleware.
+type AuthConfig struct {
+	// MaxHeaderSize is the maximum length in bytes accepted for the `Authorization` header. Longer
+	// headers are rejected before being parsed. Zero disables the limit.
+	MaxHeaderSize int
+
+	// Cookie is the name of the cookie the access token may be sent in, as an alternative to the
+	// `Authorization` header, so browser and API clients can use the same endpoints. Empty disables
+	// cookie authentication. The cookie should be set as HttpOnly and SameSite to prevent CSRF.
+	Cookie string
+
+	// PreferCookie makes the cookie take precedence over the `Authorization` header when a request
+	// provides both. The header is preferred otherwise.
+	PreferCookie bool
+
+	// Enricher, when set, augments the authenticated user added to the context. Requests are never
+	// rejected because of it: when it fails or takes longer than EnrichTimeout, the user is added as
+	// validated from the token. Zero EnrichTimeout uses 500 milliseconds.
+	Enricher      models.UserEnricher
+	EnrichTimeout time.Duration
+
+	// APIKeys, when set, authenticates the requests sending an API key in the `X-API-Key` header as the
+	// user who created the key, whatever access token they send along. Nil rejects API keys.
+	APIKeys APIKeyService
+
+	// Clients, when set, also accepts the access tokens the clients got on their own behalf with the
+	// client_credentials grant. Their claims have no user, so it is only meant for the routes that do
+	// not act on the authenticated user. Nil rejects them.
+	Clients ClientService
+}
+
+// defaultEnrichTimeout is the time the user enricher is given when no timeout is configured.
+const defaultEnrichTimeout = 500 * time.Millisecond
+
+// Authenticate validates a JWT from the `Authorization` header or, if configured, from a cookie, or an
+// API key from the `X-API-Key` header when API keys are accepted.
 // Status code of the errors used on this method need to be set at middleware level.
-func Authenticate(us UserService) web.Middleware {
+func Authenticate(us UserService, cfg AuthConfig) web.Middleware {
 
 	// This is the actual middleware function to be executed.
 	f := func(after web.Handler) web.Handler {
@@ -42,20 +102,24 @@ func Authenticate(us UserService) web.Middleware {
 			ctx, span := trace.StartSpan(ctx, "internal.middleware.Authenticate")
 			defer span.End()
 
-			// Parse the authorization header. Expected header is of
-			// the format `Bearer <token>`.
-			token := strings.Split(r.Header.Get("Authorization"), " ")
-			if len(token) != 2 || strings.ToLower(token[0]) != "bearer" {
-				viewErr.JSON(ctx, w, ErrTokenFormat)
-				return nil
+			var (
+				claims models.Claims
+				err    error
+			)
+			if key := r.Header.Get(apiKeyHeader); key != "" && cfg.APIKeys != nil {
+				claims, err = apiKeyClaims(ctx, us, cfg, key)
+			} else {
+				claims, err = tokenClaims(ctx, us, r, cfg)
 			}
-
-			claims, err := us.Validate(ctx, token[1])
 			if err != nil {
 				viewErr.JSON(ctx, w, err)
 				return nil
 			}
 
+			if cfg.Enricher != nil && claims.PrincipalType != models.PrincipalClient {
+				claims.User = enrichUser(ctx, cfg, claims.User)
+			}
+
 			// Add claims to the context so they can be retrieved later.
 			ctx = context.WithValue(ctx, models.KeyClaims, claims)
 
@@ -68,6 +132,127 @@ func Authenticate(us UserService) web.Middleware {
 	return f
 }
 
+// tokenClaims returns the claims of the access token r is sent with. The tokens of the clients are tried
+// once the ones of the users reject it, when accepted, and the error of the users is returned when both
+// reject it.
+func tokenClaims(ctx context.Context, us UserService, r *http.Request, cfg AuthConfig) (models.Claims, error) {
+	token, err := authToken(r, cfg)
+	if err != nil {
+		return models.Claims{}, err
+	}
+
+	claims, err := us.Validate(ctx, token)
+	if err != nil && cfg.Clients != nil {
+		if cc, cerr := cfg.Clients.Validate(ctx, token); cerr == nil {
+			return cc, nil
+		}
+	}
+
+	return claims, err
+}
+
+// apiKeyClaims returns the claims of the user who created the API key with the given secret. The keys of
+// the users no longer active are rejected, as their tokens are. It may return ErrTokenTooLarge.
+func apiKeyClaims(ctx context.Context, us UserService, cfg AuthConfig, secret string) (models.Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.middleware.Authenticate.APIKey")
+	defer span.End()
+
+	if cfg.MaxHeaderSize > 0 && len(secret) > cfg.MaxHeaderSize {
+		return models.Claims{}, ErrTokenTooLarge
+	}
+
+	key, err := cfg.APIKeys.Authenticate(ctx, secret)
+	if err != nil {
+		return models.Claims{}, err
+	}
+
+	user, err := us.ByID(ctx, key.UserID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return models.Claims{}, models.ErrUnauthorised
+		}
+
+		return models.Claims{}, err
+	}
+
+	if !user.Active {
+		return models.Claims{}, models.ErrUnauthorised
+	}
+
+	return models.NewClaims(user), nil
+}
+
+// enrichUser returns u augmented by the enricher of cfg, or u itself when the enricher fails or does not
+// return within the timeout. The enricher keeps running in the background until it returns.
+func enrichUser(ctx context.Context, cfg AuthConfig, u models.User) models.User {
+	ctx, span := trace.StartSpan(ctx, "internal.middleware.Authenticate.Enrich")
+	defer span.End()
+
+	timeout := cfg.EnrichTimeout
+	if timeout <= 0 {
+		timeout = defaultEnrichTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		u   models.User
+		err error
+	}
+
+	// buffered, so the enricher does not block once nobody waits for it.
+	done := make(chan result, 1)
+	go func() {
+		eu, err := cfg.Enricher.EnrichUser(ctx, u)
+		done <- result{eu, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			span.Annotate([]trace.Attribute{trace.StringAttribute("error", res.err.Error())}, "enrichment failed")
+			return u
+		}
+
+		return res.u
+	case <-ctx.Done():
+		span.Annotate(nil, "enrichment timed out")
+		return u
+	}
+}
+
+// authToken extracts the access token of r from the `Authorization` header or the cookie configured in
+// cfg, following the precedence set in cfg when both are present. It may return ErrTokenTooLarge and
+// ErrTokenFormat.
+func authToken(r *http.Request, cfg AuthConfig) (string, error) {
+	header := r.Header.Get("Authorization")
+
+	if cfg.Cookie != "" && (header == "" || cfg.PreferCookie) {
+		if c, err := r.Cookie(cfg.Cookie); err == nil && c.Value != "" {
+			if cfg.MaxHeaderSize > 0 && len(c.Value) > cfg.MaxHeaderSize {
+				return "", ErrTokenTooLarge
+			}
+
+			return c.Value, nil
+		}
+	}
+
+	// Reject oversized headers before doing any work on them.
+	if cfg.MaxHeaderSize > 0 && len(header) > cfg.MaxHeaderSize {
+		return "", ErrTokenTooLarge
+	}
+
+	// Parse the authorization header. Expected header is of
+	// the format `Bearer <token>`.
+	token := strings.Split(header, " ")
+	if len(token) != 2 || strings.ToLower(token[0]) != "bearer" {
+		return "", ErrTokenFormat
+	}
+
+	return token[1], nil
+}
+
 // Me validates that an authenticated user is accessing a resource of his own
 func Me() web.Middleware {
 
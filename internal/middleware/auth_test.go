@@ -0,0 +1,437 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+type testUserService struct {
+	validate func(context.Context, string) (models.Claims, error)
+	byID     func(context.Context, int64) (models.User, error)
+}
+
+func (t *testUserService) Validate(ctx context.Context, token string) (models.Claims, error) {
+	if t.validate != nil {
+		return t.validate(ctx, token)
+	}
+
+	panic("not provided")
+}
+
+func (t *testUserService) ByID(ctx context.Context, id int64) (models.User, error) {
+	if t.byID != nil {
+		return t.byID(ctx, id)
+	}
+
+	panic("not provided")
+}
+
+type testClientService struct {
+	validate func(context.Context, string) (models.Claims, error)
+}
+
+func (t *testClientService) Validate(ctx context.Context, token string) (models.Claims, error) {
+	if t.validate != nil {
+		return t.validate(ctx, token)
+	}
+
+	panic("not provided")
+}
+
+type testAPIKeyService struct {
+	authenticate func(context.Context, string) (models.APIKey, error)
+}
+
+func (t *testAPIKeyService) Authenticate(ctx context.Context, secret string) (models.APIKey, error) {
+	if t.authenticate != nil {
+		return t.authenticate(ctx, secret)
+	}
+
+	panic("not provided")
+}
+
+func testContext() context.Context {
+	return context.WithValue(context.Background(), web.KeyValues, &web.Values{})
+}
+
+// testHandler is the final handler of the chain. It responds with a 200 status and records it was called.
+func testHandler(called *bool) web.Handler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		*called = true
+		return web.Respond(ctx, w, nil, http.StatusOK)
+	}
+}
+
+func TestAuthenticate_MaxHeaderSize(t *testing.T) {
+	const maxSize = 64
+
+	us := &testUserService{
+		validate: func(ctx context.Context, token string) (models.Claims, error) {
+			return models.NewClaims(models.User{ID: 1}), nil
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		header    string
+		outStatus int
+		outJSON   string
+	}{
+		{
+			"atLimit",
+			"Bearer " + strings.Repeat("a", maxSize-len("Bearer ")),
+			http.StatusOK,
+			"null",
+		},
+		{
+			"overLimit",
+			"Bearer " + strings.Repeat("a", maxSize-len("Bearer ")+1),
+			http.StatusUnauthorized,
+			`{"error":"invalid_token"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var called bool
+			h := Authenticate(us, AuthConfig{MaxHeaderSize: maxSize})(testHandler(&called))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", cs.header)
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+			assert.Equal(t, cs.outStatus == http.StatusOK, called)
+		})
+	}
+
+	t.Run("unlimited", func(t *testing.T) {
+		var called bool
+		h := Authenticate(us, AuthConfig{})(testHandler(&called))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+strings.Repeat("a", 10*maxSize))
+
+		err := h(testContext(), w, r)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.True(t, called)
+	})
+}
+
+func TestAuthenticate_Cookie(t *testing.T) {
+	us := &testUserService{
+		validate: func(ctx context.Context, token string) (models.Claims, error) {
+			switch token {
+			case "header-token":
+				return models.NewClaims(models.User{ID: 1}), nil
+			case "cookie-token":
+				return models.NewClaims(models.User{ID: 2}), nil
+			}
+
+			return models.Claims{}, models.ErrUnauthorised
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		cfg       AuthConfig
+		header    string
+		cookie    string
+		outStatus int
+		outUserID int64
+	}{
+		{"headerOnly", AuthConfig{Cookie: "access_token"}, "Bearer header-token", "", http.StatusOK, 1},
+		{"cookieOnly", AuthConfig{Cookie: "access_token"}, "", "cookie-token", http.StatusOK, 2},
+		{"bothPreferHeader", AuthConfig{Cookie: "access_token"}, "Bearer header-token", "cookie-token", http.StatusOK, 1},
+		{"bothPreferCookie", AuthConfig{Cookie: "access_token", PreferCookie: true}, "Bearer header-token", "cookie-token", http.StatusOK, 2},
+		{"preferCookieWithoutCookie", AuthConfig{Cookie: "access_token", PreferCookie: true}, "Bearer header-token", "", http.StatusOK, 1},
+		{"cookieDisabled", AuthConfig{}, "", "cookie-token", http.StatusBadRequest, 0},
+		{"cookieTooLarge", AuthConfig{Cookie: "access_token", MaxHeaderSize: 8}, "", "cookie-token", http.StatusUnauthorized, 0},
+		{"invalidCookie", AuthConfig{Cookie: "access_token"}, "", "forged", http.StatusUnauthorized, 0},
+		{"none", AuthConfig{Cookie: "access_token"}, "", "", http.StatusBadRequest, 0},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var userID int64
+			h := Authenticate(us, cs.cfg)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				userID = ctx.Value(models.KeyClaims).(models.Claims).User.ID
+				return web.Respond(ctx, w, nil, http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if cs.header != "" {
+				r.Header.Set("Authorization", cs.header)
+			}
+			if cs.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "access_token", Value: cs.cookie})
+			}
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.Equal(t, cs.outUserID, userID)
+		})
+	}
+}
+
+func TestAuthenticate_TokenErrors(t *testing.T) {
+	us := &testUserService{
+		validate: func(ctx context.Context, token string) (models.Claims, error) {
+			switch token {
+			case "expired":
+				return models.Claims{}, models.ErrTokenExpired
+			case "tampered", "unknown":
+				return models.Claims{}, models.ErrInvalidToken
+			case "otherTenant":
+				return models.Claims{}, models.ErrClaimsRejected
+			}
+
+			return models.NewClaims(models.User{ID: 1}), nil
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		token     string
+		outJSON   string
+		outStatus int
+	}{
+		{"expired", "expired", `{"error":"token_expired"}`, http.StatusUnauthorized},
+		{"tampered", "tampered", `{"error":"invalid_token"}`, http.StatusUnauthorized},
+		{"unknown", "unknown", `{"error":"invalid_token"}`, http.StatusUnauthorized},
+		{"claimsRejected", "otherTenant", `{"error":"claims_rejected"}`, http.StatusForbidden},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var called bool
+			h := Authenticate(us, AuthConfig{})(testHandler(&called))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+cs.token)
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+			assert.False(t, called)
+		})
+	}
+}
+
+func TestAuthenticate_APIKey(t *testing.T) {
+	us := &testUserService{
+		validate: func(ctx context.Context, token string) (models.Claims, error) {
+			return models.NewClaims(models.User{ID: 1}), nil
+		},
+		byID: func(ctx context.Context, id int64) (models.User, error) {
+			switch id {
+			case 1, 2:
+				return models.User{ID: id, Active: id == 2}, nil
+			}
+
+			return models.User{}, models.ErrNotFound
+		},
+	}
+	as := &testAPIKeyService{
+		authenticate: func(ctx context.Context, secret string) (models.APIKey, error) {
+			switch secret {
+			case "inactive":
+				return models.APIKey{ID: 10, UserID: 1}, nil
+			case "valid":
+				return models.APIKey{ID: 20, UserID: 2}, nil
+			case "deletedUser":
+				return models.APIKey{ID: 30, UserID: 3}, nil
+			}
+
+			return models.APIKey{}, models.ErrUnauthorised
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		cfg       AuthConfig
+		key       string
+		header    string
+		outStatus int
+		outUserID int64
+	}{
+		{"valid", AuthConfig{APIKeys: as}, "valid", "", http.StatusOK, 2},
+		{"preferredToToken", AuthConfig{APIKeys: as}, "valid", "Bearer token", http.StatusOK, 2},
+		{"unknown", AuthConfig{APIKeys: as}, "revoked", "Bearer token", http.StatusUnauthorized, 0},
+		{"inactiveUser", AuthConfig{APIKeys: as}, "inactive", "", http.StatusUnauthorized, 0},
+		{"deletedUser", AuthConfig{APIKeys: as}, "deletedUser", "", http.StatusUnauthorized, 0},
+		{"tooLarge", AuthConfig{APIKeys: as, MaxHeaderSize: 3}, "valid", "", http.StatusUnauthorized, 0},
+		{"disabled", AuthConfig{}, "valid", "", http.StatusBadRequest, 0},
+		{"disabledWithToken", AuthConfig{}, "valid", "Bearer token", http.StatusOK, 1},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var userID int64
+			h := Authenticate(us, cs.cfg)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				claims := ctx.Value(models.KeyClaims).(models.Claims)
+				assert.Equal(t, models.PrincipalUser, claims.PrincipalType)
+
+				userID = claims.User.ID
+				return web.Respond(ctx, w, nil, http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-API-Key", cs.key)
+			if cs.header != "" {
+				r.Header.Set("Authorization", cs.header)
+			}
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.Equal(t, cs.outUserID, userID)
+		})
+	}
+}
+
+func TestAuthenticate_ClientTokens(t *testing.T) {
+	us := &testUserService{
+		validate: func(ctx context.Context, token string) (models.Claims, error) {
+			switch token {
+			case "user":
+				return models.NewClaims(models.User{ID: 1}), nil
+			case "expired":
+				return models.Claims{}, models.ErrTokenExpired
+			}
+
+			return models.Claims{}, models.ErrInvalidToken
+		},
+	}
+	clients := &testClientService{
+		validate: func(ctx context.Context, token string) (models.Claims, error) {
+			if token == "client" {
+				return models.Claims{PrincipalType: models.PrincipalClient, ClientID: "ci-bot"}, nil
+			}
+
+			return models.Claims{}, models.ErrUnauthorised
+		},
+	}
+
+	var cases = []struct {
+		name         string
+		cfg          AuthConfig
+		token        string
+		outStatus    int
+		outPrincipal string
+		outJSON      string
+	}{
+		{"client", AuthConfig{Clients: clients}, "client", http.StatusOK, models.PrincipalClient, ``},
+		{"user", AuthConfig{Clients: clients}, "user", http.StatusOK, models.PrincipalUser, ``},
+		{"userError", AuthConfig{Clients: clients}, "expired", http.StatusUnauthorized, "", `{"error":"token_expired"}`},
+		{"disabled", AuthConfig{}, "client", http.StatusUnauthorized, "", `{"error":"invalid_token"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var principal string
+			h := Authenticate(us, cs.cfg)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				principal = ctx.Value(models.KeyClaims).(models.Claims).PrincipalType
+				return web.Respond(ctx, w, nil, http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+cs.token)
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Result().StatusCode)
+			assert.Equal(t, cs.outPrincipal, principal)
+			if cs.outJSON != "" {
+				assert.JSONEq(t, cs.outJSON, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthenticate_Enricher(t *testing.T) {
+	us := &testUserService{
+		validate: func(ctx context.Context, token string) (models.Claims, error) {
+			return models.NewClaims(models.User{ID: 1, FirstName: "John"}), nil
+		},
+	}
+
+	var cases = []struct {
+		name       string
+		enrich     func(ctx context.Context, u models.User) (models.User, error)
+		outProfile map[string]interface{}
+	}{
+		{
+			name: "enriched",
+			enrich: func(ctx context.Context, u models.User) (models.User, error) {
+				u.Profile = map[string]interface{}{"department": "sales"}
+				return u, nil
+			},
+			outProfile: map[string]interface{}{"department": "sales"},
+		},
+		{
+			name: "failed",
+			enrich: func(ctx context.Context, u models.User) (models.User, error) {
+				return models.User{}, errors.New("profile service unavailable")
+			},
+		},
+		{
+			name: "timedOut",
+			enrich: func(ctx context.Context, u models.User) (models.User, error) {
+				// ignores ctx, so the request must not wait for it.
+				time.Sleep(time.Second)
+				u.Profile = map[string]interface{}{"department": "sales"}
+				return u, nil
+			},
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var user models.User
+			h := Authenticate(us, AuthConfig{
+				Enricher:      models.UserEnricherFunc(cs.enrich),
+				EnrichTimeout: 20 * time.Millisecond,
+			})(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				user = ctx.Value(models.KeyClaims).(models.Claims).User
+				return web.Respond(ctx, w, nil, http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer token")
+
+			start := time.Now()
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+			assert.Equal(t, int64(1), user.ID)
+			assert.Equal(t, "John", user.FirstName)
+			assert.Equal(t, cs.outProfile, user.Profile)
+		})
+	}
+}
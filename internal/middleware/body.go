@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// BodyTimeout limits the time taken to receive the request body to d, counted from the start of the
+// request, so a client trickling the body cannot keep a handler busy. Reads past the deadline fail
+// with ErrBodyTimeout. It is distinct from the server read timeout, which applies to the whole
+// request and is usually longer. A zero d returns a nil middleware, which is skipped.
+func BodyTimeout(d time.Duration) web.Middleware {
+	if d <= 0 {
+		return nil
+	}
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := trace.StartSpan(ctx, "internal.middleware.BodyTimeout")
+			defer span.End()
+
+			r.Body = &timeoutBody{ReadCloser: r.Body, deadline: time.Now().Add(d)}
+
+			return after(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return f
+}
+
+// timeoutBody is a request body failing the reads that do not complete before its deadline.
+type timeoutBody struct {
+	io.ReadCloser
+
+	deadline time.Time
+
+	// mu serialises the reads, as a read still blocked on the connection after the deadline must not
+	// overlap with the next one.
+	mu  sync.Mutex
+	err error
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	remaining := time.Until(b.deadline)
+	if remaining <= 0 {
+		b.err = ErrBodyTimeout
+		return 0, b.err
+	}
+
+	// the read happens on its own buffer, so a read completing after the deadline cannot write to p
+	// once it was returned to the caller.
+	buf := make([]byte, len(p))
+	res := make(chan readResult, 1)
+	go func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		n, err := b.ReadCloser.Read(buf)
+		res <- readResult{n, err}
+	}()
+
+	t := time.NewTimer(remaining)
+	defer t.Stop()
+
+	select {
+	case rr := <-res:
+		return copy(p, buf[:rr.n]), rr.err
+
+	case <-t.C:
+		b.err = ErrBodyTimeout
+		return 0, b.err
+	}
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// slowReader returns the bytes of body one at a time, waiting delay before each of them.
+type slowReader struct {
+	body  string
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(s.body) == 0 {
+		return 0, io.EOF
+	}
+
+	time.Sleep(s.delay)
+	p[0] = s.body[0]
+	s.body = s.body[1:]
+
+	return 1, nil
+}
+
+func TestBodyTimeout(t *testing.T) {
+	var cases = []struct {
+		name    string
+		body    io.Reader
+		outBody string
+		outErr  error
+	}{
+		{
+			"fast",
+			strings.NewReader(`{"email":"john@example.com"}`),
+			`{"email":"john@example.com"}`,
+			nil,
+		},
+		{
+			"trickled",
+			&slowReader{body: `{"email":"john@example.com"}`, delay: 10 * time.Millisecond},
+			"",
+			ErrBodyTimeout,
+		},
+		{
+			// a read blocked on the connection is cut off at the deadline.
+			"stalled",
+			&slowReader{body: `{}`, delay: time.Hour},
+			"",
+			ErrBodyTimeout,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var body []byte
+			var readErr error
+			h := BodyTimeout(50 * time.Millisecond)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				body, readErr = ioutil.ReadAll(r.Body)
+				return nil
+			})
+
+			start := time.Now()
+			err := h(testContext(), httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", cs.body))
+			require.NoError(t, err)
+
+			assert.Less(t, int64(time.Since(start)), int64(time.Second), "reads stop at the deadline")
+			assert.Equal(t, cs.outErr, readErr)
+			if cs.outErr == nil {
+				assert.Equal(t, cs.outBody, string(body))
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, BodyTimeout(0))
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		body := &slowReader{body: `{"email":"john@example.com"}`, delay: 10 * time.Millisecond}
+		h := BodyTimeout(50 * time.Millisecond)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			var req struct {
+				Email string `json:"email"`
+			}
+			return web.Decode(r, &req)
+		})
+
+		w := httptest.NewRecorder()
+		err := h(testContext(), w, httptest.NewRequest(http.MethodPost, "/", body))
+		assert.Equal(t, ErrBodyTimeout, err)
+
+		viewErr.JSON(testContext(), w, err)
+		assert.Equal(t, http.StatusRequestTimeout, w.Code)
+		assert.JSONEq(t, `{"error":"request_timeout"}`, w.Body.String())
+	})
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// defaultTokenCacheControl is the Cache-Control directive of the token responses when none is configured,
+// as required by RFC 6749.
+const defaultTokenCacheControl = "no-store"
+
+// NoStore prevents the responses of the routes it is applied to from being cached by clients and
+// intermediaries, setting the Cache-Control header to cacheControl and the Pragma header to no-cache for
+// HTTP/1.0 caches. It is meant for the responses holding tokens or secrets. An empty cacheControl uses
+// no-store.
+func NoStore(cacheControl string) web.Middleware {
+	if cacheControl == "" {
+		cacheControl = defaultTokenCacheControl
+	}
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := trace.StartSpan(ctx, "internal.middleware.NoStore")
+			defer span.End()
+
+			// headers are set before the handler runs, so they are sent with every response, errors included.
+			w.Header().Set("Cache-Control", cacheControl)
+			w.Header().Set("Pragma", "no-cache")
+
+			return after(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return f
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+func TestNoStore(t *testing.T) {
+	// the token endpoint responds with the tokens, or with an error for rejected credentials.
+	token := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		if r.FormValue("password") != "secret" {
+			viewErr.JSON(ctx, w, models.ErrUnauthorised)
+			return nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write([]byte(`{"access_token": "token", "token_type": "bearer"}`))
+		return err
+	}
+
+	var cases = []struct {
+		name            string
+		cacheControl    string
+		password        string
+		outStatus       int
+		outCacheControl string
+	}{
+		{
+			name:            "token",
+			password:        "secret",
+			outStatus:       http.StatusOK,
+			outCacheControl: "no-store",
+		},
+		{
+			name:            "error",
+			password:        "wrong",
+			outStatus:       http.StatusUnauthorized,
+			outCacheControl: "no-store",
+		},
+		{
+			name:            "configured",
+			cacheControl:    "no-store, private",
+			password:        "secret",
+			outStatus:       http.StatusOK,
+			outCacheControl: "no-store, private",
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			h := NoStore(cs.cacheControl)(token)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/oauth/login/?password="+cs.password, nil)
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Code)
+			assert.Equal(t, cs.outCacheControl, w.Header().Get("Cache-Control"))
+			assert.Equal(t, "no-cache", w.Header().Get("Pragma"))
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"context"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// CompressConfig holds the settings used to tune the response compression.
+type CompressConfig struct {
+	// Enabled compresses the responses of the clients accepting gzip.
+	Enabled bool
+
+	// Level is the gzip compression level, from gzip.BestSpeed to gzip.BestCompression. Zero uses
+	// gzip.DefaultCompression.
+	Level int
+
+	// Types lists the content types compressed, such as "application/json" or "text/*". Empty
+	// compresses every type not in SkipTypes.
+	Types []string
+
+	// SkipTypes lists the content types never compressed, such as the already compressed "image/*".
+	// It takes precedence over Types.
+	SkipTypes []string
+}
+
+// level returns the gzip compression level configured.
+func (c CompressConfig) level() int {
+	if c.Level == 0 {
+		return gzip.DefaultCompression
+	}
+
+	return c.Level
+}
+
+// compresses reports whether the responses with the given content type are compressed.
+func (c CompressConfig) compresses(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if matchType(c.SkipTypes, mt) {
+		return false
+	}
+
+	return len(c.Types) == 0 || matchType(c.Types, mt)
+}
+
+// matchType reports whether the media type mt is in types, where a type like "text/*" matches all
+// of its subtypes.
+func matchType(types []string, mt string) bool {
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == mt || t == "*/*" || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Compress gzips the responses of the clients accepting it, at the level configured, when their
+// content type is to be compressed. A cfg not enabled returns a nil middleware, which is skipped.
+func Compress(cfg CompressConfig) web.Middleware {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := trace.StartSpan(ctx, "internal.middleware.Compress")
+			defer span.End()
+
+			if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				return after(ctx, w, r)
+			}
+
+			cw := &compressWriter{ResponseWriter: w, cfg: cfg}
+			err := after(ctx, cw, r)
+
+			if cerr := cw.close(); err == nil {
+				err = cerr
+			}
+			return err
+		}
+
+		return h
+	}
+
+	return f
+}
+
+// acceptsGzip reports whether the Accept-Encoding header value accepts gzip.
+func acceptsGzip(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := mime.ParseMediaType(strings.TrimSpace(part))
+		if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+			continue
+		}
+
+		v, ok := params["q"]
+		if !ok {
+			return true
+		}
+
+		q, err := strconv.ParseFloat(v, 64)
+		return err == nil && q > 0
+	}
+
+	return false
+}
+
+// compressWriter is a response writer deciding whether to compress the response once its headers are
+// written.
+type compressWriter struct {
+	http.ResponseWriter
+
+	cfg     CompressConfig
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if !cw.decided {
+		cw.decided = true
+
+		h := cw.Header()
+		if code != http.StatusNoContent && code != http.StatusNotModified &&
+			h.Get("Content-Encoding") == "" && cw.cfg.compresses(h.Get("Content-Type")) {
+			gz, err := gzip.NewWriterLevel(cw.ResponseWriter, cw.cfg.level())
+			if err == nil {
+				cw.gz = gz
+				h.Set("Content-Encoding", "gzip")
+				h.Del("Content-Length")
+				h.Add("Vary", "Accept-Encoding")
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.gz != nil {
+		return cw.gz.Write(p)
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+// close flushes the compressed response, if any.
+func (cw *compressWriter) close() error {
+	if cw.gz == nil {
+		return nil
+	}
+
+	return cw.gz.Close()
+}
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat(`{"email":"user@example.com"}`, 64)
+
+	cfg := CompressConfig{
+		Enabled:   true,
+		Level:     gzip.BestCompression,
+		Types:     []string{"application/json", "text/*"},
+		SkipTypes: []string{"image/*", "text/csv"},
+	}
+
+	var cases = []struct {
+		name           string
+		contentType    string
+		acceptEncoding string
+		outCompressed  bool
+	}{
+		{"json", "application/json; charset=utf-8", "gzip, deflate", true},
+		{"textWildcard", "text/plain", "gzip", true},
+		{"imageSkipped", "image/png", "gzip", false},
+		{"skipOverridesAllowed", "text/csv", "gzip", false},
+		{"notAllowed", "application/octet-stream", "gzip", false},
+		{"notAccepted", "application/json", "deflate", false},
+		{"gzipRefused", "application/json", "gzip;q=0, deflate", false},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			h := Compress(cfg)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", cs.contentType)
+				w.WriteHeader(http.StatusOK)
+				_, err := w.Write([]byte(body))
+				return err
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/users/", nil)
+			r.Header.Set("Accept-Encoding", cs.acceptEncoding)
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			if !cs.outCompressed {
+				assert.Empty(t, w.Header().Get("Content-Encoding"))
+				assert.Equal(t, body, w.Body.String())
+				return
+			}
+
+			assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+			assert.Less(t, w.Body.Len(), len(body))
+
+			zr, err := gzip.NewReader(w.Body)
+			require.NoError(t, err)
+			got, err := ioutil.ReadAll(zr)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(got))
+		})
+	}
+
+	t.Run("level", func(t *testing.T) {
+		sizes := make(map[int]int)
+		for _, level := range []int{gzip.HuffmanOnly, gzip.BestCompression} {
+			h := Compress(CompressConfig{Enabled: true, Level: level})(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				return web.Respond(ctx, w, map[string]string{"data": body}, http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/users/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+
+			err := h(testContext(), w, r)
+			require.NoError(t, err)
+
+			assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+			sizes[level] = w.Body.Len()
+		}
+
+		assert.Less(t, sizes[gzip.BestCompression], sizes[gzip.HuffmanOnly])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, Compress(CompressConfig{}))
+	})
+
+	t.Run("noContent", func(t *testing.T) {
+		var called bool
+		h := Compress(cfg)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			called = true
+			return web.Respond(ctx, w, nil, http.StatusNoContent)
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodDelete, "/api/users/1", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		err := h(testContext(), w, r)
+		require.NoError(t, err)
+
+		assert.True(t, called)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Empty(t, w.Body.Bytes())
+	})
+}
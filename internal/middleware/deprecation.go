@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// Deprecation describes the deprecation of an endpoint, as announced to the clients calling it.
+type Deprecation struct {
+	// Since is when the endpoint was deprecated. A zero value announces it as deprecated without a date.
+	Since time.Time
+
+	// Sunset is when the endpoint is expected to stop responding, as defined by RFC 8594. A zero value
+	// sends no Sunset header.
+	Sunset time.Time
+
+	// Link points to the documentation of the deprecation, such as a migration guide. It is sent as a
+	// Link header with the deprecation relation when not empty.
+	Link string
+}
+
+// Deprecated marks the responses of the routes it is applied to with the Deprecation header, and with
+// the Sunset and Link headers when d sets them. Requests are handled as usual, so clients keep working
+// while they are told to migrate.
+func Deprecated(d Deprecation) web.Middleware {
+	deprecation := "true"
+	if !d.Since.IsZero() {
+		deprecation = "@" + strconv.FormatInt(d.Since.Unix(), 10)
+	}
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := trace.StartSpan(ctx, "internal.middleware.Deprecated")
+			defer span.End()
+
+			// headers are set before the handler runs, so they are sent with every response, errors included.
+			w.Header().Set("Deprecation", deprecation)
+			if !d.Sunset.IsZero() {
+				w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+			}
+			if d.Link != "" {
+				w.Header().Add("Link", "<"+d.Link+`>; rel="deprecation"`)
+			}
+
+			return after(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return f
+}
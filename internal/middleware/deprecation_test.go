@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeprecated(t *testing.T) {
+	var cases = []struct {
+		name           string
+		deprecation    Deprecation
+		outDeprecation string
+		outSunset      string
+		outLink        string
+	}{
+		{
+			name:           "undated",
+			outDeprecation: "true",
+		},
+		{
+			name: "sunset",
+			deprecation: Deprecation{
+				Since:  time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+				Sunset: time.Date(2021, 9, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60)),
+				Link:   "https://docs.example.com/migrations/login",
+			},
+			outDeprecation: "@1614556800",
+			outSunset:      "Wed, 01 Sep 2021 10:00:00 GMT",
+			outLink:        `<https://docs.example.com/migrations/login>; rel="deprecation"`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var called bool
+			h := Deprecated(cs.deprecation)(testHandler(&called))
+
+			w := httptest.NewRecorder()
+			err := h(testContext(), w, httptest.NewRequest(http.MethodPost, "/api/oauth/login/bench/", nil))
+			require.NoError(t, err)
+
+			assert.True(t, called)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, cs.outDeprecation, w.Header().Get("Deprecation"))
+			assert.Equal(t, cs.outSunset, w.Header().Get("Sunset"))
+			assert.Equal(t, cs.outLink, w.Header().Get("Link"))
+		})
+	}
+}
@@ -14,6 +14,11 @@ const (
 	ErrTokenFormat                MiddlewareError = "middleware: invalid_token_format, expected authorization header format: Bearer <token>"
 	ErrMalformedURLUserIDRequired MiddlewareError = "middleware: malformed_url, the URL must contain a user ID"
 	ErrForbidden                  MiddlewareError = "middleware: forbidden, this resource can not be accessed"
+	ErrTokenTooLarge              MiddlewareError = "middleware: invalid_token, authorization header exceeds the maximum allowed size"
+	ErrBodyTimeout                MiddlewareError = "middleware: request_timeout, request body was not received in time"
+	ErrMaintenance                MiddlewareError = "middleware: maintenance, the service is under maintenance and only accepts read requests"
+	ErrURITooLong                 MiddlewareError = "middleware: uri_too_long, the request URL exceeds the maximum allowed length"
+	ErrPayloadTooComplex          MiddlewareError = "middleware: payload_too_complex, the request body is nested too deeply or has too many elements"
 )
 
 // MiddlewareError defines errors exported by this package. This type implement a Public() method that
@@ -73,11 +78,22 @@ func Errors(log *log.Logger) web.Middleware {
 			// Run the handler chain and catch any propagated error.
 			if err := before(ctx, w, r); err != nil {
 
-				// Log the error.
-				log.Printf("%s : ERROR : %+v", v.TraceID, err)
+				// The client disconnected before its response was written, so there is no one to
+				// respond to and nothing went wrong on our side.
+				if web.IsClientGone(err) {
+					log.Printf("%s : CLIENT GONE : %v", v.TraceID, err)
+					return nil
+				}
 
 				viewErr.JSON(ctx, w, err)
 
+				// Log the error, with the ID it was responded with if any.
+				if v.ErrorID != "" {
+					log.Printf("%s : ERROR %s : %+v", v.TraceID, v.ErrorID, err)
+				} else {
+					log.Printf("%s : ERROR : %+v", v.TraceID, err)
+				}
+
 				// If we receive the shutdown err we need to return it
 				// back to the base handler to shutdown the service.
 				if ok := web.IsShutdown(err); ok {
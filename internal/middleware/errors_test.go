@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/errors"
+)
+
+func TestMiddlewareError_Shape(t *testing.T) {
+	consts, err := errors.Constants(".", "MiddlewareError")
+	require.NoError(t, err)
+	require.NotEmpty(t, consts)
+
+	for name, msg := range consts {
+		assert.NoError(t, errors.CheckPublic("middleware", msg), name)
+	}
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// JSONLimits limits the complexity of the JSON request bodies, so deeply nested or huge documents are
+// rejected while they are read instead of being parsed in full: reads past maxDepth nested objects and
+// arrays, or past maxTokens tokens, fail with ErrPayloadTooComplex. A zero limit is unlimited, and zero
+// limits return a nil middleware, which is skipped. Form bodies are not affected.
+func JSONLimits(maxDepth, maxTokens int) web.Middleware {
+	if maxDepth <= 0 && maxTokens <= 0 {
+		return nil
+	}
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := trace.StartSpan(ctx, "internal.middleware.JSONLimits")
+			defer span.End()
+
+			mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mt != "application/x-www-form-urlencoded" && mt != "multipart/form-data" {
+				r.Body = &limitedJSONBody{ReadCloser: r.Body, maxDepth: maxDepth, maxTokens: maxTokens}
+			}
+
+			return after(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return f
+}
+
+// limitedJSONBody is a request body scanning the JSON read through it, failing the reads once the
+// document exceeds its limits.
+type limitedJSONBody struct {
+	io.ReadCloser
+
+	maxDepth  int
+	maxTokens int
+
+	depth  int
+	tokens int
+
+	// the scanner state carried over between reads.
+	inString bool
+	escaped  bool
+	inValue  bool
+
+	err error
+}
+
+func (b *limitedJSONBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	for _, c := range p[:n] {
+		if b.inString {
+			switch {
+			case b.escaped:
+				b.escaped = false
+			case c == '\\':
+				b.escaped = true
+			case c == '"':
+				b.inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			b.inString, b.inValue = true, false
+			b.tokens++
+
+		case '{', '[':
+			b.inValue = false
+			b.depth++
+			b.tokens++
+
+		case '}', ']':
+			b.inValue = false
+			b.depth--
+
+		case ',', ':', ' ', '\t', '\n', '\r':
+			b.inValue = false
+
+		default:
+			// the first character of a number or a literal such as true or null.
+			if !b.inValue {
+				b.inValue = true
+				b.tokens++
+			}
+		}
+
+		if (b.maxDepth > 0 && b.depth > b.maxDepth) || (b.maxTokens > 0 && b.tokens > b.maxTokens) {
+			b.err = ErrPayloadTooComplex
+			return 0, b.err
+		}
+	}
+
+	return n, err
+}
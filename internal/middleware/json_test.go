@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+func TestJSONLimits(t *testing.T) {
+	nested := strings.Repeat("[", 100) + strings.Repeat("]", 100)
+	oversized := "[" + strings.TrimSuffix(strings.Repeat("1,", 1000), ",") + "]"
+
+	var cases = []struct {
+		name        string
+		contentType string
+		body        string
+		outErr      error
+	}{
+		{"simple", "application/json", `{"email":"john@example.com","scopes":["read","write"],"age":42,"admin":false}`, nil},
+		{"nested", "application/json", nested, ErrPayloadTooComplex},
+		{"oversized", "application/json", oversized, ErrPayloadTooComplex},
+		{"noContentType", "", nested, ErrPayloadTooComplex},
+		// delimiters within strings are not counted.
+		{"delimitersInStrings", "application/json", `{"name":"` + nested + `","escaped":"\"[[["}`, nil},
+		{"form", "application/x-www-form-urlencoded", "grant_type=password&username=" + nested, nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var body []byte
+			var readErr error
+			h := JSONLimits(10, 100)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				body, readErr = ioutil.ReadAll(r.Body)
+				return nil
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(cs.body))
+			r.Header.Set("Content-Type", cs.contentType)
+			err := h(testContext(), httptest.NewRecorder(), r)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outErr, readErr)
+			if cs.outErr == nil {
+				assert.Equal(t, cs.body, string(body))
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, JSONLimits(0, 0))
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		h := JSONLimits(10, 0)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			var req interface{}
+			return web.Decode(r, &req)
+		})
+
+		w := httptest.NewRecorder()
+		err := h(testContext(), w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(nested)))
+		assert.Equal(t, ErrPayloadTooComplex, err)
+
+		viewErr.JSON(testContext(), w, err)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.JSONEq(t, `{"error":"payload_too_complex"}`, w.Body.String())
+	})
+}
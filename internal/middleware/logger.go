@@ -11,9 +11,34 @@ import (
 	"github.com/noelruault/golang-authentication/internal/web"
 )
 
+// LogLevel is the verbosity the requests to a path are logged at.
+type LogLevel int
+
+const (
+	// LogInfo requests are always logged.
+	LogInfo LogLevel = iota
+
+	// LogDebug requests are only logged when debug logging is enabled, or when they fail with a server
+	// error.
+	LogDebug
+)
+
+// LogConfig holds the settings used to tune the request logger.
+type LogConfig struct {
+	// Debug logs the requests at debug level.
+	Debug bool
+
+	// PathLevels sets the level of the requests by path, such as LogDebug for the health checks that
+	// would flood the logs otherwise. Paths are matched exactly, and paths not present log at LogInfo.
+	PathLevels map[string]LogLevel
+}
+
 // Logger writes some information about the request to the logs in the
-// format: TraceID : (200) GET /foo -> IP ADDR (latency)
-func Logger(log *log.Logger) web.Middleware {
+// format: TraceID : (200) GET /foo -> IP ADDR (latency), followed by " : error_id ID" when
+// the response is an error identified by an ID.
+//
+// Requests to the paths logging at debug level are skipped unless cfg enables debug logging.
+func Logger(log *log.Logger, cfg LogConfig) web.Middleware {
 
 	// This is the actual middleware function to be executed.
 	f := func(before web.Handler) web.Handler {
@@ -32,6 +57,21 @@ func Logger(log *log.Logger) web.Middleware {
 
 			err := before(ctx, w, r)
 
+			// server errors are logged whatever the level of the path, so failing health checks show up.
+			if cfg.PathLevels[r.URL.Path] == LogDebug && !cfg.Debug && v.StatusCode < http.StatusInternalServerError {
+				return err
+			}
+
+			if v.ErrorID != "" {
+				log.Printf("%s : (%d) : %s %s -> %s (%s) : error_id %s",
+					v.TraceID, v.StatusCode,
+					r.Method, r.URL.Path,
+					r.RemoteAddr, time.Since(v.Start),
+					v.ErrorID,
+				)
+				return err
+			}
+
 			log.Printf("%s : (%d) : %s %s -> %s (%s)",
 				v.TraceID, v.StatusCode,
 				r.Method, r.URL.Path,
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+func TestLogger_PathLevels(t *testing.T) {
+	levels := map[string]LogLevel{"/health/": LogDebug}
+
+	var cases = []struct {
+		name      string
+		debug     bool
+		path      string
+		status    int
+		outLogged bool
+	}{
+		{"info", false, "/oauth/login/", http.StatusOK, true},
+		{"debugSkipped", false, "/health/", http.StatusOK, false},
+		{"debugEnabled", true, "/health/", http.StatusOK, true},
+		{"debugServerError", false, "/health/", http.StatusInternalServerError, true},
+		{"prefixNotMatched", false, "/health/db", http.StatusOK, true},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			h := Logger(log.New(&buf, "", 0), LogConfig{Debug: cs.debug, PathLevels: levels})(
+				func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					return web.Respond(ctx, w, nil, cs.status)
+				})
+
+			w := httptest.NewRecorder()
+			err := h(testContext(), w, httptest.NewRequest(http.MethodGet, cs.path, nil))
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outLogged, buf.Len() > 0, buf.String())
+		})
+	}
+}
+
+func TestLogger_ErrorID(t *testing.T) {
+	var cases = []struct {
+		name    string
+		handler web.Handler
+	}{
+		// the handlers responding with the error view themselves, as most do.
+		{"rendered", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			var ev web.Error
+			return ev.JSON(ctx, w, models.ErrNotFound)
+		}},
+		// the errors propagated to the Errors middleware.
+		{"propagated", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			return models.ErrNotFound
+		}},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := log.New(&buf, "", 0)
+			h := Logger(logger, LogConfig{})(Errors(logger)(cs.handler))
+
+			w := httptest.NewRecorder()
+			ctx := context.WithValue(context.Background(), web.KeyValues, &web.Values{ErrorIDs: true})
+			err := h(ctx, w, httptest.NewRequest(http.MethodGet, "/users/me", nil))
+			require.NoError(t, err)
+
+			var body map[string]string
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			require.NotEmpty(t, body["error_id"])
+			assert.Contains(t, buf.String(), "error_id "+body["error_id"])
+		})
+	}
+}
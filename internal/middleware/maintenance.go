@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// Maintenance rejects the requests with unsafe methods, such as signups, updates and token requests,
+// with ErrMaintenance, while letting GET, HEAD and OPTIONS requests through. The responses carry a
+// `Retry-After` header of retryAfter, rounded up to the second, unless it is zero.
+func Maintenance(retryAfter time.Duration) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := trace.StartSpan(ctx, "internal.middleware.Maintenance")
+			defer span.End()
+
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return after(ctx, w, r)
+			}
+
+			if retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			}
+
+			viewErr.JSON(ctx, w, ErrMaintenance)
+			return nil
+		}
+
+		return h
+	}
+
+	return f
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance(t *testing.T) {
+	var cases = []struct {
+		name          string
+		method        string
+		outStatus     int
+		outRetryAfter string
+		outCalled     bool
+	}{
+		{"get", http.MethodGet, http.StatusOK, "", true},
+		{"head", http.MethodHead, http.StatusOK, "", true},
+		{"options", http.MethodOptions, http.StatusOK, "", true},
+		{"post", http.MethodPost, http.StatusServiceUnavailable, "90", false},
+		{"put", http.MethodPut, http.StatusServiceUnavailable, "90", false},
+		{"patch", http.MethodPatch, http.StatusServiceUnavailable, "90", false},
+		{"delete", http.MethodDelete, http.StatusServiceUnavailable, "90", false},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var called bool
+			h := Maintenance(89500 * time.Millisecond)(testHandler(&called))
+
+			w := httptest.NewRecorder()
+			err := h(testContext(), w, httptest.NewRequest(cs.method, "/api/users/", nil))
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Code)
+			assert.Equal(t, cs.outRetryAfter, w.Header().Get("Retry-After"))
+			assert.Equal(t, cs.outCalled, called)
+			if !cs.outCalled {
+				assert.JSONEq(t, `{"error":"maintenance"}`, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("noRetryAfter", func(t *testing.T) {
+		var called bool
+		h := Maintenance(0)(testHandler(&called))
+
+		w := httptest.NewRecorder()
+		err := h(testContext(), w, httptest.NewRequest(http.MethodPost, "/api/oauth/login/", nil))
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Empty(t, w.Header().Get("Retry-After"))
+		assert.False(t, called)
+	})
+}
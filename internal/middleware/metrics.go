@@ -13,13 +13,15 @@ import (
 
 // m contains the global program counters for the application.
 var m = struct {
-	gr  *expvar.Int
-	req *expvar.Int
-	err *expvar.Int
+	gr   *expvar.Int
+	req  *expvar.Int
+	err  *expvar.Int
+	gone *expvar.Int
 }{
-	gr:  expvar.NewInt("goroutines"),
-	req: expvar.NewInt("requests"),
-	err: expvar.NewInt("errors"),
+	gr:   expvar.NewInt("goroutines"),
+	req:  expvar.NewInt("requests"),
+	err:  expvar.NewInt("errors"),
+	gone: expvar.NewInt("client_disconnects"),
 }
 
 // Metrics updates program counters.
@@ -43,8 +45,11 @@ func Metrics() web.Middleware {
 				m.gr.Set(int64(runtime.NumGoroutine()))
 			}
 
-			// Increment the errors counter if an error occurred on this request.
-			if err != nil {
+			// Increment the errors counter if an error occurred on this request. Clients disconnecting
+			// are counted apart, they are not server errors.
+			if web.IsClientGone(err) {
+				m.gone.Add(1)
+			} else if err != nil {
 				m.err.Add(1)
 			}
 
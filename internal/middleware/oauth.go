@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// OAuthErrors makes the routes it is applied to respond their errors in the OAuth 2.0 format, with the
+// "error", "error_description" and "error_uri" fields described by RFC 6749, instead of the format used
+// by the rest of the API. The "error_uri" of the responses is errorURI followed by the public error code,
+// such as "https://example.com/docs/errors#", and it is not sent when errorURI is empty.
+func OAuthErrors(errorURI string) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := trace.StartSpan(ctx, "internal.middleware.OAuthErrors")
+			defer span.End()
+
+			// If the context is missing this value, request the service
+			// to be shutdown gracefully.
+			v, ok := ctx.Value(web.KeyValues).(*web.Values)
+			if !ok {
+				return web.NewShutdownError("web value missing from context")
+			}
+
+			v.OAuthErrors = true
+			v.OAuthErrorURI = errorURI
+
+			return after(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return f
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"io"
+	"regexp"
+)
+
+// redacted replaces the values removed from the logs.
+const redacted = "[REDACTED]"
+
+// redactPatterns match the token values that must never be written to the logs. The first submatch,
+// when present, is kept so the logs still show which value was removed.
+var redactPatterns = []*regexp.Regexp{
+	// JWTs, as issued for access, refresh, ID and state tokens
+	regexp.MustCompile(`()eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+
+	// credentials in Authorization headers
+	regexp.MustCompile(`(?i)((?:bearer|basic)\s+)[^\s"',;]+`),
+
+	// form, query and JSON fields carrying secrets
+	regexp.MustCompile(`(?i)((?:access_token|refresh_token|id_token|client_secret|password|api_key)"?\s*[=:]\s*"?)[^\s"&,;]+`),
+}
+
+// Redact returns b with anything resembling a token or a secret replaced by a placeholder. Extra patterns
+// may be provided to redact other values; their first submatch, if any, is kept.
+func Redact(b []byte, extra ...*regexp.Regexp) []byte {
+	patterns := redactPatterns
+	if len(extra) > 0 {
+		patterns = append(append([]*regexp.Regexp{}, redactPatterns...), extra...)
+	}
+
+	for _, re := range patterns {
+		if re.NumSubexp() > 0 {
+			b = re.ReplaceAll(b, []byte("${1}"+redacted))
+			continue
+		}
+
+		b = re.ReplaceAll(b, []byte(redacted))
+	}
+
+	return b
+}
+
+type redactWriter struct {
+	w     io.Writer
+	extra []*regexp.Regexp
+}
+
+// RedactWriter returns a writer that redacts tokens and secrets, as done by Redact, before writing to w.
+// It is meant to be used as the output of the loggers, so values leaked into request data or error
+// messages are never written to the logs. Each call to Write must contain whole lines, as done by
+// log.Logger, so tokens are not split between calls.
+func RedactWriter(w io.Writer, extra ...*regexp.Regexp) io.Writer {
+	return &redactWriter{
+		w:     w,
+		extra: extra,
+	}
+}
+
+// Write writes p to the underlying writer once redacted. It reports len(p) bytes written on success,
+// as the redacted output length differs.
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	if _, err := rw.w.Write(Redact(p, rw.extra...)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/web"
+)
+
+// MaxURLLength rejects the requests whose URL, path and query string as sent by the client, is longer
+// than max bytes with ErrURITooLong, so oversized cursors or scope lists never reach the handlers. A
+// zero max returns a nil middleware, which is skipped.
+func MaxURLLength(max int) web.Middleware {
+	if max <= 0 {
+		return nil
+	}
+
+	// This is the actual middleware function to be executed.
+	f := func(after web.Handler) web.Handler {
+
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := trace.StartSpan(ctx, "internal.middleware.MaxURLLength")
+			defer span.End()
+
+			uri := r.RequestURI
+			if uri == "" {
+				uri = r.URL.RequestURI()
+			}
+
+			if len(uri) > max {
+				viewErr.JSON(ctx, w, ErrURITooLong)
+				return nil
+			}
+
+			return after(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return f
+}
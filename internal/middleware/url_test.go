@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxURLLength(t *testing.T) {
+	// "/api/users/?ids=" is 16 bytes long.
+	var cases = []struct {
+		name      string
+		target    string
+		outStatus int
+		outCalled bool
+	}{
+		{"short", "/api/users/", http.StatusOK, true},
+		{"atLimit", "/api/users/?ids=" + strings.Repeat("1", 48), http.StatusOK, true},
+		{"justOverLimit", "/api/users/?ids=" + strings.Repeat("1", 49), http.StatusRequestURITooLong, false},
+		{"longPath", "/api/users/" + strings.Repeat("x", 54), http.StatusRequestURITooLong, false},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var called bool
+			h := MaxURLLength(64)(testHandler(&called))
+
+			w := httptest.NewRecorder()
+			err := h(testContext(), w, httptest.NewRequest(http.MethodGet, cs.target, nil))
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Code)
+			assert.Equal(t, cs.outCalled, called)
+			if !cs.outCalled {
+				assert.JSONEq(t, `{"error":"uri_too_long"}`, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, MaxURLLength(0))
+	})
+}
@@ -0,0 +1,290 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"go.opencensus.io/trace"
+	"golang.org/x/xerrors"
+	jwtjose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"gorm.io/gorm"
+)
+
+const (
+	tokenClaimsIssuerAction = "goauthsvcaction"
+)
+
+// Purposes of the action tokens, each of them only valid for the action it was issued for.
+const (
+	PurposeVerification = "verification"
+	PurposeReset        = "reset"
+	PurposeMagicLink    = "magic_link"
+	PurposeRecovery     = "recovery"
+)
+
+// actionTokenDurations are the expiry times of the action tokens, by purpose.
+var actionTokenDurations = map[string]time.Duration{
+	PurposeVerification: 48 * time.Hour,
+	PurposeReset:        1 * time.Hour,
+	PurposeMagicLink:    15 * time.Minute,
+	PurposeRecovery:     1 * time.Hour,
+}
+
+// ActionTokenService issues and consumes the tokens sent to users to perform a single action, such as
+// verifying their email address, resetting their password or logging in through a magic link.
+type ActionTokenService interface {
+	// Issue returns a token allowing the user to perform the action identified by purpose. Single use
+	// tokens can only be consumed once, whatever their expiry.
+	//
+	// When a maximum number of tokens is configured for purpose, the single use tokens issued are
+	// tracked, and the oldest outstanding ones are invalidated so only the most recent remain valid.
+	Issue(ctx context.Context, userID int64, purpose string, singleUse bool) (string, error)
+
+	// Consume validates a token issued for purpose and returns the ID of the user it was issued to.
+	// Tokens older than the max age configured for purpose are rejected, even if not yet expired.
+	// Single use tokens are marked as used atomically, so concurrent requests cannot both succeed.
+	//
+	// Errors returned include ErrUnauthorised and ErrTokenAlreadyUsed.
+	Consume(ctx context.Context, token, purpose string) (int64, error)
+
+	ActionTokenDB
+}
+
+// ActionTokenDB defines how the service interacts with the database.
+type ActionTokenDB interface {
+	// MarkUsed records the token ID as used. It returns ErrTokenAlreadyUsed when it was already recorded.
+	MarkUsed(context.Context, *UsedToken) error
+
+	// SaveIssued records a single use token issued to a user.
+	SaveIssued(context.Context, *IssuedToken) error
+
+	// Outstanding returns the tokens issued to a user for a purpose that are neither used nor expired
+	// at the given time, oldest first.
+	Outstanding(ctx context.Context, userID int64, purpose string, at time.Time) ([]IssuedToken, error)
+}
+
+// A UsedToken records a single use token that was already consumed. Records can be removed once the
+// token has expired.
+type UsedToken struct {
+	ID        string    `gorm:"primary_key;size:255"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// An IssuedToken records a single use token issued for a purpose with a maximum number of outstanding
+// tokens. Records can be removed once the token has expired.
+type IssuedToken struct {
+	ID        string    `gorm:"primary_key;size:255"`
+	UserID    int64     `gorm:"not null;index:idx_issued_tokens_user_purpose"`
+	Purpose   string    `gorm:"size:32;not null;index:idx_issued_tokens_user_purpose"`
+	IssuedAt  time.Time `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type actionClaims struct {
+	jwt.Claims
+
+	Purpose   string `json:"pur"`
+	SingleUse bool   `json:"single_use,omitempty"`
+}
+
+type actionTokenService struct {
+	ActionTokenDB
+
+	signer jwtjose.Signer
+	secret []byte
+	cfg    Config
+}
+
+// NewActionTokenService instantiates a new ActionTokenService implementation with db as the backing
+// database, used to track the single use tokens consumed.
+func NewActionTokenService(db *gorm.DB, secret []byte, cfg Config) ActionTokenService {
+	return &actionTokenService{
+		ActionTokenDB: &actionTokenGorm{db},
+		signer:        newSigner(secret),
+		secret:        secret,
+		cfg:           cfg,
+	}
+}
+
+func (as *actionTokenService) Issue(ctx context.Context, userID int64, purpose string, singleUse bool) (string, error) {
+	_, span := trace.StartSpan(ctx, "models.ActionTokenService.Issue")
+	defer span.End()
+
+	d, ok := actionTokenDurations[purpose]
+	if !ok {
+		return "", wrap("unknown action token purpose "+purpose, nil)
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := as.cfg.now()
+	cl := actionClaims{
+		Claims: jwt.Claims{
+			ID:       id,
+			Subject:  strconv.FormatInt(userID, 10),
+			Issuer:   tokenClaimsIssuerAction,
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(d)),
+		},
+		Purpose:   purpose,
+		SingleUse: singleUse,
+	}
+
+	tok, err := jwt.Signed(as.signer).Claims(cl).CompactSerialize()
+	if err != nil {
+		return "", wrap("failed to sign action token", err)
+	}
+
+	if max := as.cfg.MaxActionTokens[purpose]; max > 0 && singleUse {
+		if err := as.limitOutstanding(ctx, userID, purpose, max); err != nil {
+			return "", err
+		}
+
+		err := as.ActionTokenDB.SaveIssued(ctx, &IssuedToken{
+			ID:        id,
+			UserID:    userID,
+			Purpose:   purpose,
+			IssuedAt:  now,
+			ExpiresAt: now.Add(d),
+		})
+		if err != nil {
+			return "", wrap("on issue, failed to record issued token", err)
+		}
+	}
+
+	return tok, nil
+}
+
+// limitOutstanding invalidates the oldest tokens issued to userID for purpose, leaving room for a new one
+// within max outstanding tokens. Tokens are invalidated by marking them as used.
+func (as *actionTokenService) limitOutstanding(ctx context.Context, userID int64, purpose string, max int) error {
+	out, err := as.ActionTokenDB.Outstanding(ctx, userID, purpose, as.cfg.now())
+	if err != nil {
+		return wrap("on issue, failed to obtain outstanding tokens", err)
+	}
+
+	for i := 0; i < len(out)-(max-1); i++ {
+		err := as.ActionTokenDB.MarkUsed(ctx, &UsedToken{
+			ID:        out[i].ID,
+			ExpiresAt: out[i].ExpiresAt,
+		})
+		if err != nil && !xerrors.Is(err, ErrTokenAlreadyUsed) {
+			return wrap("on issue, failed to invalidate outstanding token", err)
+		}
+	}
+
+	return nil
+}
+
+func (as *actionTokenService) Consume(ctx context.Context, token, purpose string) (int64, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ActionTokenService.Consume")
+	defer span.End()
+
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return 0, ErrUnauthorised
+	}
+
+	var cl actionClaims
+	if !signedWith(tok, jwtjose.HS512) {
+		return 0, ErrUnauthorised
+	}
+	if err := tok.Claims(as.secret, &cl); err != nil {
+		return 0, ErrUnauthorised
+	}
+
+	err = cl.ValidateWithLeeway(jwt.Expected{
+		Issuer: tokenClaimsIssuerAction,
+		Time:   as.cfg.now(),
+	}, as.cfg.clockSkew())
+	if err != nil || cl.Purpose != purpose || cl.ID == "" {
+		return 0, ErrUnauthorised
+	}
+
+	// the max age is enforced with the current configuration, as the expiry in the token reflects the
+	// one in place when it was issued.
+	if maxAge := as.cfg.ActionTokenMaxAge[purpose]; maxAge > 0 {
+		if cl.IssuedAt == nil || as.cfg.now().After(cl.IssuedAt.Time().Add(maxAge+as.cfg.clockSkew())) {
+			return 0, ErrUnauthorised
+		}
+	}
+
+	uid, err := strconv.ParseInt(cl.Subject, 10, 64)
+	if err != nil {
+		return 0, ErrUnauthorised
+	}
+
+	if cl.SingleUse {
+		err := as.ActionTokenDB.MarkUsed(ctx, &UsedToken{
+			ID:        cl.ID,
+			ExpiresAt: cl.Expiry.Time(),
+		})
+		if err != nil {
+			if xerrors.Is(err, ErrTokenAlreadyUsed) {
+				return 0, ErrTokenAlreadyUsed
+			}
+
+			return 0, wrap("on consume, failed to mark token as used", err)
+		}
+	}
+
+	return uid, nil
+}
+
+type actionTokenGorm struct {
+	db *gorm.DB
+}
+
+func (ag *actionTokenGorm) MarkUsed(ctx context.Context, t *UsedToken) error {
+	ctx, span := trace.StartSpan(ctx, "action.Database.MarkUsed")
+	defer span.End()
+
+	err := ag.db.WithContext(ctx).Create(t).Error
+	if err != nil {
+		if pgerr := (*pgconn.PgError)(nil); xerrors.As(err, &pgerr) {
+			// Info about error codes can be found at https://github.com/lib/pq/blob/master/error.go#L78
+			if pgerr.Code == "23505" && pgerr.ConstraintName == "used_tokens_pkey" {
+				return ErrTokenAlreadyUsed
+			}
+		}
+
+		return wrap("could not mark token as used", err)
+	}
+
+	return nil
+}
+
+func (ag *actionTokenGorm) SaveIssued(ctx context.Context, t *IssuedToken) error {
+	ctx, span := trace.StartSpan(ctx, "action.Database.SaveIssued")
+	defer span.End()
+
+	err := ag.db.WithContext(ctx).Create(t).Error
+	if err != nil {
+		return wrap("could not record issued token", err)
+	}
+
+	return nil
+}
+
+func (ag *actionTokenGorm) Outstanding(ctx context.Context, userID int64, purpose string, at time.Time) ([]IssuedToken, error) {
+	ctx, span := trace.StartSpan(ctx, "action.Database.Outstanding")
+	defer span.End()
+
+	var tokens []IssuedToken
+	err := ag.db.WithContext(ctx).
+		Where("user_id = ? AND purpose = ? AND expires_at > ?", userID, purpose, at).
+		Where("id NOT IN (?)", ag.db.Model(&UsedToken{}).Select("id")).
+		Order("issued_at, id").
+		Find(&tokens).Error
+	if err != nil {
+		return nil, wrap("could not list outstanding tokens", err)
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+type testActionTokenDB struct {
+	ActionTokenDB
+
+	mu     sync.Mutex
+	used   map[string]bool
+	issued []IssuedToken
+}
+
+func (t *testActionTokenDB) MarkUsed(ctx context.Context, ut *UsedToken) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.used[ut.ID] {
+		return ErrTokenAlreadyUsed
+	}
+
+	t.used[ut.ID] = true
+	return nil
+}
+
+func (t *testActionTokenDB) SaveIssued(ctx context.Context, it *IssuedToken) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.issued = append(t.issued, *it)
+	return nil
+}
+
+func (t *testActionTokenDB) Outstanding(ctx context.Context, userID int64, purpose string, at time.Time) ([]IssuedToken, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []IssuedToken
+	for _, it := range t.issued {
+		if it.UserID == userID && it.Purpose == purpose && it.ExpiresAt.After(at) && !t.used[it.ID] {
+			out = append(out, it)
+		}
+	}
+
+	return out, nil
+}
+
+func TestActionTokenService_Consume(t *testing.T) {
+	ctx := context.Background()
+	as := NewActionTokenService(nil, []byte(testJWTSecret), Config{})
+	as.(*actionTokenService).ActionTokenDB = &testActionTokenDB{used: map[string]bool{}}
+
+	t.Run("singleUse", func(t *testing.T) {
+		tok, err := as.Issue(ctx, 888, PurposeMagicLink, true)
+		require.NoError(t, err)
+
+		uid, err := as.Consume(ctx, tok, PurposeMagicLink)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(888), uid)
+
+		_, err = as.Consume(ctx, tok, PurposeMagicLink)
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrTokenAlreadyUsed))
+	})
+
+	t.Run("singleUseConcurrent", func(t *testing.T) {
+		tok, err := as.Issue(ctx, 888, PurposeReset, true)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := as.Consume(ctx, tok, PurposeReset)
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		succeeded := 0
+		for err := range errs {
+			if err == nil {
+				succeeded++
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+	})
+
+	t.Run("reusable", func(t *testing.T) {
+		tok, err := as.Issue(ctx, 888, PurposeVerification, false)
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			uid, err := as.Consume(ctx, tok, PurposeVerification)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(888), uid)
+		}
+	})
+
+	t.Run("wrongPurpose", func(t *testing.T) {
+		tok, err := as.Issue(ctx, 888, PurposeVerification, true)
+		require.NoError(t, err)
+
+		_, err = as.Consume(ctx, tok, PurposeReset)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+
+		// the failed attempt does not consume the token
+		_, err = as.Consume(ctx, tok, PurposeVerification)
+		assert.NoError(t, err)
+	})
+
+	t.Run("badToken", func(t *testing.T) {
+		_, err := as.Consume(ctx, "very.bad.token", PurposeReset)
+
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+
+	t.Run("unknownPurpose", func(t *testing.T) {
+		_, err := as.Issue(ctx, 888, "unknown", true)
+
+		assert.Error(t, err)
+	})
+}
+
+func TestActionTokenService_ConsumeMaxAge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	as := NewActionTokenService(nil, []byte(testJWTSecret), Config{
+		Now: func() time.Time { return now },
+	})
+
+	// issued while the verification tokens were valid for their whole 48 hours expiry
+	tok, err := as.Issue(ctx, 888, PurposeVerification, false)
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name    string
+		maxAge  map[string]time.Duration
+		elapsed time.Duration
+		outErr  error
+	}{
+		{"noMaxAge", nil, 24 * time.Hour, nil},
+		{"withinMaxAge", map[string]time.Duration{PurposeVerification: time.Hour}, 30 * time.Minute, nil},
+		{"shortenedMaxAge", map[string]time.Duration{PurposeVerification: time.Hour}, 2 * time.Hour, ErrUnauthorised},
+		{"otherPurpose", map[string]time.Duration{PurposeReset: time.Minute}, 2 * time.Hour, nil},
+		{"expired", nil, 49 * time.Hour, ErrUnauthorised},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			as.(*actionTokenService).cfg.ActionTokenMaxAge = cs.maxAge
+			as.(*actionTokenService).cfg.Now = func() time.Time { return now.Add(cs.elapsed) }
+
+			_, err := as.Consume(ctx, tok, PurposeVerification)
+
+			assert.Equal(t, cs.outErr, err)
+		})
+	}
+}
+
+func TestActionTokenService_IssueMaxTokens(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	as := NewActionTokenService(nil, []byte(testJWTSecret), Config{
+		Now:             func() time.Time { return now },
+		MaxActionTokens: map[string]int{PurposeReset: 2},
+	})
+	as.(*actionTokenService).ActionTokenDB = &testActionTokenDB{used: map[string]bool{}}
+
+	var tokens []string
+	for i := 0; i < 4; i++ {
+		tok, err := as.Issue(ctx, 888, PurposeReset, true)
+		require.NoError(t, err)
+		tokens = append(tokens, tok)
+
+		now = now.Add(time.Second)
+	}
+
+	// another user's tokens are not affected
+	other, err := as.Issue(ctx, 999, PurposeReset, true)
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name   string
+		token  string
+		outErr error
+	}{
+		{"oldest", tokens[0], ErrTokenAlreadyUsed},
+		{"older", tokens[1], ErrTokenAlreadyUsed},
+		{"recent", tokens[2], nil},
+		{"mostRecent", tokens[3], nil},
+		{"otherUser", other, nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			_, err := as.Consume(ctx, cs.token, PurposeReset)
+
+			assert.Equal(t, cs.outErr, err)
+		})
+	}
+}
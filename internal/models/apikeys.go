@@ -0,0 +1,236 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// APIKeyService defines a set of methods to be used when dealing with the API keys users create to
+// access the system from scripts and other applications.
+type APIKeyService interface {
+	// Create generates a new API key for the user, returning the key record and the secret key value.
+	// The secret is only returned here, as the system only stores its hash.
+	//
+	// It returns ErrTooManyAPIKeys if the user already has the maximum number of active keys.
+	Create(ctx context.Context, userID int64, name string) (APIKey, string, error)
+
+	// Revoke disables an API key of the user. Revoked keys no longer count towards the maximum.
+	//
+	// It may return ErrNotFound.
+	Revoke(ctx context.Context, userID, id int64) error
+
+	// Authenticate returns the active API key with the given secret. The key is looked up by the hash of
+	// the secret, as the secret itself is never stored.
+	//
+	// Errors returned include ErrNoCredentials and ErrUnauthorised.
+	Authenticate(ctx context.Context, secret string) (APIKey, error)
+
+	APIKeyDB
+}
+
+// APIKeyDB defines how the service interacts with the database.
+type APIKeyDB interface {
+	// Save adds an API key to the system. The Hash field must already be set. When the given maximum is
+	// positive, it returns ErrTooManyAPIKeys if the user already has that many active keys, the keys
+	// being counted and saved atomically so concurrent requests cannot exceed it.
+	Save(context.Context, *APIKey, int) error
+
+	// SetRevoked sets the revocation time of the active API key with the given user and key IDs. It
+	// returns ErrNotFound if there is no such key.
+	SetRevoked(context.Context, int64, int64, time.Time) error
+
+	// ByHash retrieves an API key by the hash of its secret. It returns ErrNotFound if there is none.
+	ByHash(context.Context, string) (APIKey, error)
+}
+
+// An APIKey represents a credential a user created to access the system on its behalf.
+type APIKey struct {
+	ID     int64  `gorm:"primary_key;type:bigserial" json:"id"`
+	UserID int64  `gorm:"not null;index" json:"user_id"`
+	Name   string `gorm:"size:255;not null" json:"name"`
+
+	// Hash is the hex encoded SHA-256 hash of the key. Keys are random and long, so a slow hash is not
+	// required.
+	Hash string `gorm:"size:64;not null;unique" json:"-"`
+
+	CreatedAt time.Time  `gorm:"not null" json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type apiKeyService struct {
+	APIKeyDB
+
+	cfg Config
+}
+
+// NewAPIKeyService instantiates a new APIKeyService implementation with db as the backing database.
+func NewAPIKeyService(db *gorm.DB, cfg Config) APIKeyService {
+	return &apiKeyService{
+		APIKeyDB: &apiKeyGorm{db},
+		cfg:      cfg,
+	}
+}
+
+func (as *apiKeyService) Create(ctx context.Context, userID int64, name string) (APIKey, string, error) {
+	ctx, span := trace.StartSpan(ctx, "models.APIKeyService.Create")
+	defer span.End()
+
+	if name == "" {
+		return APIKey{}, "", ValidationError{"name": ErrRequired}
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	key := APIKey{
+		UserID:    userID,
+		Name:      name,
+		Hash:      hashAPIKey(secret),
+		CreatedAt: as.cfg.now(),
+	}
+
+	if err := as.APIKeyDB.Save(ctx, &key, as.cfg.MaxAPIKeys); err != nil {
+		if xerrors.Is(err, ErrTooManyAPIKeys) {
+			return APIKey{}, "", ErrTooManyAPIKeys
+		}
+
+		return APIKey{}, "", wrap("on create, failed to save api key", err)
+	}
+
+	return key, secret, nil
+}
+
+func (as *apiKeyService) Revoke(ctx context.Context, userID, id int64) error {
+	ctx, span := trace.StartSpan(ctx, "models.APIKeyService.Revoke")
+	defer span.End()
+
+	return as.APIKeyDB.SetRevoked(ctx, userID, id, as.cfg.now())
+}
+
+func (as *apiKeyService) Authenticate(ctx context.Context, secret string) (APIKey, error) {
+	ctx, span := trace.StartSpan(ctx, "models.APIKeyService.Authenticate")
+	defer span.End()
+
+	if secret == "" {
+		return APIKey{}, ErrNoCredentials
+	}
+
+	key, err := as.APIKeyDB.ByHash(ctx, hashAPIKey(secret))
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return APIKey{}, ErrUnauthorised
+		}
+
+		return APIKey{}, wrap("on authenticate, failed to obtain api key from database", err)
+	}
+
+	// the key is looked up by the hash of the secret, so comparing it in variable time reveals nothing
+	// of the secret itself.
+	if key.RevokedAt != nil {
+		return APIKey{}, ErrUnauthorised
+	}
+
+	return key, nil
+}
+
+// hashAPIKey returns the hex encoded SHA-256 hash the API keys with the given secret are stored with.
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+type apiKeyGorm struct {
+	db *gorm.DB
+}
+
+func (ag *apiKeyGorm) Save(ctx context.Context, k *APIKey, max int) error {
+	ctx, span := trace.StartSpan(ctx, "apikey.Database.Save")
+	defer span.End()
+
+	err := ag.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if max > 0 {
+			// the row of the user is locked until the key is saved, so the keys created concurrently for
+			// the same user are counted one after the other.
+			var u User
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&u, k.UserID).Error; err != nil {
+				return err
+			}
+
+			var n int64
+			if err := tx.Model(&APIKey{}).Where("user_id = ? AND revoked_at IS NULL", k.UserID).Count(&n).Error; err != nil {
+				return err
+			}
+
+			if n >= int64(max) {
+				return ErrTooManyAPIKeys
+			}
+		}
+
+		return tx.Create(k).Error
+	})
+	if err != nil {
+		if xerrors.Is(err, ErrTooManyAPIKeys) {
+			return ErrTooManyAPIKeys
+		}
+
+		return wrap("could not create api key", err)
+	}
+
+	return nil
+}
+
+func (ag *apiKeyGorm) DeleteUserData(ctx context.Context, userID int64) error {
+	ctx, span := trace.StartSpan(ctx, "apikey.Database.DeleteUserData")
+	defer span.End()
+
+	err := ag.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&APIKey{}).Error
+	if err != nil {
+		return wrap("could not delete api keys of user", err)
+	}
+
+	return nil
+}
+
+func (ag *apiKeyGorm) SetRevoked(ctx context.Context, userID, id int64, at time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "apikey.Database.SetRevoked")
+	defer span.End()
+
+	res := ag.db.WithContext(ctx).Model(&APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", at)
+	if res.Error != nil {
+		return wrap("could not revoke api key", res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (ag *apiKeyGorm) ByHash(ctx context.Context, hash string) (APIKey, error) {
+	ctx, span := trace.StartSpan(ctx, "apikey.Database.ByHash")
+	defer span.End()
+
+	var k APIKey
+	err := ag.db.WithContext(ctx).Where("hash = ?", hash).First(&k).Error
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return APIKey{}, ErrNotFound
+		}
+
+		return APIKey{}, wrap("could not get api key by hash", err)
+	}
+
+	return k, nil
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAPIKeyDB struct {
+	APIKeyDB
+	keys []APIKey
+}
+
+func (t *testAPIKeyDB) Save(ctx context.Context, k *APIKey, max int) error {
+	n := 0
+	for _, key := range t.keys {
+		if key.UserID == k.UserID && key.RevokedAt == nil {
+			n++
+		}
+	}
+	if max > 0 && n >= max {
+		return ErrTooManyAPIKeys
+	}
+
+	k.ID = int64(len(t.keys) + 1)
+	t.keys = append(t.keys, *k)
+	return nil
+}
+
+func (t *testAPIKeyDB) SetRevoked(ctx context.Context, userID, id int64, at time.Time) error {
+	for i := range t.keys {
+		if t.keys[i].ID == id && t.keys[i].UserID == userID && t.keys[i].RevokedAt == nil {
+			t.keys[i].RevokedAt = &at
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (t *testAPIKeyDB) ByHash(ctx context.Context, hash string) (APIKey, error) {
+	for _, k := range t.keys {
+		if k.Hash == hash {
+			return k, nil
+		}
+	}
+
+	return APIKey{}, ErrNotFound
+}
+
+func TestAPIKeyService_Create(t *testing.T) {
+	ctx := context.Background()
+	as := NewAPIKeyService(nil, Config{MaxAPIKeys: 3})
+	as.(*apiKeyService).APIKeyDB = &testAPIKeyDB{}
+
+	var keys []APIKey
+	for i := 0; i < 3; i++ {
+		key, secret, err := as.Create(ctx, 888, "ci")
+		require.NoError(t, err)
+
+		sum := sha256.Sum256([]byte(secret))
+		assert.Equal(t, hex.EncodeToString(sum[:]), key.Hash, "only the hash of the secret is stored")
+		keys = append(keys, key)
+	}
+
+	_, _, err := as.Create(ctx, 888, "ci")
+	assert.Equal(t, ErrTooManyAPIKeys, err)
+
+	t.Run("otherUser", func(t *testing.T) {
+		_, _, err := as.Create(ctx, 999, "ci")
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("revokedDoNotCount", func(t *testing.T) {
+		require.NoError(t, as.Revoke(ctx, 888, keys[0].ID))
+
+		_, _, err := as.Create(ctx, 888, "ci")
+		assert.NoError(t, err)
+
+		_, _, err = as.Create(ctx, 888, "ci")
+		assert.Equal(t, ErrTooManyAPIKeys, err)
+	})
+
+	t.Run("revokeOtherUsersKey", func(t *testing.T) {
+		err := as.Revoke(ctx, 999, keys[1].ID)
+
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("nameRequired", func(t *testing.T) {
+		_, _, err := as.Create(ctx, 777, "")
+
+		assert.Equal(t, ValidationError{"name": ErrRequired}, err)
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		as.(*apiKeyService).cfg.MaxAPIKeys = 0
+
+		_, _, err := as.Create(ctx, 888, "ci")
+		assert.NoError(t, err)
+	})
+}
+
+func TestAPIKeyService_Authenticate(t *testing.T) {
+	ctx := context.Background()
+	db := &testAPIKeyDB{}
+	as := NewAPIKeyService(nil, Config{})
+	as.(*apiKeyService).APIKeyDB = db
+
+	key, secret, err := as.Create(ctx, 888, "ci")
+	require.NoError(t, err)
+	revoked, revokedSecret, err := as.Create(ctx, 888, "old")
+	require.NoError(t, err)
+	require.NoError(t, as.Revoke(ctx, 888, revoked.ID))
+
+	// the secret is not persisted in any form usable to authenticate.
+	b, err := json.Marshal(db.keys)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), secret)
+	for _, k := range db.keys {
+		assert.NotEqual(t, secret, k.Hash)
+	}
+
+	var cases = []struct {
+		name   string
+		secret string
+		outID  int64
+		outErr error
+	}{
+		{"valid", secret, key.ID, nil},
+		{"revoked", revokedSecret, 0, ErrUnauthorised},
+		{"unknown", secret + "x", 0, ErrUnauthorised},
+		{"hashAsSecret", key.Hash, 0, ErrUnauthorised},
+		{"empty", "", 0, ErrNoCredentials},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			k, err := as.Authenticate(ctx, cs.secret)
+			assert.Equal(t, cs.outErr, err)
+			assert.Equal(t, cs.outID, k.ID)
+		})
+	}
+}
+
+func TestAPIKeyGORM_Save(t *testing.T) {
+	db, err := NewTestDatabase(t)
+	require.NoError(t, err)
+	defer CloseDBConnection(db)
+
+	ctx := context.Background()
+	CleanupTestDatabase(db)
+	require.NoError(t, db.Migrator().CreateTable(&APIKey{}))
+	require.NoError(t, db.Create(&User{ID: 999, Active: true, Email: "test999@test.com", FirstName: "Test"}).Error)
+
+	as := NewAPIKeyService(db, Config{MaxAPIKeys: 3})
+
+	// the keys created at the same time are counted one after the other, so no more than the maximum
+	// are saved.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := as.Create(ctx, 999, "ci")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var created, rejected int
+	for err := range errs {
+		switch err {
+		case nil:
+			created++
+		case ErrTooManyAPIKeys:
+			rejected++
+		default:
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, 3, created)
+	assert.Equal(t, 7, rejected)
+
+	var n int64
+	require.NoError(t, db.Model(&APIKey{}).Where("user_id = ?", 999).Count(&n).Error)
+	assert.Equal(t, int64(3), n)
+}
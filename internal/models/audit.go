@@ -0,0 +1,284 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+	"gorm.io/gorm"
+)
+
+// AuditService records the security relevant events happening in the system, such as logins.
+type AuditService interface {
+	// Record stores e, setting its CreatedAt field when empty. When batching is enabled, the event is
+	// buffered and written along with others once the batch is full or the flush interval elapses.
+	//
+	// Buffered events are kept when a write fails, and retried with the next batch.
+	Record(ctx context.Context, e *AuditEvent) error
+
+	// Close stops the periodic flush and writes the buffered events. It must be called on shutdown so
+	// no events are lost, and Record must not be called afterwards.
+	Close(ctx context.Context) error
+
+	// Prune deletes the events beyond the configured retention, returning the number of events deleted.
+	// It does nothing when no retention is configured.
+	Prune(ctx context.Context) (int64, error)
+
+	AuditDB
+}
+
+// AuditDB defines how the service interacts with the database.
+type AuditDB interface {
+	// CreateBatch adds a set of events to the system in a single write.
+	CreateBatch(context.Context, []AuditEvent) error
+
+	// DeleteBeyond deletes the events created before the given time, when not zero, and the events of
+	// each user beyond the given number of most recent ones, when not zero. The events with the exempt
+	// actions are never deleted, nor counted. It returns the number of events deleted.
+	DeleteBeyond(ctx context.Context, before time.Time, maxEvents int, exempt []string) (int64, error)
+}
+
+// An AuditRetention bounds the audit events kept for each user, so their storage does not grow forever.
+type AuditRetention struct {
+	// MaxEvents is the number of the most recent events kept for each user. Zero keeps any number.
+	MaxEvents int
+
+	// MaxAge is how long the events are kept. Zero keeps them forever.
+	MaxAge time.Duration
+
+	// Exempt lists the actions of the security critical events, which are kept whatever their number
+	// or age.
+	Exempt []string
+}
+
+// An AuditEvent represents an action performed in the system, by or on behalf of a user or a client.
+type AuditEvent struct {
+	ID int64 `gorm:"primary_key;type:bigserial" json:"id"`
+
+	// Action is a short identifier of what happened, such as "login" or "login_failed".
+	Action string `gorm:"size:255;not null;index" json:"action"`
+
+	// UserID and ClientID identify who performed the action, and are zero when unknown.
+	UserID   int64  `gorm:"not null;index" json:"user_id,omitempty"`
+	ClientID string `gorm:"size:255;not null" json:"client_id,omitempty"`
+
+	CreatedAt time.Time `gorm:"not null;index" json:"created_at"`
+}
+
+type auditService struct {
+	AuditDB
+
+	cfg Config
+
+	mu     sync.Mutex
+	buf    []AuditEvent
+	closed bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+	pruned  chan struct{}
+}
+
+// NewAuditService instantiates a new AuditService implementation with db as the backing database. Events
+// are written as they are recorded unless cfg.AuditBatchSize is greater than one.
+func NewAuditService(db *gorm.DB, cfg Config) AuditService {
+	return newAuditService(&auditGorm{db}, cfg)
+}
+
+func newAuditService(adb AuditDB, cfg Config) *auditService {
+	as := &auditService{
+		AuditDB: adb,
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		pruned:  make(chan struct{}),
+	}
+
+	if cfg.AuditBatchSize > 1 && cfg.AuditFlushInterval > 0 {
+		go as.flushLoop()
+	} else {
+		close(as.stopped)
+	}
+
+	if cfg.AuditPruneInterval > 0 {
+		go as.pruneLoop()
+	} else {
+		close(as.pruned)
+	}
+
+	return as
+}
+
+func (as *auditService) Record(ctx context.Context, e *AuditEvent) error {
+	ctx, span := trace.StartSpan(ctx, "models.AuditService.Record")
+	defer span.End()
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = as.cfg.now()
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if as.closed {
+		return wrap("cannot record audit event, service is closed", nil)
+	}
+
+	as.buf = append(as.buf, *e)
+	if len(as.buf) < as.cfg.AuditBatchSize {
+		return nil
+	}
+
+	return as.flush(ctx)
+}
+
+func (as *auditService) Close(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "models.AuditService.Close")
+	defer span.End()
+
+	as.mu.Lock()
+	if as.closed {
+		as.mu.Unlock()
+		return nil
+	}
+	as.closed = true
+	as.mu.Unlock()
+
+	close(as.stop)
+	<-as.stopped
+	<-as.pruned
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	return as.flush(ctx)
+}
+
+// flushLoop writes the buffered events every flush interval until the service is closed.
+func (as *auditService) flushLoop() {
+	defer close(as.stopped)
+
+	t := time.NewTicker(as.cfg.AuditFlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-as.stop:
+			return
+		case <-t.C:
+			// errors are retried on the next tick, as the events are kept in the buffer.
+			as.mu.Lock()
+			_ = as.flush(context.Background())
+			as.mu.Unlock()
+		}
+	}
+}
+
+func (as *auditService) Prune(ctx context.Context) (int64, error) {
+	ctx, span := trace.StartSpan(ctx, "models.AuditService.Prune")
+	defer span.End()
+
+	r := as.cfg.AuditRetention
+	if r.MaxEvents <= 0 && r.MaxAge <= 0 {
+		return 0, nil
+	}
+
+	var before time.Time
+	if r.MaxAge > 0 {
+		before = as.cfg.now().Add(-r.MaxAge)
+	}
+
+	n, err := as.AuditDB.DeleteBeyond(ctx, before, r.MaxEvents, r.Exempt)
+	if err != nil {
+		return 0, wrap("failed to prune audit events", err)
+	}
+
+	return n, nil
+}
+
+// pruneLoop deletes the events beyond the retention every prune interval until the service is closed.
+func (as *auditService) pruneLoop() {
+	defer close(as.pruned)
+
+	t := time.NewTicker(as.cfg.AuditPruneInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-as.stop:
+			return
+		case <-t.C:
+			// errors are retried on the next tick, as the events left are pruned then.
+			_, _ = as.Prune(context.Background())
+		}
+	}
+}
+
+// flush writes the buffered events. It must be called with as.mu held.
+func (as *auditService) flush(ctx context.Context) error {
+	if len(as.buf) == 0 {
+		return nil
+	}
+
+	if err := as.AuditDB.CreateBatch(ctx, as.buf); err != nil {
+		return wrap("failed to write audit events", err)
+	}
+
+	as.buf = nil
+	return nil
+}
+
+type auditGorm struct {
+	db *gorm.DB
+}
+
+func (ag *auditGorm) CreateBatch(ctx context.Context, events []AuditEvent) error {
+	ctx, span := trace.StartSpan(ctx, "audit.Database.CreateBatch")
+	defer span.End()
+
+	err := ag.db.WithContext(ctx).Create(&events).Error
+	if err != nil {
+		return wrap("could not create audit events", err)
+	}
+
+	return nil
+}
+
+func (ag *auditGorm) DeleteBeyond(ctx context.Context, before time.Time, maxEvents int, exempt []string) (int64, error) {
+	ctx, span := trace.StartSpan(ctx, "audit.Database.DeleteBeyond")
+	defer span.End()
+
+	// notExempt scopes q to the events that can be pruned.
+	notExempt := func(q *gorm.DB) *gorm.DB {
+		if len(exempt) == 0 {
+			return q
+		}
+
+		return q.Where("action NOT IN ?", exempt)
+	}
+
+	var deleted int64
+	if !before.IsZero() {
+		res := notExempt(ag.db.WithContext(ctx).Where("created_at < ?", before)).Delete(&AuditEvent{})
+		if res.Error != nil {
+			return deleted, wrap("could not prune old audit events", res.Error)
+		}
+		deleted += res.RowsAffected
+	}
+
+	if maxEvents > 0 {
+		ranked := notExempt(ag.db.WithContext(ctx).Model(&AuditEvent{}).
+			Select("id, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY created_at DESC, id DESC) AS position").
+			Where("user_id <> 0"))
+		excess := ag.db.WithContext(ctx).Table("(?) AS ranked", ranked).Select("id").Where("position > ?", maxEvents)
+
+		res := ag.db.WithContext(ctx).Where("id IN (?)", excess).Delete(&AuditEvent{})
+		if res.Error != nil {
+			return deleted, wrap("could not prune excess audit events", res.Error)
+		}
+		deleted += res.RowsAffected
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,235 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAuditDB struct {
+	AuditDB
+
+	mu      sync.Mutex
+	batches [][]AuditEvent
+	err     error
+
+	deleteBeyond func(ctx context.Context, before time.Time, maxEvents int, exempt []string) (int64, error)
+}
+
+func (t *testAuditDB) CreateBatch(ctx context.Context, events []AuditEvent) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err != nil {
+		return t.err
+	}
+
+	t.batches = append(t.batches, append([]AuditEvent(nil), events...))
+	return nil
+}
+
+func (t *testAuditDB) DeleteBeyond(ctx context.Context, before time.Time, maxEvents int, exempt []string) (int64, error) {
+	if t.deleteBeyond != nil {
+		return t.deleteBeyond(ctx, before, maxEvents, exempt)
+	}
+
+	panic("not provided")
+}
+
+func (t *testAuditDB) written() [][]AuditEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.batches
+}
+
+func TestAuditService_Record(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("unbatched", func(t *testing.T) {
+		tadb := &testAuditDB{}
+		as := newAuditService(tadb, Config{Now: func() time.Time { return now }})
+
+		require.NoError(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 1}))
+		require.NoError(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 2}))
+
+		assert.Equal(t, [][]AuditEvent{
+			{{Action: "login", UserID: 1, CreatedAt: now}},
+			{{Action: "login", UserID: 2, CreatedAt: now}},
+		}, tadb.written())
+		assert.NoError(t, as.Close(ctx))
+	})
+
+	t.Run("batchSize", func(t *testing.T) {
+		tadb := &testAuditDB{}
+		as := newAuditService(tadb, Config{AuditBatchSize: 3})
+
+		require.NoError(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 1}))
+		require.NoError(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 2}))
+		assert.Empty(t, tadb.written(), "events are buffered until the batch is full")
+
+		require.NoError(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 3}))
+		require.Len(t, tadb.written(), 1)
+		assert.Len(t, tadb.written()[0], 3)
+	})
+
+	t.Run("failedWriteKeepsEvents", func(t *testing.T) {
+		tadb := &testAuditDB{err: wrap("database is down", nil)}
+		as := newAuditService(tadb, Config{AuditBatchSize: 2})
+
+		require.NoError(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 1}))
+		assert.Error(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 2}))
+
+		tadb.err = nil
+		require.NoError(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 3}))
+		require.Len(t, tadb.written(), 1)
+		assert.Len(t, tadb.written()[0], 3)
+	})
+
+	t.Run("flushInterval", func(t *testing.T) {
+		tadb := &testAuditDB{}
+		as := newAuditService(tadb, Config{AuditBatchSize: 100, AuditFlushInterval: 10 * time.Millisecond})
+		defer as.Close(ctx)
+
+		require.NoError(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 1}))
+
+		assert.Eventually(t, func() bool {
+			return len(tadb.written()) == 1
+		}, time.Second, 5*time.Millisecond)
+	})
+}
+
+func TestAuditService_Close(t *testing.T) {
+	ctx := context.Background()
+	tadb := &testAuditDB{}
+	as := newAuditService(tadb, Config{AuditBatchSize: 100, AuditFlushInterval: time.Hour})
+
+	for i := int64(1); i <= 5; i++ {
+		require.NoError(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: i}))
+	}
+	assert.Empty(t, tadb.written())
+
+	require.NoError(t, as.Close(ctx))
+	require.Len(t, tadb.written(), 1)
+	assert.Len(t, tadb.written()[0], 5, "all buffered events are written on close")
+
+	assert.Error(t, as.Record(ctx, &AuditEvent{Action: "login", UserID: 6}))
+	assert.NoError(t, as.Close(ctx), "closing twice is a no-op")
+	assert.Len(t, tadb.written(), 1)
+}
+
+func TestAuditService_Prune(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name         string
+		retention    AuditRetention
+		outCalled    bool
+		outBefore    time.Time
+		outMaxEvents int
+	}{
+		{"noRetention", AuditRetention{Exempt: []string{"password_changed"}}, false, time.Time{}, 0},
+		{"maxAge", AuditRetention{MaxAge: 90 * 24 * time.Hour}, true, now.Add(-90 * 24 * time.Hour), 0},
+		{"maxEvents", AuditRetention{MaxEvents: 500}, true, time.Time{}, 500},
+		{"both", AuditRetention{MaxEvents: 500, MaxAge: time.Hour, Exempt: []string{"password_changed"}}, true, now.Add(-time.Hour), 500},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var called bool
+			tadb := &testAuditDB{
+				deleteBeyond: func(ctx context.Context, before time.Time, maxEvents int, exempt []string) (int64, error) {
+					called = true
+					assert.Equal(t, cs.outBefore, before)
+					assert.Equal(t, cs.outMaxEvents, maxEvents)
+					assert.Equal(t, cs.retention.Exempt, exempt)
+					return 3, nil
+				},
+			}
+			as := newAuditService(tadb, Config{Now: func() time.Time { return now }, AuditRetention: cs.retention})
+
+			n, err := as.Prune(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, cs.outCalled, called)
+			if cs.outCalled {
+				assert.Equal(t, int64(3), n)
+			}
+		})
+	}
+}
+
+func TestAuditService_PruneLoop(t *testing.T) {
+	var mu sync.Mutex
+	var pruned int
+	tadb := &testAuditDB{
+		deleteBeyond: func(ctx context.Context, before time.Time, maxEvents int, exempt []string) (int64, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			pruned++
+			return 0, nil
+		},
+	}
+	as := newAuditService(tadb, Config{
+		AuditRetention:     AuditRetention{MaxEvents: 10},
+		AuditPruneInterval: 5 * time.Millisecond,
+	})
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return pruned >= 2
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, as.Close(context.Background()))
+	mu.Lock()
+	after := pruned
+	mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, after, pruned, "the pruner stops once the service is closed")
+}
+
+func TestAuditGORM_DeleteBeyond(t *testing.T) {
+	db, err := NewTestDatabase(t)
+	require.NoError(t, err)
+	defer CloseDBConnection(db)
+
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	CleanupTestDatabase(db)
+	require.NoError(t, db.Migrator().CreateTable(&AuditEvent{}))
+
+	// user 1 has four recent logins and an old password change, user 2 has an old login.
+	events := []AuditEvent{
+		{Action: "password_changed", UserID: 1, CreatedAt: now.Add(-48 * time.Hour)},
+		{Action: "login", UserID: 1, CreatedAt: now.Add(-4 * time.Minute)},
+		{Action: "login", UserID: 1, CreatedAt: now.Add(-3 * time.Minute)},
+		{Action: "login", UserID: 1, CreatedAt: now.Add(-2 * time.Minute)},
+		{Action: "login", UserID: 1, CreatedAt: now.Add(-1 * time.Minute)},
+		{Action: "login", UserID: 2, CreatedAt: now.Add(-48 * time.Hour)},
+		{Action: "login_failed", CreatedAt: now.Add(-time.Minute)},
+	}
+	require.NoError(t, (&auditGorm{db}).CreateBatch(ctx, events))
+
+	n, err := (&auditGorm{db}).DeleteBeyond(ctx, now.Add(-24*time.Hour), 2, []string{"password_changed"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	var kept []AuditEvent
+	require.NoError(t, db.Order("id").Find(&kept).Error)
+	require.Len(t, kept, 4)
+	assert.Equal(t, "password_changed", kept[0].Action, "exempt events are kept whatever their age")
+	assert.Equal(t, events[3].ID, kept[1].ID, "the most recent events of each user are kept")
+	assert.Equal(t, events[4].ID, kept[2].ID)
+	assert.Equal(t, "login_failed", kept[3].Action, "events without a user are not counted")
+}
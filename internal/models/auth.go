@@ -1,5 +1,18 @@
 package models
 
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	jwtjose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
 // ctxKey represents the type of value for the context key.
 type ctxKey int
 
@@ -9,11 +22,265 @@ const KeyClaims ctxKey = 1
 // Claims represents the authorization claims transmitted via a JWT.
 type Claims struct {
 	User User
+
+	// PrincipalType is the kind of principal the token represents, PrincipalUser for the tokens issued
+	// to users and PrincipalClient for the ones issued to clients on their own behalf.
+	PrincipalType string
+
+	// ClientID identifies the client the token was issued through, if any, and Scopes are the scopes it
+	// grants.
+	ClientID string
+	Scopes   []string
+
+	// FeatureFlags are the features enabled for the user when the token was issued, when configured to
+	// be included in the access tokens.
+	FeatureFlags []string
+
+	// TokenID is the unique identifier of the token, its jti claim, usable to track or revoke it.
+	TokenID string
+
+	// IssuedAt and ExpiresAt are the times the token was issued and expires at, zero when it does not
+	// carry them.
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+
+	// AuthTime is the time the user authenticated at to start the session of the token, zero when it
+	// does not carry it.
+	AuthTime time.Time
+}
+
+// A ClaimsValidator enforces custom rules on the claims of the access tokens, such as only accepting
+// the tokens of an allowlist of clients. It is run once the service has validated a token.
+type ClaimsValidator interface {
+	// ValidateClaims returns an error when c must be rejected. PublicError values are reported to the
+	// client as they are; ErrClaimsRejected can be used when no specific error is needed. Other errors
+	// are reported as server errors.
+	ValidateClaims(ctx context.Context, c Claims) error
+}
+
+// The ClaimsValidatorFunc type is an adapter to allow the use of ordinary functions as claims validators.
+type ClaimsValidatorFunc func(ctx context.Context, c Claims) error
+
+// ValidateClaims calls f(ctx, c).
+func (f ClaimsValidatorFunc) ValidateClaims(ctx context.Context, c Claims) error {
+	return f(ctx, c)
+}
+
+// A RoleProvider resolves the roles of the users, such as "admin" or "support", which the service does
+// not keep itself.
+type RoleProvider interface {
+	// UserRoles returns the roles of u.
+	UserRoles(ctx context.Context, u User) ([]string, error)
+}
+
+// The RoleProviderFunc type is an adapter to allow the use of ordinary functions as role providers.
+type RoleProviderFunc func(ctx context.Context, u User) ([]string, error)
+
+// UserRoles calls f(ctx, u).
+func (f RoleProviderFunc) UserRoles(ctx context.Context, u User) ([]string, error) {
+	return f(ctx, u)
+}
+
+// A UserEnricher augments the users authenticated by their access tokens with data the service does not
+// keep itself, such as the profile held by an external service.
+type UserEnricher interface {
+	// EnrichUser returns u augmented with the external data, usually set in its Profile. It should
+	// return when ctx is done.
+	EnrichUser(ctx context.Context, u User) (User, error)
+}
+
+// The UserEnricherFunc type is an adapter to allow the use of ordinary functions as user enrichers.
+type UserEnricherFunc func(ctx context.Context, u User) (User, error)
+
+// EnrichUser calls f(ctx, u).
+func (f UserEnricherFunc) EnrichUser(ctx context.Context, u User) (User, error) {
+	return f(ctx, u)
+}
+
+// IDClaims represents the claims transmitted via an OpenID Connect ID token.
+type IDClaims struct {
+	jwt.Claims
+
+	// Nonce is the value sent by the client with the token request, echoed back for it to detect replays.
+	Nonce string `json:"nonce,omitempty"`
+
+	// AuthClass and AuthMethods are how the user authenticated, as the acr and amr claims. They are only
+	// set when known.
+	AuthClass   string   `json:"acr,omitempty"`
+	AuthMethods []string `json:"amr,omitempty"`
+
+	UserClaims
+}
+
+// The authentication methods reported in the amr claim of the ID tokens, as registered by RFC 8176.
+const (
+	// AuthMethodPassword is a login with the password of the user.
+	AuthMethodPassword = "pwd"
+
+	// AuthMethodOTP is a one-time code, generated by an authenticator or sent by email.
+	AuthMethodOTP = "otp"
+
+	// AuthMethodSMS is a one-time code sent by SMS.
+	AuthMethodSMS = "sms"
+
+	// AuthMethodMFA is a login completing more than one authentication factor.
+	AuthMethodMFA = "mfa"
+)
+
+// IDTokenOptions are the details of the login an ID token is issued to.
+type IDTokenOptions struct {
+	// Nonce is the value sent by the client with the request, if any.
+	Nonce string
+
+	// AuthClass and AuthMethods are how the user authenticated, included as the acr and amr claims when
+	// set.
+	AuthClass   string
+	AuthMethods []string
+}
+
+// UserClaims are the OpenID Connect standard claims of a user, as included in the ID tokens and the
+// UserInfo responses.
+type UserClaims struct {
+	// Name, GivenName, FamilyName and Nickname are only set when the profile scope is granted.
+	Name       string `json:"name,omitempty"`
+	GivenName  string `json:"given_name,omitempty"`
+	FamilyName string `json:"family_name,omitempty"`
+	Nickname   string `json:"nickname,omitempty"`
+
+	// Email is only set when the email scope is granted.
+	Email string `json:"email,omitempty"`
 }
 
+// NewUserClaims returns the standard claims of u the scopes grant access to.
+func NewUserClaims(u User, scopes ...string) UserClaims {
+	var c UserClaims
+	if StringList(scopes).Contains("profile") {
+		c.Name = strings.TrimSpace(u.FirstName + " " + u.LastName)
+		c.GivenName = u.FirstName
+		c.FamilyName = u.LastName
+		c.Nickname = u.Nickname
+	}
+	if StringList(scopes).Contains("email") {
+		c.Email = u.Email
+	}
+
+	return c
+}
+
+// The kinds of principals the tokens can represent, as reported by Claims.PrincipalType.
+const (
+	// PrincipalUser is a user authenticated on their own behalf.
+	PrincipalUser = "user"
+
+	// PrincipalClient is a client authenticated on its own behalf, with a token of the
+	// client_credentials grant. Its claims have no user.
+	PrincipalClient = "client"
+
+	// PrincipalImpersonation is a user acted as by another principal. It is reserved, as the service
+	// does not issue impersonation tokens.
+	PrincipalImpersonation = "impersonation"
+)
+
 // NewClaims constructs a Claims value for the identified user.
 func NewClaims(u User) Claims {
 	return Claims{
-		User: u,
+		User:          u,
+		PrincipalType: PrincipalUser,
+	}
+}
+
+// CheckScopes splits the required scopes between the ones granted by the token, and the ones missing
+// from it. Both are returned in the order required, without duplicates.
+func (c Claims) CheckScopes(required ...string) (satisfied, missing []string) {
+	seen := make(map[string]bool, len(required))
+	for _, s := range required {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+
+		if StringList(c.Scopes).Contains(s) {
+			satisfied = append(satisfied, s)
+		} else {
+			missing = append(missing, s)
+		}
+	}
+
+	return satisfied, missing
+}
+
+// tokenClaims constructs the Claims value of an access token with claims cl, issued to u.
+func tokenClaims(u User, cl authClaims) Claims {
+	c := NewClaims(u)
+	c.ClientID = cl.ClientID
+	c.Scopes = strings.Fields(cl.Scope)
+	c.TokenID = cl.ID
+	if cl.IssuedAt != nil {
+		c.IssuedAt = cl.IssuedAt.Time().UTC()
+	}
+	if cl.Expiry != nil {
+		c.ExpiresAt = cl.Expiry.Time().UTC()
+	}
+	if cl.AuthTime != 0 {
+		c.AuthTime = time.Unix(cl.AuthTime, 0).UTC()
+	}
+	if cl.Flags != "" {
+		c.FeatureFlags = strings.Fields(cl.Flags)
 	}
+
+	return c
+}
+
+// newSigner instantiates the signer used for the JWTs issued by the services in this package. It panics if
+// the signer cannot be created, as the services are unusable without it.
+func newSigner(secret []byte) jwtjose.Signer {
+	sig, err := jwtjose.NewSigner(jwtjose.SigningKey{
+		Algorithm: jwtjose.HS512,
+		Key:       secret,
+	}, (&jwtjose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		panic(fmt.Errorf("failed to instantiate JWT signer: %v", err))
+	}
+
+	return sig
+}
+
+// signedWith reports whether tok has a single signature made with one of the algorithms algs. The
+// algorithm of a token is chosen by whoever crafted it, so it is checked against the algorithms the
+// services are configured with before verifying the signature: otherwise a token signed with HMAC,
+// keyed with a published public key, or an unsigned one, could be accepted.
+func signedWith(tok *jwt.JSONWebToken, algs ...jwtjose.SignatureAlgorithm) bool {
+	if len(tok.Headers) != 1 {
+		return false
+	}
+
+	for _, alg := range algs {
+		if tok.Headers[0].Algorithm == string(alg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// randomToken returns a URL safe string encoding n cryptographically random bytes.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", wrap("failed to read random bytes", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// waitUniform sleeps until waitAfterAuthError, plus a random jitter of up to waitJitter, has passed since
+// start. It is used in enumeration-safe mode so responses take a similar time whether an account exists
+// or not, as long as the work done takes less than waitAfterAuthError.
+func waitUniform(start time.Time) {
+	var jitter time.Duration
+	if n, err := rand.Int(rand.Reader, big.NewInt(int64(waitJitter))); err == nil {
+		jitter = time.Duration(n.Int64())
+	}
+
+	time.Sleep(time.Until(start.Add(waitAfterAuthError + jitter)))
 }
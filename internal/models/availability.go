@@ -0,0 +1,80 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Policies deciding how access token validations behave when the store cannot be read.
+const (
+	// StoreFailClosed rejects the tokens that cannot be checked against the store.
+	StoreFailClosed = "fail_closed"
+
+	// StoreFailOpen accepts the tokens with a valid signature and expiry for a short time, despite
+	// the user and the revocations not being checked.
+	StoreFailOpen = "fail_open"
+)
+
+// defaultStoreFailOpenWindow is the time validations fail open when no window is configured.
+const defaultStoreFailOpenWindow = time.Minute
+
+// storeOutage tracks since when the store has been failing, so validations only fail open for a
+// limited time.
+type storeOutage struct {
+	mu    sync.Mutex
+	since time.Time
+}
+
+// failed records a failure at now, and returns the time the outage started.
+func (o *storeOutage) failed(now time.Time) time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.since.IsZero() {
+		o.since = now
+	}
+
+	return o.since
+}
+
+// recovered ends the current outage, if any.
+func (o *storeOutage) recovered() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.since = time.Time{}
+}
+
+// failOpen decides, following the store failure policy, whether the access token of the user uid is
+// accepted after the store failed with err. It returns err when the token must be rejected.
+//
+// Accepted tokens are recorded in the audit trail, and their claims only carry the user ID along with the
+// client and scopes of the token. They still go through the ClaimsValidator.
+func (us *userService) failOpen(ctx context.Context, uid int64, cl authClaims, err error) (Claims, error) {
+	if us.cfg.StoreFailurePolicy != StoreFailOpen {
+		return Claims{}, err
+	}
+
+	now := us.cfg.now()
+	if since := us.outage.failed(now); now.Sub(since) > us.cfg.storeFailOpenWindow() {
+		return Claims{}, err
+	}
+
+	if us.cfg.Audit != nil {
+		// the event is kept in the audit buffer when batching is enabled, so it is written once the
+		// database is back. Without batching, it is lost along with the failed write.
+		_ = us.cfg.Audit.Record(ctx, &AuditEvent{
+			Action:   "token_accepted_fail_open",
+			UserID:   uid,
+			ClientID: cl.ClientID,
+		})
+	}
+
+	c := tokenClaims(User{ID: uid, Active: true}, cl)
+	if err := us.validateClaims(ctx, c); err != nil {
+		return Claims{}, err
+	}
+
+	return c, nil
+}
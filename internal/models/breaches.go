@@ -0,0 +1,78 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"go.opencensus.io/trace"
+)
+
+// hibpRangeURL is the endpoint of the Have I Been Pwned range API.
+const hibpRangeURL = "https://api.pwnedpasswords.com/range/"
+
+// A BreachChecker reports whether a password is known to have been exposed in a data breach.
+type BreachChecker interface {
+	// Breached returns true if password appears in the breach database.
+	Breached(ctx context.Context, password string) (bool, error)
+}
+
+type hibpChecker struct {
+	client *http.Client
+	url    string
+}
+
+// NewHIBPChecker returns a BreachChecker using the Have I Been Pwned range API through client. Passwords
+// are checked with k-anonymity: only the first 5 characters of their SHA-1 hash are sent, and the
+// matching is done locally against the suffixes returned.
+func NewHIBPChecker(client *http.Client) BreachChecker {
+	return &hibpChecker{
+		client: client,
+		url:    hibpRangeURL,
+	}
+}
+
+func (hc *hibpChecker) Breached(ctx context.Context, password string) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "models.BreachChecker.Breached")
+	defer span.End()
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.url+prefix, nil)
+	if err != nil {
+		return false, wrap("failed to create breach check request", err)
+	}
+
+	// padding hides the number of suffixes matching the prefix from observers of the response size
+	req.Header.Set("Add-Padding", "true")
+
+	res, err := hc.client.Do(req)
+	if err != nil {
+		return false, wrap("failed to request breach check", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, wrap("unexpected breach check response "+res.Status, nil)
+	}
+
+	// each line has the format "SUFFIX:COUNT", padding lines having a count of 0
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(sc.Text()), ":", 2)
+		if len(parts) == 2 && parts[0] == suffix && parts[1] != "0" {
+			return true, nil
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return false, wrap("failed to read breach check response", err)
+	}
+
+	return false, nil
+}
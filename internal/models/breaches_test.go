@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testBreachChecker struct {
+	breached map[string]bool
+	err      error
+}
+
+func (t *testBreachChecker) Breached(ctx context.Context, password string) (bool, error) {
+	return t.breached[password], t.err
+}
+
+func TestHIBPChecker_Breached(t *testing.T) {
+	var prefixes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefixes = append(prefixes, strings.TrimPrefix(r.URL.Path, "/range/"))
+		assert.Equal(t, "true", r.Header.Get("Add-Padding"))
+
+		// the SHA-1 hash of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+		fmt.Fprint(w, "003D68EB55068C33ACE09247EE4C639306B:3\r\n")
+		fmt.Fprint(w, "1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\r\n")
+		fmt.Fprint(w, "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:0\r\n")
+	}))
+	defer srv.Close()
+
+	hc := NewHIBPChecker(srv.Client())
+	hc.(*hibpChecker).url = srv.URL + "/range/"
+
+	ctx := context.Background()
+
+	breached, err := hc.Breached(ctx, "password")
+	require.NoError(t, err)
+	assert.True(t, breached)
+
+	breached, err = hc.Breached(ctx, "a clean and lengthy passphrase")
+	require.NoError(t, err)
+	assert.False(t, breached)
+
+	require.Len(t, prefixes, 2)
+	assert.Equal(t, "5BAA6", prefixes[0], "only the hash prefix is sent")
+	assert.Len(t, prefixes[1], 5)
+
+	t.Run("serviceError", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+
+		hc := NewHIBPChecker(srv.Client())
+		hc.(*hibpChecker).url = srv.URL + "/range/"
+
+		_, err := hc.Breached(ctx, "password")
+		assert.Error(t, err)
+	})
+}
+
+func TestUserService_CreateBreachedPassword(t *testing.T) {
+	tbc := &testBreachChecker{breached: map[string]bool{"password1": true}}
+	tudb := &testUserDB{
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			return User{}, ErrNotFound
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{BreachChecker: tbc})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	ctx := context.Background()
+
+	t.Run("breached", func(t *testing.T) {
+		err := us.Create(ctx, &User{Country: "GB", Email: "test@address.com", FirstName: "Test", Password: "password1"})
+
+		assert.Equal(t, ValidationError{"password": ErrPasswordBreached}, err)
+	})
+
+	t.Run("clean", func(t *testing.T) {
+		err := us.Create(ctx, &User{Country: "GB", Email: "test@address.com", FirstName: "Test", Password: "a clean passphrase"})
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("checkerFailsOpen", func(t *testing.T) {
+		tbc.err = wrap("breach service unavailable", nil)
+		defer func() { tbc.err = nil }()
+
+		err := us.Create(ctx, &User{Country: "GB", Email: "test@address.com", FirstName: "Test", Password: "password1"})
+
+		assert.NoError(t, err)
+	})
+}
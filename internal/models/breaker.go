@@ -0,0 +1,242 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// defaultBreakerCooldown is the time the breaker stays open when no cooldown is configured.
+const defaultBreakerCooldown = 30 * time.Second
+
+// breaker is a circuit breaker failing calls fast with ErrServiceUnavailable once threshold consecutive
+// calls failed, instead of letting them pile up waiting on an unhealthy store. Once cooldown elapses, a
+// single call is let through to probe the store: the breaker closes if it succeeds, and opens again
+// for another cooldown otherwise.
+//
+// Only errors other than ModelError count as failures, as those are answers from the store such as
+// ErrNotFound.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// newBreaker instantiates a breaker with the threshold and cooldown in cfg.
+func newBreaker(cfg Config) *breaker {
+	cooldown := cfg.StoreBreakerCooldown
+	if cooldown == 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	return &breaker{
+		threshold: cfg.StoreBreakerThreshold,
+		cooldown:  cooldown,
+		now:       cfg.now,
+	}
+}
+
+// call runs fn unless the breaker is open, recording its outcome.
+func (b *breaker) call(fn func() error) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	b.done(probe, err)
+
+	return err
+}
+
+// allow reports whether a call can go through, and whether it is the probe of a half-open breaker.
+func (b *breaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return false, nil
+	}
+
+	if b.probing || b.now().Before(b.openedAt.Add(b.cooldown)) {
+		return false, ErrServiceUnavailable
+	}
+
+	b.probing = true
+	return true, nil
+}
+
+// done records the outcome of a call let through by allow.
+func (b *breaker) done(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	if merr := ModelError(""); err == nil || xerrors.As(err, &merr) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = b.now()
+	}
+}
+
+// userBreaker is a UserDB layer guarding the database with a breaker, so the users and the token
+// revocations fail fast with ErrServiceUnavailable while the database is unhealthy.
+type userBreaker struct {
+	UserDB
+
+	breaker *breaker
+}
+
+// newUserBreaker instantiates a userBreaker in front of udb, with the breaker settings in cfg.
+func newUserBreaker(udb UserDB, cfg Config) *userBreaker {
+	return &userBreaker{
+		UserDB:  udb,
+		breaker: newBreaker(cfg),
+	}
+}
+
+func (ub *userBreaker) Create(ctx context.Context, u *User) error {
+	return ub.breaker.call(func() error {
+		return ub.UserDB.Create(ctx, u)
+	})
+}
+
+func (ub *userBreaker) Update(ctx context.Context, u *User) error {
+	return ub.breaker.call(func() error {
+		return ub.UserDB.Update(ctx, u)
+	})
+}
+
+func (ub *userBreaker) Delete(ctx context.Context, id int64) error {
+	return ub.breaker.call(func() error {
+		return ub.UserDB.Delete(ctx, id)
+	})
+}
+
+func (ub *userBreaker) ByID(ctx context.Context, id int64) (User, error) {
+	var u User
+	err := ub.breaker.call(func() (err error) {
+		u, err = ub.UserDB.ByID(ctx, id)
+		return err
+	})
+
+	return u, err
+}
+
+func (ub *userBreaker) ByIDs(ctx context.Context, ids ...int64) ([]User, error) {
+	var users []User
+	err := ub.breaker.call(func() (err error) {
+		users, err = ub.UserDB.ByIDs(ctx, ids...)
+		return err
+	})
+
+	return users, err
+}
+
+func (ub *userBreaker) ByCountries(ctx context.Context, countries ...string) ([]User, error) {
+	var users []User
+	err := ub.breaker.call(func() (err error) {
+		users, err = ub.UserDB.ByCountries(ctx, countries...)
+		return err
+	})
+
+	return users, err
+}
+
+func (ub *userBreaker) ByEmail(ctx context.Context, e string) (User, error) {
+	var u User
+	err := ub.breaker.call(func() (err error) {
+		u, err = ub.UserDB.ByEmail(ctx, e)
+		return err
+	})
+
+	return u, err
+}
+
+func (ub *userBreaker) ByCanonicalEmail(ctx context.Context, e string) (User, error) {
+	var u User
+	err := ub.breaker.call(func() (err error) {
+		u, err = ub.UserDB.ByCanonicalEmail(ctx, e)
+		return err
+	})
+
+	return u, err
+}
+
+func (ub *userBreaker) RevokeSession(ctx context.Context, rs *RevokedSession) error {
+	return ub.breaker.call(func() error {
+		return ub.UserDB.RevokeSession(ctx, rs)
+	})
+}
+
+func (ub *userBreaker) SessionRevoked(ctx context.Context, userID int64, id string) (bool, error) {
+	var revoked bool
+	err := ub.breaker.call(func() (err error) {
+		revoked, err = ub.UserDB.SessionRevoked(ctx, userID, id)
+		return err
+	})
+
+	return revoked, err
+}
+
+func (ub *userBreaker) RevokeGrant(ctx context.Context, rg *RevokedGrant) error {
+	return ub.breaker.call(func() error {
+		return ub.UserDB.RevokeGrant(ctx, rg)
+	})
+}
+
+func (ub *userBreaker) GrantRevokedAt(ctx context.Context, userID int64, clientID string) (time.Time, error) {
+	var at time.Time
+	err := ub.breaker.call(func() (err error) {
+		at, err = ub.UserDB.GrantRevokedAt(ctx, userID, clientID)
+		return err
+	})
+
+	return at, err
+}
+
+func (ub *userBreaker) RevokeTrust(ctx context.Context, rt *RevokedTrust) error {
+	return ub.breaker.call(func() error {
+		return ub.UserDB.RevokeTrust(ctx, rt)
+	})
+}
+
+func (ub *userBreaker) TrustRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	var at time.Time
+	err := ub.breaker.call(func() (err error) {
+		at, err = ub.UserDB.TrustRevokedAt(ctx, userID)
+		return err
+	})
+
+	return at, err
+}
+
+func (ub *userBreaker) RevokeTokenID(ctx context.Context, rt *RevokedToken) error {
+	return ub.breaker.call(func() error {
+		return ub.UserDB.RevokeTokenID(ctx, rt)
+	})
+}
+
+func (ub *userBreaker) TokenIDRevoked(ctx context.Context, userID int64, id string) (bool, error) {
+	var revoked bool
+	err := ub.breaker.call(func() (err error) {
+		revoked, err = ub.UserDB.TokenIDRevoked(ctx, userID, id)
+		return err
+	})
+
+	return revoked, err
+}
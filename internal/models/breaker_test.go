@@ -0,0 +1,120 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	storeErr := wrap("database is down", nil)
+
+	var calls int
+	var healthy bool
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			calls++
+			if !healthy {
+				return User{}, storeErr
+			}
+
+			return User{ID: id}, nil
+		},
+	}
+	ub := newUserBreaker(tudb, Config{
+		StoreBreakerThreshold: 3,
+		StoreBreakerCooldown:  10 * time.Second,
+		Now:                   func() time.Time { return now },
+	})
+
+	// the errors of the store go through until the threshold is reached.
+	for i := 0; i < 3; i++ {
+		_, err := ub.ByID(ctx, 1)
+		assert.Equal(t, storeErr, err)
+	}
+	assert.Equal(t, 3, calls)
+
+	// open: calls fail fast without reaching the store.
+	_, err := ub.ByID(ctx, 1)
+	assert.Equal(t, ErrServiceUnavailable, err)
+	assert.Equal(t, 3, calls)
+
+	// half-open: a failed probe opens the breaker for another cooldown.
+	now = now.Add(11 * time.Second)
+	_, err = ub.ByID(ctx, 1)
+	assert.Equal(t, storeErr, err)
+	assert.Equal(t, 4, calls)
+
+	_, err = ub.ByID(ctx, 1)
+	assert.Equal(t, ErrServiceUnavailable, err)
+	assert.Equal(t, 4, calls)
+
+	// half-open: a successful probe closes the breaker once the store heals.
+	healthy = true
+	now = now.Add(11 * time.Second)
+	u, err := ub.ByID(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), u.ID)
+
+	_, err = ub.ByID(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, calls)
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	storeErr := wrap("database is down", nil)
+
+	t.Run("modelErrorsNotCounted", func(t *testing.T) {
+		b := newBreaker(Config{StoreBreakerThreshold: 2, Now: func() time.Time { return now }})
+
+		for i := 0; i < 5; i++ {
+			err := b.call(func() error { return ErrNotFound })
+			assert.Equal(t, ErrNotFound, err)
+		}
+	})
+
+	t.Run("successResetsFailures", func(t *testing.T) {
+		b := newBreaker(Config{StoreBreakerThreshold: 2, Now: func() time.Time { return now }})
+
+		assert.Equal(t, storeErr, b.call(func() error { return storeErr }))
+		assert.NoError(t, b.call(func() error { return nil }))
+		assert.Equal(t, storeErr, b.call(func() error { return storeErr }))
+		assert.NoError(t, b.call(func() error { return nil }))
+	})
+
+	t.Run("singleProbe", func(t *testing.T) {
+		b := newBreaker(Config{StoreBreakerThreshold: 1, Now: func() time.Time { return now }})
+		assert.Equal(t, storeErr, b.call(func() error { return storeErr }))
+
+		b.now = func() time.Time { return now.Add(defaultBreakerCooldown + time.Second) }
+
+		// calls made while the probe is in flight fail fast.
+		err := b.call(func() error {
+			return b.call(func() error {
+				t.Error("call let through while probing")
+				return nil
+			})
+		})
+		assert.Equal(t, ErrServiceUnavailable, err)
+	})
+}
+
+func TestUserService_AuthenticateStoreUnavailable(t *testing.T) {
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
+	us.(*userService).UserService.(*userValidator).UserDB = &testUserDB{
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			return User{}, ErrServiceUnavailable
+		},
+	}
+
+	start := time.Now()
+	_, err := us.Authenticate(context.Background(), "john@example.com", "password1234")
+
+	assert.Equal(t, ErrServiceUnavailable, err)
+	assert.Less(t, int64(time.Since(start)), int64(waitAfterAuthError), "unavailability reported without delay")
+}
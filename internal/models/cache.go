@@ -0,0 +1,87 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// userCache is a UserDB layer keeping the users retrieved by ID in memory for a short time, reducing
+// the load on the database when validating tokens. Entries are invalidated when the user is updated or
+// deleted through it, so role or status changes take effect on the next lookup. Instances sharing the
+// same database do not see each other's invalidations and rely on the TTL being kept short.
+type userCache struct {
+	UserDB
+
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[int64]userCacheEntry
+}
+
+type userCacheEntry struct {
+	user    User
+	expires time.Time
+}
+
+// newUserCache instantiates a userCache in front of udb, keeping the entries for cfg.UserCacheTTL.
+func newUserCache(udb UserDB, cfg Config) *userCache {
+	return &userCache{
+		UserDB:  udb,
+		ttl:     cfg.UserCacheTTL,
+		now:     cfg.now,
+		entries: make(map[int64]userCacheEntry),
+	}
+}
+
+func (uc *userCache) ByID(ctx context.Context, id int64) (User, error) {
+	ctx, span := trace.StartSpan(ctx, "models.User.cache.ByID")
+	defer span.End()
+
+	now := uc.now()
+
+	uc.mu.Lock()
+	e, ok := uc.entries[id]
+	uc.mu.Unlock()
+
+	if ok && now.Before(e.expires) {
+		return e.user, nil
+	}
+
+	u, err := uc.UserDB.ByID(ctx, id)
+	if err != nil {
+		return u, err
+	}
+
+	uc.mu.Lock()
+	uc.entries[id] = userCacheEntry{user: u, expires: now.Add(uc.ttl)}
+	uc.mu.Unlock()
+
+	return u, nil
+}
+
+func (uc *userCache) Update(ctx context.Context, u *User) error {
+	ctx, span := trace.StartSpan(ctx, "models.User.cache.Update")
+	defer span.End()
+
+	defer uc.invalidate(u.ID)
+	return uc.UserDB.Update(ctx, u)
+}
+
+func (uc *userCache) Delete(ctx context.Context, id int64) error {
+	ctx, span := trace.StartSpan(ctx, "models.User.cache.Delete")
+	defer span.End()
+
+	defer uc.invalidate(id)
+	return uc.UserDB.Delete(ctx, id)
+}
+
+// invalidate removes the user with the given id from the cache.
+func (uc *userCache) invalidate(id int64) {
+	uc.mu.Lock()
+	delete(uc.entries, id)
+	uc.mu.Unlock()
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	user := User{ID: 888, Active: true, Email: "someone@somewhere.com"}
+	calls := 0
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			calls++
+			return user, nil
+		},
+	}
+
+	uc := newUserCache(tudb, Config{
+		Now:          func() time.Time { return now },
+		UserCacheTTL: time.Minute,
+	})
+
+	u, err := uc.ByID(ctx, 888)
+	require.NoError(t, err)
+	assert.Equal(t, user, u)
+	assert.Equal(t, 1, calls)
+
+	t.Run("hit", func(t *testing.T) {
+		u, err := uc.ByID(ctx, 888)
+
+		assert.NoError(t, err)
+		assert.Equal(t, user, u)
+		assert.Equal(t, 1, calls, "cache hit must not query the database")
+	})
+
+	t.Run("updateInvalidates", func(t *testing.T) {
+		user.Active = false
+		require.NoError(t, uc.Update(ctx, &user))
+
+		u, err := uc.ByID(ctx, 888)
+
+		assert.NoError(t, err)
+		assert.False(t, u.Active)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("deleteInvalidates", func(t *testing.T) {
+		tudb.byID = func(ctx context.Context, id int64) (User, error) {
+			calls++
+			return User{}, ErrNotFound
+		}
+		require.NoError(t, uc.Delete(ctx, 888))
+
+		_, err := uc.ByID(ctx, 888)
+
+		assert.Equal(t, ErrNotFound, err)
+		assert.Equal(t, 3, calls)
+
+		_, err = uc.ByID(ctx, 888)
+		assert.Equal(t, ErrNotFound, err)
+		assert.Equal(t, 4, calls, "errors are not cached")
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		tudb.byID = func(ctx context.Context, id int64) (User, error) {
+			calls++
+			return user, nil
+		}
+
+		_, err := uc.ByID(ctx, 999)
+		require.NoError(t, err)
+		assert.Equal(t, 5, calls)
+
+		now = now.Add(2 * time.Minute)
+		_, err = uc.ByID(ctx, 999)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 6, calls)
+	})
+}
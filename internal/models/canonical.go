@@ -0,0 +1,54 @@
+package models
+
+import "strings"
+
+// An EmailCanonicalisation describes the addresses an email provider delivers to the same mailbox, so
+// they are considered the same address when checking that emails are unique. The address users sign up
+// with is kept as given.
+type EmailCanonicalisation struct {
+	// StripTags removes the "+tag" suffix of the local part of the addresses.
+	StripTags bool
+
+	// StripDots removes the dots of the local part of the addresses, which the provider ignores.
+	StripDots bool
+
+	// Domain, when not empty, replaces the domain of the addresses, for providers serving the same
+	// mailboxes under several domains.
+	Domain string
+}
+
+// GmailCanonicalisation holds the canonicalisations of the Gmail addresses, which ignore the dots and
+// the "+tag" suffix of their local part and are served under both gmail.com and googlemail.com.
+var GmailCanonicalisation = map[string]EmailCanonicalisation{
+	"gmail.com":      {StripTags: true, StripDots: true},
+	"googlemail.com": {StripTags: true, StripDots: true, Domain: "gmail.com"},
+}
+
+// canonicalEmail returns the canonical form of the normalised address email under rules, keyed by
+// domain. Addresses of domains without rules are returned as they are.
+func canonicalEmail(email string, rules map[string]EmailCanonicalisation) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return email
+	}
+
+	local, domain := email[:i], email[i+1:]
+	rule, ok := rules[domain]
+	if !ok {
+		return email
+	}
+
+	if rule.StripTags {
+		if j := strings.Index(local, "+"); j >= 0 {
+			local = local[:j]
+		}
+	}
+	if rule.StripDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	if rule.Domain != "" {
+		domain = rule.Domain
+	}
+
+	return local + "@" + domain
+}
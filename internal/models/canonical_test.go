@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalEmail(t *testing.T) {
+	rules := map[string]EmailCanonicalisation{
+		"gmail.com":      {StripTags: true, StripDots: true},
+		"googlemail.com": {StripTags: true, StripDots: true, Domain: "gmail.com"},
+		"fastmail.com":   {StripTags: true},
+	}
+
+	var cases = []struct {
+		name  string
+		email string
+		out   string
+	}{
+		{"plain", "jane@gmail.com", "jane@gmail.com"},
+		{"tag", "jane+1@gmail.com", "jane@gmail.com"},
+		{"dots", "j.a.n.e@gmail.com", "jane@gmail.com"},
+		{"dotsAndTag", "j.ane+news+2@gmail.com", "jane@gmail.com"},
+		{"alias", "j.ane+1@googlemail.com", "jane@gmail.com"},
+		{"tagsOnly", "j.ane+1@fastmail.com", "j.ane@fastmail.com"},
+		{"otherDomain", "j.ane+1@example.com", "j.ane+1@example.com"},
+		{"subdomain", "jane+1@eu.gmail.com", "jane+1@eu.gmail.com"},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			assert.Equal(t, cs.out, canonicalEmail(cs.email, rules))
+		})
+	}
+}
+
+func TestUserService_CreateCanonicalEmails(t *testing.T) {
+	ctx := context.Background()
+
+	var cases = []struct {
+		name   string
+		rules  map[string]EmailCanonicalisation
+		email  string
+		outErr error
+	}{
+		{"plusAddressed", GmailCanonicalisation, "jane+2@gmail.com", ValidationError{"email": ErrDuplicate}},
+		{"dotted", GmailCanonicalisation, "J.ane@gmail.com", ValidationError{"email": ErrDuplicate}},
+		{"alias", GmailCanonicalisation, "jane+3@googlemail.com", ValidationError{"email": ErrDuplicate}},
+		{"otherMailbox", GmailCanonicalisation, "john+1@gmail.com", nil},
+		{"disabled", nil, "jane+2@gmail.com", nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			// jane+1@gmail.com signed up already.
+			tudb := &testUserDB{
+				byEmail: func(ctx context.Context, e string) (User, error) {
+					return User{}, ErrNotFound
+				},
+				byCanonicalEmail: func(ctx context.Context, e string) (User, error) {
+					if e == "jane@gmail.com" {
+						return User{ID: 1, Email: "jane+1@gmail.com", CanonicalEmail: e}, nil
+					}
+
+					return User{}, ErrNotFound
+				},
+				create: func(ctx context.Context, u *User) error {
+					return nil
+				},
+			}
+			us := NewUserService(nil, []byte(testJWTSecret), Config{CanonicalEmails: cs.rules})
+			us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+			u := &User{Country: "GB", Email: cs.email, FirstName: "Jane", Password: "testpassword"}
+			err := us.Create(ctx, u)
+
+			assert.Equal(t, cs.outErr, err)
+			if cs.outErr == nil {
+				// the address users gave is kept.
+				assert.Equal(t, cs.email, u.Email)
+			}
+		})
+	}
+}
+
+func TestUserService_UpdateCanonicalEmails(t *testing.T) {
+	ctx := context.Background()
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Email: "john@gmail.com", CanonicalEmail: "john@gmail.com", FirstName: "John"}, nil
+		},
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			return User{}, ErrNotFound
+		},
+		byCanonicalEmail: func(ctx context.Context, e string) (User, error) {
+			if e == "jane@gmail.com" {
+				return User{ID: 1, Email: "jane@gmail.com", CanonicalEmail: e}, nil
+			}
+
+			return User{}, ErrNotFound
+		},
+		update: func(ctx context.Context, u *User) error {
+			return nil
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{CanonicalEmails: GmailCanonicalisation})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	err := us.Update(ctx, &User{ID: 2, Country: "GB", Email: "ja.ne+x@gmail.com", FirstName: "John"})
+	assert.Equal(t, ValidationError{"email": ErrDuplicate}, err)
+
+	u := &User{ID: 2, Country: "GB", Email: "jo.hn+x@gmail.com", FirstName: "John"}
+	assert.NoError(t, us.Update(ctx, u))
+	assert.Equal(t, "jo.hn+x@gmail.com", u.Email)
+	assert.Equal(t, "john@gmail.com", u.CanonicalEmail)
+}
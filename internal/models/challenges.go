@@ -0,0 +1,406 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// challengeDuration is the time a user has to complete a login challenge.
+	challengeDuration = 5 * time.Minute
+
+	// challengeMaxAttempts is the number of wrong codes after which a challenge is discarded, and the
+	// user must login again.
+	challengeMaxAttempts = 5
+
+	// otpSentKeyPrefix prefixes the keys marking that a code was sent to a user within OTPSendInterval.
+	otpSentKeyPrefix = "otpsent:"
+
+	// ChallengeMethodEmail challenges are completed with a code sent to the email address of the user.
+	ChallengeMethodEmail = "email"
+
+	// ChallengeMethodTOTP challenges are completed with a code of any of the authenticators of the user.
+	ChallengeMethodTOTP = "totp"
+
+	// ChallengeMethodSMS challenges are completed with a code sent by SMS to a phone of the user.
+	ChallengeMethodSMS = "sms"
+)
+
+// LoginSignals holds what is known of a login attempt, for a RiskAssessor to evaluate.
+type LoginSignals struct {
+	IP        string
+	UserAgent string
+	ClientID  string
+}
+
+// A RiskAssessor evaluates the risk of the logins with valid credentials, such as a login from a device
+// never seen for the user or from a location too far from the previous one to have been travelled.
+type RiskAssessor interface {
+	// AssessLogin returns the risk signals detected for the login of u, such as "new_device" or
+	// "impossible_travel". Logins with signals must complete a challenge before getting their tokens.
+	AssessLogin(ctx context.Context, u User, s LoginSignals) ([]string, error)
+}
+
+// The RiskAssessorFunc type is an adapter to allow the use of ordinary functions as risk assessors.
+type RiskAssessorFunc func(ctx context.Context, u User, s LoginSignals) ([]string, error)
+
+// AssessLogin calls f(ctx, u, s).
+func (f RiskAssessorFunc) AssessLogin(ctx context.Context, u User, s LoginSignals) ([]string, error) {
+	return f(ctx, u, s)
+}
+
+// ChallengeService defines the methods used to step up the verification of risky logins.
+type ChallengeService interface {
+	// Issue starts a challenge for the login of u through the client, sending u the code completing it.
+	// The returned challenge holds the token the client completes it with, which is only returned
+	// here.
+	//
+	// Challenges sending a code, including the ones issued by IssueMFA and IssuePhone, are not issued
+	// within the configured OTPSendInterval of the last code sent to the user, returning
+	// ErrOTPSendTooSoon instead.
+	Issue(ctx context.Context, u User, clientID, scope string, signals []string) (Challenge, error)
+
+	// IssueMFA starts the MFA step of the login of u through the client. It is completed with a code of
+	// any of the authenticators of u or, for the users whose only MFA devices are phones, with a code
+	// sent by SMS to the first phone enrolled.
+	IssueMFA(ctx context.Context, u User, clientID, scope string) (Challenge, error)
+
+	// IssuePhone starts the verification of a phone u wants to enroll as an MFA device, sending it a
+	// code by SMS. The phone must be an international number; the challenge holds its E.164 form.
+	//
+	// It may return a ValidationError for the phone.
+	IssuePhone(ctx context.Context, u User, phone string) (Challenge, error)
+
+	// Complete checks code is the one sent for the challenge, or a valid code of an authenticator for
+	// the MFA step, and returns the challenge, for the login to resume. Challenges are single use, and
+	// are discarded after too many wrong codes. Phone verifications cannot be completed here.
+	//
+	// Errors returned include ErrInvalidChallenge, ErrInvalidChallengeCode and ErrMFALocked.
+	Complete(ctx context.Context, token, code string) (Challenge, error)
+
+	// CompletePhone completes a phone verification issued by IssuePhone like Complete, returning the
+	// challenge holding the verified phone.
+	//
+	// Errors returned include ErrInvalidChallenge and ErrInvalidChallengeCode.
+	CompletePhone(ctx context.Context, token, code string) (Challenge, error)
+}
+
+// A Challenge is an additional verification required from a user to complete a risky login.
+type Challenge struct {
+	Token     string   `json:"challenge_token,omitempty"`
+	Method    string   `json:"method"`
+	Signals   []string `json:"signals,omitempty"`
+	ExpiresIn int64    `json:"expires_in,omitempty"`
+
+	UserID   int64  `json:"-"`
+	ClientID string `json:"-"`
+	Scope    string `json:"-"`
+
+	// Phone is the number the code was sent to, for SMS challenges.
+	Phone string `json:"-"`
+}
+
+// storedChallenge is a challenge as kept in the ephemeral store, by the hash of its token.
+type storedChallenge struct {
+	UserID    int64     `json:"uid"`
+	ClientID  string    `json:"cid"`
+	Scope     string    `json:"scp"`
+	Method    string    `json:"mth"`
+	Signals   []string  `json:"sig"`
+	Code      string    `json:"code,omitempty"`
+	Phone     string    `json:"phn,omitempty"`
+	Enroll    bool      `json:"enr,omitempty"`
+	Attempts  int       `json:"att"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+type challengeService struct {
+	store EphemeralStore
+	mfa   MFAService
+	cfg   Config
+}
+
+// NewChallengeService instantiates a new ChallengeService implementation keeping the challenges in store.
+// Codes are sent through cfg.Notifier, which must be set to issue challenges by email, and MFA codes are
+// verified with mfa, which must be set to issue MFA steps.
+func NewChallengeService(store EphemeralStore, mfa MFAService, cfg Config) ChallengeService {
+	return &challengeService{
+		store: store,
+		mfa:   mfa,
+		cfg:   cfg,
+	}
+}
+
+func (cs *challengeService) Issue(ctx context.Context, u User, clientID, scope string, signals []string) (Challenge, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ChallengeService.Issue")
+	defer span.End()
+
+	return cs.issue(ctx, storedChallenge{
+		UserID:   u.ID,
+		ClientID: clientID,
+		Scope:    scope,
+		Method:   ChallengeMethodEmail,
+		Signals:  signals,
+	}, func(code string) error {
+		return cs.cfg.Notifier.SendChallenge(ctx, u, code)
+	})
+}
+
+func (cs *challengeService) IssueMFA(ctx context.Context, u User, clientID, scope string) (Challenge, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ChallengeService.IssueMFA")
+	defer span.End()
+
+	devices, err := cs.mfa.Devices(ctx, u.ID)
+	if err != nil {
+		return Challenge{}, wrap("on issue mfa, failed to obtain mfa devices", err)
+	}
+
+	sc := storedChallenge{
+		UserID:   u.ID,
+		ClientID: clientID,
+		Scope:    scope,
+		Method:   ChallengeMethodTOTP,
+	}
+
+	phone := smsPhone(devices)
+	if phone == "" {
+		return cs.issue(ctx, sc, nil)
+	}
+
+	sc.Method = ChallengeMethodSMS
+	sc.Phone = phone
+	return cs.issue(ctx, sc, func(code string) error {
+		return cs.cfg.Notifier.SendSMS(ctx, u, phone, code)
+	})
+}
+
+func (cs *challengeService) IssuePhone(ctx context.Context, u User, phone string) (Challenge, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ChallengeService.IssuePhone")
+	defer span.End()
+
+	phone, err := ValidatePhone(phone)
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	return cs.issue(ctx, storedChallenge{
+		UserID: u.ID,
+		Method: ChallengeMethodSMS,
+		Phone:  phone,
+		Enroll: true,
+	}, func(code string) error {
+		return cs.cfg.Notifier.SendSMS(ctx, u, phone, code)
+	})
+}
+
+// issue stores sc under a new token until it expires. When send is not nil, a new code is set to sc and
+// sent with send, unless another code was sent to the user within the configured interval.
+func (cs *challengeService) issue(ctx context.Context, sc storedChallenge, send func(code string) error) (Challenge, error) {
+	sentKey := otpSentKeyPrefix + strconv.FormatInt(sc.UserID, 10)
+	if send != nil && cs.cfg.OTPSendInterval > 0 {
+		_, err := cs.store.Get(ctx, sentKey)
+		if err == nil {
+			return Challenge{}, ErrOTPSendTooSoon
+		}
+		if !xerrors.Is(err, ErrNotFound) {
+			return Challenge{}, wrap("on issue, failed to obtain last code sent", err)
+		}
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	if send != nil {
+		if sc.Code, err = randomCode(6); err != nil {
+			return Challenge{}, err
+		}
+	}
+
+	sc.ExpiresAt = cs.cfg.now().Add(challengeDuration)
+	if err := cs.save(ctx, token, sc); err != nil {
+		return Challenge{}, wrap("on issue, failed to store challenge", err)
+	}
+
+	if send != nil {
+		if err := send(sc.Code); err != nil {
+			_ = cs.store.Delete(ctx, hashChallengeToken(token))
+			return Challenge{}, wrap("on issue, failed to send challenge code", err)
+		}
+
+		if cs.cfg.OTPSendInterval > 0 {
+			if err := cs.store.Set(ctx, sentKey, []byte{1}, cs.cfg.OTPSendInterval); err != nil {
+				return Challenge{}, wrap("on issue, failed to store last code sent", err)
+			}
+		}
+	}
+
+	ch := sc.challenge()
+	ch.Token = token
+	ch.ExpiresIn = int64(challengeDuration / time.Second)
+	return ch, nil
+}
+
+// smsPhone returns the phone the codes of the MFA step are sent to, which is the first phone enrolled,
+// or an empty string when there are authenticators, as their codes cannot be intercepted in transit.
+func smsPhone(devices []MFADevice) string {
+	var phone string
+	for _, d := range devices {
+		switch d.Method {
+		case ChallengeMethodTOTP:
+			return ""
+		case ChallengeMethodSMS:
+			if phone == "" {
+				phone = d.Phone
+			}
+		}
+	}
+
+	return phone
+}
+
+func (cs *challengeService) Complete(ctx context.Context, token, code string) (Challenge, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ChallengeService.Complete")
+	defer span.End()
+
+	return cs.complete(ctx, token, code, false)
+}
+
+func (cs *challengeService) CompletePhone(ctx context.Context, token, code string) (Challenge, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ChallengeService.CompletePhone")
+	defer span.End()
+
+	return cs.complete(ctx, token, code, true)
+}
+
+// complete completes the challenge with the given token, which must be a phone verification when enroll
+// is true, and a login challenge otherwise.
+func (cs *challengeService) complete(ctx context.Context, token, code string, enroll bool) (Challenge, error) {
+	key := hashChallengeToken(token)
+	sc, err := cs.load(ctx, cs.store.Get, key)
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	// phone verifications must never complete a login, nor login challenges verify a phone.
+	if sc.Enroll != enroll {
+		return Challenge{}, ErrInvalidChallenge
+	}
+
+	valid, err := cs.verify(ctx, sc, code)
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	if !valid {
+		sc.Attempts++
+		if sc.Attempts >= challengeMaxAttempts {
+			err = cs.store.Delete(ctx, key)
+		} else {
+			err = cs.save(ctx, token, sc)
+		}
+		if err != nil {
+			return Challenge{}, wrap("on complete, failed to record attempt", err)
+		}
+
+		return Challenge{}, ErrInvalidChallengeCode
+	}
+
+	// the challenge is taken out of the store, so concurrent requests cannot both complete it.
+	sc, err = cs.load(ctx, cs.store.Take, key)
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	return sc.challenge(), nil
+}
+
+// verify reports whether code completes sc, checking MFA codes against the devices of the user.
+func (cs *challengeService) verify(ctx context.Context, sc storedChallenge, code string) (bool, error) {
+	if sc.Method != ChallengeMethodTOTP {
+		return subtle.ConstantTimeCompare([]byte(code), []byte(sc.Code)) == 1, nil
+	}
+
+	err := cs.mfa.VerifyUser(ctx, sc.UserID, code)
+	if err != nil && !xerrors.Is(err, ErrInvalidMFACode) {
+		return false, err
+	}
+
+	return err == nil, nil
+}
+
+// challenge returns the challenge sc was stored for, without its token.
+func (sc storedChallenge) challenge() Challenge {
+	return Challenge{
+		Method:   sc.Method,
+		Signals:  sc.Signals,
+		UserID:   sc.UserID,
+		ClientID: sc.ClientID,
+		Scope:    sc.Scope,
+		Phone:    sc.Phone,
+	}
+}
+
+// save stores sc under the hash of its token, until it expires.
+func (cs *challengeService) save(ctx context.Context, token string, sc storedChallenge) error {
+	b, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+
+	return cs.store.Set(ctx, hashChallengeToken(token), b, sc.ExpiresAt.Sub(cs.cfg.now()))
+}
+
+// load reads the challenge stored under key with get, returning ErrInvalidChallenge if there is none or
+// it has expired.
+func (cs *challengeService) load(ctx context.Context, get func(context.Context, string) ([]byte, error), key string) (storedChallenge, error) {
+	b, err := get(ctx, key)
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return storedChallenge{}, ErrInvalidChallenge
+		}
+
+		return storedChallenge{}, wrap("failed to obtain challenge", err)
+	}
+
+	var sc storedChallenge
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return storedChallenge{}, wrap("failed to decode challenge", err)
+	}
+
+	if !cs.cfg.now().Before(sc.ExpiresAt) {
+		return storedChallenge{}, ErrInvalidChallenge
+	}
+
+	return sc, nil
+}
+
+// hashChallengeToken returns the hex encoded SHA-256 hash of a challenge token, which the challenges are
+// stored by.
+func hashChallengeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomCode returns a random code of n decimal digits.
+func randomCode(n int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+	v, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", wrap("failed to read random number", err)
+	}
+
+	return fmt.Sprintf("%0*d", n, v), nil
+}
@@ -0,0 +1,294 @@
+package models
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestChallengeService_Complete(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name     string
+		attempts []string // codes sent before the right one, "" standing for the right code
+		after    time.Duration
+		outErr   error // error of the last attempt
+	}{
+		{
+			name:     "completed",
+			attempts: []string{""},
+		},
+		{
+			name:     "wrongCode",
+			attempts: []string{"nope"},
+			outErr:   ErrInvalidChallengeCode,
+		},
+		{
+			name:     "completedAfterWrongCode",
+			attempts: []string{"nope", ""},
+		},
+		{
+			name:     "tooManyWrongCodes",
+			attempts: []string{"nope", "nope", "nope", "nope", "nope", ""},
+			outErr:   ErrInvalidChallenge,
+		},
+		{
+			name:     "reused",
+			attempts: []string{"", ""},
+			outErr:   ErrInvalidChallenge,
+		},
+		{
+			name:     "expired",
+			attempts: []string{""},
+			after:    challengeDuration,
+			outErr:   ErrInvalidChallenge,
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now := start
+			notifier := &testNotifier{tokens: make(map[int64]string)}
+			cfg := Config{
+				Now:      func() time.Time { return now },
+				Notifier: notifier,
+			}
+			chs := NewChallengeService(NewMemoryStore(cfg), nil, cfg)
+
+			ch, err := chs.Issue(ctx, User{ID: 7}, "web", "profile", []string{"impossible_travel"})
+			require.NoError(t, err)
+			assert.NotEmpty(t, ch.Token)
+			assert.Regexp(t, "^[0-9]{6}$", notifier.tokens[7])
+
+			now = now.Add(cs.after)
+
+			var got Challenge
+			for _, code := range cs.attempts {
+				if code == "" {
+					code = notifier.tokens[7]
+				}
+				got, err = chs.Complete(ctx, ch.Token, code)
+			}
+
+			assert.True(t, xerrors.Is(err, cs.outErr), "got %v", err)
+			if cs.outErr == nil {
+				assert.Equal(t, int64(7), got.UserID)
+				assert.Equal(t, "web", got.ClientID)
+				assert.Equal(t, "profile", got.Scope)
+				assert.Empty(t, got.Token)
+			}
+		})
+	}
+}
+
+func TestChallengeService_SMS(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	phone := "+447700900123"
+
+	var cases = []struct {
+		name     string
+		attempts []string // codes sent before the right one, "" standing for the right code
+		after    time.Duration
+		outErr   error // error of the last attempt
+	}{
+		{
+			name:     "completed",
+			attempts: []string{""},
+		},
+		{
+			name:     "wrongCode",
+			attempts: []string{"nope"},
+			outErr:   ErrInvalidChallengeCode,
+		},
+		{
+			name:     "tooManyWrongCodes",
+			attempts: []string{"nope", "nope", "nope", "nope", "nope", ""},
+			outErr:   ErrInvalidChallenge,
+		},
+		{
+			name:     "reused",
+			attempts: []string{"", ""},
+			outErr:   ErrInvalidChallenge,
+		},
+		{
+			name:     "expired",
+			attempts: []string{""},
+			after:    challengeDuration,
+			outErr:   ErrInvalidChallenge,
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now := start
+			notifier := &testNotifier{tokens: make(map[int64]string)}
+			cfg := Config{
+				Now:      func() time.Time { return now },
+				Notifier: notifier,
+			}
+			ms := NewMFAService(nil, cfg)
+			ms.(*mfaService).MFADB = &testMFADB{devices: []MFADevice{
+				{ID: 1, UserID: 7, Method: ChallengeMethodSMS, Phone: phone},
+			}}
+			chs := NewChallengeService(NewMemoryStore(cfg), ms, cfg)
+
+			ch, err := chs.IssueMFA(ctx, User{ID: 7}, "web", "profile")
+			require.NoError(t, err)
+			assert.Equal(t, ChallengeMethodSMS, ch.Method)
+			assert.Regexp(t, "^"+regexp.QuoteMeta(phone)+":[0-9]{6}$", notifier.tokens[7])
+			code := strings.TrimPrefix(notifier.tokens[7], phone+":")
+
+			now = now.Add(cs.after)
+
+			var got Challenge
+			for _, attempt := range cs.attempts {
+				if attempt == "" {
+					attempt = code
+				}
+				got, err = chs.Complete(ctx, ch.Token, attempt)
+			}
+
+			assert.True(t, xerrors.Is(err, cs.outErr), "got %v", err)
+			if cs.outErr == nil {
+				assert.Equal(t, int64(7), got.UserID)
+				assert.Equal(t, ChallengeMethodSMS, got.Method)
+				assert.Equal(t, phone, got.Phone)
+			}
+		})
+	}
+}
+
+func TestChallengeService_IssueMFAPrefersAuthenticators(t *testing.T) {
+	ctx := context.Background()
+	notifier := &testNotifier{tokens: make(map[int64]string)}
+	cfg := Config{Notifier: notifier}
+	ms := NewMFAService(nil, cfg)
+	ms.(*mfaService).MFADB = &testMFADB{devices: []MFADevice{
+		{ID: 1, UserID: 7, Method: ChallengeMethodSMS, Phone: "+447700900123"},
+		{ID: 2, UserID: 7, Method: ChallengeMethodTOTP, Secret: testTOTPSecret},
+	}}
+	chs := NewChallengeService(NewMemoryStore(cfg), ms, cfg)
+
+	ch, err := chs.IssueMFA(ctx, User{ID: 7}, "web", "profile")
+	require.NoError(t, err)
+
+	assert.Equal(t, ChallengeMethodTOTP, ch.Method)
+	assert.Empty(t, notifier.tokens)
+}
+
+func TestChallengeService_Phone(t *testing.T) {
+	ctx := context.Background()
+	notifier := &testNotifier{tokens: make(map[int64]string)}
+	cfg := Config{Notifier: notifier}
+	chs := NewChallengeService(NewMemoryStore(cfg), nil, cfg)
+
+	_, err := chs.IssuePhone(ctx, User{ID: 7}, "07700 900123")
+	assert.Equal(t, ValidationError{"phone": ErrPhoneInvalid}, err)
+
+	ch, err := chs.IssuePhone(ctx, User{ID: 7}, "+44 (0)7700 900123")
+	require.NoError(t, err)
+	require.Contains(t, notifier.tokens[7], "+447700900123:")
+	code := strings.TrimPrefix(notifier.tokens[7], "+447700900123:")
+
+	// phone verifications cannot complete a login, whatever the code.
+	_, err = chs.Complete(ctx, ch.Token, code)
+	assert.Equal(t, ErrInvalidChallenge, err)
+
+	got, err := chs.CompletePhone(ctx, ch.Token, code)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), got.UserID)
+	assert.Equal(t, "+447700900123", got.Phone)
+
+	_, err = chs.CompletePhone(ctx, ch.Token, code)
+	assert.Equal(t, ErrInvalidChallenge, err)
+}
+
+func TestChallengeService_SendInterval(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name    string
+		after   time.Duration
+		userID  int64
+		outErr  error
+		outSent bool
+	}{
+		{
+			name:   "tooSoon",
+			after:  29 * time.Second,
+			userID: 7,
+			outErr: ErrOTPSendTooSoon,
+		},
+		{
+			name:    "afterInterval",
+			after:   30 * time.Second,
+			userID:  7,
+			outSent: true,
+		},
+		{
+			name:    "otherUser",
+			userID:  8,
+			outSent: true,
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now := start
+			notifier := &testNotifier{tokens: make(map[int64]string)}
+			cfg := Config{
+				Now:             func() time.Time { return now },
+				Notifier:        notifier,
+				OTPSendInterval: 30 * time.Second,
+			}
+			chs := NewChallengeService(NewMemoryStore(cfg), nil, cfg)
+
+			_, err := chs.Issue(ctx, User{ID: 7}, "web", "profile", []string{"new_device"})
+			require.NoError(t, err)
+			sent := notifier.tokens[7]
+			delete(notifier.tokens, 7)
+
+			// phone verifications share the interval with the login challenges.
+			now = now.Add(cs.after)
+			ch, err := chs.IssuePhone(ctx, User{ID: cs.userID}, "+447700900123")
+
+			assert.Equal(t, cs.outErr, err)
+			if !cs.outSent {
+				assert.Empty(t, ch.Token)
+				assert.Empty(t, notifier.tokens)
+				return
+			}
+
+			assert.NotEmpty(t, ch.Token)
+			assert.NotEmpty(t, notifier.tokens[cs.userID])
+			assert.NotEqual(t, sent, notifier.tokens[cs.userID])
+		})
+	}
+}
+
+func TestChallengeService_SendIntervalTOTP(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{OTPSendInterval: time.Minute}
+	ms := NewMFAService(nil, cfg)
+	ms.(*mfaService).MFADB = &testMFADB{devices: []MFADevice{
+		{ID: 1, UserID: 7, Method: ChallengeMethodTOTP, Secret: testTOTPSecret},
+	}}
+	chs := NewChallengeService(NewMemoryStore(cfg), ms, cfg)
+
+	// no code is sent for authenticators, so the MFA step can be issued at any time.
+	for i := 0; i < 2; i++ {
+		ch, err := chs.IssueMFA(ctx, User{ID: 7}, "web", "profile")
+		require.NoError(t, err)
+		assert.NotEmpty(t, ch.Token)
+	}
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"context"
+
+	"go.opencensus.io/trace"
+)
+
+// userDataCleaner removes the data a store keeps about a user.
+type userDataCleaner interface {
+	// DeleteUserData removes the records of the user with the given ID. Users without any are not an
+	// error.
+	DeleteUserData(context.Context, int64) error
+}
+
+// userCleanup is a UserDB layer removing the credentials and grants kept about the users along with them
+// when they are deleted, so none of them linger once the user is gone.
+type userCleanup struct {
+	UserDB
+
+	cleaners []userDataCleaner
+}
+
+// newUserCleanup instantiates a userCleanup in front of udb, removing the data of the deleted users from
+// the stores of cleaners.
+func newUserCleanup(udb UserDB, cleaners ...userDataCleaner) *userCleanup {
+	return &userCleanup{
+		UserDB:   udb,
+		cleaners: cleaners,
+	}
+}
+
+// Delete removes the data of the user before the user itself. The stores are not updated at once, so
+// the user is only deleted once all of its data is: a failed deletion can be retried until it succeeds.
+func (uc *userCleanup) Delete(ctx context.Context, id int64) error {
+	ctx, span := trace.StartSpan(ctx, "models.User.cleanup.Delete")
+	defer span.End()
+
+	for _, c := range uc.cleaners {
+		if err := c.DeleteUserData(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return uc.UserDB.Delete(ctx, id)
+}
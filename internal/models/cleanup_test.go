@@ -0,0 +1,114 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testUserDataCleaner records the users whose data it was asked to delete.
+type testUserDataCleaner struct {
+	deleted []int64
+	err     error
+}
+
+func (t *testUserDataCleaner) DeleteUserData(ctx context.Context, userID int64) error {
+	if t.err != nil {
+		return t.err
+	}
+
+	t.deleted = append(t.deleted, userID)
+	return nil
+}
+
+func TestUserCleanup(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("deleted", func(t *testing.T) {
+		mfa, keys := &testUserDataCleaner{}, &testUserDataCleaner{}
+		var deleted []int64
+		tudb := &testUserDB{
+			delete: func(ctx context.Context, id int64) error {
+				// the data is gone by the time the user is deleted.
+				assert.Equal(t, []int64{id}, mfa.deleted)
+				assert.Equal(t, []int64{id}, keys.deleted)
+				deleted = append(deleted, id)
+				return nil
+			},
+		}
+
+		err := newUserCleanup(tudb, mfa, keys).Delete(ctx, 888)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{888}, deleted)
+	})
+
+	t.Run("cleanupFails", func(t *testing.T) {
+		failing := &testUserDataCleaner{err: errors.New("connection reset")}
+		tudb := &testUserDB{
+			delete: func(ctx context.Context, id int64) error {
+				t.Fatal("the user must be kept until its data is deleted")
+				return nil
+			},
+		}
+
+		err := newUserCleanup(tudb, failing).Delete(ctx, 888)
+		assert.Error(t, err)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		us := NewUserService(nil, []byte(testJWTSecret), Config{})
+		_, ok := us.(*userService).UserService.(*userValidator).UserDB.(*userCleanup)
+		assert.False(t, ok)
+
+		us = NewUserService(nil, []byte(testJWTSecret), Config{DeleteUserData: true})
+		_, ok = us.(*userService).UserService.(*userValidator).UserDB.(*userCleanup)
+		assert.True(t, ok)
+	})
+}
+
+func TestUserCleanupGORM_Delete(t *testing.T) {
+	db, err := NewTestDatabase(t)
+	require.NoError(t, err)
+	defer CloseDBConnection(db)
+
+	ctx := context.Background()
+	CleanupTestDatabase(db)
+	require.NoError(t, db.Migrator().CreateTable(&MFADevice{}, &SecurityAnswer{}, &APIKey{}, &Consent{}, &DeviceAuthorization{}))
+
+	now := time.Now()
+	for _, id := range []int64{998, 999} {
+		require.NoError(t, db.Create(&User{ID: id, Active: true, Email: fmt.Sprintf("test%d@test.com", id), FirstName: "Test"}).Error)
+		require.NoError(t, db.Create(&MFADevice{UserID: id, Name: "phone", Secret: "JBSWY3DPEHPK3PXP", CreatedAt: now}).Error)
+		require.NoError(t, db.Create(&SecurityAnswer{UserID: id, Question: "pet", Hash: "hash", CreatedAt: now}).Error)
+		require.NoError(t, db.Create(&APIKey{UserID: id, Name: "ci", Hash: hashAPIKey(fmt.Sprint("key", id)), CreatedAt: now}).Error)
+		require.NoError(t, db.Create(&Consent{UserID: id, ClientID: "app", Scope: "profile", GrantedAt: now}).Error)
+		require.NoError(t, db.Create(&DeviceAuthorization{
+			Hash:      hashDeviceCode(fmt.Sprint("device", id)),
+			UserCode:  fmt.Sprint("CODE-", id),
+			ClientID:  "tv",
+			Status:    DeviceStatusApproved,
+			UserID:    id,
+			ExpiresAt: now.Add(time.Minute),
+		}).Error)
+	}
+
+	us := NewUserService(db, []byte(testJWTSecret), Config{DeleteUserData: true})
+	require.NoError(t, us.Delete(ctx, 999))
+
+	// the records of the user deleted are removed, the ones of the other users are kept.
+	for _, m := range []interface{}{&MFADevice{}, &SecurityAnswer{}, &APIKey{}, &Consent{}, &DeviceAuthorization{}} {
+		var deleted, kept int64
+		require.NoError(t, db.Model(m).Where("user_id = ?", 999).Count(&deleted).Error)
+		require.NoError(t, db.Model(m).Where("user_id = ?", 998).Count(&kept).Error)
+		assert.Equal(t, int64(0), deleted, "%T", m)
+		assert.Equal(t, int64(1), kept, "%T", m)
+	}
+
+	_, err = us.ByID(ctx, 999)
+	assert.Equal(t, ErrNotFound, err)
+}
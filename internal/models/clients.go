@@ -0,0 +1,468 @@
+package models
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/xerrors"
+	jwtjose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"gorm.io/gorm"
+)
+
+const (
+	tokenClaimsIssuerClient = "goauthsvcclient"
+)
+
+// supportedGrantTypes are the grant types clients can register for.
+var supportedGrantTypes = StringList{
+	"authorization_code",
+	"client_credentials",
+	"password",
+	"refresh_token",
+	"urn:ietf:params:oauth:grant-type:device_code",
+}
+
+// ClientService defines a set of methods to be used when dealing with the OAuth clients registered in
+// the system and authenticating them.
+type ClientService interface {
+	// Authenticate returns a client based on the provided client ID and secret.
+	//
+	// Errors returned include ErrNoCredentials and ErrInvalidClient. Specific errors are masked and
+	// not provided, being replaced by ErrInvalidClient.
+	Authenticate(ctx context.Context, clientID, secret string) (Client, error)
+
+	// Token generates an access token that identifies the client itself, as issued by the
+	// client_credentials grant. No refresh token is included.
+	Token(ctx context.Context, c *Client) (Token, error)
+
+	// Validate returns the claims of an access token generated by Token, whose principal is the client
+	// itself rather than a user. The tokens of the clients disabled or deleted since are rejected.
+	//
+	// It may return ErrUnauthorised.
+	Validate(ctx context.Context, accessToken string) (Claims, error)
+
+	// Register adds a client from the metadata it sent to the dynamic client registration endpoint
+	// (RFC 7591). The ID and secret of the client are generated, and the secret is only returned here,
+	// as the system only stores its hash. Clients not sending grant types get authorization_code.
+	//
+	// It returns a ValidationError if the metadata is not valid, such as a redirect URI that is not
+	// absolute or uses plain HTTP for a host other than localhost.
+	Register(ctx context.Context, c *Client) (string, error)
+
+	// RotateSecret generates a new secret for the client, returning it. The previous secret is still
+	// accepted for overlap, so requests in flight and instances not yet updated keep working. Only one
+	// previous secret is kept: rotating again during the overlap invalidates the oldest secret. A zero
+	// overlap invalidates the previous secret at once.
+	//
+	// It may return ErrNotFound.
+	RotateSecret(ctx context.Context, clientID string, overlap time.Duration) (string, error)
+
+	ClientDB
+}
+
+// ClientDB defines how the service interacts with the database.
+type ClientDB interface {
+	// Create adds a client to the system. The Secret field must already be hashed.
+	Create(context.Context, *Client) error
+
+	// ByID retrieves a client by its client ID.
+	ByID(context.Context, string) (Client, error)
+
+	// Update saves the changes to a client. The Secret field must already be hashed.
+	Update(context.Context, *Client) error
+}
+
+// A Client represents an application registered to request tokens from the system, either on behalf
+// of a user or for itself.
+type Client struct {
+	ID string `gorm:"primary_key;size:255" json:"client_id"`
+
+	// Active marks if the client is active in the system or disabled.
+	// Inactive clients are not able to authenticate.
+	Active bool `gorm:"not null" json:"active"`
+
+	// Name is a human readable description of the client.
+	Name string `gorm:"size:255;not null" json:"client_name"`
+
+	// Secret stores the hashed client secret.
+	// This value is always cleared when the services return a client.
+	Secret string `gorm:"size:255;not null" json:"client_secret,omitempty"`
+
+	// PreviousSecret stores the hashed secret replaced by the last rotation, which is still accepted
+	// until PreviousSecretExpiresAt. It is always cleared when the services return a client.
+	PreviousSecret          string     `gorm:"size:255" json:"-"`
+	PreviousSecretExpiresAt *time.Time `json:"-"`
+
+	// RedirectURIs lists the URIs the client may ask users to be redirected to in the
+	// authorization_code grant.
+	RedirectURIs StringList `gorm:"not null" json:"redirect_uris"`
+
+	// GrantTypes lists the grant types the client registered for. It is informational, as grants are
+	// not restricted by it.
+	GrantTypes StringList `json:"grant_types,omitempty"`
+
+	// PostLogoutRedirectURIs lists the URIs users may be redirected to after logging out.
+	PostLogoutRedirectURIs StringList `json:"post_logout_redirect_uris"`
+
+	// BackchannelLogoutURI is the URI the client is notified at, with a logout token, when a user logs
+	// out. Empty disables the notifications.
+	BackchannelLogoutURI string `gorm:"size:255" json:"backchannel_logout_uri,omitempty"`
+
+	// AccessTokenTTL and RefreshTokenTTL override the lifetimes of the tokens issued through the client,
+	// whatever the grant type. Zero values keep the defaults.
+	AccessTokenTTL  time.Duration `gorm:"not null;default:0" json:"access_token_ttl,omitempty"`
+	RefreshTokenTTL time.Duration `gorm:"not null;default:0" json:"refresh_token_ttl,omitempty"`
+}
+
+// lifetimes returns the lifetimes of the tokens issued through c.
+func (c Client) lifetimes() tokenLifetimes {
+	lt := defaultLifetimes
+	if c.AccessTokenTTL > 0 {
+		lt.access = c.AccessTokenTTL
+	}
+	if c.RefreshTokenTTL > 0 {
+		lt.refresh = c.RefreshTokenTTL
+	}
+
+	return lt
+}
+
+// PostLogoutRedirectURI returns requested if it exactly matches one of the post logout redirect URIs
+// registered for c: no normalisation, prefix or substring matching is applied, as loose matching allows
+// open redirects. No URI is returned by default when requested is empty.
+//
+// It may return ErrInvalidRedirectURI.
+func (c Client) PostLogoutRedirectURI(requested string) (string, error) {
+	if requested == "" {
+		return "", nil
+	}
+
+	if !c.PostLogoutRedirectURIs.Contains(requested) {
+		return "", ErrInvalidRedirectURI
+	}
+
+	return requested, nil
+}
+
+type clientService struct {
+	ClientDB
+
+	signer jwtjose.Signer
+	secret []byte
+}
+
+// NewClientService instantiates a new ClientService implementation with db as the backing database.
+func NewClientService(db *gorm.DB, jwtSecret []byte) ClientService {
+	return &clientService{
+		ClientDB: &clientGorm{db},
+		signer:   newSigner(jwtSecret),
+		secret:   jwtSecret,
+	}
+}
+
+func (cs *clientService) Authenticate(ctx context.Context, clientID, secret string) (Client, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ClientService.Authenticate")
+	defer span.End()
+
+	if clientID == "" || secret == "" {
+		return Client{}, ErrNoCredentials
+	}
+
+	client, err := cs.ClientDB.ByID(ctx, clientID)
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			// sleep protection to reduce effectiveness of BF attacks
+			time.Sleep(waitAfterAuthError)
+			return Client{}, ErrInvalidClient
+		}
+
+		return Client{}, wrap("on authenticate, failed to obtain client from database", err)
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(client.Secret), []byte(secret))
+	if err != nil && client.PreviousSecret != "" && client.PreviousSecretExpiresAt != nil &&
+		time.Now().UTC().Before(*client.PreviousSecretExpiresAt) {
+		// the secret replaced by a rotation is accepted during the overlap.
+		err = bcrypt.CompareHashAndPassword([]byte(client.PreviousSecret), []byte(secret))
+	}
+	if err != nil || !client.Active {
+		time.Sleep(waitAfterAuthError)
+		return Client{}, ErrInvalidClient
+	}
+
+	client.Secret = ""
+	client.PreviousSecret = ""
+	return client, nil
+}
+
+func (cs *clientService) Token(ctx context.Context, c *Client) (Token, error) {
+	_, span := trace.StartSpan(ctx, "models.ClientService.Token")
+	defer span.End()
+
+	id, err := randomToken(16)
+	if err != nil {
+		return Token{}, wrap("failed to generate client access token ID", err)
+	}
+
+	ttl := c.lifetimes().access
+	now := time.Now().UTC()
+	claims := authClaims{
+		Claims: jwt.Claims{
+			ID:       id,
+			Subject:  c.ID,
+			Issuer:   tokenClaimsIssuerClient,
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+
+	accessTok, err := jwt.Signed(cs.signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		return Token{}, wrap("failed to generate client access token", err)
+	}
+
+	return Token{
+		AccessToken: accessTok,
+		ExpiresIn:   int(ttl / time.Second),
+		TokenType:   "bearer",
+	}, nil
+}
+
+func (cs *clientService) Validate(ctx context.Context, accessToken string) (Claims, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ClientService.Validate")
+	defer span.End()
+
+	tok, err := jwt.ParseSigned(accessToken)
+	if err != nil || !signedWith(tok, jwtjose.HS512) {
+		return Claims{}, ErrUnauthorised
+	}
+
+	var cl authClaims
+	if err := tok.Claims(cs.secret, &cl); err != nil {
+		return Claims{}, ErrUnauthorised
+	}
+
+	// the tokens of the users are signed with the same key, but not by the same issuer.
+	if err := cl.Validate(jwt.Expected{Issuer: tokenClaimsIssuerClient, Time: time.Now().UTC()}); err != nil {
+		return Claims{}, ErrUnauthorised
+	}
+
+	client, err := cs.ClientDB.ByID(ctx, cl.Subject)
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return Claims{}, ErrUnauthorised
+		}
+
+		return Claims{}, wrap("on validate, failed to obtain client from database", err)
+	}
+
+	if !client.Active {
+		return Claims{}, ErrUnauthorised
+	}
+
+	c := Claims{
+		PrincipalType: PrincipalClient,
+		ClientID:      client.ID,
+		TokenID:       cl.ID,
+		ExpiresAt:     cl.Expiry.Time(),
+	}
+	if cl.IssuedAt != nil {
+		c.IssuedAt = cl.IssuedAt.Time()
+	}
+
+	return c, nil
+}
+
+func (cs *clientService) Register(ctx context.Context, c *Client) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ClientService.Register")
+	defer span.End()
+
+	if len(c.GrantTypes) == 0 {
+		c.GrantTypes = StringList{"authorization_code"}
+	}
+
+	if err := c.validateMetadata(); err != nil {
+		return "", err
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", wrap("failed to hash client secret", err)
+	}
+
+	c.ID = id
+	c.Secret = string(hash)
+	c.Active = true
+	if err := cs.ClientDB.Create(ctx, c); err != nil {
+		return "", wrap("on register, failed to create client", err)
+	}
+
+	c.Secret = ""
+	return secret, nil
+}
+
+func (cs *clientService) RotateSecret(ctx context.Context, clientID string, overlap time.Duration) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ClientService.RotateSecret")
+	defer span.End()
+
+	client, err := cs.ClientDB.ByID(ctx, clientID)
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return "", ErrNotFound
+		}
+
+		return "", wrap("on rotate secret, failed to obtain client from database", err)
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", wrap("failed to hash client secret", err)
+	}
+
+	client.PreviousSecret, client.PreviousSecretExpiresAt = "", nil
+	if overlap > 0 {
+		expiresAt := time.Now().UTC().Add(overlap)
+		client.PreviousSecret, client.PreviousSecretExpiresAt = client.Secret, &expiresAt
+	}
+
+	client.Secret = string(hash)
+	if err := cs.ClientDB.Update(ctx, &client); err != nil {
+		return "", wrap("on rotate secret, failed to update client", err)
+	}
+
+	return secret, nil
+}
+
+// validateMetadata checks the metadata a client registers with.
+func (c Client) validateMetadata() error {
+	ve := ValidationError{}
+	if c.Name == "" {
+		ve["client_name"] = ErrRequired
+	}
+
+	for _, uri := range c.RedirectURIs {
+		if !validRedirectURI(uri) {
+			ve["redirect_uris"] = ErrInvalidRedirectURI
+		}
+	}
+
+	for _, uri := range c.PostLogoutRedirectURIs {
+		if !validRedirectURI(uri) {
+			ve["post_logout_redirect_uris"] = ErrInvalidRedirectURI
+		}
+	}
+
+	if c.BackchannelLogoutURI != "" && !validRedirectURI(c.BackchannelLogoutURI) {
+		ve["backchannel_logout_uri"] = ErrInvalidURLFormat
+	}
+
+	for _, gt := range c.GrantTypes {
+		if !supportedGrantTypes.Contains(gt) {
+			ve["grant_types"] = ErrInvalid
+		}
+	}
+
+	if c.GrantTypes.Contains("authorization_code") && len(c.RedirectURIs) == 0 {
+		ve["redirect_uris"] = ErrRequired
+	}
+
+	if len(ve) > 0 {
+		return ve
+	}
+
+	return nil
+}
+
+// validRedirectURI reports whether uri can be registered by a client: an absolute URI without a
+// fragment, using HTTPS unless it points at the loopback interface of a native application.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return false
+	}
+}
+
+func (cs *clientService) ByID(ctx context.Context, id string) (Client, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ClientService.ByID")
+	defer span.End()
+
+	c, err := cs.ClientDB.ByID(ctx, id)
+
+	c.Secret = ""
+	c.PreviousSecret = ""
+	return c, err
+}
+
+type clientGorm struct {
+	db *gorm.DB
+}
+
+func (cg *clientGorm) Create(ctx context.Context, c *Client) error {
+	ctx, span := trace.StartSpan(ctx, "client.Database.Create")
+	defer span.End()
+
+	err := cg.db.WithContext(ctx).Create(c).Error
+	if err != nil {
+		return wrap("could not create client", err)
+	}
+
+	return nil
+}
+
+func (cg *clientGorm) ByID(ctx context.Context, id string) (Client, error) {
+	ctx, span := trace.StartSpan(ctx, "client.Database.ByID")
+	defer span.End()
+
+	var client Client
+	err := cg.db.WithContext(ctx).Where("id = ?", id).First(&client).Error
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return Client{}, ErrNotFound
+		}
+
+		return Client{}, wrap("could not get client by id", err)
+	}
+
+	return client, nil
+}
+
+func (cg *clientGorm) Update(ctx context.Context, c *Client) error {
+	ctx, span := trace.StartSpan(ctx, "client.Database.Update")
+	defer span.End()
+
+	err := cg.db.WithContext(ctx).Save(c).Error
+	if err != nil {
+		return wrap("could not update client", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,416 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/xerrors"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type testClientDB struct {
+	ClientDB
+	byID   func(context.Context, string) (Client, error)
+	create func(context.Context, *Client) error
+	update func(context.Context, *Client) error
+}
+
+func (t *testClientDB) ByID(ctx context.Context, id string) (Client, error) {
+	if t.byID != nil {
+		return t.byID(ctx, id)
+	}
+
+	return Client{}, nil
+}
+
+func (t *testClientDB) Create(ctx context.Context, c *Client) error {
+	if t.create != nil {
+		return t.create(ctx, c)
+	}
+
+	return nil
+}
+
+func (t *testClientDB) Update(ctx context.Context, c *Client) error {
+	if t.update != nil {
+		return t.update(ctx, c)
+	}
+
+	return nil
+}
+
+func TestClientService_Authenticate(t *testing.T) {
+	tcdb := &testClientDB{}
+	cs := NewClientService(nil, []byte(testJWTSecret))
+	cs.(*clientService).ClientDB = tcdb
+
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	client := Client{
+		ID:     "ci-bot",
+		Active: true,
+		Name:   "CI bot",
+		Secret: string(hash),
+	}
+
+	t.Run("noCredentials", func(t *testing.T) {
+		_, err := cs.Authenticate(ctx, "ci-bot", "")
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrNoCredentials))
+	})
+
+	t.Run("notFound", func(t *testing.T) {
+		tcdb.byID = func(ctx context.Context, id string) (Client, error) {
+			return Client{}, ErrNotFound
+		}
+
+		_, err := cs.Authenticate(ctx, "ci-bot", "s3cret")
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrInvalidClient))
+	})
+
+	t.Run("badSecret", func(t *testing.T) {
+		tcdb.byID = func(ctx context.Context, id string) (Client, error) {
+			return client, nil
+		}
+
+		_, err := cs.Authenticate(ctx, "ci-bot", "wrong")
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrInvalidClient))
+	})
+
+	t.Run("inactive", func(t *testing.T) {
+		tcdb.byID = func(ctx context.Context, id string) (Client, error) {
+			ret := client
+			ret.Active = false
+			return ret, nil
+		}
+
+		_, err := cs.Authenticate(ctx, "ci-bot", "s3cret")
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrInvalidClient))
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		tcdb.byID = func(ctx context.Context, id string) (Client, error) {
+			assert.Equal(t, "ci-bot", id)
+			return client, nil
+		}
+
+		c, err := cs.Authenticate(ctx, "ci-bot", "s3cret")
+
+		assert.NoError(t, err)
+		assert.Equal(t, "ci-bot", c.ID)
+		assert.Empty(t, c.Secret, "secret must be cleared")
+	})
+}
+
+func TestClientService_Token(t *testing.T) {
+	ctx := context.Background()
+	cs := NewClientService(nil, []byte(testJWTSecret))
+
+	tok, err := cs.Token(ctx, &Client{ID: "ci-bot"})
+	require.NoError(t, err)
+	assert.Empty(t, tok.RefreshToken)
+	assert.Equal(t, "bearer", tok.TokenType)
+
+	jtok, err := jwt.ParseSigned(tok.AccessToken)
+	require.NoError(t, err)
+
+	var cl authClaims
+	require.NoError(t, jtok.Claims([]byte(testJWTSecret), &cl))
+	assert.NoError(t, cl.Validate(jwt.Expected{
+		Issuer:  "goauthsvcclient",
+		Subject: "ci-bot",
+		Time:    time.Now().UTC(),
+	}))
+	assert.Equal(t, int(jwtAccessDuration/time.Second), tok.ExpiresIn)
+
+	t.Run("lifetimeOverride", func(t *testing.T) {
+		tok, err := cs.Token(ctx, &Client{ID: "ci-bot", AccessTokenTTL: 10 * time.Minute})
+		require.NoError(t, err)
+		assert.Equal(t, 600, tok.ExpiresIn)
+
+		jtok, err := jwt.ParseSigned(tok.AccessToken)
+		require.NoError(t, err)
+
+		var cl authClaims
+		require.NoError(t, jtok.Claims([]byte(testJWTSecret), &cl))
+		assert.WithinDuration(t, time.Now().Add(10*time.Minute), cl.Expiry.Time(), time.Minute)
+	})
+}
+
+func TestClientService_Validate(t *testing.T) {
+	ctx := context.Background()
+	svc := NewClientService(nil, []byte(testJWTSecret))
+	svc.(*clientService).ClientDB = &testClientDB{
+		byID: func(ctx context.Context, id string) (Client, error) {
+			switch id {
+			case "ci-bot":
+				return Client{ID: id, Active: true}, nil
+			case "disabled":
+				return Client{ID: id}, nil
+			}
+
+			return Client{}, ErrNotFound
+		},
+	}
+
+	token := func(id string) string {
+		tok, err := svc.Token(ctx, &Client{ID: id})
+		require.NoError(t, err)
+
+		return tok.AccessToken
+	}
+
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
+	userTok, err := us.Token(ctx, &User{ID: 10})
+	require.NoError(t, err)
+
+	valid := token("ci-bot")
+	var cases = []struct {
+		name     string
+		token    string
+		outErr   error
+		outClaim string
+	}{
+		{"valid", valid, nil, "ci-bot"},
+		{"disabled", token("disabled"), ErrUnauthorised, ""},
+		{"deleted", token("gone"), ErrUnauthorised, ""},
+		{"userToken", userTok.AccessToken, ErrUnauthorised, ""},
+		{"tampered", valid[:len(valid)-2] + "xx", ErrUnauthorised, ""},
+		{"malformed", "token", ErrUnauthorised, ""},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			c, err := svc.Validate(ctx, cs.token)
+			assert.Equal(t, cs.outErr, err)
+			assert.Equal(t, cs.outClaim, c.ClientID)
+			if err == nil {
+				assert.Equal(t, PrincipalClient, c.PrincipalType)
+				assert.Zero(t, c.User.ID)
+				assert.NotEmpty(t, c.TokenID)
+				assert.WithinDuration(t, time.Now().Add(jwtAccessDuration), c.ExpiresAt, time.Minute)
+			}
+		})
+	}
+
+	t.Run("rejectedByUsers", func(t *testing.T) {
+		// the token of a client does not authenticate a user, even one with the ID of the client.
+		_, err := us.Validate(ctx, valid)
+		assert.Error(t, err)
+	})
+}
+
+func TestClientService_Register(t *testing.T) {
+	ctx := context.Background()
+
+	var cases = []struct {
+		name   string
+		client Client
+		outErr error
+	}{
+		{
+			"valid",
+			Client{
+				Name:         "Calendar",
+				RedirectURIs: StringList{"https://calendar.example.com/callback"},
+				GrantTypes:   StringList{"authorization_code", "refresh_token"},
+			},
+			nil,
+		},
+		{
+			"loopback",
+			Client{Name: "CLI", RedirectURIs: StringList{"http://127.0.0.1:8400/callback"}},
+			nil,
+		},
+		{
+			"noRedirectWithoutCode",
+			Client{Name: "TV", GrantTypes: StringList{"urn:ietf:params:oauth:grant-type:device_code"}},
+			nil,
+		},
+		{
+			"relativeRedirect",
+			Client{Name: "Calendar", RedirectURIs: StringList{"/callback"}},
+			ValidationError{"redirect_uris": ErrInvalidRedirectURI},
+		},
+		{
+			"plainHTTPRedirect",
+			Client{Name: "Calendar", RedirectURIs: StringList{"http://calendar.example.com/callback"}},
+			ValidationError{"redirect_uris": ErrInvalidRedirectURI},
+		},
+		{
+			"fragmentRedirect",
+			Client{Name: "Calendar", RedirectURIs: StringList{"https://calendar.example.com/callback#done"}},
+			ValidationError{"redirect_uris": ErrInvalidRedirectURI},
+		},
+		{
+			"missingRedirect",
+			Client{Name: "Calendar"},
+			ValidationError{"redirect_uris": ErrRequired},
+		},
+		{
+			"unknownGrantType",
+			Client{
+				Name:         "Calendar",
+				RedirectURIs: StringList{"https://calendar.example.com/callback"},
+				GrantTypes:   StringList{"implicit"},
+			},
+			ValidationError{"grant_types": ErrInvalid},
+		},
+		{
+			"missingName",
+			Client{RedirectURIs: StringList{"https://calendar.example.com/callback"}},
+			ValidationError{"client_name": ErrRequired},
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var created *Client
+			svc := NewClientService(nil, []byte(testJWTSecret))
+			svc.(*clientService).ClientDB = &testClientDB{
+				create: func(ctx context.Context, c *Client) error {
+					stored := *c
+					created = &stored
+					return nil
+				},
+			}
+
+			c := cs.client
+			secret, err := svc.Register(ctx, &c)
+
+			assert.Equal(t, cs.outErr, err)
+			if cs.outErr != nil {
+				assert.Nil(t, created)
+				return
+			}
+
+			require.NotNil(t, created)
+			assert.NotEmpty(t, c.ID)
+			assert.Empty(t, c.Secret)
+			assert.True(t, c.Active)
+			assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(created.Secret), []byte(secret)))
+		})
+	}
+}
+
+func TestClientService_RotateSecret(t *testing.T) {
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("old-secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	stored := Client{ID: "ci-bot", Active: true, Name: "CI bot", Secret: string(hash)}
+	cs := NewClientService(nil, []byte(testJWTSecret))
+	cs.(*clientService).ClientDB = &testClientDB{
+		byID: func(ctx context.Context, id string) (Client, error) {
+			if id != stored.ID {
+				return Client{}, ErrNotFound
+			}
+
+			return stored, nil
+		},
+		update: func(ctx context.Context, c *Client) error {
+			stored = *c
+			return nil
+		},
+	}
+
+	secret, err := cs.RotateSecret(ctx, "ci-bot", time.Hour)
+	require.NoError(t, err)
+
+	t.Run("overlap", func(t *testing.T) {
+		_, err := cs.Authenticate(ctx, "ci-bot", secret)
+		assert.NoError(t, err)
+
+		c, err := cs.Authenticate(ctx, "ci-bot", "old-secret")
+		assert.NoError(t, err)
+		assert.Empty(t, c.Secret)
+		assert.Empty(t, c.PreviousSecret)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		expired := time.Now().UTC().Add(-time.Second)
+		stored.PreviousSecretExpiresAt = &expired
+
+		_, err := cs.Authenticate(ctx, "ci-bot", "old-secret")
+		assert.True(t, xerrors.Is(err, ErrInvalidClient))
+
+		_, err = cs.Authenticate(ctx, "ci-bot", secret)
+		assert.NoError(t, err)
+	})
+
+	t.Run("noOverlap", func(t *testing.T) {
+		newer, err := cs.RotateSecret(ctx, "ci-bot", 0)
+		require.NoError(t, err)
+
+		_, err = cs.Authenticate(ctx, "ci-bot", secret)
+		assert.True(t, xerrors.Is(err, ErrInvalidClient))
+
+		_, err = cs.Authenticate(ctx, "ci-bot", newer)
+		assert.NoError(t, err)
+	})
+
+	t.Run("notFound", func(t *testing.T) {
+		_, err := cs.RotateSecret(ctx, "unknown", time.Hour)
+
+		assert.True(t, xerrors.Is(err, ErrNotFound))
+	})
+}
+
+func TestClient_PostLogoutRedirectURI(t *testing.T) {
+	client := Client{
+		ID: "web-app",
+		PostLogoutRedirectURIs: StringList{
+			"https://app.example.com/bye",
+			"https://app.example.com/oauth/done?source=web",
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		requested string
+		outURI    string
+		outErr    error
+	}{
+		{"exact", "https://app.example.com/bye", "https://app.example.com/bye", nil},
+		{"exactWithQuery", "https://app.example.com/oauth/done?source=web", "https://app.example.com/oauth/done?source=web", nil},
+		{"trailingSlash", "https://app.example.com/bye/", "", ErrInvalidRedirectURI},
+		{"extraPath", "https://app.example.com/bye/../evil", "", ErrInvalidRedirectURI},
+		{"extraQuery", "https://app.example.com/bye?next=https://evil.com", "", ErrInvalidRedirectURI},
+		{"prefix", "https://app.example.com/by", "", ErrInvalidRedirectURI},
+		{"differentCase", "https://APP.example.com/bye", "", ErrInvalidRedirectURI},
+		{"subdomainSuffix", "https://app.example.com.evil.com/bye", "", ErrInvalidRedirectURI},
+		{"unregistered", "https://evil.com/bye", "", ErrInvalidRedirectURI},
+		{"empty", "", "", nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			uri, err := client.PostLogoutRedirectURI(cs.requested)
+
+			assert.Equal(t, cs.outErr, err)
+			assert.Equal(t, cs.outURI, uri)
+		})
+	}
+}
+
+func TestStringList_Scan(t *testing.T) {
+	var l StringList
+	require.NoError(t, l.Scan([]byte("https://a.example.com/cb  https://b.example.com/cb")))
+	assert.Equal(t, StringList{"https://a.example.com/cb", "https://b.example.com/cb"}, l)
+
+	v, err := l.Value()
+	require.NoError(t, err)
+	assert.Equal(t, "https://a.example.com/cb https://b.example.com/cb", v)
+}
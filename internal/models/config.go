@@ -0,0 +1,489 @@
+package models
+
+import (
+	"crypto"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"gorm.io/gorm"
+)
+
+// Config holds the settings used to tune the behaviour of the services in this package. The zero value
+// is a valid configuration that keeps every optional feature disabled.
+type Config struct {
+	// AccessTokenGrace is the extra time an access token is still accepted after it has expired, so a
+	// request in flight with the old token succeeds while the client refreshes. Zero disables the grace.
+	AccessTokenGrace time.Duration
+
+	// Now returns the current time. It defaults to time.Now and is meant to be replaced in tests.
+	Now func() time.Time
+
+	// ClockSkew is the tolerance allowed when comparing the time claims of a token with the current
+	// time, accounting for clock differences between servers. Tokens issued further in the future are
+	// rejected. Zero uses the default leeway of one minute.
+	ClockSkew time.Duration
+
+	// ConsentTTL is how long the approval of a scope lasts before the user is prompted again. Zero keeps
+	// approvals valid forever.
+	ConsentTTL time.Duration
+
+	// ScopeConsentTTL overrides ConsentTTL for specific scopes, so sensitive scopes can be re-prompted
+	// more often. A zero value keeps the approval of the scope valid forever.
+	ScopeConsentTTL map[string]time.Duration
+
+	// ScopeTokenTTL is the maximum lifetime of the access tokens granting a scope, so tokens for
+	// sensitive scopes expire sooner. When a token grants several of them, the shortest applies. Scopes
+	// not present keep the lifetime of the client or the default one.
+	ScopeTokenTTL map[string]time.Duration
+
+	// MaxRefreshRotations is the number of times the refresh tokens descending from a login can be
+	// exchanged for new ones. Once reached, the user must login again. Zero allows unlimited rotations.
+	MaxRefreshRotations int
+
+	// RefreshScopeReauth honours the scope requested when rotating a refresh token: the same or a
+	// narrower scope is granted, and asking for scopes the refresh token was not granted returns
+	// ErrReauthRequired, so they take a fresh authorization. The requested scope is ignored otherwise.
+	RefreshScopeReauth bool
+
+	// MaxSessionLifetime is how long a session can last from the time the user authenticated, however
+	// its refresh tokens are rotated. Once over, refreshing returns ErrReauthRequired even with a refresh
+	// token not yet expired. Zero lets sessions last as long as they are refreshed.
+	MaxSessionLifetime time.Duration
+
+	// RefreshIdempotencyWindow is how long the tokens issued when rotating a refresh token are returned
+	// again to requests presenting the same refresh token, so retried requests do not rotate it once
+	// more. Zero disables it.
+	RefreshIdempotencyWindow time.Duration
+
+	// RefreshIdempotencyRecheck checks the refresh token again before returning the tokens already
+	// issued for it, so a session ended or a user disabled within the window is not answered with them.
+	RefreshIdempotencyRecheck bool
+
+	// UserCacheTTL is how long users looked up by ID, as done when validating tokens, are kept in
+	// memory. Updating or deleting a user invalidates its entry. Zero disables the cache.
+	UserCacheTTL time.Duration
+
+	// DeleteUserData removes the credentials and grants kept about the users when they are deleted: their
+	// MFA devices, security answers, API keys, consents and device authorizations. They are kept
+	// otherwise, unusable once the user is gone but still stored.
+	DeleteUserData bool
+
+	// AuditBatchSize is the number of audit events buffered before they are written together. Values
+	// lower than two write every event as it is recorded.
+	AuditBatchSize int
+
+	// AuditFlushInterval is the maximum time buffered audit events wait before being written. Zero
+	// only writes them when the batch is full or the service is closed.
+	AuditFlushInterval time.Duration
+
+	// AuditRetention bounds the audit events kept for each user. The events beyond it are deleted by
+	// AuditService.Prune, called every AuditPruneInterval when it is not zero.
+	AuditRetention     AuditRetention
+	AuditPruneInterval time.Duration
+
+	// ActionTokenMaxAge is the maximum age of the verification, reset and magic link tokens, by purpose,
+	// measured from the time they were issued. It is checked on top of the token expiry, so shortening
+	// it also applies to the tokens already sent. Purposes not present only check the expiry.
+	ActionTokenMaxAge map[string]time.Duration
+
+	// MaxActionTokens is the maximum number of outstanding single use tokens, that is unused and
+	// unexpired, a user can have by purpose. Issuing a new token invalidates the oldest ones beyond the
+	// maximum. Purposes not present are unlimited.
+	MaxActionTokens map[string]int
+
+	// MaxAPIKeys is the maximum number of active API keys a user can have. Revoked keys do not count.
+	// Zero allows any number of keys.
+	MaxAPIKeys int
+
+	// BreachChecker, when set, is used to reject passwords known to have been breached when they are
+	// set or changed. Passwords are accepted if the checker fails, so its availability does not
+	// prevent users from signing up.
+	BreachChecker BreachChecker
+
+	// PasswordRequireDigit rejects passwords without any digit when they are set or changed.
+	PasswordRequireDigit bool
+
+	// PasswordCost is the bcrypt cost the passwords are hashed with. Changing it only applies to the
+	// passwords set from then on. Zero uses a cost of 12.
+	PasswordCost int
+
+	// MFAMaxAttempts is the number of consecutive failed MFA codes after which the MFA step of the user
+	// is locked for MFALockout. Zero disables the lockout.
+	MFAMaxAttempts int
+	MFALockout     time.Duration
+
+	// MFAMinSecretBytes is the minimum length in bytes of the TOTP secrets enrolled, once base32 decoded.
+	// Zero uses 16 bytes, the minimum allowed by RFC 4226.
+	MFAMinSecretBytes int
+
+	// MaxMFADevices is the maximum number of MFA devices a user can enroll. Zero is unlimited.
+	MaxMFADevices int
+
+	// MFARequired makes multi-factor authentication mandatory, so users cannot remove their last MFA
+	// device.
+	MFARequired bool
+
+	// OTPSendInterval is the minimum time between the codes sent to a user, by email or SMS, so the
+	// service cannot be used to flood the inbox or phone of someone. Challenges requested sooner are not
+	// issued. Zero allows sending codes at any time.
+	OTPSendInterval time.Duration
+
+	// MFATrustDuration is how long a device the user chose to trust after completing the MFA step skips
+	// it. Zero disables trusting devices.
+	MFATrustDuration time.Duration
+
+	// SignupEmailDomains, when not empty, only lets users sign up with an email address of these domains.
+	// An entry starting with "*." allows any subdomain of the domain that follows, but not the domain
+	// itself. Existing users keep their address whatever the domains.
+	SignupEmailDomains []string
+
+	// DisposableChecker, when set, is used to reject signups with the addresses of disposable email
+	// services. Addresses are accepted if the checker fails.
+	DisposableChecker DisposableChecker
+
+	// CanonicalEmails maps email domains to the way their addresses are canonicalised, so variants of an
+	// address, like plus-addressed ones, cannot sign up as different users. Users keep the address they
+	// gave. Empty only rejects exact duplicates.
+	CanonicalEmails map[string]EmailCanonicalisation
+
+	// TokenFeatureFlags includes the features enabled for the users in their access tokens, so the
+	// services receiving them can gate features without looking the users up.
+	TokenFeatureFlags bool
+
+	// TokenIDInResponse sends the jti of the access tokens, their unique identifier, in the token
+	// responses, so clients can deduplicate or track the tokens without decoding them.
+	TokenIDInResponse bool
+
+	// SigningAlgorithm is the algorithm the access and refresh tokens are signed with: SigningHS512, the
+	// default, signs them with the JWT secret; SigningES256 and SigningEdDSA sign them with SigningKey,
+	// an *ecdsa.PrivateKey on the P-256 curve or an ed25519.PrivateKey, whose public key is published so
+	// other services can verify the tokens.
+	SigningAlgorithm string
+	SigningKey       crypto.Signer
+
+	// Issuer is the URL the service is reached at by OpenID Connect clients, such as
+	// "https://auth.example.com/api". It is the iss claim of the ID tokens, and the issuer of the
+	// discovery document. Empty issues the ID tokens as goauthsvcid.
+	Issuer string
+
+	// EnumerationSafe makes the services respond the same way, and in a similar time, whether an
+	// account exists or not, so their responses cannot be used to find out registered emails.
+	EnumerationSafe bool
+
+	// Notifier delivers the messages sent to users, such as password reset links. Password resets are
+	// not available when it is nil.
+	Notifier Notifier
+
+	// ResetAutoLogin logs users in after they reset their password, returning a new set of tokens
+	// instead of requiring a fresh login with the new password. It applies to account recoveries too.
+	ResetAutoLogin bool
+
+	// RecoveryQuestions is the minimum number of security questions users set to recover their account
+	// without MFA. All the questions they set are asked after the emailed recovery token is used. Zero
+	// disables the questions, so the emailed token is enough.
+	RecoveryQuestions int
+
+	// RecoveryMaxAttempts is the number of wrong answers to the security questions after which the
+	// account recovery of the user is locked for RecoveryLockout. Zero uses three attempts and one day.
+	RecoveryMaxAttempts int
+	RecoveryLockout     time.Duration
+
+	// LogoutNotifier sends back-channel logout tokens to the clients registering a back-channel logout
+	// URI when users log out. Nil disables back-channel logout.
+	LogoutNotifier LogoutNotifier
+
+	// DistinctTokenErrors makes access token validation return ErrTokenExpired for genuine tokens that
+	// expired, so clients know to refresh them, and ErrInvalidToken for any other rejected token. Both
+	// are reported as ErrUnauthorised otherwise. Expiry is only checked once the signature is verified,
+	// so forged tokens cannot be told apart from unknown ones.
+	DistinctTokenErrors bool
+
+	// ClaimsValidator, when set, enforces custom rules on the claims of the access tokens once they are
+	// validated by the service.
+	ClaimsValidator ClaimsValidator
+
+	// RejectDisabledClients looks up the client the tokens were issued through when they are validated
+	// or refreshed, rejecting the tokens of the clients disabled or deleted since with ErrClientDisabled.
+	RejectDisabledClients bool
+
+	// GlobalFailureRate is the share of failed logins, from 0 to 1, across the whole service within
+	// GlobalFailureWindow over which the service is considered under attack. Logins are then slowed
+	// down by GlobalFrictionDelay until the rate goes back down. Zero disables the global reputation.
+	GlobalFailureRate float64
+
+	// GlobalFailureWindow is the period the failure rate is measured over. Zero uses one minute.
+	GlobalFailureWindow time.Duration
+
+	// GlobalFailureMinAttempts is the number of logins needed within the window before the failure rate
+	// is considered, so a few failures on an idle service do not raise the friction.
+	GlobalFailureMinAttempts int
+
+	// GlobalFrictionDelay is the extra time every login takes while the failure rate is over the threshold.
+	GlobalFrictionDelay time.Duration
+
+	// MaxConcurrentLogins is the number of logins of the same user, identified by the email address they
+	// log in with, processed at once by an instance of the service. Logins over it fail right away with
+	// ErrTooManyConcurrentLogins, so credentials shared by many clients cannot tie up the service hashing
+	// the same password. Zero is unlimited.
+	MaxConcurrentLogins int
+
+	// StoreFailurePolicy decides how access token validations behave when the store cannot be read to
+	// check the user and the revocations. StoreFailClosed, used when empty, rejects the tokens, while
+	// StoreFailOpen accepts the ones with a valid signature and expiry for up to StoreFailOpenWindow from
+	// the start of the outage. Refreshes and logins always fail closed.
+	StoreFailurePolicy string
+
+	// StoreFailOpenWindow is how long validations fail open once the store starts failing. Zero uses one
+	// minute.
+	StoreFailOpenWindow time.Duration
+
+	// Audit, when set, records the security relevant events noticed by the services, such as the tokens
+	// accepted while failing open.
+	Audit AuditService
+
+	// StoreBreakerThreshold is the number of consecutive failed calls to the user store, which also
+	// holds the token revocations, after which calls fail fast with ErrServiceUnavailable for
+	// StoreBreakerCooldown. A single call then probes the store, closing the breaker if it succeeds.
+	// Zero disables the breaker.
+	StoreBreakerThreshold int
+
+	// StoreBreakerCooldown is how long the breaker stays open before probing the store. Zero uses thirty
+	// seconds.
+	StoreBreakerCooldown time.Duration
+
+	// TokenShards, when set, are the databases the token revocations are spread across instead of being
+	// kept along with the users, so the revocations of a user are all in the same shard. The shard of a
+	// user is picked by ShardResolver, or by JumpHashResolver when it is nil. The shards must be migrated
+	// like the main database, and the revocations recorded before sharding are not moved to them.
+	TokenShards   []*gorm.DB
+	ShardResolver ShardResolver
+
+	// DevicePollInterval is the minimum time devices must wait between polls of the token endpoint in
+	// the device authorization grant. Devices polling faster get a slow_down error and must add five
+	// seconds to their interval from then on. Zero uses five seconds.
+	DevicePollInterval time.Duration
+
+	// MaxDeviceCodes is the maximum number of outstanding device codes a client can have, that is codes
+	// not expired whose tokens have not been handed out. Requests for more codes are rejected until
+	// some expire or complete. Zero is unlimited.
+	MaxDeviceCodes int
+}
+
+// ConfigErrors lists the invalid or dangerous settings found in a Config by Validate.
+type ConfigErrors []string
+
+// Error returns the problems found, separated by semicolons.
+func (e ConfigErrors) Error() string {
+	return "models: invalid configuration: " + strings.Join(e, "; ")
+}
+
+// Validate checks the settings of c, so misconfigurations are reported at startup instead of on the
+// first requests. It returns a ConfigErrors listing every invalid, conflicting or dangerous setting
+// found, or nil when there is none.
+func (c Config) Validate() error {
+	var errs ConfigErrors
+
+	// the signing key must match the algorithm, and is unused by HS512, signing with the JWT secret.
+	if c.SigningAlgorithm == "" || c.SigningAlgorithm == SigningHS512 {
+		if c.SigningKey != nil {
+			errs = append(errs, "SigningKey is set but unused by the HS512 SigningAlgorithm")
+		}
+	} else if _, err := newTokenKeys(nil, c); err != nil {
+		errs = append(errs, strings.TrimPrefix(err.Error(), "models: "))
+	}
+
+	durations := map[string]time.Duration{
+		"AccessTokenGrace":         c.AccessTokenGrace,
+		"ClockSkew":                c.ClockSkew,
+		"ConsentTTL":               c.ConsentTTL,
+		"UserCacheTTL":             c.UserCacheTTL,
+		"RefreshIdempotencyWindow": c.RefreshIdempotencyWindow,
+		"MaxSessionLifetime":       c.MaxSessionLifetime,
+		"AuditFlushInterval":       c.AuditFlushInterval,
+		"AuditRetention.MaxAge":    c.AuditRetention.MaxAge,
+		"AuditPruneInterval":       c.AuditPruneInterval,
+		"MFALockout":               c.MFALockout,
+		"OTPSendInterval":          c.OTPSendInterval,
+		"MFATrustDuration":         c.MFATrustDuration,
+		"RecoveryLockout":          c.RecoveryLockout,
+		"GlobalFailureWindow":      c.GlobalFailureWindow,
+		"GlobalFrictionDelay":      c.GlobalFrictionDelay,
+		"StoreFailOpenWindow":      c.StoreFailOpenWindow,
+		"StoreBreakerCooldown":     c.StoreBreakerCooldown,
+		"DevicePollInterval":       c.DevicePollInterval,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			errs = append(errs, fmt.Sprintf("%s is negative", name))
+		}
+	}
+
+	counts := map[string]int{
+		"MaxRefreshRotations":      c.MaxRefreshRotations,
+		"MaxConcurrentLogins":      c.MaxConcurrentLogins,
+		"AuditRetention.MaxEvents": c.AuditRetention.MaxEvents,
+		"MaxAPIKeys":               c.MaxAPIKeys,
+		"MFAMaxAttempts":           c.MFAMaxAttempts,
+		"MaxMFADevices":            c.MaxMFADevices,
+		"RecoveryQuestions":        c.RecoveryQuestions,
+		"GlobalFailureMinAttempts": c.GlobalFailureMinAttempts,
+		"StoreBreakerThreshold":    c.StoreBreakerThreshold,
+		"MaxDeviceCodes":           c.MaxDeviceCodes,
+	}
+	for name, n := range counts {
+		if n < 0 {
+			errs = append(errs, fmt.Sprintf("%s is negative", name))
+		}
+	}
+
+	// zero lifetimes do not disable anything: zero token TTLs are ignored, and zero maximum ages reject
+	// every token of the purpose.
+	for scope, ttl := range c.ScopeTokenTTL {
+		if ttl <= 0 {
+			errs = append(errs, fmt.Sprintf("ScopeTokenTTL of scope %q is not positive", scope))
+		}
+	}
+	for purpose, age := range c.ActionTokenMaxAge {
+		if age <= 0 {
+			errs = append(errs, fmt.Sprintf("ActionTokenMaxAge of purpose %q is not positive", purpose))
+		}
+	}
+
+	if c.AccessTokenGrace >= jwtAccessDuration {
+		errs = append(errs, fmt.Sprintf("AccessTokenGrace is not shorter than the access token lifetime of %s", jwtAccessDuration))
+	}
+	if c.MFAMaxAttempts > 0 && c.MFALockout <= 0 {
+		errs = append(errs, "MFAMaxAttempts is set but MFALockout is not positive, so the MFA step is never locked")
+	}
+	if c.MFAMinSecretBytes > 0 && c.MFAMinSecretBytes < defaultMFAMinSecretBytes {
+		errs = append(errs, fmt.Sprintf("MFAMinSecretBytes is lower than the %d bytes required by RFC 4226", defaultMFAMinSecretBytes))
+	}
+	if c.PasswordCost != 0 && c.PasswordCost < minPasswordCost {
+		errs = append(errs, fmt.Sprintf("PasswordCost is lower than the bcrypt cost of %d", minPasswordCost))
+	}
+	if c.PasswordCost > bcrypt.MaxCost {
+		errs = append(errs, fmt.Sprintf("PasswordCost is higher than the maximum bcrypt cost of %d", bcrypt.MaxCost))
+	}
+	if c.StoreFailurePolicy != "" && c.StoreFailurePolicy != StoreFailClosed && c.StoreFailurePolicy != StoreFailOpen {
+		errs = append(errs, fmt.Sprintf("StoreFailurePolicy %q is neither %q nor %q", c.StoreFailurePolicy, StoreFailClosed, StoreFailOpen))
+	}
+	if c.GlobalFailureRate < 0 || c.GlobalFailureRate > 1 {
+		errs = append(errs, "GlobalFailureRate is not between 0 and 1")
+	}
+	if c.AuditPruneInterval > 0 && c.AuditRetention.MaxEvents == 0 && c.AuditRetention.MaxAge == 0 {
+		errs = append(errs, "AuditPruneInterval is set but AuditRetention keeps every event, so nothing is pruned")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	// the settings are checked from maps, so the problems are sorted to be reported in a stable order.
+	sort.Strings(errs)
+	return errs
+}
+
+// now returns the current time in UTC, as reported by c.Now when set.
+func (c Config) now() time.Time {
+	if c.Now != nil {
+		return c.Now().UTC()
+	}
+
+	return time.Now().UTC()
+}
+
+// issuer returns the iss claim of the ID tokens, the configured issuer or the default one.
+func (c Config) issuer() string {
+	if c.Issuer == "" {
+		return tokenClaimsIssuerID
+	}
+
+	return c.Issuer
+}
+
+// clockSkew returns the configured clock skew, or the default leeway when none is set.
+func (c Config) clockSkew() time.Duration {
+	if c.ClockSkew == 0 {
+		return jwt.DefaultLeeway
+	}
+
+	return c.ClockSkew
+}
+
+// storeFailOpenWindow returns the configured fail open window, or the default one when none is set.
+func (c Config) storeFailOpenWindow() time.Duration {
+	if c.StoreFailOpenWindow == 0 {
+		return defaultStoreFailOpenWindow
+	}
+
+	return c.StoreFailOpenWindow
+}
+
+// devicePollInterval returns the configured device poll interval, or the default one when none is set.
+func (c Config) devicePollInterval() time.Duration {
+	if c.DevicePollInterval <= 0 {
+		return defaultDevicePollInterval
+	}
+
+	return c.DevicePollInterval
+}
+
+// passwordCost returns the configured bcrypt cost of the passwords, or the default one when none is set.
+func (c Config) passwordCost() int {
+	if c.PasswordCost <= 0 {
+		return defaultPasswordCost
+	}
+
+	return c.PasswordCost
+}
+
+// mfaMinSecretBytes returns the configured minimum TOTP secret length, or the default one when none is set.
+func (c Config) mfaMinSecretBytes() int {
+	if c.MFAMinSecretBytes <= 0 {
+		return defaultMFAMinSecretBytes
+	}
+
+	return c.MFAMinSecretBytes
+}
+
+// recoveryMaxAttempts returns the configured maximum recovery attempts, or the default one when none is set.
+func (c Config) recoveryMaxAttempts() int {
+	if c.RecoveryMaxAttempts <= 0 {
+		return defaultRecoveryMaxAttempts
+	}
+
+	return c.RecoveryMaxAttempts
+}
+
+// recoveryLockout returns the configured recovery lockout, or the default one when none is set.
+func (c Config) recoveryLockout() time.Duration {
+	if c.RecoveryLockout <= 0 {
+		return defaultRecoveryLockout
+	}
+
+	return c.RecoveryLockout
+}
+
+// scopeTokenTTL returns the access token lifetime ttl, capped by the lifetimes configured for scopes.
+func (c Config) scopeTokenTTL(ttl time.Duration, scopes []string) time.Duration {
+	for _, s := range scopes {
+		if max, ok := c.ScopeTokenTTL[s]; ok && max > 0 && max < ttl {
+			ttl = max
+		}
+	}
+
+	return ttl
+}
+
+// consentTTL returns the consent TTL applying to scope.
+func (c Config) consentTTL(scope string) time.Duration {
+	if ttl, ok := c.ScopeConsentTTL[scope]; ok {
+		return ttl
+	}
+
+	return c.ConsentTTL
+}
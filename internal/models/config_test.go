@@ -0,0 +1,126 @@
+package models
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name      string
+		cfg       Config
+		outErrors ConfigErrors
+	}{
+		{"zero", Config{}, nil},
+		{
+			"valid",
+			Config{
+				SigningAlgorithm:   SigningES256,
+				SigningKey:         ecKey,
+				AccessTokenGrace:   30 * time.Second,
+				ScopeTokenTTL:      map[string]time.Duration{"admin": 5 * time.Minute},
+				ActionTokenMaxAge:  map[string]time.Duration{PurposeReset: time.Hour},
+				MFAMaxAttempts:     5,
+				MFALockout:         15 * time.Minute,
+				MFAMinSecretBytes:  20,
+				PasswordCost:       12,
+				StoreFailurePolicy: StoreFailOpen,
+				GlobalFailureRate:  0.5,
+				AuditRetention:     AuditRetention{MaxEvents: 100},
+				AuditPruneInterval: time.Hour,
+			},
+			nil,
+		},
+		{
+			"signing",
+			Config{SigningAlgorithm: SigningEdDSA, SigningKey: ecKey},
+			ConfigErrors{"EdDSA requires an Ed25519 signing key"},
+		},
+		{
+			"unusedSigningKey",
+			Config{SigningKey: edKey},
+			ConfigErrors{"SigningKey is set but unused by the HS512 SigningAlgorithm"},
+		},
+		{
+			"unsupportedAlgorithm",
+			Config{SigningAlgorithm: "none"},
+			ConfigErrors{`unsupported signing algorithm "none"`},
+		},
+		{
+			"negative",
+			Config{ClockSkew: -time.Minute, MaxAPIKeys: -1},
+			ConfigErrors{"ClockSkew is negative", "MaxAPIKeys is negative"},
+		},
+		{
+			"zeroTTLs",
+			Config{
+				ScopeTokenTTL:     map[string]time.Duration{"admin": 0},
+				ActionTokenMaxAge: map[string]time.Duration{PurposeReset: 0},
+			},
+			ConfigErrors{
+				`ActionTokenMaxAge of purpose "reset" is not positive`,
+				`ScopeTokenTTL of scope "admin" is not positive`,
+			},
+		},
+		{
+			"conflicting",
+			Config{
+				AccessTokenGrace:   7 * time.Hour,
+				MFAMaxAttempts:     5,
+				AuditPruneInterval: time.Hour,
+			},
+			ConfigErrors{
+				"AccessTokenGrace is not shorter than the access token lifetime of 6h0m0s",
+				"AuditPruneInterval is set but AuditRetention keeps every event, so nothing is pruned",
+				"MFAMaxAttempts is set but MFALockout is not positive, so the MFA step is never locked",
+			},
+		},
+		{
+			"dangerous",
+			Config{
+				MFAMinSecretBytes:  8,
+				StoreFailurePolicy: "fail_sometimes",
+				GlobalFailureRate:  2,
+			},
+			ConfigErrors{
+				"GlobalFailureRate is not between 0 and 1",
+				"MFAMinSecretBytes is lower than the 16 bytes required by RFC 4226",
+				`StoreFailurePolicy "fail_sometimes" is neither "fail_closed" nor "fail_open"`,
+			},
+		},
+		{
+			"lowPasswordCost",
+			Config{PasswordCost: 4},
+			ConfigErrors{"PasswordCost is lower than the bcrypt cost of 10"},
+		},
+		{
+			"highPasswordCost",
+			Config{PasswordCost: 32},
+			ConfigErrors{"PasswordCost is higher than the maximum bcrypt cost of 31"},
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			err := cs.cfg.Validate()
+			if cs.outErrors == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.IsType(t, ConfigErrors{}, err)
+			assert.Equal(t, cs.outErrors, err)
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ConsentService defines a set of methods to be used when dealing with the scopes users have agreed to
+// grant to the OAuth clients.
+type ConsentService interface {
+	// Grant records that the user approved the scopes for the client, restarting their consent TTL.
+	Grant(ctx context.Context, userID int64, clientID string, scopes ...string) error
+
+	// Pending returns the subset of scopes the user must be prompted for before the client is granted
+	// them: those never approved and those whose approval is older than the consent TTL of the scope.
+	Pending(ctx context.Context, userID int64, clientID string, scopes ...string) ([]string, error)
+
+	// Authorizations returns the clients the user has approved, with the scopes granted to each of
+	// them, sorted by client ID.
+	Authorizations(ctx context.Context, userID int64) ([]Authorization, error)
+
+	// Revoke removes the approvals the user has given to the client. Tokens already issued are not
+	// affected: use UserService.RevokeClient to invalidate them.
+	//
+	// It returns ErrNotFound if the user has not approved the client.
+	Revoke(ctx context.Context, userID int64, clientID string) error
+
+	ConsentDB
+}
+
+// ConsentDB defines how the service interacts with the database.
+type ConsentDB interface {
+	// Save creates or replaces the consent for the same user, client and scope.
+	Save(context.Context, *Consent) error
+
+	// ByUserClient retrieves the consents a user has given to a client.
+	ByUserClient(context.Context, int64, string) ([]Consent, error)
+
+	// ByUser retrieves the consents a user has given to any client.
+	ByUser(context.Context, int64) ([]Consent, error)
+
+	// DeleteUserClient removes the consents a user has given to a client. It returns ErrNotFound if
+	// there are none.
+	DeleteUserClient(context.Context, int64, string) error
+}
+
+// A Consent represents the approval given by a user for a client to be granted a scope.
+type Consent struct {
+	UserID   int64  `gorm:"primary_key;autoIncrement:false" json:"user_id"`
+	ClientID string `gorm:"primary_key;size:255" json:"client_id"`
+	Scope    string `gorm:"primary_key;size:255" json:"scope"`
+
+	// GrantedAt is the time the user last approved the scope.
+	GrantedAt time.Time `gorm:"not null" json:"granted_at"`
+}
+
+// An Authorization summarises the consents a user has given to a client.
+type Authorization struct {
+	ClientID string   `json:"client_id"`
+	Scopes   []string `json:"scopes"`
+
+	// GrantedAt is the time the user last approved any of the scopes.
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+type consentService struct {
+	ConsentDB
+
+	cfg Config
+}
+
+// NewConsentService instantiates a new ConsentService implementation with db as the backing database.
+// Consent TTLs are taken from cfg.
+func NewConsentService(db *gorm.DB, cfg Config) ConsentService {
+	return &consentService{
+		ConsentDB: &consentGorm{db},
+		cfg:       cfg,
+	}
+}
+
+func (cs *consentService) Grant(ctx context.Context, userID int64, clientID string, scopes ...string) error {
+	ctx, span := trace.StartSpan(ctx, "models.ConsentService.Grant")
+	defer span.End()
+
+	now := cs.cfg.now()
+	for _, s := range scopes {
+		err := cs.ConsentDB.Save(ctx, &Consent{
+			UserID:    userID,
+			ClientID:  clientID,
+			Scope:     s,
+			GrantedAt: now,
+		})
+		if err != nil {
+			return wrap("on grant, failed to save consent", err)
+		}
+	}
+
+	return nil
+}
+
+func (cs *consentService) Pending(ctx context.Context, userID int64, clientID string, scopes ...string) ([]string, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ConsentService.Pending")
+	defer span.End()
+
+	consents, err := cs.ConsentDB.ByUserClient(ctx, userID, clientID)
+	if err != nil {
+		return nil, wrap("on pending, failed to obtain consents from database", err)
+	}
+
+	granted := make(map[string]time.Time, len(consents))
+	for _, c := range consents {
+		granted[c.Scope] = c.GrantedAt
+	}
+
+	now := cs.cfg.now()
+	var pending []string
+	for _, s := range scopes {
+		at, ok := granted[s]
+		if !ok {
+			pending = append(pending, s)
+			continue
+		}
+
+		if ttl := cs.cfg.consentTTL(s); ttl > 0 && now.After(at.Add(ttl)) {
+			pending = append(pending, s)
+		}
+	}
+
+	return pending, nil
+}
+
+func (cs *consentService) Authorizations(ctx context.Context, userID int64) ([]Authorization, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ConsentService.Authorizations")
+	defer span.End()
+
+	consents, err := cs.ConsentDB.ByUser(ctx, userID)
+	if err != nil {
+		return nil, wrap("on authorizations, failed to obtain consents from database", err)
+	}
+
+	byClient := make(map[string]*Authorization)
+	for _, c := range consents {
+		a, ok := byClient[c.ClientID]
+		if !ok {
+			a = &Authorization{ClientID: c.ClientID}
+			byClient[c.ClientID] = a
+		}
+
+		a.Scopes = append(a.Scopes, c.Scope)
+		if c.GrantedAt.After(a.GrantedAt) {
+			a.GrantedAt = c.GrantedAt
+		}
+	}
+
+	auths := make([]Authorization, 0, len(byClient))
+	for _, a := range byClient {
+		sort.Strings(a.Scopes)
+		auths = append(auths, *a)
+	}
+
+	sort.Slice(auths, func(i, j int) bool {
+		return auths[i].ClientID < auths[j].ClientID
+	})
+
+	return auths, nil
+}
+
+func (cs *consentService) Revoke(ctx context.Context, userID int64, clientID string) error {
+	ctx, span := trace.StartSpan(ctx, "models.ConsentService.Revoke")
+	defer span.End()
+
+	err := cs.ConsentDB.DeleteUserClient(ctx, userID, clientID)
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return ErrNotFound
+		}
+
+		return wrap("on revoke, failed to delete consents", err)
+	}
+
+	return nil
+}
+
+type consentGorm struct {
+	db *gorm.DB
+}
+
+func (cg *consentGorm) Save(ctx context.Context, c *Consent) error {
+	ctx, span := trace.StartSpan(ctx, "consent.Database.Save")
+	defer span.End()
+
+	err := cg.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(c).Error
+	if err != nil {
+		return wrap("could not save consent", err)
+	}
+
+	return nil
+}
+
+func (cg *consentGorm) ByUserClient(ctx context.Context, userID int64, clientID string) ([]Consent, error) {
+	ctx, span := trace.StartSpan(ctx, "consent.Database.ByUserClient")
+	defer span.End()
+
+	var consents []Consent
+	err := cg.db.WithContext(ctx).Where("user_id = ? AND client_id = ?", userID, clientID).Find(&consents).Error
+	if err != nil {
+		return nil, wrap("could not get consents by user and client", err)
+	}
+
+	return consents, nil
+}
+
+func (cg *consentGorm) ByUser(ctx context.Context, userID int64) ([]Consent, error) {
+	ctx, span := trace.StartSpan(ctx, "consent.Database.ByUser")
+	defer span.End()
+
+	var consents []Consent
+	err := cg.db.WithContext(ctx).Where("user_id = ?", userID).Find(&consents).Error
+	if err != nil {
+		return nil, wrap("could not get consents by user", err)
+	}
+
+	return consents, nil
+}
+
+func (cg *consentGorm) DeleteUserData(ctx context.Context, userID int64) error {
+	ctx, span := trace.StartSpan(ctx, "consent.Database.DeleteUserData")
+	defer span.End()
+
+	err := cg.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&Consent{}).Error
+	if err != nil {
+		return wrap("could not delete consents of user", err)
+	}
+
+	return nil
+}
+
+func (cg *consentGorm) DeleteUserClient(ctx context.Context, userID int64, clientID string) error {
+	ctx, span := trace.StartSpan(ctx, "consent.Database.DeleteUserClient")
+	defer span.End()
+
+	res := cg.db.WithContext(ctx).Where("user_id = ? AND client_id = ?", userID, clientID).Delete(&Consent{})
+	if res.Error != nil {
+		return wrap("could not delete consents by user and client", res.Error)
+
+	} else if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConsentDB struct {
+	ConsentDB
+	consents []Consent
+}
+
+func (t *testConsentDB) Save(ctx context.Context, c *Consent) error {
+	for i := range t.consents {
+		if t.consents[i].UserID == c.UserID && t.consents[i].ClientID == c.ClientID && t.consents[i].Scope == c.Scope {
+			t.consents[i] = *c
+			return nil
+		}
+	}
+
+	t.consents = append(t.consents, *c)
+	return nil
+}
+
+func (t *testConsentDB) ByUserClient(ctx context.Context, userID int64, clientID string) ([]Consent, error) {
+	var ret []Consent
+	for _, c := range t.consents {
+		if c.UserID == userID && c.ClientID == clientID {
+			ret = append(ret, c)
+		}
+	}
+
+	return ret, nil
+}
+
+func (t *testConsentDB) ByUser(ctx context.Context, userID int64) ([]Consent, error) {
+	var ret []Consent
+	for _, c := range t.consents {
+		if c.UserID == userID {
+			ret = append(ret, c)
+		}
+	}
+
+	return ret, nil
+}
+
+func (t *testConsentDB) DeleteUserClient(ctx context.Context, userID int64, clientID string) error {
+	var kept []Consent
+	for _, c := range t.consents {
+		if c.UserID != userID || c.ClientID != clientID {
+			kept = append(kept, c)
+		}
+	}
+
+	if len(kept) == len(t.consents) {
+		return ErrNotFound
+	}
+
+	t.consents = kept
+	return nil
+}
+
+func TestConsentService_Pending(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	svc := NewConsentService(nil, Config{
+		Now:        func() time.Time { return now },
+		ConsentTTL: 30 * 24 * time.Hour,
+		ScopeConsentTTL: map[string]time.Duration{
+			"admin":   time.Hour,
+			"profile": 0,
+		},
+	})
+	svc.(*consentService).ConsentDB = &testConsentDB{}
+
+	pending, err := svc.Pending(ctx, 1, "web-app", "admin", "profile", "email")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admin", "profile", "email"}, pending, "nothing granted yet")
+
+	require.NoError(t, svc.Grant(ctx, 1, "web-app", "admin", "profile", "email"))
+
+	var cases = []struct {
+		name    string
+		elapsed time.Duration
+		out     []string
+	}{
+		{"withinAllTTLs", 30 * time.Minute, nil},
+		{"sensitiveExpired", 2 * time.Hour, []string{"admin"}},
+		{"defaultExpired", 31 * 24 * time.Hour, []string{"admin", "email"}},
+		{"infiniteNeverExpires", 10 * 365 * 24 * time.Hour, []string{"admin", "email"}},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			svc.(*consentService).cfg.Now = func() time.Time { return now.Add(cs.elapsed) }
+
+			pending, err := svc.Pending(ctx, 1, "web-app", "admin", "profile", "email")
+
+			assert.NoError(t, err)
+			assert.Equal(t, cs.out, pending)
+		})
+	}
+
+	t.Run("otherClient", func(t *testing.T) {
+		svc.(*consentService).cfg.Now = func() time.Time { return now }
+
+		pending, err := svc.Pending(ctx, 1, "other-app", "email")
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"email"}, pending)
+	})
+
+	t.Run("regrantRestartsTTL", func(t *testing.T) {
+		later := now.Add(2 * time.Hour)
+		svc.(*consentService).cfg.Now = func() time.Time { return later }
+		require.NoError(t, svc.Grant(ctx, 1, "web-app", "admin"))
+
+		pending, err := svc.Pending(ctx, 1, "web-app", "admin")
+
+		assert.NoError(t, err)
+		assert.Empty(t, pending)
+	})
+}
+
+func TestConsentService_Authorizations(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	svc := NewConsentService(nil, Config{Now: func() time.Time { return now }})
+	svc.(*consentService).ConsentDB = &testConsentDB{}
+
+	require.NoError(t, svc.Grant(ctx, 88, "webapp", "profile", "email"))
+	require.NoError(t, svc.Grant(ctx, 99, "webapp", "profile"))
+	now = now.Add(time.Hour)
+	require.NoError(t, svc.Grant(ctx, 88, "calendar", "events"))
+	require.NoError(t, svc.Grant(ctx, 88, "webapp", "admin"))
+
+	auths, err := svc.Authorizations(ctx, 88)
+	require.NoError(t, err)
+	assert.Equal(t, []Authorization{
+		{ClientID: "calendar", Scopes: []string{"events"}, GrantedAt: now},
+		{ClientID: "webapp", Scopes: []string{"admin", "email", "profile"}, GrantedAt: now},
+	}, auths)
+
+	t.Run("revoke", func(t *testing.T) {
+		require.NoError(t, svc.Revoke(ctx, 88, "webapp"))
+
+		auths, err := svc.Authorizations(ctx, 88)
+		require.NoError(t, err)
+		assert.Equal(t, []Authorization{
+			{ClientID: "calendar", Scopes: []string{"events"}, GrantedAt: now},
+		}, auths)
+
+		// other users keep their approvals
+		auths, err = svc.Authorizations(ctx, 99)
+		require.NoError(t, err)
+		assert.Len(t, auths, 1)
+	})
+
+	t.Run("revokeNotApproved", func(t *testing.T) {
+		err := svc.Revoke(ctx, 88, "unknown")
+
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		auths, err := svc.Authorizations(ctx, 77)
+		require.NoError(t, err)
+		assert.Empty(t, auths)
+	})
+}
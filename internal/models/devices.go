@@ -0,0 +1,448 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+const (
+	// deviceCodeDuration is the time a user has to approve a device once its codes are issued.
+	deviceCodeDuration = 10 * time.Minute
+
+	// defaultDevicePollInterval is the minimum time devices must wait between polls when none is
+	// configured, and deviceSlowDownStep the amount it is increased by each time a device polls too
+	// fast, as required by RFC 8628.
+	defaultDevicePollInterval = 5 * time.Second
+	deviceSlowDownStep        = 5 * time.Second
+
+	// userCodeAlphabet holds the characters used for user codes: consonants only, so codes are easy to
+	// type on a different device and cannot spell words.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// These are the states of a device authorization.
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusDenied   = "denied"
+)
+
+// DeviceService defines a set of methods to be used when dealing with the device authorization grant
+// (RFC 8628), used by input constrained devices to obtain tokens once a user approves them from another
+// device.
+type DeviceService interface {
+	// Authorize starts the authorization of a device for the client, returning the device code the
+	// device polls with and the user code the user enters to approve it. The device code is only
+	// returned here, as the system only stores its hash.
+	//
+	// It returns ErrTooManyDeviceCodes if the client already has the maximum number of outstanding
+	// device codes: those not expired whose tokens have not been handed out yet.
+	Authorize(ctx context.Context, clientID, scope string) (DeviceAuthorization, error)
+
+	// Approve grants the pending authorization with the user code to the user. Deny rejects it. User
+	// codes are matched ignoring case, spaces and dashes.
+	//
+	// Both return ErrNotFound if the user code is unknown, expired or already approved or denied.
+	Approve(ctx context.Context, userCode string, userID int64) error
+	Deny(ctx context.Context, userCode string, userID int64) error
+
+	// Poll checks the state of the authorization with the device code issued to the client. Once it is
+	// approved, the authorization is returned and the device code cannot be used again.
+	//
+	// It returns ErrAuthorizationPending while the user has not decided, ErrSlowDown if the device
+	// polls before the interval has passed, ErrAccessDenied if the user denied it, ErrDeviceCodeExpired
+	// if the user took too long, and ErrInvalidDeviceCode if the device code is unknown or was issued
+	// to another client.
+	Poll(ctx context.Context, deviceCode, clientID string) (DeviceAuthorization, error)
+
+	DeviceDB
+}
+
+// DeviceDB defines how the service interacts with the database.
+type DeviceDB interface {
+	// Create adds a device authorization to the system. The Hash field must already be set.
+	Create(context.Context, *DeviceAuthorization) error
+
+	// ByHash retrieves a device authorization by the hash of its device code.
+	ByHash(context.Context, string) (DeviceAuthorization, error)
+
+	// ByUserCode retrieves a device authorization by its user code.
+	ByUserCode(context.Context, string) (DeviceAuthorization, error)
+
+	// CountOutstanding returns the number of device authorizations of a client expiring after the given
+	// time.
+	CountOutstanding(context.Context, string, time.Time) (int, error)
+
+	// Update saves the changes to a device authorization.
+	Update(context.Context, *DeviceAuthorization) error
+
+	// Delete removes the device authorization with the given device code hash.
+	Delete(context.Context, string) error
+}
+
+// A DeviceAuthorization represents the request of a device to obtain tokens for the user approving it.
+type DeviceAuthorization struct {
+	// Hash is the hex encoded SHA-256 hash of the device code. Codes are random and long, so a slow
+	// hash is not required.
+	Hash string `gorm:"primary_key;size:64" json:"-"`
+
+	// DeviceCode is the code the device polls with. It is only set on the value returned by Authorize.
+	DeviceCode string `gorm:"-" json:"device_code,omitempty"`
+
+	UserCode string `gorm:"size:16;not null;unique" json:"user_code"`
+	ClientID string `gorm:"size:255;not null" json:"client_id"`
+	Scope    string `gorm:"size:1024" json:"scope,omitempty"`
+
+	// Status is one of DeviceStatusPending, DeviceStatusApproved or DeviceStatusDenied. UserID is set
+	// once the user decides.
+	Status string `gorm:"size:16;not null" json:"status"`
+	UserID int64  `json:"user_id,omitempty"`
+
+	// Interval is the minimum time the device must wait between polls. PolledAt is the time it last
+	// polled, if ever.
+	Interval time.Duration `gorm:"not null" json:"-"`
+	PolledAt *time.Time    `json:"-"`
+
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+
+	// ExpiresIn is the number of seconds the codes are valid for. It is only set on the value returned
+	// by Authorize.
+	ExpiresIn int64 `gorm:"-" json:"-"`
+}
+
+type deviceService struct {
+	DeviceDB
+
+	cfg Config
+}
+
+// NewDeviceService instantiates a new DeviceService implementation with db as the backing database.
+func NewDeviceService(db *gorm.DB, cfg Config) DeviceService {
+	return &deviceService{
+		DeviceDB: &deviceGorm{db},
+		cfg:      cfg,
+	}
+}
+
+func (ds *deviceService) Authorize(ctx context.Context, clientID, scope string) (DeviceAuthorization, error) {
+	ctx, span := trace.StartSpan(ctx, "models.DeviceService.Authorize")
+	defer span.End()
+
+	if clientID == "" {
+		return DeviceAuthorization{}, ValidationError{"client_id": ErrRequired}
+	}
+
+	now := ds.cfg.now()
+	if ds.cfg.MaxDeviceCodes > 0 {
+		n, err := ds.DeviceDB.CountOutstanding(ctx, clientID, now)
+		if err != nil {
+			return DeviceAuthorization{}, wrap("on authorize, failed to count outstanding device codes", err)
+		}
+
+		if n >= ds.cfg.MaxDeviceCodes {
+			return DeviceAuthorization{}, ErrTooManyDeviceCodes
+		}
+	}
+
+	code, err := randomToken(32)
+	if err != nil {
+		return DeviceAuthorization{}, err
+	}
+
+	userCode, err := randomUserCode()
+	if err != nil {
+		return DeviceAuthorization{}, err
+	}
+
+	da := DeviceAuthorization{
+		Hash:       hashDeviceCode(code),
+		DeviceCode: code,
+		UserCode:   userCode,
+		ClientID:   clientID,
+		Scope:      scope,
+		Status:     DeviceStatusPending,
+		Interval:   ds.cfg.devicePollInterval(),
+		ExpiresAt:  now.Add(deviceCodeDuration),
+		ExpiresIn:  int64(deviceCodeDuration.Seconds()),
+	}
+
+	if err := ds.DeviceDB.Create(ctx, &da); err != nil {
+		return DeviceAuthorization{}, wrap("on authorize, failed to create device authorization", err)
+	}
+
+	return da, nil
+}
+
+func (ds *deviceService) Approve(ctx context.Context, userCode string, userID int64) error {
+	ctx, span := trace.StartSpan(ctx, "models.DeviceService.Approve")
+	defer span.End()
+
+	return ds.decide(ctx, userCode, userID, DeviceStatusApproved)
+}
+
+func (ds *deviceService) Deny(ctx context.Context, userCode string, userID int64) error {
+	ctx, span := trace.StartSpan(ctx, "models.DeviceService.Deny")
+	defer span.End()
+
+	return ds.decide(ctx, userCode, userID, DeviceStatusDenied)
+}
+
+// decide records the decision of the user on the pending authorization with the user code.
+func (ds *deviceService) decide(ctx context.Context, userCode string, userID int64, status string) error {
+	userCode, ok := normalizeUserCode(userCode)
+	if !ok {
+		return ErrNotFound
+	}
+
+	da, err := ds.DeviceDB.ByUserCode(ctx, userCode)
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return ErrNotFound
+		}
+
+		return wrap("on decide, failed to obtain device authorization", err)
+	}
+
+	if da.Status != DeviceStatusPending || !ds.cfg.now().Before(da.ExpiresAt) {
+		return ErrNotFound
+	}
+
+	da.Status = status
+	da.UserID = userID
+	if err := ds.DeviceDB.Update(ctx, &da); err != nil {
+		return wrap("on decide, failed to update device authorization", err)
+	}
+
+	return nil
+}
+
+func (ds *deviceService) Poll(ctx context.Context, deviceCode, clientID string) (DeviceAuthorization, error) {
+	ctx, span := trace.StartSpan(ctx, "models.DeviceService.Poll")
+	defer span.End()
+
+	if deviceCode == "" {
+		return DeviceAuthorization{}, ErrInvalidDeviceCode
+	}
+
+	da, err := ds.DeviceDB.ByHash(ctx, hashDeviceCode(deviceCode))
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return DeviceAuthorization{}, ErrInvalidDeviceCode
+		}
+
+		return DeviceAuthorization{}, wrap("on poll, failed to obtain device authorization", err)
+	}
+
+	if da.ClientID != clientID {
+		return DeviceAuthorization{}, ErrInvalidDeviceCode
+	}
+
+	now := ds.cfg.now()
+	if !now.Before(da.ExpiresAt) {
+		if err := ds.DeviceDB.Delete(ctx, da.Hash); err != nil && !xerrors.Is(err, ErrNotFound) {
+			return DeviceAuthorization{}, wrap("on poll, failed to delete expired device authorization", err)
+		}
+
+		return DeviceAuthorization{}, ErrDeviceCodeExpired
+	}
+
+	// polling too fast is reported whatever the state of the authorization, so devices cannot get a
+	// decision sooner by ignoring the interval.
+	tooFast := da.PolledAt != nil && now.Before(da.PolledAt.Add(da.Interval))
+	da.PolledAt = &now
+	if tooFast {
+		da.Interval += deviceSlowDownStep
+		if err := ds.DeviceDB.Update(ctx, &da); err != nil {
+			return DeviceAuthorization{}, wrap("on poll, failed to update device authorization", err)
+		}
+
+		return DeviceAuthorization{}, ErrSlowDown
+	}
+
+	switch da.Status {
+	case DeviceStatusApproved, DeviceStatusDenied:
+		// the decision is only handed out once.
+		if err := ds.DeviceDB.Delete(ctx, da.Hash); err != nil {
+			if xerrors.Is(err, ErrNotFound) {
+				return DeviceAuthorization{}, ErrInvalidDeviceCode
+			}
+
+			return DeviceAuthorization{}, wrap("on poll, failed to delete device authorization", err)
+		}
+
+		if da.Status == DeviceStatusDenied {
+			return DeviceAuthorization{}, ErrAccessDenied
+		}
+
+		return da, nil
+
+	default:
+		if err := ds.DeviceDB.Update(ctx, &da); err != nil {
+			return DeviceAuthorization{}, wrap("on poll, failed to update device authorization", err)
+		}
+
+		return DeviceAuthorization{}, ErrAuthorizationPending
+	}
+}
+
+// randomUserCode returns a new user code, formatted as two groups of four characters, such as
+// "BDFG-HJKL".
+func randomUserCode() (string, error) {
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+
+	var b strings.Builder
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeLength/2 {
+			b.WriteByte('-')
+		}
+
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", wrap("failed to read random user code", err)
+		}
+
+		b.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+
+	return b.String(), nil
+}
+
+// normalizeUserCode converts code, as typed by a user, to the format of the codes issued. It reports
+// false if code cannot be a user code.
+func normalizeUserCode(code string) (string, bool) {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		switch {
+		case r == '-' || r == ' ':
+			continue
+		case !strings.ContainsRune(userCodeAlphabet, r):
+			return "", false
+		}
+
+		if b.Len() == userCodeLength/2 {
+			b.WriteByte('-')
+		}
+		b.WriteRune(r)
+	}
+
+	if b.Len() != userCodeLength+1 {
+		return "", false
+	}
+
+	return b.String(), true
+}
+
+// hashDeviceCode returns the hex encoded SHA-256 hash of code.
+func hashDeviceCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+type deviceGorm struct {
+	db *gorm.DB
+}
+
+func (dg *deviceGorm) Create(ctx context.Context, da *DeviceAuthorization) error {
+	ctx, span := trace.StartSpan(ctx, "device.Database.Create")
+	defer span.End()
+
+	err := dg.db.WithContext(ctx).Create(da).Error
+	if err != nil {
+		return wrap("could not create device authorization", err)
+	}
+
+	return nil
+}
+
+func (dg *deviceGorm) ByHash(ctx context.Context, hash string) (DeviceAuthorization, error) {
+	ctx, span := trace.StartSpan(ctx, "device.Database.ByHash")
+	defer span.End()
+
+	return dg.first(ctx, "hash = ?", hash)
+}
+
+func (dg *deviceGorm) ByUserCode(ctx context.Context, userCode string) (DeviceAuthorization, error) {
+	ctx, span := trace.StartSpan(ctx, "device.Database.ByUserCode")
+	defer span.End()
+
+	return dg.first(ctx, "user_code = ?", userCode)
+}
+
+// first returns the first device authorization matching the query, or ErrNotFound.
+func (dg *deviceGorm) first(ctx context.Context, query string, args ...interface{}) (DeviceAuthorization, error) {
+	var da DeviceAuthorization
+	err := dg.db.WithContext(ctx).Where(query, args...).First(&da).Error
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return DeviceAuthorization{}, ErrNotFound
+		}
+
+		return DeviceAuthorization{}, wrap("could not get device authorization", err)
+	}
+
+	return da, nil
+}
+
+func (dg *deviceGorm) CountOutstanding(ctx context.Context, clientID string, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "device.Database.CountOutstanding")
+	defer span.End()
+
+	var n int64
+	err := dg.db.WithContext(ctx).Model(&DeviceAuthorization{}).
+		Where("client_id = ? AND expires_at > ?", clientID, now).
+		Count(&n).Error
+	if err != nil {
+		return 0, wrap("could not count outstanding device authorizations", err)
+	}
+
+	return int(n), nil
+}
+
+func (dg *deviceGorm) Update(ctx context.Context, da *DeviceAuthorization) error {
+	ctx, span := trace.StartSpan(ctx, "device.Database.Update")
+	defer span.End()
+
+	err := dg.db.WithContext(ctx).Save(da).Error
+	if err != nil {
+		return wrap("could not update device authorization", err)
+	}
+
+	return nil
+}
+
+func (dg *deviceGorm) DeleteUserData(ctx context.Context, userID int64) error {
+	ctx, span := trace.StartSpan(ctx, "device.Database.DeleteUserData")
+	defer span.End()
+
+	err := dg.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&DeviceAuthorization{}).Error
+	if err != nil {
+		return wrap("could not delete device authorizations of user", err)
+	}
+
+	return nil
+}
+
+func (dg *deviceGorm) Delete(ctx context.Context, hash string) error {
+	ctx, span := trace.StartSpan(ctx, "device.Database.Delete")
+	defer span.End()
+
+	res := dg.db.WithContext(ctx).Where("hash = ?", hash).Delete(&DeviceAuthorization{})
+	if res.Error != nil {
+		return wrap("could not delete device authorization", res.Error)
+
+	} else if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
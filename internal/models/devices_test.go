@@ -0,0 +1,325 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+type testDeviceDB struct {
+	DeviceDB
+	auths map[string]DeviceAuthorization
+}
+
+func (t *testDeviceDB) Create(ctx context.Context, da *DeviceAuthorization) error {
+	if t.auths == nil {
+		t.auths = make(map[string]DeviceAuthorization)
+	}
+
+	t.auths[da.Hash] = *da
+	return nil
+}
+
+func (t *testDeviceDB) ByHash(ctx context.Context, hash string) (DeviceAuthorization, error) {
+	da, ok := t.auths[hash]
+	if !ok {
+		return DeviceAuthorization{}, ErrNotFound
+	}
+
+	return da, nil
+}
+
+func (t *testDeviceDB) ByUserCode(ctx context.Context, userCode string) (DeviceAuthorization, error) {
+	for _, da := range t.auths {
+		if da.UserCode == userCode {
+			return da, nil
+		}
+	}
+
+	return DeviceAuthorization{}, ErrNotFound
+}
+
+func (t *testDeviceDB) CountOutstanding(ctx context.Context, clientID string, now time.Time) (int, error) {
+	var n int
+	for _, da := range t.auths {
+		if da.ClientID == clientID && da.ExpiresAt.After(now) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (t *testDeviceDB) Update(ctx context.Context, da *DeviceAuthorization) error {
+	t.auths[da.Hash] = *da
+	return nil
+}
+
+func (t *testDeviceDB) Delete(ctx context.Context, hash string) error {
+	if _, ok := t.auths[hash]; !ok {
+		return ErrNotFound
+	}
+
+	delete(t.auths, hash)
+	return nil
+}
+
+func TestDeviceService_Poll(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name   string
+		decide func(ds DeviceService, userCode string) error
+		polls  []time.Duration // times of the polls, since the codes were issued
+		outErr error           // error of the last poll
+	}{
+		{
+			name:   "pending",
+			polls:  []time.Duration{5 * time.Second, 10 * time.Second},
+			outErr: ErrAuthorizationPending,
+		},
+		{
+			name: "approved",
+			decide: func(ds DeviceService, userCode string) error {
+				return ds.Approve(ctx, userCode, 7)
+			},
+			polls: []time.Duration{5 * time.Second},
+		},
+		{
+			name: "approvedLowercase",
+			decide: func(ds DeviceService, userCode string) error {
+				return ds.Approve(ctx, strings.ToLower(strings.Replace(userCode, "-", " ", 1)), 7)
+			},
+			polls: []time.Duration{5 * time.Second},
+		},
+		{
+			name: "denied",
+			decide: func(ds DeviceService, userCode string) error {
+				return ds.Deny(ctx, userCode, 7)
+			},
+			polls:  []time.Duration{5 * time.Second},
+			outErr: ErrAccessDenied,
+		},
+		{
+			name:   "tooFast",
+			polls:  []time.Duration{5 * time.Second, 8 * time.Second},
+			outErr: ErrSlowDown,
+		},
+		{
+			name:   "expired",
+			polls:  []time.Duration{deviceCodeDuration},
+			outErr: ErrDeviceCodeExpired,
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now := start
+			ds := &deviceService{
+				DeviceDB: &testDeviceDB{},
+				cfg:      Config{Now: func() time.Time { return now }},
+			}
+
+			da, err := ds.Authorize(ctx, "tv", "profile")
+			require.NoError(t, err)
+			assert.Regexp(t, "^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$", da.UserCode)
+			assert.NotEmpty(t, da.DeviceCode)
+			assert.Equal(t, defaultDevicePollInterval, da.Interval)
+
+			if cs.decide != nil {
+				require.NoError(t, cs.decide(ds, da.UserCode))
+			}
+
+			var got DeviceAuthorization
+			for _, at := range cs.polls {
+				now = start.Add(at)
+				got, err = ds.Poll(ctx, da.DeviceCode, "tv")
+			}
+
+			assert.True(t, xerrors.Is(err, cs.outErr), "got %v", err)
+			if cs.outErr == nil {
+				assert.Equal(t, int64(7), got.UserID)
+				assert.Equal(t, "profile", got.Scope)
+			}
+		})
+	}
+}
+
+func TestDeviceService_PollSingleUse(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	ds := &deviceService{
+		DeviceDB: &testDeviceDB{},
+		cfg:      Config{Now: func() time.Time { return now }},
+	}
+
+	da, err := ds.Authorize(ctx, "tv", "")
+	require.NoError(t, err)
+	require.NoError(t, ds.Approve(ctx, da.UserCode, 7))
+
+	t.Run("otherClient", func(t *testing.T) {
+		_, err := ds.Poll(ctx, da.DeviceCode, "other")
+
+		assert.True(t, xerrors.Is(err, ErrInvalidDeviceCode))
+	})
+
+	_, err = ds.Poll(ctx, da.DeviceCode, "tv")
+	require.NoError(t, err)
+
+	t.Run("reused", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		_, err := ds.Poll(ctx, da.DeviceCode, "tv")
+
+		assert.True(t, xerrors.Is(err, ErrInvalidDeviceCode))
+	})
+
+	t.Run("decidedTwice", func(t *testing.T) {
+		other, err := ds.Authorize(ctx, "tv", "")
+		require.NoError(t, err)
+		require.NoError(t, ds.Deny(ctx, other.UserCode, 7))
+
+		err = ds.Approve(ctx, other.UserCode, 7)
+
+		assert.True(t, xerrors.Is(err, ErrNotFound))
+	})
+}
+
+func TestDeviceService_PollInterval(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name     string
+		interval time.Duration
+		polls    []time.Duration // times of the polls, since the codes were issued
+		outErrs  []error
+	}{
+		{
+			name:     "allowedRate",
+			interval: 10 * time.Second,
+			polls:    []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second},
+			outErrs:  []error{ErrAuthorizationPending, ErrAuthorizationPending, ErrAuthorizationPending},
+		},
+		{
+			name:     "tooFast",
+			interval: 10 * time.Second,
+			polls:    []time.Duration{10 * time.Second, 19 * time.Second},
+			outErrs:  []error{ErrAuthorizationPending, ErrSlowDown},
+		},
+		{
+			// once slowed down, polling at the previous interval is too fast.
+			name:     "intervalIncreased",
+			interval: 10 * time.Second,
+			polls:    []time.Duration{10 * time.Second, 15 * time.Second, 25 * time.Second, 45 * time.Second},
+			outErrs:  []error{ErrAuthorizationPending, ErrSlowDown, ErrSlowDown, ErrAuthorizationPending},
+		},
+		{
+			name:    "defaultInterval",
+			polls:   []time.Duration{5 * time.Second, 10 * time.Second, 14 * time.Second},
+			outErrs: []error{ErrAuthorizationPending, ErrAuthorizationPending, ErrSlowDown},
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now := start
+			db := &testDeviceDB{}
+			ds := &deviceService{
+				DeviceDB: db,
+				cfg: Config{
+					Now:                func() time.Time { return now },
+					DevicePollInterval: cs.interval,
+				},
+			}
+
+			da, err := ds.Authorize(ctx, "tv", "")
+			require.NoError(t, err)
+
+			var errs []error
+			for _, at := range cs.polls {
+				now = start.Add(at)
+				_, err := ds.Poll(ctx, da.DeviceCode, "tv")
+				errs = append(errs, err)
+			}
+
+			assert.Equal(t, cs.outErrs, errs)
+		})
+	}
+}
+
+func TestDeviceService_MaxDeviceCodes(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name    string
+		free    func(ds DeviceService, codes []DeviceAuthorization) // frees slots once the cap is reached
+		advance time.Duration                                       // time passed before the last request
+		outErr  error
+	}{
+		{
+			name:   "capReached",
+			outErr: ErrTooManyDeviceCodes,
+		},
+		{
+			name:    "expired",
+			advance: deviceCodeDuration,
+		},
+		{
+			name: "completed",
+			free: func(ds DeviceService, codes []DeviceAuthorization) {
+				require.NoError(t, ds.Approve(ctx, codes[0].UserCode, 7))
+				_, err := ds.Poll(ctx, codes[0].DeviceCode, "tv")
+				require.NoError(t, err)
+			},
+		},
+		{
+			// approved codes hold their slot until the device gets its tokens.
+			name: "approvedNotPolled",
+			free: func(ds DeviceService, codes []DeviceAuthorization) {
+				require.NoError(t, ds.Approve(ctx, codes[0].UserCode, 7))
+			},
+			outErr: ErrTooManyDeviceCodes,
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now := start
+			ds := &deviceService{
+				DeviceDB: &testDeviceDB{},
+				cfg: Config{
+					Now:            func() time.Time { return now },
+					MaxDeviceCodes: 3,
+				},
+			}
+
+			var codes []DeviceAuthorization
+			for i := 0; i < 3; i++ {
+				da, err := ds.Authorize(ctx, "tv", "")
+				require.NoError(t, err)
+				codes = append(codes, da)
+			}
+
+			// other clients have their own cap.
+			_, err := ds.Authorize(ctx, "console", "")
+			require.NoError(t, err)
+
+			if cs.free != nil {
+				now = now.Add(defaultDevicePollInterval)
+				cs.free(ds, codes)
+			}
+			now = now.Add(cs.advance)
+
+			_, err = ds.Authorize(ctx, "tv", "")
+
+			assert.True(t, xerrors.Is(err, cs.outErr), "got %v", err)
+		})
+	}
+}
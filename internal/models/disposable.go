@@ -0,0 +1,78 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	_ "embed" // embeds the default disposable domains
+	"io"
+	"strings"
+
+	"go.opencensus.io/trace"
+)
+
+// defaultDisposableDomains is the list of disposable email domains used by DefaultDisposableList.
+//
+//go:embed disposable_domains.txt
+var defaultDisposableDomains string
+
+// A DisposableChecker reports whether an email domain belongs to a disposable email service, whose
+// throwaway addresses are not accepted at signup.
+type DisposableChecker interface {
+	// Disposable returns true if domain belongs to a disposable email service.
+	Disposable(ctx context.Context, domain string) (bool, error)
+}
+
+// disposableList is a DisposableChecker denying a fixed set of domains.
+type disposableList map[string]struct{}
+
+// NewDisposableList returns a DisposableChecker denying the domains read from r, one per line. Blank lines
+// and lines starting with # are ignored. The subdomains of the domains listed are denied as well.
+func NewDisposableList(r io.Reader) (DisposableChecker, error) {
+	dl := disposableList{}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		dl[line] = struct{}{}
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, wrap("failed to read disposable domains", err)
+	}
+
+	return dl, nil
+}
+
+// DefaultDisposableList returns a DisposableChecker denying the well-known disposable email domains
+// embedded in the service.
+func DefaultDisposableList() DisposableChecker {
+	dl, err := NewDisposableList(strings.NewReader(defaultDisposableDomains))
+	if err != nil {
+		panic(err) // the embedded list is always readable.
+	}
+
+	return dl
+}
+
+func (dl disposableList) Disposable(ctx context.Context, domain string) (bool, error) {
+	_, span := trace.StartSpan(ctx, "models.DisposableChecker.Disposable")
+	defer span.End()
+
+	domain = strings.ToLower(domain)
+	for {
+		if _, ok := dl[domain]; ok {
+			return true, nil
+		}
+
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return false, nil
+		}
+
+		domain = domain[i+1:]
+	}
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisposableList(t *testing.T) {
+	ctx := context.Background()
+	custom, err := NewDisposableList(strings.NewReader("# custom list\n\n  Throwaway.test \n"))
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name    string
+		checker DisposableChecker
+		domain  string
+		outBool bool
+	}{
+		{"defaultDenied", DefaultDisposableList(), "mailinator.com", true},
+		{"defaultSubdomain", DefaultDisposableList(), "eu.Mailinator.com", true},
+		{"defaultAllowed", DefaultDisposableList(), "gmail.com", false},
+		{"defaultSuffixOnly", DefaultDisposableList(), "notmailinator.com", false},
+		{"customDenied", custom, "throwaway.test", true},
+		{"customAllowed", custom, "mailinator.com", false},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			disposable, err := cs.checker.Disposable(ctx, cs.domain)
+
+			assert.NoError(t, err)
+			assert.Equal(t, cs.outBool, disposable)
+		})
+	}
+}
+
+func TestUserService_CreateDisposableEmail(t *testing.T) {
+	ctx := context.Background()
+	tudb := &testUserDB{
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			return User{}, ErrNotFound
+		},
+		create: func(ctx context.Context, u *User) error {
+			return nil
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{DisposableChecker: DefaultDisposableList()})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	var cases = []struct {
+		name   string
+		email  string
+		outErr error
+	}{
+		{"denied", "jane@yopmail.com", ValidationError{"email": ErrDisposableEmail}},
+		{"allowed", "jane@example.com", nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			err := us.Create(ctx, &User{Country: "GB", Email: cs.email, FirstName: "Jane", Password: "testpassword"})
+
+			assert.Equal(t, cs.outErr, err)
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// memorySweepInterval is the minimum time between two removals of the expired values of a memory store.
+const memorySweepInterval = time.Minute
+
+// An EphemeralStore holds the short-lived state of the flows spanning several requests, such as login
+// challenges, expiring on its own once its time to live has passed.
+type EphemeralStore interface {
+	// Set stores value under key for ttl, replacing the value stored under key, if any.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Get returns the value stored under key. It returns ErrNotFound if there is none, or it has expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Take returns the value stored under key and removes it atomically, so single use values can only
+	// be taken once. It returns ErrNotFound if there is none, or it has expired.
+	Take(ctx context.Context, key string) ([]byte, error)
+
+	// Delete removes the value stored under key, if any.
+	Delete(ctx context.Context, key string) error
+}
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+type memoryStore struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	swept   time.Time
+}
+
+// NewMemoryStore instantiates an EphemeralStore keeping the values in memory, so they are only visible
+// to the instance of the service storing them. Expiry times are read from cfg.Now.
+func NewMemoryStore(cfg Config) EphemeralStore {
+	return &memoryStore{
+		now:     cfg.now,
+		entries: make(map[string]memoryEntry),
+	}
+}
+
+func (ms *memoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	now := ms.now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// expired values are removed from time to time, as the ones never read again would stay otherwise.
+	if now.Sub(ms.swept) >= memorySweepInterval {
+		for k, e := range ms.entries {
+			if !now.Before(e.expiresAt) {
+				delete(ms.entries, k)
+			}
+		}
+		ms.swept = now
+	}
+
+	ms.entries[key] = memoryEntry{
+		value:     append([]byte(nil), value...),
+		expiresAt: now.Add(ttl),
+	}
+	return nil
+}
+
+func (ms *memoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.get(key)
+}
+
+func (ms *memoryStore) Take(ctx context.Context, key string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	v, err := ms.get(key)
+	delete(ms.entries, key)
+	return v, err
+}
+
+// get returns the value stored under key, removing it if it has expired. The caller must hold ms.mu.
+func (ms *memoryStore) get(key string) ([]byte, error) {
+	e, ok := ms.entries[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if !ms.now().Before(e.expiresAt) {
+		delete(ms.entries, key)
+		return nil, ErrNotFound
+	}
+
+	return append([]byte(nil), e.value...), nil
+}
+
+func (ms *memoryStore) Delete(ctx context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.entries, key)
+	return nil
+}
+
+type redisStore struct {
+	addr     string
+	password string
+	prefix   string
+	timeout  time.Duration
+
+	// mu serialises the commands, which share a single connection.
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewRedisStore instantiates an EphemeralStore keeping the values in the Redis server at addr, so they
+// are shared by all the instances of the service. Keys are stored with prefix, and password is used to
+// authenticate when not empty. Taking values requires Redis 6.2 or later.
+func NewRedisStore(addr, password, prefix string) EphemeralStore {
+	return &redisStore{
+		addr:     addr,
+		password: password,
+		prefix:   prefix,
+		timeout:  2 * time.Second,
+	}
+}
+
+func (rs *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ctx, span := trace.StartSpan(ctx, "ephemeral.Redis.Set")
+	defer span.End()
+
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		ms = 1
+	}
+
+	_, err := rs.do(ctx, "SET", rs.prefix+key, string(value), "PX", strconv.FormatInt(ms, 10))
+	if err != nil {
+		return wrap("could not set ephemeral value", err)
+	}
+
+	return nil
+}
+
+func (rs *redisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, span := trace.StartSpan(ctx, "ephemeral.Redis.Get")
+	defer span.End()
+
+	return rs.value(rs.do(ctx, "GET", rs.prefix+key))
+}
+
+func (rs *redisStore) Take(ctx context.Context, key string) ([]byte, error) {
+	ctx, span := trace.StartSpan(ctx, "ephemeral.Redis.Take")
+	defer span.End()
+
+	return rs.value(rs.do(ctx, "GETDEL", rs.prefix+key))
+}
+
+func (rs *redisStore) Delete(ctx context.Context, key string) error {
+	ctx, span := trace.StartSpan(ctx, "ephemeral.Redis.Delete")
+	defer span.End()
+
+	if _, err := rs.do(ctx, "DEL", rs.prefix+key); err != nil {
+		return wrap("could not delete ephemeral value", err)
+	}
+
+	return nil
+}
+
+// value maps the reply to a GET command to the value stored, nil replies being missing values.
+func (rs *redisStore) value(reply interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, wrap("could not get ephemeral value", err)
+	}
+
+	v, ok := reply.([]byte)
+	if !ok || v == nil {
+		return nil, ErrNotFound
+	}
+
+	return v, nil
+}
+
+// do sends a command to the server and returns its reply, connecting first if needed. The connection is
+// dropped on errors, so the next command starts on a new one.
+func (rs *redisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.conn == nil {
+		if err := rs.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rs.roundTrip(ctx, args...)
+	if err != nil {
+		rs.conn.Close()
+		rs.conn = nil
+	}
+
+	return reply, err
+}
+
+// connect opens the connection to the server, authenticating when a password is configured. The caller
+// must hold rs.mu.
+func (rs *redisStore) connect(ctx context.Context) error {
+	d := net.Dialer{Timeout: rs.timeout}
+	conn, err := d.DialContext(ctx, "tcp", rs.addr)
+	if err != nil {
+		return err
+	}
+
+	rs.conn = conn
+	rs.rd = bufio.NewReader(conn)
+
+	if rs.password != "" {
+		if _, err := rs.roundTrip(ctx, "AUTH", rs.password); err != nil {
+			rs.conn.Close()
+			rs.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// roundTrip writes a command and reads its reply. The caller must hold rs.mu.
+func (rs *redisStore) roundTrip(ctx context.Context, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(rs.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := rs.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// commands are sent as arrays of bulk strings, as defined by the Redis protocol (RESP).
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"+a+"\r\n"...)
+	}
+	if _, err := rs.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return readReply(rs.rd)
+}
+
+// redisError is an error reply sent by a Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readReply reads a single RESP reply. Simple strings and integers are returned as strings, bulk strings
+// as byte slices, nil for the null bulk string, and error replies as a redisError.
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk string length %q", line)
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+
+		return b[:n], nil
+	}
+
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
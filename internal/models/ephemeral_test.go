@@ -0,0 +1,124 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name     string
+		op       func(s EphemeralStore) ([]byte, error)
+		after    time.Duration // time passed since the value was set, before op
+		outValue []byte
+		outErr   error
+	}{
+		{
+			name:     "get",
+			op:       func(s EphemeralStore) ([]byte, error) { return s.Get(ctx, "state") },
+			after:    59 * time.Second,
+			outValue: []byte("value"),
+		},
+		{
+			name:   "expired",
+			op:     func(s EphemeralStore) ([]byte, error) { return s.Get(ctx, "state") },
+			after:  time.Minute,
+			outErr: ErrNotFound,
+		},
+		{
+			name:   "missing",
+			op:     func(s EphemeralStore) ([]byte, error) { return s.Get(ctx, "other") },
+			outErr: ErrNotFound,
+		},
+		{
+			name: "replaced",
+			op: func(s EphemeralStore) ([]byte, error) {
+				require.NoError(t, s.Set(ctx, "state", []byte("new"), time.Hour))
+				return s.Get(ctx, "state")
+			},
+			after:    2 * time.Minute,
+			outValue: []byte("new"),
+		},
+		{
+			name: "getTwice",
+			op: func(s EphemeralStore) ([]byte, error) {
+				_, err := s.Get(ctx, "state")
+				require.NoError(t, err)
+				return s.Get(ctx, "state")
+			},
+			outValue: []byte("value"),
+		},
+		{
+			name:     "take",
+			op:       func(s EphemeralStore) ([]byte, error) { return s.Take(ctx, "state") },
+			outValue: []byte("value"),
+		},
+		{
+			name: "takeTwice",
+			op: func(s EphemeralStore) ([]byte, error) {
+				_, err := s.Take(ctx, "state")
+				require.NoError(t, err)
+				return s.Take(ctx, "state")
+			},
+			outErr: ErrNotFound,
+		},
+		{
+			name:   "takeExpired",
+			op:     func(s EphemeralStore) ([]byte, error) { return s.Take(ctx, "state") },
+			after:  time.Hour,
+			outErr: ErrNotFound,
+		},
+		{
+			name: "deleted",
+			op: func(s EphemeralStore) ([]byte, error) {
+				require.NoError(t, s.Delete(ctx, "state"))
+				return s.Get(ctx, "state")
+			},
+			outErr: ErrNotFound,
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now := start
+			s := NewMemoryStore(Config{Now: func() time.Time { return now }})
+
+			value := []byte("value")
+			require.NoError(t, s.Set(ctx, "state", value, time.Minute))
+
+			// the store keeps its own copy of the value.
+			value[0] = 'X'
+
+			now = now.Add(cs.after)
+			got, err := cs.op(s)
+
+			assert.True(t, xerrors.Is(err, cs.outErr), "got %v", err)
+			assert.Equal(t, cs.outValue, got)
+		})
+	}
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewMemoryStore(Config{Now: func() time.Time { return now }})
+
+	require.NoError(t, s.Set(ctx, "short", []byte("a"), time.Second))
+	require.NoError(t, s.Set(ctx, "long", []byte("b"), time.Hour))
+
+	// values expired are removed on the next write after the sweep interval, even if never read.
+	now = now.Add(memorySweepInterval)
+	require.NoError(t, s.Set(ctx, "other", []byte("c"), time.Hour))
+
+	entries := s.(*memoryStore).entries
+	assert.Len(t, entries, 2)
+	assert.NotContains(t, entries, "short")
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"strings"
+
 	"github.com/noelruault/golang-authentication/internal/errors"
 )
 
@@ -18,6 +20,9 @@ const (
 	ErrInvalidField     ModelError = "models: invalid_field, provided field is not valid"
 	ErrInvalidCountry   ModelError = "models: invalid_country_code, provided country code is not valid. Must be in ISO 3166-1 format"
 	ErrInvalidJSON      ModelError = "models: invalid_json, provided input cannot be parsed"
+	ErrPhoneInvalid     ModelError = "models: phone_invalid, phone number is not a valid international number in E.164 format"
+	ErrEmailDomain      ModelError = "models: email_domain_not_allowed, email domain is not allowed to sign up"
+	ErrDisposableEmail  ModelError = "models: disposable_email, email address belongs to a disposable email service"
 
 	ErrIDTaken   ModelError = "models: id_taken, primary key already exists"
 	ErrTooShort  ModelError = "models: too_short, value is shorter than required"
@@ -30,6 +35,42 @@ const (
 	ErrRefreshInvalid    ModelError = "models: invalid_refresh_token, refresh token is not valid"
 	ErrRefreshExpired    ModelError = "models: expired_refresh_token, refresh token has expired"
 	ErrPasswordIncorrect ModelError = "models: incorrect_password, incorrect password provided"
+	ErrPasswordBreached  ModelError = "models: password_breached, password has appeared in a data breach and cannot be used"
+	ErrPasswordNoDigit   ModelError = "models: password_no_digit, password must contain at least one digit"
+	ErrInvalidClient     ModelError = "models: invalid_client, client authentication failed"
+	ErrClientDisabled    ModelError = "models: client_disabled, the client the token was issued through is disabled or deleted"
+	ErrReauthRequired    ModelError = "models: reauth_required, a fresh login is required to continue the session"
+	ErrTokenExpired      ModelError = "models: token_expired, access token has expired and must be refreshed"
+	ErrInvalidToken      ModelError = "models: invalid_token, access token is not valid"
+	ErrClaimsRejected    ModelError = "models: claims_rejected, token claims are not accepted by this service"
+	ErrTokenAlreadyUsed  ModelError = "models: token_already_used, single use token has already been used"
+	ErrTooManyAPIKeys    ModelError = "models: too_many_api_keys, maximum number of active api keys reached"
+	ErrInvalidMFACode    ModelError = "models: invalid_mfa_code, multi-factor authentication code is not valid"
+	ErrMFALocked         ModelError = "models: mfa_locked, too many failed multi-factor authentication attempts, try again later"
+	ErrInvalidMFASecret  ModelError = "models: invalid_mfa_secret, multi-factor authentication secret is too short, not random or uses unsupported parameters"
+	ErrTooManyMFADevices ModelError = "models: too_many_mfa_devices, maximum number of multi-factor authentication devices reached"
+	ErrLastMFADevice     ModelError = "models: last_mfa_device, the last multi-factor authentication device cannot be removed while MFA is required"
+
+	ErrInvalidRedirectURI ModelError = "models: invalid_redirect_uri, redirect URI is not registered for the client"
+
+	ErrAuthorizationPending ModelError = "models: authorization_pending, the user has not yet approved the device"
+	ErrSlowDown             ModelError = "models: slow_down, the device is polling too fast, the interval has been increased"
+	ErrAccessDenied         ModelError = "models: access_denied, the user denied the device authorization"
+	ErrDeviceCodeExpired    ModelError = "models: expired_token, device code has expired, the authorization must be restarted"
+	ErrInvalidDeviceCode    ModelError = "models: invalid_device_code, device code is not valid"
+	ErrTooManyDeviceCodes   ModelError = "models: too_many_device_codes, maximum number of outstanding device codes reached"
+
+	ErrInvalidChallenge     ModelError = "models: invalid_challenge, login challenge is not valid or has expired"
+	ErrInvalidChallengeCode ModelError = "models: invalid_challenge_code, login challenge code is not valid"
+	ErrOTPSendTooSoon       ModelError = "models: otp_send_too_soon, a code was sent to the user too recently"
+
+	ErrInvalidRecovery        ModelError = "models: invalid_recovery, account recovery is not valid or has expired"
+	ErrInvalidRecoveryAnswers ModelError = "models: invalid_recovery_answers, answers to the security questions are not valid"
+	ErrRecoveryLocked         ModelError = "models: recovery_locked, too many failed account recovery attempts, try again later"
+
+	ErrTooManyConcurrentLogins ModelError = "models: too_many_concurrent_logins, too many logins of the same user are being processed, try again later"
+
+	ErrServiceUnavailable ModelError = "models: service_unavailable, the service is temporarily unavailable, try again later"
 )
 
 // PublicError is an error that returns a string code that can be presented to the API user.
@@ -100,7 +141,53 @@ func (v ValidationError) Is(err error) bool {
 	}
 
 	for k := range ve {
-		if v[k] != ve[k] {
+		if !samePublicError(v[k], ve[k]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FieldErrors holds several errors of the same field of a ValidationError, for fields failing more than
+// one rule at once, such as a password that is both too short and missing a digit. The errors are kept
+// in the order they were found.
+type FieldErrors []PublicError
+
+// Error returns the messages of the errors, separated by semicolons.
+func (f FieldErrors) Error() string {
+	msgs := make([]string, len(f))
+	for i, err := range f {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Public returns the error code of the first error, so FieldErrors can be used wherever a single error
+// is expected. The web package renders the codes of all the errors.
+func (f FieldErrors) Public() string {
+	if len(f) == 0 {
+		return ""
+	}
+
+	return f[0].Public()
+}
+
+// samePublicError reports whether a and b are the same error. FieldErrors are not comparable, so they are
+// compared error by error.
+func samePublicError(a, b PublicError) bool {
+	fa, aok := a.(FieldErrors)
+	fb, bok := b.(FieldErrors)
+	if !aok || !bok {
+		return !aok && !bok && a == b
+	}
+
+	if len(fa) != len(fb) {
+		return false
+	}
+	for i := range fa {
+		if !samePublicError(fa[i], fb[i]) {
 			return false
 		}
 	}
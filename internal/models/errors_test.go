@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+
+	"golang.org/x/xerrors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/errors"
+)
+
+func TestModelError_Shape(t *testing.T) {
+	consts, err := errors.Constants(".", "ModelError")
+	require.NoError(t, err)
+	require.NotEmpty(t, consts)
+
+	for name, msg := range consts {
+		assert.NoError(t, errors.CheckPublic("models", msg), name)
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	errs := FieldErrors{ErrTooShort, ErrInvalid}
+	assert.Equal(t, "too_short", errs.Public())
+	assert.Equal(t, string(ErrTooShort)+"; "+string(ErrInvalid), errs.Error())
+
+	var err error = ValidationError{"password": errs, "email": ErrRequired}
+	assert.True(t, xerrors.Is(err, ValidationError{"password": FieldErrors{ErrTooShort, ErrInvalid}}))
+	assert.True(t, xerrors.Is(err, ValidationError{"email": ErrRequired}))
+	assert.False(t, xerrors.Is(err, ValidationError{"password": FieldErrors{ErrTooShort}}))
+	assert.False(t, xerrors.Is(err, ValidationError{"password": ErrTooShort}))
+	assert.False(t, xerrors.Is(err, ValidationError{"email": FieldErrors{ErrRequired}}))
+}
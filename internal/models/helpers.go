@@ -39,8 +39,10 @@ import (
 //
 // If a validator is not related to a specific field, its wrapper must return an empty string as its field name.
 //
-// Whan a field validator returns an error, that error is stored in a ValidationError value and no other validators
-// for the same field are called.
+// Whan a field validator returns an error, that error is stored in a ValidationError value and the other validators
+// for the same field are still called, so every failure of the field is reported: a field failing several of them
+// holds a FieldErrors value with their errors in order. Once a field is ErrRequired or ErrInvalid though, no other
+// validators for the same field are called, as there is no value to check further.
 //
 // If a field's validator returns another ValidationError, these will be merged with the resulting field errors
 // where the field name will be <validator_field>.<returned_validation_error_field>. If a field's validator returns a
@@ -71,8 +73,8 @@ func runValidationFunctions(value interface{}, fns interface{}) error {
 			continue
 		}
 
-		// else if it is a field validator and no errors yet on this field
-		if ve[field] == nil {
+		// else if it is a field validator and the field can still be checked
+		if !fieldFinal(ve[field]) {
 			rerr := rfn.Call([]reflect.Value{reflect.ValueOf(value)})
 
 			// run the validation function, if it errors...
@@ -83,8 +85,8 @@ func runValidationFunctions(value interface{}, fns interface{}) error {
 						ve[field+"."+k] = v
 					}
 
-				case PublicError: // and the error is a PublicError, put it in the ValidationError map
-					ve[field] = terr
+				case PublicError: // and the error is a PublicError, add it to the errors of the field
+					ve[field] = appendFieldError(ve[field], terr)
 
 				default: // otherwise, it's a private error so we should exit
 					return terr.(error)
@@ -100,6 +102,35 @@ func runValidationFunctions(value interface{}, fns interface{}) error {
 	return nil
 }
 
+// fieldFinal reports whether err, the errors of a field so far, stops the other validators of the field.
+func fieldFinal(err PublicError) bool {
+	errs, ok := err.(FieldErrors)
+	if !ok {
+		errs = FieldErrors{err}
+	}
+
+	for _, e := range errs {
+		if e == ErrRequired || e == ErrInvalid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// appendFieldError adds err to errs, the errors of a field so far. A single error is kept as it is, and
+// several are held in a FieldErrors value.
+func appendFieldError(errs, err PublicError) PublicError {
+	switch terrs := errs.(type) {
+	case nil:
+		return err
+	case FieldErrors:
+		return append(terrs, err)
+	default:
+		return FieldErrors{terrs, err}
+	}
+}
+
 func NewTestDatabase(t *testing.T) (*gorm.DB, error) {
 	var cfg struct {
 		Database struct {
@@ -0,0 +1,49 @@
+package models
+
+import "sync"
+
+// loginLimiter caps the number of logins of the same user processed at once, counting the logins in
+// flight by the email address they are made with.
+type loginLimiter struct {
+	max int
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// newLoginLimiter instantiates a loginLimiter allowing cfg.MaxConcurrentLogins logins per user. It
+// returns nil when the maximum is zero, which disables the limit.
+func newLoginLimiter(cfg Config) *loginLimiter {
+	if cfg.MaxConcurrentLogins <= 0 {
+		return nil
+	}
+
+	return &loginLimiter{
+		max:      cfg.MaxConcurrentLogins,
+		inFlight: make(map[string]int),
+	}
+}
+
+// acquire reports whether a login with the email address key can be processed, counting it as in
+// flight if so. Logins that can be processed must be released once done.
+func (ll *loginLimiter) acquire(key string) bool {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	if ll.inFlight[key] >= ll.max {
+		return false
+	}
+
+	ll.inFlight[key]++
+	return true
+}
+
+// release ends a login with the email address key acquired before.
+func (ll *loginLimiter) release(key string) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	if ll.inFlight[key]--; ll.inFlight[key] <= 0 {
+		delete(ll.inFlight, key)
+	}
+}
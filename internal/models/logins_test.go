@@ -0,0 +1,67 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUserService_MaxConcurrentLogins(t *testing.T) {
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password1234"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	// the logins of the shared user wait in the store until released.
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	tudb := &testUserDB{
+		byEmail: func(ctx context.Context, email string) (User, error) {
+			if email == "shared@example.com" {
+				entered <- struct{}{}
+				<-release
+			}
+
+			return User{ID: 88, Email: email, Password: string(hash), Active: true}, nil
+		},
+	}
+
+	us := NewUserService(nil, []byte(testJWTSecret), Config{MaxConcurrentLogins: 2})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = us.Authenticate(ctx, "shared@example.com", "password1234")
+		}(i)
+		<-entered
+	}
+
+	// the cap is reached: any other login of the user fails right away, however the email is written.
+	for _, email := range []string{"shared@example.com", " Shared@Example.com"} {
+		_, err := us.Authenticate(ctx, email, "password1234")
+		assert.Equal(t, ErrTooManyConcurrentLogins, err)
+	}
+
+	_, err = us.Authenticate(ctx, "other@example.com", "password1234")
+	assert.NoError(t, err, "the logins of other users are not affected")
+
+	close(release)
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	// the logins in flight are released once done.
+	go func() { <-entered }()
+	_, err = us.Authenticate(ctx, "shared@example.com", "password1234")
+	assert.NoError(t, err)
+	assert.Empty(t, us.(*userService).logins.inFlight)
+}
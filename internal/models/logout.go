@@ -0,0 +1,178 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/xerrors"
+	jwtjose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// logoutTokenDuration is the time relying parties have to accept a back-channel logout token.
+	logoutTokenDuration = 2 * time.Minute
+
+	tokenClaimsIssuerLogout = "goauthsvclogout"
+
+	// backchannelLogoutEvent is the event identifying logout tokens, as defined by OpenID Connect
+	// Back-Channel Logout.
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+)
+
+// A LogoutNotifier delivers back-channel logout tokens to relying parties.
+type LogoutNotifier interface {
+	// NotifyLogout sends logoutToken to the back-channel logout URI of a client.
+	NotifyLogout(ctx context.Context, uri, logoutToken string) error
+}
+
+// LogoutService defines the methods used to end user sessions, as in OpenID Connect RP-initiated logout.
+type LogoutService interface {
+	// Logout ends the session the refresh token belongs to and returns the URI the user should be
+	// redirected to, which is empty when postLogoutRedirectURI is. A non empty postLogoutRedirectURI
+	// must be registered for the client identified by clientID.
+	//
+	// When a LogoutNotifier is configured and the client has a back-channel logout URI, the client is
+	// sent a signed logout token. Delivery is best effort: a client that cannot be reached does not
+	// prevent the session from being ended.
+	//
+	// Errors returned include ErrNoCredentials, ErrUnauthorised, ErrInvalidClient and
+	// ErrInvalidRedirectURI. The session is not ended when the redirect URI is rejected.
+	Logout(ctx context.Context, refreshToken, clientID, postLogoutRedirectURI string) (string, error)
+}
+
+type logoutClaims struct {
+	jwt.Claims
+
+	SessionID string                 `json:"sid"`
+	Events    map[string]interface{} `json:"events"`
+}
+
+type logoutService struct {
+	us     UserService
+	cs     ClientService
+	signer jwtjose.Signer
+	cfg    Config
+}
+
+// NewLogoutService instantiates a new LogoutService implementation ending the sessions through us and
+// finding clients through cs. Logout tokens are signed with jwtSecret.
+func NewLogoutService(us UserService, cs ClientService, jwtSecret []byte, cfg Config) LogoutService {
+	return &logoutService{
+		us:     us,
+		cs:     cs,
+		signer: newSigner(jwtSecret),
+		cfg:    cfg,
+	}
+}
+
+func (ls *logoutService) Logout(ctx context.Context, refreshToken, clientID, postLogoutRedirectURI string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "models.LogoutService.Logout")
+	defer span.End()
+
+	var client Client
+	if clientID != "" {
+		var err error
+		client, err = ls.cs.ByID(ctx, clientID)
+		if err != nil {
+			if xerrors.Is(err, ErrNotFound) {
+				return "", ErrInvalidClient
+			}
+
+			return "", wrap("on logout, failed to obtain client from database", err)
+		}
+
+		if !client.Active {
+			return "", ErrInvalidClient
+		}
+	} else if postLogoutRedirectURI != "" {
+		// the redirect URI cannot be checked without the client it is registered for.
+		return "", ErrInvalidRedirectURI
+	}
+
+	redirect, err := client.PostLogoutRedirectURI(postLogoutRedirectURI)
+	if err != nil {
+		return "", err
+	}
+
+	session, err := ls.us.Logout(ctx, refreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	if ls.cfg.LogoutNotifier != nil && client.BackchannelLogoutURI != "" {
+		if tok, err := ls.logoutToken(client, session); err == nil {
+			ls.cfg.LogoutNotifier.NotifyLogout(ctx, client.BackchannelLogoutURI, tok)
+		}
+	}
+
+	return redirect, nil
+}
+
+// logoutToken generates the back-channel logout token notifying c that session has ended.
+func (ls *logoutService) logoutToken(c Client, session RevokedSession) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := ls.cfg.now()
+	claims := logoutClaims{
+		Claims: jwt.Claims{
+			ID:       jti,
+			Subject:  strconv.FormatInt(session.UserID, 10),
+			Issuer:   tokenClaimsIssuerLogout,
+			Audience: jwt.Audience{c.ID},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(logoutTokenDuration)),
+		},
+		SessionID: session.ID,
+		Events:    map[string]interface{}{backchannelLogoutEvent: struct{}{}},
+	}
+
+	tok, err := jwt.Signed(ls.signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		return "", wrap("failed to generate logout token", err)
+	}
+
+	return tok, nil
+}
+
+type backchannelNotifier struct {
+	client *http.Client
+}
+
+// NewBackchannelNotifier returns a LogoutNotifier posting the logout tokens through client, as defined
+// by OpenID Connect Back-Channel Logout.
+func NewBackchannelNotifier(client *http.Client) LogoutNotifier {
+	return &backchannelNotifier{client: client}
+}
+
+func (bn *backchannelNotifier) NotifyLogout(ctx context.Context, uri, logoutToken string) error {
+	ctx, span := trace.StartSpan(ctx, "models.LogoutNotifier.NotifyLogout")
+	defer span.End()
+
+	form := url.Values{"logout_token": {logoutToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return wrap("failed to create back-channel logout request", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := bn.client.Do(req)
+	if err != nil {
+		return wrap("failed to send back-channel logout request", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return wrap("unexpected back-channel logout response "+res.Status, nil)
+	}
+
+	return nil
+}
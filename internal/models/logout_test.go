@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type testLogoutNotifier struct {
+	uri, token string
+}
+
+func (t *testLogoutNotifier) NotifyLogout(ctx context.Context, uri, logoutToken string) error {
+	t.uri, t.token = uri, logoutToken
+	return nil
+}
+
+func TestLogoutService_Logout(t *testing.T) {
+	ctx := context.Background()
+
+	revoked := map[string]bool{}
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+		revokeSession: func(ctx context.Context, rs *RevokedSession) error {
+			assert.Equal(t, int64(88), rs.UserID)
+			revoked[rs.ID] = true
+			return nil
+		},
+		sessionRevoked: func(ctx context.Context, userID int64, id string) (bool, error) {
+			return revoked[id], nil
+		},
+	}
+	n := &testLogoutNotifier{}
+	cfg := Config{LogoutNotifier: n}
+
+	us := NewUserService(nil, []byte(testJWTSecret), cfg)
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	cs := NewClientService(nil, []byte(testJWTSecret))
+	cs.(*clientService).ClientDB = &testClientDB{
+		byID: func(ctx context.Context, id string) (Client, error) {
+			if id != "webapp" {
+				return Client{}, ErrNotFound
+			}
+
+			return Client{
+				ID:                     "webapp",
+				Active:                 true,
+				PostLogoutRedirectURIs: StringList{"https://webapp.example.com/bye"},
+				BackchannelLogoutURI:   "https://webapp.example.com/backchannel",
+			}, nil
+		},
+	}
+
+	ls := NewLogoutService(us, cs, []byte(testJWTSecret), cfg)
+
+	t.Run("unregisteredRedirectURI", func(t *testing.T) {
+		tok, err := us.Token(ctx, &User{ID: 88})
+		require.NoError(t, err)
+
+		_, err = ls.Logout(ctx, tok.RefreshToken, "webapp", "https://evil.example.com/bye")
+		assert.Equal(t, ErrInvalidRedirectURI, err)
+
+		_, err = ls.Logout(ctx, tok.RefreshToken, "", "https://webapp.example.com/bye")
+		assert.Equal(t, ErrInvalidRedirectURI, err)
+
+		// the session remains valid
+		_, err = us.Rotate(ctx, tok.RefreshToken)
+		assert.NoError(t, err)
+	})
+
+	t.Run("unknownClient", func(t *testing.T) {
+		tok, err := us.Token(ctx, &User{ID: 88})
+		require.NoError(t, err)
+
+		_, err = ls.Logout(ctx, tok.RefreshToken, "unknown", "")
+		assert.Equal(t, ErrInvalidClient, err)
+	})
+
+	t.Run("sessionInvalidated", func(t *testing.T) {
+		tok, err := us.Token(ctx, &User{ID: 88})
+		require.NoError(t, err)
+
+		rotated, err := us.Rotate(ctx, tok.RefreshToken)
+		require.NoError(t, err)
+
+		redirect, err := ls.Logout(ctx, rotated.RefreshToken, "webapp", "https://webapp.example.com/bye")
+		require.NoError(t, err)
+		assert.Equal(t, "https://webapp.example.com/bye", redirect)
+
+		// every refresh token of the session is rejected
+		_, err = us.Rotate(ctx, tok.RefreshToken)
+		assert.Equal(t, ErrUnauthorised, err)
+		_, err = us.Rotate(ctx, rotated.RefreshToken)
+		assert.Equal(t, ErrUnauthorised, err)
+
+		// other sessions are not affected
+		other, err := us.Token(ctx, &User{ID: 88})
+		require.NoError(t, err)
+		_, err = us.Rotate(ctx, other.RefreshToken)
+		assert.NoError(t, err)
+
+		// the client is notified with a logout token
+		assert.Equal(t, "https://webapp.example.com/backchannel", n.uri)
+
+		parsed, err := jwt.ParseSigned(n.token)
+		require.NoError(t, err)
+
+		var cl logoutClaims
+		require.NoError(t, parsed.Claims([]byte(testJWTSecret), &cl))
+		assert.Equal(t, "88", cl.Subject)
+		assert.Equal(t, jwt.Audience{"webapp"}, cl.Audience)
+		assert.True(t, revoked[cl.SessionID])
+		assert.Contains(t, cl.Events, backchannelLogoutEvent)
+	})
+
+	t.Run("noRedirect", func(t *testing.T) {
+		tok, err := us.Token(ctx, &User{ID: 88})
+		require.NoError(t, err)
+
+		redirect, err := ls.Logout(ctx, tok.RefreshToken, "", "")
+		assert.NoError(t, err)
+		assert.Empty(t, redirect)
+
+		_, err = us.Rotate(ctx, tok.RefreshToken)
+		assert.Equal(t, ErrUnauthorised, err)
+	})
+}
@@ -0,0 +1,444 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	// totpPeriod is the time step of the TOTP codes, as used by the authenticator apps.
+	totpPeriod = 30 * time.Second
+
+	// totpSkew is the number of time steps before and after the current one whose codes are accepted.
+	totpSkew = 1
+
+	// totpDigits is the number of digits of the TOTP codes.
+	totpDigits = 6
+
+	// defaultMFAMinSecretBytes is the minimum length of the TOTP secrets when none is configured, the
+	// minimum allowed by RFC 4226.
+	defaultMFAMinSecretBytes = 16
+)
+
+// MFAService verifies the codes provided by users in the multi-factor authentication step.
+type MFAService interface {
+	// Verify checks code is a valid TOTP code for the base32 encoded secret of the user. After the
+	// configured number of consecutive failures, the MFA step of the user is locked for the cooldown
+	// period, whatever the codes provided. A successful verification resets the failure count.
+	//
+	// Errors returned include ErrInvalidMFACode and ErrMFALocked.
+	Verify(ctx context.Context, userID int64, secret, code string) error
+
+	// VerifyUser checks code like Verify, against the secrets of all the MFA devices of the user. Users
+	// without devices have no valid codes.
+	//
+	// Errors returned include ErrInvalidMFACode and ErrMFALocked.
+	VerifyUser(ctx context.Context, userID int64, code string) error
+
+	// Enroll adds the authenticator d to its user, once code proves the authenticator was set up with
+	// the secret of d. Secrets are generated by the client or imported from another service, and
+	// must be long enough and look random. Only the standard period of 30 seconds and 6 digit codes
+	// are supported; zero values use them.
+	//
+	// It returns ErrTooManyMFADevices if the user already has the maximum number of devices.
+	//
+	// Errors returned include ErrInvalidMFASecret and ErrInvalidMFACode.
+	Enroll(ctx context.Context, d *MFADevice, code string) error
+
+	// EnrollSMS adds the phone of d to its user as an MFA device receiving the codes by SMS. The phone
+	// must have been verified first, such as by completing a challenge issued by
+	// ChallengeService.IssuePhone. It is stored in E.164 form.
+	//
+	// It returns ErrTooManyMFADevices if the user already has the maximum number of devices.
+	//
+	// It may return a ValidationError for the phone.
+	EnrollSMS(ctx context.Context, d *MFADevice) error
+
+	// Remove deletes the MFA device with the given ID from the user. When MFA is required, the last
+	// device of a user cannot be removed, and ErrLastMFADevice is returned.
+	//
+	// It may return ErrNotFound.
+	Remove(ctx context.Context, userID, id int64) error
+
+	MFADB
+}
+
+// MFADB defines how the service interacts with the database.
+type MFADB interface {
+	// CreateDevice adds an MFA device to the system.
+	CreateDevice(context.Context, *MFADevice) error
+
+	// Devices returns the MFA devices of a user, in enrollment order.
+	Devices(context.Context, int64) ([]MFADevice, error)
+
+	// CountDevices returns the number of MFA devices of a user.
+	CountDevices(context.Context, int64) (int, error)
+
+	// DeleteDevice removes the MFA device with the given user and device IDs. It returns ErrNotFound if
+	// there is no such device.
+	DeleteDevice(context.Context, int64, int64) error
+}
+
+// An MFADevice is an authenticator or a phone a user enrolled to provide the codes of the multi-factor
+// authentication step.
+type MFADevice struct {
+	ID     int64  `gorm:"primary_key;type:bigserial" json:"id"`
+	UserID int64  `gorm:"not null;index" json:"user_id"`
+	Name   string `gorm:"size:255;not null" json:"name"`
+
+	// Method is how the device provides the codes, either ChallengeMethodTOTP for authenticators or
+	// ChallengeMethodSMS for phones.
+	Method string `gorm:"size:16;not null;default:totp" json:"method"`
+
+	// Phone is the E.164 number the codes are sent to, for SMS devices.
+	Phone string `gorm:"size:16;not null;default:''" json:"phone,omitempty"`
+
+	// Secret is the base32 encoded TOTP secret shared with the authenticator, without padding.
+	Secret string `gorm:"size:255;not null" json:"-"`
+	Period int    `gorm:"not null" json:"period,omitempty"`
+	Digits int    `gorm:"not null" json:"digits,omitempty"`
+
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+}
+
+type mfaAttempts struct {
+	failures    int
+	lockedUntil time.Time
+}
+
+type mfaService struct {
+	MFADB
+
+	cfg Config
+
+	mu       sync.Mutex
+	attempts map[int64]*mfaAttempts
+}
+
+// NewMFAService instantiates a new MFAService implementation with db as the backing database. Failed
+// attempts are tracked in memory.
+func NewMFAService(db *gorm.DB, cfg Config) MFAService {
+	return &mfaService{
+		MFADB:    &mfaGorm{db},
+		cfg:      cfg,
+		attempts: make(map[int64]*mfaAttempts),
+	}
+}
+
+func (ms *mfaService) Verify(ctx context.Context, userID int64, secret, code string) error {
+	_, span := trace.StartSpan(ctx, "models.MFAService.Verify")
+	defer span.End()
+
+	return ms.verify(userID, func(now time.Time) bool {
+		return validTOTP(secret, code, now)
+	})
+}
+
+func (ms *mfaService) VerifyUser(ctx context.Context, userID int64, code string) error {
+	ctx, span := trace.StartSpan(ctx, "models.MFAService.VerifyUser")
+	defer span.End()
+
+	devices, err := ms.MFADB.Devices(ctx, userID)
+	if err != nil {
+		return wrap("on verify, failed to obtain mfa devices", err)
+	}
+
+	return ms.verify(userID, func(now time.Time) bool {
+		valid := false
+		for _, d := range devices {
+			// SMS devices have no secret, and their codes are checked by the challenges sending them.
+			if d.Method == ChallengeMethodTOTP {
+				valid = validTOTP(d.Secret, code, now) || valid
+			}
+		}
+
+		return valid
+	})
+}
+
+// verify checks the code of the user with valid, accounting for the failures and the lockout.
+func (ms *mfaService) verify(userID int64, valid func(now time.Time) bool) error {
+	now := ms.cfg.now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	a := ms.attempts[userID]
+	if a != nil && now.Before(a.lockedUntil) {
+		return ErrMFALocked
+	}
+
+	if valid(now) {
+		delete(ms.attempts, userID)
+		return nil
+	}
+
+	if ms.cfg.MFAMaxAttempts <= 0 {
+		return ErrInvalidMFACode
+	}
+
+	if a == nil || !a.lockedUntil.IsZero() {
+		// first failure, or first one after a lockout expired
+		a = &mfaAttempts{}
+		ms.attempts[userID] = a
+	}
+
+	a.failures++
+	if a.failures >= ms.cfg.MFAMaxAttempts {
+		a.lockedUntil = now.Add(ms.cfg.MFALockout)
+	}
+
+	return ErrInvalidMFACode
+}
+
+func (ms *mfaService) Enroll(ctx context.Context, d *MFADevice, code string) error {
+	ctx, span := trace.StartSpan(ctx, "models.MFAService.Enroll")
+	defer span.End()
+
+	if d.Period == 0 {
+		d.Period = int(totpPeriod / time.Second)
+	}
+	if d.Digits == 0 {
+		d.Digits = totpDigits
+	}
+	if d.Period != int(totpPeriod/time.Second) || d.Digits != totpDigits {
+		return ErrInvalidMFASecret
+	}
+
+	key, err := totpKey(d.Secret)
+	if err != nil || len(key) < ms.cfg.mfaMinSecretBytes() || weakTOTPKey(key) {
+		return ErrInvalidMFASecret
+	}
+
+	now := ms.cfg.now()
+	if !validTOTP(d.Secret, code, now) {
+		return ErrInvalidMFACode
+	}
+
+	if err := ms.checkMaxDevices(ctx, d.UserID); err != nil {
+		return err
+	}
+
+	if d.Name == "" {
+		d.Name = "Authenticator"
+	}
+	d.Method = ChallengeMethodTOTP
+	d.Phone = ""
+	d.Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	d.CreatedAt = now
+
+	if err := ms.MFADB.CreateDevice(ctx, d); err != nil {
+		return wrap("on enroll, failed to create mfa device", err)
+	}
+
+	return nil
+}
+
+func (ms *mfaService) EnrollSMS(ctx context.Context, d *MFADevice) error {
+	ctx, span := trace.StartSpan(ctx, "models.MFAService.EnrollSMS")
+	defer span.End()
+
+	phone, err := ValidatePhone(d.Phone)
+	if err != nil {
+		return err
+	}
+
+	if err := ms.checkMaxDevices(ctx, d.UserID); err != nil {
+		return err
+	}
+
+	if d.Name == "" {
+		d.Name = "Phone"
+	}
+	d.Method = ChallengeMethodSMS
+	d.Phone = phone
+	d.Secret = ""
+	d.Period = 0
+	d.Digits = 0
+	d.CreatedAt = ms.cfg.now()
+
+	if err := ms.MFADB.CreateDevice(ctx, d); err != nil {
+		return wrap("on enroll sms, failed to create mfa device", err)
+	}
+
+	return nil
+}
+
+// checkMaxDevices returns ErrTooManyMFADevices if the user already has the maximum number of devices.
+func (ms *mfaService) checkMaxDevices(ctx context.Context, userID int64) error {
+	if ms.cfg.MaxMFADevices <= 0 {
+		return nil
+	}
+
+	n, err := ms.MFADB.CountDevices(ctx, userID)
+	if err != nil {
+		return wrap("on enroll, failed to count mfa devices", err)
+	}
+
+	if n >= ms.cfg.MaxMFADevices {
+		return ErrTooManyMFADevices
+	}
+
+	return nil
+}
+
+func (ms *mfaService) Remove(ctx context.Context, userID, id int64) error {
+	ctx, span := trace.StartSpan(ctx, "models.MFAService.Remove")
+	defer span.End()
+
+	if ms.cfg.MFARequired {
+		n, err := ms.MFADB.CountDevices(ctx, userID)
+		if err != nil {
+			return wrap("on remove, failed to count mfa devices", err)
+		}
+
+		if n <= 1 {
+			// a missing device is reported as such, rather than as the last one.
+			devices, err := ms.MFADB.Devices(ctx, userID)
+			if err != nil {
+				return wrap("on remove, failed to obtain mfa devices", err)
+			}
+
+			for _, d := range devices {
+				if d.ID == id {
+					return ErrLastMFADevice
+				}
+			}
+
+			return ErrNotFound
+		}
+	}
+
+	return ms.MFADB.DeleteDevice(ctx, userID, id)
+}
+
+// weakTOTPKey reports whether key is unlikely to have been randomly generated, having few distinct byte
+// values, such as the keys made of a repeated character or a short repeated pattern.
+func weakTOTPKey(key []byte) bool {
+	seen := make(map[byte]bool, len(key))
+	for _, b := range key {
+		seen[b] = true
+	}
+
+	// random keys of the accepted lengths have almost as many distinct bytes as their length.
+	return len(seen) < len(key)/2
+}
+
+// validTOTP reports whether code is a valid TOTP code at time t for the base32 encoded secret, as defined
+// by RFC 6238 with the default SHA-1 hash and 6 digits.
+func validTOTP(secret, code string, t time.Time) bool {
+	key, err := totpKey(secret)
+	if err != nil || len(code) != 6 {
+		return false
+	}
+
+	counter := t.Unix() / int64(totpPeriod/time.Second)
+
+	valid := 0
+	for i := -totpSkew; i <= totpSkew; i++ {
+		valid |= subtle.ConstantTimeCompare([]byte(hotp(key, uint64(counter+int64(i)))), []byte(code))
+	}
+
+	return valid == 1
+}
+
+// totpKey decodes a base32 encoded TOTP secret, with or without padding.
+func totpKey(secret string) ([]byte, error) {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+// hotp returns the 6 digit HOTP code of key for counter, as defined by RFC 4226.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", bin%1000000)
+}
+
+type mfaGorm struct {
+	db *gorm.DB
+}
+
+func (mg *mfaGorm) CreateDevice(ctx context.Context, d *MFADevice) error {
+	ctx, span := trace.StartSpan(ctx, "mfa.Database.CreateDevice")
+	defer span.End()
+
+	err := mg.db.WithContext(ctx).Create(d).Error
+	if err != nil {
+		return wrap("could not create mfa device", err)
+	}
+
+	return nil
+}
+
+func (mg *mfaGorm) Devices(ctx context.Context, userID int64) ([]MFADevice, error) {
+	ctx, span := trace.StartSpan(ctx, "mfa.Database.Devices")
+	defer span.End()
+
+	var devices []MFADevice
+	err := mg.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at, id").Find(&devices).Error
+	if err != nil {
+		return nil, wrap("could not list mfa devices", err)
+	}
+
+	return devices, nil
+}
+
+func (mg *mfaGorm) CountDevices(ctx context.Context, userID int64) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "mfa.Database.CountDevices")
+	defer span.End()
+
+	var n int64
+	err := mg.db.WithContext(ctx).Model(&MFADevice{}).Where("user_id = ?", userID).Count(&n).Error
+	if err != nil {
+		return 0, wrap("could not count mfa devices", err)
+	}
+
+	return int(n), nil
+}
+
+func (mg *mfaGorm) DeleteUserData(ctx context.Context, userID int64) error {
+	ctx, span := trace.StartSpan(ctx, "mfa.Database.DeleteUserData")
+	defer span.End()
+
+	err := mg.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&MFADevice{}).Error
+	if err != nil {
+		return wrap("could not delete mfa devices of user", err)
+	}
+
+	return nil
+}
+
+func (mg *mfaGorm) DeleteDevice(ctx context.Context, userID, id int64) error {
+	ctx, span := trace.StartSpan(ctx, "mfa.Database.DeleteDevice")
+	defer span.End()
+
+	res := mg.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userID).Delete(&MFADevice{})
+	if res.Error != nil {
+		return wrap("could not delete mfa device", res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,338 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTOTPSecret is the base32 encoding of the RFC 6238 test secret "12345678901234567890".
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidTOTP(t *testing.T) {
+	// test vectors from RFC 6238, appendix B, truncated to 6 digits
+	var cases = []struct {
+		name string
+		at   int64
+		code string
+		out  bool
+	}{
+		{"vector59", 59, "287082", true},
+		{"vector1111111109", 1111111109, "081804", true},
+		{"vector1234567890", 1234567890, "005924", true},
+		{"previousStep", 1111111109 + 30, "081804", true},
+		{"tooOld", 1111111109 + 90, "081804", false},
+		{"wrongCode", 59, "287083", false},
+		{"shortCode", 59, "28708", false},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			assert.Equal(t, cs.out, validTOTP(testTOTPSecret, cs.code, time.Unix(cs.at, 0)))
+		})
+	}
+}
+
+func mustDecodeTOTPSecret(t *testing.T, secret string) []byte {
+	key, err := totpKey(secret)
+	require.NoError(t, err)
+	return key
+}
+
+func TestMFAService_VerifyLockout(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(59, 0)
+
+	ms := NewMFAService(nil, Config{
+		Now:            func() time.Time { return now },
+		MFAMaxAttempts: 3,
+		MFALockout:     15 * time.Minute,
+	})
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, ErrInvalidMFACode, ms.Verify(ctx, 888, testTOTPSecret, "000000"))
+	}
+
+	assert.Equal(t, ErrMFALocked, ms.Verify(ctx, 888, testTOTPSecret, "287082"), "locked even with a valid code")
+	assert.NoError(t, ms.Verify(ctx, 999, testTOTPSecret, "287082"), "other users are not locked")
+
+	t.Run("cooldownExpired", func(t *testing.T) {
+		now = time.Unix(59, 0).Add(16 * time.Minute)
+		code := hotp(mustDecodeTOTPSecret(t, testTOTPSecret), uint64(now.Unix()/30))
+
+		assert.NoError(t, ms.Verify(ctx, 888, testTOTPSecret, code))
+	})
+
+	t.Run("successResetsFailures", func(t *testing.T) {
+		code := hotp(mustDecodeTOTPSecret(t, testTOTPSecret), uint64(now.Unix()/30))
+
+		assert.Equal(t, ErrInvalidMFACode, ms.Verify(ctx, 777, testTOTPSecret, "000000"))
+		assert.Equal(t, ErrInvalidMFACode, ms.Verify(ctx, 777, testTOTPSecret, "000000"))
+		assert.NoError(t, ms.Verify(ctx, 777, testTOTPSecret, code))
+
+		assert.Equal(t, ErrInvalidMFACode, ms.Verify(ctx, 777, testTOTPSecret, "000000"))
+		assert.Equal(t, ErrInvalidMFACode, ms.Verify(ctx, 777, testTOTPSecret, "000000"))
+		assert.NoError(t, ms.Verify(ctx, 777, testTOTPSecret, code), "not locked after the reset")
+	})
+
+	t.Run("lockoutDisabled", func(t *testing.T) {
+		ms := NewMFAService(nil, Config{Now: func() time.Time { return now }})
+
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, ErrInvalidMFACode, ms.Verify(ctx, 888, testTOTPSecret, "000000"))
+		}
+	})
+}
+
+type testMFADB struct {
+	MFADB
+	devices []MFADevice
+	lastID  int64
+}
+
+func (t *testMFADB) CreateDevice(ctx context.Context, d *MFADevice) error {
+	t.lastID++
+	d.ID = t.lastID
+	t.devices = append(t.devices, *d)
+	return nil
+}
+
+func (t *testMFADB) Devices(ctx context.Context, userID int64) ([]MFADevice, error) {
+	var devices []MFADevice
+	for _, d := range t.devices {
+		if d.UserID == userID {
+			devices = append(devices, d)
+		}
+	}
+
+	return devices, nil
+}
+
+func (t *testMFADB) CountDevices(ctx context.Context, userID int64) (int, error) {
+	devices, _ := t.Devices(ctx, userID)
+	return len(devices), nil
+}
+
+func (t *testMFADB) DeleteDevice(ctx context.Context, userID, id int64) error {
+	for i, d := range t.devices {
+		if d.ID == id && d.UserID == userID {
+			t.devices = append(t.devices[:i], t.devices[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func TestMFAService_Enroll(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(59, 0)
+
+	var cases = []struct {
+		name      string
+		minBytes  int
+		device    MFADevice
+		code      string
+		outErr    error
+		outSecret string
+	}{
+		{
+			name:      "valid",
+			device:    MFADevice{Secret: testTOTPSecret},
+			code:      "287082",
+			outSecret: testTOTPSecret,
+		},
+		{
+			name:      "importedWithPadding",
+			device:    MFADevice{Secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq====", Period: 30, Digits: 6},
+			code:      "287082",
+			outSecret: testTOTPSecret,
+		},
+		{
+			// 10 bytes, the length of the secrets of some older authenticators.
+			name:   "tooShort",
+			device: MFADevice{Secret: "GEZDGNBVGY3TQOJQ"},
+			code:   "287082",
+			outErr: ErrInvalidMFASecret,
+		},
+		{
+			name:     "shorterThanConfigured",
+			minBytes: 32,
+			device:   MFADevice{Secret: testTOTPSecret},
+			code:     "287082",
+			outErr:   ErrInvalidMFASecret,
+		},
+		{
+			name:   "notRandom",
+			device: MFADevice{Secret: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"},
+			code:   hotp(make([]byte, 20), 1),
+			outErr: ErrInvalidMFASecret,
+		},
+		{
+			name:   "notBase32",
+			device: MFADevice{Secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJ1"},
+			code:   "287082",
+			outErr: ErrInvalidMFASecret,
+		},
+		{
+			name:   "unsupportedPeriod",
+			device: MFADevice{Secret: testTOTPSecret, Period: 60},
+			code:   "287082",
+			outErr: ErrInvalidMFASecret,
+		},
+		{
+			name:   "unsupportedDigits",
+			device: MFADevice{Secret: testTOTPSecret, Digits: 8},
+			code:   "94287082",
+			outErr: ErrInvalidMFASecret,
+		},
+		{
+			name:   "wrongCode",
+			device: MFADevice{Secret: testTOTPSecret},
+			code:   "000000",
+			outErr: ErrInvalidMFACode,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			db := &testMFADB{}
+			ms := NewMFAService(nil, Config{
+				Now:               func() time.Time { return now },
+				MFAMinSecretBytes: cs.minBytes,
+			})
+			ms.(*mfaService).MFADB = db
+
+			d := cs.device
+			d.UserID = 888
+			err := ms.Enroll(ctx, &d, cs.code)
+
+			assert.Equal(t, cs.outErr, err)
+			if cs.outErr != nil {
+				assert.Empty(t, db.devices)
+				return
+			}
+
+			require.Len(t, db.devices, 1)
+			assert.Equal(t, MFADevice{
+				ID:        1,
+				UserID:    888,
+				Name:      "Authenticator",
+				Method:    ChallengeMethodTOTP,
+				Secret:    cs.outSecret,
+				Period:    30,
+				Digits:    6,
+				CreatedAt: now.UTC(),
+			}, db.devices[0])
+		})
+	}
+}
+
+func TestMFAService_MaxDevices(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(59, 0)
+
+	db := &testMFADB{}
+	ms := NewMFAService(nil, Config{
+		Now:           func() time.Time { return now },
+		MaxMFADevices: 2,
+	})
+	ms.(*mfaService).MFADB = db
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, ms.Enroll(ctx, &MFADevice{UserID: 888, Secret: testTOTPSecret}, "287082"))
+	}
+
+	t.Run("capReached", func(t *testing.T) {
+		err := ms.Enroll(ctx, &MFADevice{UserID: 888, Secret: testTOTPSecret}, "287082")
+
+		assert.Equal(t, ErrTooManyMFADevices, err)
+	})
+
+	t.Run("otherUser", func(t *testing.T) {
+		err := ms.Enroll(ctx, &MFADevice{UserID: 999, Secret: testTOTPSecret}, "287082")
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("listed", func(t *testing.T) {
+		devices, err := ms.Devices(ctx, 888)
+		require.NoError(t, err)
+
+		require.Len(t, devices, 2)
+		assert.Equal(t, int64(1), devices[0].ID)
+		assert.Equal(t, int64(2), devices[1].ID)
+	})
+
+	t.Run("roomAfterRemoval", func(t *testing.T) {
+		require.NoError(t, ms.Remove(ctx, 888, 1))
+
+		err := ms.Enroll(ctx, &MFADevice{UserID: 888, Secret: testTOTPSecret}, "287082")
+
+		assert.NoError(t, err)
+	})
+}
+
+func TestMFAService_Remove(t *testing.T) {
+	ctx := context.Background()
+
+	var cases = []struct {
+		name     string
+		required bool
+		devices  []MFADevice
+		remove   int64
+		outErr   error
+		outLeft  int
+	}{
+		{
+			name:     "notLastRequired",
+			devices:  []MFADevice{{ID: 1, UserID: 888}, {ID: 2, UserID: 888}},
+			remove:   1,
+			required: true,
+			outLeft:  1,
+		},
+		{
+			name:     "lastRequired",
+			devices:  []MFADevice{{ID: 1, UserID: 888}, {ID: 2, UserID: 999}},
+			remove:   1,
+			required: true,
+			outErr:   ErrLastMFADevice,
+			outLeft:  1,
+		},
+		{
+			name:    "lastNotRequired",
+			devices: []MFADevice{{ID: 1, UserID: 888}},
+			remove:  1,
+			outLeft: 0,
+		},
+		{
+			name:     "otherUserDevice",
+			devices:  []MFADevice{{ID: 1, UserID: 888}, {ID: 2, UserID: 999}},
+			remove:   2,
+			required: true,
+			outErr:   ErrNotFound,
+			outLeft:  1,
+		},
+		{
+			name:    "missing",
+			devices: []MFADevice{{ID: 1, UserID: 888}, {ID: 2, UserID: 888}},
+			remove:  3,
+			outErr:  ErrNotFound,
+			outLeft: 2,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			db := &testMFADB{devices: cs.devices}
+			ms := NewMFAService(nil, Config{MFARequired: cs.required})
+			ms.(*mfaService).MFADB = db
+
+			err := ms.Remove(ctx, 888, cs.remove)
+
+			assert.Equal(t, cs.outErr, err)
+			n, _ := db.CountDevices(ctx, 888)
+			assert.Equal(t, cs.outLeft, n)
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"strings"
+)
+
+const (
+	// phoneMinDigits and phoneMaxDigits bound the digits of an E.164 number, country code included. The
+	// shortest numbers in use have 7 digits, and ITU-T E.164 allows up to 15.
+	phoneMinDigits = 7
+	phoneMaxDigits = 15
+)
+
+// ValidatePhone checks phone is an international phone number and returns it in E.164 form, that is a
+// plus sign followed by the country code and the subscriber number, such as "+442079460958", which is
+// the form phone numbers are stored in.
+//
+// Numbers must start with the plus sign or the 00 international prefix. Spaces, dots, hyphens and
+// parentheses used for grouping are removed, as is the "(0)" national trunk prefix some countries
+// write after the country code.
+//
+// It returns a ValidationError keyed on "phone" with ErrRequired or ErrPhoneInvalid.
+func ValidatePhone(phone string) (string, error) {
+	s := strings.TrimSpace(phone)
+	if s == "" {
+		return "", ValidationError{"phone": ErrRequired}
+	}
+
+	switch {
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	case strings.HasPrefix(s, "00"):
+		s = s[2:]
+	default:
+		return "", ValidationError{"phone": ErrPhoneInvalid}
+	}
+
+	s = strings.Replace(s, "(0)", "", 1)
+
+	digits := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c)
+		case c == ' ' || c == '.' || c == '-' || c == '(' || c == ')':
+		default:
+			return "", ValidationError{"phone": ErrPhoneInvalid}
+		}
+	}
+
+	// country codes never start with 0.
+	if len(digits) < phoneMinDigits || len(digits) > phoneMaxDigits || digits[0] == '0' {
+		return "", ValidationError{"phone": ErrPhoneInvalid}
+	}
+
+	return "+" + string(digits), nil
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePhone(t *testing.T) {
+	var cases = []struct {
+		name   string
+		phone  string
+		out    string
+		outErr error
+	}{
+		{"e164", "+442079460958", "+442079460958", nil},
+		{"grouped", "+44 20 7946 0958", "+442079460958", nil},
+		{"trunkPrefix", "+44 (0)20 7946 0958", "+442079460958", nil},
+		{"internationalPrefix", "0034 612-345-678", "+34612345678", nil},
+		{"northAmerica", "+1 (415) 555.2671", "+14155552671", nil},
+		{"japan", "+81 3-1234-5678", "+81312345678", nil},
+		{"shortest", "+683 4002", "+6834002", nil},
+		{"longest", "+86 138 0013 8000 12", "+861380013800012", nil},
+		{"empty", "  ", "", ValidationError{"phone": ErrRequired}},
+		{"national", "020 7946 0958", "", ValidationError{"phone": ErrPhoneInvalid}},
+		{"tooShort", "+683 400", "", ValidationError{"phone": ErrPhoneInvalid}},
+		{"tooLong", "+44 2079 4609 5812 34", "", ValidationError{"phone": ErrPhoneInvalid}},
+		{"letters", "+44 20 7946 CALL", "", ValidationError{"phone": ErrPhoneInvalid}},
+		{"countryCodeZero", "+0 20 7946 0958", "", ValidationError{"phone": ErrPhoneInvalid}},
+		{"extension", "+44 20 7946 0958 ext 12", "", ValidationError{"phone": ErrPhoneInvalid}},
+		{"doublePlus", "++442079460958", "", ValidationError{"phone": ErrPhoneInvalid}},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			got, err := ValidatePhone(cs.phone)
+
+			if cs.outErr != nil {
+				assert.Equal(t, cs.outErr, err)
+				assert.Empty(t, got)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, cs.out, got)
+		})
+	}
+}
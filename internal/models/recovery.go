@@ -0,0 +1,503 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+const (
+	// recoveryDuration is the time a user has to answer the security questions once the emailed
+	// recovery token is used.
+	recoveryDuration = 15 * time.Minute
+
+	// defaultRecoveryMaxAttempts and defaultRecoveryLockout apply when the configuration sets none.
+	defaultRecoveryMaxAttempts = 3
+	defaultRecoveryLockout     = 24 * time.Hour
+
+	// recoveryKeyPrefix and recoveryFailuresKeyPrefix prefix the keys of the recoveries in progress
+	// and of the failed attempts of the users in the ephemeral store.
+	recoveryKeyPrefix         = "recovery:"
+	recoveryFailuresKeyPrefix = "recoveryfail:"
+)
+
+// RecoveryService defines the methods used to let users without MFA recover their account, proving
+// they own its email address and, when configured, answering their security questions.
+type RecoveryService interface {
+	// SetAnswers replaces the security questions of the user with answers. Only a hash of the answers
+	// is stored; they are compared ignoring case and extra spaces. Users must set at least the number
+	// of questions asked in a recovery.
+	//
+	// It may return a ValidationError for the answers.
+	SetAnswers(ctx context.Context, userID int64, answers []SecurityAnswer) error
+
+	// Request sends a single use recovery token to the active user with the given email, when the user
+	// has no MFA devices and set enough security questions.
+	//
+	// It returns ErrNotFound if there is no such user, unless the service is in enumeration-safe mode.
+	// In that mode it returns nil after a similar time whether the user exists or not.
+	Request(ctx context.Context, email string) error
+
+	// Start uses the recovery token sent to the user, returning the recovery to complete with the
+	// answers to the security questions it holds.
+	//
+	// Errors returned include ErrUnauthorised, ErrTokenAlreadyUsed and ErrRecoveryLocked.
+	Start(ctx context.Context, token string) (Recovery, error)
+
+	// Complete sets password as the new password of the user once answers match the answers to the
+	// questions of the recovery, in order. After the configured number of failed attempts, the
+	// recovery is discarded and the recoveries of the user are locked for the lockout period. Like
+	// ResetService.Reset, it returns a new set of tokens when configured to log users in.
+	//
+	// Errors returned include ErrInvalidRecovery, ErrInvalidRecoveryAnswers, ErrRecoveryLocked and
+	// ValidationError values for the password field.
+	Complete(ctx context.Context, token string, answers []string, password string) (Token, error)
+
+	RecoveryDB
+}
+
+// RecoveryDB defines how the service interacts with the database.
+type RecoveryDB interface {
+	// ReplaceAnswers replaces the security answers of a user with the given ones.
+	ReplaceAnswers(context.Context, int64, []SecurityAnswer) error
+
+	// Answers returns the security answers of a user, in the order they were set.
+	Answers(context.Context, int64) ([]SecurityAnswer, error)
+}
+
+// A SecurityAnswer is the answer of a user to a security question, asked to recover the account.
+type SecurityAnswer struct {
+	ID       int64  `gorm:"primary_key;type:bigserial" json:"-"`
+	UserID   int64  `gorm:"not null;index" json:"-"`
+	Question string `gorm:"size:255;not null" json:"question"`
+
+	// Answer is the answer in clear, only set when the answers are being set.
+	Answer string `gorm:"-" json:"answer,omitempty"`
+
+	// Hash is the bcrypt hash of the normalised answer.
+	Hash string `gorm:"size:255;not null" json:"-"`
+
+	CreatedAt time.Time `gorm:"not null" json:"-"`
+}
+
+// A Recovery is an account recovery in progress, once the user proved they own the email address of
+// the account.
+type Recovery struct {
+	Token     string   `json:"recovery_token"`
+	Questions []string `json:"questions"`
+	ExpiresIn int64    `json:"expires_in"`
+}
+
+// storedRecovery is the recovery kept in the ephemeral store, under the hash of its token.
+type storedRecovery struct {
+	UserID    int64     `json:"uid"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+type recoveryService struct {
+	RecoveryDB
+
+	us    UserService
+	ts    ActionTokenService
+	mfa   MFAService
+	store EphemeralStore
+	cfg   Config
+}
+
+// NewRecoveryService instantiates a new RecoveryService implementation with db as the backing database of
+// the security answers. Users are found and updated through us, and the recovery tokens are issued through
+// ts and delivered by cfg.Notifier, which must be set. Users with devices in mfa cannot recover their
+// account. The recoveries in progress and the failed attempts are kept in store.
+func NewRecoveryService(db *gorm.DB, us UserService, ts ActionTokenService, mfa MFAService, store EphemeralStore, cfg Config) RecoveryService {
+	return &recoveryService{
+		RecoveryDB: &recoveryGorm{db},
+		us:         us,
+		ts:         ts,
+		mfa:        mfa,
+		store:      store,
+		cfg:        cfg,
+	}
+}
+
+func (rs *recoveryService) SetAnswers(ctx context.Context, userID int64, answers []SecurityAnswer) error {
+	ctx, span := trace.StartSpan(ctx, "models.RecoveryService.SetAnswers")
+	defer span.End()
+
+	if len(answers) < rs.cfg.RecoveryQuestions {
+		return ValidationError{"answers": ErrTooShort}
+	}
+
+	now := rs.cfg.now()
+	stored := make([]SecurityAnswer, len(answers))
+	for i, a := range answers {
+		question, answer := strings.TrimSpace(a.Question), normaliseAnswer(a.Answer)
+		if question == "" || answer == "" {
+			return ValidationError{"answers": ErrRequired}
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(answer), bcrypt.DefaultCost)
+		if err != nil {
+			return wrap("on set answers, failed to hash answer", err)
+		}
+
+		stored[i] = SecurityAnswer{
+			UserID:    userID,
+			Question:  question,
+			Hash:      string(hash),
+			CreatedAt: now,
+		}
+	}
+
+	return rs.RecoveryDB.ReplaceAnswers(ctx, userID, stored)
+}
+
+func (rs *recoveryService) Request(ctx context.Context, email string) error {
+	ctx, span := trace.StartSpan(ctx, "models.RecoveryService.Request")
+	defer span.End()
+
+	start := time.Now()
+	if rs.cfg.EnumerationSafe {
+		defer waitUniform(start)
+	}
+
+	user, err := rs.us.ByEmail(ctx, email)
+	if err != nil {
+		if verr := ValidationError(nil); xerrors.Is(err, ErrNotFound) || xerrors.As(err, &verr) {
+			return rs.notFound()
+		}
+
+		return wrap("on recovery request, failed to obtain user from database", err)
+	}
+
+	if !user.Active {
+		return rs.notFound()
+	}
+
+	// users with MFA devices recover their account through them, so the recovery cannot bypass them.
+	if n, err := rs.mfa.CountDevices(ctx, user.ID); err != nil || n > 0 {
+		if err != nil {
+			return wrap("on recovery request, failed to count mfa devices", err)
+		}
+
+		return rs.notFound()
+	}
+
+	answers, err := rs.RecoveryDB.Answers(ctx, user.ID)
+	if err != nil {
+		return wrap("on recovery request, failed to obtain security answers", err)
+	}
+
+	if len(answers) < rs.cfg.RecoveryQuestions {
+		return rs.notFound()
+	}
+
+	if locked, err := rs.locked(ctx, user.ID); err != nil || locked {
+		if err != nil {
+			return err
+		}
+
+		return rs.notFound()
+	}
+
+	token, err := rs.ts.Issue(ctx, user.ID, PurposeRecovery, true)
+	if err != nil {
+		return err
+	}
+
+	if err := rs.cfg.Notifier.SendRecovery(ctx, user, token); err != nil {
+		return wrap("on recovery request, failed to send recovery token", err)
+	}
+
+	return nil
+}
+
+// notFound returns the error for a recovery requested for a user who cannot recover their account.
+func (rs *recoveryService) notFound() error {
+	if rs.cfg.EnumerationSafe {
+		return nil
+	}
+
+	return ErrNotFound
+}
+
+func (rs *recoveryService) Start(ctx context.Context, token string) (Recovery, error) {
+	ctx, span := trace.StartSpan(ctx, "models.RecoveryService.Start")
+	defer span.End()
+
+	uid, err := rs.ts.Consume(ctx, token, PurposeRecovery)
+	if err != nil {
+		return Recovery{}, err
+	}
+
+	if locked, err := rs.locked(ctx, uid); err != nil || locked {
+		if err != nil {
+			return Recovery{}, err
+		}
+
+		return Recovery{}, ErrRecoveryLocked
+	}
+
+	answers, err := rs.RecoveryDB.Answers(ctx, uid)
+	if err != nil {
+		return Recovery{}, wrap("on recovery start, failed to obtain security answers", err)
+	}
+
+	rt, err := randomToken(32)
+	if err != nil {
+		return Recovery{}, err
+	}
+
+	sr := storedRecovery{
+		UserID:    uid,
+		ExpiresAt: rs.cfg.now().Add(recoveryDuration),
+	}
+	b, err := json.Marshal(sr)
+	if err != nil {
+		return Recovery{}, err
+	}
+
+	if err := rs.store.Set(ctx, recoveryKeyPrefix+hashChallengeToken(rt), b, recoveryDuration); err != nil {
+		return Recovery{}, wrap("on recovery start, failed to store recovery", err)
+	}
+
+	questions := []string{}
+	for _, a := range rs.asked(answers) {
+		questions = append(questions, a.Question)
+	}
+
+	return Recovery{
+		Token:     rt,
+		Questions: questions,
+		ExpiresIn: int64(recoveryDuration / time.Second),
+	}, nil
+}
+
+func (rs *recoveryService) Complete(ctx context.Context, token string, answers []string, password string) (Token, error) {
+	ctx, span := trace.StartSpan(ctx, "models.RecoveryService.Complete")
+	defer span.End()
+
+	if password == "" {
+		return Token{}, ValidationError{"password": ErrRequired}
+	}
+
+	key := recoveryKeyPrefix + hashChallengeToken(token)
+	sr, err := rs.load(ctx, rs.store.Get, key)
+	if err != nil {
+		return Token{}, err
+	}
+
+	if locked, err := rs.locked(ctx, sr.UserID); err != nil || locked {
+		if err != nil {
+			return Token{}, err
+		}
+
+		_ = rs.store.Delete(ctx, key)
+		return Token{}, ErrRecoveryLocked
+	}
+
+	stored, err := rs.RecoveryDB.Answers(ctx, sr.UserID)
+	if err != nil {
+		return Token{}, wrap("on recovery, failed to obtain security answers", err)
+	}
+
+	if !matchAnswers(rs.asked(stored), answers) {
+		locked, err := rs.fail(ctx, sr.UserID)
+		if err != nil {
+			return Token{}, err
+		}
+
+		if locked {
+			_ = rs.store.Delete(ctx, key)
+			return Token{}, ErrRecoveryLocked
+		}
+
+		return Token{}, ErrInvalidRecoveryAnswers
+	}
+
+	// the recovery is single use, so concurrent completions only succeed once.
+	if _, err := rs.load(ctx, rs.store.Take, key); err != nil {
+		return Token{}, err
+	}
+
+	user, err := rs.us.ByID(ctx, sr.UserID)
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return Token{}, ErrInvalidRecovery
+		}
+
+		return Token{}, wrap("on recovery, failed to obtain user from database", err)
+	}
+
+	user.Password = password
+	if err := rs.us.Update(ctx, &user); err != nil {
+		return Token{}, err
+	}
+
+	_ = rs.store.Delete(ctx, recoveryFailuresKeyPrefix+strconv.FormatInt(user.ID, 10))
+
+	if !rs.cfg.ResetAutoLogin {
+		return Token{}, nil
+	}
+
+	return rs.us.Token(ctx, &user)
+}
+
+// asked returns the answers to the questions asked in a recovery, which are all the questions the user
+// set when security questions are configured, and none otherwise.
+func (rs *recoveryService) asked(answers []SecurityAnswer) []SecurityAnswer {
+	if rs.cfg.RecoveryQuestions <= 0 {
+		return nil
+	}
+
+	return answers
+}
+
+// load reads the recovery stored under key with get, returning ErrInvalidRecovery if there is none or
+// it has expired.
+func (rs *recoveryService) load(ctx context.Context, get func(context.Context, string) ([]byte, error), key string) (storedRecovery, error) {
+	b, err := get(ctx, key)
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return storedRecovery{}, ErrInvalidRecovery
+		}
+
+		return storedRecovery{}, wrap("failed to obtain recovery", err)
+	}
+
+	var sr storedRecovery
+	if err := json.Unmarshal(b, &sr); err != nil {
+		return storedRecovery{}, wrap("failed to decode recovery", err)
+	}
+
+	if !rs.cfg.now().Before(sr.ExpiresAt) {
+		return storedRecovery{}, ErrInvalidRecovery
+	}
+
+	return sr, nil
+}
+
+// failures returns the number of failed recovery attempts of the user within the lockout period.
+func (rs *recoveryService) failures(ctx context.Context, userID int64) (int, error) {
+	b, err := rs.store.Get(ctx, recoveryFailuresKeyPrefix+strconv.FormatInt(userID, 10))
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return 0, nil
+		}
+
+		return 0, wrap("failed to obtain recovery failures", err)
+	}
+
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return 0, wrap("failed to decode recovery failures", err)
+	}
+
+	return n, nil
+}
+
+// locked reports whether the recoveries of the user are locked after too many failed attempts.
+func (rs *recoveryService) locked(ctx context.Context, userID int64) (bool, error) {
+	n, err := rs.failures(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return n >= rs.cfg.recoveryMaxAttempts(), nil
+}
+
+// fail records a failed recovery attempt of the user, reporting whether the recoveries of the user are
+// locked as a result. The lockout period starts again with every failure.
+func (rs *recoveryService) fail(ctx context.Context, userID int64) (bool, error) {
+	n, err := rs.failures(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	n++
+	key := recoveryFailuresKeyPrefix + strconv.FormatInt(userID, 10)
+	if err := rs.store.Set(ctx, key, []byte(strconv.Itoa(n)), rs.cfg.recoveryLockout()); err != nil {
+		return false, wrap("failed to store recovery failures", err)
+	}
+
+	return n >= rs.cfg.recoveryMaxAttempts(), nil
+}
+
+// matchAnswers reports whether answers match the stored ones, in order. Every answer is checked, so the
+// time taken does not tell which one is wrong.
+func matchAnswers(stored []SecurityAnswer, answers []string) bool {
+	match := len(stored) == len(answers)
+	for i, s := range stored {
+		var answer string
+		if i < len(answers) {
+			answer = answers[i]
+		}
+
+		err := bcrypt.CompareHashAndPassword([]byte(s.Hash), []byte(normaliseAnswer(answer)))
+		match = err == nil && match
+	}
+
+	return match
+}
+
+// normaliseAnswer returns answer in lower case, without leading, trailing or repeated spaces.
+func normaliseAnswer(answer string) string {
+	return strings.ToLower(strings.Join(strings.Fields(answer), " "))
+}
+
+type recoveryGorm struct {
+	db *gorm.DB
+}
+
+func (rg *recoveryGorm) ReplaceAnswers(ctx context.Context, userID int64, answers []SecurityAnswer) error {
+	ctx, span := trace.StartSpan(ctx, "recovery.Database.ReplaceAnswers")
+	defer span.End()
+
+	err := rg.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&SecurityAnswer{}).Error; err != nil {
+			return err
+		}
+
+		if len(answers) == 0 {
+			return nil
+		}
+
+		return tx.Create(&answers).Error
+	})
+	if err != nil {
+		return wrap("could not replace security answers", err)
+	}
+
+	return nil
+}
+
+func (rg *recoveryGorm) DeleteUserData(ctx context.Context, userID int64) error {
+	ctx, span := trace.StartSpan(ctx, "recovery.Database.DeleteUserData")
+	defer span.End()
+
+	err := rg.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&SecurityAnswer{}).Error
+	if err != nil {
+		return wrap("could not delete security answers of user", err)
+	}
+
+	return nil
+}
+
+func (rg *recoveryGorm) Answers(ctx context.Context, userID int64) ([]SecurityAnswer, error) {
+	ctx, span := trace.StartSpan(ctx, "recovery.Database.Answers")
+	defer span.End()
+
+	var answers []SecurityAnswer
+	err := rg.db.WithContext(ctx).Where("user_id = ?", userID).Order("id").Find(&answers).Error
+	if err != nil {
+		return nil, wrap("could not list security answers", err)
+	}
+
+	return answers, nil
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/xerrors"
+)
+
+type testRecoveryDB struct {
+	answers map[int64][]SecurityAnswer
+}
+
+func (t *testRecoveryDB) ReplaceAnswers(ctx context.Context, userID int64, answers []SecurityAnswer) error {
+	t.answers[userID] = answers
+	return nil
+}
+
+func (t *testRecoveryDB) Answers(ctx context.Context, userID int64) ([]SecurityAnswer, error) {
+	return t.answers[userID], nil
+}
+
+func testRecoveryService(t *testing.T, cfg Config) (RecoveryService, *testUserDB, *testNotifier) {
+	t.Helper()
+
+	user := User{ID: 88, Active: true, Email: "auseremail@name.com", FirstName: "John", Country: "GB"}
+	tudb := &testUserDB{
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			if e == user.Email {
+				return user, nil
+			}
+
+			return User{}, ErrNotFound
+		},
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return user, nil
+		},
+		update: func(ctx context.Context, u *User) error {
+			user = *u
+			return nil
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), cfg)
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	ts := NewActionTokenService(nil, []byte(testJWTSecret), cfg)
+	ts.(*actionTokenService).ActionTokenDB = &testActionTokenDB{used: map[string]bool{}}
+
+	ms := NewMFAService(nil, cfg)
+	ms.(*mfaService).MFADB = &testMFADB{}
+
+	n := &testNotifier{tokens: map[int64]string{}}
+	cfg.Notifier = n
+
+	rs := NewRecoveryService(nil, us, ts, ms, NewMemoryStore(cfg), cfg)
+	rs.(*recoveryService).RecoveryDB = &testRecoveryDB{answers: map[int64][]SecurityAnswer{}}
+
+	require.NoError(t, rs.SetAnswers(context.Background(), 88, []SecurityAnswer{
+		{Question: "First pet?", Answer: "Rex"},
+		{Question: "Birth city?", Answer: "  San   Sebastián "},
+	}))
+
+	return rs, tudb, n
+}
+
+func TestRecoveryService_Complete(t *testing.T) {
+	ctx := context.Background()
+	rs, tudb, n := testRecoveryService(t, Config{RecoveryQuestions: 2})
+
+	var updated User
+	tudb.update = func(ctx context.Context, u *User) error {
+		updated = *u
+		return nil
+	}
+
+	require.NoError(t, rs.Request(ctx, "auseremail@name.com"))
+
+	rec, err := rs.Start(ctx, n.tokens[88])
+	require.NoError(t, err)
+	assert.NotEmpty(t, rec.Token)
+	assert.Equal(t, []string{"First pet?", "Birth city?"}, rec.Questions)
+
+	// the emailed token is single use.
+	_, err = rs.Start(ctx, n.tokens[88])
+	assert.True(t, xerrors.Is(err, ErrTokenAlreadyUsed), "got %v", err)
+
+	_, err = rs.Complete(ctx, rec.Token, []string{"rex", "san sebastián"}, "7vb6sCaHrV5DfV6wE7i9QdGC")
+	require.NoError(t, err)
+	assert.Equal(t, int64(88), updated.ID)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(updated.Password), []byte("7vb6sCaHrV5DfV6wE7i9QdGC")))
+
+	_, err = rs.Complete(ctx, rec.Token, []string{"rex", "san sebastián"}, "7vb6sCaHrV5DfV6wE7i9QdGC")
+	assert.Equal(t, ErrInvalidRecovery, err)
+}
+
+func TestRecoveryService_Lockout(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	rs, _, n := testRecoveryService(t, Config{
+		Now:                 func() time.Time { return now },
+		RecoveryQuestions:   2,
+		RecoveryMaxAttempts: 3,
+		RecoveryLockout:     time.Hour,
+	})
+
+	start := func() Recovery {
+		require.NoError(t, rs.Request(ctx, "auseremail@name.com"))
+		rec, err := rs.Start(ctx, n.tokens[88])
+		require.NoError(t, err)
+		return rec
+	}
+
+	rec := start()
+	for i := 0; i < 2; i++ {
+		_, err := rs.Complete(ctx, rec.Token, []string{"rex", "paris"}, "7vb6sCaHrV5DfV6wE7i9QdGC")
+		assert.Equal(t, ErrInvalidRecoveryAnswers, err)
+	}
+
+	// a new recovery does not reset the failed attempts.
+	rec = start()
+	_, err := rs.Complete(ctx, rec.Token, []string{"rex"}, "7vb6sCaHrV5DfV6wE7i9QdGC")
+	assert.Equal(t, ErrRecoveryLocked, err)
+
+	// once locked, the right answers are rejected and no recovery can be started.
+	_, err = rs.Complete(ctx, rec.Token, []string{"rex", "san sebastián"}, "7vb6sCaHrV5DfV6wE7i9QdGC")
+	assert.Equal(t, ErrInvalidRecovery, err)
+	assert.Equal(t, ErrNotFound, rs.Request(ctx, "auseremail@name.com"))
+
+	now = now.Add(time.Hour)
+	rec = start()
+	_, err = rs.Complete(ctx, rec.Token, []string{"Rex", "San Sebastián"}, "7vb6sCaHrV5DfV6wE7i9QdGC")
+	assert.NoError(t, err)
+}
+
+func TestRecoveryService_Request(t *testing.T) {
+	ctx := context.Background()
+
+	var cases = []struct {
+		name      string
+		email     string
+		devices   []MFADevice
+		questions int
+		outErr    error
+	}{
+		{
+			name:      "sent",
+			email:     "auseremail@name.com",
+			questions: 2,
+		},
+		{
+			name:      "missing",
+			email:     "other@name.com",
+			questions: 2,
+			outErr:    ErrNotFound,
+		},
+		{
+			name:      "mfaUser",
+			email:     "auseremail@name.com",
+			devices:   []MFADevice{{UserID: 88, Method: ChallengeMethodTOTP}},
+			questions: 2,
+			outErr:    ErrNotFound,
+		},
+		{
+			name:      "tooFewQuestions",
+			email:     "auseremail@name.com",
+			questions: 3,
+			outErr:    ErrNotFound,
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			rs, _, n := testRecoveryService(t, Config{RecoveryQuestions: 2})
+			rs.(*recoveryService).mfa.(*mfaService).MFADB = &testMFADB{devices: cs.devices}
+			rs.(*recoveryService).cfg.RecoveryQuestions = cs.questions
+
+			err := rs.Request(ctx, cs.email)
+
+			assert.Equal(t, cs.outErr, err)
+			if cs.outErr == nil {
+				assert.NotEmpty(t, n.tokens[88])
+			} else {
+				assert.Empty(t, n.tokens)
+			}
+		})
+	}
+}
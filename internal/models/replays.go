@@ -0,0 +1,76 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshReplays keeps the tokens issued when rotating a refresh token for a short window, keyed on the
+// digest of the refresh token presented and of the options of the request. A client retrying a refresh
+// whose response was lost gets the same tokens again instead of rotating once more, while a request with
+// other options, such as another scope or client, is rotated as usual. Instances do not share their entries, so retries
+// reaching another instance are rotated as usual.
+type refreshReplays struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]refreshReplay
+}
+
+type refreshReplay struct {
+	token   Token
+	expires time.Time
+}
+
+// newRefreshReplays instantiates a refreshReplays keeping the tokens for cfg.RefreshIdempotencyWindow.
+// It returns nil when the window is zero, which disables the replays.
+func newRefreshReplays(cfg Config) *refreshReplays {
+	if cfg.RefreshIdempotencyWindow <= 0 {
+		return nil
+	}
+
+	return &refreshReplays{
+		window:  cfg.RefreshIdempotencyWindow,
+		now:     cfg.now,
+		entries: make(map[string]refreshReplay),
+	}
+}
+
+// Get returns the tokens issued for refreshToken with opts within the window, if any.
+func (rr *refreshReplays) Get(refreshToken string, opts RotateOptions) (Token, bool) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	e, ok := rr.entries[replayKey(refreshToken, opts)]
+	if !ok || !rr.now().Before(e.expires) {
+		return Token{}, false
+	}
+
+	return e.token, true
+}
+
+// Put keeps tok as the tokens issued for refreshToken with opts, dropping the entries out of the window.
+func (rr *refreshReplays) Put(refreshToken string, opts RotateOptions, tok Token) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	now := rr.now()
+	for k, e := range rr.entries {
+		if !now.Before(e.expires) {
+			delete(rr.entries, k)
+		}
+	}
+
+	rr.entries[replayKey(refreshToken, opts)] = refreshReplay{token: tok, expires: now.Add(rr.window)}
+}
+
+// replayKey returns the digest the tokens issued for refreshToken with opts are kept under, so refresh
+// tokens are not held in memory.
+func replayKey(refreshToken string, opts RotateOptions) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{refreshToken, opts.Scope, opts.MaxAge.String(), opts.ClientID}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserService_RotateIdempotent(t *testing.T) {
+	ctx := context.Background()
+
+	revoked := map[string]RevokedToken{}
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+		revokeTokenID: func(ctx context.Context, rt *RevokedToken) error {
+			revoked[rt.ID] = *rt
+			return nil
+		},
+		tokenIDRevoked: func(ctx context.Context, userID int64, id string) (bool, error) {
+			_, ok := revoked[id]
+			return ok, nil
+		},
+	}
+
+	newService := func(now *time.Time, cfg Config) UserService {
+		cfg.Now = func() time.Time { return *now }
+		us := NewUserService(nil, []byte(testJWTSecret), cfg)
+		us.(*userService).UserService.(*userValidator).UserDB = tudb
+		return us
+	}
+
+	t.Run("retryWithinWindow", func(t *testing.T) {
+		now := time.Now()
+		us := newService(&now, Config{RefreshIdempotencyWindow: 10 * time.Second})
+
+		tok, err := us.Token(ctx, &User{ID: 999})
+		require.NoError(t, err)
+
+		first, err := us.Rotate(ctx, tok.RefreshToken)
+		require.NoError(t, err)
+
+		now = now.Add(5 * time.Second)
+		retried, err := us.Rotate(ctx, tok.RefreshToken)
+		require.NoError(t, err)
+		assert.Equal(t, first, retried, "the retry gets the tokens already issued")
+
+		now = now.Add(10 * time.Second)
+		late, err := us.Rotate(ctx, tok.RefreshToken)
+		require.NoError(t, err)
+		assert.NotEqual(t, first, late, "the token is rotated again once the window is over")
+	})
+
+	t.Run("retryWithOtherOptions", func(t *testing.T) {
+		now := time.Now()
+		us := newService(&now, Config{RefreshIdempotencyWindow: 10 * time.Second, RefreshScopeReauth: true})
+
+		tok, err := us.ClientToken(ctx, &User{ID: 999}, &Client{ID: "app"}, "read", "write")
+		require.NoError(t, err)
+
+		first, err := us.RotateWith(ctx, tok.RefreshToken, RotateOptions{Scope: "read", ClientID: "app"})
+		require.NoError(t, err)
+
+		retried, err := us.RotateWith(ctx, tok.RefreshToken, RotateOptions{Scope: "read write", ClientID: "app"})
+		require.NoError(t, err)
+		assert.NotEqual(t, first, retried, "the tokens of another scope are not replayed")
+
+		cl, err := us.Validate(ctx, retried.AccessToken)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"read", "write"}, cl.Scopes)
+
+		_, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{Scope: "read", ClientID: "other"})
+		assert.Equal(t, ErrUnauthorised, err, "the tokens of another client are not replayed")
+
+		again, err := us.RotateWith(ctx, tok.RefreshToken, RotateOptions{Scope: "read", ClientID: "app"})
+		require.NoError(t, err)
+		assert.Equal(t, first, again)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		now := time.Now()
+		us := newService(&now, Config{})
+
+		tok, err := us.Token(ctx, &User{ID: 999})
+		require.NoError(t, err)
+
+		first, err := us.Rotate(ctx, tok.RefreshToken)
+		require.NoError(t, err)
+		retried, err := us.Rotate(ctx, tok.RefreshToken)
+		require.NoError(t, err)
+		assert.NotEqual(t, first, retried)
+	})
+
+	var cases = []struct {
+		name    string
+		recheck bool
+		outErr  error
+	}{
+		{"revokedWithRecheck", true, ErrUnauthorised},
+		{"revokedWithoutRecheck", false, nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now := time.Now()
+			us := newService(&now, Config{RefreshIdempotencyWindow: 10 * time.Second, RefreshIdempotencyRecheck: cs.recheck})
+
+			tok, err := us.Token(ctx, &User{ID: 999})
+			require.NoError(t, err)
+
+			first, err := us.Rotate(ctx, tok.RefreshToken)
+			require.NoError(t, err)
+			require.NoError(t, us.RevokeToken(ctx, tok.RefreshToken))
+
+			retried, err := us.Rotate(ctx, tok.RefreshToken)
+			assert.Equal(t, cs.outErr, err)
+			if cs.outErr == nil {
+				assert.Equal(t, first, retried)
+			}
+		})
+	}
+}
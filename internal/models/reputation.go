@@ -0,0 +1,97 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+// reputationBuckets is the number of intervals the reputation window is split into. Older intervals are
+// dropped as a whole as time passes.
+const reputationBuckets = 10
+
+// loginReputation tracks the outcome of the login attempts made to the whole service within a sliding
+// window. When the share of failed attempts rises over a threshold, which indicates a coordinated attack
+// rather than a single user mistyping a password, the reputation is elevated and logins get extra
+// friction until the failure rate goes back down.
+type loginReputation struct {
+	rate        float64
+	minAttempts int
+	bucketSize  time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	buckets [reputationBuckets]reputationBucket
+}
+
+type reputationBucket struct {
+	start              time.Time
+	attempts, failures int
+}
+
+// newLoginReputation instantiates a loginReputation using the thresholds in cfg. It returns nil when
+// cfg.GlobalFailureRate is zero, which disables the global reputation.
+func newLoginReputation(cfg Config) *loginReputation {
+	if cfg.GlobalFailureRate <= 0 {
+		return nil
+	}
+
+	window := cfg.GlobalFailureWindow
+	if window <= 0 {
+		window = time.Minute
+	}
+
+	return &loginReputation{
+		rate:        cfg.GlobalFailureRate,
+		minAttempts: cfg.GlobalFailureMinAttempts,
+		bucketSize:  window / reputationBuckets,
+		now:         cfg.now,
+	}
+}
+
+// bucket returns the bucket for the interval containing now, resetting it if it was used for an older
+// interval. The caller must hold lr.mu.
+func (lr *loginReputation) bucket(now time.Time) *reputationBucket {
+	start := now.Truncate(lr.bucketSize)
+	b := &lr.buckets[start.UnixNano()/int64(lr.bucketSize)%reputationBuckets]
+	if !b.start.Equal(start) {
+		*b = reputationBucket{start: start}
+	}
+
+	return b
+}
+
+// Record adds the outcome of a login attempt.
+func (lr *loginReputation) Record(failed bool) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	b := lr.bucket(lr.now())
+	b.attempts++
+	if failed {
+		b.failures++
+	}
+}
+
+// Elevated reports whether the failure rate within the window is over the threshold, with at least the
+// minimum number of attempts made.
+func (lr *loginReputation) Elevated() bool {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	now := lr.now()
+	oldest := now.Truncate(lr.bucketSize).Add(-lr.bucketSize * (reputationBuckets - 1))
+
+	var attempts, failures int
+	for _, b := range lr.buckets {
+		if !b.start.Before(oldest) && !b.start.After(now) {
+			attempts += b.attempts
+			failures += b.failures
+		}
+	}
+
+	if attempts == 0 || attempts < lr.minAttempts {
+		return false
+	}
+
+	return float64(failures)/float64(attempts) >= lr.rate
+}
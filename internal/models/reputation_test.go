@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginReputation_Elevated(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	lr := newLoginReputation(Config{
+		Now:                      func() time.Time { return now },
+		GlobalFailureRate:        0.5,
+		GlobalFailureWindow:      time.Minute,
+		GlobalFailureMinAttempts: 20,
+	})
+
+	// regular traffic with some users mistyping their password
+	for i := 0; i < 30; i++ {
+		lr.Record(i%5 == 0)
+		now = now.Add(time.Second)
+	}
+	assert.False(t, lr.Elevated())
+
+	// a spike of failures raises the friction
+	for i := 0; i < 60; i++ {
+		lr.Record(true)
+	}
+	assert.True(t, lr.Elevated())
+
+	// the failures age out of the window
+	now = now.Add(time.Minute)
+	assert.False(t, lr.Elevated())
+
+	t.Run("minAttempts", func(t *testing.T) {
+		for i := 0; i < 19; i++ {
+			lr.Record(true)
+		}
+		assert.False(t, lr.Elevated())
+
+		lr.Record(true)
+		assert.True(t, lr.Elevated())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, newLoginReputation(Config{}))
+	})
+}
+
+func TestUserService_AuthenticateGlobalFriction(t *testing.T) {
+	ctx := context.Background()
+	tudb := &testUserDB{
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			return User{}, ErrNotFound
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{
+		GlobalFailureRate:        0.8,
+		GlobalFailureMinAttempts: 3,
+		GlobalFrictionDelay:      50 * time.Millisecond,
+	})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+	lr := us.(*userService).reputation
+	require.NotNil(t, lr)
+
+	// missing credentials are not counted
+	_, err := us.Authenticate(ctx, "", "")
+	assert.Equal(t, ErrNoCredentials, err)
+	assert.False(t, lr.Elevated())
+
+	for i := 0; i < 3; i++ {
+		_, err := us.Authenticate(ctx, "auseremail@name.com", "password")
+		assert.Equal(t, ErrUnauthorised, err)
+	}
+	assert.True(t, lr.Elevated())
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/xerrors"
+)
+
+// A Notifier delivers messages to users through a channel external to the API, such as email.
+type Notifier interface {
+	// SendReset sends u the token allowing them to reset their password.
+	SendReset(ctx context.Context, u User, token string) error
+
+	// SendRecovery sends u the token starting the recovery of their account.
+	SendRecovery(ctx context.Context, u User, token string) error
+
+	// SendChallenge sends u the code completing the challenge of a risky login.
+	SendChallenge(ctx context.Context, u User, code string) error
+
+	// SendSMS sends the code of an MFA step or of a phone verification by SMS to phone, a number of u in
+	// E.164 form.
+	SendSMS(ctx context.Context, u User, phone, code string) error
+}
+
+// ResetService defines the methods used to let users reset a forgotten password.
+type ResetService interface {
+	// Request sends a single use reset token to the active user with the given email.
+	//
+	// It returns ErrNotFound if there is no such user, unless the service is in enumeration-safe mode.
+	// In that mode it returns nil after a similar time whether the user exists or not.
+	Request(ctx context.Context, email string) error
+
+	// Reset sets password as the new password of the user the reset token was issued to. When the
+	// service is configured to log users in after a reset, it returns a new set of tokens for the user;
+	// the returned Token is empty otherwise, and the user must login with the new password.
+	//
+	// Errors returned include ErrUnauthorised, ErrTokenAlreadyUsed and ValidationError values for the
+	// password field.
+	Reset(ctx context.Context, token, password string) (Token, error)
+}
+
+type resetService struct {
+	us  UserService
+	ts  ActionTokenService
+	cfg Config
+}
+
+// NewResetService instantiates a new ResetService implementation that finds and updates users through us,
+// and issues the reset tokens through ts. The tokens are delivered by cfg.Notifier, which must be set.
+func NewResetService(us UserService, ts ActionTokenService, cfg Config) ResetService {
+	return &resetService{
+		us:  us,
+		ts:  ts,
+		cfg: cfg,
+	}
+}
+
+func (rs *resetService) Request(ctx context.Context, email string) error {
+	ctx, span := trace.StartSpan(ctx, "models.ResetService.Request")
+	defer span.End()
+
+	start := time.Now()
+	if rs.cfg.EnumerationSafe {
+		defer waitUniform(start)
+	}
+
+	user, err := rs.us.ByEmail(ctx, email)
+	if err != nil {
+		if verr := ValidationError(nil); xerrors.Is(err, ErrNotFound) || xerrors.As(err, &verr) {
+			return rs.notFound()
+		}
+
+		return wrap("on reset request, failed to obtain user from database", err)
+	}
+
+	if !user.Active {
+		return rs.notFound()
+	}
+
+	token, err := rs.ts.Issue(ctx, user.ID, PurposeReset, true)
+	if err != nil {
+		return err
+	}
+
+	if err := rs.cfg.Notifier.SendReset(ctx, user, token); err != nil {
+		return wrap("on reset request, failed to send reset token", err)
+	}
+
+	return nil
+}
+
+// notFound returns the error for a reset requested for a missing or inactive user.
+func (rs *resetService) notFound() error {
+	if rs.cfg.EnumerationSafe {
+		return nil
+	}
+
+	return ErrNotFound
+}
+
+func (rs *resetService) Reset(ctx context.Context, token, password string) (Token, error) {
+	ctx, span := trace.StartSpan(ctx, "models.ResetService.Reset")
+	defer span.End()
+
+	if password == "" {
+		return Token{}, ValidationError{"password": ErrRequired}
+	}
+
+	uid, err := rs.ts.Consume(ctx, token, PurposeReset)
+	if err != nil {
+		return Token{}, err
+	}
+
+	user, err := rs.us.ByID(ctx, uid)
+	if err != nil {
+		if xerrors.Is(err, ErrNotFound) {
+			return Token{}, ErrUnauthorised
+		}
+
+		return Token{}, wrap("on reset, failed to obtain user from database", err)
+	}
+
+	user.Password = password
+	if err := rs.us.Update(ctx, &user); err != nil {
+		return Token{}, err
+	}
+
+	if !rs.cfg.ResetAutoLogin {
+		return Token{}, nil
+	}
+
+	return rs.us.Token(ctx, &user)
+}
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/xerrors"
+)
+
+type testNotifier struct {
+	tokens map[int64]string
+}
+
+func (t *testNotifier) SendReset(ctx context.Context, u User, token string) error {
+	t.tokens[u.ID] = token
+	return nil
+}
+
+func (t *testNotifier) SendRecovery(ctx context.Context, u User, token string) error {
+	t.tokens[u.ID] = token
+	return nil
+}
+
+func (t *testNotifier) SendChallenge(ctx context.Context, u User, code string) error {
+	t.tokens[u.ID] = code
+	return nil
+}
+
+func (t *testNotifier) SendSMS(ctx context.Context, u User, phone, code string) error {
+	t.tokens[u.ID] = phone + ":" + code
+	return nil
+}
+
+func testResetService(t *testing.T, cfg Config) (ResetService, *testUserDB, *testNotifier) {
+	t.Helper()
+
+	tudb := &testUserDB{
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			if e == "auseremail@name.com" {
+				return User{ID: 88, Active: true, Email: e}, nil
+			}
+
+			return User{}, ErrNotFound
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), cfg)
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	ts := NewActionTokenService(nil, []byte(testJWTSecret), cfg)
+	ts.(*actionTokenService).ActionTokenDB = &testActionTokenDB{used: map[string]bool{}}
+
+	n := &testNotifier{tokens: map[int64]string{}}
+	cfg.Notifier = n
+
+	return NewResetService(us, ts, cfg), tudb, n
+}
+
+func TestResetService_Request(t *testing.T) {
+	ctx := context.Background()
+
+	var cases = []struct {
+		name            string
+		enumerationSafe bool
+		email           string
+		outerr          error
+		outSent         bool
+	}{
+		{"exists", false, "auseremail@name.com", nil, true},
+		{"missing", false, "missing@name.com", ErrNotFound, false},
+		{"safeExists", true, "auseremail@name.com", nil, true},
+		{"safeMissing", true, "missing@name.com", nil, false},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			rs, _, n := testResetService(t, Config{EnumerationSafe: cs.enumerationSafe})
+
+			start := time.Now()
+			err := rs.Request(ctx, cs.email)
+			elapsed := time.Since(start)
+
+			assert.Equal(t, cs.outerr, err)
+			assert.Equal(t, cs.outSent, n.tokens[88] != "")
+			if cs.enumerationSafe {
+				assert.GreaterOrEqual(t, int64(elapsed), int64(waitAfterAuthError))
+			}
+		})
+	}
+}
+
+func TestResetService_Reset(t *testing.T) {
+	ctx := context.Background()
+	rs, tudb, n := testResetService(t, Config{})
+
+	var updated User
+	tudb.byID = func(ctx context.Context, id int64) (User, error) {
+		return User{ID: id, Active: true, Email: "auseremail@name.com", FirstName: "John", Country: "GB"}, nil
+	}
+	tudb.update = func(ctx context.Context, u *User) error {
+		updated = *u
+		return nil
+	}
+
+	require.NoError(t, rs.Request(ctx, "auseremail@name.com"))
+
+	tok, err := rs.Reset(ctx, n.tokens[88], "7vb6sCaHrV5DfV6wE7i9QdGC")
+	require.NoError(t, err)
+	assert.Equal(t, Token{}, tok, "no tokens issued without auto-login")
+	assert.Equal(t, int64(88), updated.ID)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(updated.Password), []byte("7vb6sCaHrV5DfV6wE7i9QdGC")))
+
+	_, err = rs.Reset(ctx, n.tokens[88], "7vb6sCaHrV5DfV6wE7i9QdGC")
+	assert.True(t, xerrors.Is(err, ErrTokenAlreadyUsed))
+
+	_, err = rs.Reset(ctx, "not a token", "7vb6sCaHrV5DfV6wE7i9QdGC")
+	assert.Error(t, err)
+}
+
+func TestResetService_ResetAutoLogin(t *testing.T) {
+	ctx := context.Background()
+	rs, tudb, n := testResetService(t, Config{ResetAutoLogin: true})
+
+	user := User{ID: 88, Active: true, Email: "auseremail@name.com", FirstName: "John", Country: "GB"}
+	tudb.byID = func(ctx context.Context, id int64) (User, error) {
+		return user, nil
+	}
+	tudb.update = func(ctx context.Context, u *User) error {
+		user = *u
+		return nil
+	}
+
+	require.NoError(t, rs.Request(ctx, "auseremail@name.com"))
+
+	tok, err := rs.Reset(ctx, n.tokens[88], "7vb6sCaHrV5DfV6wE7i9QdGC")
+	require.NoError(t, err)
+	assert.NotEmpty(t, tok.AccessToken)
+	assert.NotEmpty(t, tok.RefreshToken)
+	assert.Equal(t, "bearer", tok.TokenType)
+
+	// the tokens identify the user whose password was reset.
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	cl, err := us.Validate(ctx, tok.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, int64(88), cl.User.ID)
+
+	// a failed reset issues no tokens.
+	tok, err = rs.Reset(ctx, n.tokens[88], "7vb6sCaHrV5DfV6wE7i9QdGC")
+	assert.True(t, xerrors.Is(err, ErrTokenAlreadyUsed))
+	assert.Equal(t, Token{}, tok)
+}
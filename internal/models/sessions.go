@@ -0,0 +1,166 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A RevokedSession records a session ended by logging out. A session is the family of refresh tokens
+// descending from the same login.
+type RevokedSession struct {
+	ID        string    `gorm:"primary_key;size:64" json:"id"`
+	UserID    int64     `gorm:"not null;index" json:"userId"`
+	RevokedAt time.Time `gorm:"not null" json:"revokedAt"`
+}
+
+// A RevokedGrant records the time the tokens issued to a user through a client were revoked. Tokens
+// issued afterwards are not affected.
+type RevokedGrant struct {
+	UserID    int64     `gorm:"primary_key;autoIncrement:false" json:"userId"`
+	ClientID  string    `gorm:"primary_key;size:255" json:"clientId"`
+	RevokedAt time.Time `gorm:"not null" json:"revokedAt"`
+}
+
+// A RevokedTrust records the time the devices trusted by a user to skip the MFA step were revoked.
+// Devices trusted afterwards are not affected.
+type RevokedTrust struct {
+	UserID    int64     `gorm:"primary_key;autoIncrement:false" json:"userId"`
+	RevokedAt time.Time `gorm:"not null" json:"revokedAt"`
+}
+
+// A RevokedToken records a single access or refresh token revoked by its jti. It is only needed until
+// ExpiresAt, when the token expires and is rejected anyway.
+type RevokedToken struct {
+	ID        string    `gorm:"primary_key;size:64" json:"id"`
+	UserID    int64     `gorm:"not null;index" json:"userId"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expiresAt"`
+}
+
+func (ug *userGorm) RevokeSession(ctx context.Context, rs *RevokedSession) error {
+	ctx, span := trace.StartSpan(ctx, "user.Database.RevokeSession")
+	defer span.End()
+
+	// revoking a session twice is harmless, so duplicates are ignored.
+	err := ug.db.WithContext(ctx).Where(RevokedSession{ID: rs.ID}).FirstOrCreate(rs).Error
+	if err != nil {
+		return wrap("could not revoke session", err)
+	}
+
+	return nil
+}
+
+func (ug *userGorm) SessionRevoked(ctx context.Context, userID int64, id string) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "user.Database.SessionRevoked")
+	defer span.End()
+
+	var rs RevokedSession
+	err := ug.db.WithContext(ctx).Where("id = ?", id).First(&rs).Error
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+
+		return false, wrap("could not get revoked session", err)
+	}
+
+	return true, nil
+}
+
+func (ug *userGorm) RevokeGrant(ctx context.Context, rg *RevokedGrant) error {
+	ctx, span := trace.StartSpan(ctx, "user.Database.RevokeGrant")
+	defer span.End()
+
+	err := ug.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(rg).Error
+	if err != nil {
+		return wrap("could not revoke grant", err)
+	}
+
+	return nil
+}
+
+func (ug *userGorm) GrantRevokedAt(ctx context.Context, userID int64, clientID string) (time.Time, error) {
+	ctx, span := trace.StartSpan(ctx, "user.Database.GrantRevokedAt")
+	defer span.End()
+
+	var rg RevokedGrant
+	err := ug.db.WithContext(ctx).Where("user_id = ? AND client_id = ?", userID, clientID).First(&rg).Error
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, nil
+		}
+
+		return time.Time{}, wrap("could not get revoked grant", err)
+	}
+
+	return rg.RevokedAt, nil
+}
+
+func (ug *userGorm) RevokeTrust(ctx context.Context, rt *RevokedTrust) error {
+	ctx, span := trace.StartSpan(ctx, "user.Database.RevokeTrust")
+	defer span.End()
+
+	err := ug.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(rt).Error
+	if err != nil {
+		return wrap("could not revoke trusted devices", err)
+	}
+
+	return nil
+}
+
+func (ug *userGorm) TrustRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	ctx, span := trace.StartSpan(ctx, "user.Database.TrustRevokedAt")
+	defer span.End()
+
+	var rt RevokedTrust
+	err := ug.db.WithContext(ctx).Where("user_id = ?", userID).First(&rt).Error
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, nil
+		}
+
+		return time.Time{}, wrap("could not get revoked trust", err)
+	}
+
+	return rt.RevokedAt, nil
+}
+
+func (ug *userGorm) RevokeTokenID(ctx context.Context, rt *RevokedToken) error {
+	ctx, span := trace.StartSpan(ctx, "user.Database.RevokeTokenID")
+	defer span.End()
+
+	// the entries of the tokens expired since are no longer needed, so they are removed on the way.
+	err := ug.db.WithContext(ctx).Where("expires_at <= ?", time.Now()).Delete(&RevokedToken{}).Error
+	if err != nil {
+		return wrap("could not delete expired revoked tokens", err)
+	}
+
+	// revoking a token twice is harmless, so duplicates are ignored.
+	err = ug.db.WithContext(ctx).Where(RevokedToken{ID: rt.ID}).FirstOrCreate(rt).Error
+	if err != nil {
+		return wrap("could not revoke token", err)
+	}
+
+	return nil
+}
+
+func (ug *userGorm) TokenIDRevoked(ctx context.Context, userID int64, id string) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "user.Database.TokenIDRevoked")
+	defer span.End()
+
+	var rt RevokedToken
+	err := ug.db.WithContext(ctx).Where("id = ?", id).First(&rt).Error
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+
+		return false, wrap("could not get revoked token", err)
+	}
+
+	return true, nil
+}
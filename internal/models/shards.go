@@ -0,0 +1,92 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// A ShardResolver picks the shard of the token store holding the token revocations of a user.
+type ShardResolver interface {
+	// Shard returns the index, from 0 to n-1, of the shard of the user userID among n shards. It must
+	// always return the same index for the same user and number of shards.
+	Shard(userID int64, n int) int
+}
+
+// The ShardResolverFunc type is an adapter to allow the use of ordinary functions as shard resolvers.
+type ShardResolverFunc func(userID int64, n int) int
+
+// Shard calls f(userID, n).
+func (f ShardResolverFunc) Shard(userID int64, n int) int {
+	return f(userID, n)
+}
+
+// JumpHashResolver resolves the shards with the jump consistent hash of the user IDs, as described by
+// Lamping and Veach. Adding a shard only moves the users it takes over, a 1/n share of them.
+var JumpHashResolver ShardResolver = ShardResolverFunc(jumpHash)
+
+// jumpHash returns the bucket of key among n buckets with the jump consistent hash.
+func jumpHash(key int64, n int) int {
+	k := uint64(key)
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+
+	return int(b)
+}
+
+// userShards is a UserDB layer spreading the token revocations across several stores, keyed on the user
+// the tokens were issued to. The sessions, grants and tokens revoked for a user are all kept in the same
+// shard, so checking them never spans stores. The users themselves are kept in the underlying UserDB.
+type userShards struct {
+	UserDB
+
+	shards   []UserDB
+	resolver ShardResolver
+}
+
+// newUserShards instantiates a userShards in front of udb, spreading the revocations across shards with
+// cfg.ShardResolver, or JumpHashResolver when it is nil.
+func newUserShards(udb UserDB, shards []UserDB, cfg Config) *userShards {
+	resolver := cfg.ShardResolver
+	if resolver == nil {
+		resolver = JumpHashResolver
+	}
+
+	return &userShards{
+		UserDB:   udb,
+		shards:   shards,
+		resolver: resolver,
+	}
+}
+
+// shard returns the store holding the revocations of the user userID.
+func (us *userShards) shard(userID int64) UserDB {
+	return us.shards[us.resolver.Shard(userID, len(us.shards))]
+}
+
+func (us *userShards) RevokeSession(ctx context.Context, rs *RevokedSession) error {
+	return us.shard(rs.UserID).RevokeSession(ctx, rs)
+}
+
+func (us *userShards) SessionRevoked(ctx context.Context, userID int64, id string) (bool, error) {
+	return us.shard(userID).SessionRevoked(ctx, userID, id)
+}
+
+func (us *userShards) RevokeGrant(ctx context.Context, rg *RevokedGrant) error {
+	return us.shard(rg.UserID).RevokeGrant(ctx, rg)
+}
+
+func (us *userShards) GrantRevokedAt(ctx context.Context, userID int64, clientID string) (time.Time, error) {
+	return us.shard(userID).GrantRevokedAt(ctx, userID, clientID)
+}
+
+func (us *userShards) RevokeTokenID(ctx context.Context, rt *RevokedToken) error {
+	return us.shard(rt.UserID).RevokeTokenID(ctx, rt)
+}
+
+func (us *userShards) TokenIDRevoked(ctx context.Context, userID int64, id string) (bool, error) {
+	return us.shard(userID).TokenIDRevoked(ctx, userID, id)
+}
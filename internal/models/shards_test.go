@@ -0,0 +1,105 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJumpHashResolver(t *testing.T) {
+	moved := 0
+	for id := int64(1); id <= 1000; id++ {
+		shard := JumpHashResolver.Shard(id, 4)
+		require.True(t, shard >= 0 && shard < 4)
+		assert.Equal(t, shard, JumpHashResolver.Shard(id, 4), "a user is always routed to the same shard")
+
+		// adding a shard only moves users to the new shard.
+		if grown := JumpHashResolver.Shard(id, 5); grown != shard {
+			assert.Equal(t, 4, grown)
+			moved++
+		}
+	}
+
+	assert.InDelta(t, 200, moved, 60, "about a fifth of the users move to the new shard")
+	assert.Equal(t, 0, JumpHashResolver.Shard(42, 1))
+}
+
+func TestUserService_TokenShards(t *testing.T) {
+	ctx := context.Background()
+
+	// each shard records the users whose revocations it was asked about.
+	type shard struct {
+		revoked map[string]bool
+		users   map[int64]bool
+	}
+	shards := make([]*shard, 3)
+	dbs := make([]UserDB, 3)
+	for i := range shards {
+		s := &shard{revoked: map[string]bool{}, users: map[int64]bool{}}
+		shards[i] = s
+		dbs[i] = &testUserDB{
+			revokeSession: func(ctx context.Context, rs *RevokedSession) error {
+				s.users[rs.UserID] = true
+				s.revoked[rs.ID] = true
+				return nil
+			},
+			sessionRevoked: func(ctx context.Context, userID int64, id string) (bool, error) {
+				s.users[userID] = true
+				return s.revoked[id], nil
+			},
+			tokenIDRevoked: func(ctx context.Context, userID int64, id string) (bool, error) {
+				s.users[userID] = true
+				return s.revoked[id], nil
+			},
+			grantRevokedAt: func(ctx context.Context, userID int64, clientID string) (time.Time, error) {
+				s.users[userID] = true
+				return time.Time{}, nil
+			},
+		}
+	}
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	// the resolver is pluggable: users are routed by the remainder of their ID.
+	cfg := Config{ShardResolver: ShardResolverFunc(func(userID int64, n int) int {
+		return int(userID % int64(n))
+	})}
+	us := NewUserService(nil, []byte(testJWTSecret), cfg)
+	us.(*userService).UserService.(*userValidator).UserDB = newUserShards(tudb, dbs, cfg)
+
+	for _, id := range []int64{30, 31, 32, 33} {
+		tok, err := us.ClientToken(ctx, &User{ID: id}, &Client{ID: "app"})
+		require.NoError(t, err)
+
+		_, err = us.Validate(ctx, tok.AccessToken)
+		require.NoError(t, err)
+
+		other, err := us.Token(ctx, &User{ID: id})
+		require.NoError(t, err)
+
+		// the session is revoked in the shard of the user, and checked there.
+		_, err = us.Logout(ctx, tok.RefreshToken)
+		require.NoError(t, err)
+
+		_, err = us.Rotate(ctx, tok.RefreshToken)
+		assert.Equal(t, ErrUnauthorised, err)
+
+		_, err = us.Rotate(ctx, other.RefreshToken)
+		assert.NoError(t, err, "the other sessions of the user are not affected")
+	}
+
+	for i, s := range shards {
+		for id := range s.users {
+			assert.Equal(t, i, int(id%3), "user %d routed to shard %d", id, i)
+		}
+	}
+	assert.Len(t, shards[0].users, 2)
+	assert.Len(t, shards[1].users, 1)
+	assert.Len(t, shards[2].users, 1)
+}
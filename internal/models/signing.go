@@ -0,0 +1,94 @@
+package models
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+
+	jwtjose "gopkg.in/square/go-jose.v2"
+)
+
+// The algorithms the access and refresh tokens can be signed with.
+const (
+	// SigningHS512 signs the tokens with the JWT secret, so only this service can verify them.
+	SigningHS512 = "HS512"
+
+	// SigningES256 signs the tokens with an ECDSA P-256 key, giving short signatures.
+	SigningES256 = "ES256"
+
+	// SigningEdDSA signs the tokens with an Ed25519 key.
+	SigningEdDSA = "EdDSA"
+)
+
+// tokenKeys are the keys the user tokens are signed and verified with.
+type tokenKeys struct {
+	alg    jwtjose.SignatureAlgorithm
+	signer jwtjose.Signer
+
+	// verify is the key checking the signatures: the JWT secret, or the public key of the signing key.
+	verify interface{}
+
+	// public is the public key published in the JWKS. It is nil for HS512, whose secret is never
+	// published.
+	public *jwtjose.JSONWebKey
+}
+
+// newTokenKeys returns the keys for the algorithm configured in cfg, using secret for HS512 and
+// cfg.SigningKey otherwise.
+func newTokenKeys(secret []byte, cfg Config) (tokenKeys, error) {
+	switch cfg.SigningAlgorithm {
+	case "", SigningHS512:
+		return tokenKeys{alg: jwtjose.HS512, signer: newSigner(secret), verify: secret}, nil
+
+	case SigningES256:
+		key, ok := cfg.SigningKey.(*ecdsa.PrivateKey)
+		if !ok || key.Curve != elliptic.P256() {
+			return tokenKeys{}, privateError("models: ES256 requires an ECDSA P-256 signing key")
+		}
+
+		return newAsymmetricKeys(jwtjose.ES256, key, &key.PublicKey)
+
+	case SigningEdDSA:
+		key, ok := cfg.SigningKey.(ed25519.PrivateKey)
+		if !ok {
+			return tokenKeys{}, privateError("models: EdDSA requires an Ed25519 signing key")
+		}
+
+		return newAsymmetricKeys(jwtjose.EdDSA, key, key.Public())
+	}
+
+	return tokenKeys{}, privateError(fmt.Sprintf("models: unsupported signing algorithm %q", cfg.SigningAlgorithm))
+}
+
+// newAsymmetricKeys returns the keys signing with key and verifying with its public key, identified
+// in the token headers and the JWKS by the thumbprint of the public key.
+func newAsymmetricKeys(alg jwtjose.SignatureAlgorithm, key crypto.Signer, public crypto.PublicKey) (tokenKeys, error) {
+	jwk := jwtjose.JSONWebKey{Key: public, Algorithm: string(alg), Use: "sig"}
+	thumb, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return tokenKeys{}, wrap("failed to compute the signing key thumbprint", err)
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumb)
+
+	signer, err := jwtjose.NewSigner(jwtjose.SigningKey{
+		Algorithm: alg,
+		Key:       jwtjose.JSONWebKey{Key: key, KeyID: jwk.KeyID},
+	}, (&jwtjose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return tokenKeys{}, wrap("failed to instantiate JWT signer", err)
+	}
+
+	return tokenKeys{alg: alg, signer: signer, verify: public, public: &jwk}, nil
+}
+
+// keySet returns the JWKS publishing the public key, empty for HS512.
+func (k tokenKeys) keySet() jwtjose.JSONWebKeySet {
+	if k.public == nil {
+		return jwtjose.JSONWebKeySet{Keys: []jwtjose.JSONWebKey{}}
+	}
+
+	return jwtjose.JSONWebKeySet{Keys: []jwtjose.JSONWebKey{*k.public}}
+}
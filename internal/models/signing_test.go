@@ -0,0 +1,218 @@
+package models
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jwtjose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestUserService_TokenSigning(t *testing.T) {
+	ctx := context.Background()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	var cases = []struct {
+		name   string
+		alg    string
+		key    crypto.Signer
+		outKty string
+	}{
+		{"ES256", SigningES256, ecKey, "EC"},
+		{"EdDSA", SigningEdDSA, edKey, "OKP"},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			us := NewUserService(nil, []byte(testJWTSecret), Config{SigningAlgorithm: cs.alg, SigningKey: cs.key})
+			us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+			tok, err := us.Token(ctx, &User{ID: 999})
+			require.NoError(t, err)
+
+			claims, err := us.Validate(ctx, tok.AccessToken)
+			require.NoError(t, err)
+			assert.Equal(t, int64(999), claims.User.ID)
+
+			_, err = us.Rotate(ctx, tok.RefreshToken)
+			require.NoError(t, err)
+
+			// the tokens are verified with the published key alone.
+			keys := us.PublicKeys()
+			require.Len(t, keys.Keys, 1)
+
+			jtok, err := jwt.ParseSigned(tok.AccessToken)
+			require.NoError(t, err)
+			assert.Equal(t, cs.alg, jtok.Headers[0].Algorithm)
+			assert.Equal(t, keys.Keys[0].KeyID, jtok.Headers[0].KeyID)
+
+			var cl authClaims
+			require.NoError(t, jtok.Claims(keys.Keys[0].Key, &cl))
+			assert.Equal(t, "999", cl.Subject)
+
+			b, err := json.Marshal(keys)
+			require.NoError(t, err)
+			var set struct {
+				Keys []map[string]interface{} `json:"keys"`
+			}
+			require.NoError(t, json.Unmarshal(b, &set))
+			assert.Equal(t, cs.outKty, set.Keys[0]["kty"])
+			assert.Equal(t, cs.alg, set.Keys[0]["alg"])
+			assert.NotContains(t, set.Keys[0], "d", "the private key is never published")
+
+			// tokens signed with the JWT secret are not accepted.
+			hs := NewUserService(nil, []byte(testJWTSecret), Config{})
+			hsTok, err := hs.Token(ctx, &User{ID: 999})
+			require.NoError(t, err)
+			_, err = us.Validate(ctx, hsTok.AccessToken)
+			assert.Equal(t, ErrUnauthorised, err)
+		})
+	}
+
+	t.Run("HS512NotPublished", func(t *testing.T) {
+		us := NewUserService(nil, []byte(testJWTSecret), Config{})
+		assert.Empty(t, us.PublicKeys().Keys)
+	})
+
+	t.Run("keyMismatch", func(t *testing.T) {
+		_, err := newTokenKeys([]byte(testJWTSecret), Config{SigningAlgorithm: SigningES256, SigningKey: edKey})
+		assert.Error(t, err)
+
+		_, err = newTokenKeys([]byte(testJWTSecret), Config{SigningAlgorithm: SigningEdDSA, SigningKey: ecKey})
+		assert.Error(t, err)
+
+		_, err = newTokenKeys([]byte(testJWTSecret), Config{SigningAlgorithm: "none"})
+		assert.Error(t, err)
+	})
+}
+
+func TestUserService_ValidateAlgNone(t *testing.T) {
+	ctx := context.Background()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	// an unsigned token carrying valid claims.
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	now := time.Now()
+	unsigned := strings.Join([]string{
+		enc(map[string]string{"alg": "none", "typ": "JWT"}),
+		enc(map[string]interface{}{"sub": "999", "iss": tokenClaimsIssuer, "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}),
+		"",
+	}, ".")
+
+	var cases = []struct {
+		name string
+		cfg  Config
+	}{
+		{"HS512", Config{}},
+		{"ES256", Config{SigningAlgorithm: SigningES256, SigningKey: ecKey}},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			us := NewUserService(nil, []byte(testJWTSecret), cs.cfg)
+			us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+			_, err := us.Validate(ctx, unsigned)
+			assert.Equal(t, ErrUnauthorised, err)
+
+			_, err = us.Rotate(ctx, unsigned)
+			assert.Equal(t, ErrUnauthorised, err)
+		})
+	}
+}
+
+func TestUserService_ValidateAlgorithmConfusion(t *testing.T) {
+	ctx := context.Background()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	// the public key is known to anyone, and is the key material a confused verifier would use.
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	forge := func(alg jwtjose.SignatureAlgorithm, key []byte) string {
+		sig, err := jwtjose.NewSigner(jwtjose.SigningKey{Algorithm: alg, Key: key}, (&jwtjose.SignerOptions{}).WithType("JWT"))
+		require.NoError(t, err)
+
+		now := time.Now()
+		tok, err := jwt.Signed(sig).Claims(authClaims{Claims: jwt.Claims{
+			Subject:  "999",
+			Issuer:   tokenClaimsIssuer,
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		}}).CompactSerialize()
+		require.NoError(t, err)
+
+		return tok
+	}
+
+	us := NewUserService(nil, public, Config{})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	// a HS256 token signed with the public key verifies with the same key as HMAC secret, so it is
+	// only rejected because HS256 is not the configured algorithm.
+	_, err = us.Validate(ctx, forge(jwtjose.HS256, public))
+	assert.Equal(t, ErrUnauthorised, err)
+	_, err = us.Rotate(ctx, forge(jwtjose.HS256, public))
+	assert.Equal(t, ErrUnauthorised, err)
+
+	_, err = us.Validate(ctx, forge(jwtjose.HS512, public))
+	assert.NoError(t, err, "the token is accepted with the configured algorithm")
+
+	t.Run("ES256", func(t *testing.T) {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+		require.NoError(t, err)
+
+		us := NewUserService(nil, []byte(testJWTSecret), Config{SigningAlgorithm: SigningES256, SigningKey: ecKey})
+		us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+		for _, key := range [][]byte{der, []byte(testJWTSecret)} {
+			_, err = us.Validate(ctx, forge(jwtjose.HS256, key))
+			assert.Equal(t, ErrUnauthorised, err)
+			_, err = us.Validate(ctx, forge(jwtjose.HS512, key))
+			assert.Equal(t, ErrUnauthorised, err)
+		}
+	})
+}
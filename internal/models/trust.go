@@ -0,0 +1,131 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/trace"
+	jwtjose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const tokenClaimsIssuerTrust = "goauthsvctrust"
+
+// TrustService issues and checks the values of the cookies marking the devices a user trusts, which skip
+// the MFA step of the logins for the configured MFATrustDuration.
+type TrustService interface {
+	// Trust returns a new cookie value marking the device of the user as trusted, along with the time it
+	// expires. The value is signed, so no server-side storage is required, and it is only valid for the
+	// user it was issued to.
+	Trust(ctx context.Context, userID int64) (string, time.Time, error)
+
+	// Trusted reports whether value was issued by Trust for the user, has not expired, and was not
+	// issued before the devices of the user were last revoked.
+	Trusted(ctx context.Context, userID int64, value string) (bool, error)
+
+	// Revoke stops trusting all the devices the user trusted up to now. Changing the password of a user
+	// revokes them as well.
+	Revoke(ctx context.Context, userID int64) error
+}
+
+type trustService struct {
+	udb    UserDB
+	signer jwtjose.Signer
+	secret []byte
+	cfg    Config
+}
+
+// NewTrustService instantiates a new TrustService implementation signing the cookie values with secret,
+// and recording the revocations in udb. Devices are trusted for cfg.MFATrustDuration.
+func NewTrustService(udb UserDB, secret []byte, cfg Config) TrustService {
+	return &trustService{
+		udb:    udb,
+		signer: newSigner(secret),
+		secret: secret,
+		cfg:    cfg,
+	}
+}
+
+func (ts *trustService) Trust(ctx context.Context, userID int64) (string, time.Time, error) {
+	_, span := trace.StartSpan(ctx, "models.TrustService.Trust")
+	defer span.End()
+
+	id, err := randomToken(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := ts.cfg.now()
+	expiresAt := now.Add(ts.cfg.MFATrustDuration)
+	cl := jwt.Claims{
+		ID:       id,
+		Issuer:   tokenClaimsIssuerTrust,
+		Subject:  strconv.FormatInt(userID, 10),
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(expiresAt),
+	}
+
+	value, err := jwt.Signed(ts.signer).Claims(cl).CompactSerialize()
+	if err != nil {
+		return "", time.Time{}, wrap("failed to sign trusted device", err)
+	}
+
+	return value, expiresAt, nil
+}
+
+func (ts *trustService) Trusted(ctx context.Context, userID int64, value string) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "models.TrustService.Trusted")
+	defer span.End()
+
+	tok, err := jwt.ParseSigned(value)
+	if err != nil {
+		return false, nil
+	}
+
+	var cl jwt.Claims
+	if !signedWith(tok, jwtjose.HS512) {
+		return false, nil
+	}
+	if err := tok.Claims(ts.secret, &cl); err != nil {
+		return false, nil
+	}
+
+	err = cl.ValidateWithLeeway(jwt.Expected{
+		Issuer:  tokenClaimsIssuerTrust,
+		Subject: strconv.FormatInt(userID, 10),
+		Time:    ts.cfg.now(),
+	}, 0)
+	if err != nil || cl.IssuedAt == nil {
+		return false, nil
+	}
+
+	revokedAt, err := ts.udb.TrustRevokedAt(ctx, userID)
+	if err != nil {
+		return false, wrap("failed to obtain trust revocation", err)
+	}
+
+	// issue times are truncated to the second, so values issued within the second of a revocation are
+	// rejected as well.
+	return revokedAt.IsZero() || cl.IssuedAt.Time().After(revokedAt), nil
+}
+
+func (ts *trustService) Revoke(ctx context.Context, userID int64) error {
+	ctx, span := trace.StartSpan(ctx, "models.TrustService.Revoke")
+	defer span.End()
+
+	return revokeTrust(ctx, ts.udb, userID, ts.cfg.now())
+}
+
+// revokeTrust records that the devices trusted by the user up to at are revoked.
+func revokeTrust(ctx context.Context, udb UserDB, userID int64, at time.Time) error {
+	err := udb.RevokeTrust(ctx, &RevokedTrust{
+		UserID:    userID,
+		RevokedAt: at,
+	})
+	if err != nil {
+		return wrap("failed to revoke trusted devices", err)
+	}
+
+	return nil
+}
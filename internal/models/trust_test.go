@@ -0,0 +1,144 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustService_Trusted(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name    string
+		userID  int64
+		after   time.Duration // time passed since the device was trusted
+		revoke  time.Duration // time of the revocation since the device was trusted, if any
+		value   func(v string) string
+		outBool bool
+	}{
+		{
+			name:    "withinWindow",
+			userID:  7,
+			after:   30*24*time.Hour - time.Second,
+			outBool: true,
+		},
+		{
+			name:   "expired",
+			userID: 7,
+			after:  30*24*time.Hour + time.Second,
+		},
+		{
+			name:   "otherUser",
+			userID: 8,
+		},
+		{
+			name:   "otherSecret",
+			userID: 7,
+			value: func(string) string {
+				v, _, err := NewTrustService(nil, []byte("another lengthy secret"), Config{}).Trust(context.Background(), 7)
+				require.NoError(t, err)
+				return v
+			},
+		},
+		{
+			name:   "revoked",
+			userID: 7,
+			after:  time.Hour,
+			revoke: time.Minute,
+		},
+		{
+			name:   "revokedWithinSecond",
+			userID: 7,
+			after:  time.Hour,
+			revoke: time.Millisecond,
+		},
+		{
+			name:    "revokedBefore",
+			userID:  7,
+			after:   time.Hour,
+			revoke:  -time.Minute,
+			outBool: true,
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			now := start
+			var revokedAt time.Time
+			tudb := &testUserDB{
+				trustRevokedAt: func(ctx context.Context, userID int64) (time.Time, error) {
+					return revokedAt, nil
+				},
+			}
+			ts := NewTrustService(tudb, []byte(testJWTSecret), Config{
+				Now:              func() time.Time { return now },
+				MFATrustDuration: 30 * 24 * time.Hour,
+			})
+
+			v, expiresAt, err := ts.Trust(ctx, 7)
+			require.NoError(t, err)
+			assert.Equal(t, start.Add(30*24*time.Hour), expiresAt)
+
+			if cs.revoke != 0 {
+				revokedAt = start.Add(cs.revoke)
+			}
+			if cs.value != nil {
+				v = cs.value(v)
+			}
+
+			now = now.Add(cs.after)
+			trusted, err := ts.Trusted(ctx, cs.userID, v)
+
+			assert.NoError(t, err)
+			assert.Equal(t, cs.outBool, trusted)
+		})
+	}
+}
+
+func TestUserService_UpdateRevokesTrust(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		name       string
+		password   string
+		outRevoked bool
+	}{
+		{"passwordChanged", "newpassword", true},
+		{"passwordKept", "", false},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var revoked *RevokedTrust
+			tudb := &testUserDB{
+				byID: func(ctx context.Context, id int64) (User, error) {
+					return User{ID: id, Email: "test@address.com", FirstName: "Test", Password: "hash"}, nil
+				},
+				byEmail: func(ctx context.Context, e string) (User, error) {
+					return User{ID: 7}, nil
+				},
+				revokeTrust: func(ctx context.Context, rt *RevokedTrust) error {
+					revoked = rt
+					return nil
+				},
+			}
+			us := NewUserService(nil, []byte(testJWTSecret), Config{Now: func() time.Time { return now }})
+			us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+			err := us.Update(ctx, &User{ID: 7, Country: "GB", Email: "test@address.com", FirstName: "Test", Password: cs.password})
+			require.NoError(t, err)
+
+			if cs.outRevoked {
+				assert.Equal(t, &RevokedTrust{UserID: 7, RevokedAt: now}, revoked)
+			} else {
+				assert.Nil(t, revoked)
+			}
+		})
+	}
+}
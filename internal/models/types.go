@@ -0,0 +1,113 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// StringList is a list of strings persisted as a single space-delimited text column. Values must not
+// contain spaces, which holds for the URIs and scopes stored with this type.
+type StringList []string
+
+// Contains reports whether s is present in l. Values are compared exactly.
+func (l StringList) Contains(s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GormDataType returns the column type used to store the list.
+func (StringList) GormDataType() string {
+	return "text"
+}
+
+// Value implements the driver.Valuer interface.
+func (l StringList) Value() (driver.Value, error) {
+	return strings.Join(l, " "), nil
+}
+
+// Scan implements the sql.Scanner interface.
+func (l *StringList) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return privateError("models: unsupported type for StringList")
+	}
+
+	*l = strings.Fields(s)
+	return nil
+}
+
+// FeatureFlags are the features enabled or disabled for a user, by name, persisted as a JSON text column.
+// Names must not contain spaces, as the enabled ones are listed in the access tokens space-delimited.
+type FeatureFlags map[string]bool
+
+// Enabled returns the names of the features enabled, sorted.
+func (f FeatureFlags) Enabled() []string {
+	var names []string
+	for name, on := range f {
+		if on {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// GormDataType returns the column type used to store the flags.
+func (FeatureFlags) GormDataType() string {
+	return "text"
+}
+
+// Value implements the driver.Valuer interface.
+func (f FeatureFlags) Value() (driver.Value, error) {
+	if f == nil {
+		return "{}", nil
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, wrap("failed to encode feature flags", err)
+	}
+
+	return string(b), nil
+}
+
+// Scan implements the sql.Scanner interface.
+func (f *FeatureFlags) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*f = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return privateError("models: unsupported type for FeatureFlags")
+	}
+
+	var flags FeatureFlags
+	if err := json.Unmarshal(b, &flags); err != nil {
+		return wrap("failed to decode feature flags", err)
+	}
+	if len(flags) == 0 {
+		flags = nil
+	}
+
+	*f = flags
+	return nil
+}
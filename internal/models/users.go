@@ -2,11 +2,11 @@ package models
 
 import (
 	"context"
-	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/jackc/pgconn"
 	"go.opencensus.io/trace"
@@ -21,11 +21,21 @@ const (
 	// waitAfterAuthError is the period to sleep after a failed user authentication attempt.
 	waitAfterAuthError = 500 * time.Millisecond
 
+	// waitJitter is the maximum random time added to the responses in enumeration-safe mode.
+	waitJitter = 100 * time.Millisecond
+
 	jwtAccessDuration  = 6 * time.Hour
 	jwtRefreshDuration = 10 * 24 * time.Hour
+	jwtIDDuration      = time.Hour
 
 	tokenClaimsIssuer        = "goauthsvc"
 	tokenClaimsIssuerRefresh = "goauthsvcrefresh"
+	tokenClaimsIssuerID      = "goauthsvcid"
+
+	// defaultPasswordCost is the bcrypt cost of the password hashes when none is configured, and
+	// minPasswordCost the lowest one accepted by Config.Validate.
+	defaultPasswordCost = bcrypt.DefaultCost + 2
+	minPasswordCost     = bcrypt.DefaultCost
 )
 
 // UserService defines a set of methods to be used when dealing with system users and authenticating them.
@@ -40,13 +50,71 @@ type UserService interface {
 	// Refresh returns a user based on a valid refresh token.
 	Refresh(ctx context.Context, refreshToken string) (User, error)
 
+	// Rotate exchanges a valid refresh token for a new set of tokens. The new refresh token belongs
+	// to the same family as the one exchanged, that is, the tokens descending from the same login.
+	//
+	// Errors returned include ErrNoCredentials, ErrUnauthorised and ErrReauthRequired, the latter
+	// when the family reached the maximum number of rotations configured.
+	Rotate(ctx context.Context, refreshToken string) (Token, error)
+
+	// RotateWith is Rotate, with the options of the refresh request.
+	//
+	// Errors returned include the ones of Rotate, ErrReauthRequired being also returned when opts asks
+	// for scopes the refresh token was not granted, or for a login more recent than the one of the
+	// session.
+	RotateWith(ctx context.Context, refreshToken string, opts RotateOptions) (Token, error)
+
 	// Validate return claims based on a valid access token.
+	//
+	// Errors returned include ErrUnauthorised or, when distinct token errors are configured,
+	// ErrTokenExpired and ErrInvalidToken.
 	Validate(ctx context.Context, accessToken string) (Claims, error)
 
+	// IDToken generates an OpenID Connect ID token for u, issued to the client clientID with the nonce and
+	// the authentication details of opts. The profile and email claims of u are included when the scopes
+	// granted include the profile and email scopes. ID tokens are not accepted as access tokens.
+	IDToken(ctx context.Context, u *User, clientID string, opts IDTokenOptions, scopes ...string) (string, error)
+
 	// Token generates a set of tokens based on the user provided as
 	// input.
 	Token(ctx context.Context, u *User) (Token, error)
 
+	// ClientToken generates a set of tokens for u like Token, issued through the client c and granting
+	// the given scopes. The token lifetimes configured for c override the defaults, and are kept when
+	// the refresh token is rotated. The access token lifetime is further capped by the shortest
+	// lifetime configured for the scopes granted.
+	ClientToken(ctx context.Context, u *User, c *Client, scopes ...string) (Token, error)
+
+	// RevokeClient invalidates all the tokens issued to the user through the client up to now.
+	RevokeClient(ctx context.Context, userID int64, clientID string) error
+
+	// RevokeToken invalidates a single valid access or refresh token by its jti, such as a leaked one,
+	// until it expires. The other tokens of the user remain valid. Expired tokens are already rejected,
+	// so revoking them has no effect.
+	//
+	// Errors returned include ErrUnauthorised, for invalid tokens and the tokens issued without a jti.
+	RevokeToken(ctx context.Context, token string) error
+
+	// Logout ends the session a valid refresh token belongs to, so none of the refresh tokens
+	// descending from the same login can be used anymore. Access tokens already issued remain valid
+	// until they expire.
+	//
+	// Errors returned include ErrNoCredentials and ErrUnauthorised.
+	Logout(ctx context.Context, refreshToken string) (RevokedSession, error)
+
+	// PublicKeys returns the JWKS holding the public key the access and refresh tokens are signed with,
+	// so other services can verify them. It is empty when they are signed with the JWT secret.
+	PublicKeys() jwtjose.JSONWebKeySet
+
+	// UpdatePartial updates a user like Update, except that invalid fields do not fail the whole
+	// update: they keep their current value and are reported in the returned ValidationError, while
+	// the valid ones are saved. A nil ValidationError means every field was updated.
+	UpdatePartial(ctx context.Context, u *User) (ValidationError, error)
+
+	// SetFeatureFlags sets the given feature flags of the user, keeping the others. The flags set to
+	// false are disabled. It returns a ValidationError when a flag name is empty or contains spaces.
+	SetFeatureFlags(ctx context.Context, userID int64, flags FeatureFlags) error
+
 	UserDB
 }
 
@@ -82,6 +150,39 @@ type UserDB interface {
 
 	// ByEmail retrieves a user by email address, as it is unique in the database.
 	ByEmail(context.Context, string) (User, error)
+
+	// ByCanonicalEmail retrieves a user by the canonical form of their email address.
+	ByCanonicalEmail(context.Context, string) (User, error)
+
+	// RevokeSession records a session as ended.
+	RevokeSession(context.Context, *RevokedSession) error
+
+	// SessionRevoked reports whether the session with the given ID, of the user with the given ID, has
+	// been ended.
+	SessionRevoked(context.Context, int64, string) (bool, error)
+
+	// RevokeGrant records that the tokens issued to a user through a client are revoked. It replaces
+	// any previous revocation for the same user and client.
+	RevokeGrant(context.Context, *RevokedGrant) error
+
+	// GrantRevokedAt returns the time the tokens issued to a user through a client were last revoked,
+	// or the zero time if they never were.
+	GrantRevokedAt(context.Context, int64, string) (time.Time, error)
+
+	// RevokeTrust records that the devices trusted by a user to skip the MFA step are revoked. It
+	// replaces any previous revocation for the same user.
+	RevokeTrust(context.Context, *RevokedTrust) error
+
+	// TrustRevokedAt returns the time the devices trusted by a user were last revoked, or the zero time
+	// if they never were.
+	TrustRevokedAt(context.Context, int64) (time.Time, error)
+
+	// RevokeTokenID records that the token with the given jti is revoked until it expires.
+	RevokeTokenID(context.Context, *RevokedToken) error
+
+	// TokenIDRevoked reports whether the token with the given jti, issued to the user with the given ID,
+	// has been revoked.
+	TokenIDRevoked(context.Context, int64, string) (bool, error)
 }
 
 // A User represents an application user, be it a human or another application
@@ -96,6 +197,11 @@ type User struct {
 	// Email is the actual user identifier in the system and must be unique.
 	Email string `gorm:"unique;size:255;not null" json:"email"`
 
+	// CanonicalEmail is the canonical form of Email under Config.CanonicalEmails, only used to check that
+	// users do not sign up many times with variants of the same address. It is set when users are created
+	// or updated while emails are canonicalised.
+	CanonicalEmail string `gorm:"size:255;not null;default:'';index" json:"-"`
+
 	// FirstName is the user's first name or an application user's description.
 	FirstName string `gorm:"size:255;not null" json:"firstName"`
 
@@ -111,6 +217,13 @@ type User struct {
 
 	// Settings is used by the frontend to store free-form contents related to user preferences.
 	Settings string `gorm:"type:text;not null" json:"settings,omitempty"`
+
+	// FeatureFlags are the features enabled or disabled for the user. Only SetFeatureFlags changes them:
+	// they are ignored when users are created or updated.
+	FeatureFlags FeatureFlags `gorm:"not null;default:'{}'" json:"featureFlags,omitempty"`
+
+	// Profile holds the data a UserEnricher added to the authenticated user. It is never stored.
+	Profile map[string]interface{} `gorm:"-" json:"profile,omitempty"`
 }
 
 // NewUser creates a new User value with default field values applied.
@@ -123,39 +236,160 @@ func NewUser() User {
 // A Token is a set of tokens that represent a user logged in the system.
 type Token struct {
 	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 	ExpiresIn    int    `json:"expires_in"`
 	TokenType    string `json:"token_type"`
+
+	// TokenID is the unique identifier of the access token, its jti claim, when configured to be sent
+	// to clients so they can deduplicate or track the tokens.
+	TokenID string `json:"jti,omitempty"`
+
+	// IDToken is the OpenID Connect ID token of the user, when requested along with the other tokens.
+	IDToken string `json:"id_token,omitempty"`
+}
+
+// RotateOptions are the options of a refresh request.
+type RotateOptions struct {
+	// Scope is the space separated list of the scopes requested for the new tokens, empty to keep the
+	// scope of the refresh token. When the service is configured with RefreshScopeReauth, the same or a
+	// narrower scope is granted, and asking for more returns ErrReauthRequired. It is ignored otherwise.
+	Scope string
+
+	// MaxAge is the maximum time elapsed since the user authenticated to start the session, as the OpenID
+	// Connect max_age parameter. Older sessions get ErrReauthRequired. Zero does not check it.
+	MaxAge time.Duration
+
+	// ClientID is the ID of the client authenticated with the refresh request, empty when none was. The
+	// refresh tokens issued to a client can only be exchanged by it, others getting ErrUnauthorised.
+	ClientID string
 }
 
 type authClaims struct {
 	jwt.Claims
+
+	// Family identifies the tokens descending from the same login, and Rotation counts the times a
+	// refresh token was exchanged since then. Both are only set on refresh tokens.
+	Family   string `json:"fam,omitempty"`
+	Rotation int    `json:"rot,omitempty"`
+
+	// AccessTTL and RefreshTTL are the lifetimes in seconds of the tokens of the family, when overridden
+	// by the client they were issued through. They are only set on refresh tokens.
+	AccessTTL  int64 `json:"att,omitempty"`
+	RefreshTTL int64 `json:"rtt,omitempty"`
+
+	// AuthTime is the time the user authenticated at to start the session, in seconds since the epoch.
+	// It is kept as the refresh tokens are rotated.
+	AuthTime int64 `json:"auth_time,omitempty"`
+
+	// ClientID identifies the client the tokens were issued through, if any.
+	ClientID string `json:"cid,omitempty"`
+
+	// Scope is the space separated list of the scopes granted to the tokens.
+	Scope string `json:"scope,omitempty"`
+
+	// Flags is the space separated list of the features enabled for the user, when configured to be
+	// included. It is only set on access tokens.
+	Flags string `json:"flg,omitempty"`
+}
+
+// authTime returns the time the session of the refresh token started at. The tokens issued before it
+// was recorded are taken as starting the session.
+func (cl authClaims) authTime() time.Time {
+	if cl.AuthTime != 0 {
+		return time.Unix(cl.AuthTime, 0)
+	}
+
+	return cl.IssuedAt.Time()
+}
+
+// issuedTo reports whether the token can be used by the client with clientID, empty for none. The
+// tokens issued without a client can be used by any.
+func (cl authClaims) issuedTo(clientID string) bool {
+	return cl.ClientID == "" || cl.ClientID == clientID
 }
 
+// tokenLifetimes are the lifetimes of the access and refresh tokens issued together.
+type tokenLifetimes struct {
+	access, refresh time.Duration
+}
+
+// defaultLifetimes are the token lifetimes used when the client does not override them.
+var defaultLifetimes = tokenLifetimes{access: jwtAccessDuration, refresh: jwtRefreshDuration}
+
 type userService struct {
 	UserService
 
-	signer jwtjose.Signer
-	secret []byte
+	signer     jwtjose.Signer
+	keys       tokenKeys
+	secret     []byte
+	cfg        Config
+	reputation *loginReputation
+	outage     *storeOutage
+	replays    *refreshReplays
+
+	// clients looks up the clients the tokens were issued through. It is nil unless disabled clients
+	// are rejected.
+	clients ClientDB
+
+	logins *loginLimiter
 }
 
 // NewUserService instantiates a new UserService implementation with db as the backing database.
-func NewUserService(db *gorm.DB, jwtSecret []byte) UserService {
-	sig, err := jwtjose.NewSigner(jwtjose.SigningKey{
-		Algorithm: jwtjose.HS512,
-		Key:       []byte(jwtSecret),
-	}, (&jwtjose.SignerOptions{}).WithType("JWT"))
+// The cfg parameter tunes optional behaviours of the service; its zero value is a valid configuration.
+// It panics if the signing algorithm configured is not supported or does not match the signing key.
+func NewUserService(db *gorm.DB, jwtSecret []byte, cfg Config) UserService {
+	keys, err := newTokenKeys(jwtSecret, cfg)
 	if err != nil {
-		panic(fmt.Errorf("failed to instantiate JWT signer: %v", err))
+		panic(err)
+	}
+
+	var udb UserDB = &userGorm{db}
+	if cfg.StoreBreakerThreshold > 0 {
+		udb = newUserBreaker(udb, cfg)
+	}
+	if len(cfg.TokenShards) > 0 {
+		shards := make([]UserDB, len(cfg.TokenShards))
+		for i, sdb := range cfg.TokenShards {
+			shards[i] = &userGorm{sdb}
+			if cfg.StoreBreakerThreshold > 0 {
+				shards[i] = newUserBreaker(shards[i], cfg)
+			}
+		}
+
+		udb = newUserShards(udb, shards, cfg)
+	}
+	if cfg.DeleteUserData {
+		udb = newUserCleanup(udb, &mfaGorm{db}, &recoveryGorm{db}, &apiKeyGorm{db}, &consentGorm{db}, &deviceGorm{db})
+	}
+	if cfg.UserCacheTTL > 0 {
+		udb = newUserCache(udb, cfg)
+	}
+
+	var clients ClientDB
+	if cfg.RejectDisabledClients {
+		clients = &clientGorm{db}
 	}
 
 	return &userService{
 		UserService: &userValidator{
-			UserDB:     &userGorm{db},
+			UserDB:     udb,
 			emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9._\-]+\.[a-z0-9._\-]{2,16}$`),
+			breaches:   cfg.BreachChecker,
+			digit:      cfg.PasswordRequireDigit,
+			cost:       cfg.passwordCost(),
+			domains:    cfg.SignupEmailDomains,
+			disposable: cfg.DisposableChecker,
+			canonical:  cfg.CanonicalEmails,
 		},
-		signer: sig,
-		secret: jwtSecret,
+		signer:     keys.signer,
+		keys:       keys,
+		secret:     jwtSecret,
+		cfg:        cfg,
+		reputation: newLoginReputation(cfg),
+		outage:     &storeOutage{},
+		replays:    newRefreshReplays(cfg),
+		clients:    clients,
+		logins:     newLoginLimiter(cfg),
 	}
 }
 
@@ -163,8 +397,33 @@ func (us *userService) Authenticate(ctx context.Context, username, password stri
 	ctx, span := trace.StartSpan(ctx, "models.UserService.Authenticate")
 	defer span.End()
 
+	if us.logins != nil {
+		key := strings.ToLower(strings.TrimSpace(username))
+		if !us.logins.acquire(key) {
+			return User{}, ErrTooManyConcurrentLogins
+		}
+		defer us.logins.release(key)
+	}
+
+	start := time.Now()
+
+	// while the service is under a coordinated attack, every login is slowed down.
+	if us.reputation != nil && us.reputation.Elevated() {
+		time.Sleep(us.cfg.GlobalFrictionDelay)
+	}
+
 	// hide the actual errors to reduce ease of BF attacks.
 	user, err := us.UserService.Authenticate(ctx, username, password)
+
+	// an unavailable store says nothing about the credentials, and is reported right away.
+	if xerrors.Is(err, ErrServiceUnavailable) {
+		return User{}, ErrServiceUnavailable
+	}
+
+	if us.reputation != nil && !xerrors.Is(err, ValidationError{"email": ErrRequired}) &&
+		!xerrors.Is(err, ValidationError{"password": ErrRequired}) {
+		us.reputation.Record(err != nil)
+	}
 	if err != nil {
 		if xerrors.Is(err, ValidationError{"email": ErrRequired}) ||
 			xerrors.Is(err, ValidationError{"password": ErrRequired}) {
@@ -172,6 +431,10 @@ func (us *userService) Authenticate(ctx context.Context, username, password stri
 
 		} else if verr := ValidationError(nil); xerrors.As(err, &verr) {
 			if verr["password"] == ErrPasswordIncorrect {
+				// in enumeration-safe mode, an existing user takes as long to fail as a missing one.
+				if us.cfg.EnumerationSafe {
+					waitUniform(start)
+				}
 				return user, ErrUnauthorised
 			}
 			err = ErrUnauthorised
@@ -181,7 +444,11 @@ func (us *userService) Authenticate(ctx context.Context, username, password stri
 		}
 
 		// sleep protection to reduce effectiveness of BF attacks
-		time.Sleep(waitAfterAuthError)
+		if us.cfg.EnumerationSafe {
+			waitUniform(start)
+		} else {
+			time.Sleep(waitAfterAuthError)
+		}
 		return User{}, err
 	}
 
@@ -192,35 +459,200 @@ func (us *userService) Refresh(ctx context.Context, refreshToken string) (User,
 	ctx, span := trace.StartSpan(ctx, "models.UserService.Refresh")
 	defer span.End()
 
+	user, _, err := us.refresh(ctx, refreshToken)
+	return user, err
+}
+
+func (us *userService) Rotate(ctx context.Context, refreshToken string) (Token, error) {
+	ctx, span := trace.StartSpan(ctx, "models.UserService.Rotate")
+	defer span.End()
+
+	return us.rotate(ctx, refreshToken, RotateOptions{})
+}
+
+func (us *userService) RotateWith(ctx context.Context, refreshToken string, opts RotateOptions) (Token, error) {
+	ctx, span := trace.StartSpan(ctx, "models.UserService.RotateWith")
+	defer span.End()
+
+	return us.rotate(ctx, refreshToken, opts)
+}
+
+// rotate exchanges a valid refresh token for a new set of tokens, as requested by opts.
+func (us *userService) rotate(ctx context.Context, refreshToken string, opts RotateOptions) (Token, error) {
+	// a retried refresh gets the tokens already issued for the same refresh token and options, the client
+	// included, which was checked when they were issued.
+	if us.replays != nil {
+		if tok, ok := us.replays.Get(refreshToken, opts); ok {
+			if us.cfg.RefreshIdempotencyRecheck {
+				if _, _, err := us.refresh(ctx, refreshToken); err != nil {
+					return Token{}, err
+				}
+			}
+
+			return tok, nil
+		}
+	}
+
+	user, cl, err := us.refresh(ctx, refreshToken)
+	if err != nil {
+		return Token{}, err
+	}
+
+	if !cl.issuedTo(opts.ClientID) {
+		return Token{}, ErrUnauthorised
+	}
+
+	if us.cfg.MaxRefreshRotations > 0 && cl.Rotation >= us.cfg.MaxRefreshRotations {
+		return Token{}, ErrReauthRequired
+	}
+
+	// the client wants a login more recent than the one of the session.
+	if opts.MaxAge > 0 && !us.cfg.now().Before(cl.authTime().Add(opts.MaxAge)) {
+		return Token{}, ErrReauthRequired
+	}
+
+	// a refresh can narrow the scope of the session, but broadening it takes a fresh authorization.
+	if scope := opts.Scope; scope != "" && us.cfg.RefreshScopeReauth {
+		granted := StringList(strings.Fields(cl.Scope))
+		for _, s := range strings.Fields(scope) {
+			if !granted.Contains(s) {
+				return Token{}, ErrReauthRequired
+			}
+		}
+
+		cl.Scope = strings.Join(strings.Fields(scope), " ")
+	}
+
+	// refresh tokens issued before families were introduced start a new one.
+	family := cl.Family
+	if family == "" {
+		family, err = randomToken(16)
+		if err != nil {
+			return Token{}, err
+		}
+	}
+
+	lt := defaultLifetimes
+	if cl.AccessTTL > 0 {
+		lt.access = time.Duration(cl.AccessTTL) * time.Second
+	}
+	if cl.RefreshTTL > 0 {
+		lt.refresh = time.Duration(cl.RefreshTTL) * time.Second
+	}
+
+	tok, err := us.token(ctx, &user, family, cl.Rotation+1, cl.authTime(), cl.ClientID, cl.Scope, lt)
+	if err != nil {
+		return Token{}, err
+	}
+
+	if us.replays != nil {
+		us.replays.Put(refreshToken, opts, tok)
+	}
+
+	return tok, nil
+}
+
+// refresh returns the user identified by a valid refresh token, along with the token claims.
+func (us *userService) refresh(ctx context.Context, refreshToken string) (User, authClaims, error) {
 	if refreshToken == "" {
-		return User{}, ErrNoCredentials
+		return User{}, authClaims{}, ErrNoCredentials
 	}
 
 	// validate the token
-	uid, err := us.tokenValidate(ctx, refreshToken, true)
+	cl, uid, err := us.tokenValidate(ctx, refreshToken, true)
 	if err != nil {
 		if merr := ModelError(""); xerrors.As(err, &merr) {
-			return User{}, ErrUnauthorised
+			return User{}, authClaims{}, ErrUnauthorised
 		}
 
-		return User{}, wrap("failed to validate refresh token", err)
+		return User{}, authClaims{}, wrap("failed to validate refresh token", err)
+	}
+
+	// however the refresh tokens are rotated, a session cannot outlive the absolute lifetime.
+	if us.cfg.MaxSessionLifetime > 0 && !us.cfg.now().Before(cl.authTime().Add(us.cfg.MaxSessionLifetime)) {
+		return User{}, authClaims{}, ErrReauthRequired
+	}
+
+	// the tokens of a session ended by logging out are no longer accepted.
+	if cl.Family != "" {
+		revoked, err := us.SessionRevoked(ctx, uid, cl.Family)
+		if err != nil {
+			return User{}, authClaims{}, wrap("on refresh, failed to check session", err)
+		}
+
+		if revoked {
+			return User{}, authClaims{}, ErrUnauthorised
+		}
+	}
+
+	revoked, err := us.clientRevoked(ctx, uid, cl)
+	if err != nil {
+		return User{}, authClaims{}, wrap("on refresh, failed to check client grant", err)
+	}
+
+	if revoked {
+		return User{}, authClaims{}, ErrUnauthorised
+	}
+
+	disabled, err := us.clientDisabled(ctx, cl)
+	if err != nil {
+		return User{}, authClaims{}, wrap("on refresh, failed to check client status", err)
+	}
+
+	if disabled {
+		return User{}, authClaims{}, ErrClientDisabled
+	}
+
+	revoked, err = us.tokenRevoked(ctx, uid, cl)
+	if err != nil {
+		return User{}, authClaims{}, wrap("on refresh, failed to check revoked tokens", err)
+	}
+
+	if revoked {
+		return User{}, authClaims{}, ErrUnauthorised
 	}
 
 	// get the user from the database
 	user, err := us.ByID(ctx, uid)
 	if err != nil {
 		if xerrors.Is(err, ErrNotFound) {
-			return User{}, ErrUnauthorised
+			return User{}, authClaims{}, ErrUnauthorised
 		}
 
-		return User{}, wrap("on refresh, failed to obtain user from database", err)
+		return User{}, authClaims{}, wrap("on refresh, failed to obtain user from database", err)
 	}
 
 	if !user.Active {
-		return User{}, ErrUnauthorised
+		return User{}, authClaims{}, ErrUnauthorised
 	}
 
-	return user, nil
+	return user, cl, nil
+}
+
+func (us *userService) Logout(ctx context.Context, refreshToken string) (RevokedSession, error) {
+	ctx, span := trace.StartSpan(ctx, "models.UserService.Logout")
+	defer span.End()
+
+	user, cl, err := us.refresh(ctx, refreshToken)
+	if err != nil {
+		return RevokedSession{}, err
+	}
+
+	// refresh tokens issued before families were introduced do not identify a session.
+	if cl.Family == "" {
+		return RevokedSession{}, ErrUnauthorised
+	}
+
+	rs := RevokedSession{
+		ID:        cl.Family,
+		UserID:    user.ID,
+		RevokedAt: us.cfg.now(),
+	}
+	if err := us.RevokeSession(ctx, &rs); err != nil {
+		return RevokedSession{}, wrap("on logout, failed to revoke session", err)
+	}
+
+	return rs, nil
 }
 
 func (us *userService) Validate(ctx context.Context, accessToken string) (Claims, error) {
@@ -228,53 +660,303 @@ func (us *userService) Validate(ctx context.Context, accessToken string) (Claims
 	defer span.End()
 
 	if accessToken == "" {
-		return Claims{}, ErrUnauthorised
+		return Claims{}, us.invalidToken()
 	}
 
 	// validate the token
-	uid, err := us.tokenValidate(ctx, accessToken, false)
+	cl, uid, err := us.tokenValidate(ctx, accessToken, false)
 	if err != nil {
 		if merr := ModelError(""); xerrors.As(err, &merr) {
-			return Claims{}, ErrUnauthorised
+			if err == ErrRefreshExpired && us.cfg.DistinctTokenErrors {
+				return Claims{}, ErrTokenExpired
+			}
+
+			return Claims{}, us.invalidToken()
 		}
 
 		return Claims{}, wrap("failed to validate refresh token", err)
 	}
 
+	revoked, err := us.clientRevoked(ctx, uid, cl)
+	if err != nil {
+		return us.failOpen(ctx, uid, cl, wrap("on validate, failed to check client grant", err))
+	}
+
+	if revoked {
+		return Claims{}, us.invalidToken()
+	}
+
+	disabled, err := us.clientDisabled(ctx, cl)
+	if err != nil {
+		return us.failOpen(ctx, uid, cl, wrap("on validate, failed to check client status", err))
+	}
+
+	if disabled {
+		return Claims{}, ErrClientDisabled
+	}
+
+	revoked, err = us.tokenRevoked(ctx, uid, cl)
+	if err != nil {
+		return us.failOpen(ctx, uid, cl, wrap("on validate, failed to check revoked tokens", err))
+	}
+
+	if revoked {
+		return Claims{}, us.invalidToken()
+	}
+
 	// get the user from the database
 	user, err := us.ByID(ctx, uid)
 	if err != nil {
 		if xerrors.Is(err, ErrNotFound) {
-			return Claims{}, ErrUnauthorised
+			return Claims{}, us.invalidToken()
 		}
 
-		return Claims{}, wrap("on validate, failed to obtain user from database", err)
+		return us.failOpen(ctx, uid, cl, wrap("on validate, failed to obtain user from database", err))
 	}
+	us.outage.recovered()
 
 	if !user.Active {
-		return Claims{}, ErrUnauthorised
+		return Claims{}, us.invalidToken()
+	}
+
+	c := tokenClaims(user, cl)
+	if err := us.validateClaims(ctx, c); err != nil {
+		return Claims{}, err
+	}
+
+	return c, nil
+}
+
+// validateClaims runs the configured ClaimsValidator on c. The public errors it returns are kept as they
+// are, so clients are told why their token was rejected.
+func (us *userService) validateClaims(ctx context.Context, c Claims) error {
+	if us.cfg.ClaimsValidator == nil {
+		return nil
+	}
+
+	err := us.cfg.ClaimsValidator.ValidateClaims(ctx, c)
+	if err == nil {
+		return nil
+	}
+
+	if pe := PublicError(nil); xerrors.As(err, &pe) {
+		return pe
+	}
+
+	return wrap("on validate, failed to run claims validator", err)
+}
+
+// invalidToken returns the error for a rejected access token, other than an expired one.
+func (us *userService) invalidToken() error {
+	if us.cfg.DistinctTokenErrors {
+		return ErrInvalidToken
 	}
 
-	return NewClaims(user), nil
+	return ErrUnauthorised
+}
+
+func (us *userService) IDToken(ctx context.Context, u *User, clientID string, opts IDTokenOptions, scopes ...string) (string, error) {
+	_, span := trace.StartSpan(ctx, "models.UserService.IDToken")
+	defer span.End()
+
+	now := us.cfg.now()
+	cl := IDClaims{
+		Claims: jwt.Claims{
+			Subject:  strconv.FormatInt(u.ID, 10),
+			Issuer:   us.cfg.issuer(),
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(jwtIDDuration)),
+		},
+		Nonce:       opts.Nonce,
+		AuthClass:   opts.AuthClass,
+		AuthMethods: opts.AuthMethods,
+		UserClaims:  NewUserClaims(*u, scopes...),
+	}
+	if clientID != "" {
+		cl.Audience = jwt.Audience{clientID}
+	}
+
+	idToken, err := jwt.Signed(us.signer).Claims(cl).CompactSerialize()
+	if err != nil {
+		return "", wrap("failed to generate id token", err)
+	}
+
+	return idToken, nil
 }
 
 func (us *userService) Token(ctx context.Context, u *User) (Token, error) {
-	_, span := trace.StartSpan(ctx, "models.UserService.Token")
+	ctx, span := trace.StartSpan(ctx, "models.UserService.Token")
+	defer span.End()
+
+	family, err := randomToken(16)
+	if err != nil {
+		return Token{}, err
+	}
+
+	return us.token(ctx, u, family, 0, time.Time{}, "", "", defaultLifetimes)
+}
+
+func (us *userService) ClientToken(ctx context.Context, u *User, c *Client, scopes ...string) (Token, error) {
+	ctx, span := trace.StartSpan(ctx, "models.UserService.ClientToken")
+	defer span.End()
+
+	family, err := randomToken(16)
+	if err != nil {
+		return Token{}, err
+	}
+
+	return us.token(ctx, u, family, 0, time.Time{}, c.ID, strings.Join(scopes, " "), c.lifetimes())
+}
+
+func (us *userService) RevokeClient(ctx context.Context, userID int64, clientID string) error {
+	ctx, span := trace.StartSpan(ctx, "models.UserService.RevokeClient")
 	defer span.End()
 
+	err := us.RevokeGrant(ctx, &RevokedGrant{
+		UserID:    userID,
+		ClientID:  clientID,
+		RevokedAt: us.cfg.now(),
+	})
+	if err != nil {
+		return wrap("on revoke client, failed to revoke grant", err)
+	}
+
+	return nil
+}
+
+// clientRevoked reports whether the tokens with claims cl, issued to the user uid, were revoked through
+// RevokeClient.
+func (us *userService) clientRevoked(ctx context.Context, uid int64, cl authClaims) (bool, error) {
+	if cl.ClientID == "" {
+		return false, nil
+	}
+
+	at, err := us.GrantRevokedAt(ctx, uid, cl.ClientID)
+	if err != nil {
+		return false, err
+	}
+
+	// tokens without an issue time cannot be told apart from the revoked ones.
+	return !at.IsZero() && (cl.IssuedAt == nil || !cl.IssuedAt.Time().After(at)), nil
+}
+
+// clientDisabled reports whether the client the tokens with claims cl were issued through has been
+// disabled or deleted, when disabled clients are rejected.
+func (us *userService) clientDisabled(ctx context.Context, cl authClaims) (bool, error) {
+	if us.clients == nil || cl.ClientID == "" {
+		return false, nil
+	}
+
+	c, err := us.clients.ByID(ctx, cl.ClientID)
+	if xerrors.Is(err, ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return !c.Active, nil
+}
+
+func (us *userService) RevokeToken(ctx context.Context, token string) error {
+	ctx, span := trace.StartSpan(ctx, "models.UserService.RevokeToken")
+	defer span.End()
+
+	cl, uid, err := us.tokenValidate(ctx, token, false)
+	if err == ErrRefreshInvalid {
+		cl, uid, err = us.tokenValidate(ctx, token, true)
+	}
+	if err == ErrRefreshExpired {
+		return nil
+	}
+	if err != nil {
+		return ErrUnauthorised
+	}
+
+	// tokens issued before they were given a jti cannot be revoked alone.
+	if cl.ID == "" || cl.Expiry == nil {
+		return ErrUnauthorised
+	}
+
+	err = us.RevokeTokenID(ctx, &RevokedToken{
+		ID:        cl.ID,
+		UserID:    uid,
+		ExpiresAt: cl.Expiry.Time(),
+	})
+	if err != nil {
+		return wrap("on revoke token, failed to revoke token", err)
+	}
+
+	return nil
+}
+
+// tokenRevoked reports whether the token with claims cl, issued to the user uid, was revoked by its jti.
+func (us *userService) tokenRevoked(ctx context.Context, uid int64, cl authClaims) (bool, error) {
+	if cl.ID == "" {
+		return false, nil
+	}
+
+	return us.TokenIDRevoked(ctx, uid, cl.ID)
+}
+
+// token generates a set of tokens for u, with the refresh token belonging to family after the given
+// number of rotations. The tokens are issued through the client clientID, if not empty, grant the space
+// separated scopes in scope, and expire after the lifetimes in lt. The access token lifetime is capped
+// by the lifetimes configured for the scopes.
+func (us *userService) token(ctx context.Context, u *User, family string, rotation int, authTime time.Time, clientID, scope string, lt tokenLifetimes) (Token, error) {
+	// every token is identified by a random jti, so it can be told apart from the tokens issued alike.
+	accessID, err := randomToken(16)
+	if err != nil {
+		return Token{}, wrap("failed to generate access token ID", err)
+	}
+	refreshID, err := randomToken(16)
+	if err != nil {
+		return Token{}, wrap("failed to generate refresh token ID", err)
+	}
+
+	now := us.cfg.now()
+	if authTime.IsZero() {
+		authTime = now
+	}
+
+	access := us.cfg.scopeTokenTTL(lt.access, strings.Fields(scope))
 	claimsAccess := authClaims{
 		Claims: jwt.Claims{
-			Subject: strconv.FormatInt(u.ID, 10),
-			Issuer:  tokenClaimsIssuer,
-			Expiry:  jwt.NewNumericDate(time.Now().UTC().Add(jwtAccessDuration)),
+			ID:       accessID,
+			Subject:  strconv.FormatInt(u.ID, 10),
+			Issuer:   tokenClaimsIssuer,
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(access)),
 		},
+		AuthTime: authTime.Unix(),
+		ClientID: clientID,
+		Scope:    scope,
+	}
+	if us.cfg.TokenFeatureFlags {
+		claimsAccess.Flags = strings.Join(u.FeatureFlags.Enabled(), " ")
 	}
 	claimsRefresh := authClaims{
 		Claims: jwt.Claims{
-			Subject: strconv.FormatInt(u.ID, 10),
-			Issuer:  tokenClaimsIssuerRefresh,
-			Expiry:  jwt.NewNumericDate(time.Now().UTC().Add(jwtRefreshDuration)),
+			ID:       refreshID,
+			Subject:  strconv.FormatInt(u.ID, 10),
+			Issuer:   tokenClaimsIssuerRefresh,
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(lt.refresh)),
 		},
+		Family:   family,
+		Rotation: rotation,
+		AuthTime: authTime.Unix(),
+		ClientID: clientID,
+		Scope:    scope,
+	}
+
+	// overridden lifetimes are kept in the refresh token, so rotations issue tokens alike. The scope
+	// caps are left out, so the ones configured at the time of the rotation apply.
+	if lt.access != jwtAccessDuration {
+		claimsRefresh.AccessTTL = int64(lt.access / time.Second)
+	}
+	if lt.refresh != jwtRefreshDuration {
+		claimsRefresh.RefreshTTL = int64(lt.refresh / time.Second)
 	}
 
 	accessTok, err := jwt.Signed(us.signer).Claims(claimsAccess).CompactSerialize()
@@ -287,12 +969,54 @@ func (us *userService) Token(ctx context.Context, u *User) (Token, error) {
 		return Token{}, wrap("failed to generate refresh token", err)
 	}
 
-	return Token{
+	tok := Token{
 		AccessToken:  accessTok,
 		RefreshToken: refreshTok,
-		ExpiresIn:    int(jwtAccessDuration / time.Second),
+		ExpiresIn:    int(access / time.Second),
 		TokenType:    "bearer",
-	}, nil
+	}
+	if us.cfg.TokenIDInResponse {
+		tok.TokenID = accessID
+	}
+
+	return tok, nil
+}
+
+// PublicKeys returns the JWKS of the key the tokens are signed with.
+func (us *userService) PublicKeys() jwtjose.JSONWebKeySet {
+	return us.keys.keySet()
+}
+
+// Update updates u and, when it sets a new password, revokes the devices the user trusted to skip the
+// MFA step, so they must complete it again with the new password.
+func (us *userService) Update(ctx context.Context, u *User) error {
+	changed := u.Password != ""
+	if err := us.UserService.Update(ctx, u); err != nil {
+		return err
+	}
+
+	if changed {
+		return revokeTrust(ctx, us, u.ID, us.cfg.now())
+	}
+
+	return nil
+}
+
+func (us *userService) UpdatePartial(ctx context.Context, u *User) (ValidationError, error) {
+	changed := u.Password != ""
+	ve, err := us.UserService.UpdatePartial(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	// an invalid password keeps the current one, and the trusted devices with it.
+	if _, invalid := ve["password"]; changed && !invalid {
+		if err := revokeTrust(ctx, us, u.ID, us.cfg.now()); err != nil {
+			return nil, err
+		}
+	}
+
+	return ve, nil
 }
 
 func (us *userService) ByID(ctx context.Context, id int64) (User, error) {
@@ -342,55 +1066,75 @@ func (us *userService) ByEmail(ctx context.Context, e string) (User, error) {
 }
 
 // tokenValidate validates token as a JWT. If refresh is true, it validates it as being a
-// refresh token. The method returns the user id present in the token claims
-func (us *userService) tokenValidate(ctx context.Context, token string, isRefresh bool) (uid int64, err error) {
+// refresh token. The method returns the token claims and the user id present in them.
+func (us *userService) tokenValidate(ctx context.Context, token string, isRefresh bool) (cl authClaims, uid int64, err error) {
 	_, span := trace.StartSpan(ctx, "models.User.tokenValidate")
 	defer span.End()
 
-	var cl authClaims
-
 	// parse the token first
 	tok, err := jwt.ParseSigned(token)
 	if err != nil {
-		return 0, ErrRefreshInvalid
+		return authClaims{}, 0, ErrRefreshInvalid
+	}
+
+	// only the configured algorithm is accepted, so tokens with other algorithms, "none" included,
+	// cannot be verified with a key meant for another one.
+	if !signedWith(tok, us.keys.alg) {
+		return authClaims{}, 0, ErrRefreshInvalid
 	}
 
 	// verify the claims check with the signature key
-	err = tok.Claims(us.secret, &cl)
+	err = tok.Claims(us.keys.verify, &cl)
 	if err != nil {
-		return 0, ErrRefreshInvalid
+		return authClaims{}, 0, ErrRefreshInvalid
+	}
+
+	// tokens issued in the future, beyond the allowed clock skew, were not issued by a correctly
+	// configured issuer and must not be trusted.
+	now := us.cfg.now()
+	if cl.IssuedAt != nil && cl.IssuedAt.Time().After(now.Add(us.cfg.clockSkew())) {
+		return authClaims{}, 0, ErrRefreshInvalid
 	}
 
-	// verify the token has not expired
+	// verify the token has not expired. Access tokens are given an extra grace period so requests
+	// in flight while the client refreshes are not rejected.
 	iss := tokenClaimsIssuer
+	leeway := us.cfg.clockSkew() + us.cfg.AccessTokenGrace
 	if isRefresh {
 		iss = tokenClaimsIssuerRefresh
+		leeway = us.cfg.clockSkew()
 	}
 
-	err = cl.Validate(jwt.Expected{
+	err = cl.ValidateWithLeeway(jwt.Expected{
 		Issuer: iss,
-		Time:   time.Now().UTC(),
-	})
+		Time:   now,
+	}, leeway)
 	if err != nil {
 		if xerrors.Is(err, jwt.ErrExpired) {
-			return 0, ErrRefreshExpired
+			return authClaims{}, 0, ErrRefreshExpired
 		}
 
-		return 0, ErrRefreshInvalid
+		return authClaims{}, 0, ErrRefreshInvalid
 	}
 
 	// get the user ID in the claim, passed in the subject field
 	id, err := strconv.ParseInt(cl.Subject, 10, 0)
 	if err != nil {
-		return 0, ErrRefreshInvalid
+		return authClaims{}, 0, ErrRefreshInvalid
 	}
 
-	return id, nil
+	return cl, id, nil
 }
 
 type userValidator struct {
 	UserDB
 	emailRegex *regexp.Regexp
+	breaches   BreachChecker
+	digit      bool
+	cost       int
+	domains    []string
+	disposable DisposableChecker
+	canonical  map[string]EmailCanonicalisation
 	ctx        context.Context
 }
 
@@ -444,14 +1188,46 @@ func (uv *userValidator) Refresh(ctx context.Context, refreshToken string) (User
 	panic("method Refresh of userValidator must never be called")
 }
 
+func (uv *userValidator) Rotate(ctx context.Context, refreshToken string) (Token, error) {
+	panic("method Rotate of userValidator must never be called")
+}
+
+func (uv *userValidator) RotateWith(ctx context.Context, refreshToken string, opts RotateOptions) (Token, error) {
+	panic("method RotateWith of userValidator must never be called")
+}
+
+func (uv *userValidator) Logout(ctx context.Context, refreshToken string) (RevokedSession, error) {
+	panic("method Logout of userValidator must never be called")
+}
+
 func (uv *userValidator) Validate(ctx context.Context, accessToken string) (Claims, error) {
 	panic("method Validate of userValidator must never be called")
 }
 
+func (uv *userValidator) IDToken(ctx context.Context, u *User, clientID string, opts IDTokenOptions, scopes ...string) (string, error) {
+	panic("method IDToken of userValidator must never be called")
+}
+
 func (uv *userValidator) Token(ctx context.Context, u *User) (Token, error) {
 	panic("method Token of userValidator must never be called")
 }
 
+func (uv *userValidator) ClientToken(ctx context.Context, u *User, c *Client, scopes ...string) (Token, error) {
+	panic("method ClientToken of userValidator must never be called")
+}
+
+func (uv *userValidator) RevokeClient(ctx context.Context, userID int64, clientID string) error {
+	panic("method RevokeClient of userValidator must never be called")
+}
+
+func (uv *userValidator) RevokeToken(ctx context.Context, token string) error {
+	panic("method RevokeToken of userValidator must never be called")
+}
+
+func (uv *userValidator) PublicKeys() jwtjose.JSONWebKeySet {
+	panic("method PublicKeys of userValidator must never be called")
+}
+
 func (uv *userValidator) Create(ctx context.Context, u *User) error {
 	ctx, span := trace.StartSpan(ctx, "models.User.Create")
 	defer span.End()
@@ -464,16 +1240,22 @@ func (uv *userValidator) Create(ctx context.Context, u *User) error {
 
 	if err := uv.runValFuncs(u,
 		uv.idSetToZero,
+		uv.featureFlagsCleared,
 		uv.countryCodeIsValid,
 		uv.firstNameRequired,
 		uv.firstNameLength,
 		uv.settingsLength,
 		uv.passwordRequired,
 		uv.passwordLength,
+		uv.passwordDigit,
+		uv.passwordNotBreached,
 		uv.passwordHash,
 		uv.emailRequired,
 		uv.normaliseEmail,
 		uv.emailFormat,
+		uv.emailDomainAllowed,
+		uv.emailNotDisposable,
+		uv.canonicaliseEmail,
 		uv.emailIsTaken,
 	); err != nil {
 		return err
@@ -503,9 +1285,13 @@ func (uv *userValidator) Update(ctx context.Context, u *User) error {
 		uv.emailRequired,
 		uv.normaliseEmail,
 		uv.emailFormat,
+		uv.canonicaliseEmail,
 		uv.passwordLength,
+		uv.passwordDigit,
+		uv.passwordNotBreached,
 		uv.passwordHash,
 		uc.preservePassword,
+		uc.preserveFeatureFlags,
 		uc.emailIsTaken,
 	); err != nil {
 		return err
@@ -537,6 +1323,95 @@ func (uv *userValidator) ByEmail(ctx context.Context, e string) (User, error) {
 
 type userValFn func(u *User) error
 
+func (uv *userValidator) UpdatePartial(ctx context.Context, u *User) (ValidationError, error) {
+	ctx, span := trace.StartSpan(ctx, "models.User.UpdatePartial")
+	defer span.End()
+
+	// Update modifies u even when it fails, so the requested values are kept to retry with them.
+	requested := *u
+
+	err := uv.Update(ctx, u)
+	ve := ValidationError(nil)
+	if !xerrors.As(err, &ve) {
+		return nil, err
+	}
+
+	current, err := uv.UserDB.ByID(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	*u = requested
+	for field := range ve {
+		if !revertField(u, &current, field) {
+			return nil, ve
+		}
+	}
+
+	if err := uv.Update(ctx, u); err != nil {
+		return nil, err
+	}
+
+	return ve, nil
+}
+
+func (uv *userValidator) SetFeatureFlags(ctx context.Context, userID int64, flags FeatureFlags) error {
+	ctx, span := trace.StartSpan(ctx, "models.User.SetFeatureFlags")
+	defer span.End()
+
+	for name := range flags {
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return ValidationError{"featureFlags": ErrInvalid}
+		}
+	}
+
+	u, err := uv.UserDB.ByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	merged := make(FeatureFlags, len(u.FeatureFlags)+len(flags))
+	for name, on := range u.FeatureFlags {
+		merged[name] = on
+	}
+	for name, on := range flags {
+		if on {
+			merged[name] = true
+		} else {
+			delete(merged, name)
+		}
+	}
+	u.FeatureFlags = merged
+
+	return uv.UserDB.Update(ctx, &u)
+}
+
+// revertField sets the field of u with the given JSON name to its value in current. It returns false
+// if the field cannot be reverted.
+func revertField(u, current *User, field string) bool {
+	switch field {
+	case "email":
+		u.Email = current.Email
+	case "firstName":
+		u.FirstName = current.FirstName
+	case "lastName":
+		u.LastName = current.LastName
+	case "password":
+		// an empty password keeps the current one
+		u.Password = ""
+	case "nickname":
+		u.Nickname = current.Nickname
+	case "country":
+		u.Country = current.Country
+	case "settings":
+		u.Settings = current.Settings
+	default:
+		return false
+	}
+
+	return true
+}
+
 type userValWithCurrent struct {
 	uv      *userValidator
 	current User
@@ -565,12 +1440,28 @@ func (uc *userValWithCurrent) emailIsTaken() (string, userValFn) {
 			if err == nil && u.ID != 0 && u.ID != cu.ID {
 				return ErrDuplicate
 			}
+
+			if len(uc.uv.canonical) > 0 {
+				cu, err = uc.uv.UserDB.ByCanonicalEmail(uc.uv.ctx, u.CanonicalEmail)
+				if err == nil && u.ID != 0 && u.ID != cu.ID {
+					return ErrDuplicate
+				}
+			}
 		}
 
 		return nil
 	}
 }
 
+// preserveFeatureFlags makes sure the feature flags of an existing user are kept, as they are only changed by
+// SetFeatureFlags. It does not return any errors.
+func (uc *userValWithCurrent) preserveFeatureFlags() (string, userValFn) {
+	return "", func(u *User) error {
+		u.FeatureFlags = uc.current.FeatureFlags
+		return nil
+	}
+}
+
 // preservePassword makes sure an existing user's password is preserved if a new one is not provided.
 // It does not return any errors.
 //
@@ -598,6 +1489,15 @@ func (uv *userValidator) idSetToZero() (string, userValFn) {
 	}
 }
 
+// featureFlagsCleared clears the user's feature flags, as they are only set by SetFeatureFlags. It does not
+// return any errors.
+func (uv *userValidator) featureFlagsCleared() (string, userValFn) {
+	return "", func(u *User) error {
+		u.FeatureFlags = nil
+		return nil
+	}
+}
+
 // passwordRequired makes sure u.Password is not empty. It may return ErrRequired.
 func (uv *userValidator) passwordRequired() (string, userValFn) {
 	return "password", func(u *User) error {
@@ -620,6 +1520,38 @@ func (uv *userValidator) passwordLength() (string, userValFn) {
 	}
 }
 
+// passwordDigit makes sure u.Password contains a digit, when the validator requires one. It may return
+// ErrPasswordNoDigit.
+func (uv *userValidator) passwordDigit() (string, userValFn) {
+	return "password", func(u *User) error {
+		if !uv.digit || u.Password == "" {
+			return nil
+		}
+
+		if strings.IndexFunc(u.Password, unicode.IsDigit) < 0 {
+			return ErrPasswordNoDigit
+		}
+
+		return nil
+	}
+}
+
+// passwordNotBreached makes sure u.Password has not appeared in a data breach, when the validator has a
+// breach checker. Errors of the checker are ignored. It may return ErrPasswordBreached.
+func (uv *userValidator) passwordNotBreached() (string, userValFn) {
+	return "password", func(u *User) error {
+		if uv.breaches == nil || u.Password == "" {
+			return nil
+		}
+
+		if breached, err := uv.breaches.Breached(uv.ctx, u.Password); err == nil && breached {
+			return ErrPasswordBreached
+		}
+
+		return nil
+	}
+}
+
 // passwordHash hashes the password. It may return private errors.
 func (uv *userValidator) passwordHash() (string, userValFn) {
 	return "", func(u *User) error {
@@ -627,7 +1559,7 @@ func (uv *userValidator) passwordHash() (string, userValFn) {
 			return nil
 		}
 
-		hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost+2)
+		hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), uv.cost)
 		if err != nil {
 			return wrap("failed to hash password", err)
 		}
@@ -684,6 +1616,57 @@ func (uv *userValidator) emailFormat() (string, userValFn) {
 	}
 }
 
+// emailDomainAllowed makes sure the domain of u.Email is one of the domains users can sign up with, when
+// they are restricted. It may return ErrEmailDomain.
+func (uv *userValidator) emailDomainAllowed() (string, userValFn) {
+	return "email", func(u *User) error {
+		if len(uv.domains) == 0 || u.Email == "" {
+			return nil
+		}
+
+		domain := u.Email[strings.LastIndex(u.Email, "@")+1:]
+		for _, d := range uv.domains {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if domain == d || strings.HasPrefix(d, "*.") && strings.HasSuffix(domain, d[1:]) {
+				return nil
+			}
+		}
+
+		return ErrEmailDomain
+	}
+}
+
+// emailNotDisposable makes sure u.Email is not the address of a disposable email service, when they are
+// checked. It may return ErrDisposableEmail.
+func (uv *userValidator) emailNotDisposable() (string, userValFn) {
+	return "email", func(u *User) error {
+		if uv.disposable == nil || u.Email == "" {
+			return nil
+		}
+
+		domain := u.Email[strings.LastIndex(u.Email, "@")+1:]
+		if disposable, err := uv.disposable.Disposable(uv.ctx, domain); err == nil && disposable {
+			return ErrDisposableEmail
+		}
+
+		return nil
+	}
+}
+
+// canonicaliseEmail sets u.CanonicalEmail to the canonical form of u.Email, when emails are canonicalised.
+// It does not return any errors.
+//
+// This method must be called AFTER normaliseEmail.
+func (uv *userValidator) canonicaliseEmail() (string, userValFn) {
+	return "email", func(u *User) error {
+		if len(uv.canonical) > 0 {
+			u.CanonicalEmail = canonicalEmail(u.Email, uv.canonical)
+		}
+
+		return nil
+	}
+}
+
 // emailIsTaken makes sure u.Email is not taken in the database. It returns nil if the address
 // is not taken. It may return ErrDuplicate.
 func (uv *userValidator) emailIsTaken() (string, userValFn) {
@@ -693,6 +1676,12 @@ func (uv *userValidator) emailIsTaken() (string, userValFn) {
 			return ErrDuplicate
 		}
 
+		if len(uv.canonical) > 0 {
+			if _, err := uv.UserDB.ByCanonicalEmail(uv.ctx, u.CanonicalEmail); err == nil {
+				return ErrDuplicate
+			}
+		}
+
 		return nil
 	}
 }
@@ -832,6 +1821,24 @@ func (ug *userGorm) ByEmail(ctx context.Context, e string) (User, error) {
 	return user, nil
 }
 
+func (ug *userGorm) ByCanonicalEmail(ctx context.Context, e string) (User, error) {
+	ctx, span := trace.StartSpan(ctx, "user.Database.ByCanonicalEmail")
+	defer span.End()
+	ug.db.WithContext(ctx)
+
+	var user User
+	err := ug.db.Where("canonical_email = ?", e).First(&user).Error
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return User{}, ErrNotFound
+		}
+
+		return User{}, wrap("could not get user by canonical email", err)
+	}
+
+	return user, nil
+}
+
 func (ug *userGorm) ByID(ctx context.Context, id int64) (User, error) {
 	ctx, span := trace.StartSpan(ctx, "user.Database.ByID")
 	defer span.End()
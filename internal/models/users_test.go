@@ -2,6 +2,9 @@ package models
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"strings"
 	"testing"
 	"time"
@@ -21,12 +24,22 @@ const (
 
 type testUserDB struct {
 	UserDB
-	byEmail func(context.Context, string) (User, error)
-	byID    func(context.Context, int64) (User, error)
-	byIDs   func(context.Context, ...int64) ([]User, error)
-	delete  func(context.Context, int64) error
-	create  func(context.Context, *User) error
-	update  func(context.Context, *User) error
+	byEmail          func(context.Context, string) (User, error)
+	byCanonicalEmail func(context.Context, string) (User, error)
+	byID             func(context.Context, int64) (User, error)
+	byIDs            func(context.Context, ...int64) ([]User, error)
+	delete           func(context.Context, int64) error
+	create           func(context.Context, *User) error
+	update           func(context.Context, *User) error
+
+	revokeSession  func(context.Context, *RevokedSession) error
+	sessionRevoked func(context.Context, int64, string) (bool, error)
+	revokeGrant    func(context.Context, *RevokedGrant) error
+	grantRevokedAt func(context.Context, int64, string) (time.Time, error)
+	revokeTrust    func(context.Context, *RevokedTrust) error
+	trustRevokedAt func(context.Context, int64) (time.Time, error)
+	revokeTokenID  func(context.Context, *RevokedToken) error
+	tokenIDRevoked func(context.Context, int64, string) (bool, error)
 }
 
 func (t *testUserDB) ByEmail(ctx context.Context, e string) (User, error) {
@@ -37,6 +50,14 @@ func (t *testUserDB) ByEmail(ctx context.Context, e string) (User, error) {
 	return User{}, nil
 }
 
+func (t *testUserDB) ByCanonicalEmail(ctx context.Context, e string) (User, error) {
+	if t.byCanonicalEmail != nil {
+		return t.byCanonicalEmail(ctx, e)
+	}
+
+	return User{}, ErrNotFound
+}
+
 func (t *testUserDB) ByID(ctx context.Context, id int64) (User, error) {
 	if t.byID != nil {
 		return t.byID(ctx, id)
@@ -77,6 +98,70 @@ func (t *testUserDB) Update(ctx context.Context, u *User) error {
 	return nil
 }
 
+func (t *testUserDB) RevokeSession(ctx context.Context, rs *RevokedSession) error {
+	if t.revokeSession != nil {
+		return t.revokeSession(ctx, rs)
+	}
+
+	return nil
+}
+
+func (t *testUserDB) SessionRevoked(ctx context.Context, userID int64, id string) (bool, error) {
+	if t.sessionRevoked != nil {
+		return t.sessionRevoked(ctx, userID, id)
+	}
+
+	return false, nil
+}
+
+func (t *testUserDB) RevokeGrant(ctx context.Context, rg *RevokedGrant) error {
+	if t.revokeGrant != nil {
+		return t.revokeGrant(ctx, rg)
+	}
+
+	return nil
+}
+
+func (t *testUserDB) GrantRevokedAt(ctx context.Context, userID int64, clientID string) (time.Time, error) {
+	if t.grantRevokedAt != nil {
+		return t.grantRevokedAt(ctx, userID, clientID)
+	}
+
+	return time.Time{}, nil
+}
+
+func (t *testUserDB) RevokeTrust(ctx context.Context, rt *RevokedTrust) error {
+	if t.revokeTrust != nil {
+		return t.revokeTrust(ctx, rt)
+	}
+
+	return nil
+}
+
+func (t *testUserDB) TrustRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	if t.trustRevokedAt != nil {
+		return t.trustRevokedAt(ctx, userID)
+	}
+
+	return time.Time{}, nil
+}
+
+func (t *testUserDB) RevokeTokenID(ctx context.Context, rt *RevokedToken) error {
+	if t.revokeTokenID != nil {
+		return t.revokeTokenID(ctx, rt)
+	}
+
+	return nil
+}
+
+func (t *testUserDB) TokenIDRevoked(ctx context.Context, userID int64, id string) (bool, error) {
+	if t.tokenIDRevoked != nil {
+		return t.tokenIDRevoked(ctx, userID, id)
+	}
+
+	return false, nil
+}
+
 func dropUsersTable(db *gorm.DB) {
 	db.Migrator().DropTable(&User{})
 }
@@ -98,7 +183,7 @@ func TestNewUser(t *testing.T) {
 
 func TestUserService_Authenticate(t *testing.T) {
 	tudb := &testUserDB{}
-	us := NewUserService(nil, []byte(testJWTSecret))
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
 	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
 	var cases = []struct {
@@ -255,9 +340,52 @@ func TestUserService_Authenticate(t *testing.T) {
 	}
 }
 
+func TestUserService_AuthenticateEnumerationSafe(t *testing.T) {
+	ctx := context.Background()
+	tudb := &testUserDB{}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{EnumerationSafe: true})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("adifferentpassword"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	var cases = []struct {
+		name    string
+		byEmail func(context.Context, string) (User, error)
+	}{
+		{
+			"noUser",
+			func(ctx context.Context, e string) (User, error) {
+				return User{}, ErrNotFound
+			},
+		},
+		{
+			"passwordNotMatch",
+			func(ctx context.Context, e string) (User, error) {
+				return User{Active: true, Password: string(hash)}, nil
+			},
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			tudb.byEmail = cs.byEmail
+
+			start := time.Now()
+			user, err := us.Authenticate(ctx, "auseremail@name.com", "password")
+			elapsed := time.Since(start)
+
+			assert.Equal(t, ErrUnauthorised, err)
+			assert.Equal(t, User{}, user)
+			assert.GreaterOrEqual(t, int64(elapsed), int64(waitAfterAuthError))
+			assert.Less(t, int64(elapsed), int64(waitAfterAuthError+waitJitter+200*time.Millisecond))
+		})
+	}
+}
+
 func TestUserService_Refresh(t *testing.T) {
 	tudb := &testUserDB{}
-	us := NewUserService(nil, []byte(testJWTSecret))
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
 	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
 	ctx := context.Background()
@@ -386,9 +514,261 @@ func TestUserService_Refresh(t *testing.T) {
 	})
 }
 
+func TestUserService_RotateMaxRotations(t *testing.T) {
+	tudb := &testUserDB{}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{MaxRefreshRotations: 3})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	ctx := context.Background()
+	user := User{
+		ID:     888,
+		Active: true,
+	}
+
+	tudb.byID = func(ctx context.Context, id int64) (User, error) {
+		assert.Equal(t, int64(888), id)
+		return user, nil
+	}
+
+	tok, err := us.Token(ctx, &user)
+	require.NoError(t, err)
+
+	family := func(refreshToken string) authClaims {
+		jtok, err := jwt.ParseSigned(refreshToken)
+		require.NoError(t, err)
+
+		var cl authClaims
+		require.NoError(t, jtok.Claims([]byte(testJWTSecret), &cl))
+		return cl
+	}
+	first := family(tok.RefreshToken)
+	assert.NotEmpty(t, first.Family)
+	assert.Equal(t, 0, first.Rotation)
+
+	for i := 1; i <= 3; i++ {
+		tok, err = us.Rotate(ctx, tok.RefreshToken)
+		require.NoError(t, err, "rotation %d", i)
+		assert.NotEmpty(t, tok.AccessToken)
+
+		cl := family(tok.RefreshToken)
+		assert.Equal(t, first.Family, cl.Family, "rotated tokens keep the family")
+		assert.Equal(t, i, cl.Rotation)
+	}
+
+	_, err = us.Rotate(ctx, tok.RefreshToken)
+	assert.Error(t, err)
+	assert.True(t, xerrors.Is(err, ErrReauthRequired))
+
+	t.Run("newLoginStartsNewFamily", func(t *testing.T) {
+		tok, err := us.Token(ctx, &user)
+		require.NoError(t, err)
+		assert.NotEqual(t, first.Family, family(tok.RefreshToken).Family)
+
+		_, err = us.Rotate(ctx, tok.RefreshToken)
+		assert.NoError(t, err)
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		us.(*userService).cfg.MaxRefreshRotations = 0
+		defer func() { us.(*userService).cfg.MaxRefreshRotations = 3 }()
+
+		_, err := us.Rotate(ctx, tok.RefreshToken)
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalidToken", func(t *testing.T) {
+		_, err := us.Rotate(ctx, tok.AccessToken)
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+}
+
+func TestUserService_MaxSessionLifetime(t *testing.T) {
+	ctx := context.Background()
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	now := time.Now()
+	us := NewUserService(nil, []byte(testJWTSecret), Config{
+		MaxSessionLifetime: 24 * time.Hour,
+		Now:                func() time.Time { return now },
+	})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	tok, err := us.Token(ctx, &User{ID: 888})
+	require.NoError(t, err)
+
+	// every refresh token is still valid for days, but the session ends a day after the login.
+	for i := 1; i < 4; i++ {
+		now = now.Add(6 * time.Hour)
+		tok, err = us.Rotate(ctx, tok.RefreshToken)
+		require.NoError(t, err, "refresh %d", i)
+	}
+
+	now = now.Add(6 * time.Hour)
+	_, err = us.Rotate(ctx, tok.RefreshToken)
+	assert.Equal(t, ErrReauthRequired, err)
+
+	_, err = us.Refresh(ctx, tok.RefreshToken)
+	assert.Equal(t, ErrReauthRequired, err)
+
+	// a new login starts a new session.
+	tok, err = us.Token(ctx, &User{ID: 888})
+	require.NoError(t, err)
+	_, err = us.Rotate(ctx, tok.RefreshToken)
+	assert.NoError(t, err)
+}
+
+func TestUserService_RotateMaxAge(t *testing.T) {
+	ctx := context.Background()
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	login := time.Now().Truncate(time.Second)
+	now := login
+	us := NewUserService(nil, []byte(testJWTSecret), Config{Now: func() time.Time { return now }})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	tok, err := us.Token(ctx, &User{ID: 888})
+	require.NoError(t, err)
+
+	// within max_age, the session is refreshed silently and keeps the time of the login.
+	now = login.Add(30 * time.Minute)
+	tok, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{MaxAge: time.Hour})
+	require.NoError(t, err)
+
+	cl, err := us.Validate(ctx, tok.AccessToken)
+	require.NoError(t, err)
+	assert.True(t, login.Equal(cl.AuthTime), "auth_time is the time of the login")
+
+	// beyond it, a fresh login is required.
+	now = login.Add(2 * time.Hour)
+	_, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{MaxAge: time.Hour})
+	assert.Equal(t, ErrReauthRequired, err)
+
+	_, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{})
+	assert.NoError(t, err, "max_age is only checked when requested")
+
+	// the fresh login sets a new auth_time.
+	tok, err = us.Token(ctx, &User{ID: 888})
+	require.NoError(t, err)
+
+	cl, err = us.Validate(ctx, tok.AccessToken)
+	require.NoError(t, err)
+	assert.True(t, now.Equal(cl.AuthTime))
+
+	_, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{MaxAge: time.Hour})
+	assert.NoError(t, err)
+}
+
+func TestUserService_RotateScope(t *testing.T) {
+	ctx := context.Background()
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		reauth    bool
+		scope     string
+		outScopes []string
+		outErr    error
+	}{
+		{"unchanged", true, "", []string{"read", "write"}, nil},
+		{"same", true, "write read", []string{"write", "read"}, nil},
+		{"narrower", true, "read", []string{"read"}, nil},
+		{"broader", true, "read admin", nil, ErrReauthRequired},
+		{"disabledIgnored", false, "read admin", []string{"read", "write"}, nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			us := NewUserService(nil, []byte(testJWTSecret), Config{RefreshScopeReauth: cs.reauth})
+			us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+			tok, err := us.ClientToken(ctx, &User{ID: 888}, &Client{ID: "app"}, "read", "write")
+			require.NoError(t, err)
+
+			tok, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{Scope: cs.scope, ClientID: "app"})
+			assert.Equal(t, cs.outErr, err)
+			if cs.outErr != nil {
+				return
+			}
+
+			cl, err := us.Validate(ctx, tok.AccessToken)
+			require.NoError(t, err)
+			assert.Equal(t, cs.outScopes, cl.Scopes)
+
+			// the narrowed scope sticks to the session, so it cannot be broadened back.
+			if cs.reauth {
+				_, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{Scope: "read write", ClientID: "app"})
+				if len(cs.outScopes) < 2 {
+					assert.Equal(t, ErrReauthRequired, err)
+				} else {
+					assert.NoError(t, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUserService_RotateClient(t *testing.T) {
+	ctx := context.Background()
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	var cases = []struct {
+		name     string
+		issuedTo string
+		clientID string
+		outErr   error
+	}{
+		{"sameClient", "app", "app", nil},
+		{"wrongClient", "app", "other", ErrUnauthorised},
+		{"missingClient", "app", "", ErrUnauthorised},
+		{"noClientIssued", "", "app", nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			us := NewUserService(nil, []byte(testJWTSecret), Config{RefreshIdempotencyWindow: time.Minute})
+			us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+			tok, err := us.Token(ctx, &User{ID: 888})
+			if cs.issuedTo != "" {
+				tok, err = us.ClientToken(ctx, &User{ID: 888}, &Client{ID: cs.issuedTo})
+			}
+			require.NoError(t, err)
+
+			_, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{ClientID: cs.clientID})
+			assert.Equal(t, cs.outErr, err)
+
+			// the tokens already issued are not returned to other clients either.
+			_, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{ClientID: cs.issuedTo})
+			require.NoError(t, err)
+			_, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{ClientID: cs.clientID})
+			assert.Equal(t, cs.outErr, err)
+		})
+	}
+}
+
 func TestUserService_Validate(t *testing.T) {
 	tudb := &testUserDB{}
-	us := NewUserService(nil, []byte(testJWTSecret))
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
 	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
 	ctx := context.Background()
@@ -416,169 +796,1112 @@ func TestUserService_Validate(t *testing.T) {
 			},
 		}
 
-		atok, err := jwt.Signed(us.(*userService).signer).Claims(clr).CompactSerialize()
-		require.NoError(t, err)
+		atok, err := jwt.Signed(us.(*userService).signer).Claims(clr).CompactSerialize()
+		require.NoError(t, err)
+
+		_, err = us.Validate(ctx, atok)
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+
+	t.Run("wrongTokenType", func(t *testing.T) {
+		tok, err := us.Token(ctx, &User{
+			ID:     888,
+			Active: true,
+		})
+		require.NoError(t, err)
+
+		_, err = us.Validate(ctx, tok.RefreshToken)
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+
+	t.Run("notFound", func(t *testing.T) {
+		tok, err := us.Token(ctx, &User{
+			ID:     888,
+			Active: true,
+		})
+		require.NoError(t, err)
+
+		tudb.byID = func(ctx context.Context, id int64) (User, error) {
+			assert.Equal(t, int64(888), id)
+			return User{}, ErrNotFound
+		}
+
+		_, err = us.Validate(ctx, tok.AccessToken)
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+
+	t.Run("dbErrorInternal", func(t *testing.T) {
+		tok, err := us.Token(ctx, &User{
+			ID:     888,
+			Active: true,
+		})
+		require.NoError(t, err)
+
+		tudb.byID = func(ctx context.Context, id int64) (User, error) {
+			assert.Equal(t, int64(888), id)
+			return User{}, wrap("some error message", nil)
+		}
+
+		_, err = us.Validate(ctx, tok.AccessToken)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("inactiveUser", func(t *testing.T) {
+		user := User{
+			ID:     888,
+			Active: true,
+		}
+
+		tok, err := us.Token(ctx, &user)
+		require.NoError(t, err)
+
+		tudb.byID = func(ctx context.Context, id int64) (User, error) {
+			assert.Equal(t, int64(888), id)
+
+			ret := user
+			ret.Active = false
+			return ret, nil
+		}
+
+		_, err = us.Validate(ctx, tok.AccessToken)
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		user := User{
+			ID:     888,
+			Active: true,
+		}
+
+		tok, err := us.Token(ctx, &user)
+		require.NoError(t, err)
+
+		tudb.byID = func(ctx context.Context, id int64) (User, error) {
+			assert.Equal(t, int64(888), id)
+			return user, nil
+		}
+
+		claims, err := us.Validate(ctx, tok.AccessToken)
+
+		assert.NoError(t, err)
+		assert.Equal(t, user, claims.User)
+	})
+}
+
+func TestUserService_ValidateDistinctErrors(t *testing.T) {
+	ctx := context.Background()
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			if id != 999 {
+				return User{}, ErrNotFound
+			}
+
+			return User{ID: id, Active: true}, nil
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{DistinctTokenErrors: true})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	sign := func(signer jose.Signer, subject string, expiry time.Duration) string {
+		tok, err := jwt.Signed(signer).Claims(authClaims{
+			Claims: jwt.Claims{
+				Subject:  subject,
+				Issuer:   "goauthsvc",
+				IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+				Expiry:   jwt.NewNumericDate(time.Now().Add(expiry)),
+			},
+		}).CompactSerialize()
+		require.NoError(t, err)
+
+		return tok
+	}
+	valid := sign(us.(*userService).signer, "999", time.Hour)
+	expired := sign(us.(*userService).signer, "999", -10*time.Minute)
+	otherKey := newSigner([]byte("another very lengthy secret used by another issuer"))
+
+	var cases = []struct {
+		name   string
+		token  string
+		outErr error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired, ErrTokenExpired},
+		{"tampered", valid[:len(valid)-4] + "AAAA", ErrInvalidToken},
+		// an expired token with an unknown signature must not be reported as expired
+		{"unknownExpired", sign(otherKey, "999", -10*time.Minute), ErrInvalidToken},
+		{"unknown", sign(otherKey, "999", time.Hour), ErrInvalidToken},
+		{"malformed", "very.bad.token", ErrInvalidToken},
+		{"empty", "", ErrInvalidToken},
+		{"userNotFound", sign(us.(*userService).signer, "888", time.Hour), ErrInvalidToken},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			_, err := us.Validate(ctx, cs.token)
+
+			assert.Equal(t, cs.outErr, err)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		us.(*userService).cfg.DistinctTokenErrors = false
+		defer func() { us.(*userService).cfg.DistinctTokenErrors = true }()
+
+		_, err := us.Validate(ctx, expired)
+		assert.Equal(t, ErrUnauthorised, err)
+
+		_, err = us.Validate(ctx, valid[:len(valid)-4]+"AAAA")
+		assert.Equal(t, ErrUnauthorised, err)
+	})
+}
+
+func TestUserService_ValidateStoreFailure(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	storeErr := wrap("database is down", nil)
+
+	var cases = []struct {
+		name      string
+		policy    string
+		elapsed   time.Duration // since the store started failing
+		byID      func(context.Context, int64) (User, error)
+		revokedAt func(context.Context, int64, string) (time.Time, error)
+		outUserID int64
+		outErr    bool
+		outEvents int
+	}{
+		{
+			"closedUserUnavailable", StoreFailClosed, 0,
+			func(context.Context, int64) (User, error) { return User{}, storeErr },
+			nil,
+			0, true, 0,
+		},
+		{
+			"closedByDefault", "", 0,
+			func(context.Context, int64) (User, error) { return User{}, storeErr },
+			nil,
+			0, true, 0,
+		},
+		{
+			"openUserUnavailable", StoreFailOpen, 0,
+			func(context.Context, int64) (User, error) { return User{}, storeErr },
+			nil,
+			999, false, 1,
+		},
+		{
+			"openGrantUnavailable", StoreFailOpen, 0,
+			nil,
+			func(context.Context, int64, string) (time.Time, error) { return time.Time{}, storeErr },
+			999, false, 1,
+		},
+		{
+			"openWindowElapsed", StoreFailOpen, 2 * time.Minute,
+			func(context.Context, int64) (User, error) { return User{}, storeErr },
+			nil,
+			0, true, 0,
+		},
+		{
+			// a missing user is an answer from the store, not a failure.
+			"openUserNotFound", StoreFailOpen, 0,
+			func(context.Context, int64) (User, error) { return User{}, ErrNotFound },
+			nil,
+			0, true, 0,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			tadb := &testAuditDB{}
+			clock := now
+			us := NewUserService(nil, []byte(testJWTSecret), Config{
+				StoreFailurePolicy:  cs.policy,
+				StoreFailOpenWindow: time.Minute,
+				Audit:               newAuditService(tadb, Config{}),
+				Now:                 func() time.Time { return clock },
+			})
+			us.(*userService).UserService.(*userValidator).UserDB = &testUserDB{
+				byID:           cs.byID,
+				grantRevokedAt: cs.revokedAt,
+			}
+
+			tok, err := jwt.Signed(us.(*userService).signer).Claims(authClaims{
+				Claims: jwt.Claims{
+					Subject:  "999",
+					Issuer:   "goauthsvc",
+					IssuedAt: jwt.NewNumericDate(now),
+					Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+				},
+				ClientID: "client",
+			}).CompactSerialize()
+			require.NoError(t, err)
+
+			// the outage starts with a first failed validation.
+			us.(*userService).outage.failed(now.UTC())
+			clock = now.Add(cs.elapsed)
+
+			cl, err := us.Validate(ctx, tok)
+			if cs.outErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, cs.outUserID, cl.User.ID)
+
+			var events []AuditEvent
+			for _, b := range tadb.written() {
+				events = append(events, b...)
+			}
+			require.Len(t, events, cs.outEvents)
+			for _, e := range events {
+				assert.Equal(t, "token_accepted_fail_open", e.Action)
+				assert.Equal(t, int64(999), e.UserID)
+				assert.Equal(t, "client", e.ClientID)
+			}
+		})
+	}
+
+	t.Run("recovery", func(t *testing.T) {
+		clock := now
+		tudb := &testUserDB{}
+		us := NewUserService(nil, []byte(testJWTSecret), Config{
+			StoreFailurePolicy:  StoreFailOpen,
+			StoreFailOpenWindow: time.Minute,
+			Now:                 func() time.Time { return clock },
+		})
+		us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+		tok, err := jwt.Signed(us.(*userService).signer).Claims(authClaims{
+			Claims: jwt.Claims{
+				Subject: "999",
+				Issuer:  "goauthsvc",
+				Expiry:  jwt.NewNumericDate(now.Add(time.Hour)),
+			},
+		}).CompactSerialize()
+		require.NoError(t, err)
+
+		tudb.byID = func(context.Context, int64) (User, error) { return User{}, storeErr }
+		_, err = us.Validate(ctx, tok)
+		require.NoError(t, err)
+
+		// once the store answers again, a later outage gets a whole new window.
+		tudb.byID = func(ctx context.Context, id int64) (User, error) { return User{ID: id, Active: true}, nil }
+		clock = now.Add(50 * time.Second)
+		_, err = us.Validate(ctx, tok)
+		require.NoError(t, err)
+
+		tudb.byID = func(context.Context, int64) (User, error) { return User{}, storeErr }
+		clock = now.Add(90 * time.Second)
+		_, err = us.Validate(ctx, tok)
+		assert.NoError(t, err)
+	})
+}
+
+func TestUserService_ValidateClaimsValidator(t *testing.T) {
+	const errTenantNotAllowed ModelError = "models: tenant_not_allowed, the client tenant is not allowed"
+
+	ctx := context.Background()
+	allowed := map[string]bool{"acme-webapp": true}
+
+	us := NewUserService(nil, []byte(testJWTSecret), Config{
+		ClaimsValidator: ClaimsValidatorFunc(func(ctx context.Context, c Claims) error {
+			switch {
+			case c.ClientID == "broken":
+				return wrap("allowlist unavailable", nil)
+			case c.ClientID == "":
+				return ErrClaimsRejected
+			case !allowed[c.ClientID]:
+				return errTenantNotAllowed
+			}
+
+			return nil
+		}),
+	})
+	us.(*userService).UserService.(*userValidator).UserDB = &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		clientID  string
+		outErr    error
+		outPublic bool
+	}{
+		{"allowed", "acme-webapp", nil, false},
+		{"customError", "globex-webapp", errTenantNotAllowed, true},
+		{"rejected", "", ErrClaimsRejected, true},
+		{"validatorFailure", "broken", nil, false},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			tok, err := us.ClientToken(ctx, &User{ID: 999}, &Client{ID: cs.clientID}, "profile")
+			require.NoError(t, err)
+
+			cl, err := us.Validate(ctx, tok.AccessToken)
+			switch {
+			case cs.outPublic:
+				assert.Equal(t, cs.outErr, err)
+			case cs.name == "validatorFailure":
+				require.Error(t, err)
+				_, ok := err.(PublicError)
+				assert.False(t, ok, "validator failures are not reported to clients")
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, int64(999), cl.User.ID)
+				assert.Equal(t, cs.clientID, cl.ClientID)
+				assert.Equal(t, []string{"profile"}, cl.Scopes)
+			}
+		})
+	}
+}
+
+func TestUserService_ValidateAccessTokenGrace(t *testing.T) {
+	const grace = 30 * time.Second
+
+	tudb := &testUserDB{}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{AccessTokenGrace: grace})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	ctx := context.Background()
+	user := User{
+		ID:     888,
+		Active: true,
+	}
+	tudb.byID = func(ctx context.Context, id int64) (User, error) {
+		return user, nil
+	}
+
+	expiredToken := func(ago time.Duration) string {
+		cl := authClaims{
+			Claims: jwt.Claims{
+				Subject: "888",
+				Issuer:  "goauthsvc",
+				Expiry:  jwt.NewNumericDate(time.Now().UTC().Add(-ago)),
+			},
+		}
+
+		tok, err := jwt.Signed(us.(*userService).signer).Claims(cl).CompactSerialize()
+		require.NoError(t, err)
+
+		return tok
+	}
+
+	t.Run("insideGrace", func(t *testing.T) {
+		claims, err := us.Validate(ctx, expiredToken(jwt.DefaultLeeway+grace-5*time.Second))
+
+		assert.NoError(t, err)
+		assert.Equal(t, user, claims.User)
+	})
+
+	t.Run("outsideGrace", func(t *testing.T) {
+		_, err := us.Validate(ctx, expiredToken(jwt.DefaultLeeway+grace+5*time.Second))
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+
+	t.Run("refreshTokenNotAffected", func(t *testing.T) {
+		cl := authClaims{
+			Claims: jwt.Claims{
+				Subject: "888",
+				Issuer:  "goauthsvcrefresh",
+				Expiry:  jwt.NewNumericDate(time.Now().UTC().Add(-(jwt.DefaultLeeway + grace - 5*time.Second))),
+			},
+		}
+
+		rtok, err := jwt.Signed(us.(*userService).signer).Claims(cl).CompactSerialize()
+		require.NoError(t, err)
+
+		_, err = us.Refresh(ctx, rtok)
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+
+	t.Run("disabledByDefault", func(t *testing.T) {
+		us := NewUserService(nil, []byte(testJWTSecret), Config{})
+		us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+		_, err := us.Validate(ctx, expiredToken(jwt.DefaultLeeway+5*time.Second))
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+}
+
+func TestUserService_ValidateIssuedInFuture(t *testing.T) {
+	const skew = 30 * time.Second
+	now := time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	tudb := &testUserDB{}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{
+		Now:       func() time.Time { return now },
+		ClockSkew: skew,
+	})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	ctx := context.Background()
+	user := User{
+		ID:     888,
+		Active: true,
+	}
+	tudb.byID = func(ctx context.Context, id int64) (User, error) {
+		return user, nil
+	}
+
+	issuedAt := func(iat time.Time) string {
+		cl := authClaims{
+			Claims: jwt.Claims{
+				Subject:  "888",
+				Issuer:   "goauthsvc",
+				IssuedAt: jwt.NewNumericDate(iat),
+				Expiry:   jwt.NewNumericDate(iat.Add(time.Hour)),
+			},
+		}
+
+		tok, err := jwt.Signed(us.(*userService).signer).Claims(cl).CompactSerialize()
+		require.NoError(t, err)
+
+		return tok
+	}
+
+	t.Run("issuedNow", func(t *testing.T) {
+		tok, err := us.Token(ctx, &user)
+		require.NoError(t, err)
+
+		_, err = us.Validate(ctx, tok.AccessToken)
+		assert.NoError(t, err)
+	})
+
+	t.Run("withinSkew", func(t *testing.T) {
+		_, err := us.Validate(ctx, issuedAt(now.Add(skew-5*time.Second)))
+		assert.NoError(t, err)
+	})
+
+	t.Run("beyondSkew", func(t *testing.T) {
+		_, err := us.Validate(ctx, issuedAt(now.Add(skew+5*time.Second)))
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+
+	t.Run("beyondSkewWithGrace", func(t *testing.T) {
+		us.(*userService).cfg.AccessTokenGrace = time.Hour
+		defer func() { us.(*userService).cfg.AccessTokenGrace = 0 }()
+
+		_, err := us.Validate(ctx, issuedAt(now.Add(skew+5*time.Second)))
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+
+	t.Run("expiredUnderFakeClock", func(t *testing.T) {
+		_, err := us.Validate(ctx, issuedAt(now.Add(-time.Hour-skew-5*time.Second)))
+
+		assert.Error(t, err)
+		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+	})
+}
+
+// idTokenClaims returns the claims of idToken, verified as clients do with the keys and the issuer of us.
+func idTokenClaims(t *testing.T, us UserService, idToken string) IDClaims {
+	t.Helper()
+
+	tok, err := jwt.ParseSigned(idToken)
+	require.NoError(t, err)
+	require.True(t, signedWith(tok, us.(*userService).keys.alg))
+
+	var cl IDClaims
+	require.NoError(t, tok.Claims(us.(*userService).keys.verify, &cl))
+	require.NoError(t, cl.Validate(jwt.Expected{Issuer: us.(*userService).cfg.issuer(), Time: time.Now()}))
+
+	return cl
+}
+
+func TestUserService_IDToken(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Second)
+	us := NewUserService(nil, []byte(testJWTSecret), Config{Now: func() time.Time { return now }})
+	user := User{ID: 888, Email: "jane@example.com", FirstName: "Jane", LastName: "Doe", Nickname: "jd"}
+
+	idToken, err := us.IDToken(ctx, &user, "webapp", IDTokenOptions{
+		Nonce:       "n-0S6_WzA2Mj",
+		AuthClass:   "urn:example:mfa",
+		AuthMethods: []string{"pwd", "otp", "mfa"},
+	}, "openid", "profile", "email")
+	require.NoError(t, err)
+
+	cl := idTokenClaims(t, us, idToken)
+	assert.Equal(t, "888", cl.Subject)
+	assert.Equal(t, "goauthsvcid", cl.Issuer)
+	assert.Equal(t, jwt.Audience{"webapp"}, cl.Audience)
+	assert.True(t, now.Equal(cl.IssuedAt.Time()))
+	assert.True(t, now.Add(time.Hour).Equal(cl.Expiry.Time()))
+	assert.Equal(t, "n-0S6_WzA2Mj", cl.Nonce)
+	assert.Equal(t, "urn:example:mfa", cl.AuthClass)
+	assert.Equal(t, []string{"pwd", "otp", "mfa"}, cl.AuthMethods)
+	assert.Equal(t, "Jane Doe", cl.Name)
+	assert.Equal(t, "Jane", cl.GivenName)
+	assert.Equal(t, "Doe", cl.FamilyName)
+	assert.Equal(t, "jd", cl.Nickname)
+	assert.Equal(t, "jane@example.com", cl.Email)
+
+	_, err = us.Validate(ctx, idToken)
+	assert.Equal(t, ErrUnauthorised, err, "ID tokens are not access tokens")
+
+	// the claims of the user are only included for the scopes granted.
+	idToken, err = us.IDToken(ctx, &user, "webapp", IDTokenOptions{}, "openid")
+	require.NoError(t, err)
+
+	cl = idTokenClaims(t, us, idToken)
+	assert.Equal(t, "888", cl.Subject)
+	assert.Empty(t, cl.Name)
+	assert.Empty(t, cl.Email)
+	assert.Empty(t, cl.AuthClass)
+	assert.Empty(t, cl.AuthMethods)
+
+	// the ID tokens are signed with the configured algorithm, and issued by the configured issuer.
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	us = NewUserService(nil, []byte(testJWTSecret), Config{
+		SigningAlgorithm: SigningES256,
+		SigningKey:       ecKey,
+		Issuer:           "https://auth.example.com",
+	})
+
+	idToken, err = us.IDToken(ctx, &user, "webapp", IDTokenOptions{}, "openid")
+	require.NoError(t, err)
+
+	cl = idTokenClaims(t, us, idToken)
+	assert.Equal(t, "https://auth.example.com", cl.Issuer)
+}
+
+func TestUserService_Token(t *testing.T) {
+	const jwtkey = "test secret key for jwt signing"
+	ctx := context.Background()
+
+	us := NewUserService(nil, []byte(jwtkey), Config{})
+	user := User{
+		ID: 999,
+	}
+
+	assert.True(t, jwtAccessDuration >= 6*time.Hour, "jwt access duration must have a reasonable length of time")
+	assert.True(t, jwtRefreshDuration >= 1*24*time.Hour, "jwt refresh duration must have a reasonable length of time")
+
+	t.Run("good", func(t *testing.T) {
+		tok, err := us.Token(ctx, &user)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, tok.AccessToken)
+		assert.NotEmpty(t, tok.RefreshToken)
+		assert.Equal(t, "bearer", tok.TokenType)
+		assert.Equal(t, int(jwtAccessDuration/time.Second), tok.ExpiresIn)
+
+		// access token
+		jtok, err := jwt.ParseSigned(tok.AccessToken)
+		require.NoError(t, err, "token must be well formed")
+
+		var cl = authClaims{}
+		require.NoError(t, jtok.Claims([]byte(jwtkey), &cl), "token must be parseable")
+		assert.NoError(t, cl.Validate(jwt.Expected{
+			Issuer: "goauthsvc",
+			Time:   time.Now().UTC(),
+		}), "token is valid against key")
+
+		assert.Equal(t, "999", cl.Subject, "subject is present on token")
+		assert.True(t, cl.Expiry.Time().After(time.Now().Add(jwtAccessDuration-1*time.Minute)), "token has the right expiry time")
+		assert.True(t, cl.Expiry.Time().Before(time.Now().Add(jwtAccessDuration+1*time.Minute)), "token has the right expiry time")
+
+		rtok, err := jwt.ParseSigned(tok.RefreshToken)
+		require.NoError(t, err)
+
+		cl = authClaims{}
+		require.NoError(t, rtok.Claims([]byte(jwtkey), &cl), "refresh token must be parseable")
+		assert.NoError(t, cl.Validate(jwt.Expected{
+			Issuer: "goauthsvcrefresh",
+			Time:   time.Now().UTC(),
+		}), "refresh token is valid against key")
+
+		require.Equal(t, "999", cl.Subject, "subject is present on token")
+		assert.True(t, cl.Expiry.Time().After(time.Now().Add(jwtRefreshDuration-1*time.Minute)), "token has the right expiry time")
+		assert.True(t, cl.Expiry.Time().Before(time.Now().Add(jwtRefreshDuration+1*time.Minute)), "token has the right expiry time")
+	})
+
+	t.Run("badSigner", func(t *testing.T) {
+		us.(*userService).signer = &testSigner{}
+
+		tok, err := us.Token(ctx, &user)
+		assert.Error(t, err)
+		assert.Equal(t, Token{}, tok)
+	})
+}
+
+func TestUserService_ClientToken(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{Now: func() time.Time { return now }})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	var cases = []struct {
+		name       string
+		client     Client
+		outAccess  time.Duration
+		outRefresh time.Duration
+	}{
+		{"default", Client{ID: "mobile"}, jwtAccessDuration, jwtRefreshDuration},
+		{"override", Client{ID: "ci-bot", AccessTokenTTL: 5 * time.Minute, RefreshTokenTTL: time.Hour}, 5 * time.Minute, time.Hour},
+		{"accessOverride", Client{ID: "spa", AccessTokenTTL: 15 * time.Minute}, 15 * time.Minute, jwtRefreshDuration},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			tok, err := us.ClientToken(ctx, &User{ID: 999}, &cs.client)
+			require.NoError(t, err)
+
+			// rotations keep the lifetimes of the client
+			rotated, err := us.RotateWith(ctx, tok.RefreshToken, RotateOptions{ClientID: cs.client.ID})
+			require.NoError(t, err)
+
+			for _, tok := range []Token{tok, rotated} {
+				assert.Equal(t, int(cs.outAccess/time.Second), tok.ExpiresIn)
+
+				var access, refresh authClaims
+				jtok, err := jwt.ParseSigned(tok.AccessToken)
+				require.NoError(t, err)
+				require.NoError(t, jtok.Claims([]byte(testJWTSecret), &access))
+				assert.Equal(t, now.Add(cs.outAccess), access.Expiry.Time().UTC())
+
+				jtok, err = jwt.ParseSigned(tok.RefreshToken)
+				require.NoError(t, err)
+				require.NoError(t, jtok.Claims([]byte(testJWTSecret), &refresh))
+				assert.Equal(t, now.Add(cs.outRefresh), refresh.Expiry.Time().UTC())
+			}
+		})
+	}
+}
+
+func TestUserService_ClientTokenScopeTTL(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{
+		Now: func() time.Time { return now },
+		ScopeTokenTTL: map[string]time.Duration{
+			"admin":   5 * time.Minute,
+			"billing": 30 * time.Minute,
+		},
+	})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	var cases = []struct {
+		name      string
+		client    Client
+		scopes    []string
+		outAccess time.Duration
+	}{
+		{"noScopes", Client{ID: "webapp"}, nil, jwtAccessDuration},
+		{"unlistedScope", Client{ID: "webapp"}, []string{"profile"}, jwtAccessDuration},
+		{"shortLivedScope", Client{ID: "webapp"}, []string{"profile", "admin"}, 5 * time.Minute},
+		{"shortestWins", Client{ID: "webapp"}, []string{"billing", "admin"}, 5 * time.Minute},
+		{"clientShorter", Client{ID: "ci-bot", AccessTokenTTL: 2 * time.Minute}, []string{"admin"}, 2 * time.Minute},
+		{"scopeShorterThanClient", Client{ID: "spa", AccessTokenTTL: time.Hour}, []string{"billing"}, 30 * time.Minute},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			tok, err := us.ClientToken(ctx, &User{ID: 999}, &cs.client, cs.scopes...)
+			require.NoError(t, err)
+
+			// rotations keep the scopes, and so their lifetimes
+			rotated, err := us.RotateWith(ctx, tok.RefreshToken, RotateOptions{ClientID: cs.client.ID})
+			require.NoError(t, err)
+
+			for _, tok := range []Token{tok, rotated} {
+				assert.Equal(t, int(cs.outAccess/time.Second), tok.ExpiresIn)
+
+				var access authClaims
+				jtok, err := jwt.ParseSigned(tok.AccessToken)
+				require.NoError(t, err)
+				require.NoError(t, jtok.Claims([]byte(testJWTSecret), &access))
+				assert.Equal(t, now.Add(cs.outAccess), access.Expiry.Time().UTC())
+				assert.Equal(t, strings.Join(cs.scopes, " "), access.Scope)
+			}
+		})
+	}
+
+	t.Run("expiresSooner", func(t *testing.T) {
+		admin, err := us.ClientToken(ctx, &User{ID: 999}, &Client{ID: "webapp"}, "admin")
+		require.NoError(t, err)
+		profile, err := us.ClientToken(ctx, &User{ID: 999}, &Client{ID: "webapp"}, "profile")
+		require.NoError(t, err)
+
+		later := NewUserService(nil, []byte(testJWTSecret), Config{Now: func() time.Time { return now.Add(10 * time.Minute) }})
+		later.(*userService).UserService.(*userValidator).UserDB = tudb
+
+		_, err = later.Validate(ctx, admin.AccessToken)
+		assert.Equal(t, ErrUnauthorised, err)
+
+		_, err = later.Validate(ctx, profile.AccessToken)
+		assert.NoError(t, err)
+	})
+}
+
+func TestUserService_TokenFeatureFlags(t *testing.T) {
+	ctx := context.Background()
+	flags := FeatureFlags{"newCheckout": true, "betaSearch": true, "darkMode": false}
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true, FeatureFlags: flags}, nil
+		},
+	}
+
+	var cases = []struct {
+		name     string
+		included bool
+		outFlags []string
+	}{
+		{"included", true, []string{"betaSearch", "newCheckout"}},
+		{"notIncluded", false, nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			us := NewUserService(nil, []byte(testJWTSecret), Config{TokenFeatureFlags: cs.included})
+			us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+			tok, err := us.Token(ctx, &User{ID: 999, FeatureFlags: flags})
+			require.NoError(t, err)
+
+			claims, err := us.Validate(ctx, tok.AccessToken)
+			require.NoError(t, err)
+			assert.Equal(t, cs.outFlags, claims.FeatureFlags)
+			assert.Equal(t, flags, claims.User.FeatureFlags)
+
+			// refresh tokens never carry the flags.
+			var refresh authClaims
+			jtok, err := jwt.ParseSigned(tok.RefreshToken)
+			require.NoError(t, err)
+			require.NoError(t, jtok.Claims([]byte(testJWTSecret), &refresh))
+			assert.Empty(t, refresh.Flags)
+		})
+	}
+}
+
+func TestUserService_TokenID(t *testing.T) {
+	ctx := context.Background()
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	var cases = []struct {
+		name       string
+		inResponse bool
+	}{
+		{"inResponse", true},
+		{"notInResponse", false},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			us := NewUserService(nil, []byte(testJWTSecret), Config{TokenIDInResponse: cs.inResponse})
+			us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+			ids := map[string]bool{}
+			for i := 0; i < 50; i++ {
+				tok, err := us.Token(ctx, &User{ID: 999})
+				require.NoError(t, err)
+
+				claims, err := us.Validate(ctx, tok.AccessToken)
+				require.NoError(t, err)
+				require.Len(t, claims.TokenID, 22, "16 random bytes, base64url encoded")
+
+				var refresh authClaims
+				jtok, err := jwt.ParseSigned(tok.RefreshToken)
+				require.NoError(t, err)
+				require.NoError(t, jtok.Claims([]byte(testJWTSecret), &refresh))
+				require.NotEmpty(t, refresh.ID)
+
+				if cs.inResponse {
+					assert.Equal(t, claims.TokenID, tok.TokenID)
+				} else {
+					assert.Empty(t, tok.TokenID)
+				}
+
+				assert.False(t, ids[claims.TokenID], "access token IDs are unique")
+				assert.False(t, ids[refresh.ID], "refresh token IDs are unique")
+				ids[claims.TokenID], ids[refresh.ID] = true, true
+			}
+
+			// rotated tokens get new IDs too.
+			tok, err := us.Token(ctx, &User{ID: 999})
+			require.NoError(t, err)
+			rotated, err := us.Rotate(ctx, tok.RefreshToken)
+			require.NoError(t, err)
+			claims, err := us.Validate(ctx, rotated.AccessToken)
+			require.NoError(t, err)
+			assert.False(t, ids[claims.TokenID])
+		})
+	}
+}
+
+func TestUserService_ValidateTimes(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+
+	us := NewUserService(nil, []byte(testJWTSecret), Config{Now: func() time.Time { return now }})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	tok, err := us.Token(ctx, &User{ID: 999})
+	require.NoError(t, err)
+
+	// validating the token later reports the times it was issued with.
+	now = now.Add(time.Hour)
+	claims, err := us.Validate(ctx, tok.AccessToken)
+	require.NoError(t, err)
+
+	assert.Equal(t, now.Add(-time.Hour), claims.IssuedAt)
+	assert.Equal(t, now.Add(-time.Hour).Add(jwtAccessDuration), claims.ExpiresAt)
+	assert.Equal(t, jwtAccessDuration-time.Hour, claims.ExpiresAt.Sub(now))
+	assert.Equal(t, PrincipalUser, claims.PrincipalType)
+}
+
+func TestUserService_RejectDisabledClients(t *testing.T) {
+	ctx := context.Background()
+
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+	}
+	clients := map[string]Client{}
+	tcdb := &testClientDB{
+		byID: func(ctx context.Context, id string) (Client, error) {
+			c, ok := clients[id]
+			if !ok {
+				return Client{}, ErrNotFound
+			}
+			return c, nil
+		},
+	}
+
+	var cases = []struct {
+		name   string
+		reject bool
+		client *Client
+		outErr error
+	}{
+		{"active", true, &Client{ID: "app", Active: true}, nil},
+		{"disabled", true, &Client{ID: "app", Active: false}, ErrClientDisabled},
+		{"deleted", true, nil, ErrClientDisabled},
+		{"notRejected", false, &Client{ID: "app", Active: false}, nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			us := NewUserService(nil, []byte(testJWTSecret), Config{RejectDisabledClients: cs.reject})
+			us.(*userService).UserService.(*userValidator).UserDB = tudb
+			if cs.reject {
+				us.(*userService).clients = tcdb
+			}
+
+			clients["app"] = Client{ID: "app", Active: true}
+			tok, err := us.ClientToken(ctx, &User{ID: 999}, &Client{ID: "app"})
+			require.NoError(t, err)
 
-		_, err = us.Validate(ctx, atok)
+			_, err = us.Validate(ctx, tok.AccessToken)
+			require.NoError(t, err)
 
-		assert.Error(t, err)
-		assert.True(t, xerrors.Is(err, ErrUnauthorised))
-	})
+			// the client is disabled or deleted once the tokens are issued.
+			delete(clients, "app")
+			if cs.client != nil {
+				clients["app"] = *cs.client
+			}
 
-	t.Run("wrongTokenType", func(t *testing.T) {
-		tok, err := us.Token(ctx, &User{
-			ID:     888,
-			Active: true,
-		})
-		require.NoError(t, err)
+			_, err = us.Validate(ctx, tok.AccessToken)
+			assert.Equal(t, cs.outErr, err)
 
-		_, err = us.Validate(ctx, tok.RefreshToken)
+			_, err = us.RotateWith(ctx, tok.RefreshToken, RotateOptions{ClientID: "app"})
+			assert.Equal(t, cs.outErr, err)
+		})
+	}
 
-		assert.Error(t, err)
-		assert.True(t, xerrors.Is(err, ErrUnauthorised))
-	})
+	t.Run("withoutClient", func(t *testing.T) {
+		us := NewUserService(nil, []byte(testJWTSecret), Config{RejectDisabledClients: true})
+		us.(*userService).UserService.(*userValidator).UserDB = tudb
+		us.(*userService).clients = tcdb
 
-	t.Run("notFound", func(t *testing.T) {
-		tok, err := us.Token(ctx, &User{
-			ID:     888,
-			Active: true,
-		})
+		tok, err := us.Token(ctx, &User{ID: 999})
 		require.NoError(t, err)
 
-		tudb.byID = func(ctx context.Context, id int64) (User, error) {
-			assert.Equal(t, int64(888), id)
-			return User{}, ErrNotFound
-		}
-
 		_, err = us.Validate(ctx, tok.AccessToken)
-
-		assert.Error(t, err)
-		assert.True(t, xerrors.Is(err, ErrUnauthorised))
+		assert.NoError(t, err, "tokens not issued through a client are not affected")
 	})
+}
 
-	t.Run("dbErrorInternal", func(t *testing.T) {
-		tok, err := us.Token(ctx, &User{
-			ID:     888,
-			Active: true,
-		})
-		require.NoError(t, err)
+func TestUserService_RevokeToken(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
 
-		tudb.byID = func(ctx context.Context, id int64) (User, error) {
-			assert.Equal(t, int64(888), id)
-			return User{}, wrap("some error message", nil)
-		}
+	revoked := map[string]RevokedToken{}
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+		revokeTokenID: func(ctx context.Context, rt *RevokedToken) error {
+			revoked[rt.ID] = *rt
+			return nil
+		},
+		tokenIDRevoked: func(ctx context.Context, userID int64, id string) (bool, error) {
+			_, ok := revoked[id]
+			return ok, nil
+		},
+	}
 
-		_, err = us.Validate(ctx, tok.AccessToken)
+	us := NewUserService(nil, []byte(testJWTSecret), Config{Now: func() time.Time { return now }})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
-		assert.Error(t, err)
-	})
+	leaked, err := us.Token(ctx, &User{ID: 999})
+	require.NoError(t, err)
+	other, err := us.Token(ctx, &User{ID: 999})
+	require.NoError(t, err)
 
-	t.Run("inactiveUser", func(t *testing.T) {
-		user := User{
-			ID:     888,
-			Active: true,
-		}
+	t.Run("accessToken", func(t *testing.T) {
+		require.NoError(t, us.RevokeToken(ctx, leaked.AccessToken))
 
-		tok, err := us.Token(ctx, &user)
-		require.NoError(t, err)
+		_, err := us.Validate(ctx, leaked.AccessToken)
+		assert.Equal(t, ErrUnauthorised, err)
 
-		tudb.byID = func(ctx context.Context, id int64) (User, error) {
-			assert.Equal(t, int64(888), id)
+		claims, err := us.Validate(ctx, other.AccessToken)
+		require.NoError(t, err, "the other tokens remain valid")
+		assert.Equal(t, int64(999), claims.User.ID)
 
-			ret := user
-			ret.Active = false
-			return ret, nil
-		}
+		// the entry is kept until the token expires.
+		leakedClaims := parseAuthClaims(t, leaked.AccessToken)
+		require.Contains(t, revoked, leakedClaims.ID)
+		assert.Equal(t, RevokedToken{ID: leakedClaims.ID, UserID: 999, ExpiresAt: leakedClaims.Expiry.Time()}, revoked[leakedClaims.ID])
+	})
 
-		_, err = us.Validate(ctx, tok.AccessToken)
+	t.Run("refreshToken", func(t *testing.T) {
+		require.NoError(t, us.RevokeToken(ctx, leaked.RefreshToken))
 
-		assert.Error(t, err)
-		assert.True(t, xerrors.Is(err, ErrUnauthorised))
-	})
+		_, err := us.Rotate(ctx, leaked.RefreshToken)
+		assert.Equal(t, ErrUnauthorised, err)
 
-	t.Run("ok", func(t *testing.T) {
-		user := User{
-			ID:     888,
-			Active: true,
-		}
+		_, err = us.Rotate(ctx, other.RefreshToken)
+		assert.NoError(t, err, "the other tokens remain valid")
+	})
 
-		tok, err := us.Token(ctx, &user)
+	t.Run("expired", func(t *testing.T) {
+		expired := NewUserService(nil, []byte(testJWTSecret), Config{Now: func() time.Time { return now.Add(-48 * time.Hour) }})
+		tok, err := expired.Token(ctx, &User{ID: 999})
 		require.NoError(t, err)
 
-		tudb.byID = func(ctx context.Context, id int64) (User, error) {
-			assert.Equal(t, int64(888), id)
-			return user, nil
-		}
-
-		claims, err := us.Validate(ctx, tok.AccessToken)
+		n := len(revoked)
+		assert.NoError(t, us.RevokeToken(ctx, tok.AccessToken))
+		assert.Len(t, revoked, n, "expired tokens are not recorded")
+	})
 
-		assert.NoError(t, err)
-		assert.Equal(t, user, claims.User)
+	t.Run("invalid", func(t *testing.T) {
+		assert.Equal(t, ErrUnauthorised, us.RevokeToken(ctx, "not.a.token"))
 	})
 }
 
-func TestUserService_Token(t *testing.T) {
-	const jwtkey = "test secret key for jwt signing"
-	ctx := context.Background()
-
-	us := NewUserService(nil, []byte(jwtkey))
-	user := User{
-		ID: 999,
-	}
-
-	assert.True(t, jwtAccessDuration >= 6*time.Hour, "jwt access duration must have a reasonable length of time")
-	assert.True(t, jwtRefreshDuration >= 1*24*time.Hour, "jwt refresh duration must have a reasonable length of time")
+// parseAuthClaims returns the claims of the token signed with the test JWT secret.
+func parseAuthClaims(t *testing.T, token string) authClaims {
+	jtok, err := jwt.ParseSigned(token)
+	require.NoError(t, err)
 
-	t.Run("good", func(t *testing.T) {
-		tok, err := us.Token(ctx, &user)
-		assert.NoError(t, err)
-		assert.NotEmpty(t, tok.AccessToken)
-		assert.NotEmpty(t, tok.RefreshToken)
-		assert.Equal(t, "bearer", tok.TokenType)
-		assert.Equal(t, int(jwtAccessDuration/time.Second), tok.ExpiresIn)
+	var cl authClaims
+	require.NoError(t, jtok.Claims([]byte(testJWTSecret), &cl))
 
-		// access token
-		jtok, err := jwt.ParseSigned(tok.AccessToken)
-		require.NoError(t, err, "token must be well formed")
+	return cl
+}
 
-		var cl = authClaims{}
-		require.NoError(t, jtok.Claims([]byte(jwtkey), &cl), "token must be parseable")
-		assert.NoError(t, cl.Validate(jwt.Expected{
-			Issuer: "goauthsvc",
-			Time:   time.Now().UTC(),
-		}), "token is valid against key")
+func TestUserService_RevokeClient(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
 
-		assert.Equal(t, "999", cl.Subject, "subject is present on token")
-		assert.True(t, cl.Expiry.Time().After(time.Now().Add(jwtAccessDuration-1*time.Minute)), "token has the right expiry time")
-		assert.True(t, cl.Expiry.Time().Before(time.Now().Add(jwtAccessDuration+1*time.Minute)), "token has the right expiry time")
+	revoked := map[string]time.Time{}
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Active: true}, nil
+		},
+		revokeGrant: func(ctx context.Context, rg *RevokedGrant) error {
+			assert.Equal(t, int64(999), rg.UserID)
+			revoked[rg.ClientID] = rg.RevokedAt
+			return nil
+		},
+		grantRevokedAt: func(ctx context.Context, userID int64, clientID string) (time.Time, error) {
+			return revoked[clientID], nil
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{Now: func() time.Time { return now }})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
-		rtok, err := jwt.ParseSigned(tok.RefreshToken)
-		require.NoError(t, err)
+	revokedTok, err := us.ClientToken(ctx, &User{ID: 999}, &Client{ID: "calendar"})
+	require.NoError(t, err)
+	otherTok, err := us.ClientToken(ctx, &User{ID: 999}, &Client{ID: "webapp"})
+	require.NoError(t, err)
+	directTok, err := us.Token(ctx, &User{ID: 999})
+	require.NoError(t, err)
 
-		cl = authClaims{}
-		require.NoError(t, rtok.Claims([]byte(jwtkey), &cl), "refresh token must be parseable")
-		assert.NoError(t, cl.Validate(jwt.Expected{
-			Issuer: "goauthsvcrefresh",
-			Time:   time.Now().UTC(),
-		}), "refresh token is valid against key")
+	now = now.Add(time.Minute)
+	require.NoError(t, us.RevokeClient(ctx, 999, "calendar"))
 
-		require.Equal(t, "999", cl.Subject, "subject is present on token")
-		assert.True(t, cl.Expiry.Time().After(time.Now().Add(jwtRefreshDuration-1*time.Minute)), "token has the right expiry time")
-		assert.True(t, cl.Expiry.Time().Before(time.Now().Add(jwtRefreshDuration+1*time.Minute)), "token has the right expiry time")
-	})
+	now = now.Add(time.Minute)
+	newTok, err := us.ClientToken(ctx, &User{ID: 999}, &Client{ID: "calendar"})
+	require.NoError(t, err)
 
-	t.Run("badSigner", func(t *testing.T) {
-		us.(*userService).signer = &testSigner{}
+	var cases = []struct {
+		name     string
+		tok      Token
+		clientID string
+		outErr   error
+	}{
+		{"revokedClient", revokedTok, "calendar", ErrUnauthorised},
+		{"otherClient", otherTok, "webapp", nil},
+		{"noClient", directTok, "", nil},
+		{"issuedAfterRevoke", newTok, "calendar", nil},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			_, err := us.Validate(ctx, cs.tok.AccessToken)
+			assert.Equal(t, cs.outErr, err)
 
-		tok, err := us.Token(ctx, &user)
-		assert.Error(t, err)
-		assert.Equal(t, Token{}, tok)
-	})
+			_, err = us.RotateWith(ctx, cs.tok.RefreshToken, RotateOptions{ClientID: cs.clientID})
+			assert.Equal(t, cs.outErr, err)
+		})
+	}
 }
 
 func TestUserService_ByID(t *testing.T) {
 	tudb := &testUserDB{}
-	us := NewUserService(nil, []byte(testJWTSecret))
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
 	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
 	ctx := context.Background()
@@ -604,7 +1927,7 @@ func TestUserService_ByID(t *testing.T) {
 
 func TestUserService_ByEmail(t *testing.T) {
 	tudb := &testUserDB{}
-	us := NewUserService(nil, []byte(testJWTSecret))
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
 	us.(*userService).UserService.(*userValidator).UserDB = tudb
 	ctx := context.Background()
 
@@ -654,7 +1977,7 @@ func TestUserService_ByEmail(t *testing.T) {
 
 func TestUserService_ByIDs(t *testing.T) {
 	tudb := &testUserDB{}
-	us := NewUserService(nil, []byte(testJWTSecret))
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
 	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
 	ctx := context.Background()
@@ -692,7 +2015,7 @@ func TestUserService_ByIDs(t *testing.T) {
 
 func TestUserService_Delete(t *testing.T) {
 	tudb := &testUserDB{}
-	us := NewUserService(nil, []byte(testJWTSecret))
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
 	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
 	ctx := context.Background()
@@ -714,7 +2037,7 @@ func TestUserService_Delete(t *testing.T) {
 
 func TestUserService_Create(t *testing.T) {
 	tudb := &testUserDB{}
-	us := NewUserService(nil, []byte(testJWTSecret))
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
 	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
 	goodEmail := func(ctx context.Context, e string) (User, error) {
@@ -866,9 +2189,98 @@ func TestUserService_Create(t *testing.T) {
 	}
 }
 
+func TestUserService_CreateEmailDomains(t *testing.T) {
+	ctx := context.Background()
+	tudb := &testUserDB{
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			return User{}, ErrNotFound
+		},
+		create: func(ctx context.Context, u *User) error {
+			return nil
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{
+		SignupEmailDomains: []string{"example.com", " *.Corp.example.org "},
+	})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	var cases = []struct {
+		name   string
+		email  string
+		outErr error
+	}{
+		{"allowed", "Jane@Example.com", nil},
+		{"disallowed", "jane@gmail.com", ValidationError{"email": ErrEmailDomain}},
+		{"subdomainNotWildcard", "jane@eu.example.com", ValidationError{"email": ErrEmailDomain}},
+		{"wildcard", "jane@eu.corp.example.org", nil},
+		{"wildcardNested", "jane@dev.eu.corp.example.org", nil},
+		{"wildcardExcludesDomain", "jane@corp.example.org", ValidationError{"email": ErrEmailDomain}},
+		{"wildcardSuffixOnly", "jane@badcorp.example.org", ValidationError{"email": ErrEmailDomain}},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			err := us.Create(ctx, &User{Country: "GB", Email: cs.email, FirstName: "Jane", Password: "testpassword"})
+
+			assert.Equal(t, cs.outErr, err)
+		})
+	}
+}
+
+func TestUserService_PasswordFieldErrors(t *testing.T) {
+	ctx := context.Background()
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return User{ID: id, Country: "GB", Email: "jane@example.com", FirstName: "Jane", Password: "hash"}, nil
+		},
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			return User{}, ErrNotFound
+		},
+		create: func(ctx context.Context, u *User) error {
+			return nil
+		},
+		update: func(ctx context.Context, u *User) error {
+			return nil
+		},
+	}
+	tbc := &testBreachChecker{breached: map[string]bool{"secret": true}}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{BreachChecker: tbc, PasswordRequireDigit: true})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	var cases = []struct {
+		name     string
+		password string
+		outErr   error
+	}{
+		{"valid", "testpassword1", nil},
+		{"single", "testpassword", ValidationError{"password": ErrPasswordNoDigit}},
+		{"several", "short", ValidationError{"password": FieldErrors{ErrTooShort, ErrPasswordNoDigit}}},
+		{"all", "secret", ValidationError{"password": FieldErrors{ErrTooShort, ErrPasswordNoDigit, ErrPasswordBreached}}},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			t.Run("create", func(t *testing.T) {
+				err := us.Create(ctx, &User{Country: "GB", Email: "jane@example.com", FirstName: "Jane", Password: cs.password})
+				assert.Equal(t, cs.outErr, err)
+			})
+
+			t.Run("update", func(t *testing.T) {
+				err := us.Update(ctx, &User{ID: 10, Country: "GB", Email: "jane@example.com", FirstName: "Jane", Password: cs.password})
+				assert.Equal(t, cs.outErr, err)
+			})
+		})
+	}
+
+	t.Run("required", func(t *testing.T) {
+		// an empty field has no value to check further, so it only fails as required.
+		err := us.Create(ctx, &User{Country: "GB", Email: "jane@example.com"})
+
+		assert.Equal(t, ValidationError{"password": ErrRequired, "firstName": ErrRequired}, err)
+	})
+}
+
 func TestUserService_Update(t *testing.T) {
 	tudb := &testUserDB{}
-	us := NewUserService(nil, []byte(testJWTSecret))
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
 	us.(*userService).UserService.(*userValidator).UserDB = tudb
 
 	goodEmail := func(ctx context.Context, e string) (User, error) {
@@ -1088,6 +2500,134 @@ func TestUserService_Update(t *testing.T) {
 	}
 }
 
+func TestUserService_UpdatePartial(t *testing.T) {
+	tudb := &testUserDB{}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	ctx := context.Background()
+	current := User{ID: 10, Active: true, Country: "GB", Email: "test@address.com", FirstName: "Test", Password: "currenthash"}
+
+	var saved *User
+	tudb.byID = func(ctx context.Context, id int64) (User, error) {
+		assert.Equal(t, int64(10), id)
+		return current, nil
+	}
+	tudb.update = func(ctx context.Context, u *User) error {
+		cp := *u
+		saved = &cp
+		return nil
+	}
+
+	mixed := func() *User {
+		return &User{ID: 10, Active: true, Country: "XX", Email: "test@address.com", FirstName: "Changed", Password: "newpassword"}
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		saved = nil
+
+		err := us.Update(ctx, mixed())
+
+		assert.Equal(t, ValidationError{"country": ErrInvalidCountry}, err)
+		assert.Nil(t, saved, "nothing is saved in strict mode")
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		saved = nil
+		u := mixed()
+
+		ve, err := us.UpdatePartial(ctx, u)
+
+		require.NoError(t, err)
+		assert.Equal(t, ValidationError{"country": ErrInvalidCountry}, ve)
+		require.NotNil(t, saved)
+		assert.Equal(t, "Changed", saved.FirstName, "valid fields are saved")
+		assert.Equal(t, "GB", saved.Country, "invalid fields keep their current value")
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(saved.Password), []byte("newpassword")))
+		assert.Empty(t, u.Password)
+	})
+
+	t.Run("partialInvalidPassword", func(t *testing.T) {
+		saved = nil
+		u := mixed()
+		u.Country = "ES"
+		u.Password = "short"
+
+		ve, err := us.UpdatePartial(ctx, u)
+
+		require.NoError(t, err)
+		assert.Equal(t, ValidationError{"password": ErrTooShort}, ve)
+		require.NotNil(t, saved)
+		assert.Equal(t, "ES", saved.Country)
+		assert.Equal(t, "currenthash", saved.Password, "current password is preserved")
+	})
+
+	t.Run("partialAllValid", func(t *testing.T) {
+		saved = nil
+		u := mixed()
+		u.Country = "ES"
+
+		ve, err := us.UpdatePartial(ctx, u)
+
+		assert.NoError(t, err)
+		assert.Nil(t, ve)
+		require.NotNil(t, saved)
+		assert.Equal(t, "ES", saved.Country)
+	})
+}
+
+func TestUserService_SetFeatureFlags(t *testing.T) {
+	ctx := context.Background()
+	current := User{ID: 88, Active: true, Email: "auseremail@name.com", FirstName: "John", Country: "GB",
+		FeatureFlags: FeatureFlags{"betaSearch": true, "darkMode": true}}
+
+	var updated User
+	tudb := &testUserDB{
+		byID: func(ctx context.Context, id int64) (User, error) {
+			return current, nil
+		},
+		byEmail: func(ctx context.Context, e string) (User, error) {
+			return User{}, ErrNotFound
+		},
+		create: func(ctx context.Context, u *User) error {
+			updated = *u
+			return nil
+		},
+		update: func(ctx context.Context, u *User) error {
+			updated = *u
+			return nil
+		},
+	}
+	us := NewUserService(nil, []byte(testJWTSecret), Config{})
+	us.(*userService).UserService.(*userValidator).UserDB = tudb
+
+	t.Run("merged", func(t *testing.T) {
+		err := us.SetFeatureFlags(ctx, 88, FeatureFlags{"newCheckout": true, "darkMode": false})
+		require.NoError(t, err)
+		assert.Equal(t, FeatureFlags{"betaSearch": true, "newCheckout": true}, updated.FeatureFlags)
+		assert.Equal(t, "auseremail@name.com", updated.Email)
+	})
+
+	t.Run("invalidName", func(t *testing.T) {
+		err := us.SetFeatureFlags(ctx, 88, FeatureFlags{"new checkout": true})
+		assert.Equal(t, ValidationError{"featureFlags": ErrInvalid}, err)
+	})
+
+	t.Run("notSetByUpdate", func(t *testing.T) {
+		err := us.Update(ctx, &User{ID: 88, Email: "auseremail@name.com", FirstName: "John", Country: "GB",
+			FeatureFlags: FeatureFlags{"admin": true}})
+		require.NoError(t, err)
+		assert.Equal(t, current.FeatureFlags, updated.FeatureFlags)
+	})
+
+	t.Run("notSetByCreate", func(t *testing.T) {
+		err := us.Create(ctx, &User{Email: "other@name.com", FirstName: "Jane", Country: "GB", Password: "testpassword",
+			FeatureFlags: FeatureFlags{"admin": true}})
+		require.NoError(t, err)
+		assert.Nil(t, updated.FeatureFlags)
+	})
+}
+
 func TestUserGORM_Create(t *testing.T) {
 	db, err := NewTestDatabase(t)
 	require.NoError(t, err)
@@ -15,6 +15,19 @@ import (
 func MigrateGORM(gdb *gorm.DB) error {
 	var models = []interface{}{
 		&models.User{},
+		&models.Client{},
+		&models.Consent{},
+		&models.AuditEvent{},
+		&models.UsedToken{},
+		&models.APIKey{},
+		&models.RevokedSession{},
+		&models.IssuedToken{},
+		&models.RevokedGrant{},
+		&models.RevokedTrust{},
+		&models.RevokedToken{},
+		&models.DeviceAuthorization{},
+		&models.MFADevice{},
+		&models.SecurityAnswer{},
 	}
 
 	var err error
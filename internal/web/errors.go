@@ -2,10 +2,16 @@ package web
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 
+	ierrors "github.com/noelruault/golang-authentication/internal/errors"
 	"github.com/noelruault/golang-authentication/internal/models"
 )
 
@@ -34,11 +40,44 @@ func IsShutdown(err error) bool {
 	return false
 }
 
+// clientGone is the error returned when the client disconnected before its response was written. It is
+// not a server error: the client gave up on the request.
+type clientGone struct {
+	err error
+}
+
+// Error is the implementation of the error interface.
+func (c *clientGone) Error() string {
+	return "client disconnected: " + c.err.Error()
+}
+
+// Unwrap returns the write error.
+func (c *clientGone) Unwrap() error {
+	return c.err
+}
+
+// IsClientGone checks to see if the error of a client disconnecting while its response was written is
+// contained in the specified error value.
+func IsClientGone(err error) bool {
+	var c *clientGone
+	return errors.As(err, &c)
+}
+
 // Error is a view that converts errors into API HTTP responses.
 type Error struct {
-	codes map[string]int
+	codes  map[string]int
+	limits map[string]string
+	oauth  map[string]string
 }
 
+// The scopes of the limits the rate limiting errors are returned for, telling who hit the limit.
+const (
+	LimitScopeIP     = "ip"
+	LimitScopeUser   = "user"
+	LimitScopeClient = "client"
+	LimitScopeGrant  = "grant"
+)
+
 // SetCode defines a default HTTP error code to be returned when err is found. The result of calling err.Public()
 // must match any other error instances of the same type.
 //
@@ -53,6 +92,167 @@ func (e *Error) SetCode(err models.PublicError, code int) {
 	e.codes[err.Public()] = code
 }
 
+// SetLimitScope defines the scope of the limit err is returned for once hit, one of the LimitScope
+// constants, which is included in the responses when the App is configured with LimitScopes.
+func (e *Error) SetLimitScope(err models.PublicError, scope string) {
+	if e.limits == nil {
+		e.limits = make(map[string]string)
+	}
+
+	e.limits[err.Public()] = scope
+}
+
+// SetOAuthCode defines the standard OAuth 2.0 error code, such as "invalid_grant", err is responded with
+// on the routes responding OAuth errors. The errors without one are responded with their own code when
+// it is a standard one, and with "invalid_request" or "server_error" otherwise.
+func (e *Error) SetOAuthCode(err models.PublicError, code string) {
+	if e.oauth == nil {
+		e.oauth = make(map[string]string)
+	}
+
+	e.oauth[err.Public()] = code
+}
+
+// SetOAuthCodes defines the standard OAuth 2.0 error codes of several errors at once, as SetOAuthCode
+// does for each of them.
+func (e *Error) SetOAuthCodes(codes map[models.PublicError]string) {
+	for err, code := range codes {
+		e.SetOAuthCode(err, code)
+	}
+}
+
+// SetCodes defines the default HTTP error codes of several errors at once, as SetCode does for each of
+// them, so the errors of a package can be mapped in one place.
+func (e *Error) SetCodes(codes map[models.PublicError]int) {
+	for err, code := range codes {
+		e.SetCode(err, code)
+	}
+}
+
+// ErrorCode describes a public error code and the HTTP status code returned along with it.
+type ErrorCode struct {
+	Code   string `json:"code"`
+	Status int    `json:"status"`
+}
+
+// Codes returns the public error codes known by the view along with their HTTP status code, sorted by
+// code. It includes the codes registered with SetCode and the built-in "server_error" and
+// "validation_error" codes, making it suitable for generating an error reference.
+func (e Error) Codes() []ErrorCode {
+	codes := map[string]int{
+		"server_error":        http.StatusInternalServerError,
+		"service_unavailable": http.StatusServiceUnavailable,
+		"validation_error":    http.StatusBadRequest,
+	}
+	for code, status := range e.codes {
+		codes[code] = status
+	}
+
+	ret := make([]ErrorCode, 0, len(codes))
+	for code, status := range codes {
+		ret = append(ret, ErrorCode{Code: code, Status: status})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Code < ret[j].Code
+	})
+
+	return ret
+}
+
+// NextAction returns the hint of what clients should do next when getting the public error code, as
+// configured for the App serving the request. It is empty when no hint is configured for code.
+func NextAction(ctx context.Context, code string) string {
+	v, ok := ctx.Value(KeyValues).(*Values)
+	if !ok {
+		return ""
+	}
+
+	return v.NextActions[code]
+}
+
+// Message returns the human-readable message of the public error code, in the language accepted by the
+// client as configured for the App serving the request. It is empty when no message is configured for
+// code in that language.
+func Message(ctx context.Context, code string) string {
+	v, ok := ctx.Value(KeyValues).(*Values)
+	if !ok {
+		return ""
+	}
+
+	return v.Messages[code]
+}
+
+// languageFor returns the language of messages preferred by the accept header, an Accept-Language
+// header such as "fr-CH, fr;q=0.9, en;q=0.8". A language such as "fr-CH" is also served by the messages
+// of its base language "fr". It is empty when none of the accepted languages has messages.
+func languageFor(accept string, messages map[string]map[string]string) string {
+	if len(messages) == 0 {
+		return ""
+	}
+
+	lang, best := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, p := range params[1:] {
+			if v := strings.TrimSpace(p); strings.HasPrefix(v, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(v[len("q="):], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+
+		// the most preferred language wins, the first one listed among equally preferred ones.
+		if q <= best {
+			continue
+		}
+
+		for _, candidate := range []string{tag, strings.SplitN(tag, "-", 2)[0]} {
+			if _, ok := messages[candidate]; ok {
+				lang, best = candidate, q
+				break
+			}
+		}
+	}
+
+	return lang
+}
+
+// A fieldCode is the error of a field of a validation error, in the array form of the "fields".
+type fieldCode struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// fieldMap returns the map form of the codes and messages in list, the errors of the fields of ve. The
+// fields of ve holding models.FieldErrors map to arrays, and the others to a single code and message.
+func fieldMap(ve models.ValidationError, list []fieldCode) (codes, msgs map[string]interface{}) {
+	codes, msgs = make(map[string]interface{}, len(ve)), make(map[string]interface{})
+	for _, fc := range list {
+		if _, ok := ve[fc.Field].(models.FieldErrors); !ok {
+			codes[fc.Field] = fc.Code
+			if fc.Message != "" {
+				msgs[fc.Field] = fc.Message
+			}
+			continue
+		}
+
+		fieldCodes, _ := codes[fc.Field].([]string)
+		codes[fc.Field] = append(fieldCodes, fc.Code)
+		if fc.Message != "" {
+			fieldMsgs, _ := msgs[fc.Field].([]string)
+			msgs[fc.Field] = append(fieldMsgs, fc.Message)
+		}
+	}
+
+	return codes, msgs
+}
+
 // JSON returns a JSON document with an error response to a requester.
 //
 // In case err has a "Public() string" method, it returns by default an HTTP Bad Request code and the
@@ -64,42 +264,248 @@ func (e *Error) SetCode(err models.PublicError, code int) {
 // In case err does not have a "Public() string" method, it returns an HTTP Internal Server
 // Error code and the JSON "error" field receives a "server_error" value.
 //
+// In case models.ErrServiceUnavailable is found in the err chain, wrapped or not, or err is a shutdown
+// error, it returns an HTTP Service Unavailable code and the JSON "error" field receives a
+// "service_unavailable" value.
+//
 // In case err is a models.ValidationError, it returns by default an HTTP Bad Request doce an error code of "validation_error"
 // is returned, and the specific errors for each field are included as the
-// value of the JSON "fields" field.
+// value of the JSON "fields" field. A field with several errors, held in a models.FieldErrors value, gets
+// an array with the codes of all of them.
+//
+// When a next action is configured for the public error code, it is included as the JSON "next_action"
+// field.
+//
+// When the App is configured with LimitScopes and a limit scope is set for the public error code, the
+// scope is included as the JSON "limit_scope" field.
+//
+// When messages are configured for the language accepted by the client, the message of the public error
+// code is included as the JSON "message" field, and the messages of the validation errors of each field
+// as the JSON "field_messages" field. The codes are kept in "error" and "fields" for programs.
+//
+// When the App is configured with FieldsArray, "fields" is an array of {"field", "code"} objects sorted
+// by field instead, each carrying its "message" when one is configured, and "field_messages" is not sent.
+// A field with several errors has one object per error.
+//
+// On the routes responding OAuth errors, the response holds the OAuth 2.0 error fields instead, as
+// described by oauthJSON.
+//
+// When the App is configured with ErrorIDs, a random "error_id" is generated for each call and recorded
+// in the request Values, so the middlewares log it along with the request.
+//
+// When the App runs in development mode, the messages of the err cause chain are included as the JSON
+// "debug.causes" array. They are never included otherwise, as they may expose internal details.
 func (e Error) JSON(ctx context.Context, w http.ResponseWriter, err error) error {
+	code, status := e.code(err)
+	if v, ok := ctx.Value(KeyValues).(*Values); ok && v.OAuthErrors {
+		return e.oauthJSON(ctx, w, v, err, code, status)
+	}
+
+	data, status := e.document(ctx, err, code, status)
+
+	return Respond(ctx, w, data, status)
+}
+
+// JSONWith returns the same JSON document as JSON with the fields of extra added to it, such as the
+// resource a request partially applied to along with the validation errors of the rest, and the given
+// status instead of the one of err. OAuth errors are not supported.
+func (e Error) JSONWith(ctx context.Context, w http.ResponseWriter, err error, status int, extra map[string]interface{}) error {
+	code, s := e.code(err)
+	data, _ := e.document(ctx, err, code, s)
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	return Respond(ctx, w, data, status)
+}
+
+// code returns the public error code of err and the HTTP status it is responded with.
+func (e Error) code(err error) (string, int) {
 	// set the defaults we are going to return
 	status := http.StatusInternalServerError
-	data := map[string]interface{}{"error": "server_error"}
+	code := "server_error"
 
-	// if it is a public error, must check if there's a different HTTP code set in the map
-	if pe, ok := err.(models.PublicError); ok {
-		status = http.StatusBadRequest
+	// an unavailable dependency is reported as such however deep in the chain, so clients know to
+	// retry later instead of seeing a server error. So is the request shutting the service down.
+	if errors.Is(err, models.ErrServiceUnavailable) || IsShutdown(err) {
+		status = http.StatusServiceUnavailable
+		code = models.ErrServiceUnavailable.Public()
 
-		public := pe.Public()
-		data["error"] = public
+	} else if pe, ok := err.(models.PublicError); ok {
+		// if it is a public error, must check if there's a different HTTP code set in the map
+		status = http.StatusBadRequest
 
-		if s := e.codes[public]; s != 0 {
+		code = pe.Public()
+		if s := e.codes[code]; s != 0 {
 			status = s
 		}
 	}
 
+	return code, status
+}
+
+// document returns the JSON document of err, whose public error code is code, and its HTTP status, which
+// the codes of the field errors may change from status.
+func (e Error) document(ctx context.Context, err error, code string, status int) (map[string]interface{}, int) {
+	data := map[string]interface{}{}
+
+	data["error"] = code
+	if action := NextAction(ctx, code); action != "" {
+		data["next_action"] = action
+	}
+	if msg := Message(ctx, code); msg != "" {
+		data["message"] = msg
+	}
+	if v, ok := ctx.Value(KeyValues).(*Values); ok && v.LimitScopes && e.limits[code] != "" {
+		data["limit_scope"] = e.limits[code]
+	}
+
+	if v, ok := ctx.Value(KeyValues).(*Values); ok {
+		setErrorID(v, data)
+	}
+
 	// if it's a validation error, we also need to check for codes and also add the fields to the output
 	if ve, ok := err.(models.ValidationError); ok {
-		vem := make(map[string]string, len(ve))
-
+		var list []fieldCode
 		for field, err := range ve {
-			public := err.Public()
+			errs, ok := err.(models.FieldErrors)
+			if !ok {
+				errs = models.FieldErrors{err}
+			}
+
+			for _, err := range errs {
+				public := err.Public()
 
-			if s := e.codes[public]; s != 0 {
-				status = s
+				if s := e.codes[public]; s != 0 {
+					status = s
+				}
+
+				list = append(list, fieldCode{Field: field, Code: public, Message: Message(ctx, public)})
 			}
+		}
 
-			vem[field] = public
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Field < list[j].Field
+		})
+
+		if v, ok := ctx.Value(KeyValues).(*Values); ok && v.FieldsArray {
+			data["fields"] = list
+		} else {
+			vem, msgs := fieldMap(ve, list)
+			data["fields"] = vem
+			if len(msgs) > 0 {
+				data["field_messages"] = msgs
+			}
 		}
+	}
+
+	if v, ok := ctx.Value(KeyValues).(*Values); ok && v.DevMode {
+		data["debug"] = map[string]interface{}{"causes": ierrors.Causes(err)}
+	}
+
+	return data, status
+}
+
+// oauthCodes are the error codes defined by OAuth 2.0, its extensions and OpenID Connect for the token
+// endpoint.
+var oauthCodes = map[string]bool{
+	"invalid_request":        true,
+	"invalid_client":         true,
+	"invalid_grant":          true,
+	"unauthorized_client":    true,
+	"unsupported_grant_type": true,
+	"invalid_scope":          true,
+	"authorization_pending":  true,
+	"slow_down":              true,
+	"access_denied":          true,
+	"expired_token":          true,
+	"login_required":         true,
+	"interaction_required":   true,
+}
 
-		data["fields"] = vem
+// oauthJSON responds err as an OAuth 2.0 error response, as described by RFC 6749 section 5.2, with the
+// standard error code of the public error code. The description of the public error, or its message when
+// one is configured, is sent as "error_description", and "error_uri" is the error URI of the route
+// followed by the public error code. Server errors are never described.
+//
+// The status is 401 for invalid_client, and 400 for any other client error but the rate limiting ones,
+// which keep their 429 so clients back off.
+func (e Error) oauthJSON(ctx context.Context, w http.ResponseWriter, v *Values, err error, code string, status int) error {
+	std := e.oauth[code]
+	switch {
+	case std != "":
+	case status == http.StatusServiceUnavailable:
+		std = "temporarily_unavailable"
+	case status >= http.StatusInternalServerError:
+		std = "server_error"
+	case oauthCodes[code]:
+		std = code
+	default:
+		std = "invalid_request"
+	}
+
+	switch {
+	case status >= http.StatusInternalServerError, status == http.StatusTooManyRequests:
+	case std == "invalid_client":
+		status = http.StatusUnauthorized
+	default:
+		status = http.StatusBadRequest
+	}
+
+	data := map[string]interface{}{"error": std}
+	if status < http.StatusInternalServerError {
+		if desc := description(ctx, err, code); desc != "" {
+			data["error_description"] = desc
+		}
+	}
+	if v.OAuthErrorURI != "" {
+		data["error_uri"] = v.OAuthErrorURI + code
 	}
+	setErrorID(v, data)
 
 	return Respond(ctx, w, data, status)
 }
+
+// description returns the human-readable description of the public error err with the code, that is the
+// message configured for the code, or the text following the code in the error string.
+func description(ctx context.Context, err error, code string) string {
+	if msg := Message(ctx, code); msg != "" {
+		return msg
+	}
+
+	pe, ok := err.(models.PublicError)
+	if !ok {
+		return ""
+	}
+
+	s := pe.Error()
+	if i := strings.Index(s, code+", "); i >= 0 {
+		return s[i+len(code)+2:]
+	}
+
+	return ""
+}
+
+// setErrorID sets a new "error_id" in the data of an error response when the App is configured with
+// ErrorIDs, recording it in v so the middlewares can log it.
+func setErrorID(v *Values, data map[string]interface{}) {
+	if !v.ErrorIDs {
+		return
+	}
+
+	if id, err := newErrorID(); err == nil {
+		v.ErrorID = id
+		data["error_id"] = id
+	}
+}
+
+// newErrorID returns a random ID for an error response. It carries nothing about the request or the
+// error, so it can be shown to anyone.
+func newErrorID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,500 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/errors"
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+func testContext(v *Values) context.Context {
+	return context.WithValue(context.Background(), KeyValues, v)
+}
+
+func TestError_JSONDebugCauses(t *testing.T) {
+	wrap := errors.Wrapper("models")
+	err := wrap("on validate, failed to obtain user from database", wrap("could not get user by id", nil))
+
+	var cases = []struct {
+		name    string
+		devMode bool
+		err     error
+		outJSON string
+	}{
+		{
+			"devInternal",
+			true,
+			err,
+			`{"error":"server_error","debug":{"causes":[` +
+				`"models: on validate, failed to obtain user from database: models: could not get user by id",` +
+				`"models: could not get user by id"]}}`,
+		},
+		{
+			"devPublic",
+			true,
+			models.ErrNotFound,
+			`{"error":"not_found","debug":{"causes":["models: not_found, resource not found"]}}`,
+		},
+		{
+			"productionInternal",
+			false,
+			err,
+			`{"error":"server_error"}`,
+		},
+		{
+			"productionPublic",
+			false,
+			models.ErrNotFound,
+			`{"error":"not_found"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var ev Error
+			ev.SetCode(models.ErrNotFound, http.StatusNotFound)
+
+			w := httptest.NewRecorder()
+			err := ev.JSON(testContext(&Values{DevMode: cs.devMode}), w, cs.err)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestError_JSONServiceUnavailable(t *testing.T) {
+	wrap := errors.Wrapper("models")
+
+	var cases = []struct {
+		name string
+		err  error
+	}{
+		{"bare", models.ErrServiceUnavailable},
+		{"wrapped", wrap("on validate, failed to obtain user from database", models.ErrServiceUnavailable)},
+		{"shutdown", NewShutdownError("web value missing from context")},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var ev Error
+
+			w := httptest.NewRecorder()
+			err := ev.JSON(testContext(&Values{}), w, cs.err)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			assert.JSONEq(t, `{"error":"service_unavailable"}`, w.Body.String())
+		})
+	}
+}
+
+func TestError_JSONNextAction(t *testing.T) {
+	wrap := errors.Wrapper("models")
+	actions := map[string]string{
+		"unauthorised":     "login",
+		"server_error":     "retry",
+		"validation_error": "fix_fields",
+	}
+
+	var cases = []struct {
+		name    string
+		actions map[string]string
+		err     error
+		outJSON string
+	}{
+		{"configured", actions, models.ErrUnauthorised, `{"error":"unauthorised","next_action":"login"}`},
+		{"notConfigured", actions, models.ErrNotFound, `{"error":"not_found"}`},
+		{"internal", actions, wrap("could not get user by id", nil), `{"error":"server_error","next_action":"retry"}`},
+		{"validation", actions, models.ValidationError{"email": models.ErrRequired},
+			`{"error":"validation_error","fields":{"email":"required"},"next_action":"fix_fields"}`},
+		{"noActions", nil, models.ErrUnauthorised, `{"error":"unauthorised"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var ev Error
+
+			w := httptest.NewRecorder()
+			err := ev.JSON(testContext(&Values{NextActions: cs.actions}), w, cs.err)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestError_JSONMessages(t *testing.T) {
+	messages := map[string]map[string]string{
+		"en": {
+			"validation_error": "Some fields are invalid.",
+			"required":         "This field is required.",
+			"invalid":          "This value is not valid.",
+		},
+		"fr": {
+			"validation_error": "Certains champs sont invalides.",
+			"required":         "Ce champ est obligatoire.",
+			"invalid":          "Cette valeur n'est pas valide.",
+		},
+	}
+	verr := models.ValidationError{"password": models.ErrRequired, "email": models.ErrInvalid}
+
+	var cases = []struct {
+		name     string
+		language string
+		err      error
+		outJSON  string
+	}{
+		{"en", "en-US,en;q=0.9", verr, `{
+			"error": "validation_error",
+			"message": "Some fields are invalid.",
+			"fields": {"password": "required", "email": "invalid"},
+			"field_messages": {"password": "This field is required.", "email": "This value is not valid."}
+		}`},
+		{"fr", "fr-CH, fr;q=0.9, en;q=0.8", verr, `{
+			"error": "validation_error",
+			"message": "Certains champs sont invalides.",
+			"fields": {"password": "required", "email": "invalid"},
+			"field_messages": {"password": "Ce champ est obligatoire.", "email": "Cette valeur n'est pas valide."}
+		}`},
+		{"preferred", "en;q=0.5, fr;q=0.8", models.ErrRequired, `{"error":"required","message":"Ce champ est obligatoire."}`},
+		{"unknownLanguage", "de", verr, `{"error":"validation_error","fields":{"password":"required","email":"invalid"}}`},
+		{"unknownCode", "en", models.ErrNotFound, `{"error":"not_found"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var ev Error
+
+			v := &Values{Messages: messages[languageFor(cs.language, messages)]}
+			w := httptest.NewRecorder()
+			err := ev.JSON(testContext(v), w, cs.err)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestError_JSONFieldsArray(t *testing.T) {
+	verr := models.ValidationError{"password": models.ErrTooShort, "email": models.ErrRequired, "country": models.ErrInvalid}
+	messages := map[string]string{"required": "This field is required."}
+
+	var cases = []struct {
+		name     string
+		array    bool
+		messages map[string]string
+		outJSON  string
+	}{
+		{"map", false, nil, `{
+			"error": "validation_error",
+			"fields": {"country": "invalid", "email": "required", "password": "too_short"}
+		}`},
+		{"array", true, nil, `{
+			"error": "validation_error",
+			"fields": [
+				{"field": "country", "code": "invalid"},
+				{"field": "email", "code": "required"},
+				{"field": "password", "code": "too_short"}
+			]
+		}`},
+		{"mapMessages", false, messages, `{
+			"error": "validation_error",
+			"fields": {"country": "invalid", "email": "required", "password": "too_short"},
+			"field_messages": {"email": "This field is required."}
+		}`},
+		{"arrayMessages", true, messages, `{
+			"error": "validation_error",
+			"fields": [
+				{"field": "country", "code": "invalid"},
+				{"field": "email", "code": "required", "message": "This field is required."},
+				{"field": "password", "code": "too_short"}
+			]
+		}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var ev Error
+
+			w := httptest.NewRecorder()
+			err := ev.JSON(testContext(&Values{FieldsArray: cs.array, Messages: cs.messages}), w, verr)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestError_JSONFieldErrors(t *testing.T) {
+	verr := models.ValidationError{
+		"password": models.FieldErrors{models.ErrTooShort, models.ErrInvalid},
+		"email":    models.ErrRequired,
+	}
+	messages := map[string]string{"too_short": "Too short.", "invalid": "Invalid."}
+
+	var cases = []struct {
+		name     string
+		array    bool
+		messages map[string]string
+		outJSON  string
+	}{
+		{"map", false, nil, `{
+			"error": "validation_error",
+			"fields": {"email": "required", "password": ["too_short", "invalid"]}
+		}`},
+		{"array", true, nil, `{
+			"error": "validation_error",
+			"fields": [
+				{"field": "email", "code": "required"},
+				{"field": "password", "code": "too_short"},
+				{"field": "password", "code": "invalid"}
+			]
+		}`},
+		{"mapMessages", false, messages, `{
+			"error": "validation_error",
+			"fields": {"email": "required", "password": ["too_short", "invalid"]},
+			"field_messages": {"password": ["Too short.", "Invalid."]}
+		}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var ev Error
+
+			w := httptest.NewRecorder()
+			err := ev.JSON(testContext(&Values{FieldsArray: cs.array, Messages: cs.messages}), w, verr)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+
+	t.Run("codes", func(t *testing.T) {
+		var ev Error
+		ev.SetCode(models.ErrInvalid, http.StatusUnprocessableEntity)
+
+		w := httptest.NewRecorder()
+		require.NoError(t, ev.JSON(testContext(&Values{}), w, verr))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, "the codes of every error of a field are checked")
+	})
+}
+
+func TestError_JSONWith(t *testing.T) {
+	verr := models.ValidationError{
+		"password": models.FieldErrors{models.ErrTooShort, models.ErrInvalid},
+		"country":  models.ErrInvalidCountry,
+	}
+	user := map[string]interface{}{"id": 99}
+
+	var cases = []struct {
+		name    string
+		values  Values
+		outJSON string
+	}{
+		{"map", Values{}, `{
+			"user": {"id": 99},
+			"error": "validation_error",
+			"fields": {"country": "invalid_country_code", "password": ["too_short", "invalid"]}
+		}`},
+		{"array", Values{FieldsArray: true, Messages: map[string]string{"too_short": "Too short."}}, `{
+			"user": {"id": 99},
+			"error": "validation_error",
+			"fields": [
+				{"field": "country", "code": "invalid_country_code"},
+				{"field": "password", "code": "too_short", "message": "Too short."},
+				{"field": "password", "code": "invalid"}
+			]
+		}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var ev Error
+			ev.SetCode(models.ErrInvalidCountry, http.StatusUnprocessableEntity)
+
+			w := httptest.NewRecorder()
+			err := ev.JSONWith(testContext(&cs.values), w, verr, http.StatusMultiStatus, map[string]interface{}{"user": user})
+			require.NoError(t, err)
+
+			// the status of the field errors does not override the one given.
+			assert.Equal(t, http.StatusMultiStatus, w.Code)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+
+	t.Run("errorID", func(t *testing.T) {
+		var ev Error
+		v := &Values{ErrorIDs: true}
+
+		w := httptest.NewRecorder()
+		require.NoError(t, ev.JSONWith(testContext(v), w, verr, http.StatusMultiStatus, map[string]interface{}{"user": user}))
+
+		var doc map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+		assert.NotEmpty(t, doc["error_id"])
+		assert.Equal(t, v.ErrorID, doc["error_id"])
+	})
+}
+
+func TestError_JSONLimitScope(t *testing.T) {
+	var ev Error
+	ev.SetCode(models.ErrMFALocked, http.StatusTooManyRequests)
+	ev.SetLimitScope(models.ErrMFALocked, LimitScopeUser)
+	ev.SetLimitScope(models.ErrTooManyDeviceCodes, LimitScopeClient)
+	ev.SetLimitScope(models.ErrSlowDown, LimitScopeGrant)
+	ev.SetLimitScope(models.ErrRecoveryLocked, LimitScopeIP)
+
+	var cases = []struct {
+		name    string
+		enabled bool
+		err     error
+		outJSON string
+	}{
+		{"user", true, models.ErrMFALocked, `{"error": "mfa_locked", "limit_scope": "user"}`},
+		{"client", true, models.ErrTooManyDeviceCodes, `{"error": "too_many_device_codes", "limit_scope": "client"}`},
+		{"grant", true, models.ErrSlowDown, `{"error": "slow_down", "limit_scope": "grant"}`},
+		{"ip", true, models.ErrRecoveryLocked, `{"error": "recovery_locked", "limit_scope": "ip"}`},
+		{"disabled", false, models.ErrMFALocked, `{"error": "mfa_locked"}`},
+		{"noScope", true, models.ErrNotFound, `{"error": "not_found"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			err := ev.JSON(testContext(&Values{LimitScopes: cs.enabled}), w, cs.err)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestError_JSONErrorID(t *testing.T) {
+	var ev Error
+
+	ids := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		v := &Values{ErrorIDs: true}
+		w := httptest.NewRecorder()
+		err := ev.JSON(testContext(v), w, models.ErrNotFound)
+		require.NoError(t, err)
+
+		var body map[string]string
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, "not_found", body["error"])
+		assert.Len(t, body["error_id"], 32)
+		assert.Equal(t, v.ErrorID, body["error_id"], "the ID is recorded to be logged")
+
+		ids[body["error_id"]] = true
+	}
+	assert.Len(t, ids, 3, "each error gets its own ID")
+
+	v := &Values{}
+	w := httptest.NewRecorder()
+	err := ev.JSON(testContext(v), w, models.ErrNotFound)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"error": "not_found"}`, w.Body.String())
+	assert.Empty(t, v.ErrorID)
+}
+
+func TestError_JSONOAuth(t *testing.T) {
+	var ev Error
+	ev.SetCode(models.ErrUnauthorised, http.StatusUnauthorized)
+	ev.SetCode(models.ErrMFALocked, http.StatusTooManyRequests)
+	ev.SetOAuthCode(models.ErrUnauthorised, "invalid_grant")
+
+	var cases = []struct {
+		name      string
+		values    Values
+		err       error
+		outStatus int
+		outJSON   string
+	}{
+		{"mapped", Values{}, models.ErrUnauthorised, http.StatusBadRequest,
+			`{"error": "invalid_grant", "error_description": "username, password or refresh token are invalid, user does not exist or validation failed"}`},
+		{"standard", Values{}, models.ErrInvalidClient, http.StatusUnauthorized,
+			`{"error": "invalid_client", "error_description": "client authentication failed"}`},
+		{"nonStandard", Values{}, models.ErrInvalidJSON, http.StatusBadRequest,
+			`{"error": "invalid_request", "error_description": "provided input cannot be parsed"}`},
+		{"rateLimited", Values{}, models.ErrMFALocked, http.StatusTooManyRequests,
+			`{"error": "invalid_request", "error_description": "too many failed multi-factor authentication attempts, try again later"}`},
+		{"validation", Values{}, models.ValidationError{"email": models.ErrRequired}, http.StatusBadRequest,
+			`{"error": "invalid_request"}`},
+		{"unavailable", Values{}, models.ErrServiceUnavailable, http.StatusServiceUnavailable,
+			`{"error": "temporarily_unavailable"}`},
+		{"message", Values{Messages: map[string]string{"invalid_client": "Client inconnu"}}, models.ErrInvalidClient, http.StatusUnauthorized,
+			`{"error": "invalid_client", "error_description": "Client inconnu"}`},
+		{"errorURI", Values{OAuthErrorURI: "https://docs.example.com/errors/"}, models.ErrUnauthorised, http.StatusBadRequest,
+			`{"error": "invalid_grant", "error_description": "username, password or refresh token are invalid, user does not exist or validation failed", "error_uri": "https://docs.example.com/errors/unauthorised"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			v := cs.values
+			v.OAuthErrors = true
+
+			w := httptest.NewRecorder()
+			err := ev.JSON(testContext(&v), w, cs.err)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outStatus, w.Code)
+			assert.JSONEq(t, cs.outJSON, w.Body.String())
+		})
+	}
+}
+
+func TestError_Codes(t *testing.T) {
+	var ev Error
+	assert.Equal(t, []ErrorCode{
+		{"server_error", http.StatusInternalServerError},
+		{"service_unavailable", http.StatusServiceUnavailable},
+		{"validation_error", http.StatusBadRequest},
+	}, ev.Codes())
+
+	ev.SetCode(models.ErrNotFound, http.StatusNotFound)
+	ev.SetCode(models.ErrUnauthorised, http.StatusUnauthorized)
+	ev.SetCode(models.ErrDuplicate, http.StatusConflict)
+	ev.SetCode(models.ErrRequired, http.StatusUnprocessableEntity)
+
+	assert.Equal(t, []ErrorCode{
+		{"is_duplicate", http.StatusConflict},
+		{"not_found", http.StatusNotFound},
+		{"required", http.StatusUnprocessableEntity},
+		{"server_error", http.StatusInternalServerError},
+		{"service_unavailable", http.StatusServiceUnavailable},
+		{"unauthorised", http.StatusUnauthorized},
+		{"validation_error", http.StatusBadRequest},
+	}, ev.Codes())
+}
+
+func TestError_SetCodes(t *testing.T) {
+	codes := map[models.PublicError]int{
+		models.ErrNotFound:     http.StatusNotFound,
+		models.ErrUnauthorised: http.StatusUnauthorized,
+		models.ErrDuplicate:    http.StatusConflict,
+	}
+
+	var bulk, single Error
+	bulk.SetCodes(codes)
+	for err, code := range codes {
+		single.SetCode(err, code)
+	}
+	assert.Equal(t, single.Codes(), bulk.Codes())
+
+	// the codes set in bulk apply to the responses like the ones set one by one.
+	for _, err := range []error{models.ErrNotFound, models.ErrDuplicate, models.ErrRequired, models.ValidationError{"email": models.ErrDuplicate}} {
+		wb, ws := httptest.NewRecorder(), httptest.NewRecorder()
+		require.NoError(t, bulk.JSON(testContext(&Values{}), wb, err))
+		require.NoError(t, single.JSON(testContext(&Values{}), ws, err))
+
+		assert.Equal(t, ws.Code, wb.Code)
+		assert.Equal(t, ws.Body.String(), wb.Body.String())
+	}
+
+	// codes set later replace the ones set before, whichever way they were set.
+	bulk.SetCodes(map[models.PublicError]int{models.ErrNotFound: http.StatusGone})
+	w := httptest.NewRecorder()
+	require.NoError(t, bulk.JSON(testContext(&Values{}), w, models.ErrNotFound))
+	assert.Equal(t, http.StatusGone, w.Code)
+}
@@ -22,3 +22,16 @@ func wrapMiddleware(mw []Middleware, handler Handler) Handler {
 
 	return handler
 }
+
+// Chain composes mw into a single Middleware. Requests run the middlewares in the order they are
+// provided, each of them once, before reaching the wrapped handler; nil middlewares are skipped.
+// Chains can be nested, so common sequences such as authentication followed by authorisation are
+// defined once and reused across routes.
+func Chain(mw ...Middleware) Middleware {
+	// copy the middlewares so later changes to the caller's slice do not alter the chain.
+	mws := append([]Middleware(nil), mw...)
+
+	return func(handler Handler) Handler {
+		return wrapMiddleware(mws, handler)
+	}
+}
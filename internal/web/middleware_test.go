@@ -0,0 +1,87 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMiddleware returns a middleware appending name to calls before running the next handler.
+func testMiddleware(name string, calls *[]string) Middleware {
+	return func(after Handler) Handler {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			*calls = append(*calls, name)
+			return after(ctx, w, r)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var cases = []struct {
+		name     string
+		chain    func(calls *[]string) Middleware
+		outCalls []string
+	}{
+		{
+			"order",
+			func(calls *[]string) Middleware {
+				return Chain(testMiddleware("requestID", calls), testMiddleware("logger", calls), testMiddleware("auth", calls))
+			},
+			[]string{"requestID", "logger", "auth", "handler"},
+		},
+		{
+			"nested",
+			func(calls *[]string) Middleware {
+				auth := Chain(testMiddleware("authenticate", calls), testMiddleware("me", calls))
+				return Chain(testMiddleware("logger", calls), auth, testMiddleware("rateLimit", calls))
+			},
+			[]string{"logger", "authenticate", "me", "rateLimit", "handler"},
+		},
+		{
+			"nilSkipped",
+			func(calls *[]string) Middleware {
+				return Chain(nil, testMiddleware("logger", calls), nil)
+			},
+			[]string{"logger", "handler"},
+		},
+		{
+			"empty",
+			func(calls *[]string) Middleware {
+				return Chain()
+			},
+			[]string{"handler"},
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			var calls []string
+			h := cs.chain(&calls)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				calls = append(calls, "handler")
+				return nil
+			})
+
+			err := h(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.outCalls, calls)
+		})
+	}
+}
+
+func TestChain_SliceCopied(t *testing.T) {
+	var calls []string
+	mws := []Middleware{testMiddleware("first", &calls)}
+	chain := Chain(mws...)
+	mws[0] = testMiddleware("replaced", &calls)
+
+	h := chain(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		return nil
+	})
+	require.NoError(t, h(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)))
+
+	assert.Equal(t, []string{"first"}, calls)
+}
@@ -74,6 +74,11 @@ func Decode(r *http.Request, val interface{}) error {
 	// contains object keys which do not match the destination.
 
 	if err := decoder.Decode(val); err != nil {
+		// errors raised by the body itself, such as a read timeout, are reported as they are.
+		if pe := models.PublicError(nil); errors.As(err, &pe) {
+			return pe
+		}
+
 		if strings.Contains(err.Error(), "json: unknown field") { // Used alongside DisallowUnknownFields to return an idiomatic error
 			uf := strings.Trim(strings.ReplaceAll(err.Error(), "json: unknown field ", ""), "\"") // Gets the unknown field name from the error
 			return models.ValidationError{uf: models.ErrInvalidField}
@@ -3,10 +3,120 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-// Respond converts a Go value to JSON and sends it to the client.
+// StatusClientClosedRequest is the status recorded for the requests whose client disconnected before the
+// response was written. It is never sent, there is no one left to receive it.
+const StatusClientClosedRequest = 499
+
+// contentTypeJSON is the content type of the responses when the client accepts no other registered type.
+const contentTypeJSON = "application/json"
+
+// An Encoder serialises the values sent to clients by Respond.
+type Encoder func(v interface{}) ([]byte, error)
+
+// encoders holds the registered encoders, by content type.
+var encoders = struct {
+	sync.RWMutex
+	m map[string]Encoder
+}{
+	m: map[string]Encoder{contentTypeJSON: json.Marshal},
+}
+
+// RegisterEncoder makes Respond use enc for the clients accepting contentType, such as
+// "application/cbor". Registering an encoder for a content type already registered replaces it,
+// including the default JSON encoder. It is meant to be called during initialisation.
+func RegisterEncoder(contentType string, enc Encoder) {
+	encoders.Lock()
+	defer encoders.Unlock()
+
+	encoders.m[contentType] = enc
+}
+
+// encoderFor returns the registered encoder preferred by the accept header, along with its content type.
+// JSON is used when none of the accepted types has an encoder.
+func encoderFor(accept string) (string, Encoder) {
+	encoders.RLock()
+	defer encoders.RUnlock()
+
+	type accepted struct {
+		contentType string
+		q           float64
+	}
+
+	var types []accepted
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		if _, ok := encoders.m[mt]; ok && q > 0 {
+			types = append(types, accepted{mt, q})
+		}
+	}
+
+	// the most preferred type wins, the first one listed among equally preferred ones.
+	sort.SliceStable(types, func(i, j int) bool {
+		return types[i].q > types[j].q
+	})
+
+	if len(types) > 0 {
+		return types[0].contentType, encoders.m[types[0].contentType]
+	}
+
+	return contentTypeJSON, encoders.m[contentTypeJSON]
+}
+
+// An envelope holds the payload of a response along with its metadata, as sent in envelope mode.
+type envelope struct {
+	Data interface{} `json:"data"`
+	Meta Meta        `json:"meta"`
+}
+
+// Meta is the metadata of the responses sent in envelope mode.
+type Meta struct {
+	RequestID string `json:"request_id"`
+
+	// DurationMS is the time taken to handle the request until the response was sent, in milliseconds.
+	DurationMS int64 `json:"duration_ms"`
+
+	Pagination *Pagination `json:"pagination,omitempty"`
+}
+
+// Pagination describes a page of a paginated listing.
+type Pagination struct {
+	// NextCursor is the cursor of the following page, empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+	Limit      int    `json:"limit,omitempty"`
+}
+
+// SetPagination attaches p to the metadata of the response to the request of ctx. It has no effect
+// unless the App runs in envelope mode.
+func SetPagination(ctx context.Context, p Pagination) {
+	if v, ok := ctx.Value(KeyValues).(*Values); ok {
+		v.Pagination = &p
+	}
+}
+
+// Respond converts a Go value to the format accepted by the client and sends it. Values are sent as
+// JSON unless the client accepts a content type with an encoder registered through RegisterEncoder.
 func Respond(ctx context.Context, w http.ResponseWriter, data interface{}, statusCode int) error {
 	// Set the status code for the request logger middleware.
 	// If the context is missing this value, request the service
@@ -22,18 +132,71 @@ func Respond(ctx context.Context, w http.ResponseWriter, data interface{}, statu
 		return nil
 	}
 
-	// Convert the response value to JSON.
-	res, err := json.Marshal(data)
+	// Nest successful payloads in the envelope, if enabled. Errors keep their format, so clients handle
+	// them the same way in both modes.
+	if v.Envelope && statusCode < http.StatusBadRequest {
+		data = envelope{
+			Data: data,
+			Meta: Meta{
+				RequestID:  v.TraceID,
+				DurationMS: time.Since(v.Start).Milliseconds(),
+				Pagination: v.Pagination,
+			},
+		}
+	}
+
+	// Convert the response value to the accepted format.
+	contentType, encode := encoderFor(v.Accept)
+	res, err := encode(data)
 	if err != nil {
 		return err
 	}
 
-	// Respond with the provided JSON.
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if contentType == contentTypeJSON {
+		contentType += jsonCharset(v.JSONCharset)
+	}
+
+	// Respond with the encoded value.
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(statusCode)
 	if _, err := w.Write(res); err != nil {
+		if disconnected(ctx, err) {
+			v.StatusCode = StatusClientClosedRequest
+			return &clientGone{err}
+		}
+
 		return err
 	}
 
 	return nil
 }
+
+// disconnected reports whether the write error err was caused by the client of the request of ctx
+// disconnecting: the connection was closed or reset by the client, or the request was canceled.
+func disconnected(ctx context.Context, err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(ctx.Err(), context.Canceled)
+}
+
+// jsonCharset returns the parameter appended to the JSON content type for the configured charset.
+func jsonCharset(charset string) string {
+	switch charset {
+	case "":
+		return "; charset=utf-8"
+	case "-":
+		return ""
+	}
+
+	return "; charset=" + charset
+}
+
+// Redirect replies to the request with a redirect to url, which must be validated by the caller.
+func Redirect(ctx context.Context, w http.ResponseWriter, r *http.Request, url string, statusCode int) error {
+	v, ok := ctx.Value(KeyValues).(*Values)
+	if !ok {
+		return NewShutdownError("web value missing from context")
+	}
+	v.StatusCode = statusCode
+
+	http.Redirect(w, r, url, statusCode)
+	return nil
+}
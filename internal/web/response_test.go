@@ -0,0 +1,232 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/noelruault/golang-authentication/internal/models"
+)
+
+// testEncoder formats values with the %v verb, standing in for a binary format such as CBOR.
+func testEncoder(v interface{}) ([]byte, error) {
+	return []byte(fmt.Sprintf("%v", v)), nil
+}
+
+func TestRespond_Encoders(t *testing.T) {
+	RegisterEncoder("application/x-test", testEncoder)
+	defer func() {
+		encoders.Lock()
+		delete(encoders.m, "application/x-test")
+		encoders.Unlock()
+	}()
+
+	data := map[string]string{"status": "ok"}
+
+	var cases = []struct {
+		name           string
+		accept         string
+		outContentType string
+		outBody        string
+	}{
+		{"noAccept", "", "application/json; charset=utf-8", `{"status":"ok"}`},
+		{"any", "*/*", "application/json; charset=utf-8", `{"status":"ok"}`},
+		{"unknown", "application/xml", "application/json; charset=utf-8", `{"status":"ok"}`},
+		{"json", "application/json", "application/json; charset=utf-8", `{"status":"ok"}`},
+		{"custom", "application/x-test", "application/x-test", "map[status:ok]"},
+		{"customFirst", "application/x-test, application/json", "application/x-test", "map[status:ok]"},
+		{"jsonFirst", "application/json, application/x-test", "application/json; charset=utf-8", `{"status":"ok"}`},
+		{"customPreferred", "application/json;q=0.5, application/x-test;q=0.9", "application/x-test", "map[status:ok]"},
+		{"customRefused", "application/x-test;q=0", "application/json; charset=utf-8", `{"status":"ok"}`},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			err := Respond(testContext(&Values{Accept: cs.accept}), w, data, http.StatusOK)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, cs.outContentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, cs.outBody, w.Body.String())
+		})
+	}
+}
+
+func TestRespond_EncoderError(t *testing.T) {
+	RegisterEncoder("application/x-failing", func(v interface{}) ([]byte, error) {
+		return nil, fmt.Errorf("cannot encode %T", v)
+	})
+	defer func() {
+		encoders.Lock()
+		delete(encoders.m, "application/x-failing")
+		encoders.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	err := Respond(testContext(&Values{Accept: "application/x-failing"}), w, "value", http.StatusOK)
+	assert.EqualError(t, err, "cannot encode string")
+}
+
+func TestRespond_JSONCharset(t *testing.T) {
+	var cases = []struct {
+		name           string
+		charset        string
+		outContentType string
+	}{
+		{"default", "", "application/json; charset=utf-8"},
+		{"custom", "UTF-8", "application/json; charset=UTF-8"},
+		{"omitted", "-", "application/json"},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			err := Respond(testContext(&Values{JSONCharset: cs.charset}), w, map[string]string{"status": "ok"}, http.StatusOK)
+			require.NoError(t, err)
+			assert.Equal(t, cs.outContentType, w.Header().Get("Content-Type"))
+
+			// error responses carry the same content type.
+			var ev Error
+			w = httptest.NewRecorder()
+			err = ev.JSON(testContext(&Values{JSONCharset: cs.charset}), w, models.ErrNotFound)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Equal(t, cs.outContentType, w.Header().Get("Content-Type"))
+
+			// so do envelopes, and responses without a body have none.
+			w = httptest.NewRecorder()
+			err = Respond(testContext(&Values{JSONCharset: cs.charset, Envelope: true}), w, "ok", http.StatusCreated)
+			require.NoError(t, err)
+			assert.Equal(t, cs.outContentType, w.Header().Get("Content-Type"))
+
+			w = httptest.NewRecorder()
+			err = Respond(testContext(&Values{JSONCharset: cs.charset}), w, nil, http.StatusNoContent)
+			require.NoError(t, err)
+			assert.Empty(t, w.Header().Get("Content-Type"))
+		})
+	}
+}
+
+// failingWriter is a ResponseWriter whose writes fail with err, such as a closed connection.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+func TestRespond_ClientGone(t *testing.T) {
+	closed := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", errno)}
+	}
+
+	var cases = []struct {
+		name      string
+		err       error
+		cancel    bool
+		outGone   bool
+		outStatus int
+	}{
+		{"brokenPipe", closed(syscall.EPIPE), false, true, StatusClientClosedRequest},
+		{"connectionReset", closed(syscall.ECONNRESET), false, true, StatusClientClosedRequest},
+		{"canceled", errors.New("write failed"), true, true, StatusClientClosedRequest},
+		{"otherError", errors.New("write failed"), false, false, http.StatusOK},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			v := &Values{}
+			ctx, cancel := context.WithCancel(testContext(v))
+			defer cancel()
+			if cs.cancel {
+				cancel()
+			}
+
+			w := failingWriter{httptest.NewRecorder(), cs.err}
+			err := Respond(ctx, w, map[string]string{"status": "ok"}, http.StatusOK)
+			require.Error(t, err)
+
+			assert.Equal(t, cs.outGone, IsClientGone(err))
+			assert.Equal(t, cs.outStatus, v.StatusCode)
+			assert.True(t, errors.Is(err, cs.err), "the write error is kept")
+		})
+	}
+}
+
+func TestRespond_Envelope(t *testing.T) {
+	data := map[string]string{"status": "ok"}
+
+	var cases = []struct {
+		name       string
+		envelope   bool
+		pagination *Pagination
+		status     int
+		outBody    string
+	}{
+		{
+			"disabled",
+			false,
+			nil,
+			http.StatusOK,
+			`{"status":"ok"}`,
+		},
+		{
+			"enabled",
+			true,
+			nil,
+			http.StatusOK,
+			`{"data":{"status":"ok"},"meta":{"request_id":"trace-id"}}`,
+		},
+		{
+			"paginated",
+			true,
+			&Pagination{NextCursor: "next", Limit: 20},
+			http.StatusOK,
+			`{"data":{"status":"ok"},"meta":{"request_id":"trace-id","pagination":{"next_cursor":"next","limit":20}}}`,
+		},
+		{
+			"errorNotWrapped",
+			true,
+			nil,
+			http.StatusBadRequest,
+			`{"status":"ok"}`,
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			ctx := testContext(&Values{TraceID: "trace-id", Start: time.Now(), Envelope: cs.envelope})
+			if cs.pagination != nil {
+				SetPagination(ctx, *cs.pagination)
+			}
+
+			w := httptest.NewRecorder()
+			err := Respond(ctx, w, data, cs.status)
+			require.NoError(t, err)
+
+			assert.Equal(t, cs.status, w.Code)
+
+			// the duration depends on the machine running the test, so it is only checked to be set.
+			var got map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			if meta, ok := got["meta"].(map[string]interface{}); ok {
+				assert.Contains(t, meta, "duration_ms")
+				delete(meta, "duration_ms")
+			}
+
+			body, err := json.Marshal(got)
+			require.NoError(t, err)
+			assert.JSONEq(t, cs.outBody, string(body))
+		})
+	}
+}
@@ -3,8 +3,11 @@ package web
 import (
 	"context"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -12,6 +15,8 @@ import (
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
 	"go.opencensus.io/trace"
+
+	"github.com/noelruault/golang-authentication/internal/models"
 )
 
 // ctxKey represents the type of value for the context key.
@@ -25,6 +30,89 @@ type Values struct {
 	TraceID    string
 	StatusCode int
 	Start      time.Time
+
+	// DevMode is copied from the App configuration so views can include development aids.
+	DevMode bool
+
+	// Accept is the Accept header of the request, used to choose the format of the responses.
+	Accept string
+
+	// JSONCharset is copied from the App configuration to be sent with the JSON responses.
+	JSONCharset string
+
+	// FieldsArray is copied from the App configuration so views send the fields of the validation
+	// errors as an array.
+	FieldsArray bool
+
+	// LimitScopes is copied from the App configuration so views tell which limit the rate limiting
+	// errors are returned for.
+	LimitScopes bool
+
+	// ErrorIDs is copied from the App configuration so views identify each error response. ErrorID is
+	// set by the view to the ID of the error responded, so the middlewares can log it.
+	ErrorIDs bool
+	ErrorID  string
+
+	// OAuthErrors is set by the routes responding errors in the OAuth 2.0 format, along with the
+	// OAuthErrorURI their "error_uri" starts with.
+	OAuthErrors   bool
+	OAuthErrorURI string
+
+	// Envelope is copied from the App configuration. Pagination is set by the handlers of paginated
+	// listings through SetPagination, and included in the envelope.
+	Envelope   bool
+	Pagination *Pagination
+
+	// NextActions is copied from the App configuration so views can hint clients what to do next.
+	NextActions map[string]string
+
+	// Messages are the messages of the public error codes configured for the language accepted by the
+	// client, nil when none is.
+	Messages map[string]string
+}
+
+// Config holds the settings used to tune how the App serves requests.
+type Config struct {
+	// DevMode includes development aids, such as error cause chains, in the responses. It must be
+	// disabled in production.
+	DevMode bool
+
+	// Envelope nests the payloads of successful responses under "data", along with a "meta" object
+	// holding the request ID, the time taken and the pagination. Error responses are not affected.
+	Envelope bool
+
+	// NextActions maps public error codes to a machine-readable hint of what clients should do next,
+	// such as "mfa_required" to "submit_mfa". The hint is sent as the "next_action" field of the error
+	// responses with those codes.
+	NextActions map[string]string
+
+	// Messages holds the human-readable messages of the public error codes, by language and code, such as
+	// "fr" to "required" to "Ce champ est obligatoire". The language is chosen from the Accept-Language
+	// header of the request, and the messages are sent as the "message" and "field_messages" fields of
+	// the error responses.
+	Messages map[string]map[string]string
+
+	// JSONCharset is the charset parameter of the Content-Type header of the JSON responses, successful
+	// and error ones alike. Empty sends utf-8, and "-" sends no charset at all.
+	JSONCharset string
+
+	// FieldsArray sends the "fields" of the validation errors as an array of {"field", "code"} objects,
+	// ordered by field, instead of an object mapping the fields to their code.
+	FieldsArray bool
+
+	// LimitScopes includes the scope of the limit hit, such as "ip" or "user", as the "limit_scope" field
+	// of the rate limiting error responses. It helps diagnosing throttling but tells clients how the
+	// service counts their requests, so it is disabled by default.
+	LimitScopes bool
+
+	// ErrorIDs includes a random ID, unique to each error returned, as the "error_id" field of the error
+	// responses. The ID is logged along with the request, so the reports of clients can be matched with
+	// the logs even when they cannot tell the request ID.
+	ErrorIDs bool
+
+	// DrainRetryAfter is sent as the `Retry-After` header of the requests rejected while the App drains
+	// before shutting down, rounded up to the second. Zero sends no header.
+	DrainRetryAfter time.Duration
 }
 
 // Handler is the signature used by all application handlers in this service.
@@ -38,16 +126,21 @@ type App struct {
 	mw       []Middleware
 	och      *ochttp.Handler
 	shutdown chan os.Signal
+	cfg      Config
+
+	// draining is set to 1 once the App drains, turning away the requests it receives.
+	draining int32
 }
 
 // NewApp constructs an App to handle a set of routes. Any Middleware provided
 // will be ran for every request.
-func NewApp(shutdown chan os.Signal, log *log.Logger, mux *chi.Mux, mw ...Middleware) *App {
+func NewApp(shutdown chan os.Signal, log *log.Logger, mux *chi.Mux, cfg Config, mw ...Middleware) *App {
 	app := App{
 		log:      log,
 		mux:      mux,
 		mw:       mw,
 		shutdown: shutdown,
+		cfg:      cfg,
 	}
 
 	// Create an OpenCensus HTTP Handler which wraps the router. This will start
@@ -85,11 +178,26 @@ func (a *App) Handle(method, url string, h Handler, mw ...Middleware) {
 		// Create a Values struct to record state for the request. Store the
 		// address in the request's context so it is sent down the call chain.
 		v := Values{
-			TraceID: span.SpanContext().TraceID.String(),
-			Start:   time.Now(),
+			TraceID:     span.SpanContext().TraceID.String(),
+			Start:       time.Now(),
+			DevMode:     a.cfg.DevMode,
+			Accept:      r.Header.Get("Accept"),
+			JSONCharset: a.cfg.JSONCharset,
+			FieldsArray: a.cfg.FieldsArray,
+			LimitScopes: a.cfg.LimitScopes,
+			ErrorIDs:    a.cfg.ErrorIDs,
+			Envelope:    a.cfg.Envelope,
+			NextActions: a.cfg.NextActions,
+			Messages:    a.cfg.Messages[languageFor(r.Header.Get("Accept-Language"), a.cfg.Messages)],
 		}
 		ctx = context.WithValue(ctx, KeyValues, &v)
 
+		// While draining, the requests are turned away before reaching the handlers.
+		if a.Draining() {
+			a.rejectDraining(ctx, w)
+			return
+		}
+
 		// Run the handler chain and catch any propagated error.
 		if err := h(ctx, w, r); err != nil {
 			a.log.Printf("%s : unhandled error: %+v", v.TraceID, err)
@@ -103,12 +211,36 @@ func (a *App) Handle(method, url string, h Handler, mw ...Middleware) {
 }
 
 // SignalShutdown is used to gracefully shutdown the app when an integrity
-// issue is identified.
+// issue is identified. The app drains until it is shut down.
 func (a *App) SignalShutdown() {
 	a.log.Println("error returned from handler indicated integrity issue, shutting down service")
+	a.Drain()
 	a.shutdown <- syscall.SIGSTOP
 }
 
+// Drain makes the App respond the requests it receives from now on with a service_unavailable error,
+// asking clients to close the connection, while the requests in flight complete. Clients can then retry
+// against another instance while this one shuts down, instead of having their connection dropped.
+func (a *App) Drain() {
+	atomic.StoreInt32(&a.draining, 1)
+}
+
+// Draining reports whether the App drains.
+func (a *App) Draining() bool {
+	return atomic.LoadInt32(&a.draining) == 1
+}
+
+// rejectDraining responds a request received while draining with a service_unavailable error.
+func (a *App) rejectDraining(ctx context.Context, w http.ResponseWriter) {
+	if a.cfg.DrainRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(a.cfg.DrainRetryAfter.Seconds()))))
+	}
+	w.Header().Set("Connection", "close")
+
+	var ev Error
+	ev.JSON(ctx, w, models.ErrServiceUnavailable)
+}
+
 // ServeHTTP implements the http.Handler interface.
 func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.och.ServeHTTP(w, r)
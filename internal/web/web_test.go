@@ -0,0 +1,89 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApp_Drain(t *testing.T) {
+	shutdown := make(chan os.Signal, 1)
+	app := NewApp(shutdown, log.New(ioutil.Discard, "", 0), chi.NewRouter(), Config{DrainRetryAfter: 2500 * time.Millisecond})
+
+	// the slow handler waits until released, so the app starts draining while it is in flight.
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	app.Handle(http.MethodGet, "/users/", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		return Respond(ctx, w, map[string]string{"status": "ok"}, http.StatusOK)
+	})
+	app.Handle(http.MethodGet, "/slow/", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		close(entered)
+		<-release
+		return Respond(ctx, w, map[string]string{"status": "ok"}, http.StatusOK)
+	})
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	w := serve(http.MethodGet, "/users/")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, app.Draining())
+
+	inFlight := make(chan *httptest.ResponseRecorder)
+	go func() { inFlight <- serve(http.MethodGet, "/slow/") }()
+	<-entered
+
+	app.Drain()
+	assert.True(t, app.Draining())
+
+	t.Run("newRequest", func(t *testing.T) {
+		w := serve(http.MethodGet, "/users/")
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.JSONEq(t, `{"error": "service_unavailable"}`, w.Body.String())
+		assert.Equal(t, "3", w.Header().Get("Retry-After"))
+		assert.Equal(t, "close", w.Header().Get("Connection"))
+	})
+
+	t.Run("inFlight", func(t *testing.T) {
+		close(release)
+		w := <-inFlight
+
+		assert.Equal(t, http.StatusOK, w.Code, "the requests in flight complete")
+		assert.JSONEq(t, `{"status": "ok"}`, w.Body.String())
+	})
+
+	t.Run("signalShutdown", func(t *testing.T) {
+		app := NewApp(shutdown, log.New(ioutil.Discard, "", 0), chi.NewRouter(), Config{})
+		app.Handle(http.MethodPost, "/broken/", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			return NewShutdownError("integrity issue")
+		})
+		app.Handle(http.MethodGet, "/users/", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			return Respond(ctx, w, map[string]string{"status": "ok"}, http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/broken/", nil))
+		assert.Equal(t, syscall.SIGSTOP, <-shutdown)
+
+		// the app drains until it is shut down.
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.JSONEq(t, `{"error": "service_unavailable"}`, w.Body.String())
+		assert.Empty(t, w.Header().Get("Retry-After"))
+	})
+}